@@ -0,0 +1,203 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package authz decides whether to allow an HTTP request that arrives at a workload, using the
+// policy that Felix sends to the workload over the policy sync API.  It's intended for an agent
+// that runs in the workload's pod and answers authorization checks from a proxy; Felix's
+// iptables rules still enforce the L3/L4 parts of the policy.
+//
+// The ingress policy of the workload's endpoint is evaluated in the same way as Felix's
+// endpoint chains: the policies in the first tier (the endpoint manager only renders one
+// tier), then the endpoint's profiles.  Only the parts of each rule that make sense for an HTTP
+// request are evaluated:
+//
+//   - the HTTP match against the request's method
+//   - the source service account match against the peer's service account
+//   - the original source selectors against the peer's labels and namespace
+//   - the source CIDRs and IP sets against the peer's address, if it's known
+//   - the destination CIDRs and IP sets against the workload's address, if it's known
+//   - the protocol and destination ports against TCP and the request's port.
+//
+// The IP sets, which include the network sets, are evaluated using the members that Felix
+// sends over the policy sync API.  A rule that needs an address that isn't known doesn't
+// match.  Rules that match ICMP never match a request.
+package authz
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/policysync/client"
+	"github.com/projectcalico/felix/proto"
+)
+
+// Request describes an HTTP request to authorize.
+type Request struct {
+	// SourceIP is the peer's address, or nil if it isn't known.
+	SourceIP net.IP
+	// DestinationIP is the workload's address that the request arrived on.  If it's nil, the
+	// endpoint's address is used, as long as it has exactly one of the right IP version.
+	DestinationIP        net.IP
+	SourceNamespace      string
+	SourceServiceAccount string
+	SourceLabels         map[string]string
+
+	Method          string
+	DestinationPort uint16
+	// EndpointID is the endpoint that the request arrived on, for example, "eth0".  It may be
+	// empty if the workload only has one endpoint.
+	EndpointID string
+}
+
+// Decision is the outcome of evaluating a request.  Reason explains which rule (or default)
+// the decision came from.
+type Decision struct {
+	Allowed bool
+	Reason  string
+}
+
+// Evaluate decides whether the snapshot's policy allows the request.
+func Evaluate(snap *client.Snapshot, req *Request) Decision {
+	var ep *proto.WorkloadEndpoint
+	for id, candidate := range snap.Endpoints {
+		if req.EndpointID == "" {
+			if len(snap.Endpoints) > 1 {
+				return deny("request doesn't say which of the workload's endpoints it arrived on")
+			}
+			ep = candidate
+		} else if id.EndpointId == req.EndpointID {
+			ep = candidate
+		}
+	}
+	if ep == nil {
+		return deny("workload endpoint is not known")
+	}
+	e := evaluator{snap: snap, req: req, dstIP: req.DestinationIP}
+	if e.dstIP == nil {
+		e.dstIP = endpointAddress(ep, req.SourceIP)
+	}
+	return e.evaluateEndpoint(ep)
+}
+
+type evaluator struct {
+	snap  *client.Snapshot
+	req   *Request
+	dstIP net.IP
+}
+
+// endpointAddress returns the endpoint's address if it has exactly one of the same IP version
+// as the peer (or exactly one in total, if the peer's address isn't known).  Otherwise, returns
+// nil.
+func endpointAddress(ep *proto.WorkloadEndpoint, srcIP net.IP) net.IP {
+	var cidrs []string
+	switch {
+	case srcIP == nil:
+		cidrs = append(append(cidrs, ep.Ipv4Nets...), ep.Ipv6Nets...)
+	case ipVersion(srcIP) == 4:
+		cidrs = ep.Ipv4Nets
+	default:
+		cidrs = ep.Ipv6Nets
+	}
+	if len(cidrs) != 1 {
+		return nil
+	}
+	addr, _, err := net.ParseCIDR(withPrefixLen(cidrs[0]))
+	if err != nil {
+		log.WithError(err).WithField("cidr", cidrs[0]).Warn("Ignoring bad endpoint address")
+		return nil
+	}
+	return addr
+}
+
+func allow(reason string, args ...interface{}) Decision {
+	return Decision{Allowed: true, Reason: fmt.Sprintf(reason, args...)}
+}
+
+func deny(reason string, args ...interface{}) Decision {
+	return Decision{Allowed: false, Reason: fmt.Sprintf(reason, args...)}
+}
+
+func (e *evaluator) evaluateEndpoint(ep *proto.WorkloadEndpoint) Decision {
+	// Like the endpoint manager, we only render the first tier.
+	if len(ep.Tiers) > 0 && len(ep.Tiers[0].IngressPolicies) > 0 {
+		tier := ep.Tiers[0]
+		passed := false
+		for _, polName := range tier.IngressPolicies {
+			polID := proto.PolicyID{Tier: tier.Name, Name: polName}
+			policy := e.snap.Policies[polID]
+			if policy == nil {
+				log.WithField("policy", polID).Warn("Endpoint references unknown policy, skipping")
+				continue
+			}
+			idx, action := e.evaluateRules(policy.InboundRules, policy.Namespace)
+			switch action {
+			case "allow":
+				return allow("tier %q policy %q rule %d allows request", tier.Name, polName, idx)
+			case "deny":
+				return deny("tier %q policy %q rule %d denies request", tier.Name, polName, idx)
+			case "pass":
+				passed = true
+			}
+			if passed {
+				break
+			}
+		}
+		if !passed {
+			return deny("no policies in tier %q allowed request", tier.Name)
+		}
+	}
+
+	for _, profName := range ep.ProfileIds {
+		profile := e.snap.Profiles[proto.ProfileID{Name: profName}]
+		if profile == nil {
+			log.WithField("profile", profName).Warn("Endpoint references unknown profile, skipping")
+			continue
+		}
+		idx, action := e.evaluateRules(profile.InboundRules, "")
+		switch action {
+		case "allow":
+			return allow("profile %q rule %d allows request", profName, idx)
+		case "deny":
+			return deny("profile %q rule %d denies request", profName, idx)
+		}
+	}
+	return deny("no profiles allowed request")
+}
+
+// evaluateRules evaluates the rules in order and returns the index and normalised action of the
+// first terminating rule that matches: "allow", "deny" or "pass".  Returns "" if no terminating
+// rule matched.  namespace is the namespace of the policy that the rules belong to, or "" for
+// global policies and profiles.
+func (e *evaluator) evaluateRules(rules []*proto.Rule, namespace string) (int, string) {
+	for i, rule := range rules {
+		if !e.ruleMatches(rule, namespace) {
+			continue
+		}
+		switch rule.Action {
+		case "", "allow":
+			return i, "allow"
+		case "next-tier", "pass":
+			return i, "pass"
+		case "deny":
+			return i, "deny"
+		case "log":
+			continue
+		default:
+			log.WithField("action", rule.Action).Warn("Unknown rule action, skipping rule")
+		}
+	}
+	return -1, ""
+}
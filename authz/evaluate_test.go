@@ -0,0 +1,298 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"net"
+
+	. "github.com/projectcalico/felix/authz"
+	"github.com/projectcalico/felix/policysync/client"
+	"github.com/projectcalico/felix/proto"
+)
+
+var wepID = proto.WorkloadEndpointID{
+	OrchestratorId: "k8s",
+	WorkloadId:     "default/pod-a",
+	EndpointId:     "eth0",
+}
+
+func newSnapshot() *client.Snapshot {
+	return &client.Snapshot{
+		Endpoints: map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint{
+			wepID: {
+				State:      "active",
+				ProfileIds: []string{"prof-1"},
+				Ipv4Nets:   []string{"10.0.2.1/32"},
+				Tiers: []*proto.TierInfo{{
+					Name:            "default",
+					IngressPolicies: []string{"pol-1"},
+				}},
+			},
+		},
+		Policies: map[proto.PolicyID]*proto.Policy{},
+		Profiles: map[proto.ProfileID]*proto.Profile{
+			{Name: "prof-1"}: {},
+		},
+		IPSets: map[string]*client.IPSet{
+			"s-frontends": {Type: proto.IPSetUpdate_IP, Members: []string{"10.0.1.1/32", "10.0.1.2/32"}},
+			"s-backends":  {Type: proto.IPSetUpdate_IP, Members: []string{"10.0.3.1/32"}},
+			"s-netset":    {Type: proto.IPSetUpdate_NET, Members: []string{"10.0.0.0/16"}},
+			"s-local":     {Type: proto.IPSetUpdate_IP, Members: []string{"10.0.2.1/32"}},
+			"s-http":      {Type: proto.IPSetUpdate_IP_AND_PORT, Members: []string{"10.0.2.1,tcp:8080", "10.0.2.2,tcp:8080"}},
+			"s-metrics":   {Type: proto.IPSetUpdate_IP_AND_PORT, Members: []string{"10.0.2.1,tcp:9090"}},
+		},
+		ServiceAccounts: map[proto.ServiceAccountID]*proto.ServiceAccountUpdate{
+			{Namespace: "default", Name: "frontend"}: {
+				Id:     &proto.ServiceAccountID{Namespace: "default", Name: "frontend"},
+				Labels: map[string]string{"role": "web"},
+			},
+		},
+		Namespaces: map[proto.NamespaceID]*proto.NamespaceUpdate{
+			{Name: "default"}: {
+				Id:     &proto.NamespaceID{Name: "default"},
+				Labels: map[string]string{"env": "prod"},
+			},
+			{Name: "other"}: {
+				Id:     &proto.NamespaceID{Name: "other"},
+				Labels: map[string]string{"env": "dev"},
+			},
+		},
+	}
+}
+
+func request() *Request {
+	return &Request{
+		SourceIP:             net.ParseIP("10.0.1.1"),
+		SourceNamespace:      "default",
+		SourceServiceAccount: "frontend",
+		SourceLabels:         map[string]string{"app": "frontend"},
+		Method:               "GET",
+		DestinationPort:      8080,
+	}
+}
+
+var _ = Describe("HTTP authorization", func() {
+	var snap *client.Snapshot
+
+	BeforeEach(func() {
+		snap = newSnapshot()
+	})
+
+	setPolicy := func(namespace string, rules ...*proto.Rule) {
+		snap.Policies[proto.PolicyID{Tier: "default", Name: "pol-1"}] = &proto.Policy{
+			Namespace:    namespace,
+			InboundRules: rules,
+		}
+	}
+
+	It("should deny if the endpoint is not known", func() {
+		delete(snap.Endpoints, wepID)
+		Expect(Evaluate(snap, request()).Allowed).To(BeFalse())
+	})
+
+	Describe("with two endpoints", func() {
+		BeforeEach(func() {
+			setPolicy("", &proto.Rule{Action: "allow"})
+			eth1ID := wepID
+			eth1ID.EndpointId = "eth1"
+			snap.Endpoints[eth1ID] = &proto.WorkloadEndpoint{State: "active"}
+		})
+
+		It("should deny if the request doesn't say which endpoint it arrived on", func() {
+			Expect(Evaluate(snap, request()).Allowed).To(BeFalse())
+		})
+
+		It("should evaluate the policy of the requested endpoint", func() {
+			req := request()
+			req.EndpointID = "eth0"
+			Expect(Evaluate(snap, req).Allowed).To(BeTrue())
+			req.EndpointID = "eth1"
+			Expect(Evaluate(snap, req).Allowed).To(BeFalse())
+		})
+	})
+
+	It("should deny at the end of the tier if no policy matches", func() {
+		setPolicy("", &proto.Rule{Action: "allow", HttpMatch: &proto.HTTPMatch{Methods: []string{"POST"}}})
+		decision := Evaluate(snap, request())
+		Expect(decision.Allowed).To(BeFalse())
+		Expect(decision.Reason).To(ContainSubstring(`tier "default"`))
+	})
+
+	It("should fall through to the profile on pass", func() {
+		setPolicy("", &proto.Rule{Action: "pass"})
+		snap.Profiles[proto.ProfileID{Name: "prof-1"}] = &proto.Profile{
+			InboundRules: []*proto.Rule{{Action: "allow"}},
+		}
+		decision := Evaluate(snap, request())
+		Expect(decision.Allowed).To(BeTrue())
+		Expect(decision.Reason).To(ContainSubstring(`profile "prof-1"`))
+	})
+
+	It("should only evaluate the first tier, like the dataplane", func() {
+		ep := snap.Endpoints[wepID]
+		ep.Tiers = append(ep.Tiers, &proto.TierInfo{
+			Name:            "second",
+			IngressPolicies: []string{"pol-2"},
+		})
+		setPolicy("", &proto.Rule{Action: "pass"})
+		snap.Policies[proto.PolicyID{Tier: "second", Name: "pol-2"}] = &proto.Policy{
+			InboundRules: []*proto.Rule{{Action: "deny"}},
+		}
+		snap.Profiles[proto.ProfileID{Name: "prof-1"}] = &proto.Profile{
+			InboundRules: []*proto.Rule{{Action: "allow"}},
+		}
+		decision := Evaluate(snap, request())
+		Expect(decision.Allowed).To(BeTrue())
+		Expect(decision.Reason).To(ContainSubstring(`profile "prof-1"`))
+	})
+
+	It("should deny if no profile matches", func() {
+		snap.Endpoints[wepID].Tiers = nil
+		Expect(Evaluate(snap, request()).Allowed).To(BeFalse())
+	})
+
+	DescribeTable("rule matching",
+		func(namespace string, rule *proto.Rule, expectAllowed bool) {
+			setPolicy(namespace, rule)
+			Expect(Evaluate(snap, request()).Allowed).To(Equal(expectAllowed))
+		},
+		Entry("match-all rule", "", &proto.Rule{Action: "allow"}, true),
+		Entry("matching method", "",
+			&proto.Rule{Action: "allow", HttpMatch: &proto.HTTPMatch{Methods: []string{"PUT", "GET"}}}, true),
+		Entry("non-matching method", "",
+			&proto.Rule{Action: "allow", HttpMatch: &proto.HTTPMatch{Methods: []string{"PUT"}}}, false),
+		Entry("matching service account name", "",
+			&proto.Rule{Action: "allow", SrcServiceAccountMatch: &proto.ServiceAccountMatch{Names: []string{"frontend"}}}, true),
+		Entry("non-matching service account name", "",
+			&proto.Rule{Action: "allow", SrcServiceAccountMatch: &proto.ServiceAccountMatch{Names: []string{"backend"}}}, false),
+		Entry("matching service account selector", "",
+			&proto.Rule{Action: "allow", SrcServiceAccountMatch: &proto.ServiceAccountMatch{Selector: "role == 'web'"}}, true),
+		Entry("non-matching service account selector", "",
+			&proto.Rule{Action: "allow", SrcServiceAccountMatch: &proto.ServiceAccountMatch{Selector: "role == 'db'"}}, false),
+		Entry("matching source selector", "",
+			&proto.Rule{Action: "allow", OriginalSrcSelector: "app == 'frontend'"}, true),
+		Entry("non-matching source selector", "",
+			&proto.Rule{Action: "allow", OriginalSrcSelector: "app == 'backend'"}, false),
+		Entry("matching negated source selector", "",
+			&proto.Rule{Action: "allow", OriginalNotSrcSelector: "app == 'frontend'"}, false),
+		Entry("bad selector", "",
+			&proto.Rule{Action: "allow", OriginalSrcSelector: "app == "}, false),
+		Entry("matching namespace selector", "",
+			&proto.Rule{Action: "allow", OriginalSrcNamespaceSelector: "env == 'prod'"}, true),
+		Entry("non-matching namespace selector", "",
+			&proto.Rule{Action: "allow", OriginalSrcNamespaceSelector: "env == 'dev'"}, false),
+		Entry("namespaced policy, selector, same namespace", "default",
+			&proto.Rule{Action: "allow", OriginalSrcSelector: "app == 'frontend'"}, true),
+		Entry("namespaced policy, selector, other namespace", "other",
+			&proto.Rule{Action: "allow", OriginalSrcSelector: "app == 'frontend'"}, false),
+		Entry("namespaced policy, no selectors, other namespace", "other",
+			&proto.Rule{Action: "allow"}, true),
+		Entry("matching destination port", "",
+			&proto.Rule{Action: "allow", DstPorts: []*proto.PortRange{{First: 8000, Last: 9000}}}, true),
+		Entry("non-matching destination port", "",
+			&proto.Rule{Action: "allow", DstPorts: []*proto.PortRange{{First: 80, Last: 80}}}, false),
+		Entry("negated destination port", "",
+			&proto.Rule{Action: "allow", NotDstPorts: []*proto.PortRange{{First: 8080, Last: 8080}}}, false),
+		Entry("source port", "",
+			&proto.Rule{Action: "allow", SrcPorts: []*proto.PortRange{{First: 0, Last: 65535}}}, false),
+		Entry("TCP protocol", "",
+			&proto.Rule{Action: "allow", Protocol: &proto.Protocol{NumberOrName: &proto.Protocol_Name{Name: "TCP"}}}, true),
+		Entry("UDP protocol", "",
+			&proto.Rule{Action: "allow", Protocol: &proto.Protocol{NumberOrName: &proto.Protocol_Number{Number: 17}}}, false),
+		Entry("ICMP", "",
+			&proto.Rule{Action: "allow", Icmp: &proto.Rule_IcmpType{IcmpType: 8}}, false),
+		Entry("matching source CIDR", "",
+			&proto.Rule{Action: "allow", SrcNet: []string{"10.0.0.0/16"}}, true),
+		Entry("non-matching source CIDR", "",
+			&proto.Rule{Action: "allow", SrcNet: []string{"10.1.0.0/16"}}, false),
+		Entry("negated source CIDR", "",
+			&proto.Rule{Action: "allow", NotSrcNet: []string{"10.0.1.1"}}, false),
+		Entry("IPv6-only rule", "",
+			&proto.Rule{Action: "allow", IpVersion: proto.IPVersion_IPV6}, false),
+		Entry("matching source IP set", "",
+			&proto.Rule{Action: "allow", SrcIpSetIds: []string{"s-frontends"}}, true),
+		Entry("non-matching source IP set", "",
+			&proto.Rule{Action: "allow", SrcIpSetIds: []string{"s-backends"}}, false),
+		Entry("matching and non-matching source IP sets", "",
+			&proto.Rule{Action: "allow", SrcIpSetIds: []string{"s-frontends", "s-backends"}}, false),
+		Entry("matching source network set", "",
+			&proto.Rule{Action: "allow", SrcIpSetIds: []string{"s-netset"}}, true),
+		Entry("negated source network set", "",
+			&proto.Rule{Action: "allow", NotSrcIpSetIds: []string{"s-netset"}}, false),
+		Entry("negated non-matching source IP set", "",
+			&proto.Rule{Action: "allow", NotSrcIpSetIds: []string{"s-backends"}}, true),
+		Entry("unknown IP set", "",
+			&proto.Rule{Action: "allow", SrcIpSetIds: []string{"s-unknown"}}, false),
+		Entry("matching destination IP set", "",
+			&proto.Rule{Action: "allow", DstIpSetIds: []string{"s-local"}}, true),
+		Entry("non-matching destination IP set", "",
+			&proto.Rule{Action: "allow", DstIpSetIds: []string{"s-frontends"}}, false),
+		Entry("matching destination CIDR", "",
+			&proto.Rule{Action: "allow", DstNet: []string{"10.0.2.0/24"}}, true),
+		Entry("negated destination CIDR", "",
+			&proto.Rule{Action: "allow", NotDstNet: []string{"10.0.2.0/24"}}, false),
+		Entry("matching named port", "",
+			&proto.Rule{Action: "allow", DstNamedPortIpSetIds: []string{"s-http"}}, true),
+		Entry("non-matching named port", "",
+			&proto.Rule{Action: "allow", DstNamedPortIpSetIds: []string{"s-metrics"}}, false),
+		Entry("non-matching numeric port but matching named port", "",
+			&proto.Rule{
+				Action:               "allow",
+				DstPorts:             []*proto.PortRange{{First: 80, Last: 80}},
+				DstNamedPortIpSetIds: []string{"s-http"},
+			}, true),
+	)
+
+	It("should skip log rules", func() {
+		setPolicy("", &proto.Rule{Action: "log"}, &proto.Rule{Action: "deny"})
+		decision := Evaluate(snap, request())
+		Expect(decision.Allowed).To(BeFalse())
+		Expect(decision.Reason).To(ContainSubstring("rule 1"))
+	})
+
+	It("should not match source IP sets if the peer's address is unknown", func() {
+		setPolicy("", &proto.Rule{Action: "allow", SrcIpSetIds: []string{"s-netset"}})
+		req := request()
+		req.SourceIP = nil
+		Expect(Evaluate(snap, req).Allowed).To(BeFalse())
+	})
+
+	It("should prefer the request's destination address to the endpoint's", func() {
+		setPolicy("", &proto.Rule{Action: "allow", DstNamedPortIpSetIds: []string{"s-http"}})
+		req := request()
+		req.DestinationIP = net.ParseIP("10.0.2.2")
+		Expect(Evaluate(snap, req).Allowed).To(BeTrue())
+		req.DestinationIP = net.ParseIP("10.0.2.3")
+		Expect(Evaluate(snap, req).Allowed).To(BeFalse())
+	})
+
+	It("should not match destination IP sets if the endpoint has several addresses", func() {
+		ep := snap.Endpoints[wepID]
+		ep.Ipv4Nets = append(ep.Ipv4Nets, "10.0.2.2/32")
+		setPolicy("", &proto.Rule{Action: "allow", DstIpSetIds: []string{"s-local"}})
+		Expect(Evaluate(snap, request()).Allowed).To(BeFalse())
+	})
+
+	It("should not match source CIDRs if the peer's address is unknown", func() {
+		setPolicy("", &proto.Rule{Action: "allow", SrcNet: []string{"10.0.0.0/8"}})
+		req := request()
+		req.SourceIP = nil
+		Expect(Evaluate(snap, req).Allowed).To(BeFalse())
+	})
+})
@@ -0,0 +1,295 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/selector"
+
+	"github.com/projectcalico/felix/policysync/client"
+	"github.com/projectcalico/felix/proto"
+)
+
+const protocolTCP = 6
+
+// ruleMatches returns true if the rule matches the request.  All the criteria that are present
+// in the rule must match.  namespace is the namespace of the policy that contains the rule, if
+// any; as in the v3 data model, a namespaced policy's source selectors only match peers in the
+// same namespace unless the rule has a namespace selector.
+func (e *evaluator) ruleMatches(rule *proto.Rule, namespace string) bool {
+	req := e.req
+
+	if rule.Icmp != nil {
+		// HTTP requests are never ICMP.
+		return false
+	}
+	if rule.Protocol != nil && !protocolIsTCP(rule.Protocol) {
+		return false
+	}
+	if rule.NotProtocol != nil && protocolIsTCP(rule.NotProtocol) {
+		return false
+	}
+	if rule.IpVersion != proto.IPVersion_ANY && req.SourceIP != nil &&
+		int(rule.IpVersion) != ipVersion(req.SourceIP) {
+		return false
+	}
+
+	// We don't know the peer's source port.
+	if len(rule.SrcPorts) > 0 || len(rule.SrcNamedPortIpSetIds) > 0 {
+		return false
+	}
+	// As in the dataplane, the numeric ports and the named ports (which are resolved to IP sets
+	// of the endpoints' addresses and ports) are ORed together.
+	if len(rule.DstPorts) > 0 || len(rule.DstNamedPortIpSetIds) > 0 {
+		if !portInRanges(rule.DstPorts, req.DestinationPort) && !e.anyNamedPortMatches(rule.DstNamedPortIpSetIds) {
+			return false
+		}
+	}
+	if portInRanges(rule.NotDstPorts, req.DestinationPort) {
+		return false
+	}
+
+	if !addrMatches(req.SourceIP, rule.SrcNet, rule.NotSrcNet) ||
+		!addrMatches(e.dstIP, rule.DstNet, rule.NotDstNet) {
+		return false
+	}
+	if !e.ipSetsMatch(req.SourceIP, rule.SrcIpSetIds, rule.NotSrcIpSetIds) ||
+		!e.ipSetsMatch(e.dstIP, rule.DstIpSetIds, rule.NotDstIpSetIds) {
+		return false
+	}
+
+	if !e.httpMatches(rule.HttpMatch) {
+		return false
+	}
+
+	// Source endpoint matches.
+	saMatch := rule.SrcServiceAccountMatch
+	hasSAMatch := saMatch != nil && (len(saMatch.Names) > 0 || saMatch.Selector != "")
+	if rule.OriginalSrcSelector != "" || hasSAMatch || rule.OriginalSrcNamespaceSelector != "" {
+		if !e.namespaceMatches(rule.OriginalSrcNamespaceSelector, namespace) {
+			return false
+		}
+	}
+	if rule.OriginalSrcSelector != "" && !selectorMatches(rule.OriginalSrcSelector, req.SourceLabels) {
+		return false
+	}
+	if hasSAMatch && !e.serviceAccountMatches(saMatch) {
+		return false
+	}
+	if rule.OriginalNotSrcSelector != "" {
+		sel, ok := parseSelector(rule.OriginalNotSrcSelector)
+		if !ok || sel.Evaluate(req.SourceLabels) {
+			return false
+		}
+	}
+	return true
+}
+
+// addrMatches returns true if the address is in one of the nets (if there are any) and isn't in
+// any of the negated nets.  If the address isn't known, only a rule without nets can match.
+func addrMatches(addr net.IP, nets, notNets []string) bool {
+	if addr == nil {
+		return len(nets) == 0 && len(notNets) == 0
+	}
+	if len(nets) > 0 && !anyNetContains(nets, addr) {
+		return false
+	}
+	return !anyNetContains(notNets, addr)
+}
+
+// ipSetsMatch returns true if the address is in all of the IP sets and none of the negated IP
+// sets.  If the address isn't known, only a rule without IP sets can match.
+func (e *evaluator) ipSetsMatch(addr net.IP, ids, notIDs []string) bool {
+	if addr == nil {
+		return len(ids) == 0 && len(notIDs) == 0
+	}
+	for _, id := range ids {
+		if !e.ipSetContainsIP(id, addr) {
+			return false
+		}
+	}
+	for _, id := range notIDs {
+		if e.ipSetContainsIP(id, addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// anyNamedPortMatches returns true if the workload's address and the request's port are in
+// one of the named port IP sets.
+func (e *evaluator) anyNamedPortMatches(ids []string) bool {
+	if e.dstIP == nil {
+		return false
+	}
+	member := fmt.Sprintf("%s,tcp:%d", e.dstIP, e.req.DestinationPort)
+	for _, id := range ids {
+		ipSet := e.lookUpIPSet(id)
+		if ipSet == nil {
+			continue
+		}
+		// The members are sorted, and Felix formats them canonically.
+		idx := sort.SearchStrings(ipSet.Members, member)
+		if idx < len(ipSet.Members) && ipSet.Members[idx] == member {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *evaluator) ipSetContainsIP(id string, addr net.IP) bool {
+	ipSet := e.lookUpIPSet(id)
+	if ipSet == nil {
+		return false
+	}
+	// Both the IP and the NET IP sets have CIDRs as members.
+	return anyNetContains(ipSet.Members, addr)
+}
+
+func (e *evaluator) lookUpIPSet(id string) *client.IPSet {
+	ipSet := e.snap.IPSets[id]
+	if ipSet == nil {
+		// Felix always sends the IP sets before the policies that use them so this indicates
+		// an incomplete snapshot.  An empty IP set is the best guess.
+		log.WithField("setID", id).Warn("Rule references unknown IP set, treating it as empty")
+	}
+	return ipSet
+}
+
+func (e *evaluator) httpMatches(match *proto.HTTPMatch) bool {
+	if match == nil || len(match.Methods) == 0 {
+		return true
+	}
+	return stringInList(e.req.Method, match.Methods)
+}
+
+func stringInList(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceMatches returns true if the peer's namespace matches the namespace selector.  If
+// there's no selector, the peer has to be in the policy's namespace (if it has one).
+func (e *evaluator) namespaceMatches(nsSelector string, policyNamespace string) bool {
+	if nsSelector == "" {
+		return policyNamespace == "" || e.req.SourceNamespace == policyNamespace
+	}
+	var labels map[string]string
+	if ns := e.snap.Namespaces[proto.NamespaceID{Name: e.req.SourceNamespace}]; ns != nil {
+		labels = ns.Labels
+	}
+	return selectorMatches(nsSelector, labels)
+}
+
+func (e *evaluator) serviceAccountMatches(match *proto.ServiceAccountMatch) bool {
+	if e.req.SourceServiceAccount == "" {
+		return false
+	}
+	if len(match.Names) > 0 && !stringInList(e.req.SourceServiceAccount, match.Names) {
+		return false
+	}
+	if match.Selector != "" {
+		var labels map[string]string
+		saID := proto.ServiceAccountID{Namespace: e.req.SourceNamespace, Name: e.req.SourceServiceAccount}
+		if sa := e.snap.ServiceAccounts[saID]; sa != nil {
+			labels = sa.Labels
+		}
+		if !selectorMatches(match.Selector, labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseSelector(expr string) (selector.Selector, bool) {
+	sel, err := selector.Parse(expr)
+	if err != nil {
+		log.WithError(err).WithField("selector", expr).Warn("Ignoring rule with bad selector")
+		return nil, false
+	}
+	return sel, true
+}
+
+func selectorMatches(expr string, labels map[string]string) bool {
+	sel, ok := parseSelector(expr)
+	if !ok {
+		return false
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return sel.Evaluate(labels)
+}
+
+func protocolIsTCP(protocol *proto.Protocol) bool {
+	switch p := protocol.NumberOrName.(type) {
+	case *proto.Protocol_Name:
+		return strings.ToLower(p.Name) == "tcp"
+	case *proto.Protocol_Number:
+		return p.Number == protocolTCP
+	}
+	return false
+}
+
+func ipVersion(addr net.IP) int {
+	if addr.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+func portInRanges(ranges []*proto.PortRange, port uint16) bool {
+	for _, r := range ranges {
+		if int32(port) >= r.First && int32(port) <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+func anyNetContains(cidrs []string, addr net.IP) bool {
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(withPrefixLen(cidr))
+		if err != nil {
+			log.WithError(err).WithField("cidr", cidr).Warn("Ignoring bad CIDR in rule")
+			continue
+		}
+		if ipNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// withPrefixLen adds a full-length prefix to a bare IP so that it can be parsed as a CIDR.
+func withPrefixLen(cidr string) string {
+	if strings.Contains(cidr, "/") {
+		return cidr
+	}
+	if strings.Contains(cidr, ":") {
+		return cidr + "/128"
+	}
+	return cidr + "/32"
+}
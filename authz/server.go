@@ -0,0 +1,82 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/projectcalico/felix/policysync/client"
+	"github.com/projectcalico/felix/proto"
+)
+
+// Server implements the Authorization gRPC API, evaluating each request against the latest
+// snapshot of the policy sync API's state.
+type Server struct {
+	getSnapshot func() *client.Snapshot
+}
+
+// NewServer creates a server; getSnapshot is typically client.Client.Snapshot.  It should return
+// nil until the policy sync client is in sync.
+func NewServer(getSnapshot func() *client.Snapshot) *Server {
+	return &Server{getSnapshot: getSnapshot}
+}
+
+func (s *Server) RegisterGrpc(g *grpc.Server) {
+	proto.RegisterAuthorizationServer(g, s)
+}
+
+func (s *Server) Check(_ context.Context, checkReq *proto.CheckRequest) (*proto.CheckResponse, error) {
+	logCxt := log.WithField("request", checkReq)
+	snap := s.getSnapshot()
+	if snap == nil {
+		logCxt.Info("Not in sync with Felix yet, unable to authorize request")
+		return &proto.CheckResponse{
+			Code:    int32(codes.Unavailable),
+			Message: "not in sync with Felix",
+		}, nil
+	}
+
+	req := &Request{
+		Method:          checkReq.Method,
+		DestinationPort: uint16(checkReq.DestinationPort),
+		EndpointID:      checkReq.EndpointId,
+	}
+	if src := checkReq.Source; src != nil {
+		req.SourceNamespace = src.Namespace
+		req.SourceServiceAccount = src.ServiceAccount
+		req.SourceLabels = src.Labels
+		if src.Address != "" {
+			req.SourceIP = net.ParseIP(src.Address)
+			if req.SourceIP == nil {
+				logCxt.WithField("address", src.Address).Warn("Ignoring unparseable peer address")
+			}
+		}
+	}
+
+	decision := Evaluate(snap, req)
+	logCxt.WithField("decision", decision).Debug("Evaluated request")
+	resp := &proto.CheckResponse{Message: decision.Reason}
+	if decision.Allowed {
+		resp.Code = int32(codes.OK)
+	} else {
+		resp.Code = int32(codes.PermissionDenied)
+	}
+	return resp, nil
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+
+	. "github.com/projectcalico/felix/authz"
+	"github.com/projectcalico/felix/policysync/client"
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("Authorization server", func() {
+	var (
+		snap   *client.Snapshot
+		server *Server
+	)
+
+	BeforeEach(func() {
+		snap = nil
+		server = NewServer(func() *client.Snapshot { return snap })
+	})
+
+	check := func() *proto.CheckResponse {
+		resp, err := server.Check(context.Background(), &proto.CheckRequest{
+			Source: &proto.Peer{
+				Address:        "10.0.1.1",
+				Namespace:      "default",
+				ServiceAccount: "frontend",
+			},
+			Method:          "GET",
+			DestinationPort: 8080,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	It("should report unavailable before it's in sync", func() {
+		Expect(check().Code).To(Equal(int32(codes.Unavailable)))
+	})
+
+	Describe("with a snapshot", func() {
+		BeforeEach(func() {
+			snap = newSnapshot()
+		})
+
+		It("should allow a request that the policy allows", func() {
+			snap.Policies[proto.PolicyID{Tier: "default", Name: "pol-1"}] = &proto.Policy{
+				InboundRules: []*proto.Rule{{
+					Action:                 "allow",
+					SrcServiceAccountMatch: &proto.ServiceAccountMatch{Names: []string{"frontend"}},
+					SrcNet:                 []string{"10.0.1.0/24"},
+				}},
+			}
+			resp := check()
+			Expect(resp.Code).To(Equal(int32(codes.OK)))
+			Expect(resp.Message).To(ContainSubstring(`policy "pol-1" rule 0`))
+		})
+
+		It("should deny a request that the policy doesn't allow", func() {
+			Expect(check().Code).To(Equal(int32(codes.PermissionDenied)))
+		})
+	})
+})
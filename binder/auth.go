@@ -31,6 +31,14 @@ type Credentials struct {
 	Workload       string
 	Namespace      string
 	ServiceAccount string
+
+	// OrchestratorID and WorkloadID identify the workload in Felix's data model.  If they're
+	// empty, the workload is a Kubernetes pod, identified by Namespace and Workload.
+	OrchestratorID string
+	WorkloadID     string
+	// EndpointIDs lists the workload's endpoints that the client may subscribe to.  If empty,
+	// the client may only subscribe to the workload's default endpoint, "eth0".
+	EndpointIDs []string
 }
 
 func (c Credentials) AuthType() string {
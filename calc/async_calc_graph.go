@@ -15,7 +15,9 @@
 package calc
 
 import (
+	"context"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -71,7 +73,9 @@ func init() {
 
 type AsyncCalcGraph struct {
 	Dispatcher       *dispatcher.Dispatcher
+	calcGraph        *CalcGraph
 	inputEvents      chan interface{}
+	debugRequests    chan func(*CalcGraph)
 	outputChannels   []chan<- interface{}
 	eventBuffer      *EventSequencer
 	beenInSync       bool
@@ -84,6 +88,10 @@ type AsyncCalcGraph struct {
 	dirty            bool
 
 	debugHangC <-chan time.Time
+
+	// flushWatchers are notified after each flush; see WatchFlushes.
+	flushWatchersLock sync.Mutex
+	flushWatchers     map[chan struct{}]bool
 }
 
 const (
@@ -97,13 +105,16 @@ func NewAsyncCalcGraph(
 	healthAggregator *health.HealthAggregator,
 ) *AsyncCalcGraph {
 	eventBuffer := NewEventSequencer(conf)
-	disp := NewCalculationGraph(eventBuffer, conf.FelixHostname)
+	calcGraph := NewCalculationGraph(eventBuffer, conf.FelixHostname)
 	g := &AsyncCalcGraph{
 		inputEvents:      make(chan interface{}, 10),
+		debugRequests:    make(chan func(*CalcGraph)),
 		outputChannels:   outputChannels,
-		Dispatcher:       disp,
+		Dispatcher:       calcGraph.AllUpdDispatcher,
+		calcGraph:        calcGraph,
 		eventBuffer:      eventBuffer,
 		healthAggregator: healthAggregator,
+		flushWatchers:    map[chan struct{}]bool{},
 	}
 	if conf.DebugSimulateCalcGraphHangAfter != 0 {
 		log.WithField("delay", conf.DebugSimulateCalcGraphHangAfter).Warn(
@@ -168,6 +179,14 @@ func (acg *AsyncCalcGraph) loop() {
 					}
 				}
 				acg.reportHealth()
+			case flushRequest:
+				// Everything that was queued before the request has now been processed.
+				log.Debug("Pulled flush request off channel")
+				if acg.dirty {
+					acg.flush()
+				}
+				close(update)
+				continue
 			default:
 				log.Panicf("Unexpected update: %#v", update)
 			}
@@ -177,6 +196,10 @@ func (acg *AsyncCalcGraph) loop() {
 			if acg.flushLeakyBucket < leakyBucketSize {
 				acg.flushLeakyBucket++
 			}
+		case f := <-acg.debugRequests:
+			// Debug API request; it only reads the graph's state so it doesn't make us
+			// dirty.
+			f(acg.calcGraph)
 		case <-healthTicks:
 			acg.reportHealth()
 		case <-acg.debugHangC:
@@ -188,6 +211,28 @@ func (acg *AsyncCalcGraph) loop() {
 	}
 }
 
+// ExecuteInLoop runs f on the calculation graph's goroutine, where it can safely read the state
+// of the graph, and waits for it to finish.  It gives up, returning the context's error, if the
+// context is cancelled before f finishes; in that case f may still run later.
+func (acg *AsyncCalcGraph) ExecuteInLoop(ctx context.Context, f func(cg *CalcGraph)) error {
+	done := make(chan struct{})
+	request := func(cg *CalcGraph) {
+		f(cg)
+		close(done)
+	}
+	select {
+	case acg.debugRequests <- request:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (acg *AsyncCalcGraph) reportHealth() {
 	if acg.healthAggregator != nil {
 		acg.healthAggregator.Report(healthName, &health.HealthReport{
@@ -205,18 +250,74 @@ func (acg *AsyncCalcGraph) maybeFlush() {
 	if acg.flushLeakyBucket > 0 {
 		log.Debug("Not throttled: flushing event buffer")
 		acg.flushLeakyBucket--
-		acg.eventBuffer.Flush()
-		if acg.needToSendInSync {
-			log.Info("First flush after becoming in sync, sending InSync message.")
-			acg.onEvent(&proto.InSync{})
-			acg.needToSendInSync = false
-		}
-		acg.dirty = false
+		acg.flush()
 	} else {
 		log.Debug("Throttled: not flushing event buffer")
 	}
 }
 
+func (acg *AsyncCalcGraph) flush() {
+	acg.eventBuffer.Flush()
+	if acg.needToSendInSync {
+		log.Info("First flush after becoming in sync, sending InSync message.")
+		acg.onEvent(&proto.InSync{})
+		acg.needToSendInSync = false
+	}
+	acg.dirty = false
+	acg.notifyFlushWatchers()
+}
+
+// WatchFlushes returns a channel that receives a value each time the graph flushes a batch of
+// changes to its output channels, for use by the debug API.  Notifications are coalesced if the
+// receiver falls behind.  The channel stops receiving notifications once ctx is cancelled.
+func (acg *AsyncCalcGraph) WatchFlushes(ctx context.Context) <-chan struct{} {
+	c := make(chan struct{}, 1)
+	acg.flushWatchersLock.Lock()
+	acg.flushWatchers[c] = true
+	acg.flushWatchersLock.Unlock()
+	go func() {
+		<-ctx.Done()
+		acg.flushWatchersLock.Lock()
+		delete(acg.flushWatchers, c)
+		acg.flushWatchersLock.Unlock()
+	}()
+	return c
+}
+
+func (acg *AsyncCalcGraph) notifyFlushWatchers() {
+	acg.flushWatchersLock.Lock()
+	defer acg.flushWatchersLock.Unlock()
+	for c := range acg.flushWatchers {
+		select {
+		case c <- struct{}{}:
+		default:
+			// Already has a notification pending.
+		}
+	}
+}
+
+// flushRequest is queued by WaitForFlush; the loop closes it once it has flushed.
+type flushRequest chan struct{}
+
+// WaitForFlush waits until the graph has processed all the updates that were queued before the
+// call and has sent the resulting events to the output channels, bypassing the usual flush
+// throttling.  It is used by offline tools, such as felix-replay, that need a reproducible
+// mapping from input batches to output events.
+func (acg *AsyncCalcGraph) WaitForFlush(ctx context.Context) error {
+	done := make(flushRequest)
+	select {
+	case acg.inputEvents <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (acg *AsyncCalcGraph) onEvent(event interface{}) {
 	log.Debug("Sending output event on channel")
 	for _, c := range acg.outputChannels {
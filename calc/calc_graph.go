@@ -70,6 +70,8 @@ type configCallbacks interface {
 type passthruCallbacks interface {
 	OnHostIPUpdate(hostname string, ip *net.IP)
 	OnHostIPRemove(hostname string)
+	OnHostIPv6Update(hostname string, ip *net.IP)
+	OnHostIPv6Remove(hostname string)
 	OnIPPoolUpdate(model.IPPoolKey, *model.IPPool)
 	OnIPPoolRemove(model.IPPoolKey)
 	OnServiceAccountUpdate(*proto.ServiceAccountUpdate)
@@ -78,15 +80,32 @@ type passthruCallbacks interface {
 	OnNamespaceRemove(proto.NamespaceID)
 }
 
+type routeCallbacks interface {
+	OnRouteUpdate(update *proto.RouteUpdate)
+	OnRouteRemove(dst string)
+}
+
 type PipelineCallbacks interface {
 	ipSetUpdateCallbacks
 	rulesUpdateCallbacks
 	endpointCallbacks
 	configCallbacks
 	passthruCallbacks
+	routeCallbacks
+}
+
+// CalcGraph is the calculation graph.  Updates should be fed to its AllUpdDispatcher.  It also
+// keeps references to the stateful nodes of the graph so that their state can be inspected by
+// the debug API.
+type CalcGraph struct {
+	AllUpdDispatcher *dispatcher.Dispatcher
+
+	activeRulesCalculator *ActiveRulesCalculator
+	policyResolver        *PolicyResolver
+	ipsetMemberIndex      *labelindex.SelectorAndNamedPortIndex
 }
 
-func NewCalculationGraph(callbacks PipelineCallbacks, hostname string) (allUpdDispatcher *dispatcher.Dispatcher) {
+func NewCalculationGraph(callbacks PipelineCallbacks, hostname string) *CalcGraph {
 	log.Infof("Creating calculation graph, filtered to hostname %v", hostname)
 	// The source of the processing graph, this dispatcher will be fed all the updates from the
 	// datastore, fanning them out to the registered receivers.
@@ -101,7 +120,7 @@ func NewCalculationGraph(callbacks PipelineCallbacks, hostname string) (allUpdDi
 	//              /   |   \
 	//     receiver_1  ...  receiver_n
 	//
-	allUpdDispatcher = dispatcher.NewDispatcher()
+	allUpdDispatcher := dispatcher.NewDispatcher()
 
 	// Some of the receivers only need to know about local endpoints. Create a second dispatcher
 	// that will filter out non-local endpoints.
@@ -276,6 +295,23 @@ func NewCalculationGraph(callbacks PipelineCallbacks, hostname string) (allUpdDi
 	hostIPPassthru := NewDataplanePassthru(callbacks)
 	hostIPPassthru.RegisterWith(allUpdDispatcher)
 
+	// The route resolver joins IPAM blocks with the IPs of the hosts that they're affine to
+	// and calculates the routes to other hosts' blocks.
+	//
+	//        ...
+	//     Dispatcher (all updates)
+	//         |
+	//         | IPAM blocks, host IPs
+	//         |
+	//       route resolver
+	//         |
+	//         | Routes to remote blocks
+	//         |
+	//      <dataplane>
+	//
+	routeResolver := NewRouteResolver(hostname, callbacks)
+	routeResolver.RegisterWith(allUpdDispatcher)
+
 	// Register for config updates.
 	//
 	//        ...
@@ -309,7 +345,12 @@ func NewCalculationGraph(callbacks PipelineCallbacks, hostname string) (allUpdDi
 	profileDecoder := NewProfileDecoder(callbacks)
 	profileDecoder.RegisterWith(allUpdDispatcher)
 
-	return allUpdDispatcher
+	return &CalcGraph{
+		AllUpdDispatcher:      allUpdDispatcher,
+		activeRulesCalculator: activeRulesCalc,
+		policyResolver:        polResolver,
+		ipsetMemberIndex:      ipsetMemberIndex,
+	}
 }
 
 type localEndpointDispatcherReg dispatcher.Dispatcher
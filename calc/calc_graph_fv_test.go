@@ -420,7 +420,7 @@ func doStateSequenceTest(expandedTest StateList, flushStrategy flushStrategy) {
 		mockDataplane = mock.NewMockDataplane()
 		eventBuf = NewEventSequencer(mockDataplane)
 		eventBuf.Callback = mockDataplane.OnEvent
-		calcGraph = NewCalculationGraph(eventBuf, localHostname)
+		calcGraph = NewCalculationGraph(eventBuf, localHostname).AllUpdDispatcher
 		validationFilter = NewValidationFilter(calcGraph)
 		sentInSync = false
 		lastState = empty
@@ -26,6 +26,7 @@ import (
 
 	"github.com/projectcalico/felix/dispatcher"
 	"github.com/projectcalico/felix/proto"
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
 	"github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/projectcalico/libcalico-go/lib/net"
@@ -35,6 +36,14 @@ var testIP = mustParseIP("10.0.0.1")
 var testIP2 = mustParseIP("10.0.0.2")
 var testIPAs6 = net.IP{testIP.To16()}
 var testIPAs4 = net.IP{testIP.To4()}
+var testNodeWithIPv6 = &apiv3.Node{
+	Spec: apiv3.NodeSpec{
+		BGP: &apiv3.NodeBGPSpec{
+			IPv4Address: "10.0.0.1/24",
+			IPv6Address: "fd00::1/64",
+		},
+	},
+}
 
 var _ = DescribeTable("Calculation graph pass-through tests",
 	func(key model.Key, input interface{}, expUpdate interface{}, expRemove interface{}) {
@@ -45,7 +54,7 @@ var _ = DescribeTable("Calculation graph pass-through tests",
 			logrus.WithField("message", message).Info("Received message")
 			messageReceived = message
 		}
-		cg := NewCalculationGraph(eb, "hostname")
+		cg := NewCalculationGraph(eb, "hostname").AllUpdDispatcher
 
 		// Send in the update and flush the buffer.  It should deposit the message
 		// via our callback.
@@ -114,6 +123,16 @@ var _ = DescribeTable("Calculation graph pass-through tests",
 		proto.HostMetadataRemove{
 			Hostname: "foo",
 		}),
+	Entry("Node IPv6",
+		model.ResourceKey{Kind: apiv3.KindNode, Name: "foo"},
+		testNodeWithIPv6,
+		proto.HostMetadataUpdate{
+			Hostname: "foo",
+			Ipv6Addr: "fd00::1",
+		},
+		proto.HostMetadataRemove{
+			Hostname: "foo",
+		}),
 )
 
 var _ = Describe("Host IP duplicate squashing test", func() {
@@ -129,7 +148,7 @@ var _ = Describe("Host IP duplicate squashing test", func() {
 			logrus.WithField("message", message).Info("Received message")
 			messagesReceived = append(messagesReceived, message)
 		}
-		cg = NewCalculationGraph(eb, "hostname")
+		cg = NewCalculationGraph(eb, "hostname").AllUpdDispatcher
 	})
 
 	It("should coalesce duplicate updates", func() {
@@ -220,4 +239,40 @@ var _ = Describe("Host IP duplicate squashing test", func() {
 			},
 		))
 	})
+	It("should send both of a dual-stack host's addresses", func() {
+		cg.OnUpdate(api.Update{
+			UpdateType: api.UpdateTypeKVNew,
+			KVPair: model.KVPair{
+				Key:   model.HostIPKey{Hostname: "foo"},
+				Value: &testIP,
+			},
+		})
+		cg.OnUpdate(api.Update{
+			UpdateType: api.UpdateTypeKVNew,
+			KVPair: model.KVPair{
+				Key:   model.ResourceKey{Kind: apiv3.KindNode, Name: "foo"},
+				Value: testNodeWithIPv6,
+			},
+		})
+		eb.Flush()
+		By("removing the IPv4 address")
+		cg.OnUpdate(api.Update{
+			UpdateType: api.UpdateTypeKVDeleted,
+			KVPair: model.KVPair{
+				Key: model.HostIPKey{Hostname: "foo"},
+			},
+		})
+		eb.Flush()
+		Expect(messagesReceived).To(Equal([]interface{}{
+			&proto.HostMetadataUpdate{
+				Hostname: "foo",
+				Ipv4Addr: "10.0.0.1",
+				Ipv6Addr: "fd00::1",
+			},
+			&proto.HostMetadataUpdate{
+				Hostname: "foo",
+				Ipv6Addr: "fd00::1",
+			},
+		}))
+	})
 })
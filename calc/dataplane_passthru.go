@@ -18,6 +18,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/projectcalico/felix/dispatcher"
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
 	"github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/projectcalico/libcalico-go/lib/net"
@@ -29,19 +30,22 @@ import (
 type DataplanePassthru struct {
 	callbacks passthruCallbacks
 
-	hostIPs map[string]*net.IP
+	hostIPs   map[string]*net.IP
+	hostIPv6s map[string]*net.IP
 }
 
 func NewDataplanePassthru(callbacks passthruCallbacks) *DataplanePassthru {
 	return &DataplanePassthru{
 		callbacks: callbacks,
 		hostIPs:   map[string]*net.IP{},
+		hostIPv6s: map[string]*net.IP{},
 	}
 }
 
 func (h *DataplanePassthru) RegisterWith(dispatcher *dispatcher.Dispatcher) {
 	dispatcher.Register(model.HostIPKey{}, h.OnUpdate)
 	dispatcher.Register(model.IPPoolKey{}, h.OnUpdate)
+	dispatcher.Register(model.ResourceKey{}, h.OnUpdate)
 }
 
 func (h *DataplanePassthru) OnUpdate(update api.Update) (filterOut bool) {
@@ -75,6 +79,43 @@ func (h *DataplanePassthru) OnUpdate(update api.Update) (filterOut bool) {
 			pool := update.Value.(*model.IPPool)
 			h.callbacks.OnIPPoolUpdate(key, pool)
 		}
+	case model.ResourceKey:
+		if key.Kind == apiv3.KindNode {
+			// The HostIPKey only carries the node's IPv4 address so we take the IPv6
+			// address from the Node itself.
+			h.onNodeUpdate(key.Name, update.Value)
+		}
 	}
 	return
 }
+
+func (h *DataplanePassthru) onNodeUpdate(hostname string, value interface{}) {
+	var ip *net.IP
+	if node, ok := value.(*apiv3.Node); ok && node.Spec.BGP != nil && node.Spec.BGP.IPv6Address != "" {
+		var err error
+		ip, _, err = net.ParseCIDROrIP(node.Spec.BGP.IPv6Address)
+		if err != nil {
+			log.WithError(err).WithField("node", hostname).Warn("Failed to parse node's IPv6 address")
+			ip = nil
+		}
+	}
+	oldIP := h.hostIPv6s[hostname]
+	if ip == nil {
+		if oldIP != nil {
+			log.WithField("hostname", hostname).Debug("Passing-through host IPv6 deletion")
+			delete(h.hostIPv6s, hostname)
+			h.callbacks.OnHostIPv6Remove(hostname)
+		}
+		return
+	}
+	if oldIP != nil && ip.IP.Equal(oldIP.IP) {
+		log.WithField("hostname", hostname).Debug("Ignoring duplicate host IPv6 update")
+		return
+	}
+	log.WithFields(log.Fields{
+		"hostname": hostname,
+		"ip":       ip,
+	}).Debug("Passing-through host IPv6 update")
+	h.hostIPv6s[hostname] = ip
+	h.callbacks.OnHostIPv6Update(hostname, ip)
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calc
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/projectcalico/felix/labelindex"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+// This file contains the read-only views of the calculation graph's state that back the debug
+// API.  The methods on CalcGraph must only be called from the calculation graph's goroutine; use
+// AsyncCalcGraph.ExecuteInLoop() to run them there.
+
+const (
+	EndpointTypeWorkload = "workload"
+	EndpointTypeHost     = "host"
+)
+
+// EndpointDebugInfo describes the policies and profiles that apply to a local endpoint.
+type EndpointDebugInfo struct {
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	Orchestrator string          `json:"orchestrator,omitempty"`
+	Workload     string          `json:"workload,omitempty"`
+	Endpoint     string          `json:"endpoint"`
+	Tiers        []TierDebugInfo `json:"tiers"`
+	Profiles     []string        `json:"profiles"`
+}
+
+// TierDebugInfo lists the policies in a tier that apply to an endpoint, in the order that
+// they're applied.
+type TierDebugInfo struct {
+	Name     string   `json:"name"`
+	Policies []string `json:"policies"`
+}
+
+// SelectorsDebugInfo shows which endpoints the active selectors match.
+type SelectorsDebugInfo struct {
+	// Policies lists every known policy, along with the local endpoints that its selector
+	// matches.
+	Policies []PolicySelectorDebugInfo `json:"policies"`
+	// IPSets lists the active IP sets, along with the endpoints and network sets (local or
+	// remote) that contribute to them.
+	IPSets []IPSetSelectorDebugInfo `json:"ipSets"`
+}
+
+type PolicySelectorDebugInfo struct {
+	Name      string   `json:"name"`
+	Selector  string   `json:"selector"`
+	Endpoints []string `json:"endpoints"`
+}
+
+type IPSetSelectorDebugInfo struct {
+	ID        string   `json:"id"`
+	Selector  string   `json:"selector"`
+	NamedPort string   `json:"namedPort,omitempty"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// IPSetDebugInfo lists the members of an IP set along with the endpoints and network sets that
+// contribute each member.
+type IPSetDebugInfo struct {
+	ID        string                 `json:"id"`
+	Selector  string                 `json:"selector"`
+	NamedPort string                 `json:"namedPort,omitempty"`
+	Members   []IPSetMemberDebugInfo `json:"members"`
+}
+
+type IPSetMemberDebugInfo struct {
+	Member  string   `json:"member"`
+	Sources []string `json:"sources"`
+}
+
+// DescribeEndpoints returns the policies and profiles that apply to each local endpoint, sorted
+// by endpoint ID.  The policy order is the order that was last sent to the dataplane.
+func (cg *CalcGraph) DescribeEndpoints() []EndpointDebugInfo {
+	pr := cg.policyResolver
+	endpointKeyToProfileIDs := cg.activeRulesCalculator.endpointKeyToProfileIDs.endpointKeyToProfileIDs
+	infos := []EndpointDebugInfo{}
+	for key := range pr.endpoints {
+		info := EndpointDebugInfo{
+			ID:       debugID(key),
+			Tiers:    []TierDebugInfo{},
+			Profiles: endpointKeyToProfileIDs[key],
+		}
+		switch key := key.(type) {
+		case model.WorkloadEndpointKey:
+			info.Type = EndpointTypeWorkload
+			info.Orchestrator = key.OrchestratorID
+			info.Workload = key.WorkloadID
+			info.Endpoint = key.EndpointID
+		case model.HostEndpointKey:
+			info.Type = EndpointTypeHost
+			info.Endpoint = key.EndpointID
+		}
+		if info.Profiles == nil {
+			info.Profiles = []string{}
+		}
+		for _, tier := range pr.tiersForEndpoint(key) {
+			tierInfo := TierDebugInfo{Name: tier.Name}
+			for _, polKV := range tier.OrderedPolicies {
+				tierInfo.Policies = append(tierInfo.Policies, polKV.Key.Name)
+			}
+			info.Tiers = append(info.Tiers, tierInfo)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// DescribeSelectors returns the endpoints that are matched by the selectors of the policies and
+// of the active IP sets.
+func (cg *CalcGraph) DescribeSelectors() *SelectorsDebugInfo {
+	arc := cg.activeRulesCalculator
+	info := &SelectorsDebugInfo{
+		Policies: []PolicySelectorDebugInfo{},
+		IPSets:   []IPSetSelectorDebugInfo{},
+	}
+	for key, policy := range arc.allPolicies {
+		endpoints := []string{}
+		arc.policyIDToEndpointKeys.Iter(key, func(epKey interface{}) {
+			endpoints = append(endpoints, debugID(epKey))
+		})
+		sort.Strings(endpoints)
+		info.Policies = append(info.Policies, PolicySelectorDebugInfo{
+			Name:      key.Name,
+			Selector:  policy.Selector,
+			Endpoints: endpoints,
+		})
+	}
+	sort.Slice(info.Policies, func(i, j int) bool {
+		return info.Policies[i].Name < info.Policies[j].Name
+	})
+
+	for _, id := range cg.ipsetMemberIndex.IPSetIDs() {
+		desc := cg.ipsetMemberIndex.DescribeIPSet(id)
+		contributors := map[string]bool{}
+		for _, sources := range desc.Contributors {
+			for _, source := range sources {
+				contributors[debugID(source)] = true
+			}
+		}
+		endpoints := make([]string, 0, len(contributors))
+		for source := range contributors {
+			endpoints = append(endpoints, source)
+		}
+		sort.Strings(endpoints)
+		info.IPSets = append(info.IPSets, IPSetSelectorDebugInfo{
+			ID:        id,
+			Selector:  desc.Selector,
+			NamedPort: namedPortString(desc),
+			Endpoints: endpoints,
+		})
+	}
+	sort.Slice(info.IPSets, func(i, j int) bool {
+		return info.IPSets[i].ID < info.IPSets[j].ID
+	})
+	return info
+}
+
+// IPSetIDs returns the IDs of the active IP sets, sorted.
+func (cg *CalcGraph) IPSetIDs() []string {
+	ids := cg.ipsetMemberIndex.IPSetIDs()
+	sort.Strings(ids)
+	return ids
+}
+
+// DescribeIPSet returns the members of the given IP set and the endpoints and network sets that
+// contribute them.  Returns nil if the IP set isn't active.
+func (cg *CalcGraph) DescribeIPSet(id string) *IPSetDebugInfo {
+	desc := cg.ipsetMemberIndex.DescribeIPSet(id)
+	if desc == nil {
+		return nil
+	}
+	info := &IPSetDebugInfo{
+		ID:        id,
+		Selector:  desc.Selector,
+		NamedPort: namedPortString(desc),
+		Members:   []IPSetMemberDebugInfo{},
+	}
+	for member, sources := range desc.Contributors {
+		memberInfo := IPSetMemberDebugInfo{Member: memberToProto(member)}
+		for _, source := range sources {
+			memberInfo.Sources = append(memberInfo.Sources, debugID(source))
+		}
+		sort.Strings(memberInfo.Sources)
+		info.Members = append(info.Members, memberInfo)
+	}
+	sort.Slice(info.Members, func(i, j int) bool {
+		return info.Members[i].Member < info.Members[j].Member
+	})
+	return info
+}
+
+func namedPortString(desc *labelindex.IPSetDescription) string {
+	if desc.NamedPortProtocol == labelindex.ProtocolNone {
+		return ""
+	}
+	return fmt.Sprintf("%v:%s", desc.NamedPortProtocol, desc.NamedPort)
+}
+
+// debugID converts the key of an endpoint or network set to the string that we use to identify
+// it in the debug API.
+func debugID(key interface{}) string {
+	switch key := key.(type) {
+	case model.WorkloadEndpointKey:
+		return fmt.Sprintf("workload/%s/%s/%s/%s",
+			key.Hostname, key.OrchestratorID, key.WorkloadID, key.EndpointID)
+	case model.HostEndpointKey:
+		return fmt.Sprintf("host/%s/%s", key.Hostname, key.EndpointID)
+	case model.NetworkSetKey:
+		return "networkset/" + key.Name
+	}
+	return fmt.Sprint(key)
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	debugRequestTimeout = 10 * time.Second
+
+	DebugPathEndpoints = "/calc-graph/endpoints"
+	DebugPathSelectors = "/calc-graph/selectors"
+	DebugPathIPSets    = "/calc-graph/ipsets/"
+)
+
+// NewDebugHandler returns an http.Handler that serves the calculation graph's state as JSON:
+//
+//     /calc-graph/endpoints[?workload=<workload ID>][&endpoint=<endpoint ID>]
+//         the policies and profiles that apply to each local endpoint.
+//     /calc-graph/selectors
+//         the endpoints that each policy and IP set selector matches.
+//     /calc-graph/ipsets/
+//         the IDs of the active IP sets.
+//     /calc-graph/ipsets/<IP set ID>
+//         the members of the IP set and the endpoints that contribute each member.
+//
+// Adding watch=true to any of the queries streams the result instead: the response is a stream
+// of JSON documents, one per line, starting with the current state and followed by the new state
+// each time the calculation graph applies a batch of updates that changes it.  A watched IP set
+// that isn't active is streamed as null.
+//
+// Each request is handled on the calculation graph's goroutine so large responses delay the
+// processing of datastore updates.
+func NewDebugHandler(acg *AsyncCalcGraph) http.Handler {
+	h := &debugHandler{acg: acg}
+	mux := http.NewServeMux()
+	mux.HandleFunc(DebugPathEndpoints, h.serveEndpoints)
+	mux.HandleFunc(DebugPathSelectors, h.serveSelectors)
+	mux.HandleFunc(DebugPathIPSets, h.serveIPSets)
+	return mux
+}
+
+type debugHandler struct {
+	acg *AsyncCalcGraph
+}
+
+// debugQuery computes the response to a debug request on the calculation graph's goroutine.  It
+// returns nil if the requested resource doesn't exist.
+type debugQuery func(cg *CalcGraph) interface{}
+
+func (h *debugHandler) serveEndpoints(w http.ResponseWriter, req *http.Request) {
+	workloadID := req.URL.Query().Get("workload")
+	endpointID := req.URL.Query().Get("endpoint")
+	h.serve(w, req, func(cg *CalcGraph) interface{} {
+		filtered := []EndpointDebugInfo{}
+		for _, ep := range cg.DescribeEndpoints() {
+			if workloadID != "" && ep.Workload != workloadID {
+				continue
+			}
+			if endpointID != "" && ep.Endpoint != endpointID {
+				continue
+			}
+			filtered = append(filtered, ep)
+		}
+		return filtered
+	})
+}
+
+func (h *debugHandler) serveSelectors(w http.ResponseWriter, req *http.Request) {
+	h.serve(w, req, func(cg *CalcGraph) interface{} {
+		return cg.DescribeSelectors()
+	})
+}
+
+func (h *debugHandler) serveIPSets(w http.ResponseWriter, req *http.Request) {
+	ipSetID := strings.TrimPrefix(req.URL.Path, DebugPathIPSets)
+	if ipSetID == "" {
+		h.serve(w, req, func(cg *CalcGraph) interface{} {
+			return cg.IPSetIDs()
+		})
+		return
+	}
+	h.serve(w, req, func(cg *CalcGraph) interface{} {
+		ipSet := cg.DescribeIPSet(ipSetID)
+		if ipSet == nil {
+			// Avoid returning a typed nil.
+			return nil
+		}
+		return ipSet
+	})
+}
+
+func (h *debugHandler) serve(w http.ResponseWriter, req *http.Request, query debugQuery) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.URL.Query().Get("watch") == "true" {
+		h.watch(w, req, query)
+		return
+	}
+	result, err := h.runQuery(req.Context(), query)
+	if err != nil {
+		h.logQueryFailure(req, err)
+		http.Error(w, "timed out waiting for calculation graph", http.StatusServiceUnavailable)
+		return
+	}
+	if result == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	writeDebugJSON(w, result)
+}
+
+// watch streams the result of the query until the client goes away: it writes the current result
+// and then, each time the calculation graph flushes a batch of updates, it writes the new result
+// if it has changed.
+func (h *debugHandler) watch(w http.ResponseWriter, req *http.Request, query debugQuery) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ctx := req.Context()
+	// Register for notifications before we take the first snapshot so that we can't miss a
+	// change.
+	flushes := h.acg.WatchFlushes(ctx)
+	var lastResult []byte
+	for {
+		result, err := h.runQuery(ctx, query)
+		if err != nil {
+			if ctx.Err() != nil {
+				// Client went away.
+				return
+			}
+			h.logQueryFailure(req, err)
+			if lastResult == nil {
+				http.Error(w, "timed out waiting for calculation graph", http.StatusServiceUnavailable)
+			}
+			return
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			log.WithError(err).Warn("Failed to marshal debug response.")
+			return
+		}
+		if !bytes.Equal(data, lastResult) {
+			if lastResult == nil {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+			}
+			if _, err := w.Write(append(data, '\n')); err != nil {
+				log.WithError(err).Debug("Failed to write to debug watch, client gone?")
+				return
+			}
+			flusher.Flush()
+			lastResult = data
+		}
+		select {
+		case <-flushes:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runQuery runs the query on the calculation graph's goroutine and returns its result.  It gives
+// up after debugRequestTimeout.
+func (h *debugHandler) runQuery(ctx context.Context, query debugQuery) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, debugRequestTimeout)
+	defer cancel()
+	// The query writes its result to a local variable so we must not return while it may
+	// still run.  Run it via a wrapper that only lets it run if we're still waiting.
+	var lock sync.Mutex
+	abandoned := false
+	var result interface{}
+	err := h.acg.ExecuteInLoop(ctx, func(cg *CalcGraph) {
+		lock.Lock()
+		defer lock.Unlock()
+		if abandoned {
+			return
+		}
+		result = query(cg)
+	})
+	if err != nil {
+		lock.Lock()
+		abandoned = true
+		lock.Unlock()
+		return nil, err
+	}
+	return result, nil
+}
+
+func (h *debugHandler) logQueryFailure(req *http.Request, err error) {
+	log.WithError(err).WithField("path", req.URL.Path).Warn(
+		"Gave up waiting for calculation graph to handle debug request.")
+}
+
+func writeDebugJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.WithError(err).Warn("Failed to write debug response.")
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calc_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/calc"
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	. "github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+var (
+	debugPol1Key = PolicyKey{Name: "pol-1"}
+	debugPol2Key = PolicyKey{Name: "pol-2"}
+	debugPol3Key = PolicyKey{Name: "pol-3"}
+	debugPol2    = Policy{
+		Order:    &order10,
+		Selector: "id == 'loc-ep-2'",
+	}
+	debugPol3 = Policy{
+		Selector: "id == 'unknown'",
+	}
+
+	debugLocalEp1ID  = "workload/localhostname/orch/wl1/ep1"
+	debugLocalEp2ID  = "workload/localhostname/orch/wl2/ep2"
+	debugRemoteEp1ID = "workload/remotehostname/orch/wl1/ep1"
+)
+
+func debugTestUpdates() []api.Update {
+	var updates []api.Update
+	for _, kv := range []KVPair{
+		{Key: localWlEpKey1, Value: &localWlEp1},
+		{Key: localWlEpKey2, Value: &localWlEp2},
+		{Key: remoteWlEpKey1, Value: &localWlEp1},
+		{Key: debugPol1Key, Value: &policy1_order20},
+		{Key: debugPol2Key, Value: &debugPol2},
+		{Key: debugPol3Key, Value: &debugPol3},
+		{Key: ProfileRulesKey{ProfileKey: ProfileKey{Name: "prof-1"}}, Value: &profileRules1},
+	} {
+		updates = append(updates, api.Update{KVPair: kv, UpdateType: api.UpdateTypeKVNew})
+	}
+	return updates
+}
+
+var _ = Describe("Calculation graph debug API", func() {
+	var cg *CalcGraph
+
+	BeforeEach(func() {
+		eb := NewEventSequencer(nil)
+		eb.Callback = func(message interface{}) {}
+		cg = NewCalculationGraph(eb, localHostname)
+		cg.AllUpdDispatcher.OnUpdates(debugTestUpdates())
+		cg.AllUpdDispatcher.OnStatusUpdated(api.InSync)
+	})
+
+	It("should describe the policies and profiles of the local endpoints", func() {
+		Expect(cg.DescribeEndpoints()).To(Equal([]EndpointDebugInfo{
+			{
+				ID:           debugLocalEp1ID,
+				Type:         EndpointTypeWorkload,
+				Orchestrator: "orch",
+				Workload:     "wl1",
+				Endpoint:     "ep1",
+				Tiers:        []TierDebugInfo{{Name: "default", Policies: []string{"pol-1"}}},
+				Profiles:     []string{"prof-1", "prof-2", "prof-missing"},
+			},
+			{
+				ID:           debugLocalEp2ID,
+				Type:         EndpointTypeWorkload,
+				Orchestrator: "orch",
+				Workload:     "wl2",
+				Endpoint:     "ep2",
+				Tiers:        []TierDebugInfo{{Name: "default", Policies: []string{"pol-2", "pol-1"}}},
+				Profiles:     []string{"prof-2", "prof-3"},
+			},
+		}))
+	})
+
+	It("should describe which endpoints the selectors match", func() {
+		selectors := cg.DescribeSelectors()
+		Expect(selectors.Policies).To(Equal([]PolicySelectorDebugInfo{
+			{Name: "pol-1", Selector: "a == 'a'", Endpoints: []string{debugLocalEp1ID, debugLocalEp2ID}},
+			{Name: "pol-2", Selector: "id == 'loc-ep-2'", Endpoints: []string{debugLocalEp2ID}},
+			{Name: "pol-3", Selector: "id == 'unknown'", Endpoints: []string{}},
+		}))
+
+		ipSetEndpoints := map[string][]string{}
+		for _, ipSet := range selectors.IPSets {
+			ipSetEndpoints[ipSet.ID] = ipSet.Endpoints
+		}
+		Expect(ipSetEndpoints).To(Equal(map[string][]string{
+			allSelectorId:  {debugLocalEp1ID, debugLocalEp2ID, debugRemoteEp1ID},
+			bEqBSelectorId: {debugLocalEp1ID, debugRemoteEp1ID},
+			tag1LabelID:    {},
+		}))
+	})
+
+	It("should list the active IP sets", func() {
+		Expect(cg.IPSetIDs()).To(ConsistOf(allSelectorId, bEqBSelectorId, tag1LabelID))
+	})
+
+	It("should describe the members of an IP set and where they came from", func() {
+		Expect(cg.DescribeIPSet(bEqBSelectorId)).To(Equal(&IPSetDebugInfo{
+			ID:       bEqBSelectorId,
+			Selector: `b == "b"`,
+			Members: []IPSetMemberDebugInfo{
+				{Member: "10.0.0.1/32", Sources: []string{debugLocalEp1ID, debugRemoteEp1ID}},
+				{Member: "10.0.0.2/32", Sources: []string{debugLocalEp1ID, debugRemoteEp1ID}},
+				{Member: "fc00:fe11::1/128", Sources: []string{debugLocalEp1ID, debugRemoteEp1ID}},
+				{Member: "fc00:fe11::2/128", Sources: []string{debugLocalEp1ID, debugRemoteEp1ID}},
+			},
+		}))
+	})
+
+	It("should show members that are shared by more than one endpoint", func() {
+		info := cg.DescribeIPSet(allSelectorId)
+		Expect(info.Selector).To(Equal("all()"))
+		Expect(info.Members).To(ContainElement(IPSetMemberDebugInfo{
+			Member:  "10.0.0.2/32",
+			Sources: []string{debugLocalEp1ID, debugLocalEp2ID, debugRemoteEp1ID},
+		}))
+		Expect(info.Members).To(ContainElement(IPSetMemberDebugInfo{
+			Member:  "10.0.0.3/32",
+			Sources: []string{debugLocalEp2ID},
+		}))
+	})
+
+	It("should return nil for an unknown IP set", func() {
+		Expect(cg.DescribeIPSet("unknown")).To(BeNil())
+	})
+})
+
+var _ = Describe("Calculation graph debug HTTP server", func() {
+	var server *httptest.Server
+	var asyncGraph *AsyncCalcGraph
+
+	BeforeEach(func() {
+		conf := config.New()
+		conf.FelixHostname = localHostname
+		outputChan := make(chan interface{})
+		go func() {
+			for range outputChan {
+			}
+		}()
+		asyncGraph = NewAsyncCalcGraph(conf, []chan<- interface{}{outputChan}, nil)
+		asyncGraph.Start()
+		asyncGraph.OnUpdates(debugTestUpdates())
+		asyncGraph.OnStatusUpdated(api.InSync)
+		server = httptest.NewServer(NewDebugHandler(asyncGraph))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	get := func(path string, v interface{}) int {
+		resp, err := http.Get(server.URL + path)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		if resp.StatusCode == http.StatusOK {
+			Expect(json.Unmarshal(body, v)).To(Succeed())
+		}
+		return resp.StatusCode
+	}
+
+	It("should serve the endpoints, filtered by workload", func() {
+		Eventually(func() []EndpointDebugInfo {
+			var endpoints []EndpointDebugInfo
+			Expect(get("/calc-graph/endpoints?workload=wl2", &endpoints)).To(Equal(http.StatusOK))
+			return endpoints
+		}).Should(Equal([]EndpointDebugInfo{{
+			ID:           debugLocalEp2ID,
+			Type:         EndpointTypeWorkload,
+			Orchestrator: "orch",
+			Workload:     "wl2",
+			Endpoint:     "ep2",
+			Tiers:        []TierDebugInfo{{Name: "default", Policies: []string{"pol-2", "pol-1"}}},
+			Profiles:     []string{"prof-2", "prof-3"},
+		}}))
+	})
+
+	It("should serve the selectors", func() {
+		Eventually(func() []PolicySelectorDebugInfo {
+			var selectors SelectorsDebugInfo
+			Expect(get("/calc-graph/selectors", &selectors)).To(Equal(http.StatusOK))
+			return selectors.Policies
+		}).Should(HaveLen(3))
+	})
+
+	It("should serve the IP sets", func() {
+		Eventually(func() []string {
+			var ids []string
+			Expect(get("/calc-graph/ipsets/", &ids)).To(Equal(http.StatusOK))
+			return ids
+		}).Should(ConsistOf(allSelectorId, bEqBSelectorId, tag1LabelID))
+
+		var ipSet IPSetDebugInfo
+		Expect(get("/calc-graph/ipsets/"+bEqBSelectorId, &ipSet)).To(Equal(http.StatusOK))
+		Expect(ipSet.Members).To(HaveLen(4))
+	})
+
+	It("should return 404 for an unknown IP set", func() {
+		Expect(get("/calc-graph/ipsets/unknown", nil)).To(Equal(http.StatusNotFound))
+	})
+
+	It("should stream the changes to a watched query", func() {
+		// Wait for the initial updates to be processed so that the first document is
+		// predictable.
+		Eventually(func() []EndpointDebugInfo {
+			var endpoints []EndpointDebugInfo
+			get("/calc-graph/endpoints?workload=wl2", &endpoints)
+			return endpoints
+		}).Should(HaveLen(1))
+
+		resp, err := http.Get(server.URL + "/calc-graph/endpoints?workload=wl2&watch=true")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/x-ndjson"))
+		docs := make(chan []EndpointDebugInfo, 10)
+		go func() {
+			decoder := json.NewDecoder(resp.Body)
+			for {
+				var endpoints []EndpointDebugInfo
+				if err := decoder.Decode(&endpoints); err != nil {
+					return
+				}
+				docs <- endpoints
+			}
+		}()
+		nextPolicies := func() []string {
+			var endpoints []EndpointDebugInfo
+			Eventually(docs).Should(Receive(&endpoints))
+			Expect(endpoints).To(HaveLen(1))
+			Expect(endpoints[0].Tiers).To(HaveLen(1))
+			return endpoints[0].Tiers[0].Policies
+		}
+
+		Expect(nextPolicies()).To(Equal([]string{"pol-2", "pol-1"}))
+		asyncGraph.OnUpdates([]api.Update{{
+			KVPair:     KVPair{Key: debugPol2Key},
+			UpdateType: api.UpdateTypeKVDeleted,
+		}})
+		Expect(nextPolicies()).To(Equal([]string{"pol-1"}))
+		// Changes that don't affect the watched state shouldn't generate a document.
+		asyncGraph.OnUpdates([]api.Update{{
+			KVPair:     KVPair{Key: debugPol3Key},
+			UpdateType: api.UpdateTypeKVDeleted,
+		}})
+		Consistently(docs, "200ms").ShouldNot(Receive())
+	})
+})
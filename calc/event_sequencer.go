@@ -56,8 +56,7 @@ type EventSequencer struct {
 	pendingEndpointUpdates       map[model.Key]interface{}
 	pendingEndpointTierUpdates   map[model.Key][]tierInfo
 	pendingEndpointDeletes       set.Set
-	pendingHostIPUpdates         map[string]*net.IP
-	pendingHostIPDeletes         set.Set
+	pendingHostMetadata          set.Set
 	pendingIPPoolUpdates         map[ip.CIDR]*model.IPPool
 	pendingIPPoolDeletes         set.Set
 	pendingNotReady              bool
@@ -67,6 +66,8 @@ type EventSequencer struct {
 	pendingServiceAccountDeletes set.Set
 	pendingNamespaceUpdates      map[proto.NamespaceID]*proto.NamespaceUpdate
 	pendingNamespaceDeletes      set.Set
+	pendingRouteUpdates          map[string]*proto.RouteUpdate
+	pendingRouteDeletes          set.Set
 
 	// Sets to record what we've sent downstream.  Updated whenever we flush.
 	sentIPSets          set.Set
@@ -75,9 +76,14 @@ type EventSequencer struct {
 	sentEndpoints       set.Set
 	sentHostIPs         set.Set
 	sentIPPools         set.Set
+	sentRoutes          set.Set
 	sentServiceAccounts set.Set
 	sentNamespaces      set.Set
 
+	// The hosts' current IP addresses, which we send together in each HostMetadataUpdate.
+	hostIPv4s map[string]*net.IP
+	hostIPv6s map[string]*net.IP
+
 	Callback EventHandler
 }
 
@@ -106,14 +112,15 @@ func NewEventSequencer(conf configInterface) *EventSequencer {
 		pendingEndpointUpdates:       map[model.Key]interface{}{},
 		pendingEndpointTierUpdates:   map[model.Key][]tierInfo{},
 		pendingEndpointDeletes:       set.New(),
-		pendingHostIPUpdates:         map[string]*net.IP{},
-		pendingHostIPDeletes:         set.New(),
+		pendingHostMetadata:          set.New(),
 		pendingIPPoolUpdates:         map[ip.CIDR]*model.IPPool{},
 		pendingIPPoolDeletes:         set.New(),
 		pendingServiceAccountUpdates: map[proto.ServiceAccountID]*proto.ServiceAccountUpdate{},
 		pendingServiceAccountDeletes: set.New(),
 		pendingNamespaceUpdates:      map[proto.NamespaceID]*proto.NamespaceUpdate{},
 		pendingNamespaceDeletes:      set.New(),
+		pendingRouteUpdates:          map[string]*proto.RouteUpdate{},
+		pendingRouteDeletes:          set.New(),
 
 		// Sets to record what we've sent downstream.  Updated whenever we flush.
 		sentIPSets:          set.New(),
@@ -122,8 +129,12 @@ func NewEventSequencer(conf configInterface) *EventSequencer {
 		sentEndpoints:       set.New(),
 		sentHostIPs:         set.New(),
 		sentIPPools:         set.New(),
+		sentRoutes:          set.New(),
 		sentServiceAccounts: set.New(),
 		sentNamespaces:      set.New(),
+
+		hostIPv4s: map[string]*net.IP{},
+		hostIPv6s: map[string]*net.IP{},
 	}
 	return buf
 }
@@ -437,34 +448,57 @@ func (buf *EventSequencer) OnHostIPUpdate(hostname string, ip *net.IP) {
 		"hostname": hostname,
 		"ip":       ip,
 	}).Debug("HostIP update")
-	buf.pendingHostIPDeletes.Discard(hostname)
-	buf.pendingHostIPUpdates[hostname] = ip
-}
-
-func (buf *EventSequencer) flushHostIPUpdates() {
-	for hostname, hostIP := range buf.pendingHostIPUpdates {
-		buf.Callback(&proto.HostMetadataUpdate{
-			Hostname: hostname,
-			Ipv4Addr: hostIP.IP.String(),
-		})
-		buf.sentHostIPs.Add(hostname)
-		delete(buf.pendingHostIPUpdates, hostname)
-	}
+	buf.hostIPv4s[hostname] = ip
+	buf.pendingHostMetadata.Add(hostname)
 }
 
 func (buf *EventSequencer) OnHostIPRemove(hostname string) {
 	log.WithField("hostname", hostname).Debug("HostIP removed")
-	delete(buf.pendingHostIPUpdates, hostname)
-	if buf.sentHostIPs.Contains(hostname) {
-		buf.pendingHostIPDeletes.Add(hostname)
-	}
+	delete(buf.hostIPv4s, hostname)
+	buf.pendingHostMetadata.Add(hostname)
 }
-func (buf *EventSequencer) flushHostIPDeletes() {
-	buf.pendingHostIPDeletes.Iter(func(item interface{}) error {
-		buf.Callback(&proto.HostMetadataRemove{
-			Hostname: item.(string),
-		})
-		buf.sentHostIPs.Discard(item)
+
+func (buf *EventSequencer) OnHostIPv6Update(hostname string, ip *net.IP) {
+	log.WithFields(log.Fields{
+		"hostname": hostname,
+		"ip":       ip,
+	}).Debug("Host IPv6 update")
+	buf.hostIPv6s[hostname] = ip
+	buf.pendingHostMetadata.Add(hostname)
+}
+
+func (buf *EventSequencer) OnHostIPv6Remove(hostname string) {
+	log.WithField("hostname", hostname).Debug("Host IPv6 removed")
+	delete(buf.hostIPv6s, hostname)
+	buf.pendingHostMetadata.Add(hostname)
+}
+
+// flushHostMetadata sends an update with both of the host's addresses for each host whose
+// addresses have changed, or a remove once it has neither.
+func (buf *EventSequencer) flushHostMetadata() {
+	buf.pendingHostMetadata.Iter(func(item interface{}) error {
+		hostname := item.(string)
+		ipv4, ipv6 := buf.hostIPv4s[hostname], buf.hostIPv6s[hostname]
+		if ipv4 == nil && ipv6 == nil {
+			if buf.sentHostIPs.Contains(hostname) {
+				buf.Callback(&proto.HostMetadataRemove{
+					Hostname: hostname,
+				})
+				buf.sentHostIPs.Discard(hostname)
+			}
+			return set.RemoveItem
+		}
+		update := &proto.HostMetadataUpdate{
+			Hostname: hostname,
+		}
+		if ipv4 != nil {
+			update.Ipv4Addr = ipv4.IP.String()
+		}
+		if ipv6 != nil {
+			update.Ipv6Addr = ipv6.IP.String()
+		}
+		buf.Callback(update)
+		buf.sentHostIPs.Add(hostname)
 		return set.RemoveItem
 	})
 }
@@ -513,6 +547,38 @@ func (buf *EventSequencer) flushIPPoolDeletes() {
 	})
 }
 
+func (buf *EventSequencer) OnRouteUpdate(update *proto.RouteUpdate) {
+	log.WithField("route", update).Debug("Route update")
+	buf.pendingRouteDeletes.Discard(update.Dst)
+	buf.pendingRouteUpdates[update.Dst] = update
+}
+
+func (buf *EventSequencer) flushRouteUpdates() {
+	for dst, update := range buf.pendingRouteUpdates {
+		buf.Callback(update)
+		buf.sentRoutes.Add(dst)
+		delete(buf.pendingRouteUpdates, dst)
+	}
+}
+
+func (buf *EventSequencer) OnRouteRemove(dst string) {
+	log.WithField("dst", dst).Debug("Route removed")
+	delete(buf.pendingRouteUpdates, dst)
+	if buf.sentRoutes.Contains(dst) {
+		buf.pendingRouteDeletes.Add(dst)
+	}
+}
+
+func (buf *EventSequencer) flushRouteDeletes() {
+	buf.pendingRouteDeletes.Iter(func(item interface{}) error {
+		buf.Callback(&proto.RouteRemove{
+			Dst: item.(string),
+		})
+		buf.sentRoutes.Discard(item)
+		return set.RemoveItem
+	})
+}
+
 func (buf *EventSequencer) flushAddedIPSets() {
 	for setID, setType := range buf.pendingAddedIPSets {
 		log.WithField("setID", setID).Debug("Flushing added IP set")
@@ -570,10 +636,11 @@ func (buf *EventSequencer) Flush() {
 
 	// Flush (rare) cluster-wide updates.  There's no particular ordering to these so we might
 	// as well do deletions first to minimise occupancy.
-	buf.flushHostIPDeletes()
-	buf.flushHostIPUpdates()
+	buf.flushHostMetadata()
 	buf.flushIPPoolDeletes()
 	buf.flushIPPoolUpdates()
+	buf.flushRouteDeletes()
+	buf.flushRouteUpdates()
 }
 
 func (buf *EventSequencer) flushRemovedIPSets() {
@@ -162,6 +162,15 @@ func (pr *PolicyResolver) sendEndpointUpdate(endpointID interface{}) error {
 			nil, []tierInfo{})
 		return nil
 	}
+	applicableTiers := pr.tiersForEndpoint(endpointID)
+	log.Debugf("Endpoint tier update: %v -> %v", endpointID, applicableTiers)
+	pr.Callbacks.OnEndpointTierUpdate(endpointID.(model.Key),
+		endpoint, applicableTiers)
+	return nil
+}
+
+// tiersForEndpoint filters the sorted tiers down to the policies that match the given endpoint.
+func (pr *PolicyResolver) tiersForEndpoint(endpointID interface{}) []tierInfo {
 	applicableTiers := []tierInfo{}
 	tier := pr.sortedTierData
 	tierMatches := false
@@ -182,8 +191,5 @@ func (pr *PolicyResolver) sendEndpointUpdate(endpointID interface{}) error {
 		log.Debugf("Tier %v matches %v", tier.Name, endpointID)
 		applicableTiers = append(applicableTiers, filteredTier)
 	}
-	log.Debugf("Endpoint tier update: %v -> %v", endpointID, applicableTiers)
-	pr.Callbacks.OnEndpointTierUpdate(endpointID.(model.Key),
-		endpoint, applicableTiers)
-	return nil
+	return applicableTiers
 }
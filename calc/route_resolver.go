@@ -0,0 +1,156 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calc
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/dispatcher"
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/proto"
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// RouteResolver calculates the routes to other hosts' IPAM blocks.  It joins each block's host
+// affinity with that host's IP of the same IP version and emits a route to the block via the
+// host IP.  The IPv4 address comes from the HostIPKey and the IPv6 address from the Node
+// resource.  Blocks that are affine to this host, or to a host whose IP we don't know, don't
+// get a route.
+type RouteResolver struct {
+	hostname  string
+	callbacks routeCallbacks
+
+	blockToHost map[ip.CIDR]string
+	hostToIPv4  map[string]ip.Addr
+	hostToIPv6  map[string]ip.Addr
+	// sentRoutes contains the routes that we've emitted, indexed by block CIDR, so that we can
+	// squash duplicates and send removes.
+	sentRoutes map[ip.CIDR]*proto.RouteUpdate
+}
+
+func NewRouteResolver(hostname string, callbacks routeCallbacks) *RouteResolver {
+	return &RouteResolver{
+		hostname:    hostname,
+		callbacks:   callbacks,
+		blockToHost: map[ip.CIDR]string{},
+		hostToIPv4:  map[string]ip.Addr{},
+		hostToIPv6:  map[string]ip.Addr{},
+		sentRoutes:  map[ip.CIDR]*proto.RouteUpdate{},
+	}
+}
+
+func (r *RouteResolver) RegisterWith(allUpdDispatcher *dispatcher.Dispatcher) {
+	allUpdDispatcher.Register(model.BlockKey{}, r.OnBlockUpdate)
+	allUpdDispatcher.Register(model.HostIPKey{}, r.OnHostIPUpdate)
+	allUpdDispatcher.Register(model.ResourceKey{}, r.OnResourceUpdate)
+}
+
+func (r *RouteResolver) OnBlockUpdate(update api.Update) (filterOut bool) {
+	key := update.Key.(model.BlockKey)
+	cidr := ip.CIDRFromCalicoNet(key.CIDR)
+	hostname := ""
+	if update.Value != nil {
+		block := update.Value.(*model.AllocationBlock)
+		if block.Affinity != nil && strings.HasPrefix(*block.Affinity, "host:") {
+			hostname = strings.TrimPrefix(*block.Affinity, "host:")
+		}
+	}
+	if hostname == "" {
+		delete(r.blockToHost, cidr)
+	} else {
+		r.blockToHost[cidr] = hostname
+	}
+	r.recalculateRoute(cidr)
+	return
+}
+
+func (r *RouteResolver) OnHostIPUpdate(update api.Update) (filterOut bool) {
+	hostname := update.Key.(model.HostIPKey).Hostname
+	if update.Value == nil {
+		delete(r.hostToIPv4, hostname)
+	} else {
+		r.hostToIPv4[hostname] = ip.FromNetIP(update.Value.(*net.IP).IP)
+	}
+	r.recalculateHostRoutes(hostname)
+	return
+}
+
+func (r *RouteResolver) OnResourceUpdate(update api.Update) (filterOut bool) {
+	key := update.Key.(model.ResourceKey)
+	if key.Kind != apiv3.KindNode {
+		return
+	}
+	var addr ip.Addr
+	if node, ok := update.Value.(*apiv3.Node); ok && node.Spec.BGP != nil && node.Spec.BGP.IPv6Address != "" {
+		if nodeIP, _, err := net.ParseCIDROrIP(node.Spec.BGP.IPv6Address); err == nil {
+			addr = ip.FromNetIP(nodeIP.IP)
+		}
+	}
+	if addr == nil {
+		delete(r.hostToIPv6, key.Name)
+	} else {
+		r.hostToIPv6[key.Name] = addr
+	}
+	r.recalculateHostRoutes(key.Name)
+	return
+}
+
+func (r *RouteResolver) recalculateHostRoutes(hostname string) {
+	// Host updates are rare so a linear scan over the blocks is fine.
+	for cidr, blockHost := range r.blockToHost {
+		if blockHost == hostname {
+			r.recalculateRoute(cidr)
+		}
+	}
+}
+
+func (r *RouteResolver) recalculateRoute(cidr ip.CIDR) {
+	logCxt := log.WithField("block", cidr)
+	var route *proto.RouteUpdate
+	hostname := r.blockToHost[cidr]
+	hostIP := r.hostToIPv4[hostname]
+	if cidr.Version() == 6 {
+		hostIP = r.hostToIPv6[hostname]
+	}
+	if hostname != "" && hostname != r.hostname && hostIP != nil && hostIP.Version() == cidr.Version() {
+		route = &proto.RouteUpdate{
+			Dst:         cidr.String(),
+			DstNodeName: hostname,
+			DstNodeIp:   hostIP.String(),
+		}
+	}
+
+	oldRoute, sent := r.sentRoutes[cidr]
+	if route == nil {
+		if sent {
+			logCxt.Debug("Route to block no longer needed")
+			delete(r.sentRoutes, cidr)
+			r.callbacks.OnRouteRemove(cidr.String())
+		}
+		return
+	}
+	if sent && oldRoute.DstNodeName == route.DstNodeName && oldRoute.DstNodeIp == route.DstNodeIp {
+		logCxt.Debug("Route to block unchanged")
+		return
+	}
+	logCxt.WithField("route", route).Debug("Route to block updated")
+	r.sentRoutes[cidr] = route
+	r.callbacks.OnRouteUpdate(route)
+}
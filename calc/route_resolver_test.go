@@ -0,0 +1,198 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calc_test
+
+import (
+	. "github.com/projectcalico/felix/calc"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/proto"
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+var _ = Describe("RouteResolver", func() {
+	var resolver *RouteResolver
+	var recorder *routeCallbackRecorder
+
+	blockUpdate := func(cidr string, affinity string) api.Update {
+		block := &model.AllocationBlock{CIDR: mustParseNet(cidr)}
+		if affinity != "" {
+			block.Affinity = &affinity
+		}
+		return api.Update{KVPair: model.KVPair{
+			Key:   model.BlockKey{CIDR: mustParseNet(cidr)},
+			Value: block,
+		}}
+	}
+	blockDelete := func(cidr string) api.Update {
+		return api.Update{KVPair: model.KVPair{
+			Key: model.BlockKey{CIDR: mustParseNet(cidr)},
+		}}
+	}
+	hostIPUpdate := func(hostname string, addr string) api.Update {
+		hostIP := mustParseIP(addr)
+		return api.Update{KVPair: model.KVPair{
+			Key:   model.HostIPKey{Hostname: hostname},
+			Value: &hostIP,
+		}}
+	}
+
+	BeforeEach(func() {
+		recorder = &routeCallbackRecorder{routes: map[string]*proto.RouteUpdate{}}
+		resolver = NewRouteResolver("local", recorder)
+	})
+
+	It("should emit a route once it knows the block's host IP", func() {
+		resolver.OnBlockUpdate(blockUpdate("10.0.1.0/26", "host:remote"))
+		Expect(recorder.routes).To(BeEmpty())
+		resolver.OnHostIPUpdate(hostIPUpdate("remote", "172.16.0.2"))
+		Expect(recorder.routes).To(Equal(map[string]*proto.RouteUpdate{
+			"10.0.1.0/26": {
+				Dst:         "10.0.1.0/26",
+				DstNodeName: "remote",
+				DstNodeIp:   "172.16.0.2",
+			},
+		}))
+	})
+
+	It("should not emit routes for local blocks", func() {
+		resolver.OnHostIPUpdate(hostIPUpdate("local", "172.16.0.1"))
+		resolver.OnBlockUpdate(blockUpdate("10.0.0.0/26", "host:local"))
+		Expect(recorder.routes).To(BeEmpty())
+	})
+
+	It("should not emit routes for blocks without an affinity", func() {
+		resolver.OnHostIPUpdate(hostIPUpdate("remote", "172.16.0.2"))
+		resolver.OnBlockUpdate(blockUpdate("10.0.1.0/26", ""))
+		Expect(recorder.routes).To(BeEmpty())
+	})
+
+	It("should not route IPv6 blocks via an IPv4 host IP", func() {
+		resolver.OnHostIPUpdate(hostIPUpdate("remote", "172.16.0.2"))
+		resolver.OnBlockUpdate(blockUpdate("fd00::/122", "host:remote"))
+		Expect(recorder.routes).To(BeEmpty())
+	})
+
+	It("should route IPv6 blocks via the node's IPv6 address", func() {
+		resolver.OnHostIPUpdate(hostIPUpdate("remote", "172.16.0.2"))
+		resolver.OnBlockUpdate(blockUpdate("fd00::/122", "host:remote"))
+		resolver.OnResourceUpdate(api.Update{KVPair: model.KVPair{
+			Key: model.ResourceKey{Kind: apiv3.KindNode, Name: "remote"},
+			Value: &apiv3.Node{Spec: apiv3.NodeSpec{BGP: &apiv3.NodeBGPSpec{
+				IPv4Address: "172.16.0.2/24",
+				IPv6Address: "fd10::2/64",
+			}}},
+		}})
+		Expect(recorder.routes).To(Equal(map[string]*proto.RouteUpdate{
+			"fd00::/122": {
+				Dst:         "fd00::/122",
+				DstNodeName: "remote",
+				DstNodeIp:   "fd10::2",
+			},
+		}))
+
+		resolver.OnResourceUpdate(api.Update{KVPair: model.KVPair{
+			Key: model.ResourceKey{Kind: apiv3.KindNode, Name: "remote"},
+		}})
+		Expect(recorder.routes).To(BeEmpty())
+	})
+
+	Describe("with a remote block", func() {
+		BeforeEach(func() {
+			resolver.OnHostIPUpdate(hostIPUpdate("remote", "172.16.0.2"))
+			resolver.OnBlockUpdate(blockUpdate("10.0.1.0/26", "host:remote"))
+			recorder.numUpdates = 0
+		})
+
+		It("should squash duplicate updates", func() {
+			resolver.OnBlockUpdate(blockUpdate("10.0.1.0/26", "host:remote"))
+			resolver.OnHostIPUpdate(hostIPUpdate("remote", "172.16.0.2"))
+			Expect(recorder.numUpdates).To(BeZero())
+		})
+		It("should update the route if the host IP changes", func() {
+			resolver.OnHostIPUpdate(hostIPUpdate("remote", "172.16.0.3"))
+			Expect(recorder.routes["10.0.1.0/26"].DstNodeIp).To(Equal("172.16.0.3"))
+		})
+		It("should update the route if the block moves to another host", func() {
+			resolver.OnHostIPUpdate(hostIPUpdate("remote2", "172.16.0.4"))
+			resolver.OnBlockUpdate(blockUpdate("10.0.1.0/26", "host:remote2"))
+			Expect(recorder.routes["10.0.1.0/26"].DstNodeName).To(Equal("remote2"))
+			Expect(recorder.routes["10.0.1.0/26"].DstNodeIp).To(Equal("172.16.0.4"))
+		})
+		It("should remove the route if the block moves to this host", func() {
+			resolver.OnBlockUpdate(blockUpdate("10.0.1.0/26", "host:local"))
+			Expect(recorder.routes).To(BeEmpty())
+		})
+		It("should remove the route when the block is deleted", func() {
+			resolver.OnBlockUpdate(blockDelete("10.0.1.0/26"))
+			Expect(recorder.routes).To(BeEmpty())
+		})
+		It("should remove the route when the host IP is deleted", func() {
+			resolver.OnHostIPUpdate(api.Update{KVPair: model.KVPair{
+				Key: model.HostIPKey{Hostname: "remote"},
+			}})
+			Expect(recorder.routes).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Route event sequencing", func() {
+	var eb *EventSequencer
+	var messagesReceived []interface{}
+
+	BeforeEach(func() {
+		eb = NewEventSequencer(nil)
+		messagesReceived = nil
+		eb.Callback = func(message interface{}) {
+			messagesReceived = append(messagesReceived, message)
+		}
+	})
+
+	It("should squash an update followed by a remove", func() {
+		eb.OnRouteUpdate(&proto.RouteUpdate{Dst: "10.0.1.0/26"})
+		eb.OnRouteRemove("10.0.1.0/26")
+		eb.Flush()
+		Expect(messagesReceived).To(BeEmpty())
+	})
+	It("should send a remove for a route that was sent", func() {
+		eb.OnRouteUpdate(&proto.RouteUpdate{Dst: "10.0.1.0/26"})
+		eb.Flush()
+		eb.OnRouteRemove("10.0.1.0/26")
+		eb.Flush()
+		Expect(messagesReceived).To(Equal([]interface{}{
+			&proto.RouteUpdate{Dst: "10.0.1.0/26"},
+			&proto.RouteRemove{Dst: "10.0.1.0/26"},
+		}))
+	})
+})
+
+type routeCallbackRecorder struct {
+	routes     map[string]*proto.RouteUpdate
+	numUpdates int
+}
+
+func (r *routeCallbackRecorder) OnRouteUpdate(update *proto.RouteUpdate) {
+	r.routes[update.Dst] = update
+	r.numUpdates++
+}
+
+func (r *routeCallbackRecorder) OnRouteRemove(dst string) {
+	Expect(r.routes).To(HaveKey(dst))
+	delete(r.routes, dst)
+}
@@ -128,6 +128,8 @@ func parsedRuleToProtoRule(in *ParsedRule) *proto.Rule {
 		}
 	}
 
+	// The datamodel's HTTP match only has methods so far; it's up to the rule renderer to make
+	// sure that iptables doesn't allow more than the rule intends.
 	if in.HTTPMatch != nil {
 		out.HttpMatch = &proto.HTTPMatch{Methods: in.HTTPMatch.Methods}
 	}
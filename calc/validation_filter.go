@@ -23,6 +23,7 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	validator "github.com/projectcalico/libcalico-go/lib/validator/v1"
+	validatorv3 "github.com/projectcalico/libcalico-go/lib/validator/v3"
 )
 
 func NewValidationFilter(sink api.SyncerCallbacks) *ValidationFilter {
@@ -53,7 +54,12 @@ func (v *ValidationFilter) OnUpdates(updates []api.Update) {
 			if val.Kind() == reflect.Ptr {
 				elem := val.Elem()
 				if elem.Kind() == reflect.Struct {
-					if err := validator.Validate(elem.Interface()); err != nil {
+					validate := validator.Validate
+					if _, ok := update.Key.(model.ResourceKey); ok {
+						// v3 resources, such as Nodes, have their own validation.
+						validate = validatorv3.Validate
+					}
+					if err := validate(elem.Interface()); err != nil {
 						logCxt.WithError(err).Warn("Validation failed; treating as missing")
 						update.Value = nil
 					}
@@ -0,0 +1,312 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package collector implements flow logs.  When flow logs are enabled, the rule renderer adds
+// NFLOG actions to the rules that allow or deny traffic; the collector reads the logged packets,
+// aggregates them into per-flow records and periodically exports the records to its sinks.
+//
+// Established connections are accepted before they reach the policy rules so, for allowed
+// traffic, NFLOG only sees the first packet of each connection.  The NFLOG packet identifies the
+// connection and the policy that allowed it; the collector then takes the connection's packet and
+// byte counts from conntrack's accounting, which it reads at the end of each interval.  A
+// connection that ends before the end of the interval in which it started is only counted by
+// its first packet.  Denied packets are never accepted as established so each one is logged.
+package collector
+
+import (
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/conntrack"
+	"github.com/projectcalico/felix/rules"
+)
+
+// Tuple is the 5-tuple of a packet.  For protocols without ports, the ports are 0.
+type Tuple struct {
+	Protocol uint8
+	SrcIP    [16]byte
+	DstIP    [16]byte
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+// PacketInfo describes a packet that was logged by one of our NFLOG rules.
+type PacketInfo struct {
+	Prefix rules.FlowLogPrefix
+	Tuple  Tuple
+	// NumBytes is the length of the IP packet, which may be larger than the part of the packet
+	// that the kernel copied to us.
+	NumBytes int
+}
+
+// FlowLog is the aggregated record for a flow; it's what we export to the sinks.
+type FlowLog struct {
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+
+	Protocol uint8  `json:"protocol"`
+	SrcIP    string `json:"source_ip"`
+	DstIP    string `json:"dest_ip"`
+	SrcPort  uint16 `json:"source_port"`
+	DstPort  uint16 `json:"dest_port"`
+
+	Action    string `json:"action"`
+	Direction string `json:"direction"`
+	RuleID    string `json:"rule_id,omitempty"`
+	Owner     string `json:"policy"`
+
+	// NumPackets and NumBytes count the packets in the direction of the flow.  ReplyPackets and
+	// ReplyBytes count the reply packets of allowed flows.
+	NumPackets   int `json:"packets"`
+	NumBytes     int `json:"bytes"`
+	ReplyPackets int `json:"reply_packets,omitempty"`
+	ReplyBytes   int `json:"reply_bytes,omitempty"`
+}
+
+// Sink receives the flow logs that the collector aggregates at the end of each interval.
+type Sink interface {
+	Export(logs []*FlowLog) error
+}
+
+// ConntrackLister lists the flows in the conntrack table; it's implemented by
+// conntrack.Conntrack.
+type ConntrackLister interface {
+	ListFlows(ipVersion uint8) ([]*conntrack.Flow, error)
+}
+
+type flowKey struct {
+	Tuple  Tuple
+	Prefix rules.FlowLogPrefix
+}
+
+// trackedConn is an allowed connection that we take the counts of from conntrack.  The same
+// connection may be logged by several policies, for example by the egress policy of its source
+// and the ingress policy of its destination.
+type trackedConn struct {
+	keys map[flowKey]bool
+	// lastOrig and lastReply are the counters that we read at the end of the last interval.
+	lastOrig  conntrack.Counters
+	lastReply conntrack.Counters
+}
+
+type Collector struct {
+	packets       <-chan *PacketInfo
+	flushInterval time.Duration
+	conntrack     ConntrackLister
+	sinks         []Sink
+
+	flows         map[flowKey]*FlowLog
+	tracked       map[Tuple]*trackedConn
+	intervalStart time.Time
+}
+
+// New creates a Collector.  If ct is nil, the counts are only taken from the NFLOG packets.
+func New(packets <-chan *PacketInfo, flushInterval time.Duration, ct ConntrackLister, sinks ...Sink) *Collector {
+	return &Collector{
+		packets:       packets,
+		flushInterval: flushInterval,
+		conntrack:     ct,
+		sinks:         sinks,
+		flows:         map[flowKey]*FlowLog{},
+		tracked:       map[Tuple]*trackedConn{},
+	}
+}
+
+// Start starts a goroutine that aggregates packets from the channel.  If the channel is closed,
+// the collector flushes its remaining flows and exits.
+func (c *Collector) Start() {
+	go c.loop()
+}
+
+func (c *Collector) loop() {
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+	c.intervalStart = time.Now()
+	for {
+		select {
+		case pkt, ok := <-c.packets:
+			if !ok {
+				log.Info("Flow log packet source closed, flushing remaining flows.")
+				c.flush()
+				return
+			}
+			c.onPacket(pkt)
+		case <-ticker.C:
+			c.flush()
+		}
+	}
+}
+
+func (c *Collector) onPacket(pkt *PacketInfo) {
+	key := flowKey{Tuple: pkt.Tuple, Prefix: pkt.Prefix}
+	flow := c.flowLog(key)
+	flow.NumPackets++
+	flow.NumBytes += pkt.NumBytes
+	if c.conntrack != nil && pkt.Prefix.Action == rules.FlowLogActionAllow {
+		conn := c.tracked[pkt.Tuple]
+		if conn == nil {
+			conn = &trackedConn{keys: map[flowKey]bool{}}
+			c.tracked[pkt.Tuple] = conn
+		}
+		conn.keys[key] = true
+	}
+}
+
+// flowLog returns the record for the given flow in the current interval, creating it if needed.
+func (c *Collector) flowLog(key flowKey) *FlowLog {
+	flow := c.flows[key]
+	if flow == nil {
+		flow = &FlowLog{
+			Protocol:  key.Tuple.Protocol,
+			SrcIP:     ipString(key.Tuple.SrcIP),
+			DstIP:     ipString(key.Tuple.DstIP),
+			SrcPort:   key.Tuple.SrcPort,
+			DstPort:   key.Tuple.DstPort,
+			Action:    key.Prefix.Action.String(),
+			Direction: key.Prefix.Direction.String(),
+			RuleID:    key.Prefix.RuleID,
+			Owner:     key.Prefix.Owner,
+		}
+		c.flows[key] = flow
+	}
+	return flow
+}
+
+// updateCountsFromConntrack replaces the NFLOG counts of the tracked connections with the
+// increase in their conntrack counters since the last interval.  It adds records for the
+// connections that are still sending traffic from earlier intervals and stops tracking the
+// connections that have gone.
+func (c *Collector) updateCountsFromConntrack() {
+	for _, ipVersion := range []uint8{4, 6} {
+		ctFlows, err := c.conntrack.ListFlows(ipVersion)
+		if err != nil {
+			// Fall back to the NFLOG counts for this interval.
+			log.WithError(err).WithField("ipVersion", ipVersion).Warn(
+				"Failed to read conntrack counters for flow logs.")
+			continue
+		}
+		seen := map[Tuple]bool{}
+		for _, ctFlow := range ctFlows {
+			tuple, conn := c.lookUpTrackedConn(ctFlow)
+			if conn == nil {
+				continue
+			}
+			seen[tuple] = true
+			if ctFlow.OrigCounters == nil || ctFlow.ReplyCounters == nil {
+				// Accounting is disabled.
+				continue
+			}
+			origDelta := counterDelta(conn.lastOrig, *ctFlow.OrigCounters)
+			replyDelta := counterDelta(conn.lastReply, *ctFlow.ReplyCounters)
+			conn.lastOrig = *ctFlow.OrigCounters
+			conn.lastReply = *ctFlow.ReplyCounters
+			for key := range conn.keys {
+				if c.flows[key] == nil && origDelta.Packets == 0 && replyDelta.Packets == 0 {
+					// Idle for the whole interval.
+					continue
+				}
+				flow := c.flowLog(key)
+				flow.NumPackets = int(origDelta.Packets)
+				flow.NumBytes = int(origDelta.Bytes)
+				flow.ReplyPackets = int(replyDelta.Packets)
+				flow.ReplyBytes = int(replyDelta.Bytes)
+			}
+		}
+		for tuple := range c.tracked {
+			if !seen[tuple] && tupleIPVersion(tuple) == ipVersion {
+				delete(c.tracked, tuple)
+			}
+		}
+	}
+}
+
+// lookUpTrackedConn finds the tracked connection for a conntrack flow.  NFLOG logs packets in
+// the filter table, after DNAT, so for service traffic the tuple that we track is the inverse of
+// the flow's reply tuple rather than its original tuple.
+func (c *Collector) lookUpTrackedConn(ctFlow *conntrack.Flow) (Tuple, *trackedConn) {
+	tuple := tupleFromConntrack(ctFlow.Orig)
+	if conn := c.tracked[tuple]; conn != nil {
+		return tuple, conn
+	}
+	tuple = tupleFromConntrack(conntrack.Tuple{
+		Src:     ctFlow.Reply.Dst,
+		Dst:     ctFlow.Reply.Src,
+		Proto:   ctFlow.Reply.Proto,
+		SrcPort: ctFlow.Reply.DstPort,
+		DstPort: ctFlow.Reply.SrcPort,
+	})
+	return tuple, c.tracked[tuple]
+}
+
+// counterDelta returns the increase in a flow's counters.  If the counters have gone backwards,
+// the connection must have been replaced by a new one with the same tuple.
+func counterDelta(last, current conntrack.Counters) conntrack.Counters {
+	if current.Packets < last.Packets || current.Bytes < last.Bytes {
+		return current
+	}
+	return conntrack.Counters{
+		Packets: current.Packets - last.Packets,
+		Bytes:   current.Bytes - last.Bytes,
+	}
+}
+
+func (c *Collector) flush() {
+	if c.conntrack != nil && len(c.tracked) > 0 {
+		c.updateCountsFromConntrack()
+	}
+	now := time.Now()
+	if len(c.flows) == 0 {
+		log.Debug("No flows to export.")
+		c.intervalStart = now
+		return
+	}
+	logs := make([]*FlowLog, 0, len(c.flows))
+	for _, flow := range c.flows {
+		flow.StartTime = c.intervalStart
+		flow.EndTime = now
+		logs = append(logs, flow)
+	}
+	for _, sink := range c.sinks {
+		if err := sink.Export(logs); err != nil {
+			// We don't retry; the flows will be lost but we'll try again with the next
+			// batch.
+			log.WithError(err).WithField("numFlows", len(logs)).Warn("Failed to export flow logs.")
+		}
+	}
+	log.WithField("numFlows", len(logs)).Debug("Exported flow logs.")
+	c.flows = map[flowKey]*FlowLog{}
+	c.intervalStart = now
+}
+
+// ipString converts an IP stored in a Tuple to a string; IPv4 addresses are stored in their
+// IPv4-in-IPv6 form.
+func ipString(addr [16]byte) string {
+	return net.IP(addr[:]).String()
+}
+
+func tupleIPVersion(t Tuple) uint8 {
+	if net.IP(t.SrcIP[:]).To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+func tupleFromConntrack(ct conntrack.Tuple) Tuple {
+	t := Tuple{Protocol: ct.Proto, SrcPort: ct.SrcPort, DstPort: ct.DstPort}
+	copy(t.SrcIP[:], ct.Src.To16())
+	copy(t.DstIP[:], ct.Dst.To16())
+	return t
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/collector"
+	"github.com/projectcalico/felix/conntrack"
+	"github.com/projectcalico/felix/rules"
+)
+
+type mockSink struct {
+	lock    sync.Mutex
+	batches [][]*FlowLog
+	fail    bool
+}
+
+func (s *mockSink) Export(logs []*FlowLog) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.batches = append(s.batches, logs)
+	if s.fail {
+		return errors.New("dummy failure")
+	}
+	return nil
+}
+
+func (s *mockSink) Batches() [][]*FlowLog {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.batches
+}
+
+// mockConntrack returns a single flow, whose counters can be updated, from the IPv4 table.  The
+// flow is from 10.0.0.1:34567 to 10.0.0.2:80, either directly or via a DNATed service IP.
+type mockConntrack struct {
+	lock  sync.Mutex
+	flows []*conntrack.Flow
+	err   error
+}
+
+func (m *mockConntrack) ListFlows(ipVersion uint8) ([]*conntrack.Flow, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if ipVersion != 4 {
+		return nil, nil
+	}
+	return m.flows, m.err
+}
+
+func (m *mockConntrack) SetFlow(orig, reply conntrack.Counters) {
+	m.setFlow("10.0.0.2", 80, orig, reply)
+}
+
+func (m *mockConntrack) SetDNATFlow(orig, reply conntrack.Counters) {
+	m.setFlow("10.96.0.10", 8080, orig, reply)
+}
+
+func (m *mockConntrack) setFlow(origDst string, origDstPort uint16, orig, reply conntrack.Counters) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.flows = []*conntrack.Flow{{
+		Orig: conntrack.Tuple{
+			Src:     net.ParseIP("10.0.0.1"),
+			Dst:     net.ParseIP(origDst),
+			Proto:   6,
+			SrcPort: 34567,
+			DstPort: origDstPort,
+		},
+		Reply: conntrack.Tuple{
+			Src:     net.ParseIP("10.0.0.2"),
+			Dst:     net.ParseIP("10.0.0.1"),
+			Proto:   6,
+			SrcPort: 80,
+			DstPort: 34567,
+		},
+		OrigCounters:  &orig,
+		ReplyCounters: &reply,
+	}}
+}
+
+func (m *mockConntrack) SetError(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.err = err
+}
+
+func tuple(src, dst string, protocol uint8, srcPort, dstPort uint16) Tuple {
+	t := Tuple{Protocol: protocol, SrcPort: srcPort, DstPort: dstPort}
+	copy(t.SrcIP[:], net.ParseIP(src).To16())
+	copy(t.DstIP[:], net.ParseIP(dst).To16())
+	return t
+}
+
+var (
+	allowPrefix = rules.FlowLogPrefix{
+		Action:    rules.FlowLogActionAllow,
+		Direction: rules.FlowLogDirInbound,
+		RuleID:    "rule-1",
+		Owner:     "pol:default/foo",
+	}
+	denyPrefix = rules.FlowLogPrefix{
+		Action:    rules.FlowLogActionDeny,
+		Direction: rules.FlowLogDirOutbound,
+		Owner:     "ep:cali1234",
+	}
+	tcpTuple = tuple("10.0.0.1", "10.0.0.2", 6, 34567, 80)
+	udpTuple = tuple("fd00::1", "fd00::2", 17, 34567, 53)
+)
+
+// stripTimes zeroes the timestamps in the flow logs so that they can be compared.
+func stripTimes(logs []*FlowLog) []FlowLog {
+	var stripped []FlowLog
+	for _, l := range logs {
+		s := *l
+		Expect(s.StartTime.IsZero()).To(BeFalse())
+		Expect(s.EndTime.Before(s.StartTime)).To(BeFalse())
+		s.StartTime = time.Time{}
+		s.EndTime = time.Time{}
+		stripped = append(stripped, s)
+	}
+	return stripped
+}
+
+var _ = Describe("Collector", func() {
+	var packets chan *PacketInfo
+	var sink, failingSink *mockSink
+
+	BeforeEach(func() {
+		packets = make(chan *PacketInfo)
+		sink = &mockSink{}
+		failingSink = &mockSink{fail: true}
+	})
+
+	It("should aggregate packets by flow and flush when the source closes", func() {
+		New(packets, time.Hour, nil, failingSink, sink).Start()
+		packets <- &PacketInfo{Prefix: allowPrefix, Tuple: tcpTuple, NumBytes: 60}
+		packets <- &PacketInfo{Prefix: allowPrefix, Tuple: tcpTuple, NumBytes: 40}
+		packets <- &PacketInfo{Prefix: denyPrefix, Tuple: tcpTuple, NumBytes: 60}
+		packets <- &PacketInfo{Prefix: denyPrefix, Tuple: udpTuple, NumBytes: 100}
+		close(packets)
+
+		Eventually(sink.Batches).Should(HaveLen(1))
+		Expect(stripTimes(sink.Batches()[0])).To(ConsistOf(
+			FlowLog{
+				Protocol:   6,
+				SrcIP:      "10.0.0.1",
+				DstIP:      "10.0.0.2",
+				SrcPort:    34567,
+				DstPort:    80,
+				Action:     "allow",
+				Direction:  "inbound",
+				RuleID:     "rule-1",
+				Owner:      "pol:default/foo",
+				NumPackets: 2,
+				NumBytes:   100,
+			},
+			FlowLog{
+				Protocol:   6,
+				SrcIP:      "10.0.0.1",
+				DstIP:      "10.0.0.2",
+				SrcPort:    34567,
+				DstPort:    80,
+				Action:     "deny",
+				Direction:  "outbound",
+				Owner:      "ep:cali1234",
+				NumPackets: 1,
+				NumBytes:   60,
+			},
+			FlowLog{
+				Protocol:   17,
+				SrcIP:      "fd00::1",
+				DstIP:      "fd00::2",
+				SrcPort:    34567,
+				DstPort:    53,
+				Action:     "deny",
+				Direction:  "outbound",
+				Owner:      "ep:cali1234",
+				NumPackets: 1,
+				NumBytes:   100,
+			},
+		))
+		// A failing sink shouldn't stop the others from getting the flows.
+		Expect(failingSink.Batches()).To(HaveLen(1))
+	})
+
+	It("should flush periodically and start a new interval", func() {
+		New(packets, 50*time.Millisecond, nil, sink).Start()
+		packets <- &PacketInfo{Prefix: allowPrefix, Tuple: tcpTuple, NumBytes: 60}
+		Eventually(sink.Batches).Should(HaveLen(1))
+		Expect(sink.Batches()[0]).To(HaveLen(1))
+		Expect(sink.Batches()[0][0].NumPackets).To(Equal(1))
+
+		packets <- &PacketInfo{Prefix: allowPrefix, Tuple: tcpTuple, NumBytes: 60}
+		Eventually(sink.Batches).Should(HaveLen(2))
+		Expect(sink.Batches()[1][0].NumPackets).To(Equal(1))
+		Expect(sink.Batches()[1][0].StartTime).To(Equal(sink.Batches()[0][0].EndTime))
+		close(packets)
+	})
+
+	Describe("with conntrack accounting", func() {
+		var ct *mockConntrack
+
+		BeforeEach(func() {
+			ct = &mockConntrack{}
+			ct.SetFlow(
+				conntrack.Counters{Packets: 10, Bytes: 1000},
+				conntrack.Counters{Packets: 8, Bytes: 4000},
+			)
+		})
+
+		It("should take the counts of allowed connections from conntrack", func() {
+			New(packets, 50*time.Millisecond, ct, sink).Start()
+			packets <- &PacketInfo{Prefix: allowPrefix, Tuple: tcpTuple, NumBytes: 60}
+			packets <- &PacketInfo{Prefix: denyPrefix, Tuple: tcpTuple, NumBytes: 60}
+			Eventually(sink.Batches).Should(HaveLen(1))
+			Expect(stripTimes(sink.Batches()[0])).To(ConsistOf(
+				FlowLog{
+					Protocol:     6,
+					SrcIP:        "10.0.0.1",
+					DstIP:        "10.0.0.2",
+					SrcPort:      34567,
+					DstPort:      80,
+					Action:       "allow",
+					Direction:    "inbound",
+					RuleID:       "rule-1",
+					Owner:        "pol:default/foo",
+					NumPackets:   10,
+					NumBytes:     1000,
+					ReplyPackets: 8,
+					ReplyBytes:   4000,
+				},
+				FlowLog{
+					Protocol:   6,
+					SrcIP:      "10.0.0.1",
+					DstIP:      "10.0.0.2",
+					SrcPort:    34567,
+					DstPort:    80,
+					Action:     "deny",
+					Direction:  "outbound",
+					Owner:      "ep:cali1234",
+					NumPackets: 1,
+					NumBytes:   60,
+				},
+			))
+
+			// The connection keeps going without any more NFLOG packets; the next interval
+			// should get the increase.
+			ct.SetFlow(
+				conntrack.Counters{Packets: 15, Bytes: 1500},
+				conntrack.Counters{Packets: 9, Bytes: 4100},
+			)
+			Eventually(sink.Batches).Should(HaveLen(2))
+			Expect(sink.Batches()[1]).To(HaveLen(1))
+			flow := sink.Batches()[1][0]
+			Expect(flow.Owner).To(Equal("pol:default/foo"))
+			Expect(flow.NumPackets).To(Equal(5))
+			Expect(flow.NumBytes).To(Equal(500))
+			Expect(flow.ReplyPackets).To(Equal(1))
+			Expect(flow.ReplyBytes).To(Equal(100))
+
+			// Idle connections shouldn't be logged.
+			Consistently(sink.Batches, "200ms").Should(HaveLen(2))
+			close(packets)
+		})
+
+		It("should take the counts of DNATed connections from conntrack", func() {
+			ct.SetDNATFlow(
+				conntrack.Counters{Packets: 10, Bytes: 1000},
+				conntrack.Counters{Packets: 8, Bytes: 4000},
+			)
+			New(packets, 50*time.Millisecond, ct, sink).Start()
+			// NFLOG sees the packet after DNAT, with the pod as the destination.
+			packets <- &PacketInfo{Prefix: allowPrefix, Tuple: tcpTuple, NumBytes: 60}
+			Eventually(sink.Batches).Should(HaveLen(1))
+			Expect(sink.Batches()[0]).To(HaveLen(1))
+			flow := sink.Batches()[0][0]
+			Expect(flow.DstIP).To(Equal("10.0.0.2"))
+			Expect(flow.NumPackets).To(Equal(10))
+			Expect(flow.ReplyBytes).To(Equal(4000))
+
+			// The connection should still be tracked in the next interval.
+			ct.SetDNATFlow(
+				conntrack.Counters{Packets: 15, Bytes: 1500},
+				conntrack.Counters{Packets: 9, Bytes: 4100},
+			)
+			Eventually(sink.Batches).Should(HaveLen(2))
+			Expect(sink.Batches()[1]).To(HaveLen(1))
+			Expect(sink.Batches()[1][0].NumPackets).To(Equal(5))
+			Expect(sink.Batches()[1][0].ReplyPackets).To(Equal(1))
+			close(packets)
+		})
+
+		It("should fall back to the NFLOG counts if conntrack fails", func() {
+			ct.SetError(errors.New("dummy failure"))
+			New(packets, time.Hour, ct, sink).Start()
+			packets <- &PacketInfo{Prefix: allowPrefix, Tuple: tcpTuple, NumBytes: 60}
+			close(packets)
+			Eventually(sink.Batches).Should(HaveLen(1))
+			Expect(sink.Batches()[0]).To(HaveLen(1))
+			Expect(sink.Batches()[0][0].NumPackets).To(Equal(1))
+			Expect(sink.Batches()[0][0].NumBytes).To(Equal(60))
+			Expect(sink.Batches()[0][0].ReplyPackets).To(BeZero())
+		})
+	})
+
+	It("should not export empty batches", func() {
+		New(packets, 10*time.Millisecond, nil, sink).Start()
+		Consistently(sink.Batches, "100ms").Should(BeEmpty())
+		close(packets)
+	})
+})
@@ -0,0 +1,133 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const FlowLogFileName = "flows.log"
+
+// FileSink writes flow logs, one JSON object per line, to a file.  Once the file reaches its
+// maximum size, it's rotated: flows.log is renamed to flows.log.1, flows.log.1 to flows.log.2 and
+// so on, up to the maximum number of files.
+type FileSink struct {
+	directory   string
+	maxFileSize int64
+	maxFiles    int
+
+	file     *os.File
+	fileSize int64
+}
+
+func NewFileSink(directory string, maxFileSize int64, maxFiles int) *FileSink {
+	return &FileSink{
+		directory:   directory,
+		maxFileSize: maxFileSize,
+		maxFiles:    maxFiles,
+	}
+}
+
+func (s *FileSink) Export(logs []*FlowLog) error {
+	for _, l := range logs {
+		data, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		if err := s.write(append(data, '\n')); err != nil {
+			s.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileSink) write(line []byte) error {
+	if s.file != nil && s.fileSize > 0 && s.fileSize+int64(len(line)) > s.maxFileSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.fileSize += int64(n)
+	return err
+}
+
+func (s *FileSink) open() error {
+	if err := os.MkdirAll(s.directory, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path(0), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.fileSize = info.Size()
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	s.close()
+	log.WithField("file", s.path(0)).Info("Rotating flow log file.")
+	// Shuffle the old files up, discarding the oldest.
+	for i := s.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(s.path(i-1), s.path(i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if s.maxFiles <= 1 {
+		// No room for old files.
+		if err := os.Remove(s.path(0)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileSink) close() {
+	if s.file == nil {
+		return
+	}
+	if err := s.file.Close(); err != nil {
+		log.WithError(err).Warn("Failed to close flow log file.")
+	}
+	s.file = nil
+	s.fileSize = 0
+}
+
+// path returns the path of the current file (index 0) or of an old file.
+func (s *FileSink) path(index int) string {
+	name := FlowLogFileName
+	if index > 0 {
+		name = fmt.Sprintf("%s.%d", FlowLogFileName, index)
+	}
+	return filepath.Join(s.directory, name)
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/collector"
+)
+
+var _ = Describe("FileSink", func() {
+	var dir string
+	var flowLog *FlowLog
+	var lineLen int64
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-flowlogs")
+		Expect(err).NotTo(HaveOccurred())
+		flowLog = &FlowLog{
+			Protocol:   6,
+			SrcIP:      "10.0.0.1",
+			DstIP:      "10.0.0.2",
+			SrcPort:    34567,
+			DstPort:    80,
+			Action:     "allow",
+			Direction:  "inbound",
+			RuleID:     "rule-1",
+			Owner:      "pol:default/foo",
+			NumPackets: 2,
+			NumBytes:   120,
+		}
+		data, err := json.Marshal(flowLog)
+		Expect(err).NotTo(HaveOccurred())
+		lineLen = int64(len(data) + 1)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	readLines := func(name string) []string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		Expect(err).NotTo(HaveOccurred())
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	It("should create the directory and write one JSON object per line", func() {
+		sink := NewFileSink(filepath.Join(dir, "sub"), 1024*1024, 5)
+		Expect(sink.Export([]*FlowLog{flowLog, flowLog})).To(Succeed())
+		data, err := ioutil.ReadFile(filepath.Join(dir, "sub", FlowLogFileName))
+		Expect(err).NotTo(HaveOccurred())
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		Expect(lines).To(HaveLen(2))
+		var decoded map[string]interface{}
+		Expect(json.Unmarshal([]byte(lines[0]), &decoded)).To(Succeed())
+		Expect(decoded["source_ip"]).To(Equal("10.0.0.1"))
+		Expect(decoded["dest_port"]).To(BeEquivalentTo(80))
+		Expect(decoded["action"]).To(Equal("allow"))
+		Expect(decoded["policy"]).To(Equal("pol:default/foo"))
+	})
+
+	It("should rotate the file when it reaches its maximum size", func() {
+		sink := NewFileSink(dir, 2*lineLen, 3)
+		for i := 0; i < 7; i++ {
+			Expect(sink.Export([]*FlowLog{flowLog})).To(Succeed())
+		}
+		Expect(readLines(FlowLogFileName)).To(HaveLen(1))
+		Expect(readLines(FlowLogFileName + ".1")).To(HaveLen(2))
+		Expect(readLines(FlowLogFileName + ".2")).To(HaveLen(2))
+		_, err := os.Stat(filepath.Join(dir, FlowLogFileName+".3"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should append to an existing file", func() {
+		Expect(NewFileSink(dir, 1024*1024, 5).Export([]*FlowLog{flowLog})).To(Succeed())
+		Expect(NewFileSink(dir, 1024*1024, 5).Export([]*FlowLog{flowLog})).To(Succeed())
+		Expect(readLines(FlowLogFileName)).To(HaveLen(2))
+	})
+})
@@ -0,0 +1,296 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/nfnetlink"
+	"github.com/projectcalico/felix/rules"
+)
+
+// Constants from linux/netfilter/nfnetlink.h and linux/netfilter/nfnetlink_log.h.
+const (
+	nfnlSubsysULog = 4
+
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	// Attributes of NFULNL_MSG_PACKET.
+	nfulaPayload = 9
+	nfulaPrefix  = 10
+
+	// Attributes of NFULNL_MSG_CONFIG.
+	nfulaCfgCmd  = 1
+	nfulaCfgMode = 2
+
+	nfulnlCfgCmdBind   = 1
+	nfulnlCfgCmdPFBind = 3
+	nfulnlCfgCmdPFUnbd = 4
+
+	nfulnlCopyPacket = 2
+
+	ipProtoHopOpts  = 0
+	ipProtoTCP      = 6
+	ipProtoUDP      = 17
+	ipProtoRouting  = 43
+	ipProtoFragment = 44
+	ipProtoDstOpts  = 60
+	ipProtoSCTP     = 132
+	ipProtoUDPLite  = 136
+
+	ipv4MinHeaderLen     = 20
+	ipv6HeaderLen        = 40
+	ipv6ExtHeaderLenUnit = 8
+
+	// NflogCopyRange is the number of bytes of each packet that we ask the kernel to copy to
+	// us; enough for the IP header (including IPv6 extension headers) and the ports.
+	NflogCopyRange = 128
+)
+
+// NflogSocket is a shim for a NETLINK_NETFILTER socket, which allows the NFLOG reader to be
+// tested without a kernel.
+type NflogSocket = nfnetlink.Socket
+
+// NflogReader reads the packets that our NFLOG rules send to an NFLOG group.
+type NflogReader struct {
+	group   uint16
+	socket  NflogSocket
+	packets chan *PacketInfo
+}
+
+func NewNflogReaderWithShims(group uint16, socket NflogSocket) *NflogReader {
+	return &NflogReader{
+		group:   group,
+		socket:  socket,
+		packets: make(chan *PacketInfo, 1000),
+	}
+}
+
+// Start binds the socket to the NFLOG group and starts a goroutine that decodes the logged
+// packets.  The returned channel is closed if the socket fails.
+func (r *NflogReader) Start() (<-chan *PacketInfo, error) {
+	if err := r.bind(); err != nil {
+		r.socket.Close()
+		return nil, err
+	}
+	go r.loop()
+	return r.packets, nil
+}
+
+func (r *NflogReader) bind() error {
+	// The PF_UNBIND/PF_BIND commands are only needed on kernels before v3.17 but they're
+	// harmless on newer kernels.
+	var requests []nfnetlink.Request
+	var seq uint32
+	addRequest := func(family uint8, resID uint16, b *nfnetlink.MsgBuilder, desc string) {
+		seq++
+		requests = append(requests, nfnetlink.Request{
+			Seq: seq,
+			Data: b.Message(nfnlSubsysULog, nfulnlMsgConfig,
+				nfnetlink.FlagRequest|nfnetlink.FlagAck, family, resID, seq),
+			Description: desc,
+		})
+	}
+	for _, family := range []uint8{nfnetlink.ProtoIPv4, nfnetlink.ProtoIPv6} {
+		var unbind, bind nfnetlink.MsgBuilder
+		unbind.AddUint8(nfulaCfgCmd, nfulnlCfgCmdPFUnbd)
+		addRequest(family, 0, &unbind, "PF_UNBIND")
+		bind.AddUint8(nfulaCfgCmd, nfulnlCfgCmdPFBind)
+		addRequest(family, 0, &bind, "PF_BIND")
+	}
+	lastPFRequest := seq
+	var bind, mode nfnetlink.MsgBuilder
+	bind.AddUint8(nfulaCfgCmd, nfulnlCfgCmdBind)
+	addRequest(nfnetlink.ProtoUnspec, r.group, &bind, "BIND")
+	modeValue := make([]byte, 6)
+	binary.BigEndian.PutUint32(modeValue[0:4], NflogCopyRange)
+	modeValue[4] = nfulnlCopyPacket
+	mode.AddAttr(nfulaCfgMode, modeValue)
+	addRequest(nfnetlink.ProtoUnspec, r.group, &mode, "MODE")
+
+	// Any packets that arrive before we've finished binding are dropped.
+	err := nfnetlink.SendRequests(r.socket, requests, func(req *nfnetlink.Request, errno int32) error {
+		// Failures of the PF_(UN)BIND commands are harmless; if the group bind fails,
+		// we won't receive any packets.
+		if errno != 0 && req.Seq > lastPFRequest {
+			return fmt.Errorf("failed to bind to NFLOG group %d: %s failed with errno %d",
+				r.group, req.Description, errno)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.WithField("group", r.group).Info("Bound to NFLOG group.")
+	return nil
+}
+
+func (r *NflogReader) loop() {
+	defer close(r.packets)
+	defer r.socket.Close()
+	for {
+		data, err := r.socket.Receive()
+		if err == nfnetlink.ErrBufferOverrun {
+			// The kernel dropped some packets because we fell behind.  We'll under-count
+			// but there's nothing else to do.
+			log.Warn("NFLOG socket buffer overflowed, some flow logs will be lost.")
+			continue
+		} else if err != nil {
+			log.WithError(err).Error("Failed to read from NFLOG socket.")
+			return
+		}
+		msgs, err := nfnetlink.ParseMessages(data)
+		if err != nil {
+			log.WithError(err).Warn("Failed to parse NFLOG message, ignoring.")
+			continue
+		}
+		for _, msg := range msgs {
+			r.handleMessage(msg)
+		}
+	}
+}
+
+func (r *NflogReader) handleMessage(msg nfnetlink.Message) {
+	if msg.Type != nfnlSubsysULog<<8|nfulnlMsgPacket {
+		log.WithField("type", msg.Type).Debug("Ignoring non-packet netlink message.")
+		return
+	}
+	pkt, err := parseNflogPacket(msg.Payload)
+	if err == rules.ErrBadFlowLogPrefix {
+		log.Debug("Ignoring packet logged by non-flow-log NFLOG rule.")
+		return
+	} else if err != nil {
+		log.WithError(err).Warn("Failed to parse NFLOG packet, ignoring.")
+		return
+	}
+	select {
+	case r.packets <- pkt:
+	default:
+		log.Warn("Flow log collector is falling behind, dropping packet.")
+	}
+}
+
+// parseNflogPacket parses the payload of an NFULNL_MSG_PACKET message (after the nfgenmsg
+// header).
+func parseNflogPacket(data []byte) (*PacketInfo, error) {
+	attrs, err := nfnetlink.ParseAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+	var prefix string
+	var payload []byte
+	for _, attr := range attrs {
+		switch attr.Type {
+		case nfulaPrefix:
+			prefix = attr.StringValue()
+		case nfulaPayload:
+			payload = attr.Value
+		}
+	}
+	parsedPrefix, err := rules.ParseFlowLogPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if payload == nil {
+		return nil, errors.New("NFLOG packet has no payload")
+	}
+	pkt := &PacketInfo{Prefix: parsedPrefix}
+	if err := parseIPPacket(payload, pkt); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// parseIPPacket fills in the tuple and length of the packet from its (possibly truncated) IP
+// header.
+func parseIPPacket(data []byte, pkt *PacketInfo) error {
+	if len(data) < 1 {
+		return errors.New("empty packet")
+	}
+	var l4 []byte
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < ipv4MinHeaderLen {
+			return errors.New("truncated IPv4 header")
+		}
+		headerLen := int(data[0]&0xf) * 4
+		pkt.NumBytes = int(binary.BigEndian.Uint16(data[2:4]))
+		pkt.Tuple.Protocol = data[9]
+		copy(pkt.Tuple.SrcIP[:], v4InV6Prefix)
+		copy(pkt.Tuple.SrcIP[12:], data[12:16])
+		copy(pkt.Tuple.DstIP[:], v4InV6Prefix)
+		copy(pkt.Tuple.DstIP[12:], data[16:20])
+		fragOffset := binary.BigEndian.Uint16(data[6:8]) & 0x1fff
+		if fragOffset == 0 && headerLen <= len(data) {
+			l4 = data[headerLen:]
+		}
+	case 6:
+		if len(data) < ipv6HeaderLen {
+			return errors.New("truncated IPv6 header")
+		}
+		pkt.NumBytes = ipv6HeaderLen + int(binary.BigEndian.Uint16(data[4:6]))
+		copy(pkt.Tuple.SrcIP[:], data[8:24])
+		copy(pkt.Tuple.DstIP[:], data[24:40])
+		pkt.Tuple.Protocol, l4 = skipIPv6ExtHeaders(data[6], data[ipv6HeaderLen:])
+	default:
+		return fmt.Errorf("unknown IP version %d", data[0]>>4)
+	}
+
+	switch pkt.Tuple.Protocol {
+	case ipProtoTCP, ipProtoUDP, ipProtoSCTP, ipProtoUDPLite:
+		if len(l4) >= 4 {
+			pkt.Tuple.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+			pkt.Tuple.DstPort = binary.BigEndian.Uint16(l4[2:4])
+		}
+	}
+	return nil
+}
+
+// skipIPv6ExtHeaders walks the IPv6 extension headers to find the upper-layer protocol.  It
+// returns the protocol and the upper-layer header, which is nil if the packet was truncated
+// before it or if the packet is a non-first fragment.
+func skipIPv6ExtHeaders(nextHeader uint8, rest []byte) (uint8, []byte) {
+	for {
+		switch nextHeader {
+		case ipProtoHopOpts, ipProtoRouting, ipProtoDstOpts, ipProtoFragment:
+		default:
+			return nextHeader, rest
+		}
+		if len(rest) < ipv6ExtHeaderLenUnit {
+			return nextHeader, nil
+		}
+		extLen := (int(rest[1]) + 1) * ipv6ExtHeaderLenUnit
+		if nextHeader == ipProtoFragment {
+			// The fragment header has a fixed length.
+			extLen = ipv6ExtHeaderLenUnit
+			if binary.BigEndian.Uint16(rest[2:4])&^0x7 != 0 {
+				// Non-first fragment, there's no upper-layer header.
+				return rest[0], nil
+			}
+		}
+		if extLen > len(rest) {
+			return nextHeader, nil
+		}
+		nextHeader = rest[0]
+		rest = rest[extLen:]
+	}
+}
+
+var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
@@ -0,0 +1,32 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"github.com/projectcalico/felix/nfnetlink"
+)
+
+// nflogSocketRcvBuf is the size of the kernel's socket buffer; if we fall behind and it fills
+// up, the kernel drops packets.
+const nflogSocketRcvBuf = 4 * 1024 * 1024
+
+// NewNflogReader creates an NflogReader that reads from the given NFLOG group.
+func NewNflogReader(group uint16) (*NflogReader, error) {
+	socket, err := nfnetlink.NewSocket(nfnetlink.SocketOptions{KernelRecvBufSize: nflogSocketRcvBuf})
+	if err != nil {
+		return nil, err
+	}
+	return NewNflogReaderWithShims(group, socket), nil
+}
@@ -0,0 +1,281 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"unsafe"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/collector"
+	"github.com/projectcalico/felix/nfnetlink"
+	"github.com/projectcalico/felix/rules"
+)
+
+var nativeEndian binary.ByteOrder
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// mockNflogSocket acks the config requests that it's sent and then returns the queued
+// datagrams.  A nil datagram simulates a receive buffer overrun.
+type mockNflogSocket struct {
+	lock      sync.Mutex
+	toReceive chan []byte
+	sent      [][]byte
+	failBind  bool
+	closed    bool
+}
+
+func newMockNflogSocket() *mockNflogSocket {
+	return &mockNflogSocket{toReceive: make(chan []byte, 10)}
+}
+
+func (s *mockNflogSocket) Send(data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sent = append(s.sent, data)
+	// Ack each message in the request.
+	var acks []byte
+	for len(data) > 0 {
+		msgLen := int(nativeEndian.Uint32(data[0:4]))
+		seq := nativeEndian.Uint32(data[8:12])
+		resID := binary.BigEndian.Uint16(data[18:20])
+		errno := int32(0)
+		if s.failBind && resID != 0 {
+			errno = 1
+		}
+		acks = append(acks, errorMessage(seq, errno)...)
+		data = data[(msgLen+3)&^3:]
+	}
+	s.toReceive <- acks
+	return nil
+}
+
+func (s *mockNflogSocket) Receive() ([]byte, error) {
+	data, ok := <-s.toReceive
+	if !ok {
+		return nil, errors.New("socket closed")
+	}
+	if data == nil {
+		return nil, nfnetlink.ErrBufferOverrun
+	}
+	return data, nil
+}
+
+func (s *mockNflogSocket) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *mockNflogSocket) Closed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+func netlinkMessage(msgType uint16, seq uint32, payload []byte) []byte {
+	msgLen := 16 + len(payload)
+	msg := make([]byte, (msgLen+3)&^3)
+	nativeEndian.PutUint32(msg[0:4], uint32(msgLen))
+	nativeEndian.PutUint16(msg[4:6], msgType)
+	nativeEndian.PutUint32(msg[8:12], seq)
+	copy(msg[16:], payload)
+	return msg
+}
+
+func errorMessage(seq uint32, errno int32) []byte {
+	payload := make([]byte, 20)
+	nativeEndian.PutUint32(payload[0:4], uint32(-errno))
+	return netlinkMessage(2, seq, payload)
+}
+
+func netlinkAttr(attrType uint16, value []byte) []byte {
+	attrLen := 4 + len(value)
+	attr := make([]byte, (attrLen+3)&^3)
+	nativeEndian.PutUint16(attr[0:2], uint16(attrLen))
+	nativeEndian.PutUint16(attr[2:4], attrType)
+	copy(attr[4:], value)
+	return attr
+}
+
+// nflogPacketMessage builds an NFULNL_MSG_PACKET message.
+func nflogPacketMessage(prefix string, payload []byte) []byte {
+	// nfgenmsg header, followed by the hardware header attribute (which we ignore), the prefix
+	// and the payload.
+	msg := []byte{2, 0, 0, 20}
+	msg = append(msg, netlinkAttr(1, []byte{0x08, 0x00, 3, 0})...)
+	msg = append(msg, netlinkAttr(10, append([]byte(prefix), 0))...)
+	msg = append(msg, netlinkAttr(9, payload)...)
+	return netlinkMessage(4<<8, 0, msg)
+}
+
+func ipv4Packet(protocol uint8, src, dst string, totalLen uint16, l4 []byte) []byte {
+	hdr := make([]byte, 20)
+	hdr[0] = 0x45
+	binary.BigEndian.PutUint16(hdr[2:4], totalLen)
+	hdr[8] = 64
+	hdr[9] = protocol
+	copy(hdr[12:16], net.ParseIP(src).To4())
+	copy(hdr[16:20], net.ParseIP(dst).To4())
+	return append(hdr, l4...)
+}
+
+func ipv6Packet(nextHeader uint8, src, dst string, payloadLen uint16, rest []byte) []byte {
+	hdr := make([]byte, 40)
+	hdr[0] = 0x60
+	binary.BigEndian.PutUint16(hdr[4:6], payloadLen)
+	hdr[6] = nextHeader
+	hdr[7] = 64
+	copy(hdr[8:24], net.ParseIP(src).To16())
+	copy(hdr[24:40], net.ParseIP(dst).To16())
+	return append(hdr, rest...)
+}
+
+func ports(src, dst uint16) []byte {
+	p := make([]byte, 8)
+	binary.BigEndian.PutUint16(p[0:2], src)
+	binary.BigEndian.PutUint16(p[2:4], dst)
+	return p
+}
+
+var _ = Describe("NflogReader", func() {
+	var socket *mockNflogSocket
+	var reader *NflogReader
+
+	BeforeEach(func() {
+		socket = newMockNflogSocket()
+		reader = NewNflogReaderWithShims(20, socket)
+	})
+
+	It("should fail if the kernel rejects the group bind", func() {
+		socket.failBind = true
+		_, err := reader.Start()
+		Expect(err).To(HaveOccurred())
+		Expect(socket.Closed()).To(BeTrue())
+	})
+
+	Describe("after starting", func() {
+		var packets <-chan *PacketInfo
+
+		BeforeEach(func() {
+			var err error
+			packets, err = reader.Start()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should bind to the group in copy-packet mode", func() {
+			Expect(socket.sent).To(HaveLen(1))
+			data := socket.sent[0]
+			var resIDs []uint16
+			for len(data) > 0 {
+				msgLen := int(nativeEndian.Uint32(data[0:4]))
+				Expect(nativeEndian.Uint16(data[4:6])).To(Equal(uint16(4<<8 | 1)))
+				resIDs = append(resIDs, binary.BigEndian.Uint16(data[18:20]))
+				data = data[(msgLen+3)&^3:]
+			}
+			// PF_UNBIND/PF_BIND for IPv4 and IPv6, then BIND and MODE for our group.
+			Expect(resIDs).To(Equal([]uint16{0, 0, 0, 0, 20, 20}))
+		})
+
+		It("should decode logged packets", func() {
+			var datagram []byte
+			datagram = append(datagram, nflogPacketMessage("AI|rule-1|pol:default/foo",
+				ipv4Packet(6, "10.0.0.1", "10.0.0.2", 1500, ports(34567, 80)))...)
+			datagram = append(datagram, nflogPacketMessage("calico-packet: ",
+				ipv4Packet(6, "10.0.0.1", "10.0.0.2", 60, ports(34567, 80)))...)
+			datagram = append(datagram, nflogPacketMessage("DO||ep:cali1234",
+				ipv4Packet(1, "10.0.0.1", "10.0.0.2", 84, []byte{8, 0, 0, 0}))...)
+			socket.toReceive <- datagram
+
+			var pkt *PacketInfo
+			Eventually(packets).Should(Receive(&pkt))
+			Expect(*pkt).To(Equal(PacketInfo{
+				Prefix: rules.FlowLogPrefix{
+					Action:    rules.FlowLogActionAllow,
+					Direction: rules.FlowLogDirInbound,
+					RuleID:    "rule-1",
+					Owner:     "pol:default/foo",
+				},
+				Tuple:    tuple("10.0.0.1", "10.0.0.2", 6, 34567, 80),
+				NumBytes: 1500,
+			}))
+			// The packet with a non-flow log prefix should be skipped.
+			Eventually(packets).Should(Receive(&pkt))
+			Expect(pkt.Prefix.Owner).To(Equal("ep:cali1234"))
+			Expect(pkt.Tuple).To(Equal(tuple("10.0.0.1", "10.0.0.2", 1, 0, 0)))
+			Expect(pkt.NumBytes).To(Equal(84))
+		})
+
+		It("should decode IPv6 packets with extension headers", func() {
+			hopByHop := []byte{17, 0, 0, 0, 0, 0, 0, 0}
+			socket.toReceive <- nflogPacketMessage("AO|rule-2|pro:kns.default",
+				ipv6Packet(0, "fd00::1", "fd00::2", 100, append(hopByHop, ports(5353, 53)...)))
+
+			var pkt *PacketInfo
+			Eventually(packets).Should(Receive(&pkt))
+			Expect(pkt.Tuple).To(Equal(tuple("fd00::1", "fd00::2", 17, 5353, 53)))
+			Expect(pkt.NumBytes).To(Equal(140))
+		})
+
+		It("should not decode ports of non-first IPv6 fragments", func() {
+			fragment := []byte{6, 0, 0x01, 0x00, 0, 0, 0, 1}
+			socket.toReceive <- nflogPacketMessage("AO|rule-2|pro:kns.default",
+				ipv6Packet(44, "fd00::1", "fd00::2", 100, append(fragment, ports(5353, 53)...)))
+
+			var pkt *PacketInfo
+			Eventually(packets).Should(Receive(&pkt))
+			Expect(pkt.Tuple).To(Equal(tuple("fd00::1", "fd00::2", 6, 0, 0)))
+		})
+
+		It("should skip malformed packets", func() {
+			socket.toReceive <- nflogPacketMessage("AI|rule-1|pol:default/foo", []byte{0x45, 0})
+			socket.toReceive <- nflogPacketMessage("AI|rule-1|pol:default/foo",
+				ipv4Packet(17, "10.0.0.1", "10.0.0.2", 60, ports(1, 2)))
+			var pkt *PacketInfo
+			Eventually(packets).Should(Receive(&pkt))
+			Expect(pkt.Tuple).To(Equal(tuple("10.0.0.1", "10.0.0.2", 17, 1, 2)))
+		})
+
+		It("should carry on after a receive buffer overrun", func() {
+			socket.toReceive <- nil
+			socket.toReceive <- nflogPacketMessage("AI|rule-1|pol:default/foo",
+				ipv4Packet(17, "10.0.0.1", "10.0.0.2", 60, ports(1, 2)))
+			var pkt *PacketInfo
+			Eventually(packets).Should(Receive(&pkt))
+			Expect(pkt.Tuple).To(Equal(tuple("10.0.0.1", "10.0.0.2", 17, 1, 2)))
+			Expect(socket.Closed()).To(BeFalse())
+		})
+
+		It("should close the channel if the socket fails", func() {
+			close(socket.toReceive)
+			Eventually(packets).Should(BeClosed())
+			Expect(socket.Closed()).To(BeTrue())
+		})
+	})
+})
@@ -91,8 +91,21 @@ type Config struct {
 	// Configuration parameters.
 	UseInternalDataplaneDriver bool   `config:"bool;true"`
 	DataplaneDriver            string `config:"file(must-exist,executable);calico-iptables-plugin;non-zero,die-on-fail,skip-default-validation"`
-
-	DatastoreType string `config:"oneof(kubernetes,etcdv3);etcdv3;non-zero,die-on-fail,local"`
+	// DataplaneDriverSocket, if set, is the unix socket of an external dataplane driver that
+	// runs as a separate service.  If UseInternalDataplaneDriver is false, Felix connects to it
+	// over gRPC instead of starting DataplaneDriver.
+	DataplaneDriverSocket string `config:"file;;local"`
+	// DataplaneDriverSendTimeout is how long Felix waits for the external dataplane driver to
+	// accept an update before it disconnects from the driver, then reconnects and resyncs it.
+	// 0 means no timeout.
+	DataplaneDriverSendTimeout time.Duration `config:"seconds;10;local"`
+
+	DatastoreType string `config:"oneof(kubernetes,etcdv3,file);etcdv3;non-zero,die-on-fail,local"`
+	// FileDatastorePath is the directory of Calico resources that Felix watches when
+	// DatastoreType is "file"; FileDatastoreStatusFile is where it then reports its status and
+	// the status of its endpoints.
+	FileDatastorePath       string `config:"file;/etc/calico/resources;local"`
+	FileDatastoreStatusFile string `config:"file;/var/run/calico/status.json;local"`
 
 	FelixHostname string `config:"hostname;;local,non-zero"`
 
@@ -112,41 +125,73 @@ type Config struct {
 	Ipv6Support    bool `config:"bool;true"`
 	IgnoreLooseRPF bool `config:"bool;false"`
 
-	RouteRefreshInterval               time.Duration `config:"seconds;90"`
-	IptablesRefreshInterval            time.Duration `config:"seconds;90"`
+	RouteRefreshInterval               time.Duration `config:"seconds;90;live"`
+	IptablesRefreshInterval            time.Duration `config:"seconds;90;live"`
 	IptablesPostWriteCheckIntervalSecs time.Duration `config:"seconds;1"`
 	IptablesLockFilePath               string        `config:"file;/run/xtables.lock"`
 	IptablesLockTimeoutSecs            time.Duration `config:"seconds;0"`
 	IptablesLockProbeIntervalMillis    time.Duration `config:"millis;50"`
-	IpsetsRefreshInterval              time.Duration `config:"seconds;10"`
+	IpsetsRefreshInterval              time.Duration `config:"seconds;10;live"`
 	MaxIpsetSize                       int           `config:"int;1048576;non-zero"`
 
 	PolicySyncPathPrefix string `config:"file;;"`
+	// PolicySyncMaxQueueLen is the number of updates that Felix queues for a policy sync client
+	// before it disconnects the client for falling behind.
+	PolicySyncMaxQueueLen int `config:"int;10000;non-zero"`
 
 	NetlinkTimeoutSecs time.Duration `config:"seconds;10"`
 
+	// WarmStartSnapshotFile, if set, is where the internal dataplane driver saves the state
+	// that it has applied, at most once per WarmStartSaveInterval.  After a restart, the driver
+	// reprograms that state straight away instead of waiting for the datastore resync, as long
+	// as the snapshot was saved with the same config and within WarmStartMaxAge.
+	WarmStartSnapshotFile string        `config:"file;;local"`
+	WarmStartMaxAge       time.Duration `config:"seconds;3600;local"`
+	WarmStartSaveInterval time.Duration `config:"seconds;10;local"`
+
 	MetadataAddr string `config:"hostname;127.0.0.1;die-on-fail"`
 	MetadataPort int    `config:"int(0,65535);8775;die-on-fail"`
 
 	InterfacePrefix  string `config:"iface-list;cali;non-zero,die-on-fail"`
 	InterfaceExclude string `config:"iface-list;kube-ipvs0"`
 
+	DataplaneBackend            string `config:"oneof(iptables,nftables);iptables;non-zero,die-on-fail"`
+	IpsetsBackend               string `config:"oneof(ipset-restore,netlink);ipset-restore;non-zero,die-on-fail"`
 	ChainInsertMode             string `config:"oneof(insert,append);insert;non-zero,die-on-fail"`
-	DefaultEndpointToHostAction string `config:"oneof(DROP,RETURN,ACCEPT);DROP;non-zero,die-on-fail"`
+	DefaultEndpointToHostAction string `config:"oneof(DROP,RETURN,ACCEPT);DROP;non-zero,die-on-fail,live"`
 	IptablesFilterAllowAction   string `config:"oneof(ACCEPT,RETURN);ACCEPT;non-zero,die-on-fail"`
 	IptablesMangleAllowAction   string `config:"oneof(ACCEPT,RETURN);ACCEPT;non-zero,die-on-fail"`
-	LogPrefix                   string `config:"string;calico-packet"`
+	LogPrefix                   string `config:"string;calico-packet;live"`
 
 	LogFilePath string `config:"file;/var/log/calico/felix.log;die-on-fail"`
 
-	LogSeverityFile   string `config:"oneof(DEBUG,INFO,WARNING,ERROR,FATAL);INFO"`
-	LogSeverityScreen string `config:"oneof(DEBUG,INFO,WARNING,ERROR,FATAL);INFO"`
-	LogSeveritySys    string `config:"oneof(DEBUG,INFO,WARNING,ERROR,FATAL);INFO"`
+	LogSeverityFile   string `config:"oneof(DEBUG,INFO,WARNING,ERROR,FATAL);INFO;live"`
+	LogSeverityScreen string `config:"oneof(DEBUG,INFO,WARNING,ERROR,FATAL);INFO;live"`
+	LogSeveritySys    string `config:"oneof(DEBUG,INFO,WARNING,ERROR,FATAL);INFO;live"`
 
 	IpInIpEnabled    bool   `config:"bool;false"`
 	IpInIpMtu        int    `config:"int;1440;non-zero"`
 	IpInIpTunnelAddr net.IP `config:"ipv4;"`
 
+	// IpInIpV6* configure the IPv6-in-IPv6 tunnel, which carries IPv6 workload traffic
+	// between hosts.  The MTU default allows for the larger IPv6 outer header.
+	IpInIpV6Enabled    bool   `config:"bool;false"`
+	IpInIpV6Mtu        int    `config:"int;1420;non-zero"`
+	IpInIpV6TunnelAddr net.IP `config:"ipv6;"`
+
+	// VXLAN* configure the VXLAN overlay, an alternative to IPIP for networks that drop IP
+	// protocol 4.  The MTU default allows for the 50-byte VXLAN header.
+	VXLANEnabled    bool   `config:"bool;false"`
+	VXLANVNI        int    `config:"int;4096;non-zero"`
+	VXLANPort       int    `config:"int(0,65535);4789;non-zero"`
+	VXLANMTU        int    `config:"int;1410;non-zero"`
+	VXLANTunnelAddr net.IP `config:"ipv4;"`
+
+	// RemoteRoutesEnabled tells Felix to program the routes to other hosts' IPAM blocks, via
+	// the IPIP tunnel if it's enabled, so that BIRD isn't needed.  VXLAN always programs its
+	// own routes.  Felix only learns the blocks when it talks to an etcd datastore directly.
+	RemoteRoutesEnabled bool `config:"bool;false"`
+
 	ReportingIntervalSecs time.Duration `config:"seconds;30"`
 	ReportingTTLSecs      time.Duration `config:"seconds;90"`
 
@@ -159,27 +204,49 @@ type Config struct {
 
 	HealthEnabled                   bool `config:"bool;false"`
 	HealthPort                      int  `config:"int(0,65535);9099"`
+	CalcGraphDebugEnabled           bool `config:"bool;false"`
+	CalcGraphDebugPort              int  `config:"int(0,65535);9097"`
 	PrometheusMetricsEnabled        bool `config:"bool;false"`
 	PrometheusMetricsPort           int  `config:"int(0,65535);9091"`
 	PrometheusGoMetricsEnabled      bool `config:"bool;true"`
 	PrometheusProcessMetricsEnabled bool `config:"bool;true"`
 
-	FailsafeInboundHostPorts  []ProtoPort `config:"port-list;tcp:22,udp:68,tcp:179,tcp:2379,tcp:2380,tcp:6666,tcp:6667;die-on-fail"`
-	FailsafeOutboundHostPorts []ProtoPort `config:"port-list;udp:53,udp:67,tcp:179,tcp:2379,tcp:2380,tcp:6666,tcp:6667;die-on-fail"`
+	FlowLogsEnabled           bool          `config:"bool;false"`
+	FlowLogsNflogGroup        int           `config:"int(1,65535);20"`
+	FlowLogsFlushInterval     time.Duration `config:"seconds;300"`
+	FlowLogsFileDirectory     string        `config:"file;/var/log/calico/flowlogs"`
+	FlowLogsFileMaxFileSizeMB int           `config:"int;100;non-zero"`
+	FlowLogsFileMaxFiles      int           `config:"int;5;non-zero"`
+
+	RuleCountersEnabled         bool          `config:"bool;false"`
+	RuleCountersPollInterval    time.Duration `config:"seconds;10;non-zero"`
+	RuleCountersPolicyAllowlist string        `config:"string;"`
+	RuleCountersMaxRules        int           `config:"int;1000;non-zero"`
+
+	// ConntrackTeardown* configure the optional teardown of established connections that a
+	// policy change has made disallowed.  Without it, the conntrack fast path keeps such
+	// connections open until they end.
+	ConntrackTeardownEnabled             bool          `config:"bool;false"`
+	ConntrackTeardownMaxDeletesPerSecond int           `config:"int;100;non-zero"`
+	ConntrackTeardownMinScanInterval     time.Duration `config:"seconds;1"`
+
+	FailsafeInboundHostPorts  []ProtoPort `config:"port-list;tcp:22,udp:68,tcp:179,tcp:2379,tcp:2380,tcp:6666,tcp:6667;die-on-fail,live"`
+	FailsafeOutboundHostPorts []ProtoPort `config:"port-list;udp:53,udp:67,tcp:179,tcp:2379,tcp:2380,tcp:6666,tcp:6667;die-on-fail,live"`
 
 	KubeNodePortRanges []numorstring.Port `config:"portrange-list;30000:32767"`
 
 	UsageReportingEnabled          bool          `config:"bool;true"`
 	UsageReportingInitialDelaySecs time.Duration `config:"seconds;300"`
 	UsageReportingIntervalSecs     time.Duration `config:"seconds;86400"`
-	ClusterGUID                    string        `config:"string;baddecaf"`
-	ClusterType                    string        `config:"string;"`
-	CalicoVersion                  string        `config:"string;"`
+	ClusterGUID                    string        `config:"string;baddecaf;live"`
+	ClusterType                    string        `config:"string;;live"`
+	CalicoVersion                  string        `config:"string;;live"`
 
 	DebugMemoryProfilePath          string        `config:"file;;"`
 	DebugDisableLogDropping         bool          `config:"bool;false"`
 	DebugSimulateCalcGraphHangAfter time.Duration `config:"seconds;0"`
 	DebugSimulateDataplaneHangAfter time.Duration `config:"seconds;0"`
+	DebugSyncerRecordingFile        string        `config:"file;;"`
 
 	// State tracking.
 
@@ -223,6 +290,19 @@ func (c *Config) InterfacePrefixes() []string {
 	return strings.Split(c.InterfacePrefix, ",")
 }
 
+// RuleCountersPolicies returns the names of the policies and profiles whose rule counters should
+// be exported, or nil if all of them should be exported.
+func (c *Config) RuleCountersPolicies() []string {
+	var names []string
+	for _, name := range strings.Split(c.RuleCountersPolicyAllowlist, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 func (c *Config) InterfaceExcludes() []string {
 	return strings.Split(c.InterfaceExclude, ",")
 }
@@ -384,10 +464,10 @@ func (config *Config) DatastoreConfig() apiconfig.CalicoAPIConfig {
 		}
 	}
 
-	if !config.IpInIpEnabled {
+	if !config.IpInIpEnabled && !config.IpInIpV6Enabled && !config.VXLANEnabled && !config.RemoteRoutesEnabled {
 		// Polling k8s for node updates is expensive (because we get many superfluous
 		// updates) so disable if we don't need it.
-		log.Info("IPIP disabled, disabling node poll (if KDD is in use).")
+		log.Info("IPIP, VXLAN and remote routes disabled, disabling node poll (if KDD is in use).")
 		cfg.Spec.K8sDisableNodePoll = true
 	}
 	return *cfg
@@ -408,6 +488,10 @@ func (config *Config) Validate() (err error) {
 		}
 	}
 
+	if config.DatastoreType == "file" && config.FileDatastorePath == "" {
+		err = errors.New("FileDatastorePath missing")
+	}
+
 	if err != nil {
 		config.Err = err
 	}
@@ -481,6 +565,8 @@ func loadParams() {
 				Msg: "invalid URL authority"}
 		case "ipv4":
 			param = &Ipv4Param{}
+		case "ipv6":
+			param = &Ipv6Param{}
 		case "endpoint-list":
 			param = &EndpointListParam{}
 		case "port-list":
@@ -517,6 +603,9 @@ func loadParams() {
 		if strings.Index(flags, "local") > -1 {
 			metadata.Local = true
 		}
+		if strings.Index(flags, "live") > -1 {
+			metadata.LiveReload = true
+		}
 
 		if defaultStr != "" {
 			if strings.Index(flags, "skip-default-validation") > -1 {
@@ -537,6 +626,19 @@ func loadParams() {
 	}
 }
 
+// ParamIsLiveReloadable returns true if a change to the named parameter can be applied to a
+// running Felix, without a restart.  Returns false for unknown parameters.
+func ParamIsLiveReloadable(name string) bool {
+	if knownParams == nil {
+		loadParams()
+	}
+	param, ok := knownParams[strings.ToLower(name)]
+	if !ok {
+		return false
+	}
+	return param.GetMetadata().LiveReload
+}
+
 func (config *Config) RawValues() map[string]string {
 	return config.rawValues
 }
@@ -562,6 +664,18 @@ func New() *Config {
 	return p
 }
 
+// NewFromRawValues creates a Config from the resolved raw values of another Config, such as
+// those that are sent to the dataplane driver in a ConfigUpdate message.
+func NewFromRawValues(rawValues map[string]string) (*Config, error) {
+	p := New()
+	// The values have already been resolved, including any local-only values, so we load
+	// them as if they came from a local source.
+	if _, err := p.UpdateFrom(rawValues, ConfigFile); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
 type param interface {
 	GetMetadata() *Metadata
 	Parse(raw string) (result interface{}, err error)
@@ -47,9 +47,12 @@ var _ = Describe("FelixConfig vs ConfigParams parity", func() {
 
 		// Moved to Node.
 		"IpInIpTunnelAddr",
+		"IpInIpV6TunnelAddr",
+		"VXLANTunnelAddr",
 
 		// FIXME Remove this once libcalico-go supports policy-sync API!
 		"PolicySyncPathPrefix",
+		"PolicySyncMaxQueueLen",
 	}
 	cpFieldNameToFC := map[string]string{
 		"IpInIpEnabled":                      "IPIPEnabled",
@@ -164,6 +167,11 @@ var _ = DescribeTable("Config parsing",
 
 	Entry("ChainInsertMode append", "ChainInsertMode", "append", "append"),
 
+	Entry("DataplaneBackend nftables", "DataplaneBackend", "nftables", "nftables"),
+	Entry("DataplaneBackend garbage", "DataplaneBackend", "ebtables", "iptables", true),
+	Entry("IpsetsBackend netlink", "IpsetsBackend", "netlink", "netlink"),
+	Entry("IpsetsBackend garbage", "IpsetsBackend", "ipset", "ipset-restore", true),
+
 	Entry("IptablesPostWriteCheckIntervalSecs", "IptablesPostWriteCheckIntervalSecs",
 		"1.5", 1500*time.Millisecond),
 	Entry("IptablesLockFilePath", "IptablesLockFilePath",
@@ -210,6 +218,38 @@ var _ = DescribeTable("Config parsing",
 	Entry("IpInIpTunnelAddr", "IpInIpTunnelAddr",
 		"10.0.0.1", net.ParseIP("10.0.0.1")),
 
+	Entry("IpInIpV6Enabled", "IpInIpV6Enabled", "true", true),
+	Entry("IpInIpV6Mtu", "IpInIpV6Mtu", "1234", int(1234)),
+	Entry("IpInIpV6Mtu default", "IpInIpV6Mtu", "", int(1420)),
+	Entry("IpInIpV6TunnelAddr", "IpInIpV6TunnelAddr",
+		"fd00::1", net.ParseIP("fd00::1")),
+	Entry("IpInIpV6TunnelAddr IPv4", "IpInIpV6TunnelAddr",
+		"10.0.0.1", net.IP(nil)),
+
+	Entry("VXLANEnabled", "VXLANEnabled", "true", true),
+	Entry("VXLANVNI", "VXLANVNI", "4097", int(4097)),
+	Entry("VXLANVNI default", "VXLANVNI", "", int(4096)),
+	Entry("VXLANPort", "VXLANPort", "8472", int(8472)),
+	Entry("VXLANPort default", "VXLANPort", "", int(4789)),
+	Entry("VXLANPort out of range", "VXLANPort", "65536", int(4789)),
+	Entry("VXLANMTU", "VXLANMTU", "1234", int(1234)),
+	Entry("VXLANMTU default", "VXLANMTU", "", int(1410)),
+	Entry("RemoteRoutesEnabled", "RemoteRoutesEnabled", "true", true),
+	Entry("RemoteRoutesEnabled default", "RemoteRoutesEnabled", "", false),
+	Entry("PolicySyncMaxQueueLen", "PolicySyncMaxQueueLen", "100", int(100)),
+	Entry("PolicySyncMaxQueueLen default", "PolicySyncMaxQueueLen", "", int(10000)),
+	Entry("DataplaneDriverSocket", "DataplaneDriverSocket", "/var/run/calico/dataplane.sock", "/var/run/calico/dataplane.sock"),
+	Entry("DataplaneDriverSocket default", "DataplaneDriverSocket", "", ""),
+	Entry("DataplaneDriverSendTimeout", "DataplaneDriverSendTimeout", "3", 3*time.Second),
+	Entry("DataplaneDriverSendTimeout default", "DataplaneDriverSendTimeout", "", 10*time.Second),
+	Entry("DatastoreType file", "DatastoreType", "file", "file"),
+	Entry("FileDatastorePath", "FileDatastorePath", "/etc/felix/resources", "/etc/felix/resources"),
+	Entry("FileDatastorePath default", "FileDatastorePath", "", "/etc/calico/resources"),
+	Entry("FileDatastoreStatusFile", "FileDatastoreStatusFile", "/tmp/status.json", "/tmp/status.json"),
+	Entry("FileDatastoreStatusFile default", "FileDatastoreStatusFile", "", "/var/run/calico/status.json"),
+	Entry("VXLANTunnelAddr", "VXLANTunnelAddr",
+		"10.0.0.1", net.ParseIP("10.0.0.1")),
+
 	Entry("ReportingIntervalSecs", "ReportingIntervalSecs", "31", 31*time.Second),
 	Entry("ReportingTTLSecs", "ReportingTTLSecs", "91", 91*time.Second),
 
@@ -223,11 +263,42 @@ var _ = DescribeTable("Config parsing",
 	Entry("MaxIpsetSize", "MaxIpsetSize", "12345", int(12345)),
 	Entry("IptablesMarkMask", "IptablesMarkMask", "0xf0f0", uint32(0xf0f0)),
 
+	Entry("CalcGraphDebugEnabled", "CalcGraphDebugEnabled", "true", true),
+	Entry("CalcGraphDebugPort", "CalcGraphDebugPort", "1234", int(1234)),
+
 	Entry("PrometheusMetricsEnabled", "PrometheusMetricsEnabled", "true", true),
 	Entry("PrometheusMetricsPort", "PrometheusMetricsPort", "1234", int(1234)),
 	Entry("PrometheusGoMetricsEnabled", "PrometheusGoMetricsEnabled", "false", false),
 	Entry("PrometheusProcessMetricsEnabled", "PrometheusProcessMetricsEnabled", "false", false),
 
+	Entry("FlowLogsEnabled", "FlowLogsEnabled", "true", true),
+	Entry("FlowLogsNflogGroup", "FlowLogsNflogGroup", "30", int(30)),
+	Entry("FlowLogsNflogGroup out of range", "FlowLogsNflogGroup", "65536", int(20)),
+	Entry("FlowLogsFlushInterval", "FlowLogsFlushInterval", "60", 60*time.Second),
+	Entry("FlowLogsFileDirectory", "FlowLogsFileDirectory", "/tmp/flows", "/tmp/flows"),
+	Entry("FlowLogsFileMaxFileSizeMB", "FlowLogsFileMaxFileSizeMB", "10", int(10)),
+	Entry("FlowLogsFileMaxFiles", "FlowLogsFileMaxFiles", "2", int(2)),
+
+	Entry("RuleCountersEnabled", "RuleCountersEnabled", "true", true),
+	Entry("RuleCountersPollInterval", "RuleCountersPollInterval", "30", 30*time.Second),
+	Entry("RuleCountersPolicyAllowlist", "RuleCountersPolicyAllowlist", "default.foo,default.bar", "default.foo,default.bar"),
+	Entry("RuleCountersMaxRules", "RuleCountersMaxRules", "50", int(50)),
+
+	Entry("ConntrackTeardownEnabled", "ConntrackTeardownEnabled", "true", true),
+	Entry("ConntrackTeardownEnabled default", "ConntrackTeardownEnabled", "", false),
+	Entry("ConntrackTeardownMaxDeletesPerSecond", "ConntrackTeardownMaxDeletesPerSecond", "20", int(20)),
+	Entry("ConntrackTeardownMaxDeletesPerSecond default", "ConntrackTeardownMaxDeletesPerSecond", "", int(100)),
+	Entry("ConntrackTeardownMinScanInterval", "ConntrackTeardownMinScanInterval", "5", 5*time.Second),
+
+	Entry("WarmStartSnapshotFile", "WarmStartSnapshotFile", "/var/lib/calico/snapshot", "/var/lib/calico/snapshot"),
+	Entry("WarmStartSnapshotFile default", "WarmStartSnapshotFile", "", ""),
+	Entry("WarmStartMaxAge", "WarmStartMaxAge", "60", 60*time.Second),
+	Entry("WarmStartMaxAge default", "WarmStartMaxAge", "", 3600*time.Second),
+	Entry("WarmStartSaveInterval default", "WarmStartSaveInterval", "", 10*time.Second),
+
+	Entry("DebugSyncerRecordingFile", "DebugSyncerRecordingFile", "/tmp/syncer.rec.gz", "/tmp/syncer.rec.gz"),
+	Entry("DebugSyncerRecordingFile default", "DebugSyncerRecordingFile", "", ""),
+
 	Entry("FailsafeInboundHostPorts old syntax", "FailsafeInboundHostPorts", "1,2,3,4",
 		[]ProtoPort{
 			{Protocol: "tcp", Port: 1},
@@ -378,6 +449,36 @@ var _ = Describe("DatastoreConfig tests", func() {
 			Expect(c.DatastoreConfig().Spec.K8sDisableNodePoll).To(BeFalse())
 		})
 	})
+	Describe("with IPv6 IPIP enabled", func() {
+		BeforeEach(func() {
+			c = New()
+			c.DatastoreType = "k8s"
+			c.IpInIpV6Enabled = true
+		})
+		It("should leave node polling enabled", func() {
+			Expect(c.DatastoreConfig().Spec.K8sDisableNodePoll).To(BeFalse())
+		})
+	})
+	Describe("with VXLAN enabled", func() {
+		BeforeEach(func() {
+			c = New()
+			c.DatastoreType = "k8s"
+			c.VXLANEnabled = true
+		})
+		It("should leave node polling enabled", func() {
+			Expect(c.DatastoreConfig().Spec.K8sDisableNodePoll).To(BeFalse())
+		})
+	})
+	Describe("with remote routes enabled", func() {
+		BeforeEach(func() {
+			c = New()
+			c.DatastoreType = "k8s"
+			c.RemoteRoutesEnabled = true
+		})
+		It("should leave node polling enabled", func() {
+			Expect(c.DatastoreConfig().Spec.K8sDisableNodePoll).To(BeFalse())
+		})
+	})
 	Describe("with IPIP disabled", func() {
 		BeforeEach(func() {
 			c = New()
@@ -389,3 +490,62 @@ var _ = Describe("DatastoreConfig tests", func() {
 		})
 	})
 })
+
+var _ = DescribeTable("Live reload classification",
+	func(name string, expected bool) {
+		Expect(ParamIsLiveReloadable(name)).To(Equal(expected))
+	},
+
+	Entry("LogSeverityScreen", "LogSeverityScreen", true),
+	Entry("lower-case name", "logseverityscreen", true),
+	Entry("IptablesRefreshInterval", "IptablesRefreshInterval", true),
+	Entry("IpsetsRefreshInterval", "IpsetsRefreshInterval", true),
+	Entry("RouteRefreshInterval", "RouteRefreshInterval", true),
+	Entry("FailsafeInboundHostPorts", "FailsafeInboundHostPorts", true),
+	Entry("FailsafeOutboundHostPorts", "FailsafeOutboundHostPorts", true),
+	Entry("DefaultEndpointToHostAction", "DefaultEndpointToHostAction", true),
+	Entry("LogPrefix", "LogPrefix", true),
+	Entry("ClusterGUID", "ClusterGUID", true),
+	Entry("InterfacePrefix", "InterfacePrefix", false),
+	Entry("IptablesMarkMask", "IptablesMarkMask", false),
+	Entry("DatastoreType", "DatastoreType", false),
+	Entry("unknown param", "NotAParam", false),
+)
+
+var _ = Describe("NewFromRawValues", func() {
+	It("should round-trip the raw values of another config", func() {
+		c := New()
+		_, err := c.UpdateFrom(map[string]string{
+			"LogPrefix":                "foo",
+			"IptablesMarkMask":         "0xff000000",
+			"EtcdAddr":                 "10.0.0.1:2379",
+			"FailsafeInboundHostPorts": "tcp:1022",
+		}, EnvironmentVariable)
+		Expect(err).NotTo(HaveOccurred())
+
+		c2, err := NewFromRawValues(c.RawValues())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c2.LogPrefix).To(Equal("foo"))
+		Expect(c2.IptablesMarkMask).To(Equal(uint32(0xff000000)))
+		Expect(c2.EtcdAddr).To(Equal("10.0.0.1:2379"))
+		Expect(c2.FailsafeInboundHostPorts).To(Equal([]ProtoPort{{Protocol: "tcp", Port: 1022}}))
+		Expect(c2.RawValues()).To(Equal(c.RawValues()))
+	})
+
+	It("should return an error for a bad value", func() {
+		_, err := NewFromRawValues(map[string]string{"IptablesMarkMask": "not a mask"})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = DescribeTable("RuleCountersPolicies",
+	func(allowlist string, expected []string) {
+		c := New()
+		c.RuleCountersPolicyAllowlist = allowlist
+		Expect(c.RuleCountersPolicies()).To(Equal(expected))
+	},
+
+	Entry("empty", "", []string(nil)),
+	Entry("single policy", "default.foo", []string{"default.foo"}),
+	Entry("multiple policies with spaces", "default.foo, default.bar,", []string{"default.foo", "default.bar"}),
+)
@@ -45,6 +45,9 @@ type Metadata struct {
 	NonZero           bool
 	DieOnParseFailure bool
 	Local             bool
+	// LiveReload is true if a change to the parameter can be applied without restarting
+	// Felix.
+	LiveReload bool
 }
 
 func (m *Metadata) GetMetadata() *Metadata {
@@ -238,6 +241,20 @@ func (p *Ipv4Param) Parse(raw string) (result interface{}, err error) {
 	return
 }
 
+type Ipv6Param struct {
+	Metadata
+}
+
+func (p *Ipv6Param) Parse(raw string) (result interface{}, err error) {
+	ip := net.ParseIP(raw)
+	if ip == nil || ip.To4() != nil {
+		err = p.parseFailed(raw, "invalid IPv6 address")
+		return
+	}
+	result = ip
+	return
+}
+
 type PortListParam struct {
 	Metadata
 }
@@ -1,4 +1,4 @@
-// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+// Copyright (c) 2016-2018 Tigera, Inc. All rights reserved.
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -16,8 +16,8 @@ package conntrack
 
 import (
 	"net"
-	"os/exec"
 	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -42,39 +42,171 @@ var deleteDirections = []string{
 
 const numRetries = 3
 
+// Conntrack deletes conntrack flows, either by running the conntrack command or, if it was
+// created by New or NewWithNetlinkShim, by using the kernel's netlink API directly.
+//
+// With the netlink API, removing the flows for an IP means dumping the whole conntrack table, so
+// concurrent calls to RemoveConntrackFlows are coalesced: while one pass over the table is in
+// progress, later requests are queued up and then handled together in the next pass.
 type Conntrack struct {
-	newCmd newCmd
+	newCmd  newCmd
+	netlink *ctNetlink
+
+	batchLock      sync.Mutex
+	nextBatch      *removalBatch
+	passInProgress bool
 }
 
-func New() *Conntrack {
-	return NewWithCmdShim(func(name string, arg ...string) CmdIface {
-		return exec.Command(name, arg...)
-	})
+// removalBatch is a set of IPs whose flows will be removed in the same pass.  done is closed
+// when the pass is complete.
+type removalBatch struct {
+	ipsByVersion map[uint8][]net.IP
+	done         chan struct{}
 }
 
-// NewWithCmdShim is a test constructor that allows for shimming exec.Command.
+// NewWithCmdShim is a test constructor that allows for shimming exec.Command.  The returned
+// Conntrack uses the conntrack command rather than netlink.
 func NewWithCmdShim(newCmd newCmd) *Conntrack {
 	return &Conntrack{
 		newCmd: newCmd,
 	}
 }
 
+// NewWithNetlinkShim is a test constructor that allows for shimming the netlink socket.
+func NewWithNetlinkShim(newSocket NetlinkSocketFactory) *Conntrack {
+	return &Conntrack{
+		netlink: newCTNetlink(newSocket),
+	}
+}
+
 type newCmd func(name string, arg ...string) CmdIface
 
 type CmdIface interface {
 	CombinedOutput() ([]byte, error)
 }
 
-func (c Conntrack) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {
-	var family string
-	switch ipVersion {
-	case 4:
-		family = "ipv4"
-	case 6:
-		family = "ipv6"
-	default:
-		log.WithField("version", ipVersion).Panic("Unknown IP version")
+// RemoveConntrackFlows removes the flows to and from the given IP, that is, the flows that have
+// the IP as their original or reply source.
+func (c *Conntrack) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {
+	c.RemoveConntrackFlowsForIPs(ipVersion, []net.IP{ipAddr})
+}
+
+// RemoveConntrackFlowsForIPs removes the flows to and from each of the given IPs.  With the
+// netlink API, that is done in a single pass over the conntrack table.
+func (c *Conntrack) RemoveConntrackFlowsForIPs(ipVersion uint8, ipAddrs []net.IP) {
+	family := ipVersionToFamily(ipVersion)
+	if c.netlink == nil {
+		for _, ipAddr := range ipAddrs {
+			c.removeFlowsWithCmd(family, ipAddr)
+		}
+		return
 	}
+
+	c.batchLock.Lock()
+	if c.nextBatch == nil {
+		c.nextBatch = &removalBatch{
+			ipsByVersion: map[uint8][]net.IP{},
+			done:         make(chan struct{}),
+		}
+	}
+	batch := c.nextBatch
+	batch.ipsByVersion[ipVersion] = append(batch.ipsByVersion[ipVersion], ipAddrs...)
+	runPasses := !c.passInProgress
+	c.passInProgress = true
+	c.batchLock.Unlock()
+
+	if runPasses {
+		c.runRemovalPasses()
+	}
+	<-batch.done
+}
+
+// ListFlows returns the conntrack flows for the given IP version.  Only supported with the
+// netlink API.
+func (c *Conntrack) ListFlows(ipVersion uint8) ([]*Flow, error) {
+	ipVersionToFamily(ipVersion)
+	if c.netlink == nil {
+		return nil, ErrNotSupported
+	}
+	return c.netlink.list(nfproto(ipVersion))
+}
+
+// DeleteFlows deletes the conntrack flows for the given IP version that match any of the
+// filters, in a single pass over the conntrack table.  It returns the number of flows that it
+// deleted.  Only supported with the netlink API.
+func (c *Conntrack) DeleteFlows(ipVersion uint8, filters ...FlowFilter) (int, error) {
+	return c.DeleteFlowsFunc(ipVersion, func(flow *Flow) bool {
+		for _, f := range filters {
+			if f.Matches(flow) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// DeleteFlowsFunc is like DeleteFlows but it takes an arbitrary predicate.  The predicate is
+// called while the table is being dumped so it should be fast.
+func (c *Conntrack) DeleteFlowsFunc(ipVersion uint8, match func(flow *Flow) bool) (int, error) {
+	ipVersionToFamily(ipVersion)
+	if c.netlink == nil {
+		return 0, ErrNotSupported
+	}
+	countDeletionPasses.Inc()
+	numDeleted, err := c.netlink.deleteFlows(nfproto(ipVersion), match)
+	countFlowsDeleted.Add(float64(numDeleted))
+	return numDeleted, err
+}
+
+// runRemovalPasses handles queued batches until there are none left.  Only one goroutine runs
+// the passes at a time; the others wait for their batch to be done.
+func (c *Conntrack) runRemovalPasses() {
+	for {
+		c.batchLock.Lock()
+		batch := c.nextBatch
+		c.nextBatch = nil
+		if batch == nil {
+			c.passInProgress = false
+			c.batchLock.Unlock()
+			return
+		}
+		c.batchLock.Unlock()
+
+		for _, ipVersion := range []uint8{4, 6} {
+			if ipAddrs := batch.ipsByVersion[ipVersion]; len(ipAddrs) > 0 {
+				c.removeFlowsWithNetlink(ipVersion, ipAddrs)
+			}
+		}
+		close(batch.done)
+	}
+}
+
+func (c *Conntrack) removeFlowsWithNetlink(ipVersion uint8, ipAddrs []net.IP) {
+	ipStrs := map[string]bool{}
+	for _, ipAddr := range ipAddrs {
+		ipStrs[ipAddr.String()] = true
+	}
+	logCxt := log.WithFields(log.Fields{"ipVersion": ipVersion, "numIPs": len(ipStrs)})
+	logCxt.WithField("ips", ipAddrs).Info("Removing conntrack flows")
+	// See the comment on deleteDirections for why we look at these two fields.
+	match := func(flow *Flow) bool {
+		return ipStrs[flow.Orig.Src.String()] || ipStrs[flow.Reply.Src.String()]
+	}
+	for retry := 0; retry <= numRetries; retry++ {
+		numDeleted, err := c.DeleteFlowsFunc(ipVersion, match)
+		if err == nil {
+			logCxt.WithField("numDeleted", numDeleted).Debug("Successfully removed conntrack flows.")
+			return
+		}
+		if retry == numRetries {
+			logCxt.WithError(err).Error("Failed to remove conntrack flows after retries.")
+		} else {
+			logCxt.WithError(err).Warn("Failed to remove conntrack flows, will retry...")
+		}
+	}
+}
+
+func (c *Conntrack) removeFlowsWithCmd(family string, ipAddr net.IP) {
 	log.WithField("ip", ipAddr).Info("Removing conntrack flows")
 	for _, direction := range deleteDirections {
 		logCxt := log.WithFields(log.Fields{"ip": ipAddr, "direction": direction})
@@ -102,3 +234,14 @@ func (c Conntrack) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {
 		}
 	}
 }
+
+func ipVersionToFamily(ipVersion uint8) string {
+	switch ipVersion {
+	case 4:
+		return "ipv4"
+	case 6:
+		return "ipv6"
+	}
+	log.WithField("version", ipVersion).Panic("Unknown IP version")
+	return ""
+}
@@ -0,0 +1,480 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conntrack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/nfnetlink"
+)
+
+// Constants from linux/netfilter/nfnetlink.h and linux/netfilter/nfnetlink_conntrack.h.
+const (
+	nfnlSubsysCTNetlink = 1
+
+	ipctnlMsgCtNew    = 0
+	ipctnlMsgCtGet    = 1
+	ipctnlMsgCtDelete = 2
+
+	// Top-level attributes.
+	ctaTupleOrig     = 1
+	ctaTupleReply    = 2
+	ctaMark          = 8
+	ctaCountersOrig  = 9
+	ctaCountersReply = 10
+	ctaID            = 12
+	ctaZone          = 18
+
+	// Attributes nested inside ctaTupleOrig and ctaTupleReply.
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	// Attributes nested inside ctaTupleIP.
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	// Attributes nested inside ctaTupleProto.
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+
+	// Attributes nested inside ctaCountersOrig and ctaCountersReply.  Old kernels send 32-bit
+	// counters.
+	ctaCountersPackets   = 1
+	ctaCountersBytes     = 2
+	ctaCounters32Packets = 3
+	ctaCounters32Bytes   = 4
+
+	errnoENOENT = 2
+)
+
+var (
+	countFlowsDumped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_conntrack_flows_dumped",
+		Help: "Number of conntrack flows read from the kernel while looking for flows to delete.",
+	})
+	countFlowsDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_conntrack_flows_deleted",
+		Help: "Number of conntrack flows deleted.",
+	})
+	countNetlinkErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_conntrack_netlink_errors",
+		Help: "Number of failed conntrack netlink requests.",
+	})
+	countDeletionPasses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_conntrack_deletion_passes",
+		Help: "Number of passes over the conntrack table to delete flows.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(countFlowsDumped)
+	prometheus.MustRegister(countFlowsDeleted)
+	prometheus.MustRegister(countNetlinkErrors)
+	prometheus.MustRegister(countDeletionPasses)
+}
+
+// ErrNotSupported is returned by the Conntrack methods that need the netlink API when the
+// Conntrack was created to use the conntrack command instead.
+var ErrNotSupported = errors.New("operation not supported by the conntrack command backend")
+
+// NetlinkSocket is a shim for a NETLINK_NETFILTER socket; it allows the netlink API to be
+// mocked in UT.
+type NetlinkSocket = nfnetlink.Socket
+
+type NetlinkSocketFactory = nfnetlink.SocketFactory
+
+// NetlinkError is returned when the kernel rejects one of our requests.
+type NetlinkError = nfnetlink.Error
+
+// Tuple is one direction of a conntrack flow.  The ports are zero for protocols that don't have
+// them.
+type Tuple struct {
+	Src     net.IP
+	Dst     net.IP
+	Proto   uint8
+	SrcPort uint16
+	DstPort uint16
+}
+
+func (t Tuple) String() string {
+	return fmt.Sprintf("proto %d %s -> %s",
+		t.Proto,
+		net.JoinHostPort(t.Src.String(), strconv.Itoa(int(t.SrcPort))),
+		net.JoinHostPort(t.Dst.String(), strconv.Itoa(int(t.DstPort))))
+}
+
+// Counters are the packet and byte counts of one direction of a flow.
+type Counters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// Flow is a conntrack entry, as read from the kernel.
+type Flow struct {
+	Orig  Tuple
+	Reply Tuple
+	Zone  uint16
+	Mark  uint32
+	ID    uint32
+	// OrigCounters and ReplyCounters are nil unless conntrack accounting is enabled
+	// (net.netfilter.nf_conntrack_acct).
+	OrigCounters  *Counters
+	ReplyCounters *Counters
+
+	// origTupleAttr is the raw CTA_TUPLE_ORIG attribute, which we send back to the kernel to
+	// delete the flow.
+	origTupleAttr []byte
+	hasID         bool
+}
+
+// FlowFilter selects conntrack flows.  Fields that are left as their zero value match any flow.
+type FlowFilter struct {
+	OrigSrc  net.IP
+	OrigDst  net.IP
+	ReplySrc net.IP
+	ReplyDst net.IP
+	// Zone, if non-nil, restricts the filter to flows in the given conntrack zone.
+	Zone *uint16
+	// Mark and MarkMask select the flows for which (mark & MarkMask) == Mark.  If MarkMask is
+	// zero, the mark isn't checked.
+	Mark     uint32
+	MarkMask uint32
+}
+
+func (f FlowFilter) Matches(flow *Flow) bool {
+	if f.OrigSrc != nil && !f.OrigSrc.Equal(flow.Orig.Src) {
+		return false
+	}
+	if f.OrigDst != nil && !f.OrigDst.Equal(flow.Orig.Dst) {
+		return false
+	}
+	if f.ReplySrc != nil && !f.ReplySrc.Equal(flow.Reply.Src) {
+		return false
+	}
+	if f.ReplyDst != nil && !f.ReplyDst.Equal(flow.Reply.Dst) {
+		return false
+	}
+	if f.Zone != nil && *f.Zone != flow.Zone {
+		return false
+	}
+	if flow.Mark&f.MarkMask != f.Mark&f.MarkMask {
+		return false
+	}
+	return true
+}
+
+// ctNetlink is a minimal client for the kernel's conntrack netlink API (NFNL_SUBSYS_CTNETLINK).
+// It may be used from multiple goroutines; requests are serialised over a single socket.
+type ctNetlink struct {
+	lock      sync.Mutex
+	newSocket NetlinkSocketFactory
+	socket    NetlinkSocket
+	seq       uint32
+}
+
+func newCTNetlink(newSocket NetlinkSocketFactory) *ctNetlink {
+	return &ctNetlink{
+		newSocket: newSocket,
+	}
+}
+
+// list dumps the flows of the given family from the kernel.
+func (n *ctNetlink) list(family uint8) (flows []*Flow, err error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if err = n.ensureSocket(); err != nil {
+		return
+	}
+	defer n.closeSocketOnError(&err)
+
+	err = n.dump(family, func(flow *Flow) {
+		flows = append(flows, flow)
+	})
+	return
+}
+
+// deleteFlows dumps the flows of the given family and deletes the ones that match.  All the
+// deletions are sent after the dump completes, in as few batches as possible.  Flows that have
+// already gone by the time we try to delete them don't count as failures.  If some deletions
+// fail, the others are still applied and deleteFlows returns the first error.
+func (n *ctNetlink) deleteFlows(family uint8, match func(flow *Flow) bool) (numDeleted int, err error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if err = n.ensureSocket(); err != nil {
+		return
+	}
+	defer n.closeSocketOnError(&err)
+
+	var pending []nfnetlink.Request
+	err = n.dump(family, func(flow *Flow) {
+		if match(flow) {
+			pending = append(pending, n.deleteRequest(family, flow))
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	// Unlike most netlink clients, we carry on after a failed deletion since the other
+	// deletions don't depend on it.
+	var firstErr error
+	err = nfnetlink.SendRequests(n.socket, pending, func(req *nfnetlink.Request, errno int32) error {
+		switch errno {
+		case 0:
+			numDeleted++
+		case errnoENOENT:
+			// The flow expired or was deleted by someone else.
+			log.WithField("flow", req.Description).Debug("Flow already gone")
+		default:
+			countNetlinkErrors.Inc()
+			if firstErr == nil {
+				firstErr = NetlinkError{Errno: errno, Request: req.Description}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	err = firstErr
+	return
+}
+
+// dump sends a dump request and passes each flow in the response to the callback.
+func (n *ctNetlink) dump(family uint8, onFlow func(flow *Flow)) error {
+	var b nfnetlink.MsgBuilder
+	n.seq++
+	request := b.Message(nfnlSubsysCTNetlink, ipctnlMsgCtGet, nfnetlink.FlagRequest|nfnetlink.FlagDump, family, 0, n.seq)
+	err := nfnetlink.Dump(n.socket, request, n.seq, "dump", func(msg nfnetlink.Message) error {
+		if msg.Type != nfnlSubsysCTNetlink<<8|ipctnlMsgCtNew {
+			return nil
+		}
+		flow, err := parseFlow(msg.Payload)
+		if err != nil {
+			return err
+		}
+		countFlowsDumped.Inc()
+		onFlow(flow)
+		return nil
+	})
+	if _, ok := err.(NetlinkError); ok {
+		countNetlinkErrors.Inc()
+	}
+	return err
+}
+
+func (n *ctNetlink) deleteRequest(family uint8, flow *Flow) nfnetlink.Request {
+	var b nfnetlink.MsgBuilder
+	b.AddAttr(ctaTupleOrig|nfnetlink.AttrFlagNested, flow.origTupleAttr)
+	if flow.Zone != 0 {
+		b.AddBE16(ctaZone, flow.Zone)
+	}
+	if flow.hasID {
+		// Makes sure that we don't delete a new flow that happens to reuse the tuple.
+		b.AddBE32(ctaID, flow.ID)
+	}
+	n.seq++
+	return nfnetlink.Request{
+		Seq: n.seq,
+		Data: b.Message(nfnlSubsysCTNetlink, ipctnlMsgCtDelete,
+			nfnetlink.FlagRequest|nfnetlink.FlagAck, family, 0, n.seq),
+		Description: "delete " + flow.Orig.String(),
+	}
+}
+
+func (n *ctNetlink) ensureSocket() (err error) {
+	if n.socket != nil {
+		return
+	}
+	n.socket, err = n.newSocket()
+	if err != nil {
+		n.socket = nil
+		countNetlinkErrors.Inc()
+		log.WithError(err).Error("Failed to open netlink socket")
+	}
+	return
+}
+
+// closeSocketOnError closes the socket after a socket-level error; we don't know what state the
+// socket is in so we start again with a fresh one next time.
+func (n *ctNetlink) closeSocketOnError(err *error) {
+	if *err == nil {
+		return
+	}
+	if _, ok := (*err).(NetlinkError); ok {
+		return
+	}
+	countNetlinkErrors.Inc()
+	if n.socket == nil {
+		return
+	}
+	if closeErr := n.socket.Close(); closeErr != nil {
+		log.WithError(closeErr).Warn("Failed to close netlink socket")
+	}
+	n.socket = nil
+}
+
+func nfproto(ipVersion uint8) uint8 {
+	switch ipVersion {
+	case 4:
+		return nfnetlink.ProtoIPv4
+	case 6:
+		return nfnetlink.ProtoIPv6
+	}
+	return 0
+}
+
+// parseFlow parses the attributes of one flow from a conntrack dump.
+func parseFlow(data []byte) (*Flow, error) {
+	attrs, err := nfnetlink.ParseAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+	flow := &Flow{}
+	for _, attr := range attrs {
+		switch attr.Type {
+		case ctaTupleOrig:
+			flow.origTupleAttr = attr.Value
+			if err := parseTuple(attr.Value, &flow.Orig); err != nil {
+				return nil, err
+			}
+		case ctaTupleReply:
+			if err := parseTuple(attr.Value, &flow.Reply); err != nil {
+				return nil, err
+			}
+		case ctaCountersOrig, ctaCountersReply:
+			counters, err := parseCounters(attr.Value)
+			if err != nil {
+				return nil, err
+			}
+			if attr.Type == ctaCountersOrig {
+				flow.OrigCounters = counters
+			} else {
+				flow.ReplyCounters = counters
+			}
+		case ctaMark:
+			if len(attr.Value) < 4 {
+				return nil, errors.New("bad mark attribute in conntrack dump")
+			}
+			flow.Mark = binary.BigEndian.Uint32(attr.Value)
+		case ctaZone:
+			if len(attr.Value) < 2 {
+				return nil, errors.New("bad zone attribute in conntrack dump")
+			}
+			flow.Zone = binary.BigEndian.Uint16(attr.Value)
+		case ctaID:
+			if len(attr.Value) < 4 {
+				return nil, errors.New("bad ID attribute in conntrack dump")
+			}
+			flow.ID = binary.BigEndian.Uint32(attr.Value)
+			flow.hasID = true
+		}
+	}
+	if flow.origTupleAttr == nil {
+		return nil, errors.New("flow in conntrack dump had no original tuple")
+	}
+	return flow, nil
+}
+
+func parseCounters(data []byte) (*Counters, error) {
+	attrs, err := nfnetlink.ParseAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+	counters := &Counters{}
+	for _, attr := range attrs {
+		var value *uint64
+		switch attr.Type {
+		case ctaCountersPackets, ctaCounters32Packets:
+			value = &counters.Packets
+		case ctaCountersBytes, ctaCounters32Bytes:
+			value = &counters.Bytes
+		default:
+			continue
+		}
+		switch len(attr.Value) {
+		case 4:
+			*value = uint64(binary.BigEndian.Uint32(attr.Value))
+		case 8:
+			*value = binary.BigEndian.Uint64(attr.Value)
+		default:
+			return nil, errors.New("bad counter attribute in conntrack dump")
+		}
+	}
+	return counters, nil
+}
+
+func parseTuple(data []byte, tuple *Tuple) error {
+	attrs, err := nfnetlink.ParseAttrs(data)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Type {
+		case ctaTupleIP:
+			ipAttrs, err := nfnetlink.ParseAttrs(attr.Value)
+			if err != nil {
+				return err
+			}
+			for _, ipAttr := range ipAttrs {
+				switch ipAttr.Type {
+				case ctaIPv4Src, ctaIPv6Src:
+					tuple.Src = net.IP(ipAttr.Value)
+				case ctaIPv4Dst, ctaIPv6Dst:
+					tuple.Dst = net.IP(ipAttr.Value)
+				}
+			}
+		case ctaTupleProto:
+			protoAttrs, err := nfnetlink.ParseAttrs(attr.Value)
+			if err != nil {
+				return err
+			}
+			for _, protoAttr := range protoAttrs {
+				switch protoAttr.Type {
+				case ctaProtoNum:
+					if len(protoAttr.Value) < 1 {
+						return errors.New("bad protocol attribute in conntrack dump")
+					}
+					tuple.Proto = protoAttr.Value[0]
+				case ctaProtoSrcPort, ctaProtoDstPort:
+					if len(protoAttr.Value) < 2 {
+						return errors.New("bad port attribute in conntrack dump")
+					}
+					port := binary.BigEndian.Uint16(protoAttr.Value)
+					if protoAttr.Type == ctaProtoSrcPort {
+						tuple.SrcPort = port
+					} else {
+						tuple.DstPort = port
+					}
+				}
+			}
+		}
+	}
+	if tuple.Src == nil || tuple.Dst == nil {
+		return errors.New("tuple in conntrack dump had no addresses")
+	}
+	return nil
+}
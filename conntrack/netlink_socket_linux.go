@@ -0,0 +1,33 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conntrack
+
+import (
+	"time"
+
+	"github.com/projectcalico/felix/nfnetlink"
+)
+
+const netlinkRecvTimeout = 10 * time.Second
+
+// New creates a Conntrack that uses the conntrack netlink API.
+func New() *Conntrack {
+	return NewWithNetlinkShim(newRealNetlinkSocket)
+}
+
+func newRealNetlinkSocket() (NetlinkSocket, error) {
+	// Make sure that we don't block forever if the kernel fails to respond.
+	return nfnetlink.NewSocket(nfnetlink.SocketOptions{RecvTimeout: netlinkRecvTimeout})
+}
@@ -0,0 +1,611 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conntrack_test
+
+import (
+	. "github.com/projectcalico/felix/conntrack"
+
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"unsafe"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Conntrack with netlink", func() {
+	var conntrack *Conntrack
+	var kernel *fakeConntrackKernel
+
+	tcpFlow := fakeFlow{
+		Proto: 6, OrigSrc: "10.0.0.1", OrigDst: "10.0.0.2", SrcPort: 1234, DstPort: 80,
+		ReplySrc: "10.0.0.2", ReplyDst: "10.0.0.1",
+	}
+	replyFlow := fakeFlow{
+		Proto: 17, OrigSrc: "10.0.0.3", OrigDst: "10.96.0.10", SrcPort: 5353, DstPort: 53,
+		ReplySrc: "10.0.0.1", ReplyDst: "10.0.0.3",
+	}
+	otherFlow := fakeFlow{
+		Proto: 6, OrigSrc: "10.0.0.3", OrigDst: "10.0.0.4", SrcPort: 4321, DstPort: 443,
+		ReplySrc: "10.0.0.4", ReplyDst: "10.0.0.3", Zone: 7, Mark: 0x1100,
+	}
+	v6Flow := fakeFlow{
+		Proto: 6, OrigSrc: "fd00::1", OrigDst: "fd00::2", SrcPort: 1234, DstPort: 80,
+		ReplySrc: "fd00::2", ReplyDst: "fd00::1",
+	}
+
+	BeforeEach(func() {
+		kernel = newFakeConntrackKernel(tcpFlow, replyFlow, otherFlow, v6Flow)
+		conntrack = NewWithNetlinkShim(kernel.newSocket)
+	})
+
+	It("should list the flows of one family", func() {
+		flows, err := conntrack.ListFlows(4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(flows).To(HaveLen(3))
+		Expect(flows[0].Orig).To(Equal(Tuple{
+			Src: net.ParseIP("10.0.0.1").To4(), Dst: net.ParseIP("10.0.0.2").To4(),
+			Proto: 6, SrcPort: 1234, DstPort: 80,
+		}))
+		Expect(flows[0].Reply.Src.String()).To(Equal("10.0.0.2"))
+		Expect(flows[2].Zone).To(Equal(uint16(7)))
+		Expect(flows[2].Mark).To(Equal(uint32(0x1100)))
+
+		flows, err = conntrack.ListFlows(6)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(flows).To(HaveLen(1))
+		Expect(flows[0].Orig.Src.String()).To(Equal("fd00::1"))
+	})
+
+	It("should read the counters of flows that have them", func() {
+		kernel = newFakeConntrackKernel(tcpFlow, fakeFlow{
+			Proto: 17, OrigSrc: "10.0.0.5", OrigDst: "10.0.0.6", SrcPort: 1234, DstPort: 53,
+			ReplySrc: "10.0.0.6", ReplyDst: "10.0.0.5",
+			OrigPackets: 5000000000, OrigBytes: 6000000000, ReplyPackets: 7, ReplyBytes: 800,
+		})
+		conntrack = NewWithNetlinkShim(kernel.newSocket)
+		flows, err := conntrack.ListFlows(4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(flows).To(HaveLen(2))
+		Expect(flows[0].OrigCounters).To(BeNil())
+		Expect(flows[0].ReplyCounters).To(BeNil())
+		Expect(flows[1].OrigCounters).To(Equal(&Counters{Packets: 5000000000, Bytes: 6000000000}))
+		Expect(flows[1].ReplyCounters).To(Equal(&Counters{Packets: 7, Bytes: 800}))
+	})
+
+	It("should remove flows with the IP as original or reply source", func() {
+		conntrack.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		Expect(kernel.Flows()).To(ConsistOf(otherFlow, v6Flow))
+		Expect(kernel.NumDumps()).To(Equal(1))
+	})
+
+	It("should remove the flows for several IPs in one pass", func() {
+		conntrack.RemoveConntrackFlowsForIPs(4, []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.4")})
+		Expect(kernel.Flows()).To(ConsistOf(v6Flow))
+		Expect(kernel.NumDumps()).To(Equal(1))
+	})
+
+	It("should handle IPv6", func() {
+		conntrack.RemoveConntrackFlows(6, net.ParseIP("fd00::1"))
+		Expect(kernel.Flows()).To(ConsistOf(tcpFlow, replyFlow, otherFlow))
+	})
+
+	It("should panic on unknown IP version", func() {
+		Expect(func() { conntrack.RemoveConntrackFlows(9, nil) }).To(Panic())
+	})
+
+	It("should delete by zone and mark", func() {
+		zone := uint16(7)
+		n, err := conntrack.DeleteFlows(4, FlowFilter{Zone: &zone, Mark: 0x1000, MarkMask: 0xf000})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(1))
+		Expect(kernel.Flows()).To(ConsistOf(tcpFlow, replyFlow, v6Flow))
+		Expect(kernel.LastDeleteZone()).To(Equal(uint16(7)))
+	})
+
+	It("should delete by original and reply destination", func() {
+		n, err := conntrack.DeleteFlows(4,
+			FlowFilter{OrigDst: net.ParseIP("10.96.0.10")},
+			FlowFilter{ReplyDst: net.ParseIP("10.0.0.1")},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(2))
+		Expect(kernel.Flows()).To(ConsistOf(otherFlow, v6Flow))
+	})
+
+	It("should not delete anything if the mark doesn't match", func() {
+		n, err := conntrack.DeleteFlows(4, FlowFilter{Mark: 0x2000, MarkMask: 0xf000})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(0))
+		Expect(kernel.Flows()).To(HaveLen(4))
+	})
+
+	It("should ignore flows that disappear before they're deleted", func() {
+		kernel.expireAfterDump = true
+		n, err := conntrack.DeleteFlows(4, FlowFilter{OrigSrc: net.ParseIP("10.0.0.1")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(0))
+	})
+
+	It("should report a failed deletion", func() {
+		kernel.deleteErrno = 1
+		_, err := conntrack.DeleteFlows(4, FlowFilter{OrigSrc: net.ParseIP("10.0.0.1")})
+		Expect(err).To(BeAssignableToTypeOf(NetlinkError{}))
+		Expect(err.(NetlinkError).Errno).To(Equal(int32(1)))
+	})
+
+	It("should split a large deletion into batches", func() {
+		var flows []fakeFlow
+		for i := 0; i < 300; i++ {
+			flows = append(flows, fakeFlow{
+				Proto: 6, OrigSrc: "10.0.0.1", OrigDst: "10.0.0.2", SrcPort: uint16(1000 + i), DstPort: 80,
+				ReplySrc: "10.0.0.2", ReplyDst: "10.0.0.1",
+			})
+		}
+		kernel = newFakeConntrackKernel(flows...)
+		conntrack = NewWithNetlinkShim(kernel.newSocket)
+		n, err := conntrack.DeleteFlows(4, FlowFilter{OrigSrc: net.ParseIP("10.0.0.1")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(300))
+		Expect(kernel.Flows()).To(BeEmpty())
+		Expect(kernel.NumDeleteBatches()).To(Equal(3))
+	})
+
+	It("should retry with a new socket after a socket error", func() {
+		kernel.failNextSend = true
+		conntrack.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		Expect(kernel.Flows()).To(ConsistOf(otherFlow, v6Flow))
+		Expect(kernel.NumSockets()).To(Equal(2))
+		Expect(kernel.sockets[0].closed).To(BeTrue())
+	})
+
+	It("should reuse the socket", func() {
+		conntrack.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		conntrack.RemoveConntrackFlows(4, net.ParseIP("10.0.0.3"))
+		Expect(kernel.Flows()).To(ConsistOf(v6Flow))
+		Expect(kernel.NumSockets()).To(Equal(1))
+	})
+
+	It("should handle concurrent removals", func() {
+		var wg sync.WaitGroup
+		for _, ip := range []string{"10.0.0.1", "10.0.0.3", "fd00::1"} {
+			ipAddr := net.ParseIP(ip)
+			version := uint8(4)
+			if ipAddr.To4() == nil {
+				version = 6
+			}
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				conntrack.RemoveConntrackFlows(version, ipAddr)
+			}()
+		}
+		wg.Wait()
+		Expect(kernel.Flows()).To(BeEmpty())
+		Expect(kernel.NumDumps()).To(BeNumerically("<=", 3))
+	})
+})
+
+var _ = Describe("Conntrack with the conntrack command", func() {
+	It("should not support netlink-only operations", func() {
+		conntrack := NewWithCmdShim((&cmdRecorder{}).newCmd)
+		_, err := conntrack.ListFlows(4)
+		Expect(err).To(Equal(ErrNotSupported))
+		_, err = conntrack.DeleteFlows(4, FlowFilter{})
+		Expect(err).To(Equal(ErrNotSupported))
+	})
+})
+
+var _ = Describe("FlowFilter", func() {
+	flow := &Flow{
+		Orig:  Tuple{Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.2")},
+		Reply: Tuple{Src: net.ParseIP("10.0.0.2"), Dst: net.ParseIP("10.0.0.1")},
+		Zone:  3,
+		Mark:  0x1234,
+	}
+	zone3 := uint16(3)
+	zone4 := uint16(4)
+
+	DescribeTable("matching",
+		func(filter FlowFilter, expected bool) {
+			Expect(filter.Matches(flow)).To(Equal(expected))
+		},
+		Entry("empty filter", FlowFilter{}, true),
+		Entry("orig src", FlowFilter{OrigSrc: net.ParseIP("10.0.0.1")}, true),
+		Entry("wrong orig src", FlowFilter{OrigSrc: net.ParseIP("10.0.0.2")}, false),
+		Entry("orig dst", FlowFilter{OrigDst: net.ParseIP("10.0.0.2")}, true),
+		Entry("reply src", FlowFilter{ReplySrc: net.ParseIP("10.0.0.2")}, true),
+		Entry("wrong reply dst", FlowFilter{ReplyDst: net.ParseIP("10.0.0.2")}, false),
+		Entry("zone", FlowFilter{Zone: &zone3}, true),
+		Entry("wrong zone", FlowFilter{Zone: &zone4}, false),
+		Entry("masked mark", FlowFilter{Mark: 0x1000, MarkMask: 0xf000}, true),
+		Entry("wrong masked mark", FlowFilter{Mark: 0x2000, MarkMask: 0xf000}, false),
+		Entry("mark without mask", FlowFilter{Mark: 0x2000}, true),
+	)
+})
+
+// This is a fake netlink socket backed by a simulated conntrack table.  Like the fake in the
+// ipsets package, it deliberately doesn't share any encoding code with the production code.
+
+const (
+	fakeNlmsgError = 2
+	fakeNlmsgDone  = 3
+	fakeNlmFAck    = 0x4
+	fakeNlmFDump   = 0x300
+
+	fakeCtSubsys    = 1
+	fakeCtMsgNew    = 0
+	fakeCtMsgGet    = 1
+	fakeCtMsgDelete = 2
+
+	fakeErrnoENOENT = 2
+)
+
+var fakeNativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		fakeNativeEndian = binary.BigEndian
+	}
+}
+
+type fakeFlow struct {
+	Proto    uint8
+	OrigSrc  string
+	OrigDst  string
+	SrcPort  uint16
+	DstPort  uint16
+	ReplySrc string
+	ReplyDst string
+	Zone     uint16
+	Mark     uint32
+	// If OrigPackets is non-zero, the flow has counters, as it would if accounting was enabled.
+	OrigPackets  uint64
+	OrigBytes    uint64
+	ReplyPackets uint64
+	ReplyBytes   uint64
+}
+
+func (f fakeFlow) isV6() bool {
+	return net.ParseIP(f.OrigSrc).To4() == nil
+}
+
+type fakeConntrackKernel struct {
+	lock    sync.Mutex
+	flows   map[uint32]fakeFlow
+	order   []uint32
+	sockets []*fakeConntrackSocket
+
+	numDumps         int
+	numDeleteBatches int
+	lastDeleteZone   uint16
+
+	failNextSend    bool
+	expireAfterDump bool
+	deleteErrno     int32
+}
+
+func newFakeConntrackKernel(flows ...fakeFlow) *fakeConntrackKernel {
+	k := &fakeConntrackKernel{flows: map[uint32]fakeFlow{}}
+	for i, f := range flows {
+		id := uint32(i + 100)
+		k.flows[id] = f
+		k.order = append(k.order, id)
+	}
+	return k
+}
+
+func (k *fakeConntrackKernel) newSocket() (NetlinkSocket, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	s := &fakeConntrackSocket{kernel: k}
+	k.sockets = append(k.sockets, s)
+	return s, nil
+}
+
+func (k *fakeConntrackKernel) Flows() []fakeFlow {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	var flows []fakeFlow
+	for _, id := range k.order {
+		if f, ok := k.flows[id]; ok {
+			flows = append(flows, f)
+		}
+	}
+	return flows
+}
+
+func (k *fakeConntrackKernel) NumDumps() int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.numDumps
+}
+
+func (k *fakeConntrackKernel) NumDeleteBatches() int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.numDeleteBatches
+}
+
+func (k *fakeConntrackKernel) NumSockets() int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return len(k.sockets)
+}
+
+func (k *fakeConntrackKernel) LastDeleteZone() uint16 {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.lastDeleteZone
+}
+
+type fakeConntrackSocket struct {
+	kernel    *fakeConntrackKernel
+	closed    bool
+	responses [][]byte
+}
+
+func (s *fakeConntrackSocket) Send(data []byte) error {
+	k := s.kernel
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	Expect(s.closed).To(BeFalse(), "Send() called on closed socket")
+	Expect(s.responses).To(BeEmpty(), "Send() called with unread responses")
+	if k.failNextSend {
+		k.failNextSend = false
+		return errors.New("simulated send failure")
+	}
+
+	for len(data) > 0 {
+		Expect(len(data)).To(BeNumerically(">=", 20))
+		msgLen := int(fakeNativeEndian.Uint32(data[0:4]))
+		Expect(msgLen).To(BeNumerically("<=", len(data)))
+		msgType := fakeNativeEndian.Uint16(data[4:6])
+		Expect(msgType >> 8).To(Equal(uint16(fakeCtSubsys)))
+		flags := fakeNativeEndian.Uint16(data[6:8])
+		seq := fakeNativeEndian.Uint32(data[8:12])
+		family := data[16]
+		attrs := fakeParseAttrs(data[20:msgLen])
+		data = data[(msgLen+3)&^3:]
+
+		switch uint8(msgType) {
+		case fakeCtMsgGet:
+			Expect(flags & fakeNlmFDump).To(Equal(uint16(fakeNlmFDump)))
+			Expect(data).To(BeEmpty(), "dump request should be sent on its own")
+			k.numDumps++
+			s.dump(family, seq)
+		case fakeCtMsgDelete:
+			Expect(flags & fakeNlmFAck).To(Equal(uint16(fakeNlmFAck)))
+			if len(s.responses) == 0 {
+				k.numDeleteBatches++
+			}
+			s.queue(fakeErrorMessage(seq, s.delete(family, attrs)))
+		default:
+			Fail("Unexpected conntrack netlink command")
+		}
+	}
+	return nil
+}
+
+func (s *fakeConntrackSocket) dump(family uint8, seq uint32) {
+	k := s.kernel
+	for _, id := range k.order {
+		f, ok := k.flows[id]
+		if !ok {
+			continue
+		}
+		if f.isV6() != (family == 10) {
+			continue
+		}
+		s.queue(fakeFlowMessage(seq, id, f))
+	}
+	s.queue(fakeMessageBytes(fakeNlmsgDone, seq, make([]byte, 4)))
+	if k.expireAfterDump {
+		k.flows = map[uint32]fakeFlow{}
+	}
+}
+
+// delete applies a delete request with the same semantics as the kernel: the original tuple,
+// zone and ID (if given) must all match.  Returns the errno, or 0 for success.
+func (s *fakeConntrackSocket) delete(family uint8, attrs fakeAttrs) int32 {
+	k := s.kernel
+	Expect(attrs).To(HaveKey(uint16(1)), "delete should include the original tuple")
+	orig := fakeParseAttrs(attrs[1])
+	ips := fakeParseAttrs(orig[1])
+	proto := fakeParseAttrs(orig[2])
+	var src, dst net.IP
+	if family == 10 {
+		src, dst = net.IP(ips[3]), net.IP(ips[4])
+	} else {
+		src, dst = net.IP(ips[1]), net.IP(ips[2])
+	}
+	var zone uint16
+	if z, ok := attrs[18]; ok {
+		zone = binary.BigEndian.Uint16(z)
+	}
+	k.lastDeleteZone = zone
+	if k.deleteErrno != 0 {
+		return k.deleteErrno
+	}
+	for id, f := range k.flows {
+		if idAttr, ok := attrs[12]; ok && binary.BigEndian.Uint32(idAttr) != id {
+			continue
+		}
+		if !net.ParseIP(f.OrigSrc).Equal(src) || !net.ParseIP(f.OrigDst).Equal(dst) ||
+			f.Proto != proto[1][0] ||
+			f.SrcPort != binary.BigEndian.Uint16(proto[2]) ||
+			f.DstPort != binary.BigEndian.Uint16(proto[3]) ||
+			f.Zone != zone {
+			continue
+		}
+		delete(k.flows, id)
+		return 0
+	}
+	return fakeErrnoENOENT
+}
+
+func (s *fakeConntrackSocket) queue(data []byte) {
+	s.responses = append(s.responses, data)
+}
+
+func (s *fakeConntrackSocket) Receive() ([]byte, error) {
+	k := s.kernel
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	Expect(s.closed).To(BeFalse(), "Receive() called on closed socket")
+	if len(s.responses) == 0 {
+		// A real socket would block forever.
+		Fail("Receive() called with nothing to receive")
+		return nil, errors.New("nothing to receive")
+	}
+	// Return up to two messages per datagram to check that we handle both cases.
+	var data []byte
+	for i := 0; i < 2 && len(s.responses) > 0; i++ {
+		data = append(data, s.responses[0]...)
+		s.responses = s.responses[1:]
+	}
+	return data, nil
+}
+
+func (s *fakeConntrackSocket) Close() error {
+	s.kernel.lock.Lock()
+	defer s.kernel.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+type fakeAttrs map[uint16][]byte
+
+func fakeParseAttrs(data []byte) fakeAttrs {
+	attrs := fakeAttrs{}
+	for len(data) >= 4 {
+		attrLen := int(fakeNativeEndian.Uint16(data[0:2]))
+		Expect(attrLen).To(BeNumerically(">=", 4))
+		Expect(attrLen).To(BeNumerically("<=", len(data)))
+		attrType := fakeNativeEndian.Uint16(data[2:4]) & 0x3fff
+		attrs[attrType] = data[4:attrLen]
+		padded := (attrLen + 3) &^ 3
+		if padded > len(data) {
+			break
+		}
+		data = data[padded:]
+	}
+	return attrs
+}
+
+type fakeAttrBuilder []byte
+
+func (b *fakeAttrBuilder) add(attrType uint16, value []byte) {
+	hdr := make([]byte, 4)
+	fakeNativeEndian.PutUint16(hdr[0:2], uint16(4+len(value)))
+	fakeNativeEndian.PutUint16(hdr[2:4], attrType)
+	*b = append(*b, hdr...)
+	*b = append(*b, value...)
+	for len(*b)%4 != 0 {
+		*b = append(*b, 0)
+	}
+}
+
+func fakeBE16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func fakeBE32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func fakeBE64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func fakeTuple(proto uint8, src, dst string, srcPort, dstPort uint16) []byte {
+	var ips fakeAttrBuilder
+	if srcIP := net.ParseIP(src).To4(); srcIP != nil {
+		ips.add(1|1<<14, srcIP)
+		ips.add(2|1<<14, net.ParseIP(dst).To4())
+	} else {
+		ips.add(3|1<<14, net.ParseIP(src).To16())
+		ips.add(4|1<<14, net.ParseIP(dst).To16())
+	}
+	var protoAttrs fakeAttrBuilder
+	protoAttrs.add(1, []byte{proto})
+	protoAttrs.add(2|1<<14, fakeBE16(srcPort))
+	protoAttrs.add(3|1<<14, fakeBE16(dstPort))
+	var tuple fakeAttrBuilder
+	tuple.add(1|1<<15, ips)
+	tuple.add(2|1<<15, protoAttrs)
+	return tuple
+}
+
+func fakeFlowMessage(seq uint32, id uint32, f fakeFlow) []byte {
+	var attrs fakeAttrBuilder
+	attrs.add(1|1<<15, fakeTuple(f.Proto, f.OrigSrc, f.OrigDst, f.SrcPort, f.DstPort))
+	attrs.add(2|1<<15, fakeTuple(f.Proto, f.ReplySrc, f.ReplyDst, f.DstPort, f.SrcPort))
+	// CTA_STATUS and CTA_TIMEOUT, which we should ignore.
+	attrs.add(3|1<<14, fakeBE32(0x18e))
+	attrs.add(7|1<<14, fakeBE32(120))
+	attrs.add(8|1<<14, fakeBE32(f.Mark))
+	attrs.add(12|1<<14, fakeBE32(id))
+	if f.Zone != 0 {
+		attrs.add(18|1<<14, fakeBE16(f.Zone))
+	}
+	if f.OrigPackets != 0 {
+		// 64-bit counters, with CTA_COUNTERS_PAD, for the original direction and old-style
+		// 32-bit counters for the reply direction.
+		var orig fakeAttrBuilder
+		orig.add(1|1<<14, fakeBE64(f.OrigPackets))
+		orig.add(2|1<<14, fakeBE64(f.OrigBytes))
+		orig.add(5, nil)
+		attrs.add(9|1<<15, orig)
+		var reply fakeAttrBuilder
+		reply.add(3|1<<14, fakeBE32(uint32(f.ReplyPackets)))
+		reply.add(4|1<<14, fakeBE32(uint32(f.ReplyBytes)))
+		attrs.add(10|1<<15, reply)
+	}
+	family := byte(2)
+	if f.isV6() {
+		family = 10
+	}
+	payload := append([]byte{family, 0, 0, 0}, attrs...)
+	return fakeMessageBytes(fakeCtSubsys<<8|fakeCtMsgNew, seq, payload)
+}
+
+func fakeMessageBytes(msgType uint16, seq uint32, payload []byte) []byte {
+	msgLen := 16 + len(payload)
+	msg := make([]byte, (msgLen+3)&^3)
+	fakeNativeEndian.PutUint32(msg[0:4], uint32(msgLen))
+	fakeNativeEndian.PutUint16(msg[4:6], msgType)
+	fakeNativeEndian.PutUint32(msg[8:12], seq)
+	copy(msg[16:], payload)
+	return msg
+}
+
+func fakeErrorMessage(seq uint32, errno int32) []byte {
+	// struct nlmsgerr: negative errno followed by the header of the failed request.
+	payload := make([]byte, 20)
+	fakeNativeEndian.PutUint32(payload[0:4], uint32(-errno))
+	return fakeMessageBytes(fakeNlmsgError, seq, payload)
+}
@@ -17,15 +17,19 @@
 package dataplane
 
 import (
+	"io/ioutil"
 	"math/bits"
 	"net"
 	"os/exec"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/projectcalico/felix/collector"
 	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/conntrack"
 	"github.com/projectcalico/felix/dataplane/external"
 	"github.com/projectcalico/felix/dataplane/linux"
+	"github.com/projectcalico/felix/dataplane/snapshot"
 	"github.com/projectcalico/felix/ifacemonitor"
 	"github.com/projectcalico/felix/ipsets"
 	"github.com/projectcalico/felix/logutils"
@@ -44,92 +48,26 @@ func StartDataplaneDriver(configParams *config.Config,
 		if kubeIPVSSupportEnabled {
 			log.Info("Kube-proxy in ipvs mode, enabling felix kube-proxy ipvs support.")
 		}
+		if kubeIPVSSupportEnabled && configParams.DataplaneBackend == intdataplane.BackendNftables {
+			// Our kube-proxy ipvs support relies on the iptables ipvs match, which has no
+			// nftables equivalent.
+			log.Fatal("Kube-proxy in ipvs mode is not supported by the nftables backend.")
+		}
 		if configChangedRestartCallback == nil {
 			log.Panic("Starting dataplane with nil callback func.")
 		}
 
-		markBitsManager := markbits.NewMarkBitsManager(configParams.IptablesMarkMask, "felix-iptables")
-		// Dedicated mark bits for accept and pass actions.  These are long lived bits
-		// that we use for communicating between chains.
-		markAccept, _ := markBitsManager.NextSingleBitMark()
-		markPass, _ := markBitsManager.NextSingleBitMark()
-		// Short-lived mark bits for local calculations within a chain.
-		markScratch0, _ := markBitsManager.NextSingleBitMark()
-		markScratch1, _ := markBitsManager.NextSingleBitMark()
-		if markAccept == 0 || markPass == 0 || markScratch0 == 0 || markScratch1 == 0 {
-			log.WithFields(log.Fields{
-				"Name":     "felix-iptables",
-				"MarkMask": configParams.IptablesMarkMask,
-			}).Panic("Not enough mark bits available.")
-		}
-
-		// Mark bits for end point mark. Currently felix takes the rest bits from mask available for use.
-		markEndpointMark, allocated := markBitsManager.NextBlockBitsMark(markBitsManager.AvailableMarkBitCount())
-		if kubeIPVSSupportEnabled && allocated == 0 {
-			log.WithFields(log.Fields{
-				"Name":     "felix-iptables",
-				"MarkMask": configParams.IptablesMarkMask,
-			}).Panic("Not enough mark bits available for endpoint mark.")
-		}
-		// Take lowest bit position (position 1) from endpoint mark mask reserved for non-calico endpoint.
-		markEndpointNonCaliEndpoint := uint32(1) << uint(bits.TrailingZeros32(markEndpointMark))
-		log.WithFields(log.Fields{
-			"acceptMark":          markAccept,
-			"passMark":            markPass,
-			"scratch0Mark":        markScratch0,
-			"scratch1Mark":        markScratch1,
-			"endpointMark":        markEndpointMark,
-			"endpointMarkNonCali": markEndpointNonCaliEndpoint,
-		}).Info("Calculated iptables mark bits")
-
 		dpConfig := intdataplane.Config{
 			IfaceMonitorConfig: ifacemonitor.Config{
 				InterfaceExcludes: configParams.InterfaceExcludes(),
 			},
-			RulesConfig: rules.Config{
-				WorkloadIfacePrefixes: configParams.InterfacePrefixes(),
-
-				IPSetConfigV4: ipsets.NewIPVersionConfig(
-					ipsets.IPFamilyV4,
-					rules.IPSetNamePrefix,
-					rules.AllHistoricIPSetNamePrefixes,
-					rules.LegacyV4IPSetNames,
-				),
-				IPSetConfigV6: ipsets.NewIPVersionConfig(
-					ipsets.IPFamilyV6,
-					rules.IPSetNamePrefix,
-					rules.AllHistoricIPSetNamePrefixes,
-					nil,
-				),
-
-				KubeNodePortRanges:     configParams.KubeNodePortRanges,
-				KubeIPVSSupportEnabled: kubeIPVSSupportEnabled,
-
-				OpenStackSpecialCasesEnabled: configParams.OpenstackActive(),
-				OpenStackMetadataIP:          net.ParseIP(configParams.MetadataAddr),
-				OpenStackMetadataPort:        uint16(configParams.MetadataPort),
-
-				IptablesMarkAccept:          markAccept,
-				IptablesMarkPass:            markPass,
-				IptablesMarkScratch0:        markScratch0,
-				IptablesMarkScratch1:        markScratch1,
-				IptablesMarkEndpoint:        markEndpointMark,
-				IptablesMarkNonCaliEndpoint: markEndpointNonCaliEndpoint,
-
-				IPIPEnabled:       configParams.IpInIpEnabled,
-				IPIPTunnelAddress: configParams.IpInIpTunnelAddr,
-
-				IptablesLogPrefix:         configParams.LogPrefix,
-				EndpointToHostAction:      configParams.DefaultEndpointToHostAction,
-				IptablesFilterAllowAction: configParams.IptablesFilterAllowAction,
-				IptablesMangleAllowAction: configParams.IptablesMangleAllowAction,
-
-				FailsafeInboundHostPorts:  configParams.FailsafeInboundHostPorts,
-				FailsafeOutboundHostPorts: configParams.FailsafeOutboundHostPorts,
-
-				DisableConntrackInvalid: configParams.DisableConntrackInvalidCheck,
-			},
+			Hostname:                       configParams.FelixHostname,
+			RulesConfig:                    RulesConfigFromConfigParams(configParams, kubeIPVSSupportEnabled),
 			IPIPMTU:                        configParams.IpInIpMtu,
+			IPIPMTUV6:                      configParams.IpInIpV6Mtu,
+			VXLANMTU:                       configParams.VXLANMTU,
+			VXLANVNI:                       configParams.VXLANVNI,
+			RemoteRoutesEnabled:            configParams.RemoteRoutesEnabled,
 			IptablesRefreshInterval:        configParams.IptablesRefreshInterval,
 			RouteRefreshInterval:           configParams.RouteRefreshInterval,
 			IPSetsRefreshInterval:          configParams.IpsetsRefreshInterval,
@@ -138,13 +76,29 @@ func StartDataplaneDriver(configParams *config.Config,
 			IptablesLockFilePath:           configParams.IptablesLockFilePath,
 			IptablesLockTimeout:            configParams.IptablesLockTimeoutSecs,
 			IptablesLockProbeInterval:      configParams.IptablesLockProbeIntervalMillis,
+			DataplaneBackend:               configParams.DataplaneBackend,
+			IPSetsBackend:                  configParams.IpsetsBackend,
 			MaxIPSetSize:                   configParams.MaxIpsetSize,
 			IgnoreLooseRPF:                 configParams.IgnoreLooseRPF,
 			IPv6Enabled:                    configParams.Ipv6Support,
 			StatusReportingInterval:        configParams.ReportingIntervalSecs,
 
+			RuleCountersEnabled:      configParams.RuleCountersEnabled,
+			RuleCountersPollInterval: configParams.RuleCountersPollInterval,
+			RuleCountersPolicies:     configParams.RuleCountersPolicies(),
+			RuleCountersMaxRules:     configParams.RuleCountersMaxRules,
+
+			ConntrackTeardownEnabled:             configParams.ConntrackTeardownEnabled,
+			ConntrackTeardownMaxDeletesPerSecond: configParams.ConntrackTeardownMaxDeletesPerSecond,
+			ConntrackTeardownMinScanInterval:     configParams.ConntrackTeardownMinScanInterval,
+
 			NetlinkTimeout: configParams.NetlinkTimeoutSecs,
 
+			WarmStartSnapshotFile: configParams.WarmStartSnapshotFile,
+			WarmStartMaxAge:       configParams.WarmStartMaxAge,
+			WarmStartSaveInterval: configParams.WarmStartSaveInterval,
+			WarmStartConfigHash:   snapshot.ConfigHash(configParams.RawValues()),
+
 			ConfigChangedRestartCallback: configChangedRestartCallback,
 
 			PostInSyncCallback:              func() { logutils.DumpHeapMemoryProfile(configParams) },
@@ -154,7 +108,20 @@ func StartDataplaneDriver(configParams *config.Config,
 		intDP := intdataplane.NewIntDataplaneDriver(dpConfig)
 		intDP.Start()
 
+		if configParams.FlowLogsEnabled {
+			startFlowLogCollector(configParams)
+		}
+
 		return intDP, nil
+	} else if configParams.DataplaneDriverSocket != "" {
+		log.WithField("socket", configParams.DataplaneDriverSocket).Info(
+			"Using external dataplane driver service.")
+
+		return extdataplane.StartGRPCDataplaneDriver(
+			configParams.DataplaneDriverSocket,
+			configParams.DataplaneDriverSendTimeout,
+			healthAggregator,
+		), nil
 	} else {
 		log.WithField("driver", configParams.DataplaneDriver).Info(
 			"Using external dataplane driver.")
@@ -162,3 +129,128 @@ func StartDataplaneDriver(configParams *config.Config,
 		return extdataplane.StartExtDataplaneDriver(configParams.DataplaneDriver)
 	}
 }
+
+// RulesConfigFromConfigParams allocates the iptables mark bits and calculates the config for the
+// rule renderer, as used by the internal dataplane driver.
+func RulesConfigFromConfigParams(configParams *config.Config, kubeIPVSSupportEnabled bool) rules.Config {
+	markBitsManager := markbits.NewMarkBitsManager(configParams.IptablesMarkMask, "felix-iptables")
+	// Dedicated mark bits for accept and pass actions.  These are long lived bits
+	// that we use for communicating between chains.
+	markAccept, _ := markBitsManager.NextSingleBitMark()
+	markPass, _ := markBitsManager.NextSingleBitMark()
+	// Short-lived mark bits for local calculations within a chain.
+	markScratch0, _ := markBitsManager.NextSingleBitMark()
+	markScratch1, _ := markBitsManager.NextSingleBitMark()
+	if markAccept == 0 || markPass == 0 || markScratch0 == 0 || markScratch1 == 0 {
+		log.WithFields(log.Fields{
+			"Name":     "felix-iptables",
+			"MarkMask": configParams.IptablesMarkMask,
+		}).Panic("Not enough mark bits available.")
+	}
+
+	// Mark bits for end point mark. Currently felix takes the rest bits from mask available for use.
+	markEndpointMark, allocated := markBitsManager.NextBlockBitsMark(markBitsManager.AvailableMarkBitCount())
+	if kubeIPVSSupportEnabled && allocated == 0 {
+		log.WithFields(log.Fields{
+			"Name":     "felix-iptables",
+			"MarkMask": configParams.IptablesMarkMask,
+		}).Panic("Not enough mark bits available for endpoint mark.")
+	}
+	// Take lowest bit position (position 1) from endpoint mark mask reserved for non-calico endpoint.
+	markEndpointNonCaliEndpoint := uint32(1) << uint(bits.TrailingZeros32(markEndpointMark))
+	log.WithFields(log.Fields{
+		"acceptMark":          markAccept,
+		"passMark":            markPass,
+		"scratch0Mark":        markScratch0,
+		"scratch1Mark":        markScratch1,
+		"endpointMark":        markEndpointMark,
+		"endpointMarkNonCali": markEndpointNonCaliEndpoint,
+	}).Info("Calculated iptables mark bits")
+
+	return rules.Config{
+		WorkloadIfacePrefixes: configParams.InterfacePrefixes(),
+
+		IPSetConfigV4: ipsets.NewIPVersionConfig(
+			ipsets.IPFamilyV4,
+			rules.IPSetNamePrefix,
+			rules.AllHistoricIPSetNamePrefixes,
+			rules.LegacyV4IPSetNames,
+		),
+		IPSetConfigV6: ipsets.NewIPVersionConfig(
+			ipsets.IPFamilyV6,
+			rules.IPSetNamePrefix,
+			rules.AllHistoricIPSetNamePrefixes,
+			nil,
+		),
+
+		KubeNodePortRanges:     configParams.KubeNodePortRanges,
+		KubeIPVSSupportEnabled: kubeIPVSSupportEnabled,
+
+		OpenStackSpecialCasesEnabled: configParams.OpenstackActive(),
+		OpenStackMetadataIP:          net.ParseIP(configParams.MetadataAddr),
+		OpenStackMetadataPort:        uint16(configParams.MetadataPort),
+
+		IptablesMarkAccept:          markAccept,
+		IptablesMarkPass:            markPass,
+		IptablesMarkScratch0:        markScratch0,
+		IptablesMarkScratch1:        markScratch1,
+		IptablesMarkEndpoint:        markEndpointMark,
+		IptablesMarkNonCaliEndpoint: markEndpointNonCaliEndpoint,
+
+		IPIPEnabled:         configParams.IpInIpEnabled,
+		IPIPTunnelAddress:   configParams.IpInIpTunnelAddr,
+		IPIPEnabledV6:       configParams.IpInIpV6Enabled && configParams.Ipv6Support,
+		IPIPTunnelAddressV6: configParams.IpInIpV6TunnelAddr,
+
+		VXLANEnabled:       configParams.VXLANEnabled,
+		VXLANPort:          configParams.VXLANPort,
+		VXLANTunnelAddress: configParams.VXLANTunnelAddr,
+
+		IptablesLogPrefix:         configParams.LogPrefix,
+		EndpointToHostAction:      configParams.DefaultEndpointToHostAction,
+		IptablesFilterAllowAction: configParams.IptablesFilterAllowAction,
+		IptablesMangleAllowAction: configParams.IptablesMangleAllowAction,
+
+		FailsafeInboundHostPorts:  configParams.FailsafeInboundHostPorts,
+		FailsafeOutboundHostPorts: configParams.FailsafeOutboundHostPorts,
+
+		DisableConntrackInvalid: configParams.DisableConntrackInvalidCheck,
+
+		// When the policy sync API is enabled, workloads' agents enforce the
+		// HTTP parts of their policy.
+		HTTPMatchEnforcedExternally: configParams.PolicySyncPathPrefix != "",
+
+		FlowLogsEnabled:    configParams.FlowLogsEnabled,
+		FlowLogsNflogGroup: uint16(configParams.FlowLogsNflogGroup),
+	}
+}
+
+const conntrackAcctSysctl = "/proc/sys/net/netfilter/nf_conntrack_acct"
+
+// startFlowLogCollector starts reading the packets that our NFLOG rules log and aggregating them
+// into flow logs.  Flow logs are best-effort so failures are logged rather than being fatal.
+func startFlowLogCollector(configParams *config.Config) {
+	reader, err := collector.NewNflogReader(uint16(configParams.FlowLogsNflogGroup))
+	if err != nil {
+		log.WithError(err).Error("Failed to create NFLOG socket, flow logs disabled.")
+		return
+	}
+	packets, err := reader.Start()
+	if err != nil {
+		log.WithError(err).Error("Failed to bind to NFLOG group, flow logs disabled.")
+		return
+	}
+	sink := collector.NewFileSink(
+		configParams.FlowLogsFileDirectory,
+		int64(configParams.FlowLogsFileMaxFileSizeMB)*1024*1024,
+		configParams.FlowLogsFileMaxFiles,
+	)
+	// The collector takes the counts of allowed connections from conntrack's accounting, which
+	// is off by default.  It only applies to connections that start after it's turned on.
+	if err := ioutil.WriteFile(conntrackAcctSysctl, []byte("1"), 0644); err != nil {
+		log.WithError(err).Warn("Failed to enable conntrack accounting, flow logs will only " +
+			"count the first packet of each allowed connection.")
+	}
+	collector.New(packets, configParams.FlowLogsFlushInterval, conntrack.New(), sink).Start()
+	log.WithField("group", configParams.FlowLogsNflogGroup).Info("Started flow log collector.")
+}
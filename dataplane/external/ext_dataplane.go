@@ -12,8 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// extdataplane implements the connection to an external dataplane driver, connected via
-// a pair of pipes.
+// extdataplane implements the connection to an external dataplane driver.  The driver is
+// either started as a child process and connected via a pair of pipes, or it runs as a
+// separate service that Felix connects to over gRPC (see grpc_dataplane.go).
 package extdataplane
 
 import (
@@ -104,32 +105,67 @@ func (c *extDataplaneConn) RecvMessage() (msg interface{}, err error) {
 	}
 	log.WithField("envelope", envelope).Debug("Received message from dataplane.")
 
+	msg = unwrapFromDataplane(&envelope)
+	return
+}
+
+// unwrapFromDataplane returns the payload of a message from the driver, or nil if it is of
+// an unknown type.
+func unwrapFromDataplane(envelope *proto.FromDataplane) interface{} {
 	switch payload := envelope.Payload.(type) {
 	case *proto.FromDataplane_ProcessStatusUpdate:
-		msg = payload.ProcessStatusUpdate
+		return payload.ProcessStatusUpdate
 	case *proto.FromDataplane_WorkloadEndpointStatusUpdate:
-		msg = payload.WorkloadEndpointStatusUpdate
+		return payload.WorkloadEndpointStatusUpdate
 	case *proto.FromDataplane_WorkloadEndpointStatusRemove:
-		msg = payload.WorkloadEndpointStatusRemove
+		return payload.WorkloadEndpointStatusRemove
 	case *proto.FromDataplane_HostEndpointStatusUpdate:
-		msg = payload.HostEndpointStatusUpdate
+		return payload.HostEndpointStatusUpdate
 	case *proto.FromDataplane_HostEndpointStatusRemove:
-		msg = payload.HostEndpointStatusRemove
+		return payload.HostEndpointStatusRemove
 	default:
 		log.WithField("payload", payload).Warn("Ignoring unknown message from dataplane")
 	}
-
-	return
+	return nil
 }
 
 func (fc *extDataplaneConn) SendMessage(msg interface{}) error {
 	log.Debugf("Writing msg (%v) to felix: %#v", fc.nextSeqNumber, msg)
-	// Wrap the payload message in an envelope so that protobuf takes care of deserialising
-	// it as the correct type.
+	envelope := WrapToDataplane(fc.nextSeqNumber, msg)
+	fc.nextSeqNumber += 1
+	data, err := pb.Marshal(envelope)
+
+	if err != nil {
+		log.WithError(err).WithField("msg", msg).Panic(
+			"Failed to marshal data to front end")
+	}
+
+	lengthBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(lengthBytes, uint64(len(data)))
+	var messageBuf bytes.Buffer
+	messageBuf.Write(lengthBytes)
+	messageBuf.Write(data)
+	for {
+		_, err := messageBuf.WriteTo(fc.toDataplane)
+		if err == io.ErrShortWrite {
+			log.Warn("Short write to dataplane driver; buffer full?")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		log.Debug("Wrote message to dataplane driver")
+		break
+	}
+	return nil
+}
+
+// WrapToDataplane wraps the payload message in an envelope so that protobuf takes care of
+// deserialising it as the correct type.
+func WrapToDataplane(seqNo uint64, msg interface{}) *proto.ToDataplane {
 	envelope := &proto.ToDataplane{
-		SequenceNumber: fc.nextSeqNumber,
+		SequenceNumber: seqNo,
 	}
-	fc.nextSeqNumber += 1
 	switch msg := msg.(type) {
 	case *proto.ConfigUpdate:
 		envelope.Payload = &proto.ToDataplane_ConfigUpdate{msg}
@@ -173,32 +209,12 @@ func (fc *extDataplaneConn) SendMessage(msg interface{}) error {
 		envelope.Payload = &proto.ToDataplane_NamespaceUpdate{msg}
 	case *proto.NamespaceRemove:
 		envelope.Payload = &proto.ToDataplane_NamespaceRemove{msg}
+	case *proto.RouteUpdate:
+		envelope.Payload = &proto.ToDataplane_RouteUpdate{msg}
+	case *proto.RouteRemove:
+		envelope.Payload = &proto.ToDataplane_RouteRemove{msg}
 	default:
 		log.WithField("msg", msg).Panic("Unknown message type")
 	}
-	data, err := pb.Marshal(envelope)
-
-	if err != nil {
-		log.WithError(err).WithField("msg", msg).Panic(
-			"Failed to marshal data to front end")
-	}
-
-	lengthBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(lengthBytes, uint64(len(data)))
-	var messageBuf bytes.Buffer
-	messageBuf.Write(lengthBytes)
-	messageBuf.Write(data)
-	for {
-		_, err := messageBuf.WriteTo(fc.toDataplane)
-		if err == io.ErrShortWrite {
-			log.Warn("Short write to dataplane driver; buffer full?")
-			continue
-		}
-		if err != nil {
-			return err
-		}
-		log.Debug("Wrote message to dataplane driver")
-		break
-	}
-	return nil
+	return envelope
 }
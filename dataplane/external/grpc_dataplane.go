@@ -0,0 +1,330 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extdataplane
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/projectcalico/felix/buildinfo"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/health"
+)
+
+const (
+	// ProtocolVersion is the version of the Dataplane gRPC API that Felix speaks.
+	ProtocolVersion = 1
+
+	// CapabilityIPSetDeltas means that the driver handles IPSetDeltaUpdate messages.  If the
+	// driver doesn't support it, Felix sends a full IPSetUpdate instead of each delta.
+	CapabilityIPSetDeltas = "ipset-deltas"
+	// CapabilityHealthReports means that the driver sends DataplaneHealthUpdate messages.  If
+	// the driver supports it, Felix is only ready while the driver reports that it's ready.
+	CapabilityHealthReports = "health-reports"
+
+	grpcHealthName     = "ext_dataplane"
+	grpcHealthInterval = 10 * time.Second
+	// driverHealthTimeout is how long we trust the driver's last health report for.
+	driverHealthTimeout = grpcHealthInterval * 2
+
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 10 * time.Second
+	dialTimeout         = 5 * time.Second
+)
+
+var felixCapabilities = []string{CapabilityIPSetDeltas}
+
+// GRPCDataplaneConn is a connection to an external dataplane driver that runs as a separate,
+// long-lived service and serves the Dataplane gRPC API on a unix socket.
+//
+// If the connection fails, GRPCDataplaneConn reconnects (with backoff) and resyncs the driver
+// by sending it the complete current state, followed by InSync if Felix has already sent
+// InSync.  Updates that Felix sends while the driver is disconnected are only recorded in the
+// cache, so SendMessage never blocks waiting for the driver to come back.  If the driver stops
+// accepting updates, SendMessage gives up after the send timeout and disconnects from the
+// driver, which then gets resynced when we reconnect.
+type GRPCDataplaneConn struct {
+	socketPath       string
+	sendTimeout      time.Duration
+	healthAggregator *health.HealthAggregator
+
+	// lock protects the fields below.  It's held while sending to the driver so that
+	// SendMessage doesn't interleave updates with a resync.
+	lock            sync.Mutex
+	cache           *stateCache
+	stream          proto.Dataplane_ConnectClient
+	cancelStream    context.CancelFunc
+	deltasSupported bool
+	nextSeqNumber   uint64
+
+	// reportsHealth is set if the connected driver sends health reports.  lastDriverHealth is
+	// the last one that it sent, and lastDriverHealthTime is when we received it.
+	reportsHealth        bool
+	lastDriverHealth     *proto.DataplaneHealthUpdate
+	lastDriverHealthTime time.Time
+
+	fromDataplane chan interface{}
+}
+
+// StartGRPCDataplaneDriver starts connecting to the driver's socket in the background and
+// returns the connection.  sendTimeout limits how long each send to the driver may block.
+func StartGRPCDataplaneDriver(
+	socketPath string,
+	sendTimeout time.Duration,
+	healthAggregator *health.HealthAggregator,
+) *GRPCDataplaneConn {
+	c := &GRPCDataplaneConn{
+		socketPath:       socketPath,
+		sendTimeout:      sendTimeout,
+		healthAggregator: healthAggregator,
+		cache:            newStateCache(),
+		fromDataplane:    make(chan interface{}),
+	}
+	if healthAggregator != nil {
+		healthAggregator.RegisterReporter(
+			grpcHealthName,
+			&health.HealthReport{Live: true, Ready: true},
+			grpcHealthInterval*2,
+		)
+		c.reportHealth()
+	}
+	go c.loopConnecting()
+	go c.loopReportingHealth()
+	return c
+}
+
+// RecvMessage blocks until the driver sends a message.  It never returns an error since the
+// connection is re-established if it fails.
+func (c *GRPCDataplaneConn) RecvMessage() (msg interface{}, err error) {
+	return <-c.fromDataplane, nil
+}
+
+func (c *GRPCDataplaneConn) SendMessage(msg interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cache.OnUpdate(msg)
+	if c.stream == nil {
+		log.WithField("msg", msg).Debug("Dataplane driver not connected, cached update")
+		return nil
+	}
+	if delta, ok := msg.(*proto.IPSetDeltaUpdate); ok && !c.deltasSupported {
+		if update := c.cache.IPSetUpdate(delta.Id); update != nil {
+			msg = update
+		}
+	}
+	if err := c.sendLocked(msg); err != nil {
+		// Disconnect; loopConnecting will notice and reconnect, then resync the driver
+		// from the cache, which already includes this update.
+		log.WithError(err).Warn("Failed to send to dataplane driver, will reconnect")
+		c.disconnectLocked()
+	}
+	return nil
+}
+
+func (c *GRPCDataplaneConn) sendLocked(msg interface{}) error {
+	envelope := WrapToDataplane(c.nextSeqNumber, msg)
+	c.nextSeqNumber++
+	if c.sendTimeout > 0 {
+		// Send blocks if the driver isn't reading from the stream.  Cancelling the stream
+		// unblocks it; our caller then disconnects.
+		cancelStream := c.cancelStream
+		timer := time.AfterFunc(c.sendTimeout, func() {
+			log.WithField("timeout", c.sendTimeout).Warn("Timed out sending to dataplane driver")
+			cancelStream()
+		})
+		defer timer.Stop()
+	}
+	return c.stream.Send(envelope)
+}
+
+func (c *GRPCDataplaneConn) disconnectLocked() {
+	if c.cancelStream != nil {
+		c.cancelStream()
+	}
+	c.stream = nil
+	c.cancelStream = nil
+}
+
+func (c *GRPCDataplaneConn) loopConnecting() {
+	backoff := minReconnectBackoff
+	for {
+		connected, err := c.connectOnce()
+		logCxt := log.WithField("socket", c.socketPath)
+		if err != nil {
+			logCxt = logCxt.WithError(err)
+		}
+		if connected {
+			logCxt.Warn("Connection to dataplane driver failed, reconnecting")
+			backoff = minReconnectBackoff
+		} else {
+			logCxt.WithField("backoff", backoff).Warn("Failed to connect to dataplane driver")
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// connectOnce connects to the driver, resyncs it and then passes on messages from the driver
+// until the connection fails.  It returns true if it got as far as resyncing the driver.
+func (c *GRPCDataplaneConn) connectOnce() (connected bool, err error) {
+	dialCtx, cancelDial := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancelDial()
+	conn, err := grpc.DialContext(dialCtx, c.socketPath,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}),
+	)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	client := proto.NewDataplaneClient(conn)
+
+	hello, err := client.Hello(dialCtx, &proto.DataplaneHello{
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    felixCapabilities,
+		Version:         buildinfo.GitVersion,
+	})
+	if err != nil {
+		return false, err
+	}
+	if hello.ProtocolVersion != ProtocolVersion {
+		return false, fmt.Errorf("dataplane driver speaks protocol version %d, Felix speaks %d",
+			hello.ProtocolVersion, ProtocolVersion)
+	}
+	deltasSupported := false
+	reportsHealth := false
+	for _, capability := range hello.Capabilities {
+		switch capability {
+		case CapabilityIPSetDeltas:
+			deltasSupported = true
+		case CapabilityHealthReports:
+			reportsHealth = true
+		}
+	}
+	log.WithFields(log.Fields{
+		"driverVersion": hello.Version,
+		"capabilities":  hello.Capabilities,
+	}).Info("Connected to dataplane driver")
+
+	streamCtx, cancelStream := context.WithCancel(context.Background())
+	defer cancelStream()
+	stream, err := client.Connect(streamCtx)
+	if err != nil {
+		return false, err
+	}
+
+	// Resync the driver before we let SendMessage use the stream.
+	c.lock.Lock()
+	c.stream = stream
+	c.cancelStream = cancelStream
+	c.deltasSupported = deltasSupported
+	c.reportsHealth = reportsHealth
+	c.lastDriverHealth = nil
+	c.nextSeqNumber = 0
+	err = c.cache.Replay(c.sendLocked)
+	if err != nil {
+		c.disconnectLocked()
+		c.lock.Unlock()
+		return false, err
+	}
+	c.lock.Unlock()
+	log.Info("Resynced dataplane driver")
+	c.reportHealth()
+	defer c.reportHealth()
+
+	defer func() {
+		c.lock.Lock()
+		if c.stream == stream {
+			c.disconnectLocked()
+		}
+		c.lock.Unlock()
+	}()
+	for {
+		envelope, err := stream.Recv()
+		if err != nil {
+			return true, err
+		}
+		if healthUpdate := envelope.GetDataplaneHealthUpdate(); healthUpdate != nil {
+			c.onDriverHealthUpdate(healthUpdate)
+			continue
+		}
+		if msg := unwrapFromDataplane(envelope); msg != nil {
+			c.fromDataplane <- msg
+		}
+	}
+}
+
+func (c *GRPCDataplaneConn) loopReportingHealth() {
+	if c.healthAggregator == nil {
+		return
+	}
+	for range time.NewTicker(grpcHealthInterval).C {
+		c.reportHealth()
+	}
+}
+
+func (c *GRPCDataplaneConn) onDriverHealthUpdate(update *proto.DataplaneHealthUpdate) {
+	log.WithField("health", update).Debug("Health report from dataplane driver")
+	c.lock.Lock()
+	changed := c.lastDriverHealth == nil ||
+		c.lastDriverHealth.Live != update.Live ||
+		c.lastDriverHealth.Ready != update.Ready
+	c.lastDriverHealth = update
+	c.lastDriverHealthTime = time.Now()
+	c.lock.Unlock()
+	if changed {
+		c.reportHealth()
+	}
+}
+
+// reportHealth reports our health, which depends on whether we're connected to the driver and,
+// if the driver sends health reports, the driver's health.
+func (c *GRPCDataplaneConn) reportHealth() {
+	if c.healthAggregator == nil {
+		return
+	}
+	c.lock.Lock()
+	report := c.healthLocked()
+	c.lock.Unlock()
+	c.healthAggregator.Report(grpcHealthName, report)
+}
+
+func (c *GRPCDataplaneConn) healthLocked() *health.HealthReport {
+	if c.stream == nil {
+		return &health.HealthReport{Live: true, Ready: false}
+	}
+	if !c.reportsHealth {
+		return &health.HealthReport{Live: true, Ready: true}
+	}
+	if c.lastDriverHealth == nil || time.Since(c.lastDriverHealthTime) > driverHealthTimeout {
+		// Either the driver hasn't reported yet or it's stopped reporting; either way, we
+		// can't vouch for it.
+		return &health.HealthReport{Live: true, Ready: false}
+	}
+	return &health.HealthReport{Live: c.lastDriverHealth.Live, Ready: c.lastDriverHealth.Ready}
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extdataplane_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/projectcalico/felix/dataplane/external"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/health"
+)
+
+// fakeDriver serves the Dataplane API and records the updates that it receives.
+type fakeDriver struct {
+	protocolVersion uint32
+	capabilities    []string
+	received        chan *proto.ToDataplane
+	toFelix         chan *proto.FromDataplane
+	grpcServer      *grpc.Server
+
+	// connects receives a value each time Felix opens a stream.
+	connects chan struct{}
+	// If stalled is non-nil, the driver doesn't read from its streams until it's closed.
+	stalled chan struct{}
+}
+
+func startFakeDriver(socketPath string, capabilities ...string) *fakeDriver {
+	return startFakeDriverWithStall(socketPath, nil, capabilities...)
+}
+
+func startFakeDriverWithStall(socketPath string, stalled chan struct{}, capabilities ...string) *fakeDriver {
+	d := &fakeDriver{
+		protocolVersion: extdataplane.ProtocolVersion,
+		capabilities:    capabilities,
+		received:        make(chan *proto.ToDataplane, 100),
+		toFelix:         make(chan *proto.FromDataplane),
+		// Use a fixed flow control window so that Felix's sends block when the driver
+		// isn't reading.
+		grpcServer: grpc.NewServer(
+			grpc.InitialWindowSize(65535),
+			grpc.InitialConnWindowSize(65535),
+		),
+		connects: make(chan struct{}, 100),
+		stalled:  stalled,
+	}
+	proto.RegisterDataplaneServer(d.grpcServer, d)
+	lis, err := net.Listen("unix", socketPath)
+	Expect(err).NotTo(HaveOccurred())
+	go d.grpcServer.Serve(lis)
+	return d
+}
+
+func (d *fakeDriver) Hello(_ context.Context, _ *proto.DataplaneHello) (*proto.DataplaneHello, error) {
+	return &proto.DataplaneHello{
+		ProtocolVersion: d.protocolVersion,
+		Capabilities:    d.capabilities,
+		Version:         "fake",
+	}, nil
+}
+
+func (d *fakeDriver) Connect(stream proto.Dataplane_ConnectServer) error {
+	d.connects <- struct{}{}
+	if d.stalled != nil {
+		select {
+		case <-d.stalled:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+	go func() {
+		for msg := range d.toFelix {
+			if stream.Send(msg) != nil {
+				return
+			}
+		}
+	}()
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		d.received <- msg
+	}
+}
+
+func (d *fakeDriver) stop() {
+	d.grpcServer.Stop()
+}
+
+var _ = Describe("gRPC dataplane connection", func() {
+	var (
+		tempDir    string
+		socketPath string
+		driver     *fakeDriver
+		conn       *extdataplane.GRPCDataplaneConn
+	)
+
+	polID := proto.PolicyID{Tier: "default", Name: "pol1"}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "extdataplane")
+		Expect(err).NotTo(HaveOccurred())
+		socketPath = filepath.Join(tempDir, "socket")
+	})
+
+	AfterEach(func() {
+		if driver != nil {
+			driver.stop()
+		}
+		os.RemoveAll(tempDir)
+	})
+
+	Describe("with a driver that supports IP set deltas", func() {
+		BeforeEach(func() {
+			driver = startFakeDriver(socketPath, extdataplane.CapabilityIPSetDeltas)
+			conn = extdataplane.StartGRPCDataplaneDriver(socketPath, time.Second, nil)
+		})
+
+		It("should resync the driver with the cached state after it reconnects", func() {
+			Expect(conn.SendMessage(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}})).To(Succeed())
+			Expect(conn.SendMessage(&proto.ActivePolicyUpdate{Id: &polID, Policy: &proto.Policy{}})).To(Succeed())
+			Expect(conn.SendMessage(&proto.InSync{})).To(Succeed())
+			Eventually(driver.received, "5s").Should(HaveLen(3))
+			for len(driver.received) > 0 {
+				<-driver.received
+			}
+
+			driver.stop()
+			os.Remove(socketPath)
+			Expect(conn.SendMessage(&proto.IPSetDeltaUpdate{Id: "s1", AddedMembers: []string{"10.0.0.2"}})).To(Succeed())
+			driver = startFakeDriver(socketPath, extdataplane.CapabilityIPSetDeltas)
+
+			var msg *proto.ToDataplane
+			Eventually(driver.received, "15s").Should(Receive(&msg))
+			Expect(msg.GetIpsetUpdate()).To(Equal(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1", "10.0.0.2"}}))
+			Eventually(driver.received).Should(Receive(&msg))
+			Expect(msg.GetActivePolicyUpdate().GetId()).To(Equal(&polID))
+			Eventually(driver.received).Should(Receive(&msg))
+			Expect(msg.GetInSync()).NotTo(BeNil())
+		})
+
+		It("should pass on messages from the driver", func() {
+			Expect(conn.SendMessage(&proto.InSync{})).To(Succeed())
+			Eventually(driver.received, "5s").Should(Receive())
+			driver.toFelix <- &proto.FromDataplane{
+				Payload: &proto.FromDataplane_ProcessStatusUpdate{
+					ProcessStatusUpdate: &proto.ProcessStatusUpdate{Uptime: 10},
+				},
+			}
+			msg, err := conn.RecvMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg).To(Equal(&proto.ProcessStatusUpdate{Uptime: 10}))
+		})
+	})
+
+	Describe("with a driver that stops reading", func() {
+		var stalled chan struct{}
+
+		BeforeEach(func() {
+			stalled = make(chan struct{})
+			driver = startFakeDriverWithStall(socketPath, stalled)
+			conn = extdataplane.StartGRPCDataplaneDriver(socketPath, 200*time.Millisecond, nil)
+		})
+
+		It("should give up on the send, reconnect and resync the driver", func() {
+			Eventually(driver.connects, "5s").Should(Receive())
+
+			// Each update is bigger than the driver's flow control window so the first
+			// one blocks until the send timeout disconnects the driver.
+			members := make([]string, 20000)
+			for i := range members {
+				members[i] = fmt.Sprintf("10.%d.%d.1", i/256, i%256)
+			}
+			start := time.Now()
+			Expect(conn.SendMessage(&proto.IPSetUpdate{Id: "s1", Members: members})).To(Succeed())
+			Expect(conn.SendMessage(&proto.InSync{})).To(Succeed())
+			Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+			Eventually(driver.connects, "5s").Should(Receive())
+
+			close(stalled)
+			var msg *proto.ToDataplane
+			Eventually(driver.received, "15s").Should(Receive(&msg))
+			Expect(msg.GetIpsetUpdate().GetMembers()).To(HaveLen(len(members)))
+			Eventually(driver.received).Should(Receive(&msg))
+			Expect(msg.GetInSync()).NotTo(BeNil())
+		})
+	})
+
+	Describe("with a driver that reports its health", func() {
+		var healthAggregator *health.HealthAggregator
+
+		BeforeEach(func() {
+			healthAggregator = health.NewHealthAggregator()
+			driver = startFakeDriver(socketPath, extdataplane.CapabilityHealthReports)
+			conn = extdataplane.StartGRPCDataplaneDriver(socketPath, time.Second, healthAggregator)
+		})
+
+		sendHealth := func(live, ready bool) {
+			driver.toFelix <- &proto.FromDataplane{
+				Payload: &proto.FromDataplane_DataplaneHealthUpdate{
+					DataplaneHealthUpdate: &proto.DataplaneHealthUpdate{Live: live, Ready: ready},
+				},
+			}
+		}
+
+		It("should only be ready once the driver reports that it's ready", func() {
+			Eventually(driver.connects, "5s").Should(Receive())
+			Consistently(healthAggregator.Summary, "500ms").Should(Equal(&health.HealthReport{Live: true, Ready: false}))
+			sendHealth(true, true)
+			Eventually(healthAggregator.Summary).Should(Equal(&health.HealthReport{Live: true, Ready: true}))
+			sendHealth(false, false)
+			Eventually(healthAggregator.Summary).Should(Equal(&health.HealthReport{Live: false, Ready: false}))
+		})
+
+		It("should not be ready after the driver disconnects", func() {
+			sendHealth(true, true)
+			Eventually(healthAggregator.Summary).Should(Equal(&health.HealthReport{Live: true, Ready: true}))
+			driver.stop()
+			Eventually(healthAggregator.Summary).Should(Equal(&health.HealthReport{Live: true, Ready: false}))
+		})
+	})
+
+	Describe("with a driver that doesn't support IP set deltas", func() {
+		BeforeEach(func() {
+			driver = startFakeDriver(socketPath)
+			conn = extdataplane.StartGRPCDataplaneDriver(socketPath, time.Second, nil)
+		})
+
+		It("should send full IP set updates instead of deltas", func() {
+			Expect(conn.SendMessage(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}})).To(Succeed())
+			Eventually(driver.received, "5s").Should(Receive())
+			Expect(conn.SendMessage(&proto.IPSetDeltaUpdate{Id: "s1", AddedMembers: []string{"10.0.0.2"}})).To(Succeed())
+			var msg *proto.ToDataplane
+			Eventually(driver.received).Should(Receive(&msg))
+			Expect(msg.GetIpsetUpdate()).To(Equal(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1", "10.0.0.2"}}))
+		})
+	})
+})
@@ -0,0 +1,196 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extdataplane
+
+import (
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+type ipSetState struct {
+	ipSetType proto.IPSetUpdate_IPSetType
+	members   set.Set
+}
+
+// stateCache records the current state that Felix has sent to the dataplane driver so that it
+// can be replayed to the driver in full when the driver reconnects.  IP set deltas are folded
+// into their IP sets so that the replay only contains full updates.
+type stateCache struct {
+	config          *proto.ConfigUpdate
+	ipSets          map[string]*ipSetState
+	profiles        map[proto.ProfileID]*proto.ActiveProfileUpdate
+	policies        map[proto.PolicyID]*proto.ActivePolicyUpdate
+	hostEndpoints   map[proto.HostEndpointID]*proto.HostEndpointUpdate
+	workloadEPs     map[proto.WorkloadEndpointID]*proto.WorkloadEndpointUpdate
+	hostMetadata    map[string]*proto.HostMetadataUpdate
+	ipamPools       map[string]*proto.IPAMPoolUpdate
+	serviceAccounts map[proto.ServiceAccountID]*proto.ServiceAccountUpdate
+	namespaces      map[proto.NamespaceID]*proto.NamespaceUpdate
+	routes          map[string]*proto.RouteUpdate
+	inSync          bool
+}
+
+func newStateCache() *stateCache {
+	return &stateCache{
+		ipSets:          map[string]*ipSetState{},
+		profiles:        map[proto.ProfileID]*proto.ActiveProfileUpdate{},
+		policies:        map[proto.PolicyID]*proto.ActivePolicyUpdate{},
+		hostEndpoints:   map[proto.HostEndpointID]*proto.HostEndpointUpdate{},
+		workloadEPs:     map[proto.WorkloadEndpointID]*proto.WorkloadEndpointUpdate{},
+		hostMetadata:    map[string]*proto.HostMetadataUpdate{},
+		ipamPools:       map[string]*proto.IPAMPoolUpdate{},
+		serviceAccounts: map[proto.ServiceAccountID]*proto.ServiceAccountUpdate{},
+		namespaces:      map[proto.NamespaceID]*proto.NamespaceUpdate{},
+		routes:          map[string]*proto.RouteUpdate{},
+	}
+}
+
+// OnUpdate records the given message, which must be one of the messages that
+// WrapToDataplane accepts.
+func (c *stateCache) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.ConfigUpdate:
+		c.config = msg
+	case *proto.InSync:
+		c.inSync = true
+	case *proto.IPSetUpdate:
+		members := set.New()
+		for _, m := range msg.Members {
+			members.Add(m)
+		}
+		c.ipSets[msg.Id] = &ipSetState{ipSetType: msg.Type, members: members}
+	case *proto.IPSetDeltaUpdate:
+		ipSet := c.ipSets[msg.Id]
+		if ipSet == nil {
+			log.WithField("id", msg.Id).Warn("Delta update for unknown IP set")
+			return
+		}
+		for _, m := range msg.RemovedMembers {
+			ipSet.members.Discard(m)
+		}
+		for _, m := range msg.AddedMembers {
+			ipSet.members.Add(m)
+		}
+	case *proto.IPSetRemove:
+		delete(c.ipSets, msg.Id)
+	case *proto.ActiveProfileUpdate:
+		c.profiles[*msg.Id] = msg
+	case *proto.ActiveProfileRemove:
+		delete(c.profiles, *msg.Id)
+	case *proto.ActivePolicyUpdate:
+		c.policies[*msg.Id] = msg
+	case *proto.ActivePolicyRemove:
+		delete(c.policies, *msg.Id)
+	case *proto.HostEndpointUpdate:
+		c.hostEndpoints[*msg.Id] = msg
+	case *proto.HostEndpointRemove:
+		delete(c.hostEndpoints, *msg.Id)
+	case *proto.WorkloadEndpointUpdate:
+		c.workloadEPs[*msg.Id] = msg
+	case *proto.WorkloadEndpointRemove:
+		delete(c.workloadEPs, *msg.Id)
+	case *proto.HostMetadataUpdate:
+		c.hostMetadata[msg.Hostname] = msg
+	case *proto.HostMetadataRemove:
+		delete(c.hostMetadata, msg.Hostname)
+	case *proto.IPAMPoolUpdate:
+		c.ipamPools[msg.Id] = msg
+	case *proto.IPAMPoolRemove:
+		delete(c.ipamPools, msg.Id)
+	case *proto.ServiceAccountUpdate:
+		c.serviceAccounts[*msg.Id] = msg
+	case *proto.ServiceAccountRemove:
+		delete(c.serviceAccounts, *msg.Id)
+	case *proto.NamespaceUpdate:
+		c.namespaces[*msg.Id] = msg
+	case *proto.NamespaceRemove:
+		delete(c.namespaces, *msg.Id)
+	case *proto.RouteUpdate:
+		c.routes[msg.Dst] = msg
+	case *proto.RouteRemove:
+		delete(c.routes, msg.Dst)
+	default:
+		log.WithField("msg", msg).Panic("Unknown message type")
+	}
+}
+
+// IPSetUpdate returns a full update for the given IP set, or nil if it isn't known.
+func (c *stateCache) IPSetUpdate(id string) *proto.IPSetUpdate {
+	ipSet := c.ipSets[id]
+	if ipSet == nil {
+		return nil
+	}
+	var members []string
+	ipSet.members.Iter(func(item interface{}) error {
+		members = append(members, item.(string))
+		return nil
+	})
+	sort.Strings(members)
+	return &proto.IPSetUpdate{Id: id, Type: ipSet.ipSetType, Members: members}
+}
+
+// Replay calls send for each message in the cache, in the same order that the calculation
+// graph guarantees: config, then metadata, IP sets, profiles and policies, and then the
+// endpoints that refer to them.  It finishes with InSync if the cache has seen InSync.
+// Within each type, messages are sent in an arbitrary order.
+func (c *stateCache) Replay(send func(msg interface{}) error) error {
+	var msgs []interface{}
+	if c.config != nil {
+		msgs = append(msgs, c.config)
+	}
+	for _, m := range c.hostMetadata {
+		msgs = append(msgs, m)
+	}
+	for _, m := range c.ipamPools {
+		msgs = append(msgs, m)
+	}
+	for id := range c.ipSets {
+		msgs = append(msgs, c.IPSetUpdate(id))
+	}
+	for _, m := range c.profiles {
+		msgs = append(msgs, m)
+	}
+	for _, m := range c.policies {
+		msgs = append(msgs, m)
+	}
+	for _, m := range c.serviceAccounts {
+		msgs = append(msgs, m)
+	}
+	for _, m := range c.namespaces {
+		msgs = append(msgs, m)
+	}
+	for _, m := range c.hostEndpoints {
+		msgs = append(msgs, m)
+	}
+	for _, m := range c.workloadEPs {
+		msgs = append(msgs, m)
+	}
+	for _, m := range c.routes {
+		msgs = append(msgs, m)
+	}
+	if c.inSync {
+		msgs = append(msgs, &proto.InSync{})
+	}
+	for _, m := range msgs {
+		if err := send(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
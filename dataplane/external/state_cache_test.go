@@ -0,0 +1,83 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extdataplane
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("stateCache", func() {
+	var cache *stateCache
+	var replay func() []interface{}
+
+	BeforeEach(func() {
+		cache = newStateCache()
+		replay = func() []interface{} {
+			var msgs []interface{}
+			Expect(cache.Replay(func(msg interface{}) error {
+				msgs = append(msgs, msg)
+				return nil
+			})).To(Succeed())
+			return msgs
+		}
+	})
+
+	It("should replay nothing when empty", func() {
+		Expect(replay()).To(BeEmpty())
+	})
+
+	It("should fold IP set deltas into the IP set", func() {
+		cache.OnUpdate(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1", "10.0.0.2"}})
+		cache.OnUpdate(&proto.IPSetDeltaUpdate{
+			Id:             "s1",
+			AddedMembers:   []string{"10.0.0.3"},
+			RemovedMembers: []string{"10.0.0.1"},
+		})
+		Expect(replay()).To(Equal([]interface{}{
+			&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.2", "10.0.0.3"}},
+		}))
+	})
+
+	It("should replay IP sets before policies before endpoints, then InSync", func() {
+		polID := proto.PolicyID{Tier: "default", Name: "pol1"}
+		epID := proto.WorkloadEndpointID{OrchestratorId: "k8s", WorkloadId: "ns1/pod1", EndpointId: "eth0"}
+		epUpd := &proto.WorkloadEndpointUpdate{Id: &epID, Endpoint: &proto.WorkloadEndpoint{}}
+		polUpd := &proto.ActivePolicyUpdate{Id: &polID, Policy: &proto.Policy{}}
+		cache.OnUpdate(epUpd)
+		cache.OnUpdate(polUpd)
+		cache.OnUpdate(&proto.IPSetUpdate{Id: "s1"})
+		cache.OnUpdate(&proto.InSync{})
+		Expect(replay()).To(Equal([]interface{}{
+			&proto.IPSetUpdate{Id: "s1"},
+			polUpd,
+			epUpd,
+			&proto.InSync{},
+		}))
+	})
+
+	It("should forget removed resources", func() {
+		polID := proto.PolicyID{Tier: "default", Name: "pol1"}
+		cache.OnUpdate(&proto.ActivePolicyUpdate{Id: &polID, Policy: &proto.Policy{}})
+		cache.OnUpdate(&proto.IPSetUpdate{Id: "s1"})
+		cache.OnUpdate(&proto.RouteUpdate{Dst: "10.0.1.0/26"})
+		cache.OnUpdate(&proto.ActivePolicyRemove{Id: &polID})
+		cache.OnUpdate(&proto.IPSetRemove{Id: "s1"})
+		cache.OnUpdate(&proto.RouteRemove{Dst: "10.0.1.0/26"})
+		Expect(replay()).To(BeEmpty())
+	})
+})
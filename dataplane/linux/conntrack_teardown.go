@@ -0,0 +1,532 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/conntrack"
+	"github.com/projectcalico/felix/policysim"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+var (
+	countTeardownScans = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_conntrack_teardown_scans",
+		Help: "Number of scans of the conntrack table for flows that policy no longer allows.",
+	})
+	countTeardownFlowsChecked = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_conntrack_teardown_flows_checked",
+		Help: "Number of flows of affected endpoints that were checked against the current policy.",
+	})
+	countTeardownFlowsDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_conntrack_teardown_flows_deleted",
+		Help: "Number of flows deleted because policy no longer allows them.",
+	})
+	countTeardownFlowsDeferred = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_conntrack_teardown_flows_deferred",
+		Help: "Number of denied flows left for a later scan by the deletion rate limit.",
+	})
+	countTeardownErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_conntrack_teardown_errors",
+		Help: "Number of conntrack teardown scans that failed.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(countTeardownScans)
+	prometheus.MustRegister(countTeardownFlowsChecked)
+	prometheus.MustRegister(countTeardownFlowsDeleted)
+	prometheus.MustRegister(countTeardownFlowsDeferred)
+	prometheus.MustRegister(countTeardownErrors)
+}
+
+// conntrackDeleter is implemented by conntrack.Conntrack.
+type conntrackDeleter interface {
+	DeleteFlowsFunc(ipVersion uint8, match func(flow *conntrack.Flow) bool) (int, error)
+}
+
+// dataplaneAppliedMarker is queued after each apply() so that the teardown goroutine knows
+// which of the queued updates are now in the dataplane.
+type dataplaneAppliedMarker struct{}
+
+// conntrackTeardown deletes the conntrack flows of local workload endpoints that a policy
+// change has made disallowed.  Without it, narrowing a policy doesn't affect established
+// connections because our rules accept packets of known flows before they reach the policy
+// chains.
+//
+// The dataplane goroutine passes us the same updates as the managers and then tells us when
+// they've been applied.  We track which endpoints each applied update could have affected: an
+// endpoint whose policies, profiles or their IP sets changed.  Then, in our own goroutine, we
+// dump the conntrack table, evaluate each flow of those endpoints against the new policy with
+// policysim and delete the flows that would now be denied.
+//
+// We don't try to work out whether an update removed allowed traffic; we re-check the flows and
+// only delete the denied ones so, if the update only added traffic, the scan deletes nothing.
+// Scans are at least minScanInterval apart and at most maxDeletesPerSecond flows are deleted per
+// second; denied flows over the limit are deleted by later scans.  Only TCP, UDP, SCTP and
+// UDP-Lite flows are checked since policysim can't reconstruct the ICMP type of a flow, and
+// host endpoints are not covered.  Flows from the host's own IPs are skipped since, like the
+// OUTPUT chain, we don't police host to workload traffic.  The state that we apply when the
+// datastore first comes in sync is treated as a baseline rather than as a change.
+type conntrackTeardown struct {
+	conntrack           conntrackDeleter
+	ipVersions          []uint8
+	wlIfacesRegexp      *regexp.Regexp
+	maxDeletesPerSecond int
+	minScanInterval     time.Duration
+	now                 func() time.Time
+
+	// lock protects pending, which the dataplane goroutine appends to.
+	lock    sync.Mutex
+	pending []interface{}
+	wakeC   chan struct{}
+
+	// The remaining fields are only accessed from the teardown goroutine.
+
+	// sim evaluates flows against the applied policy.
+	sim       *policysim.Snapshot
+	endpoints map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint
+	policies  map[proto.PolicyID]*proto.Policy
+	profiles  map[proto.ProfileID]*proto.Profile
+	// hostIfaceToAddrs maps each host interface to its IPs, so that we can spot flows from
+	// the host.
+	hostIfaceToAddrs map[string]set.Set
+
+	// Updates since the last applied marker.
+	dirtyEndpoints set.Set
+	dirtyPolicies  set.Set
+	dirtyProfiles  set.Set
+	dirtyIPSets    set.Set
+
+	// inSync is set once we've seen the InSync message; haveBaseline is set by the first
+	// applied marker after that.
+	inSync       bool
+	haveBaseline bool
+	// endpointsToScan contains the IDs of the endpoints whose flows need to be checked.
+	endpointsToScan set.Set
+	lastScan        time.Time
+
+	// tokens is the number of deletions that the rate limit currently allows.
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newConntrackTeardown(
+	conntrack conntrackDeleter,
+	ipVersions []uint8,
+	wlInterfacePrefixes []string,
+	maxDeletesPerSecond int,
+	minScanInterval time.Duration,
+	now func() time.Time,
+) *conntrackTeardown {
+	return &conntrackTeardown{
+		conntrack:           conntrack,
+		ipVersions:          ipVersions,
+		wlIfacesRegexp:      regexp.MustCompile("^(" + strings.Join(wlInterfacePrefixes, "|") + ").*"),
+		maxDeletesPerSecond: maxDeletesPerSecond,
+		minScanInterval:     minScanInterval,
+		now:                 now,
+		wakeC:               make(chan struct{}, 1),
+		sim:                 policysim.NewSnapshot(),
+		endpoints:           map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint{},
+		policies:            map[proto.PolicyID]*proto.Policy{},
+		profiles:            map[proto.ProfileID]*proto.Profile{},
+		hostIfaceToAddrs:    map[string]set.Set{},
+		dirtyEndpoints:      set.New(),
+		dirtyPolicies:       set.New(),
+		dirtyProfiles:       set.New(),
+		dirtyIPSets:         set.New(),
+		endpointsToScan:     set.New(),
+		tokens:              float64(maxDeletesPerSecond),
+		lastRefill:          now(),
+	}
+}
+
+// OnUpdate queues an update from the calculation graph or the interface monitor.  Called from
+// the dataplane goroutine.
+func (t *conntrackTeardown) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *ifaceAddrsUpdate:
+		if t.wlIfacesRegexp.MatchString(msg.Name) {
+			return
+		}
+		// The managers share the update's set so take our own copy for our goroutine.
+		update := &ifaceAddrsUpdate{Name: msg.Name}
+		if msg.Addrs != nil {
+			update.Addrs = msg.Addrs.Copy()
+		}
+		t.queue(update)
+	case *proto.InSync, *proto.ConfigUpdate,
+		*proto.IPSetUpdate, *proto.IPSetDeltaUpdate, *proto.IPSetRemove,
+		*proto.ActivePolicyUpdate, *proto.ActivePolicyRemove,
+		*proto.ActiveProfileUpdate, *proto.ActiveProfileRemove,
+		*proto.WorkloadEndpointUpdate, *proto.WorkloadEndpointRemove:
+		t.queue(msg)
+	}
+}
+
+// OnDataplaneApplied tells the teardown goroutine that the updates queued so far are now in the
+// dataplane.  Called from the dataplane goroutine after it updates iptables.
+func (t *conntrackTeardown) OnDataplaneApplied() {
+	t.queue(dataplaneAppliedMarker{})
+	select {
+	case t.wakeC <- struct{}{}:
+	default:
+	}
+}
+
+func (t *conntrackTeardown) queue(msg interface{}) {
+	t.lock.Lock()
+	t.pending = append(t.pending, msg)
+	t.lock.Unlock()
+}
+
+func (t *conntrackTeardown) loopDeletingFlows() {
+	log.WithFields(log.Fields{
+		"maxDeletesPerSecond": t.maxDeletesPerSecond,
+		"minScanInterval":     t.minScanInterval,
+	}).Info("Starting conntrack teardown")
+	var retryC <-chan time.Time
+	for {
+		select {
+		case <-t.wakeC:
+		case <-retryC:
+			retryC = nil
+		}
+		t.processAppliedUpdates()
+		if t.endpointsToScan.Len() == 0 {
+			continue
+		}
+		if wait := t.minScanInterval - t.now().Sub(t.lastScan); wait > 0 {
+			if retryC == nil {
+				retryC = time.After(wait)
+			}
+			continue
+		}
+		t.scan()
+		if t.endpointsToScan.Len() > 0 && retryC == nil {
+			// Rate limited or failed; try again later.
+			retryC = time.After(t.retryDelay())
+		}
+	}
+}
+
+// retryDelay returns the time until the next scan is allowed and there's at least one token.
+func (t *conntrackTeardown) retryDelay() time.Duration {
+	delay := t.minScanInterval
+	if t.tokens < 1 {
+		tokenDelay := time.Duration((1 - t.tokens) / float64(t.maxDeletesPerSecond) * float64(time.Second))
+		if tokenDelay > delay {
+			delay = tokenDelay
+		}
+	}
+	return delay
+}
+
+// processAppliedUpdates applies the queued updates up to the last applied marker.  Updates after
+// the marker stay queued because they aren't in the dataplane yet.
+func (t *conntrackTeardown) processAppliedUpdates() {
+	t.lock.Lock()
+	lastMarker := -1
+	for i, msg := range t.pending {
+		if _, ok := msg.(dataplaneAppliedMarker); ok {
+			lastMarker = i
+		}
+	}
+	msgs := t.pending[:lastMarker+1]
+	t.pending = append([]interface{}(nil), t.pending[lastMarker+1:]...)
+	t.lock.Unlock()
+
+	for _, msg := range msgs {
+		if _, ok := msg.(dataplaneAppliedMarker); ok {
+			t.onApplied()
+			continue
+		}
+		t.onUpdate(msg)
+	}
+}
+
+func (t *conntrackTeardown) onUpdate(msg interface{}) {
+	t.sim.OnUpdate(msg)
+	switch msg := msg.(type) {
+	case *proto.InSync:
+		t.inSync = true
+	case *proto.IPSetUpdate:
+		t.dirtyIPSets.Add(msg.Id)
+	case *proto.IPSetDeltaUpdate:
+		t.dirtyIPSets.Add(msg.Id)
+	case *proto.IPSetRemove:
+		t.dirtyIPSets.Add(msg.Id)
+	case *proto.ActivePolicyUpdate:
+		t.policies[*msg.Id] = msg.Policy
+		t.dirtyPolicies.Add(*msg.Id)
+	case *proto.ActivePolicyRemove:
+		delete(t.policies, *msg.Id)
+		t.dirtyPolicies.Add(*msg.Id)
+	case *proto.ActiveProfileUpdate:
+		t.profiles[*msg.Id] = msg.Profile
+		t.dirtyProfiles.Add(*msg.Id)
+	case *proto.ActiveProfileRemove:
+		delete(t.profiles, *msg.Id)
+		t.dirtyProfiles.Add(*msg.Id)
+	case *proto.WorkloadEndpointUpdate:
+		// A new endpoint has no flows that were allowed by an older policy.  The routing
+		// table cleans up the flows of an IP that's reused.
+		if old := t.endpoints[*msg.Id]; old != nil && endpointPolicyChanged(old, msg.Endpoint) {
+			t.dirtyEndpoints.Add(*msg.Id)
+		}
+		t.endpoints[*msg.Id] = msg.Endpoint
+	case *proto.WorkloadEndpointRemove:
+		delete(t.endpoints, *msg.Id)
+		t.dirtyEndpoints.Discard(*msg.Id)
+	case *ifaceAddrsUpdate:
+		if msg.Addrs != nil {
+			t.hostIfaceToAddrs[msg.Name] = msg.Addrs
+		} else {
+			delete(t.hostIfaceToAddrs, msg.Name)
+		}
+	}
+}
+
+// isHostIP returns true if the IP belongs to one of the host's own interfaces.
+func (t *conntrackTeardown) isHostIP(addr net.IP) bool {
+	for _, addrs := range t.hostIfaceToAddrs {
+		if addrs.Contains(addr.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointPolicyChanged returns true if the update changed the parts of an endpoint that
+// determine which of its traffic is allowed.
+func endpointPolicyChanged(oldEP, newEP *proto.WorkloadEndpoint) bool {
+	return oldEP.State != newEP.State ||
+		!reflect.DeepEqual(oldEP.Tiers, newEP.Tiers) ||
+		!reflect.DeepEqual(oldEP.ProfileIds, newEP.ProfileIds) ||
+		!reflect.DeepEqual(oldEP.Ipv4Nets, newEP.Ipv4Nets) ||
+		!reflect.DeepEqual(oldEP.Ipv6Nets, newEP.Ipv6Nets)
+}
+
+// onApplied converts the updates that have just been applied into the set of endpoints whose
+// flows need to be checked.
+func (t *conntrackTeardown) onApplied() {
+	defer func() {
+		t.dirtyEndpoints = set.New()
+		t.dirtyPolicies = set.New()
+		t.dirtyProfiles = set.New()
+		t.dirtyIPSets = set.New()
+	}()
+	if !t.haveBaseline {
+		if t.inSync {
+			log.Info("Conntrack teardown has baseline policy, will check flows after future changes")
+			t.haveBaseline = true
+		}
+		return
+	}
+	if t.dirtyEndpoints.Len() == 0 && t.dirtyPolicies.Len() == 0 &&
+		t.dirtyProfiles.Len() == 0 && t.dirtyIPSets.Len() == 0 {
+		return
+	}
+	for id, ep := range t.endpoints {
+		if t.endpointAffected(id, ep) {
+			log.WithField("endpoint", id).Debug("Policy change may affect endpoint's flows")
+			t.endpointsToScan.Add(id)
+		}
+	}
+}
+
+func (t *conntrackTeardown) endpointAffected(id proto.WorkloadEndpointID, ep *proto.WorkloadEndpoint) bool {
+	if t.dirtyEndpoints.Contains(id) {
+		return true
+	}
+	for _, tier := range ep.Tiers {
+		for _, names := range [][]string{tier.IngressPolicies, tier.EgressPolicies} {
+			for _, name := range names {
+				polID := proto.PolicyID{Tier: tier.Name, Name: name}
+				if t.dirtyPolicies.Contains(polID) {
+					return true
+				}
+				if pol := t.policies[polID]; pol != nil &&
+					(t.rulesUseDirtyIPSet(pol.InboundRules) || t.rulesUseDirtyIPSet(pol.OutboundRules)) {
+					return true
+				}
+			}
+		}
+	}
+	for _, name := range ep.ProfileIds {
+		profID := proto.ProfileID{Name: name}
+		if t.dirtyProfiles.Contains(profID) {
+			return true
+		}
+		if prof := t.profiles[profID]; prof != nil &&
+			(t.rulesUseDirtyIPSet(prof.InboundRules) || t.rulesUseDirtyIPSet(prof.OutboundRules)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *conntrackTeardown) rulesUseDirtyIPSet(rules []*proto.Rule) bool {
+	if t.dirtyIPSets.Len() == 0 {
+		return false
+	}
+	for _, rule := range rules {
+		for _, ids := range [][]string{
+			rule.SrcIpSetIds, rule.DstIpSetIds, rule.NotSrcIpSetIds, rule.NotDstIpSetIds,
+			rule.SrcNamedPortIpSetIds, rule.DstNamedPortIpSetIds,
+			rule.NotSrcNamedPortIpSetIds, rule.NotDstNamedPortIpSetIds,
+		} {
+			for _, id := range ids {
+				if t.dirtyIPSets.Contains(id) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// scan checks the flows of the endpoints in endpointsToScan and deletes the denied ones.  If the
+// rate limit stops us from deleting all of them, or the scan fails, the endpoints are left in
+// endpointsToScan for the next scan.
+func (t *conntrackTeardown) scan() {
+	t.lastScan = t.now()
+	t.refillTokens()
+
+	// Index the IPs of the endpoints to scan, by IP version.
+	ipsByVersion := map[uint8]set.Set{4: set.New(), 6: set.New()}
+	t.endpointsToScan.Iter(func(item interface{}) error {
+		id := item.(proto.WorkloadEndpointID)
+		ep := t.endpoints[id]
+		if ep == nil {
+			// Endpoint has gone since we queued it.
+			return set.RemoveItem
+		}
+		for _, cidrs := range [][]string{ep.Ipv4Nets, ep.Ipv6Nets} {
+			for _, cidr := range cidrs {
+				addr, _, err := net.ParseCIDR(cidr)
+				if err != nil {
+					log.WithError(err).WithField("cidr", cidr).Warn("Ignoring bad endpoint CIDR")
+					continue
+				}
+				version := uint8(6)
+				if addr.To4() != nil {
+					version = 4
+				}
+				ipsByVersion[version].Add(addr.String())
+			}
+		}
+		return nil
+	})
+
+	rescanNeeded := false
+	for _, version := range t.ipVersions {
+		affectedIPs := ipsByVersion[version]
+		if affectedIPs.Len() == 0 {
+			continue
+		}
+		countTeardownScans.Inc()
+		logCxt := log.WithFields(log.Fields{"ipVersion": version, "numIPs": affectedIPs.Len()})
+		logCxt.Debug("Scanning conntrack for flows that are no longer allowed")
+		numDenied := 0
+		budget := int(t.tokens)
+		numDeleted, err := t.conntrack.DeleteFlowsFunc(version, func(flow *conntrack.Flow) bool {
+			// The original source is the endpoint for its outbound flows.  For its inbound
+			// flows, it's the reply source, which also sees through any DNAT of the original
+			// destination.
+			if !affectedIPs.Contains(flow.Orig.Src.String()) && !affectedIPs.Contains(flow.Reply.Src.String()) {
+				return false
+			}
+			if !protocolHasPorts(flow.Orig.Proto) {
+				return false
+			}
+			if t.isHostIP(flow.Orig.Src) {
+				// Sent from the host, which the OUTPUT chain doesn't police.
+				return false
+			}
+			countTeardownFlowsChecked.Inc()
+			// The policy chains see the source before any SNAT and the destination after
+			// any DNAT.
+			result, err := t.sim.Simulate(&policysim.Packet{
+				SrcIP:    flow.Orig.Src,
+				DstIP:    flow.Reply.Src,
+				Protocol: int(flow.Orig.Proto),
+				SrcPort:  flow.Orig.SrcPort,
+				DstPort:  flow.Reply.SrcPort,
+			})
+			if err != nil {
+				log.WithError(err).WithField("flow", flow.Orig).Debug("Failed to evaluate flow")
+				return false
+			}
+			if result.Verdict != policysim.VerdictDeny {
+				return false
+			}
+			numDenied++
+			if numDenied > budget {
+				countTeardownFlowsDeferred.Inc()
+				return false
+			}
+			log.WithFields(log.Fields{
+				"flow":  flow.Orig,
+				"steps": result.Steps,
+			}).Info("Deleting conntrack flow that policy no longer allows")
+			return true
+		})
+		t.tokens -= float64(numDeleted)
+		countTeardownFlowsDeleted.Add(float64(numDeleted))
+		if err != nil {
+			logCxt.WithError(err).Warn("Failed to delete conntrack flows, will retry")
+			countTeardownErrors.Inc()
+			rescanNeeded = true
+			continue
+		}
+		if numDenied > budget {
+			logCxt.WithField("numDeferred", numDenied-budget).Info(
+				"Deletion rate limit reached, will delete remaining flows later")
+			rescanNeeded = true
+		}
+	}
+	if !rescanNeeded {
+		t.endpointsToScan = set.New()
+	}
+}
+
+func (t *conntrackTeardown) refillTokens() {
+	now := t.now()
+	t.tokens += now.Sub(t.lastRefill).Seconds() * float64(t.maxDeletesPerSecond)
+	if t.tokens > float64(t.maxDeletesPerSecond) {
+		t.tokens = float64(t.maxDeletesPerSecond)
+	}
+	t.lastRefill = now
+}
+
+func protocolHasPorts(protocol uint8) bool {
+	switch int(protocol) {
+	case policysim.ProtocolTCP, policysim.ProtocolUDP, policysim.ProtocolSCTP, policysim.ProtocolUDPLite:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/conntrack"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+var _ = Describe("Conntrack teardown", func() {
+	var (
+		teardown *conntrackTeardown
+		ct       *mockConntrack
+		now      time.Time
+	)
+
+	epID := proto.WorkloadEndpointID{OrchestratorId: "k8s", WorkloadId: "ns1/pod1", EndpointId: "eth0"}
+	polID := proto.PolicyID{Tier: "default", Name: "pol1"}
+	otherPolID := proto.PolicyID{Tier: "default", Name: "pol2"}
+
+	endpoint := &proto.WorkloadEndpoint{
+		State:    "active",
+		Ipv4Nets: []string{"10.65.0.2/32"},
+		Tiers:    []*proto.TierInfo{{Name: "default", IngressPolicies: []string{"pol1"}}},
+	}
+	allowPort := func(port int32) *proto.ActivePolicyUpdate {
+		return &proto.ActivePolicyUpdate{
+			Id: &polID,
+			Policy: &proto.Policy{InboundRules: []*proto.Rule{{
+				Action:   "allow",
+				Protocol: &proto.Protocol{NumberOrName: &proto.Protocol_Name{Name: "tcp"}},
+				DstPorts: []*proto.PortRange{{First: port, Last: port}},
+			}}},
+		}
+	}
+	allowFromIPSet := &proto.ActivePolicyUpdate{
+		Id: &polID,
+		Policy: &proto.Policy{InboundRules: []*proto.Rule{{
+			Action:      "allow",
+			SrcIpSetIds: []string{"s1"},
+		}}},
+	}
+	inboundFlow := newMockFlow(6, "10.65.1.9", 1234, "10.65.0.2", 80)
+	// A flow to a service IP that was DNATted to the endpoint.
+	serviceFlow := newMockFlow(6, "10.65.1.10", 2345, "10.96.0.1", 8080)
+	serviceFlow.Reply.Src = net.ParseIP("10.65.0.2")
+	serviceFlow.Reply.SrcPort = 80
+	icmpFlow := newMockFlow(1, "10.65.1.9", 0, "10.65.0.2", 0)
+	otherFlow := newMockFlow(6, "10.65.1.9", 1234, "10.65.0.3", 80)
+
+	// applyAndScan simulates the dataplane goroutine sending some updates and applying them,
+	// followed by the teardown goroutine waking up.
+	applyAndScan := func(msgs ...interface{}) {
+		for _, msg := range msgs {
+			teardown.OnUpdate(msg)
+		}
+		teardown.OnDataplaneApplied()
+		teardown.processAppliedUpdates()
+		if teardown.endpointsToScan.Len() > 0 {
+			teardown.scan()
+		}
+	}
+
+	BeforeEach(func() {
+		ct = &mockConntrack{flows: []*conntrack.Flow{inboundFlow, serviceFlow, icmpFlow, otherFlow}}
+		now = time.Now()
+		teardown = newConntrackTeardown(ct, []uint8{4}, []string{"cali"}, 10, time.Second, func() time.Time { return now })
+		applyAndScan(
+			allowPort(80),
+			&proto.WorkloadEndpointUpdate{Id: &epID, Endpoint: endpoint},
+			&proto.InSync{},
+		)
+	})
+
+	It("should treat the initial state as a baseline", func() {
+		Expect(ct.numScans).To(Equal(0))
+		Expect(ct.flows).To(HaveLen(4))
+	})
+
+	It("should delete the flows that a narrowed policy denies", func() {
+		applyAndScan(allowPort(443))
+		Expect(ct.numScans).To(Equal(1))
+		Expect(ct.flows).To(ConsistOf(icmpFlow, otherFlow))
+		Expect(teardown.endpointsToScan.Len()).To(BeZero())
+	})
+
+	It("should not delete anything if the change only allows more traffic", func() {
+		applyAndScan(&proto.ActivePolicyUpdate{
+			Id:     &polID,
+			Policy: &proto.Policy{InboundRules: []*proto.Rule{{Action: "allow"}}},
+		})
+		Expect(ct.numScans).To(Equal(1))
+		Expect(ct.flows).To(HaveLen(4))
+	})
+
+	It("should ignore changes to policies that the endpoint doesn't use", func() {
+		applyAndScan(&proto.ActivePolicyUpdate{Id: &otherPolID, Policy: &proto.Policy{}})
+		Expect(ct.numScans).To(Equal(0))
+	})
+
+	It("should wait for updates to be applied", func() {
+		teardown.OnUpdate(allowPort(443))
+		teardown.processAppliedUpdates()
+		Expect(teardown.endpointsToScan.Len()).To(BeZero())
+
+		teardown.OnDataplaneApplied()
+		teardown.processAppliedUpdates()
+		Expect(teardown.endpointsToScan.Len()).To(Equal(1))
+	})
+
+	Describe("with flows from the host", func() {
+		hostFlow := newMockFlow(6, "192.168.0.1", 3456, "10.65.0.2", 80)
+
+		BeforeEach(func() {
+			ct.flows = append(ct.flows, hostFlow)
+			teardown.OnUpdate(&ifaceAddrsUpdate{Name: "eth0", Addrs: set.From("192.168.0.1")})
+			// Workload interfaces aren't host interfaces.
+			teardown.OnUpdate(&ifaceAddrsUpdate{Name: "cali1234", Addrs: set.From("10.65.1.9")})
+		})
+
+		It("should not delete them, since host to workload traffic isn't policed", func() {
+			applyAndScan(allowPort(443))
+			Expect(ct.flows).To(ConsistOf(icmpFlow, otherFlow, hostFlow))
+		})
+
+		It("should delete them once the IP is no longer the host's", func() {
+			teardown.OnUpdate(&ifaceAddrsUpdate{Name: "eth0", Addrs: nil})
+			applyAndScan(allowPort(443))
+			Expect(ct.flows).To(ConsistOf(icmpFlow, otherFlow))
+		})
+	})
+
+	It("should check flows when the endpoint's policies change", func() {
+		applyAndScan(&proto.WorkloadEndpointUpdate{Id: &epID, Endpoint: &proto.WorkloadEndpoint{
+			State:    "active",
+			Ipv4Nets: []string{"10.65.0.2/32"},
+			Tiers:    []*proto.TierInfo{{Name: "default", IngressPolicies: []string{"pol2"}}},
+		}})
+		Expect(ct.flows).To(ConsistOf(icmpFlow, otherFlow))
+	})
+
+	Describe("with a policy that uses an IP set", func() {
+		BeforeEach(func() {
+			applyAndScan(
+				&proto.IPSetUpdate{Id: "s1", Members: []string{"10.65.1.9", "10.65.1.10"}},
+				allowFromIPSet,
+			)
+			Expect(ct.flows).To(HaveLen(4))
+		})
+
+		It("should delete the flows of an IP that's removed from the IP set", func() {
+			applyAndScan(&proto.IPSetDeltaUpdate{Id: "s1", RemovedMembers: []string{"10.65.1.9"}})
+			Expect(ct.flows).To(ConsistOf(serviceFlow, icmpFlow, otherFlow))
+		})
+
+		It("should ignore changes to other IP sets", func() {
+			applyAndScan(&proto.IPSetUpdate{Id: "s2", Members: []string{"10.0.0.1"}})
+			Expect(ct.numScans).To(Equal(1))
+		})
+	})
+
+	Describe("with a rate limit of one deletion per second", func() {
+		BeforeEach(func() {
+			teardown.maxDeletesPerSecond = 1
+			teardown.tokens = 1
+		})
+
+		It("should defer the deletions over the limit", func() {
+			applyAndScan(allowPort(443))
+			Expect(ct.flows).To(HaveLen(3))
+			Expect(teardown.endpointsToScan.Len()).To(Equal(1))
+
+			// No tokens left until time moves on.
+			teardown.scan()
+			Expect(ct.flows).To(HaveLen(3))
+			Expect(teardown.retryDelay()).To(Equal(time.Second))
+
+			now = now.Add(time.Second)
+			teardown.scan()
+			Expect(ct.flows).To(ConsistOf(icmpFlow, otherFlow))
+			Expect(teardown.endpointsToScan.Len()).To(BeZero())
+		})
+	})
+
+	It("should retry after a conntrack failure", func() {
+		ct.err = errors.New("netlink failure")
+		applyAndScan(allowPort(443))
+		Expect(teardown.endpointsToScan.Len()).To(Equal(1))
+
+		ct.err = nil
+		teardown.scan()
+		Expect(ct.flows).To(ConsistOf(icmpFlow, otherFlow))
+		Expect(teardown.endpointsToScan.Len()).To(BeZero())
+	})
+
+	It("should forget endpoints that are removed", func() {
+		teardown.OnUpdate(allowPort(443))
+		teardown.OnDataplaneApplied()
+		teardown.processAppliedUpdates()
+		applyAndScan(&proto.WorkloadEndpointRemove{Id: &epID})
+		Expect(ct.numScans).To(Equal(0))
+		Expect(teardown.endpointsToScan.Len()).To(BeZero())
+	})
+})
+
+func newMockFlow(protocol uint8, src string, srcPort uint16, dst string, dstPort uint16) *conntrack.Flow {
+	return &conntrack.Flow{
+		Orig: conntrack.Tuple{
+			Src: net.ParseIP(src), Dst: net.ParseIP(dst), Proto: protocol,
+			SrcPort: srcPort, DstPort: dstPort,
+		},
+		Reply: conntrack.Tuple{
+			Src: net.ParseIP(dst), Dst: net.ParseIP(src), Proto: protocol,
+			SrcPort: dstPort, DstPort: srcPort,
+		},
+	}
+}
+
+type mockConntrack struct {
+	flows    []*conntrack.Flow
+	numScans int
+	err      error
+}
+
+func (c *mockConntrack) DeleteFlowsFunc(ipVersion uint8, match func(flow *conntrack.Flow) bool) (int, error) {
+	Expect(ipVersion).To(Equal(uint8(4)))
+	c.numScans++
+	if c.err != nil {
+		return 0, c.err
+	}
+	var remaining []*conntrack.Flow
+	for _, flow := range c.flows {
+		if !match(flow) {
+			remaining = append(remaining, flow)
+		}
+	}
+	numDeleted := len(c.flows) - len(remaining)
+	c.flows = remaining
+	return numDeleted, nil
+}
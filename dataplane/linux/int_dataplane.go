@@ -26,10 +26,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/conntrack"
+	"github.com/projectcalico/felix/dataplane/snapshot"
 	"github.com/projectcalico/felix/ifacemonitor"
 	"github.com/projectcalico/felix/ipsets"
 	"github.com/projectcalico/felix/iptables"
 	"github.com/projectcalico/felix/jitter"
+	"github.com/projectcalico/felix/nftables"
 	"github.com/projectcalico/felix/proto"
 	"github.com/projectcalico/felix/routetable"
 	"github.com/projectcalico/felix/rules"
@@ -46,6 +50,14 @@ const (
 
 	// Interface name used by kube-proxy to bind service ips.
 	KubeIPVSInterface = "kube-ipvs0"
+
+	// Values for Config.DataplaneBackend.
+	BackendIptables = "iptables"
+	BackendNftables = "nftables"
+
+	// Values for Config.IPSetsBackend.
+	IPSetsBackendRestore = "ipset-restore"
+	IPSetsBackendNetlink = "netlink"
 )
 
 var (
@@ -94,8 +106,15 @@ type Config struct {
 	IPv6Enabled          bool
 	RuleRendererOverride rules.RuleRenderer
 	IPIPMTU              int
+	IPIPMTUV6            int
+	VXLANMTU             int
+	VXLANVNI             int
 	IgnoreLooseRPF       bool
 
+	// RemoteRoutesEnabled enables the programming of routes to remote hosts' IPAM blocks,
+	// which lets Felix route between hosts without BIRD.
+	RemoteRoutesEnabled bool
+
 	MaxIPSetSize int
 
 	IPSetsRefreshInterval          time.Duration
@@ -107,14 +126,50 @@ type Config struct {
 	IptablesLockTimeout            time.Duration
 	IptablesLockProbeInterval      time.Duration
 
+	// DataplaneBackend selects the packet filtering backend: BackendIptables (the default)
+	// or BackendNftables.
+	DataplaneBackend string
+	// IPSetsBackend selects how we program IP sets when using the iptables backend: by
+	// running "ipset restore" (IPSetsBackendRestore, the default) or via the kernel's
+	// netlink API (IPSetsBackendNetlink).
+	IPSetsBackend string
+
 	NetlinkTimeout time.Duration
 
+	// WarmStartSnapshotFile, if set, is where we save the state that we've applied so that we
+	// can reprogram it straight away after a restart.  We only use a snapshot that was saved
+	// with the config that has hash WarmStartConfigHash, within WarmStartMaxAge.
+	WarmStartSnapshotFile string
+	WarmStartMaxAge       time.Duration
+	WarmStartSaveInterval time.Duration
+	WarmStartConfigHash   string
+
+	// Hostname is our hostname, used to pick out this host's metadata from that of the
+	// remote hosts.
+	Hostname string
+
 	RulesConfig rules.Config
 
 	IfaceMonitorConfig ifacemonitor.Config
 
 	StatusReportingInterval time.Duration
 
+	// RuleCountersEnabled enables the export of per-rule policy counters as Prometheus
+	// metrics.  Only supported by the iptables backend.
+	RuleCountersEnabled      bool
+	RuleCountersPollInterval time.Duration
+	// RuleCountersPolicies limits the policies and profiles whose counters we export; empty
+	// means all.
+	RuleCountersPolicies []string
+	RuleCountersMaxRules int
+
+	// ConntrackTeardownEnabled enables the deletion of conntrack flows that a policy change has
+	// made disallowed, at most ConntrackTeardownMaxDeletesPerSecond per second and with scans
+	// at least ConntrackTeardownMinScanInterval apart.
+	ConntrackTeardownEnabled             bool
+	ConntrackTeardownMaxDeletesPerSecond int
+	ConntrackTeardownMinScanInterval     time.Duration
+
 	ConfigChangedRestartCallback func()
 
 	PostInSyncCallback func()
@@ -155,14 +210,21 @@ type InternalDataplane struct {
 	toDataplane   chan interface{}
 	fromDataplane chan interface{}
 
-	allIptablesTables    []*iptables.Table
-	iptablesMangleTables []*iptables.Table
-	iptablesNATTables    []*iptables.Table
-	iptablesRawTables    []*iptables.Table
-	iptablesFilterTables []*iptables.Table
-	ipSets               []*ipsets.IPSets
+	allIptablesTables    []dataplaneTable
+	iptablesMangleTables []dataplaneTable
+	iptablesNATTables    []dataplaneTable
+	iptablesRawTables    []dataplaneTable
+	iptablesFilterTables []dataplaneTable
+	ipSets               []ipSetsWriter
+
+	ipipManager   *ipipManager
+	ipipManagerV6 *ipipManager
+	vxlanManager  *vxlanManager
 
-	ipipManager *ipipManager
+	// ruleCounters exports the counters of the policy rules; nil if disabled.
+	ruleCounters *ruleCounterCollector
+	// conntrackTeardown deletes the flows that policy no longer allows; nil if disabled.
+	conntrackTeardown *conntrackTeardown
 
 	ifaceMonitor     *ifacemonitor.InterfaceMonitor
 	ifaceUpdates     chan *ifaceUpdate
@@ -191,9 +253,22 @@ type InternalDataplane struct {
 	// that the dataplane should now be in sync.
 	doneFirstApply bool
 
+	// snapshotTracker follows the state that we've been asked to program so that we can save
+	// it for a warm start; nil if warm start is disabled.
+	snapshotTracker  *snapshot.Tracker
+	lastSnapshotSave time.Time
+	// warmStartReconciler is set from the time that we warm start from a snapshot until the
+	// datastore is in sync.  It tracks which parts of the snapshot Felix has sent again.
+	warmStartReconciler *snapshot.Reconciler
+
 	reschedTimer *time.Timer
 	reschedC     <-chan time.Time
 
+	// ipSetsRefreshTicker and routeRefreshTicker drive the periodic refreshes of the IP sets
+	// and routes.  They're nil if the refresh is disabled.
+	ipSetsRefreshTicker *jitter.Ticker
+	routeRefreshTicker  *jitter.Ticker
+
 	applyThrottle *throttle.Throttle
 
 	config Config
@@ -229,6 +304,37 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 	}
 	dp.applyThrottle.Refill() // Allow the first apply() immediately.
 
+	if config.WarmStartSnapshotFile != "" {
+		dp.snapshotTracker = snapshot.NewTracker(config.WarmStartConfigHash)
+	}
+
+	if config.RuleCountersEnabled {
+		if config.DataplaneBackend == BackendNftables {
+			log.Warn("Rule counters are not supported by the nftables backend, disabling them.")
+		} else {
+			dp.ruleCounters = newRuleCounterCollector(
+				config.RuleCountersPollInterval,
+				config.RuleCountersPolicies,
+				config.RuleCountersMaxRules,
+			)
+		}
+	}
+
+	if config.ConntrackTeardownEnabled {
+		ipVersions := []uint8{4}
+		if config.IPv6Enabled {
+			ipVersions = append(ipVersions, 6)
+		}
+		dp.conntrackTeardown = newConntrackTeardown(
+			conntrack.New(),
+			ipVersions,
+			config.RulesConfig.WorkloadIfacePrefixes,
+			config.ConntrackTeardownMaxDeletesPerSecond,
+			config.ConntrackTeardownMinScanInterval,
+			time.Now,
+		)
+	}
+
 	dp.ifaceMonitor.Callback = dp.onIfaceStateChange
 	dp.ifaceMonitor.AddrCallback = dp.onIfaceAddrsChange
 
@@ -261,40 +367,46 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		)
 	}
 
-	mangleTableV4 := iptables.NewTable(
-		"mangle",
-		4,
-		rules.RuleHashPrefix,
-		iptablesLock,
-		iptablesOptions)
-	natTableV4 := iptables.NewTable(
-		"nat",
-		4,
-		rules.RuleHashPrefix,
-		iptablesLock,
-		iptablesNATOptions,
-	)
-	rawTableV4 := iptables.NewTable(
-		"raw",
-		4,
-		rules.RuleHashPrefix,
-		iptablesLock,
-		iptablesOptions)
-	filterTableV4 := iptables.NewTable(
-		"filter",
-		4,
-		rules.RuleHashPrefix,
-		iptablesLock,
-		iptablesOptions)
-	ipSetsConfigV4 := config.RulesConfig.IPSetConfigV4
-	ipSetsV4 := ipsets.NewIPSets(ipSetsConfigV4)
+	// newTable creates a table using the configured backend.  The nftables backend renders
+	// IP sets into the tables that reference them so it needs the IP sets for the table's IP
+	// version.
+	newTable := func(
+		name string,
+		ipVersion uint8,
+		nftIPSets *nftables.IPSets,
+		options iptables.TableOptions,
+	) dataplaneTable {
+		if config.DataplaneBackend == BackendNftables {
+			return nftables.NewTable(
+				name,
+				ipVersion,
+				rules.RuleHashPrefix,
+				nftIPSets,
+				nftables.TableOptions{
+					InsertMode:      options.InsertMode,
+					RefreshInterval: options.RefreshInterval,
+				})
+		}
+		return iptables.NewTable(
+			name,
+			ipVersion,
+			rules.RuleHashPrefix,
+			iptablesLock,
+			options)
+	}
+
+	ipSetsV4, nftIPSetsV4 := newIPSets(config, config.RulesConfig.IPSetConfigV4)
+	mangleTableV4 := newTable("mangle", 4, nftIPSetsV4, iptablesOptions)
+	natTableV4 := newTable("nat", 4, nftIPSetsV4, iptablesNATOptions)
+	rawTableV4 := newTable("raw", 4, nftIPSetsV4, iptablesOptions)
+	filterTableV4 := newTable("filter", 4, nftIPSetsV4, iptablesOptions)
 	dp.iptablesNATTables = append(dp.iptablesNATTables, natTableV4)
 	dp.iptablesRawTables = append(dp.iptablesRawTables, rawTableV4)
 	dp.iptablesMangleTables = append(dp.iptablesMangleTables, mangleTableV4)
 	dp.iptablesFilterTables = append(dp.iptablesFilterTables, filterTableV4)
 	dp.ipSets = append(dp.ipSets, ipSetsV4)
 
-	routeTableV4 := routetable.New(config.RulesConfig.WorkloadIfacePrefixes, 4, config.NetlinkTimeout)
+	routeTableV4 := routetable.New(config.RulesConfig.WorkloadIfacePrefixes, 4, config.NetlinkTimeout, true)
 	dp.routeTables = append(dp.routeTables, routeTableV4)
 
 	dp.endpointStatusCombiner = newEndpointStatusCombiner(dp.fromDataplane, config.IPv6Enabled)
@@ -305,7 +417,7 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		rules.IPSetIDThisHostIPs,
 		ipSetsV4,
 		config.MaxIPSetSize))
-	dp.RegisterManager(newPolicyManager(rawTableV4, mangleTableV4, filterTableV4, ruleRenderer, 4))
+	dp.RegisterManager(newPolicyManager(rawTableV4, mangleTableV4, filterTableV4, ruleRenderer, 4, dp.ruleCounters))
 	dp.RegisterManager(newEndpointManager(
 		rawTableV4,
 		mangleTableV4,
@@ -319,50 +431,43 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		dp.endpointStatusCombiner.OnEndpointStatusUpdate))
 	dp.RegisterManager(newFloatingIPManager(natTableV4, ruleRenderer, 4))
 	dp.RegisterManager(newMasqManager(ipSetsV4, natTableV4, ruleRenderer, config.MaxIPSetSize, 4))
-	if config.RulesConfig.IPIPEnabled {
-		// Add a manger to keep the all-hosts IP set up to date.
-		dp.ipipManager = newIPIPManager(ipSetsV4, config.MaxIPSetSize)
-		dp.RegisterManager(dp.ipipManager) // IPv4-only
+	if config.RulesConfig.IPIPEnabled || config.RulesConfig.VXLANEnabled {
+		// Add a manger to keep the all-hosts IP set up to date.  The VXLAN rules use the
+		// IP set too.
+		dp.ipipManager = newIPIPManager(ipSetsV4, config.MaxIPSetSize, 4)
+		dp.RegisterManager(dp.ipipManager)
 	}
-	if config.IPv6Enabled {
-		mangleTableV6 := iptables.NewTable(
-			"mangle",
-			6,
-			rules.RuleHashPrefix,
-			iptablesLock,
-			iptablesOptions,
-		)
-		natTableV6 := iptables.NewTable(
-			"nat",
-			6,
-			rules.RuleHashPrefix,
-			iptablesLock,
-			iptablesNATOptions,
-		)
-		rawTableV6 := iptables.NewTable(
-			"raw",
-			6,
-			rules.RuleHashPrefix,
-			iptablesLock,
-			iptablesOptions,
-		)
-		filterTableV6 := iptables.NewTable(
-			"filter",
-			6,
-			rules.RuleHashPrefix,
-			iptablesLock,
-			iptablesOptions,
+	if config.RulesConfig.VXLANEnabled {
+		// The VXLAN routes get their own route table so that they don't interfere with the
+		// workload routes.
+		vxlanRouteTable := routetable.New([]string{rules.VXLANIfaceName}, 4, config.NetlinkTimeout, true)
+		dp.routeTables = append(dp.routeTables, vxlanRouteTable)
+		dp.vxlanManager = newVXLANManager(
+			config.Hostname,
+			config.VXLANVNI,
+			config.RulesConfig.VXLANPort,
+			config.VXLANMTU,
+			config.RulesConfig.VXLANTunnelAddress,
 		)
+		dp.RegisterManager(dp.vxlanManager)
+		dp.RegisterManager(newRemoteRoutesManager(config.Hostname, 4, rules.VXLANIfaceName, vxlanRouteTable))
+	} else if config.RemoteRoutesEnabled {
+		dp.addRemoteRoutesManager(config, 4, config.RulesConfig.IPIPEnabled)
+	}
+	if config.IPv6Enabled {
+		ipSetsV6, nftIPSetsV6 := newIPSets(config, config.RulesConfig.IPSetConfigV6)
+		mangleTableV6 := newTable("mangle", 6, nftIPSetsV6, iptablesOptions)
+		natTableV6 := newTable("nat", 6, nftIPSetsV6, iptablesNATOptions)
+		rawTableV6 := newTable("raw", 6, nftIPSetsV6, iptablesOptions)
+		filterTableV6 := newTable("filter", 6, nftIPSetsV6, iptablesOptions)
 
-		ipSetsConfigV6 := config.RulesConfig.IPSetConfigV6
-		ipSetsV6 := ipsets.NewIPSets(ipSetsConfigV6)
 		dp.ipSets = append(dp.ipSets, ipSetsV6)
 		dp.iptablesNATTables = append(dp.iptablesNATTables, natTableV6)
 		dp.iptablesRawTables = append(dp.iptablesRawTables, rawTableV6)
 		dp.iptablesMangleTables = append(dp.iptablesMangleTables, mangleTableV6)
 		dp.iptablesFilterTables = append(dp.iptablesFilterTables, filterTableV6)
 
-		routeTableV6 := routetable.New(config.RulesConfig.WorkloadIfacePrefixes, 6, config.NetlinkTimeout)
+		routeTableV6 := routetable.New(config.RulesConfig.WorkloadIfacePrefixes, 6, config.NetlinkTimeout, true)
 		dp.routeTables = append(dp.routeTables, routeTableV6)
 
 		dp.RegisterManager(newIPSetsManager(ipSetsV6, config.MaxIPSetSize))
@@ -371,7 +476,7 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 			rules.IPSetIDThisHostIPs,
 			ipSetsV6,
 			config.MaxIPSetSize))
-		dp.RegisterManager(newPolicyManager(rawTableV6, mangleTableV6, filterTableV6, ruleRenderer, 6))
+		dp.RegisterManager(newPolicyManager(rawTableV6, mangleTableV6, filterTableV6, ruleRenderer, 6, dp.ruleCounters))
 		dp.RegisterManager(newEndpointManager(
 			rawTableV6,
 			mangleTableV6,
@@ -385,6 +490,14 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 			dp.endpointStatusCombiner.OnEndpointStatusUpdate))
 		dp.RegisterManager(newFloatingIPManager(natTableV6, ruleRenderer, 6))
 		dp.RegisterManager(newMasqManager(ipSetsV6, natTableV6, ruleRenderer, config.MaxIPSetSize, 6))
+		if config.RulesConfig.IPIPEnabledV6 {
+			// Add a manager to keep the IPv6 all-hosts IP set up to date.
+			dp.ipipManagerV6 = newIPIPManager(ipSetsV6, config.MaxIPSetSize, 6)
+			dp.RegisterManager(dp.ipipManagerV6)
+		}
+		if config.RemoteRoutesEnabled {
+			dp.addRemoteRoutesManager(config, 6, config.RulesConfig.IPIPEnabledV6)
+		}
 	}
 
 	for _, t := range dp.iptablesMangleTables {
@@ -400,6 +513,21 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		dp.allIptablesTables = append(dp.allIptablesTables, t)
 	}
 
+	if dp.ruleCounters != nil {
+		// Policy chains are rendered into the raw, mangle and filter tables.
+		for _, tables := range [][]dataplaneTable{
+			dp.iptablesRawTables,
+			dp.iptablesMangleTables,
+			dp.iptablesFilterTables,
+		} {
+			for _, t := range tables {
+				if t, ok := t.(*iptables.Table); ok {
+					dp.ruleCounters.addReader(t.IPVersion, t)
+				}
+			}
+		}
+	}
+
 	// Register that we will report liveness and readiness.
 	if config.HealthAggregator != nil {
 		log.Info("Registering to report health.")
@@ -434,6 +562,20 @@ func (d *InternalDataplane) RegisterManager(mgr Manager) {
 	d.allManagers = append(d.allManagers, mgr)
 }
 
+// addRemoteRoutesManager adds a route table and manager for the routes to remote hosts' IPAM
+// blocks.  The routes go through the IPIP tunnel if it's enabled; otherwise, they go directly
+// via the remote host.  Since BIRD may program routes through the same device, the route table
+// only removes the routes that it programmed.
+func (d *InternalDataplane) addRemoteRoutesManager(config Config, ipVersion uint8, viaTunnel bool) {
+	ifaceName := routetable.InterfaceNone
+	if viaTunnel {
+		ifaceName = rules.IPIPIfaceName(ipVersion)
+	}
+	routeTable := routetable.New([]string{ifaceName}, ipVersion, config.NetlinkTimeout, false)
+	d.routeTables = append(d.routeTables, routeTable)
+	d.RegisterManager(newRemoteRoutesManager(config.Hostname, ipVersion, ifaceName, routeTable))
+}
+
 func (d *InternalDataplane) Start() {
 	// Do our start-of-day configuration.
 	d.doStaticDataplaneConfig()
@@ -442,6 +584,12 @@ func (d *InternalDataplane) Start() {
 	go d.loopUpdatingDataplane()
 	go d.loopReportingStatus()
 	go d.ifaceMonitor.MonitorInterfaces()
+	if d.ruleCounters != nil {
+		go d.ruleCounters.loopPollingCounters()
+	}
+	if d.conntrackTeardown != nil {
+		go d.conntrackTeardown.loopDeletingFlows()
+	}
 }
 
 // onIfaceStateChange is our interface monitor callback.  It gets called from the monitor's thread.
@@ -515,9 +663,9 @@ func (d *InternalDataplane) doStaticDataplaneConfig() {
 	// Felix being able to configure it.
 	writeProcSys("/proc/sys/net/ipv4/conf/default/rp_filter", "1")
 
+	d.updateStaticChains()
+
 	for _, t := range d.iptablesRawTables {
-		rawChains := d.ruleRenderer.StaticRawTableChains(t.IPVersion)
-		t.UpdateChains(rawChains)
 		t.SetRuleInsertions("PREROUTING", []iptables.Rule{{
 			Action: iptables.JumpAction{Target: rules.ChainRawPrerouting},
 		}})
@@ -527,8 +675,6 @@ func (d *InternalDataplane) doStaticDataplaneConfig() {
 	}
 
 	for _, t := range d.iptablesFilterTables {
-		filterChains := d.ruleRenderer.StaticFilterTableChains(t.IPVersion)
-		t.UpdateChains(filterChains)
 		t.SetRuleInsertions("FORWARD", []iptables.Rule{{
 			Action: iptables.JumpAction{Target: rules.ChainFilterForward},
 		}})
@@ -549,9 +695,15 @@ func (d *InternalDataplane) doStaticDataplaneConfig() {
 	} else {
 		log.Info("IPIP disabled. Not starting tunnel update thread.")
 	}
+	if d.ipipManagerV6 != nil {
+		log.Info("IPv6 IPIP enabled, starting thread to keep tunnel configuration in sync.")
+		go d.ipipManagerV6.KeepIPIPDeviceInSync(
+			d.config.IPIPMTUV6,
+			d.config.RulesConfig.IPIPTunnelAddressV6,
+		)
+	}
 
 	for _, t := range d.iptablesNATTables {
-		t.UpdateChains(d.ruleRenderer.StaticNATTableChains(t.IPVersion))
 		t.SetRuleInsertions("PREROUTING", []iptables.Rule{{
 			Action: iptables.JumpAction{Target: rules.ChainNATPrerouting},
 		}})
@@ -564,13 +716,29 @@ func (d *InternalDataplane) doStaticDataplaneConfig() {
 	}
 
 	for _, t := range d.iptablesMangleTables {
-		t.UpdateChains(d.ruleRenderer.StaticMangleTableChains(t.IPVersion))
 		t.SetRuleInsertions("PREROUTING", []iptables.Rule{{
 			Action: iptables.JumpAction{Target: rules.ChainManglePrerouting},
 		}})
 	}
 }
 
+// updateStaticChains renders our static chains and queues them for programming.  It's called
+// at start of day and after a config change that affects the rule renderer.
+func (d *InternalDataplane) updateStaticChains() {
+	for _, t := range d.iptablesRawTables {
+		t.UpdateChains(d.ruleRenderer.StaticRawTableChains(tableIPVersion(t)))
+	}
+	for _, t := range d.iptablesFilterTables {
+		t.UpdateChains(d.ruleRenderer.StaticFilterTableChains(tableIPVersion(t)))
+	}
+	for _, t := range d.iptablesNATTables {
+		t.UpdateChains(d.ruleRenderer.StaticNATTableChains(tableIPVersion(t)))
+	}
+	for _, t := range d.iptablesMangleTables {
+		t.UpdateChains(d.ruleRenderer.StaticMangleTableChains(tableIPVersion(t)))
+	}
+}
+
 func (d *InternalDataplane) loopUpdatingDataplane() {
 	log.Info("Started internal iptables dataplane driver loop")
 	healthTicks := time.NewTicker(healthInterval).C
@@ -580,26 +748,7 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 	retryTicker := time.NewTicker(10 * time.Second)
 
 	// If configured, start tickers to refresh the IP sets and routing table entries.
-	var ipSetsRefreshC <-chan time.Time
-	if d.config.IPSetsRefreshInterval > 0 {
-		log.WithField("interval", d.config.IptablesRefreshInterval).Info(
-			"Will refresh IP sets on timer")
-		refreshTicker := jitter.NewTicker(
-			d.config.IPSetsRefreshInterval,
-			d.config.IPSetsRefreshInterval/10,
-		)
-		ipSetsRefreshC = refreshTicker.C
-	}
-	var routeRefreshC <-chan time.Time
-	if d.config.RouteRefreshInterval > 0 {
-		log.WithField("interval", d.config.RouteRefreshInterval).Info(
-			"Will refresh routes on timer")
-		refreshTicker := jitter.NewTicker(
-			d.config.RouteRefreshInterval,
-			d.config.RouteRefreshInterval/10,
-		)
-		routeRefreshC = refreshTicker.C
-	}
+	d.restartRefreshTickers()
 
 	// Fill the apply throttle leaky bucket.
 	throttleC := jitter.NewTicker(100*time.Millisecond, 10*time.Millisecond).C
@@ -607,18 +756,28 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 
 	datastoreInSync := false
 
+	if d.snapshotTracker != nil {
+		d.warmStart()
+	}
+
 	processMsgFromCalcGraph := func(msg interface{}) {
 		log.WithField("msg", proto.MsgStringer{Msg: msg}).Infof(
 			"Received %T update from calculation graph", msg)
 		d.recordMsgStat(msg)
-		for _, mgr := range d.allManagers {
-			mgr.OnUpdate(msg)
+		if _, ok := msg.(*proto.InSync); ok && d.warmStartReconciler != nil {
+			d.removeStaleWarmStartState()
 		}
-		switch msg.(type) {
+		d.onDatastoreMessage(msg)
+		switch msg := msg.(type) {
 		case *proto.InSync:
 			log.WithField("timeSinceStart", time.Since(processStartTime)).Info(
 				"Datastore in sync, flushing the dataplane for the first time...")
 			datastoreInSync = true
+		case *proto.ConfigUpdate:
+			d.onConfigUpdate(msg)
+			// Felix is likely to restart to pick up the new config; save a snapshot with
+			// the new config as soon as we can so that the restart can use it.
+			d.lastSnapshotSave = time.Time{}
 		}
 	}
 
@@ -642,6 +801,9 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 		for _, mgr := range d.allManagers {
 			mgr.OnUpdate(ifaceAddrsUpdate)
 		}
+		if d.conntrackTeardown != nil {
+			d.conntrackTeardown.OnUpdate(ifaceAddrsUpdate)
+		}
 	}
 
 	for {
@@ -698,11 +860,11 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 			}
 			summaryAddrBatchSize.Observe(float64(batchSize))
 			d.dataplaneNeedsSync = true
-		case <-ipSetsRefreshC:
+		case <-tickerC(d.ipSetsRefreshTicker):
 			log.Debug("Refreshing IP sets state")
 			d.forceIPSetsRefresh = true
 			d.dataplaneNeedsSync = true
-		case <-routeRefreshC:
+		case <-tickerC(d.routeRefreshTicker):
 			log.Debug("Refreshing routes")
 			d.forceRouteRefresh = true
 			d.dataplaneNeedsSync = true
@@ -764,9 +926,175 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 				}
 			}
 		}
+
+		if datastoreInSync && !d.dataplaneNeedsSync {
+			d.maybeSaveSnapshot()
+		}
+	}
+}
+
+// onDatastoreMessage passes a message from the calculation graph (or from a warm start
+// snapshot) to the managers and records it for the next snapshot.
+func (d *InternalDataplane) onDatastoreMessage(msg interface{}) {
+	for _, mgr := range d.allManagers {
+		mgr.OnUpdate(msg)
+	}
+	if d.snapshotTracker != nil {
+		d.snapshotTracker.OnUpdate(msg)
+	}
+	if d.warmStartReconciler != nil {
+		d.warmStartReconciler.OnUpdate(msg)
+	}
+	if d.conntrackTeardown != nil {
+		d.conntrackTeardown.OnUpdate(msg)
+	}
+}
+
+// warmStart loads the snapshot of the state that we last applied, if there is a usable one, and
+// applies it straight away.  Since the snapshot normally matches the dataplane, the apply keeps
+// the existing state rather than having to wait for the datastore resync.  The apply is retried
+// with everything else once the datastore is in sync.
+func (d *InternalDataplane) warmStart() {
+	logCxt := log.WithField("file", d.config.WarmStartSnapshotFile)
+	snap, err := snapshot.Load(d.config.WarmStartSnapshotFile, d.config.WarmStartConfigHash,
+		d.config.WarmStartMaxAge)
+	if os.IsNotExist(err) {
+		logCxt.Info("No dataplane snapshot, waiting for the datastore to be in sync.")
+		return
+	} else if err != nil {
+		logCxt.WithError(err).Warn(
+			"Not using dataplane snapshot, waiting for the datastore to be in sync.")
+		return
+	}
+
+	msgs := snapshot.Messages(snap)
+	logCxt.WithFields(log.Fields{
+		"numMessages":  len(msgs),
+		"snapshotTime": snap.IsoTimestamp,
+	}).Info("Warm starting the dataplane from snapshot.")
+	for _, msg := range msgs {
+		d.onDatastoreMessage(msg)
+	}
+	d.warmStartReconciler = snapshot.NewReconciler(snap)
+
+	applyStart := time.Now()
+	d.apply()
+	logCxt.WithFields(log.Fields{
+		"msecToApply": time.Since(applyStart).Seconds() * 1000.0,
+		"success":     !d.dataplaneNeedsSync,
+	}).Info("Applied dataplane snapshot.")
+}
+
+// removeStaleWarmStartState is called when the datastore comes in sync after a warm start.  It
+// removes the parts of the snapshot that the datastore no longer has.
+func (d *InternalDataplane) removeStaleWarmStartState() {
+	removes := d.warmStartReconciler.StaleRemoves()
+	log.WithField("numRemoves", len(removes)).Info(
+		"Removing state from the dataplane snapshot that the datastore no longer has.")
+	for _, msg := range removes {
+		d.onDatastoreMessage(msg)
+	}
+	d.warmStartReconciler = nil
+}
+
+// maybeSaveSnapshot saves the state that we've applied if it has changed, at most once per
+// WarmStartSaveInterval.
+func (d *InternalDataplane) maybeSaveSnapshot() {
+	if d.snapshotTracker == nil || !d.snapshotTracker.Dirty() {
+		return
+	}
+	if time.Since(d.lastSnapshotSave) < d.config.WarmStartSaveInterval {
+		return
+	}
+	d.lastSnapshotSave = time.Now()
+	if err := d.snapshotTracker.Save(d.config.WarmStartSnapshotFile); err != nil {
+		log.WithError(err).Warn("Failed to save dataplane snapshot.")
+		return
+	}
+	log.Debug("Saved dataplane snapshot.")
+}
+
+// onConfigUpdate applies the live-reloadable config parameters that affect the dataplane.
+// The main Felix process restarts if any other parameter changes so we only need to look at
+// the live-reloadable ones here.
+func (d *InternalDataplane) onConfigUpdate(msg *proto.ConfigUpdate) {
+	newParams, err := config.NewFromRawValues(msg.Config)
+	if err != nil {
+		log.WithError(err).Error("Failed to parse updated config, ignoring it")
+		return
+	}
+
+	if newParams.IptablesRefreshInterval != d.config.IptablesRefreshInterval {
+		log.WithField("interval", newParams.IptablesRefreshInterval).Info(
+			"iptables refresh interval changed")
+		d.config.IptablesRefreshInterval = newParams.IptablesRefreshInterval
+		for _, t := range d.allIptablesTables {
+			t.SetRefreshInterval(newParams.IptablesRefreshInterval)
+		}
+	}
+	if newParams.IpsetsRefreshInterval != d.config.IPSetsRefreshInterval ||
+		newParams.RouteRefreshInterval != d.config.RouteRefreshInterval {
+		log.Info("IP sets or route refresh interval changed")
+		d.config.IPSetsRefreshInterval = newParams.IpsetsRefreshInterval
+		d.config.RouteRefreshInterval = newParams.RouteRefreshInterval
+		d.restartRefreshTickers()
+	}
+
+	rulesConfig := d.config.RulesConfig
+	rulesConfig.IptablesLogPrefix = newParams.LogPrefix
+	rulesConfig.EndpointToHostAction = newParams.DefaultEndpointToHostAction
+	rulesConfig.FailsafeInboundHostPorts = newParams.FailsafeInboundHostPorts
+	rulesConfig.FailsafeOutboundHostPorts = newParams.FailsafeOutboundHostPorts
+	if !reflect.DeepEqual(rulesConfig, d.config.RulesConfig) {
+		log.Info("Rule renderer config changed, re-rendering chains")
+		d.config.RulesConfig = rulesConfig
+		d.ruleRenderer.UpdateConfig(rulesConfig)
+		d.updateStaticChains()
+		// Let the managers re-render any chains that depend on the renderer's config.
+		for _, mgr := range d.allManagers {
+			mgr.OnUpdate(&rulesConfigUpdate{})
+		}
+		d.dataplaneNeedsSync = true
 	}
 }
 
+// rulesConfigUpdate is sent to the managers after the rule renderer's config has been
+// updated.
+type rulesConfigUpdate struct{}
+
+// restartRefreshTickers (re)starts the IP sets and route refresh tickers using the currently
+// configured intervals.
+func (d *InternalDataplane) restartRefreshTickers() {
+	d.ipSetsRefreshTicker = restartRefreshTicker(
+		d.ipSetsRefreshTicker, d.config.IPSetsRefreshInterval, "IP sets")
+	d.routeRefreshTicker = restartRefreshTicker(
+		d.routeRefreshTicker, d.config.RouteRefreshInterval, "routes")
+}
+
+// restartRefreshTicker stops the old ticker, if there is one, and returns a new ticker with
+// the given interval.  Returns nil if the interval is zero, which disables the refresh.
+func restartRefreshTicker(oldTicker *jitter.Ticker, interval time.Duration, what string) *jitter.Ticker {
+	if oldTicker != nil {
+		// Stop() blocks until the ticker's next tick so we do it in the background.
+		go oldTicker.Stop()
+	}
+	if interval <= 0 {
+		log.Infof("Periodic refresh of %s disabled", what)
+		return nil
+	}
+	log.WithField("interval", interval).Infof("Will refresh %s on timer", what)
+	return jitter.NewTicker(interval, interval/10)
+}
+
+// tickerC returns the channel of the given ticker, or nil, which blocks forever, if the
+// ticker is nil.
+func tickerC(t *jitter.Ticker) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C
+}
+
 func (d *InternalDataplane) configureKernel() {
 	// For IPv4, we rely on the kernel's reverse path filtering to prevent workloads from
 	// spoofing their IP addresses.
@@ -843,23 +1171,28 @@ func (d *InternalDataplane) apply() {
 	// Unset the needs-sync flag, we'll set it again if something fails.
 	d.dataplaneNeedsSync = false
 
-	// First, give the managers a chance to update IP sets and iptables.
-	for _, mgr := range d.allManagers {
-		err := mgr.CompleteDeferredWork()
-		if err != nil {
-			d.dataplaneNeedsSync = true
-		}
-	}
-
 	if d.forceRouteRefresh {
 		// Refresh timer popped.
 		for _, r := range d.routeTables {
 			// Queue a resync on the next Apply().
 			r.QueueResync()
 		}
+		if d.vxlanManager != nil {
+			// The VXLAN device and its FDB are routing state too; recheck them in
+			// case something else has modified them.
+			d.vxlanManager.QueueResync()
+		}
 		d.forceRouteRefresh = false
 	}
 
+	// First, give the managers a chance to update IP sets and iptables.
+	for _, mgr := range d.allManagers {
+		err := mgr.CompleteDeferredWork()
+		if err != nil {
+			d.dataplaneNeedsSync = true
+		}
+	}
+
 	if d.forceIPSetsRefresh {
 		// Refresh timer popped.
 		for _, r := range d.ipSets {
@@ -874,7 +1207,7 @@ func (d *InternalDataplane) apply() {
 	var ipSetsWG sync.WaitGroup
 	for _, ipSets := range d.ipSets {
 		ipSetsWG.Add(1)
-		go func(ipSets *ipsets.IPSets) {
+		go func(ipSets ipSetsWriter) {
 			ipSets.ApplyUpdates()
 			ipSetsWG.Done()
 		}(ipSets)
@@ -904,7 +1237,7 @@ func (d *InternalDataplane) apply() {
 	var iptablesWG sync.WaitGroup
 	for _, t := range d.allIptablesTables {
 		iptablesWG.Add(1)
-		go func(t *iptables.Table) {
+		go func(t dataplaneTable) {
 			tableReschedAfter := t.Apply()
 
 			reschedDelayMutex.Lock()
@@ -920,7 +1253,7 @@ func (d *InternalDataplane) apply() {
 	// Now clean up any left-over IP sets.
 	for _, ipSets := range d.ipSets {
 		ipSetsWG.Add(1)
-		go func(s *ipsets.IPSets) {
+		go func(s ipSetsWriter) {
 			s.ApplyDeletions()
 			ipSetsWG.Done()
 		}(ipSets)
@@ -930,6 +1263,13 @@ func (d *InternalDataplane) apply() {
 	// Wait for the route updates to finish.
 	routesWG.Wait()
 
+	// Now that the new policy is in place, check whether it denies any existing flows.  If
+	// anything failed, the updates aren't all in the dataplane yet; they'll be checked after
+	// the retry succeeds.
+	if d.conntrackTeardown != nil && !d.dataplaneNeedsSync {
+		d.conntrackTeardown.OnDataplaneApplied()
+	}
+
 	// And publish and status updates.
 	d.endpointStatusCombiner.Apply()
 
@@ -985,6 +1325,49 @@ type iptablesTable interface {
 	RemoveChainByName(name string)
 }
 
+// dataplaneTable is the interface implemented by the tables of both the iptables and
+// nftables backends.
+type dataplaneTable interface {
+	iptablesTable
+	SetRuleInsertions(chainName string, rules []iptables.Rule)
+	SetRefreshInterval(interval time.Duration)
+	Apply() (rescheduleAfter time.Duration)
+}
+
+// tableIPVersion returns the IP version of the given table.
+func tableIPVersion(t dataplaneTable) uint8 {
+	switch t := t.(type) {
+	case *iptables.Table:
+		return t.IPVersion
+	case *nftables.Table:
+		return t.IPVersion
+	}
+	log.WithField("table", t).Panic("Unknown table type")
+	return 0
+}
+
+// ipSetsWriter is the interface implemented by the IP sets of both the iptables and nftables
+// backends.
+type ipSetsWriter interface {
+	ipsetsDataplane
+	QueueResync()
+	ApplyUpdates()
+	ApplyDeletions()
+}
+
+// newIPSets creates the IP sets object for the configured backend.  For the nftables backend,
+// it also returns the concrete nftables.IPSets, which the nftables tables need.
+func newIPSets(config Config, ipSetsConfig *ipsets.IPVersionConfig) (ipSetsWriter, *nftables.IPSets) {
+	if config.DataplaneBackend == BackendNftables {
+		nftIPSets := nftables.NewIPSets(ipSetsConfig)
+		return nftIPSets, nftIPSets
+	}
+	if config.IPSetsBackend == IPSetsBackendNetlink {
+		return ipsets.NewNetlinkIPSets(ipSetsConfig), nil
+	}
+	return ipsets.NewIPSets(ipSetsConfig), nil
+}
+
 func (d *InternalDataplane) reportHealth() {
 	if d.config.HealthAggregator != nil {
 		d.config.HealthAggregator.Report(
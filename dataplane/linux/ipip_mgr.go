@@ -30,9 +30,12 @@ import (
 // when IPIP is enabled.  It doesn't actually program the rules, because they are part of the
 // top-level static chains.
 //
-// ipipManager also takes care of the configuration of the IPIP tunnel device.
+// ipipManager also takes care of the configuration of the IPIP tunnel device.  There's one
+// ipipManager per IP version: the IPv4 manager manages the IPv4-in-IPv4 tunl0 device and the
+// IPv6 manager manages the IPv6-in-IPv6 ip6tnl0 device.
 type ipipManager struct {
 	ipsetsDataplane ipsetsDataplane
+	ipVersion       uint8
 
 	// activeHostnameToIP maps hostname to string IP address.  We don't bother to parse into
 	// net.IPs because we're going to pass them directly to the IPSet API.
@@ -49,17 +52,20 @@ type ipipManager struct {
 func newIPIPManager(
 	ipsetsDataplane ipsetsDataplane,
 	maxIPSetSize int,
+	ipVersion uint8,
 ) *ipipManager {
-	return newIPIPManagerWithShim(ipsetsDataplane, maxIPSetSize, realIPIPNetlink{})
+	return newIPIPManagerWithShim(ipsetsDataplane, maxIPSetSize, ipVersion, realIPIPNetlink{})
 }
 
 func newIPIPManagerWithShim(
 	ipsetsDataplane ipsetsDataplane,
 	maxIPSetSize int,
+	ipVersion uint8,
 	dataplane ipipDataplane,
 ) *ipipManager {
 	ipipMgr := &ipipManager{
 		ipsetsDataplane:    ipsetsDataplane,
+		ipVersion:          ipVersion,
 		activeHostnameToIP: map[string]string{},
 		dataplane:          dataplane,
 		ipSetMetadata: ipsets.IPSetMetadata{
@@ -74,7 +80,7 @@ func newIPIPManagerWithShim(
 // KeepIPIPDeviceInSync is a goroutine that configures the IPIP tunnel device, then periodically
 // checks that it is still correctly configured.
 func (d *ipipManager) KeepIPIPDeviceInSync(mtu int, address net.IP) {
-	log.Info("IPIP thread started.")
+	log.WithField("ipVersion", d.ipVersion).Info("IPIP thread started.")
 	for {
 		err := d.configureIPIPDevice(mtu, address)
 		if err != nil {
@@ -88,23 +94,29 @@ func (d *ipipManager) KeepIPIPDeviceInSync(mtu int, address net.IP) {
 
 // configureIPIPDevice ensures the IPIP tunnel device is up and configures correctly.
 func (d *ipipManager) configureIPIPDevice(mtu int, address net.IP) error {
+	ifaceName := rules.IPIPIfaceName(d.ipVersion)
 	logCxt := log.WithFields(log.Fields{
 		"mtu":        mtu,
 		"tunnelAddr": address,
+		"device":     ifaceName,
 	})
 	logCxt.Debug("Configuring IPIP tunnel")
-	link, err := d.dataplane.LinkByName("tunl0")
+	link, err := d.dataplane.LinkByName(ifaceName)
 	if err != nil {
 		log.WithError(err).Info("Failed to get IPIP tunnel device, assuming it isn't present")
 		// We call out to "ip tunnel", which takes care of loading the kernel module if
-		// needed.  The tunl0 device is actually created automatically by the kernel
+		// needed.  The tunnel device is actually created automatically by the kernel
 		// module.
-		err := d.dataplane.RunCmd("ip", "tunnel", "add", "tunl0", "mode", "ipip")
+		if d.ipVersion == 6 {
+			err = d.dataplane.RunCmd("ip", "-6", "tunnel", "add", ifaceName, "mode", "ip6ip6")
+		} else {
+			err = d.dataplane.RunCmd("ip", "tunnel", "add", ifaceName, "mode", "ipip")
+		}
 		if err != nil {
 			log.WithError(err).Warning("Failed to add IPIP tunnel device")
 			return err
 		}
-		link, err = d.dataplane.LinkByName("tunl0")
+		link, err = d.dataplane.LinkByName(ifaceName)
 		if err != nil {
 			log.WithError(err).Warning("Failed to get tunnel device")
 			return err
@@ -130,28 +142,32 @@ func (d *ipipManager) configureIPIPDevice(mtu int, address net.IP) error {
 		logCxt.Info("Set tunnel admin up")
 	}
 
-	if err := d.setLinkAddressV4("tunl0", address); err != nil {
+	if err := d.setLinkAddress(ifaceName, address); err != nil {
 		log.WithError(err).Warn("Failed to set tunnel device IP")
 		return err
 	}
 	return nil
 }
 
-// setLinkAddressV4 updates the given link to set its local IP address.  It removes any other
-// addresses.
-func (d *ipipManager) setLinkAddressV4(linkName string, address net.IP) error {
+// setLinkAddress updates the given link to set its local IP address, of the manager's IP
+// version.  It removes any other addresses of that version.
+func (d *ipipManager) setLinkAddress(linkName string, address net.IP) error {
 	logCxt := log.WithFields(log.Fields{
 		"link": linkName,
 		"addr": address,
 	})
-	logCxt.Debug("Setting local IPv4 address on link.")
+	logCxt.Debug("Setting local IP address on link.")
 	link, err := d.dataplane.LinkByName(linkName)
 	if err != nil {
 		log.WithError(err).WithField("name", linkName).Warning("Failed to get device")
 		return err
 	}
 
-	addrs, err := d.dataplane.AddrList(link, netlink.FAMILY_V4)
+	family := netlink.FAMILY_V4
+	if d.ipVersion == 6 {
+		family = netlink.FAMILY_V6
+	}
+	addrs, err := d.dataplane.AddrList(link, family)
 	if err != nil {
 		log.WithError(err).Warn("Failed to list interface addresses")
 		return err
@@ -159,6 +175,10 @@ func (d *ipipManager) setLinkAddressV4(linkName string, address net.IP) error {
 
 	found := false
 	for _, oldAddr := range addrs {
+		if d.ipVersion == 6 && oldAddr.IP.IsLinkLocalUnicast() {
+			// The kernel manages the IPv6 link-local address.
+			continue
+		}
 		if address != nil && oldAddr.IP.Equal(address) {
 			logCxt.Debug("Address already present.")
 			found = true
@@ -174,6 +194,9 @@ func (d *ipipManager) setLinkAddressV4(linkName string, address net.IP) error {
 	if !found && address != nil {
 		logCxt.Info("Address wasn't present, adding it.")
 		mask := net.CIDRMask(32, 32)
+		if d.ipVersion == 6 {
+			mask = net.CIDRMask(128, 128)
+		}
 		ipNet := net.IPNet{
 			IP:   address.Mask(mask), // Mask the IP to match ParseCIDR()'s behaviour.
 			Mask: mask,
@@ -195,7 +218,16 @@ func (d *ipipManager) OnUpdate(msg interface{}) {
 	switch msg := msg.(type) {
 	case *proto.HostMetadataUpdate:
 		log.WithField("hostanme", msg.Hostname).Debug("Host update/create")
-		d.activeHostnameToIP[msg.Hostname] = msg.Ipv4Addr
+		addr := msg.Ipv4Addr
+		if d.ipVersion == 6 {
+			addr = msg.Ipv6Addr
+		}
+		if addr == "" {
+			// Host doesn't have an address of our IP version.
+			delete(d.activeHostnameToIP, msg.Hostname)
+		} else {
+			d.activeHostnameToIP[msg.Hostname] = addr
+		}
 		d.ipSetInSync = false
 	case *proto.HostMetadataRemove:
 		log.WithField("hostname", msg.Hostname).Debug("Host removed")
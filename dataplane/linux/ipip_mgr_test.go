@@ -53,7 +53,7 @@ var _ = Describe("IpipMgr (tunnel configuration)", func() {
 	BeforeEach(func() {
 		dataplane = &mockIPIPDataplane{}
 		ipSets = newMockIPSets()
-		ipipMgr = newIPIPManagerWithShim(ipSets, 1024, dataplane)
+		ipipMgr = newIPIPManagerWithShim(ipSets, 1024, 4, dataplane)
 	})
 
 	Describe("after calling configureIPIPDevice", func() {
@@ -195,6 +195,64 @@ var _ = Describe("IpipMgr (tunnel configuration)", func() {
 	}
 })
 
+var _ = Describe("IpipMgr (IPv6 tunnel configuration)", func() {
+	var (
+		ipipMgr   *ipipManager
+		dataplane *mockIPIPDataplane
+	)
+
+	ip := net.ParseIP("fd00::1")
+	linkLocal := netlink.Addr{
+		IPNet: &net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+	}
+
+	BeforeEach(func() {
+		dataplane = &mockIPIPDataplane{ipVersion: 6}
+		ipipMgr = newIPIPManagerWithShim(newMockIPSets(), 1024, 6, dataplane)
+	})
+
+	Describe("after calling configureIPIPDevice", func() {
+		BeforeEach(func() {
+			Expect(ipipMgr.configureIPIPDevice(1420, ip)).To(Succeed())
+		})
+
+		It("should create the ip6tnl0 interface", func() {
+			Expect(dataplane.RunCmdCalled).To(BeTrue())
+			Expect(dataplane.tunnelLink).ToNot(BeNil())
+		})
+		It("should set the MTU", func() {
+			Expect(dataplane.tunnelLinkAttrs.MTU).To(Equal(1420))
+		})
+		It("should set the interface UP", func() {
+			Expect(dataplane.tunnelLinkAttrs.Flags).To(Equal(net.FlagUp))
+		})
+		It("should configure the address with a /128", func() {
+			Expect(dataplane.addrs).To(HaveLen(1))
+			Expect(dataplane.addrs[0].IPNet.String()).To(Equal("fd00::1/128"))
+		})
+
+		Describe("after second call with different IP", func() {
+			BeforeEach(func() {
+				dataplane.ResetCalls()
+				Expect(ipipMgr.configureIPIPDevice(1420, net.ParseIP("fd00::2"))).To(Succeed())
+			})
+			It("should reconfigure the address", func() {
+				Expect(dataplane.addrs).To(HaveLen(1))
+				Expect(dataplane.addrs[0].IPNet.String()).To(Equal("fd00::2/128"))
+			})
+		})
+	})
+
+	It("should leave the link-local address alone", func() {
+		dataplane.RunCmd("ip", "-6", "tunnel", "add", "ip6tnl0", "mode", "ip6ip6")
+		dataplane.addrs = []netlink.Addr{linkLocal}
+		Expect(ipipMgr.configureIPIPDevice(1420, ip)).To(Succeed())
+		Expect(dataplane.addrs).To(HaveLen(2))
+		Expect(dataplane.addrs[0]).To(Equal(linkLocal))
+		Expect(dataplane.addrs[1].IPNet.String()).To(Equal("fd00::1/128"))
+	})
+})
+
 var _ = Describe("ipipManager IP set updates", func() {
 	var (
 		ipipMgr   *ipipManager
@@ -205,7 +263,7 @@ var _ = Describe("ipipManager IP set updates", func() {
 	BeforeEach(func() {
 		dataplane = &mockIPIPDataplane{}
 		ipSets = newMockIPSets()
-		ipipMgr = newIPIPManagerWithShim(ipSets, 1024, dataplane)
+		ipipMgr = newIPIPManagerWithShim(ipSets, 1024, 4, dataplane)
 	})
 
 	It("should not create the IP set until first call to CompleteDeferredWork()", func() {
@@ -323,7 +381,49 @@ var _ = Describe("ipipManager IP set updates", func() {
 	})
 })
 
+var _ = Describe("ipipManager IPv6 IP set updates", func() {
+	var (
+		ipipMgr *ipipManager
+		ipSets  *mockIPSets
+	)
+
+	BeforeEach(func() {
+		ipSets = newMockIPSets()
+		ipipMgr = newIPIPManagerWithShim(ipSets, 1024, 6, &mockIPIPDataplane{ipVersion: 6})
+		ipipMgr.OnUpdate(&proto.HostMetadataUpdate{
+			Hostname: "host1",
+			Ipv6Addr: "fd00::1",
+		})
+		ipipMgr.OnUpdate(&proto.HostMetadataUpdate{
+			Hostname: "host2",
+			Ipv4Addr: "10.0.0.2",
+		})
+		ipipMgr.CompleteDeferredWork()
+	})
+
+	It("should only add the IPv6 addresses to the IP set", func() {
+		Expect(ipSets.Members["all-hosts"]).To(Equal(set.From("fd00::1")))
+	})
+
+	Describe("after host1 switches to an IPv4 address", func() {
+		BeforeEach(func() {
+			ipipMgr.OnUpdate(&proto.HostMetadataUpdate{
+				Hostname: "host1",
+				Ipv4Addr: "10.0.0.1",
+			})
+			ipipMgr.CompleteDeferredWork()
+		})
+
+		It("should remove host1 from the IP set", func() {
+			Expect(ipSets.Members["all-hosts"]).To(Equal(set.New()))
+		})
+	})
+})
+
 type mockIPIPDataplane struct {
+	// ipVersion is the IP version of the tunnel that we expect to be configured; 0 means 4.
+	ipVersion uint8
+
 	tunnelLink      *mockLink
 	tunnelLinkAttrs *netlink.LinkAttrs
 	addrs           []netlink.Addr
@@ -337,6 +437,13 @@ type mockIPIPDataplane struct {
 	ErrorAtCall int
 }
 
+func (d *mockIPIPDataplane) ifaceName() string {
+	if d.ipVersion == 6 {
+		return "ip6tnl0"
+	}
+	return "tunl0"
+}
+
 func (d *mockIPIPDataplane) ResetCalls() {
 	d.RunCmdCalled = false
 	d.LinkSetMTUCalled = false
@@ -360,7 +467,7 @@ func (d *mockIPIPDataplane) LinkByName(name string) (netlink.Link, error) {
 		return nil, err
 	}
 
-	Expect(name).To(Equal("tunl0"))
+	Expect(name).To(Equal(d.ifaceName()))
 	if d.tunnelLink == nil {
 		return nil, notFound
 	}
@@ -372,7 +479,7 @@ func (d *mockIPIPDataplane) LinkSetMTU(link netlink.Link, mtu int) error {
 	if err := d.incCallCount(); err != nil {
 		return err
 	}
-	Expect(link.Attrs().Name).To(Equal("tunl0"))
+	Expect(link.Attrs().Name).To(Equal(d.ifaceName()))
 	d.tunnelLinkAttrs.MTU = mtu
 	return nil
 }
@@ -382,7 +489,7 @@ func (d *mockIPIPDataplane) LinkSetUp(link netlink.Link) error {
 	if err := d.incCallCount(); err != nil {
 		return err
 	}
-	Expect(link.Attrs().Name).To(Equal("tunl0"))
+	Expect(link.Attrs().Name).To(Equal(d.ifaceName()))
 	d.tunnelLinkAttrs.Flags |= net.FlagUp
 	return nil
 }
@@ -391,7 +498,12 @@ func (d *mockIPIPDataplane) AddrList(link netlink.Link, family int) ([]netlink.A
 	if err := d.incCallCount(); err != nil {
 		return nil, err
 	}
-	Expect(link.Attrs().Name).To(Equal("tunl0"))
+	Expect(link.Attrs().Name).To(Equal(d.ifaceName()))
+	if d.ipVersion == 6 {
+		Expect(family).To(Equal(netlink.FAMILY_V6))
+	} else {
+		Expect(family).To(Equal(netlink.FAMILY_V4))
+	}
 	return d.addrs, nil
 }
 
@@ -423,12 +535,16 @@ func (d *mockIPIPDataplane) RunCmd(name string, args ...string) error {
 	}
 	log.WithFields(log.Fields{"name": name, "args": args}).Info("RunCmd called")
 	Expect(name).To(Equal("ip"))
-	Expect(args).To(Equal([]string{"tunnel", "add", "tunl0", "mode", "ipip"}))
+	if d.ipVersion == 6 {
+		Expect(args).To(Equal([]string{"-6", "tunnel", "add", "ip6tnl0", "mode", "ip6ip6"}))
+	} else {
+		Expect(args).To(Equal([]string{"tunnel", "add", "tunl0", "mode", "ipip"}))
+	}
 
 	if d.tunnelLink == nil {
 		log.Info("Creating tunnel link")
 		link := &mockLink{}
-		link.attrs.Name = "tunl0"
+		link.attrs.Name = d.ifaceName()
 		d.tunnelLinkAttrs = &link.attrs
 		d.tunnelLink = link
 	}
@@ -0,0 +1,151 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/routetable"
+	"github.com/projectcalico/felix/rules"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// RenderChainsOffline feeds the given calculation graph output through the same managers that
+// the dataplane uses to program iptables and returns the chains that they would program, keyed
+// by table name.  Nothing is written to the kernel: the managers write to tables that just
+// record their chains, and the routes, IP sets and sysctls that they'd program are discarded.
+//
+// Offline, there are no interfaces, so only host endpoints with an explicit interface name are
+// resolved; each of those is treated as if its interface exists.  The rules that Felix inserts
+// into the kernel's top-level chains aren't included.
+func RenderChainsOffline(config rules.Config, msgs []interface{}, ipVersion uint8) map[string][]*iptables.Chain {
+	ruleRenderer := rules.NewRenderer(config)
+	epMarkMapper := rules.NewEndpointMarkMapper(config.IptablesMarkEndpoint, config.IptablesMarkNonCaliEndpoint)
+
+	rawTable := newRecordingTable()
+	mangleTable := newRecordingTable()
+	filterTable := newRecordingTable()
+	natTable := newRecordingTable()
+	rawTable.UpdateChains(ruleRenderer.StaticRawTableChains(ipVersion))
+	mangleTable.UpdateChains(ruleRenderer.StaticMangleTableChains(ipVersion))
+	filterTable.UpdateChains(ruleRenderer.StaticFilterTableChains(ipVersion))
+	natTable.UpdateChains(ruleRenderer.StaticNATTableChains(ipVersion))
+
+	managers := []Manager{
+		newPolicyManager(rawTable, mangleTable, filterTable, ruleRenderer, ipVersion, nil),
+		newEndpointManagerWithShims(
+			rawTable,
+			mangleTable,
+			filterTable,
+			ruleRenderer,
+			discardingRouteTable{},
+			ipVersion,
+			epMarkMapper,
+			config.KubeIPVSSupportEnabled,
+			config.WorkloadIfacePrefixes,
+			func(ipVersion uint8, id interface{}, status string) {},
+			func(path, value string) error { return nil },
+		),
+		newFloatingIPManager(natTable, ruleRenderer, ipVersion),
+		newMasqManager(discardingIPSets{}, natTable, ruleRenderer, 0, ipVersion),
+	}
+
+	hostIfaces := set.New()
+	for _, msg := range msgs {
+		for _, mgr := range managers {
+			mgr.OnUpdate(msg)
+		}
+		if update, ok := msg.(*proto.HostEndpointUpdate); ok {
+			if update.Endpoint.Name == "" {
+				log.WithField("id", update.Id).Warn(
+					"Host endpoint has no interface name, can't resolve it offline; skipping")
+				continue
+			}
+			hostIfaces.Add(update.Endpoint.Name)
+		}
+	}
+	// Stand in for the interface monitor so that the named host endpoints resolve.
+	hostIfaces.Iter(func(item interface{}) error {
+		update := &ifaceAddrsUpdate{Name: item.(string), Addrs: set.New()}
+		for _, mgr := range managers {
+			mgr.OnUpdate(update)
+		}
+		return nil
+	})
+
+	for _, mgr := range managers {
+		if err := mgr.CompleteDeferredWork(); err != nil {
+			log.WithError(err).Warn("Manager failed to render its chains offline")
+		}
+	}
+
+	return map[string][]*iptables.Chain{
+		"filter": filterTable.chains(),
+		"mangle": mangleTable.chains(),
+		"nat":    natTable.chains(),
+		"raw":    rawTable.chains(),
+	}
+}
+
+// recordingTable is an iptablesTable that just records the chains that it's given.
+type recordingTable struct {
+	chainsByName map[string]*iptables.Chain
+}
+
+func newRecordingTable() *recordingTable {
+	return &recordingTable{chainsByName: map[string]*iptables.Chain{}}
+}
+
+func (t *recordingTable) UpdateChain(chain *iptables.Chain) {
+	t.chainsByName[chain.Name] = chain
+}
+
+func (t *recordingTable) UpdateChains(chains []*iptables.Chain) {
+	for _, chain := range chains {
+		t.UpdateChain(chain)
+	}
+}
+
+func (t *recordingTable) RemoveChains(chains []*iptables.Chain) {
+	for _, chain := range chains {
+		t.RemoveChainByName(chain.Name)
+	}
+}
+
+func (t *recordingTable) RemoveChainByName(name string) {
+	delete(t.chainsByName, name)
+}
+
+func (t *recordingTable) chains() []*iptables.Chain {
+	chains := make([]*iptables.Chain, 0, len(t.chainsByName))
+	for _, chain := range t.chainsByName {
+		chains = append(chains, chain)
+	}
+	return chains
+}
+
+type discardingRouteTable struct{}
+
+func (discardingRouteTable) SetRoutes(ifaceName string, targets []routetable.Target) {}
+
+type discardingIPSets struct{}
+
+func (discardingIPSets) AddOrReplaceIPSet(setMetadata ipsets.IPSetMetadata, members []string) {}
+func (discardingIPSets) AddMembers(setID string, newMembers []string)                         {}
+func (discardingIPSets) RemoveMembers(setID string, removedMembers []string)                  {}
+func (discardingIPSets) RemoveIPSet(setID string)                                             {}
@@ -30,20 +30,36 @@ type policyManager struct {
 	filterTable  iptablesTable
 	ruleRenderer policyRenderer
 	ipVersion    uint8
+
+	// policies and profiles hold the active policies and profiles so that we can re-render
+	// them if the rule renderer's config changes.
+	policies map[proto.PolicyID]*proto.Policy
+	profiles map[proto.ProfileID]*proto.Profile
+
+	// ruleCounters, if non-nil, tracks the counters of the rendered policy rules.
+	ruleCounters *ruleCounterCollector
 }
 
 type policyRenderer interface {
-	PolicyToIptablesChains(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) []*iptables.Chain
-	ProfileToIptablesChains(profileID *proto.ProfileID, policy *proto.Profile, ipVersion uint8) []*iptables.Chain
+	PolicyToIptablesChainsWithHitIndexes(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) (chains []*iptables.Chain, inbound, outbound []int)
+	ProfileToIptablesChainsWithHitIndexes(profileID *proto.ProfileID, profile *proto.Profile, ipVersion uint8) (chains []*iptables.Chain, inbound, outbound []int)
 }
 
-func newPolicyManager(rawTable, mangleTable, filterTable iptablesTable, ruleRenderer policyRenderer, ipVersion uint8) *policyManager {
+func newPolicyManager(
+	rawTable, mangleTable, filterTable iptablesTable,
+	ruleRenderer policyRenderer,
+	ipVersion uint8,
+	ruleCounters *ruleCounterCollector,
+) *policyManager {
 	return &policyManager{
 		rawTable:     rawTable,
 		mangleTable:  mangleTable,
 		filterTable:  filterTable,
 		ruleRenderer: ruleRenderer,
 		ipVersion:    ipVersion,
+		policies:     map[proto.PolicyID]*proto.Policy{},
+		profiles:     map[proto.ProfileID]*proto.Profile{},
+		ruleCounters: ruleCounters,
 	}
 }
 
@@ -51,12 +67,14 @@ func (m *policyManager) OnUpdate(msg interface{}) {
 	switch msg := msg.(type) {
 	case *proto.ActivePolicyUpdate:
 		log.WithField("id", msg.Id).Debug("Updating policy chains")
-		chains := m.ruleRenderer.PolicyToIptablesChains(msg.Id, msg.Policy, m.ipVersion)
-		m.rawTable.UpdateChains(chains)
-		m.mangleTable.UpdateChains(chains)
-		m.filterTable.UpdateChains(chains)
+		m.policies[*msg.Id] = msg.Policy
+		m.updatePolicyChains(msg.Id, msg.Policy)
 	case *proto.ActivePolicyRemove:
 		log.WithField("id", msg.Id).Debug("Removing policy chains")
+		delete(m.policies, *msg.Id)
+		if m.ruleCounters != nil {
+			m.ruleCounters.removePolicy(m.ipVersion, msg.Id)
+		}
 		inName := rules.PolicyChainName(rules.PolicyInboundPfx, msg.Id)
 		outName := rules.PolicyChainName(rules.PolicyOutboundPfx, msg.Id)
 		m.filterTable.RemoveChainByName(inName)
@@ -67,14 +85,46 @@ func (m *policyManager) OnUpdate(msg interface{}) {
 		m.rawTable.RemoveChainByName(outName)
 	case *proto.ActiveProfileUpdate:
 		log.WithField("id", msg.Id).Debug("Updating profile chains")
-		chains := m.ruleRenderer.ProfileToIptablesChains(msg.Id, msg.Profile, m.ipVersion)
-		m.filterTable.UpdateChains(chains)
+		m.profiles[*msg.Id] = msg.Profile
+		m.updateProfileChains(msg.Id, msg.Profile)
 	case *proto.ActiveProfileRemove:
 		log.WithField("id", msg.Id).Debug("Removing profile chains")
+		delete(m.profiles, *msg.Id)
+		if m.ruleCounters != nil {
+			m.ruleCounters.removeProfile(m.ipVersion, msg.Id)
+		}
 		inName := rules.ProfileChainName(rules.ProfileInboundPfx, msg.Id)
 		outName := rules.ProfileChainName(rules.ProfileOutboundPfx, msg.Id)
 		m.filterTable.RemoveChainByName(inName)
 		m.filterTable.RemoveChainByName(outName)
+	case *rulesConfigUpdate:
+		log.Info("Rule renderer config changed, re-rendering policy and profile chains")
+		for id, policy := range m.policies {
+			id := id
+			m.updatePolicyChains(&id, policy)
+		}
+		for id, profile := range m.profiles {
+			id := id
+			m.updateProfileChains(&id, profile)
+		}
+	}
+}
+
+func (m *policyManager) updatePolicyChains(id *proto.PolicyID, policy *proto.Policy) {
+	chains, inbound, outbound := m.ruleRenderer.PolicyToIptablesChainsWithHitIndexes(id, policy, m.ipVersion)
+	m.rawTable.UpdateChains(chains)
+	m.mangleTable.UpdateChains(chains)
+	m.filterTable.UpdateChains(chains)
+	if m.ruleCounters != nil {
+		m.ruleCounters.registerPolicy(m.ipVersion, id, policy, chains, inbound, outbound)
+	}
+}
+
+func (m *policyManager) updateProfileChains(id *proto.ProfileID, profile *proto.Profile) {
+	chains, inbound, outbound := m.ruleRenderer.ProfileToIptablesChainsWithHitIndexes(id, profile, m.ipVersion)
+	m.filterTable.UpdateChains(chains)
+	if m.ruleCounters != nil {
+		m.ruleCounters.registerProfile(m.ipVersion, id, profile, chains, inbound, outbound)
 	}
 }
 
@@ -37,7 +37,7 @@ var _ = Describe("Policy manager", func() {
 		mangleTable = newMockTable("mangle")
 		filterTable = newMockTable("filter")
 		ruleRenderer = newMockPolRenderer()
-		policyMgr = newPolicyManager(rawTable, mangleTable, filterTable, ruleRenderer, 4)
+		policyMgr = newPolicyManager(rawTable, mangleTable, filterTable, ruleRenderer, 4, nil)
 	})
 
 	It("shouldn't touch iptables", func() {
@@ -83,6 +83,29 @@ var _ = Describe("Policy manager", func() {
 				filterTable.checkChains([][]*iptables.Chain{})
 				mangleTable.checkChains([][]*iptables.Chain{})
 			})
+
+			It("should not re-render the chains after a rule renderer config update", func() {
+				policyMgr.OnUpdate(&rulesConfigUpdate{})
+				filterTable.checkChains([][]*iptables.Chain{})
+				mangleTable.checkChains([][]*iptables.Chain{})
+			})
+		})
+
+		Describe("after a rule renderer config update", func() {
+			BeforeEach(func() {
+				filterTable.UpdateCalled = false
+				mangleTable.UpdateCalled = false
+				policyMgr.OnUpdate(&rulesConfigUpdate{})
+			})
+
+			It("should re-render the in and out chain", func() {
+				Expect(filterTable.UpdateCalled).To(BeTrue())
+				Expect(mangleTable.UpdateCalled).To(BeTrue())
+				filterTable.checkChains([][]*iptables.Chain{{
+					{Name: "cali-pi-pol1"},
+					{Name: "cali-po-pol1"},
+				}})
+			})
 		})
 	})
 
@@ -241,21 +264,21 @@ var _ = Describe("Policy manager", func() {
 type mockPolRenderer struct {
 }
 
-func (r *mockPolRenderer) PolicyToIptablesChains(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) []*iptables.Chain {
+func (r *mockPolRenderer) PolicyToIptablesChainsWithHitIndexes(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) ([]*iptables.Chain, []int, []int) {
 	inName := rules.PolicyChainName(rules.PolicyInboundPfx, policyID)
 	outName := rules.PolicyChainName(rules.PolicyOutboundPfx, policyID)
 	return []*iptables.Chain{
 		{Name: inName},
 		{Name: outName},
-	}
+	}, nil, nil
 }
-func (r *mockPolRenderer) ProfileToIptablesChains(profID *proto.ProfileID, policy *proto.Profile, ipVersion uint8) []*iptables.Chain {
+func (r *mockPolRenderer) ProfileToIptablesChainsWithHitIndexes(profID *proto.ProfileID, policy *proto.Profile, ipVersion uint8) ([]*iptables.Chain, []int, []int) {
 	inName := rules.ProfileChainName(rules.ProfileInboundPfx, profID)
 	outName := rules.ProfileChainName(rules.ProfileOutboundPfx, profID)
 	return []*iptables.Chain{
 		{Name: inName},
 		{Name: outName},
-	}
+	}, nil, nil
 }
 
 func newMockPolRenderer() *mockPolRenderer {
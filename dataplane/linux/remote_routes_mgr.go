@@ -0,0 +1,156 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/routetable"
+)
+
+// remoteRoutesManager programs the routes to remote hosts' IPAM blocks, which the calculation
+// graph sends as RouteUpdates.  Each route goes via the IP of the host that owns the block,
+// either through a tunnel device, as an onlink route, or, if ifaceName is
+// routetable.InterfaceNone, through whichever interface the kernel uses to reach that host.
+// That lets Felix route between hosts without a BGP daemon.
+//
+// We only route to blocks that are inside one of the IPAM pools.
+type remoteRoutesManager struct {
+	hostname   string
+	ipVersion  uint8
+	ifaceName  string
+	targetType routetable.TargetType
+	routeTable routeTable
+
+	// poolIDToCIDR contains the IPAM pools of our IP version.
+	poolIDToCIDR map[string]ip.CIDR
+	// routesByDst contains the routes to remote IPAM blocks, indexed by block CIDR.
+	routesByDst map[string]*proto.RouteUpdate
+
+	dirty bool
+}
+
+func newRemoteRoutesManager(
+	hostname string,
+	ipVersion uint8,
+	ifaceName string,
+	routeTable routeTable,
+) *remoteRoutesManager {
+	targetType := routetable.TargetTypeOnLink
+	if ifaceName == routetable.InterfaceNone {
+		targetType = routetable.TargetTypeGateway
+	}
+	return &remoteRoutesManager{
+		hostname:     hostname,
+		ipVersion:    ipVersion,
+		ifaceName:    ifaceName,
+		targetType:   targetType,
+		routeTable:   routeTable,
+		poolIDToCIDR: map[string]ip.CIDR{},
+		routesByDst:  map[string]*proto.RouteUpdate{},
+		dirty:        true,
+	}
+}
+
+func (m *remoteRoutesManager) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.IPAMPoolUpdate:
+		cidr, err := ip.ParseCIDROrIP(msg.Pool.Cidr)
+		if err != nil {
+			log.WithError(err).WithField("pool", msg.Pool).Warn("Failed to parse IPAM pool CIDR")
+			return
+		}
+		if cidr.Version() != m.ipVersion {
+			return
+		}
+		m.poolIDToCIDR[msg.Id] = cidr
+		m.dirty = true
+	case *proto.IPAMPoolRemove:
+		if _, ok := m.poolIDToCIDR[msg.Id]; ok {
+			delete(m.poolIDToCIDR, msg.Id)
+			m.dirty = true
+		}
+	case *proto.RouteUpdate:
+		m.routesByDst[msg.Dst] = msg
+		m.dirty = true
+	case *proto.RouteRemove:
+		if _, ok := m.routesByDst[msg.Dst]; ok {
+			delete(m.routesByDst, msg.Dst)
+			m.dirty = true
+		}
+	}
+}
+
+func (m *remoteRoutesManager) CompleteDeferredWork() error {
+	if !m.dirty {
+		return nil
+	}
+	m.updateRoutes()
+	m.dirty = false
+	return nil
+}
+
+// updateRoutes calculates the routes to remote IPAM blocks and passes them to the route table,
+// which takes care of the route programming.
+func (m *remoteRoutesManager) updateRoutes() {
+	var targets []routetable.Target
+	for dst, route := range m.routesByDst {
+		logCxt := log.WithField("route", route)
+		if route.DstNodeName == m.hostname {
+			// The calculation graph shouldn't send us our own blocks but it's cheap
+			// to check.
+			continue
+		}
+		cidr, err := ip.ParseCIDROrIP(dst)
+		if err != nil {
+			logCxt.WithError(err).Warn("Failed to parse route destination")
+			continue
+		}
+		if cidr.Version() != m.ipVersion {
+			continue
+		}
+		if !m.cidrIsInPool(cidr) {
+			logCxt.Debug("Route destination isn't in an IPAM pool, ignoring")
+			continue
+		}
+		gw := ip.FromString(route.DstNodeIp)
+		if gw == nil || gw.Version() != m.ipVersion {
+			logCxt.Warn("Route has no next hop of the right IP version, ignoring")
+			continue
+		}
+		targets = append(targets, routetable.Target{
+			Type: m.targetType,
+			CIDR: cidr,
+			GW:   gw,
+		})
+	}
+	log.WithFields(log.Fields{
+		"ifaceName": m.ifaceName,
+		"numRoutes": len(targets),
+	}).Info("Remote block routes updated")
+	m.routeTable.SetRoutes(m.ifaceName, targets)
+}
+
+func (m *remoteRoutesManager) cidrIsInPool(cidr ip.CIDR) bool {
+	for _, pool := range m.poolIDToCIDR {
+		poolNet := pool.ToIPNet()
+		if poolNet.Contains(cidr.Addr().AsNetIP()) && pool.Prefix() <= cidr.Prefix() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/ip"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/routetable"
+)
+
+var _ = Describe("Remote routes manager", func() {
+	var (
+		mgr        *remoteRoutesManager
+		routeTable *mockRouteTable
+	)
+
+	BeforeEach(func() {
+		routeTable = &mockRouteTable{currentRoutes: map[string][]routetable.Target{}}
+		mgr = newRemoteRoutesManager("host1", 4, "tunl0", routeTable)
+	})
+
+	It("should program no routes initially", func() {
+		Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		Expect(routeTable.currentRoutes).To(HaveKey("tunl0"))
+		routeTable.checkRoutes("tunl0", nil)
+	})
+
+	Describe("with routes", func() {
+		BeforeEach(func() {
+			mgr.OnUpdate(&proto.IPAMPoolUpdate{
+				Id:   "pool1",
+				Pool: &proto.IPAMPool{Cidr: "10.0.0.0/16"},
+			})
+			mgr.OnUpdate(&proto.RouteUpdate{
+				Dst:         "10.0.1.0/26",
+				DstNodeName: "host2",
+				DstNodeIp:   "172.16.0.2",
+			})
+			mgr.OnUpdate(&proto.RouteUpdate{
+				Dst:         "192.168.0.0/26",
+				DstNodeName: "host2",
+				DstNodeIp:   "172.16.0.2",
+			})
+			mgr.OnUpdate(&proto.RouteUpdate{
+				Dst:         "10.0.2.0/26",
+				DstNodeName: "host1",
+				DstNodeIp:   "172.16.0.1",
+			})
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		})
+
+		It("should only program routes to remote blocks inside IPAM pools", func() {
+			routeTable.checkRoutes("tunl0", []routetable.Target{{
+				Type: routetable.TargetTypeOnLink,
+				CIDR: ip.MustParseCIDROrIP("10.0.1.0/26"),
+				GW:   ip.FromString("172.16.0.2"),
+			}})
+		})
+		It("should update the route when the host IP changes", func() {
+			mgr.OnUpdate(&proto.RouteUpdate{
+				Dst:         "10.0.1.0/26",
+				DstNodeName: "host2",
+				DstNodeIp:   "172.16.0.3",
+			})
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+			routeTable.checkRoutes("tunl0", []routetable.Target{{
+				Type: routetable.TargetTypeOnLink,
+				CIDR: ip.MustParseCIDROrIP("10.0.1.0/26"),
+				GW:   ip.FromString("172.16.0.3"),
+			}})
+		})
+		It("should remove the route when the pool is removed", func() {
+			mgr.OnUpdate(&proto.IPAMPoolRemove{Id: "pool1"})
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+			routeTable.checkRoutes("tunl0", nil)
+		})
+		It("should remove the route on RouteRemove", func() {
+			mgr.OnUpdate(&proto.RouteRemove{Dst: "10.0.1.0/26"})
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+			routeTable.checkRoutes("tunl0", nil)
+		})
+		It("should ignore routes of the other IP version", func() {
+			mgr.OnUpdate(&proto.IPAMPoolUpdate{
+				Id:   "pool2",
+				Pool: &proto.IPAMPool{Cidr: "fd00::/48"},
+			})
+			mgr.OnUpdate(&proto.RouteUpdate{
+				Dst:         "fd00::/122",
+				DstNodeName: "host2",
+				DstNodeIp:   "fc00::2",
+			})
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+			Expect(routeTable.currentRoutes["tunl0"]).To(HaveLen(1))
+		})
+	})
+
+	Describe("without a tunnel device", func() {
+		BeforeEach(func() {
+			mgr = newRemoteRoutesManager("host1", 4, routetable.InterfaceNone, routeTable)
+			mgr.OnUpdate(&proto.IPAMPoolUpdate{
+				Id:   "pool1",
+				Pool: &proto.IPAMPool{Cidr: "10.0.0.0/16"},
+			})
+			mgr.OnUpdate(&proto.RouteUpdate{
+				Dst:         "10.0.1.0/26",
+				DstNodeName: "host2",
+				DstNodeIp:   "172.16.0.2",
+			})
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		})
+
+		It("should program a route via the host IP", func() {
+			routeTable.checkRoutes(routetable.InterfaceNone, []routetable.Target{{
+				Type: routetable.TargetTypeGateway,
+				CIDR: ip.MustParseCIDROrIP("10.0.1.0/26"),
+				GW:   ip.FromString("172.16.0.2"),
+			}})
+		})
+	})
+})
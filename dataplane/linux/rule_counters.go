@@ -0,0 +1,356 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/jitter"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/rules"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// ruleCounterLabelNames are the labels of the rule counters.  The kind is "policy" or "profile";
+// for profiles, the policy label holds the profile's name and the tier is empty.
+var ruleCounterLabelNames = []string{"kind", "policy", "tier", "direction", "rule", "rule_id"}
+
+const (
+	ruleCounterKindPolicy  = "policy"
+	ruleCounterKindProfile = "profile"
+)
+
+var (
+	countPolicyRulePackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_policy_rule_packets_total",
+		Help: "Number of packets that matched each policy or profile rule.",
+	}, ruleCounterLabelNames)
+	countPolicyRuleBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_policy_rule_bytes_total",
+		Help: "Number of bytes that matched each policy or profile rule.",
+	}, ruleCounterLabelNames)
+)
+
+func init() {
+	prometheus.MustRegister(countPolicyRulePackets)
+	prometheus.MustRegister(countPolicyRuleBytes)
+}
+
+// ruleCounterReader is implemented by iptables.Table.  The nftables backend doesn't support
+// reading rule counters.
+type ruleCounterReader interface {
+	ReadRuleCounters() (map[string]iptables.RuleCounters, error)
+}
+
+type versionedCounterReader struct {
+	ipVersion uint8
+	reader    ruleCounterReader
+}
+
+// counterOwnerKey identifies the policy or profile, and the IP version of its chains, that a set
+// of tracked rules belongs to.
+type counterOwnerKey struct {
+	ipVersion uint8
+	kind      string
+	tier      string
+	name      string
+}
+
+// ruleHashKey identifies a rule in the dataplane.  The IPv4 and IPv6 versions of a policy chain
+// often render to the same rules so we need the IP version as well as the hash.
+type ruleHashKey struct {
+	ipVersion uint8
+	hash      string
+}
+
+type ruleCounterLabels struct {
+	kind      string
+	policy    string
+	tier      string
+	direction string
+	rule      string
+	ruleID    string
+}
+
+func (l ruleCounterLabels) values() []string {
+	return []string{l.kind, l.policy, l.tier, l.direction, l.rule, l.ruleID}
+}
+
+type trackedRule struct {
+	hashKey ruleHashKey
+	labels  ruleCounterLabels
+}
+
+// ruleCounterCollector periodically reads the packet and byte counters of the rules that
+// implement our policies and profiles and exports them as Prometheus counters, labelled with the
+// policy (or profile), tier, direction and index of the policy rule.
+//
+// The policy managers register each policy's rules as they render it, from the dataplane
+// goroutine, while the counters are polled from the collector's own goroutine so all the
+// tracking state is protected by a lock.
+type ruleCounterCollector struct {
+	pollInterval time.Duration
+	// allowedNames contains the names of the policies and profiles that we track; nil means
+	// all of them.
+	allowedNames set.Set
+	// maxRules limits the number of label sets (and hence Prometheus time series) that we
+	// export.  Policies that would take us over the limit aren't tracked.
+	maxRules int
+
+	readers []versionedCounterReader
+
+	lock sync.Mutex
+	// owners maps from policy or profile and IP version to the rules that we're tracking for
+	// it.
+	owners map[counterOwnerKey][]trackedRule
+	// labelRefs counts the tracked rules with each label set; the IPv4 and IPv6 versions of
+	// a rule share their labels.
+	labelRefs map[ruleCounterLabels]int
+	// lastCounters holds the counters that we read for each rule on the previous poll.
+	lastCounters map[ruleHashKey]iptables.RuleCounters
+	// baselineCounters holds the counters of the rules that were already in the dataplane when
+	// we first polled, for example, because Felix restarted.  We only export the traffic that
+	// those rules see after that first poll.  nil until the first successful poll.
+	baselineCounters map[ruleHashKey]iptables.RuleCounters
+}
+
+func newRuleCounterCollector(pollInterval time.Duration, allowedNames []string, maxRules int) *ruleCounterCollector {
+	c := &ruleCounterCollector{
+		pollInterval: pollInterval,
+		maxRules:     maxRules,
+		owners:       map[counterOwnerKey][]trackedRule{},
+		labelRefs:    map[ruleCounterLabels]int{},
+		lastCounters: map[ruleHashKey]iptables.RuleCounters{},
+	}
+	if len(allowedNames) > 0 {
+		c.allowedNames = set.New()
+		for _, name := range allowedNames {
+			c.allowedNames.Add(name)
+		}
+	}
+	return c
+}
+
+// addReader adds a table to read counters from.  It must be called before the collector is
+// started.
+func (c *ruleCounterCollector) addReader(ipVersion uint8, reader ruleCounterReader) {
+	c.readers = append(c.readers, versionedCounterReader{ipVersion: ipVersion, reader: reader})
+}
+
+// registerPolicy starts tracking the rules of the given policy, replacing any rules that we
+// were tracking for a previous version of the policy.  chains, inbound and outbound should be
+// the chains and hit indexes returned by the rule renderer's
+// PolicyToIptablesChainsWithHitIndexes().
+func (c *ruleCounterCollector) registerPolicy(
+	ipVersion uint8,
+	id *proto.PolicyID,
+	policy *proto.Policy,
+	chains []*iptables.Chain,
+	inbound, outbound []int,
+) {
+	c.register(
+		counterOwnerKey{ipVersion: ipVersion, kind: ruleCounterKindPolicy, tier: id.Tier, name: id.Name},
+		chains,
+		rules.PolicyChainName(rules.PolicyInboundPfx, id), policy.InboundRules, inbound,
+		rules.PolicyChainName(rules.PolicyOutboundPfx, id), policy.OutboundRules, outbound,
+	)
+}
+
+// registerProfile is the profile equivalent of registerPolicy.
+func (c *ruleCounterCollector) registerProfile(
+	ipVersion uint8,
+	id *proto.ProfileID,
+	profile *proto.Profile,
+	chains []*iptables.Chain,
+	inbound, outbound []int,
+) {
+	c.register(
+		counterOwnerKey{ipVersion: ipVersion, kind: ruleCounterKindProfile, name: id.Name},
+		chains,
+		rules.ProfileChainName(rules.ProfileInboundPfx, id), profile.InboundRules, inbound,
+		rules.ProfileChainName(rules.ProfileOutboundPfx, id), profile.OutboundRules, outbound,
+	)
+}
+
+func (c *ruleCounterCollector) register(
+	key counterOwnerKey,
+	chains []*iptables.Chain,
+	inChainName string, inRules []*proto.Rule, inbound []int,
+	outChainName string, outRules []*proto.Rule, outbound []int,
+) {
+	logCxt := log.WithFields(log.Fields{"kind": key.kind, "tier": key.tier, "name": key.name})
+	if c.allowedNames != nil && !c.allowedNames.Contains(key.name) {
+		logCxt.Debug("Not in rule counters allowlist, skipping")
+		return
+	}
+
+	var tracked []trackedRule
+	trackChain := func(chainName, direction string, protoRules []*proto.Rule, hitIndexes []int) {
+		var chain *iptables.Chain
+		for _, ch := range chains {
+			if ch.Name == chainName {
+				chain = ch
+				break
+			}
+		}
+		if chain == nil {
+			logCxt.WithField("chain", chainName).Warn("Chain not rendered, can't track its counters")
+			return
+		}
+		hashes := chain.RuleHashes()
+		for i, hitIdx := range hitIndexes {
+			if hitIdx < 0 || hitIdx >= len(hashes) {
+				// Rule isn't rendered for this IP version.
+				continue
+			}
+			tracked = append(tracked, trackedRule{
+				hashKey: ruleHashKey{ipVersion: key.ipVersion, hash: hashes[hitIdx]},
+				labels: ruleCounterLabels{
+					kind:      key.kind,
+					policy:    key.name,
+					tier:      key.tier,
+					direction: direction,
+					rule:      strconv.Itoa(i),
+					ruleID:    protoRules[i].RuleId,
+				},
+			})
+		}
+	}
+	trackChain(inChainName, "inbound", inRules, inbound)
+	trackChain(outChainName, "outbound", outRules, outbound)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.removeLocked(key)
+
+	newLabels := map[ruleCounterLabels]bool{}
+	for _, r := range tracked {
+		if c.labelRefs[r.labels] == 0 {
+			newLabels[r.labels] = true
+		}
+	}
+	if len(c.labelRefs)+len(newLabels) > c.maxRules {
+		logCxt.WithField("maxRules", c.maxRules).Warn(
+			"Tracking rule counters would exceed RuleCountersMaxRules, not tracking them")
+		return
+	}
+	for _, r := range tracked {
+		c.labelRefs[r.labels]++
+	}
+	c.owners[key] = tracked
+}
+
+// removePolicy stops tracking the rules of the given policy.
+func (c *ruleCounterCollector) removePolicy(ipVersion uint8, id *proto.PolicyID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeLocked(counterOwnerKey{ipVersion: ipVersion, kind: ruleCounterKindPolicy, tier: id.Tier, name: id.Name})
+}
+
+// removeProfile stops tracking the rules of the given profile.
+func (c *ruleCounterCollector) removeProfile(ipVersion uint8, id *proto.ProfileID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeLocked(counterOwnerKey{ipVersion: ipVersion, kind: ruleCounterKindProfile, name: id.Name})
+}
+
+func (c *ruleCounterCollector) removeLocked(key counterOwnerKey) {
+	for _, r := range c.owners[key] {
+		c.labelRefs[r.labels]--
+		if c.labelRefs[r.labels] > 0 {
+			continue
+		}
+		delete(c.labelRefs, r.labels)
+		countPolicyRulePackets.DeleteLabelValues(r.labels.values()...)
+		countPolicyRuleBytes.DeleteLabelValues(r.labels.values()...)
+	}
+	delete(c.owners, key)
+}
+
+func (c *ruleCounterCollector) loopPollingCounters() {
+	log.WithField("interval", c.pollInterval).Info("Starting rule counter collector")
+	ticker := jitter.NewTicker(c.pollInterval, c.pollInterval/10)
+	for range ticker.C {
+		c.poll()
+	}
+}
+
+// poll reads the counters from all the tables and adds the traffic seen since the last poll to
+// the Prometheus counters.
+func (c *ruleCounterCollector) poll() {
+	// Reading the counters can be slow so we do it before taking the lock.  Each policy
+	// chain is rendered into the raw, mangle and filter tables so we add up the counters of
+	// the copies of each rule.
+	current := map[ruleHashKey]iptables.RuleCounters{}
+	for _, r := range c.readers {
+		counters, err := r.reader.ReadRuleCounters()
+		if err != nil {
+			log.WithError(err).Warn("Failed to read rule counters, will retry on next poll")
+			return
+		}
+		for hash, counts := range counters {
+			key := ruleHashKey{ipVersion: r.ipVersion, hash: hash}
+			sum := current[key]
+			sum.Packets += counts.Packets
+			sum.Bytes += counts.Bytes
+			current[key] = sum
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.baselineCounters == nil {
+		// First successful poll; the counters of the rules that are already programmed may
+		// include traffic from before we started so we only record them.
+		log.WithField("numRules", len(current)).Info("Took baseline of rule counters")
+		c.baselineCounters = current
+		return
+	}
+
+	lastCounters := map[ruleHashKey]iptables.RuleCounters{}
+	for _, tracked := range c.owners {
+		for _, r := range tracked {
+			counts, ok := current[r.hashKey]
+			if !ok {
+				// Rule not programmed yet (or no longer).
+				continue
+			}
+			lastCounters[r.hashKey] = counts
+			last, ok := c.lastCounters[r.hashKey]
+			if !ok {
+				// First time we've seen this rule since it was registered.  If it was
+				// programmed before we started, start from the baseline.
+				last = c.baselineCounters[r.hashKey]
+			}
+			if counts.Packets < last.Packets || counts.Bytes < last.Bytes {
+				// The counters were reset, for example because the rule was
+				// reprogrammed.  Count everything since the reset.
+				last = iptables.RuleCounters{}
+			}
+			labelValues := r.labels.values()
+			countPolicyRulePackets.WithLabelValues(labelValues...).Add(float64(counts.Packets - last.Packets))
+			countPolicyRuleBytes.WithLabelValues(labelValues...).Add(float64(counts.Bytes - last.Bytes))
+		}
+	}
+	c.lastCounters = lastCounters
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/rules"
+)
+
+var _ = Describe("Rule counter collector", func() {
+	var (
+		collector  *ruleCounterCollector
+		rawV4      *mockCounterReader
+		filterV4   *mockCounterReader
+		filterV6   *mockCounterReader
+		policyID   *proto.PolicyID
+		policy     *proto.Policy
+		chains     []*iptables.Chain
+		inHashes   []string
+		outHashes  []string
+		hitIndexes []int
+	)
+
+	register := func(ipVersion uint8) {
+		collector.registerPolicy(ipVersion, policyID, policy, chains, hitIndexes, []int{0})
+	}
+
+	setUp := func(policyName string, allowlist []string, maxRules int) {
+		collector = newRuleCounterCollector(0, allowlist, maxRules)
+		rawV4 = &mockCounterReader{}
+		filterV4 = &mockCounterReader{}
+		filterV6 = &mockCounterReader{}
+		collector.addReader(4, rawV4)
+		collector.addReader(4, filterV4)
+		collector.addReader(6, filterV6)
+		// Take the baseline while the dataplane is empty.
+		collector.poll()
+
+		policyID = &proto.PolicyID{Tier: "default", Name: policyName}
+		policy = &proto.Policy{
+			InboundRules: []*proto.Rule{
+				{Action: "allow", RuleId: "rule-id-0"},
+				{Action: "deny", RuleId: "rule-id-1"},
+			},
+			OutboundRules: []*proto.Rule{
+				{Action: "allow", RuleId: "rule-id-2"},
+			},
+		}
+		inChain := &iptables.Chain{
+			Name: rules.PolicyChainName(rules.PolicyInboundPfx, policyID),
+			Rules: []iptables.Rule{
+				{Action: iptables.SetMarkAction{Mark: 0x8}},
+				{Action: iptables.ReturnAction{}},
+				{Action: iptables.DropAction{}},
+			},
+		}
+		outChain := &iptables.Chain{
+			Name: rules.PolicyChainName(rules.PolicyOutboundPfx, policyID),
+			Rules: []iptables.Rule{
+				{Action: iptables.SetMarkAction{Mark: 0x8}},
+			},
+		}
+		chains = []*iptables.Chain{inChain, outChain}
+		inHashes = inChain.RuleHashes()
+		outHashes = outChain.RuleHashes()
+		// The allow rule renders as a set-mark and a return, the deny rule as a drop.
+		hitIndexes = []int{0, 2}
+	}
+
+	packets := func(policyName, direction, rule, ruleID string) float64 {
+		return counterValue(countPolicyRulePackets, "policy", policyName, "default", direction, rule, ruleID)
+	}
+	bytes := func(policyName, direction, rule, ruleID string) float64 {
+		return counterValue(countPolicyRuleBytes, "policy", policyName, "default", direction, rule, ruleID)
+	}
+
+	Describe("with a registered policy", func() {
+		BeforeEach(func() {
+			setUp("rc-pol1", nil, 100)
+			register(4)
+			rawV4.Counters = map[string]iptables.RuleCounters{
+				inHashes[0]: {Packets: 1, Bytes: 100},
+			}
+			filterV4.Counters = map[string]iptables.RuleCounters{
+				inHashes[0]:  {Packets: 10, Bytes: 1000},
+				inHashes[2]:  {Packets: 3, Bytes: 300},
+				outHashes[0]: {Packets: 5, Bytes: 500},
+				"unknown":    {Packets: 1000, Bytes: 1000},
+			}
+			collector.poll()
+		})
+
+		It("should sum the counters across tables", func() {
+			Expect(packets("rc-pol1", "inbound", "0", "rule-id-0")).To(Equal(11.0))
+			Expect(bytes("rc-pol1", "inbound", "0", "rule-id-0")).To(Equal(1100.0))
+			Expect(packets("rc-pol1", "inbound", "1", "rule-id-1")).To(Equal(3.0))
+			Expect(packets("rc-pol1", "outbound", "0", "rule-id-2")).To(Equal(5.0))
+		})
+
+		It("should only add the increase on the next poll", func() {
+			filterV4.Counters[inHashes[0]] = iptables.RuleCounters{Packets: 15, Bytes: 1500}
+			collector.poll()
+			Expect(packets("rc-pol1", "inbound", "0", "rule-id-0")).To(Equal(16.0))
+			Expect(bytes("rc-pol1", "inbound", "0", "rule-id-0")).To(Equal(1600.0))
+			Expect(packets("rc-pol1", "inbound", "1", "rule-id-1")).To(Equal(3.0))
+		})
+
+		It("should handle a counter reset", func() {
+			filterV4.Counters[inHashes[2]] = iptables.RuleCounters{Packets: 2, Bytes: 200}
+			collector.poll()
+			Expect(packets("rc-pol1", "inbound", "1", "rule-id-1")).To(Equal(5.0))
+		})
+
+		It("should leave the counters alone if a read fails", func() {
+			filterV4.Counters[inHashes[2]] = iptables.RuleCounters{Packets: 30, Bytes: 3000}
+			filterV6.Err = errors.New("dummy error")
+			collector.poll()
+			Expect(packets("rc-pol1", "inbound", "1", "rule-id-1")).To(Equal(3.0))
+		})
+
+		It("should aggregate the IPv6 version of the policy without double counting", func() {
+			register(6)
+			filterV6.Counters = map[string]iptables.RuleCounters{
+				inHashes[2]: {Packets: 4, Bytes: 400},
+			}
+			collector.poll()
+			Expect(packets("rc-pol1", "inbound", "1", "rule-id-1")).To(Equal(7.0))
+		})
+
+		It("should delete the metrics when the policy is removed", func() {
+			collector.removePolicy(4, policyID)
+			Expect(collector.labelRefs).To(BeEmpty())
+			Expect(packets("rc-pol1", "inbound", "0", "rule-id-0")).To(Equal(0.0))
+		})
+
+		It("should keep the metrics while the IPv6 version is still tracked", func() {
+			register(6)
+			collector.removePolicy(4, policyID)
+			Expect(collector.labelRefs).To(HaveLen(3))
+			Expect(packets("rc-pol1", "inbound", "0", "rule-id-0")).To(Equal(11.0))
+		})
+	})
+
+	It("should not count traffic from before the first poll", func() {
+		setUp("rc-pol5", nil, 100)
+		// setUp takes the baseline with an empty dataplane; start again with rules that
+		// were programmed by a previous run of Felix.
+		collector = newRuleCounterCollector(0, nil, 100)
+		collector.addReader(4, filterV4)
+		filterV4.Counters = map[string]iptables.RuleCounters{
+			inHashes[0]: {Packets: 100, Bytes: 10000},
+		}
+		collector.poll()
+		register(4)
+		collector.poll()
+		Expect(packets("rc-pol5", "inbound", "0", "rule-id-0")).To(Equal(0.0))
+
+		filterV4.Counters[inHashes[0]] = iptables.RuleCounters{Packets: 102, Bytes: 10200}
+		collector.poll()
+		Expect(packets("rc-pol5", "inbound", "0", "rule-id-0")).To(Equal(2.0))
+		Expect(bytes("rc-pol5", "inbound", "0", "rule-id-0")).To(Equal(200.0))
+	})
+
+	It("should track the rules of profiles", func() {
+		setUp("rc-pol6", nil, 100)
+		profileID := &proto.ProfileID{Name: "rc-prof1"}
+		profile := &proto.Profile{InboundRules: []*proto.Rule{{Action: "allow", RuleId: "rule-id-3"}}}
+		profChain := &iptables.Chain{
+			Name: rules.ProfileChainName(rules.ProfileInboundPfx, profileID),
+			Rules: []iptables.Rule{
+				{Action: iptables.SetMarkAction{Mark: 0x8}},
+				{Action: iptables.ReturnAction{}},
+			},
+		}
+		collector.registerProfile(4, profileID, profile, []*iptables.Chain{profChain}, []int{0}, nil)
+		filterV4.Counters = map[string]iptables.RuleCounters{
+			profChain.RuleHashes()[0]: {Packets: 7, Bytes: 700},
+		}
+		collector.poll()
+		Expect(counterValue(countPolicyRulePackets, "profile", "rc-prof1", "", "inbound", "0", "rule-id-3")).To(Equal(7.0))
+
+		collector.removeProfile(4, profileID)
+		Expect(collector.owners).To(BeEmpty())
+		Expect(collector.labelRefs).To(BeEmpty())
+	})
+
+	It("should skip policies that aren't in the allowlist", func() {
+		setUp("rc-pol2", []string{"some-other-policy"}, 100)
+		register(4)
+		Expect(collector.owners).To(BeEmpty())
+	})
+
+	It("should track policies that are in the allowlist", func() {
+		setUp("rc-pol3", []string{"rc-pol3"}, 100)
+		register(4)
+		Expect(collector.owners).To(HaveLen(1))
+	})
+
+	It("should skip policies that would exceed the rule limit", func() {
+		setUp("rc-pol4", nil, 2)
+		register(4)
+		Expect(collector.owners).To(BeEmpty())
+		Expect(collector.labelRefs).To(BeEmpty())
+	})
+})
+
+type mockCounterReader struct {
+	Counters map[string]iptables.RuleCounters
+	Err      error
+}
+
+func (r *mockCounterReader) ReadRuleCounters() (map[string]iptables.RuleCounters, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return r.Counters, nil
+}
+
+func counterValue(vec *prometheus.CounterVec, labels ...string) float64 {
+	m := &dto.Metric{}
+	Expect(vec.WithLabelValues(labels...).Write(m)).To(Succeed())
+	return m.GetCounter().GetValue()
+}
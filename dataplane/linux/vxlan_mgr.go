@@ -0,0 +1,398 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/rules"
+)
+
+// vxlanManager manages the VXLAN overlay.  It maintains the vxlan.calico device and, for each
+// remote host, a forwarding database entry (mapping the remote host's VTEP MAC to its IP)
+// and a neighbour entry (mapping the remote host's IP to its VTEP MAC).  The routes to the
+// remote hosts' IPAM blocks are programmed via the VXLAN device by a remoteRoutesManager,
+// from the RouteUpdates that the calculation graph's RouteResolver generates.  The dataplane
+// periodically calls QueueResync() to recheck the device and the FDB.
+//
+// The VTEP MAC of each host is derived from its IP so that every host can calculate the
+// MAC of its peers without any extra coordination.
+//
+// The all-hosts IP set that the VXLAN rules depend on is maintained by the IPv4 ipipManager.
+type vxlanManager struct {
+	hostname string
+
+	vni        int
+	port       int
+	mtu        int
+	tunnelAddr net.IP
+
+	// myHostIP is this host's IP, which we learn from our own HostMetadataUpdate.  It is the
+	// source address of our VXLAN packets and determines the MAC of our VXLAN device.
+	myHostIP net.IP
+	// remoteHostnameToIP maps the hostname of each remote VTEP to its IP.
+	remoteHostnameToIP map[string]net.IP
+
+	deviceNeedsSync bool
+	vtepsNeedSync   bool
+
+	// Dataplane shim.
+	dataplane vxlanDataplane
+}
+
+func newVXLANManager(
+	hostname string,
+	vni int,
+	port int,
+	mtu int,
+	tunnelAddr net.IP,
+) *vxlanManager {
+	return newVXLANManagerWithShim(hostname, vni, port, mtu, tunnelAddr, realVXLANNetlink{})
+}
+
+func newVXLANManagerWithShim(
+	hostname string,
+	vni int,
+	port int,
+	mtu int,
+	tunnelAddr net.IP,
+	dataplane vxlanDataplane,
+) *vxlanManager {
+	return &vxlanManager{
+		hostname:           hostname,
+		vni:                vni,
+		port:               port,
+		mtu:                mtu,
+		tunnelAddr:         tunnelAddr,
+		remoteHostnameToIP: map[string]net.IP{},
+		deviceNeedsSync:    true,
+		vtepsNeedSync:      true,
+		dataplane:          dataplane,
+	}
+}
+
+func (m *vxlanManager) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.HostMetadataUpdate:
+		log.WithField("hostname", msg.Hostname).Debug("VXLAN manager: host update/create")
+		hostIP := net.ParseIP(msg.Ipv4Addr).To4()
+		if msg.Hostname == m.hostname {
+			if !hostIP.Equal(m.myHostIP) {
+				m.myHostIP = hostIP
+				m.deviceNeedsSync = true
+			}
+			return
+		}
+		if hostIP == nil {
+			// Host doesn't have an IPv4 address; VXLAN is IPv4-only.
+			m.removeRemoteHost(msg.Hostname)
+			return
+		}
+		if !hostIP.Equal(m.remoteHostnameToIP[msg.Hostname]) {
+			m.remoteHostnameToIP[msg.Hostname] = hostIP
+			m.vtepsNeedSync = true
+		}
+	case *proto.HostMetadataRemove:
+		log.WithField("hostname", msg.Hostname).Debug("VXLAN manager: host removed")
+		if msg.Hostname == m.hostname {
+			m.myHostIP = nil
+			m.deviceNeedsSync = true
+			return
+		}
+		m.removeRemoteHost(msg.Hostname)
+	}
+}
+
+func (m *vxlanManager) removeRemoteHost(hostname string) {
+	if _, ok := m.remoteHostnameToIP[hostname]; ok {
+		delete(m.remoteHostnameToIP, hostname)
+		m.vtepsNeedSync = true
+	}
+}
+
+// QueueResync makes the next CompleteDeferredWork() recheck the VXLAN device and its FDB and
+// neighbour entries, in case they've been changed or removed behind our back.  The VXLAN
+// device has no background thread (unlike the IPIP device) because its configuration depends
+// on the host IPs that we learn on the dataplane goroutine.
+func (m *vxlanManager) QueueResync() {
+	log.Debug("VXLAN manager: resync queued")
+	m.deviceNeedsSync = true
+}
+
+func (m *vxlanManager) CompleteDeferredWork() error {
+	if m.myHostIP == nil {
+		// We can't configure the device until we know our own IP.  We'll try again when
+		// we get our HostMetadataUpdate.
+		log.Debug("Waiting for our host IP before configuring the VXLAN device")
+		return nil
+	}
+	if m.deviceNeedsSync {
+		if err := m.configureVXLANDevice(); err != nil {
+			return err
+		}
+		m.deviceNeedsSync = false
+		// The device may have been recreated, in which case its FDB will be empty.
+		m.vtepsNeedSync = true
+	}
+	if m.vtepsNeedSync {
+		if err := m.syncVTEPs(); err != nil {
+			return err
+		}
+		m.vtepsNeedSync = false
+	}
+	return nil
+}
+
+// configureVXLANDevice ensures that the VXLAN device exists and is configured correctly.  If
+// it exists but has the wrong VNI, port or source address, it is recreated.
+func (m *vxlanManager) configureVXLANDevice() error {
+	logCxt := log.WithFields(log.Fields{
+		"device":     rules.VXLANIfaceName,
+		"vni":        m.vni,
+		"port":       m.port,
+		"mtu":        m.mtu,
+		"hostIP":     m.myHostIP,
+		"tunnelAddr": m.tunnelAddr,
+	})
+	logCxt.Debug("Configuring VXLAN device")
+
+	parent, err := m.findParentLink()
+	if err != nil {
+		return err
+	}
+	desired := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         rules.VXLANIfaceName,
+			HardwareAddr: vtepMAC(m.myHostIP),
+		},
+		VxlanId:      m.vni,
+		VtepDevIndex: parent.Attrs().Index,
+		SrcAddr:      m.myHostIP,
+		Port:         m.port,
+	}
+
+	link, err := m.dataplane.LinkByName(rules.VXLANIfaceName)
+	if err == nil {
+		if existing, ok := link.(*netlink.Vxlan); !ok || !vxlanLinksMatch(existing, desired) {
+			logCxt.WithField("existing", link).Info("VXLAN device has wrong configuration, recreating it")
+			if err := m.dataplane.LinkDel(link); err != nil {
+				logCxt.WithError(err).Warn("Failed to delete VXLAN device")
+				return err
+			}
+			link = nil
+		}
+	} else {
+		logCxt.WithError(err).Info("Failed to get VXLAN device, assuming it isn't present")
+		link = nil
+	}
+	if link == nil {
+		if err := m.dataplane.LinkAdd(desired); err != nil {
+			logCxt.WithError(err).Warn("Failed to add VXLAN device")
+			return err
+		}
+		link, err = m.dataplane.LinkByName(rules.VXLANIfaceName)
+		if err != nil {
+			logCxt.WithError(err).Warn("Failed to get VXLAN device after creating it")
+			return err
+		}
+		logCxt.Info("Created VXLAN device")
+	}
+
+	attrs := link.Attrs()
+	if attrs.MTU != m.mtu {
+		logCxt.WithField("oldMTU", attrs.MTU).Info("VXLAN device MTU needs to be updated")
+		if err := m.dataplane.LinkSetMTU(link, m.mtu); err != nil {
+			logCxt.WithError(err).Warn("Failed to set VXLAN device MTU")
+			return err
+		}
+	}
+	if err := m.setLinkAddress(link); err != nil {
+		return err
+	}
+	if attrs.Flags&net.FlagUp == 0 {
+		logCxt.WithField("flags", attrs.Flags).Info("VXLAN device wasn't admin up, enabling it")
+		if err := m.dataplane.LinkSetUp(link); err != nil {
+			logCxt.WithError(err).Warn("Failed to set VXLAN device up")
+			return err
+		}
+	}
+	return nil
+}
+
+// findParentLink finds the interface that has our host IP; we send VXLAN packets out of that
+// interface.
+func (m *vxlanManager) findParentLink() (netlink.Link, error) {
+	links, err := m.dataplane.LinkList()
+	if err != nil {
+		log.WithError(err).Warn("Failed to list interfaces")
+		return nil, err
+	}
+	for _, link := range links {
+		addrs, err := m.dataplane.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			log.WithError(err).WithField("link", link.Attrs().Name).Warn(
+				"Failed to list interface addresses")
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(m.myHostIP) {
+				return link, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no interface has the host IP %v", m.myHostIP)
+}
+
+// setLinkAddress sets the tunnel address on the VXLAN device, removing any other IPv4
+// addresses.
+func (m *vxlanManager) setLinkAddress(link netlink.Link) error {
+	addrs, err := m.dataplane.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		log.WithError(err).Warn("Failed to list VXLAN device addresses")
+		return err
+	}
+	found := false
+	for _, oldAddr := range addrs {
+		if m.tunnelAddr != nil && oldAddr.IP.Equal(m.tunnelAddr) {
+			found = true
+			continue
+		}
+		log.WithField("oldAddr", oldAddr).Info("Removing old address from VXLAN device")
+		if err := m.dataplane.AddrDel(link, &oldAddr); err != nil {
+			log.WithError(err).Warn("Failed to delete address")
+			return err
+		}
+	}
+	if !found && m.tunnelAddr != nil {
+		addr := &netlink.Addr{
+			IPNet: &net.IPNet{
+				IP:   m.tunnelAddr,
+				Mask: net.CIDRMask(32, 32),
+			},
+		}
+		if err := m.dataplane.AddrAdd(link, addr); err != nil {
+			log.WithError(err).WithField("addr", m.tunnelAddr).Warn("Failed to add address")
+			return err
+		}
+	}
+	return nil
+}
+
+// syncVTEPs brings the FDB and neighbour entries of the VXLAN device in sync with the set of
+// remote hosts.  Entries for hosts that have gone away are removed.
+func (m *vxlanManager) syncVTEPs() error {
+	link, err := m.dataplane.LinkByName(rules.VXLANIfaceName)
+	if err != nil {
+		log.WithError(err).Warn("Failed to get VXLAN device")
+		return err
+	}
+	linkIndex := link.Attrs().Index
+
+	expectedNeighs := map[string]netlink.Neigh{}
+	expectedFDBs := map[string]netlink.Neigh{}
+	for _, hostIP := range m.remoteHostnameToIP {
+		mac := vtepMAC(hostIP)
+		expectedNeighs[hostIP.String()] = netlink.Neigh{
+			LinkIndex:    linkIndex,
+			Family:       netlink.FAMILY_V4,
+			State:        netlink.NUD_PERMANENT,
+			IP:           hostIP,
+			HardwareAddr: mac,
+		}
+		expectedFDBs[mac.String()] = netlink.Neigh{
+			LinkIndex:    linkIndex,
+			Family:       syscall.AF_BRIDGE,
+			Flags:        netlink.NTF_SELF,
+			State:        netlink.NUD_PERMANENT,
+			IP:           hostIP,
+			HardwareAddr: mac,
+		}
+	}
+
+	// Remove any stale entries.
+	neighs, err := m.dataplane.NeighList(linkIndex, netlink.FAMILY_V4)
+	if err != nil {
+		log.WithError(err).Warn("Failed to list VXLAN neighbour entries")
+		return err
+	}
+	for _, n := range neighs {
+		if exp, ok := expectedNeighs[n.IP.String()]; ok && macsEqual(exp.HardwareAddr, n.HardwareAddr) {
+			continue
+		}
+		log.WithField("neigh", n).Info("Removing stale VXLAN neighbour entry")
+		if err := m.dataplane.NeighDel(&n); err != nil {
+			log.WithError(err).Warn("Failed to remove VXLAN neighbour entry")
+			return err
+		}
+	}
+	fdbs, err := m.dataplane.NeighList(linkIndex, syscall.AF_BRIDGE)
+	if err != nil {
+		log.WithError(err).Warn("Failed to list VXLAN FDB entries")
+		return err
+	}
+	for _, n := range fdbs {
+		if exp, ok := expectedFDBs[n.HardwareAddr.String()]; ok && exp.IP.Equal(n.IP) {
+			continue
+		}
+		log.WithField("fdb", n).Info("Removing stale VXLAN FDB entry")
+		if err := m.dataplane.NeighDel(&n); err != nil {
+			log.WithError(err).Warn("Failed to remove VXLAN FDB entry")
+			return err
+		}
+	}
+
+	// Then (re)write the expected entries; NeighSet is idempotent.
+	for _, n := range expectedFDBs {
+		n := n
+		if err := m.dataplane.NeighSet(&n); err != nil {
+			log.WithError(err).WithField("fdb", n).Warn("Failed to set VXLAN FDB entry")
+			return err
+		}
+	}
+	for _, n := range expectedNeighs {
+		n := n
+		if err := m.dataplane.NeighSet(&n); err != nil {
+			log.WithError(err).WithField("neigh", n).Warn("Failed to set VXLAN neighbour entry")
+			return err
+		}
+	}
+	log.WithField("numVTEPs", len(m.remoteHostnameToIP)).Info("VXLAN VTEPs in sync")
+	return nil
+}
+
+// vtepMAC calculates the MAC of the VXLAN device on the host with the given IP.  The first
+// octet has the locally-administered bit set so it can't clash with a real NIC.
+func vtepMAC(hostIP net.IP) net.HardwareAddr {
+	ipv4 := hostIP.To4()
+	return net.HardwareAddr{0x66, 0x00, ipv4[0], ipv4[1], ipv4[2], ipv4[3]}
+}
+
+func vxlanLinksMatch(existing, desired *netlink.Vxlan) bool {
+	return existing.VxlanId == desired.VxlanId &&
+		existing.Port == desired.Port &&
+		existing.VtepDevIndex == desired.VtepDevIndex &&
+		existing.SrcAddr.Equal(desired.SrcAddr) &&
+		macsEqual(existing.HardwareAddr, desired.HardwareAddr)
+}
+
+func macsEqual(a, b net.HardwareAddr) bool {
+	return a.String() == b.String()
+}
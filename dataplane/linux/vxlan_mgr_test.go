@@ -0,0 +1,245 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("VXLAN manager", func() {
+	var (
+		mgr       *vxlanManager
+		dataplane *mockVXLANDataplane
+	)
+
+	BeforeEach(func() {
+		dataplane = newMockVXLANDataplane()
+		mgr = newVXLANManagerWithShim("host1", 4096, 4789, 1410, net.ParseIP("10.0.0.1"), dataplane)
+	})
+
+	It("should calculate VTEP MACs from the host IP", func() {
+		Expect(vtepMAC(net.ParseIP("172.16.0.2")).String()).To(Equal("66:00:ac:10:00:02"))
+	})
+
+	It("should wait for the host IP before creating the device", func() {
+		Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		Expect(dataplane.links).NotTo(HaveKey("vxlan.calico"))
+	})
+
+	Describe("after receiving the local and a remote host's metadata", func() {
+		BeforeEach(func() {
+			mgr.OnUpdate(&proto.HostMetadataUpdate{Hostname: "host1", Ipv4Addr: "172.16.0.1"})
+			mgr.OnUpdate(&proto.HostMetadataUpdate{Hostname: "host2", Ipv4Addr: "172.16.0.2"})
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		})
+
+		It("should create the VXLAN device", func() {
+			link := dataplane.links["vxlan.calico"].(*netlink.Vxlan)
+			Expect(link.VxlanId).To(Equal(4096))
+			Expect(link.Port).To(Equal(4789))
+			Expect(link.MTU).To(Equal(1410))
+			Expect(link.VtepDevIndex).To(Equal(1))
+			Expect(link.SrcAddr.Equal(net.ParseIP("172.16.0.1"))).To(BeTrue())
+			Expect(link.HardwareAddr.String()).To(Equal("66:00:ac:10:00:01"))
+			Expect(link.Flags & net.FlagUp).NotTo(BeZero())
+		})
+		It("should set the tunnel address", func() {
+			addrs := dataplane.addrs["vxlan.calico"]
+			Expect(addrs).To(HaveLen(1))
+			Expect(addrs[0].IPNet.String()).To(Equal("10.0.0.1/32"))
+		})
+		It("should program the FDB and neighbour entries for the remote host", func() {
+			Expect(dataplane.neighs).To(ConsistOf(
+				netlink.Neigh{
+					LinkIndex:    2,
+					Family:       netlink.FAMILY_V4,
+					State:        netlink.NUD_PERMANENT,
+					IP:           net.ParseIP("172.16.0.2").To4(),
+					HardwareAddr: vtepMAC(net.ParseIP("172.16.0.2")),
+				},
+				netlink.Neigh{
+					LinkIndex:    2,
+					Family:       syscall.AF_BRIDGE,
+					Flags:        netlink.NTF_SELF,
+					State:        netlink.NUD_PERMANENT,
+					IP:           net.ParseIP("172.16.0.2").To4(),
+					HardwareAddr: vtepMAC(net.ParseIP("172.16.0.2")),
+				},
+			))
+		})
+		It("should remove the entries when the remote host is removed", func() {
+			mgr.OnUpdate(&proto.HostMetadataRemove{Hostname: "host2"})
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.neighs).To(BeEmpty())
+		})
+		It("should recreate the device if the VNI is wrong", func() {
+			dataplane.links["vxlan.calico"].(*netlink.Vxlan).VxlanId = 1
+			mgr.QueueResync()
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.numLinkDels).To(Equal(1))
+			Expect(dataplane.links["vxlan.calico"].(*netlink.Vxlan).VxlanId).To(Equal(4096))
+		})
+		It("should only recheck the device after a resync is queued", func() {
+			dataplane.neighs = nil
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.neighs).To(BeEmpty())
+
+			mgr.QueueResync()
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+			Expect(dataplane.neighs).To(HaveLen(2))
+			Expect(dataplane.numLinkDels).To(BeZero())
+		})
+	})
+
+	It("should return an error and retry if the device can't be created", func() {
+		dataplane.failLinkAdd = true
+		mgr.OnUpdate(&proto.HostMetadataUpdate{Hostname: "host1", Ipv4Addr: "172.16.0.1"})
+		Expect(mgr.CompleteDeferredWork()).NotTo(Succeed())
+		dataplane.failLinkAdd = false
+		Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		Expect(dataplane.links).To(HaveKey("vxlan.calico"))
+	})
+})
+
+type mockVXLANDataplane struct {
+	links       map[string]netlink.Link
+	addrs       map[string][]netlink.Addr
+	neighs      []netlink.Neigh
+	nextIndex   int
+	numLinkDels int
+	failLinkAdd bool
+}
+
+func newMockVXLANDataplane() *mockVXLANDataplane {
+	d := &mockVXLANDataplane{
+		links:     map[string]netlink.Link{},
+		addrs:     map[string][]netlink.Addr{},
+		nextIndex: 1,
+	}
+	eth0 := &mockLink{attrs: netlink.LinkAttrs{Name: "eth0", Index: d.nextIndex}}
+	d.nextIndex++
+	d.links["eth0"] = eth0
+	_, ipNet, _ := net.ParseCIDR("172.16.0.0/24")
+	ipNet.IP = net.ParseIP("172.16.0.1").To4()
+	d.addrs["eth0"] = []netlink.Addr{{IPNet: ipNet}}
+	return d
+}
+
+func (d *mockVXLANDataplane) LinkByName(name string) (netlink.Link, error) {
+	if link, ok := d.links[name]; ok {
+		return link, nil
+	}
+	return nil, notFound
+}
+
+func (d *mockVXLANDataplane) LinkList() ([]netlink.Link, error) {
+	var links []netlink.Link
+	for _, link := range d.links {
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func (d *mockVXLANDataplane) LinkAdd(link netlink.Link) error {
+	if d.failLinkAdd {
+		return mockFailure
+	}
+	vxlan := *link.(*netlink.Vxlan)
+	vxlan.Index = d.nextIndex
+	d.nextIndex++
+	d.links[vxlan.Name] = &vxlan
+	return nil
+}
+
+func (d *mockVXLANDataplane) LinkDel(link netlink.Link) error {
+	d.numLinkDels++
+	delete(d.links, link.Attrs().Name)
+	delete(d.addrs, link.Attrs().Name)
+	d.neighs = nil
+	return nil
+}
+
+func (d *mockVXLANDataplane) LinkSetMTU(link netlink.Link, mtu int) error {
+	link.Attrs().MTU = mtu
+	return nil
+}
+
+func (d *mockVXLANDataplane) LinkSetUp(link netlink.Link) error {
+	link.Attrs().Flags |= net.FlagUp
+	return nil
+}
+
+func (d *mockVXLANDataplane) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return d.addrs[link.Attrs().Name], nil
+}
+
+func (d *mockVXLANDataplane) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	name := link.Attrs().Name
+	d.addrs[name] = append(d.addrs[name], *addr)
+	return nil
+}
+
+func (d *mockVXLANDataplane) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	name := link.Attrs().Name
+	var remaining []netlink.Addr
+	for _, a := range d.addrs[name] {
+		if !a.IP.Equal(addr.IP) {
+			remaining = append(remaining, a)
+		}
+	}
+	d.addrs[name] = remaining
+	return nil
+}
+
+func (d *mockVXLANDataplane) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	var neighs []netlink.Neigh
+	for _, n := range d.neighs {
+		if n.LinkIndex == linkIndex && n.Family == family {
+			neighs = append(neighs, n)
+		}
+	}
+	return neighs, nil
+}
+
+func (d *mockVXLANDataplane) NeighSet(neigh *netlink.Neigh) error {
+	d.removeNeigh(neigh)
+	d.neighs = append(d.neighs, *neigh)
+	return nil
+}
+
+func (d *mockVXLANDataplane) NeighDel(neigh *netlink.Neigh) error {
+	d.removeNeigh(neigh)
+	return nil
+}
+
+func (d *mockVXLANDataplane) removeNeigh(neigh *netlink.Neigh) {
+	var remaining []netlink.Neigh
+	for _, n := range d.neighs {
+		if n.LinkIndex == neigh.LinkIndex && n.Family == neigh.Family &&
+			n.IP.Equal(neigh.IP) && n.HardwareAddr.String() == neigh.HardwareAddr.String() {
+			continue
+		}
+		remaining = append(remaining, n)
+	}
+	d.neighs = remaining
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sdk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	pb "github.com/gogo/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// Conn is the driver's end of its connection to Felix.  RecvMessage returns the payload of each
+// ToDataplane message, or nil if the message is of an unknown type; SendMessage accepts the
+// payloads of FromDataplane messages.
+type Conn interface {
+	RecvMessage() (msg interface{}, err error)
+	SendMessage(msg interface{}) error
+}
+
+// PipeConn is a Conn over the pair of pipes that Felix creates when it starts the driver.
+// Each message is a protobuf envelope, preceded by its length as an 8-byte little-endian
+// integer.  SendMessage may be called from multiple goroutines.
+type PipeConn struct {
+	fromFelix io.Reader
+
+	lock          sync.Mutex
+	toFelix       io.Writer
+	nextSeqNumber uint64
+}
+
+func NewPipeConn(fromFelix io.Reader, toFelix io.Writer) *PipeConn {
+	return &PipeConn{
+		fromFelix: fromFelix,
+		toFelix:   toFelix,
+	}
+}
+
+// NewPipeConnFromFelix returns a connection over the pipes that Felix passes to the driver
+// process as file descriptors 3 (from Felix) and 4 (to Felix).
+func NewPipeConnFromFelix() *PipeConn {
+	return NewPipeConn(os.NewFile(3, "from-felix"), os.NewFile(4, "to-felix"))
+}
+
+func (c *PipeConn) RecvMessage() (msg interface{}, err error) {
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(c.fromFelix, buf)
+	if err != nil {
+		return
+	}
+	length := binary.LittleEndian.Uint64(buf)
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(c.fromFelix, data)
+	if err != nil {
+		return
+	}
+
+	envelope := proto.ToDataplane{}
+	err = pb.Unmarshal(data, &envelope)
+	if err != nil {
+		return
+	}
+	log.WithField("envelope", envelope).Debug("Received message from Felix.")
+
+	// Returns nil for unknown messages, which may come from a newer version of Felix.
+	msg = unwrapToDataplane(&envelope)
+	return
+}
+
+func (c *PipeConn) SendMessage(msg interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	envelope := &proto.FromDataplane{
+		SequenceNumber: c.nextSeqNumber,
+	}
+	c.nextSeqNumber++
+	switch msg := msg.(type) {
+	case *proto.ProcessStatusUpdate:
+		envelope.Payload = &proto.FromDataplane_ProcessStatusUpdate{msg}
+	case *proto.WorkloadEndpointStatusUpdate:
+		envelope.Payload = &proto.FromDataplane_WorkloadEndpointStatusUpdate{msg}
+	case *proto.WorkloadEndpointStatusRemove:
+		envelope.Payload = &proto.FromDataplane_WorkloadEndpointStatusRemove{msg}
+	case *proto.HostEndpointStatusUpdate:
+		envelope.Payload = &proto.FromDataplane_HostEndpointStatusUpdate{msg}
+	case *proto.HostEndpointStatusRemove:
+		envelope.Payload = &proto.FromDataplane_HostEndpointStatusRemove{msg}
+	default:
+		return fmt.Errorf("unknown message type %T", msg)
+	}
+	data, err := pb.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	lengthBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(lengthBytes, uint64(len(data)))
+	var messageBuf bytes.Buffer
+	messageBuf.Write(lengthBytes)
+	messageBuf.Write(data)
+	_, err = messageBuf.WriteTo(c.toFelix)
+	return err
+}
+
+// unwrapToDataplane returns the payload of a message from Felix, or nil if it is of an unknown
+// type.
+func unwrapToDataplane(envelope *proto.ToDataplane) interface{} {
+	switch payload := envelope.Payload.(type) {
+	case *proto.ToDataplane_InSync:
+		return payload.InSync
+	case *proto.ToDataplane_ConfigUpdate:
+		return payload.ConfigUpdate
+	case *proto.ToDataplane_IpsetUpdate:
+		return payload.IpsetUpdate
+	case *proto.ToDataplane_IpsetDeltaUpdate:
+		return payload.IpsetDeltaUpdate
+	case *proto.ToDataplane_IpsetRemove:
+		return payload.IpsetRemove
+	case *proto.ToDataplane_ActiveProfileUpdate:
+		return payload.ActiveProfileUpdate
+	case *proto.ToDataplane_ActiveProfileRemove:
+		return payload.ActiveProfileRemove
+	case *proto.ToDataplane_ActivePolicyUpdate:
+		return payload.ActivePolicyUpdate
+	case *proto.ToDataplane_ActivePolicyRemove:
+		return payload.ActivePolicyRemove
+	case *proto.ToDataplane_HostEndpointUpdate:
+		return payload.HostEndpointUpdate
+	case *proto.ToDataplane_HostEndpointRemove:
+		return payload.HostEndpointRemove
+	case *proto.ToDataplane_WorkloadEndpointUpdate:
+		return payload.WorkloadEndpointUpdate
+	case *proto.ToDataplane_WorkloadEndpointRemove:
+		return payload.WorkloadEndpointRemove
+	case *proto.ToDataplane_HostMetadataUpdate:
+		return payload.HostMetadataUpdate
+	case *proto.ToDataplane_HostMetadataRemove:
+		return payload.HostMetadataRemove
+	case *proto.ToDataplane_IpamPoolUpdate:
+		return payload.IpamPoolUpdate
+	case *proto.ToDataplane_IpamPoolRemove:
+		return payload.IpamPoolRemove
+	case *proto.ToDataplane_ServiceAccountUpdate:
+		return payload.ServiceAccountUpdate
+	case *proto.ToDataplane_ServiceAccountRemove:
+		return payload.ServiceAccountRemove
+	case *proto.ToDataplane_NamespaceUpdate:
+		return payload.NamespaceUpdate
+	case *proto.ToDataplane_NamespaceRemove:
+		return payload.NamespaceRemove
+	case *proto.ToDataplane_RouteUpdate:
+		return payload.RouteUpdate
+	case *proto.ToDataplane_RouteRemove:
+		return payload.RouteRemove
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sdk_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"encoding/binary"
+
+	pb "github.com/gogo/protobuf/proto"
+
+	"github.com/projectcalico/felix/dataplane/sdk"
+	"github.com/projectcalico/felix/proto"
+)
+
+func frame(msg pb.Message) []byte {
+	data, err := pb.Marshal(msg)
+	Expect(err).NotTo(HaveOccurred())
+	buf := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint64(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+var _ = Describe("PipeConn", func() {
+	var fromFelix, toFelix *bytes.Buffer
+	var conn *sdk.PipeConn
+
+	BeforeEach(func() {
+		fromFelix = &bytes.Buffer{}
+		toFelix = &bytes.Buffer{}
+		conn = sdk.NewPipeConn(fromFelix, toFelix)
+	})
+
+	It("should decode the messages that Felix sends", func() {
+		fromFelix.Write(frame(&proto.ToDataplane{
+			SequenceNumber: 1,
+			Payload: &proto.ToDataplane_IpsetUpdate{
+				IpsetUpdate: &proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}},
+			},
+		}))
+		fromFelix.Write(frame(&proto.ToDataplane{
+			SequenceNumber: 2,
+			Payload:        &proto.ToDataplane_InSync{InSync: &proto.InSync{}},
+		}))
+
+		msg, err := conn.RecvMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg).To(Equal(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}}))
+		msg, err = conn.RecvMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg).To(Equal(&proto.InSync{}))
+		_, err = conn.RecvMessage()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should encode messages to Felix", func() {
+		Expect(conn.SendMessage(&proto.ProcessStatusUpdate{Uptime: 1})).To(Succeed())
+		Expect(toFelix.Bytes()).To(Equal(frame(&proto.FromDataplane{
+			Payload: &proto.FromDataplane_ProcessStatusUpdate{
+				ProcessStatusUpdate: &proto.ProcessStatusUpdate{Uptime: 1},
+			},
+		})))
+	})
+
+	It("should reject messages that Felix doesn't accept", func() {
+		Expect(conn.SendMessage(&proto.InSync{})).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,206 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sdk
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+const (
+	// Endpoint statuses that Felix understands.
+	StatusUp    = "up"
+	StatusDown  = "down"
+	StatusError = "error"
+
+	defaultHeartbeatInterval  = 10 * time.Second
+	defaultApplyRetryInterval = 1 * time.Second
+	defaultMaxBatchSize       = 1000
+)
+
+type Config struct {
+	// HeartbeatInterval is how often to send a ProcessStatusUpdate to Felix.
+	HeartbeatInterval time.Duration
+	// ApplyRetryInterval is how long to wait before calling Apply again after it fails.
+	ApplyRetryInterval time.Duration
+	// MaxBatchSize limits the number of updates that are passed to the Handler between calls
+	// to Apply.
+	MaxBatchSize int
+	// StrictOrdering makes Run return an error if Felix breaks one of its ordering guarantees.
+	// Otherwise, the violation is logged and the update is passed to the Handler anyway.
+	StrictOrdering bool
+}
+
+// Driver reads updates from Felix, passes them to a Handler and calls the Handler's Apply
+// method after each batch.  Updates that Felix sends before InSync are all treated as one batch
+// so Apply isn't called until the driver has the complete starting state.
+type Driver struct {
+	config  Config
+	conn    Conn
+	handler Handler
+	model   *Model
+
+	startTime time.Time
+}
+
+func NewDriver(conn Conn, handler Handler, config Config) *Driver {
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if config.ApplyRetryInterval == 0 {
+		config.ApplyRetryInterval = defaultApplyRetryInterval
+	}
+	if config.MaxBatchSize == 0 {
+		config.MaxBatchSize = defaultMaxBatchSize
+	}
+	return &Driver{
+		config:  config,
+		conn:    conn,
+		handler: handler,
+		model:   NewModel(),
+	}
+}
+
+// Model returns the reference model of the dataplane state.  It may only be used from the
+// Handler's methods, since the Driver updates it from the same goroutine.
+func (d *Driver) Model() *Model {
+	return d.model
+}
+
+// Run processes updates from Felix until the connection fails or the context is done.
+func (d *Driver) Run(ctx context.Context) error {
+	d.startTime = time.Now()
+	msgs := make(chan interface{}, d.config.MaxBatchSize)
+	recvErrs := make(chan error, 1)
+	go d.loopReadingFromFelix(ctx, msgs, recvErrs)
+
+	heartbeats := time.NewTicker(d.config.HeartbeatInterval)
+	defer heartbeats.Stop()
+	d.sendHeartbeat()
+
+	var retryC <-chan time.Time
+	dirty := false
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-recvErrs:
+			return err
+		case msg := <-msgs:
+			if err := d.handle(msg); err != nil {
+				return err
+			}
+			dirty = true
+			// Pass on any more updates that are already waiting, so they're applied as one
+			// batch.
+		batchLoop:
+			for i := 1; i < d.config.MaxBatchSize; i++ {
+				select {
+				case msg := <-msgs:
+					if err := d.handle(msg); err != nil {
+						return err
+					}
+				default:
+					break batchLoop
+				}
+			}
+		case <-heartbeats.C:
+			d.sendHeartbeat()
+		case <-retryC:
+			retryC = nil
+		}
+
+		if dirty && retryC == nil && d.model.InSync() {
+			if err := d.handler.Apply(); err != nil {
+				log.WithError(err).Warn("Failed to apply dataplane updates, will retry")
+				retryC = time.After(d.config.ApplyRetryInterval)
+			} else {
+				dirty = false
+			}
+		}
+	}
+}
+
+func (d *Driver) loopReadingFromFelix(ctx context.Context, msgs chan<- interface{}, errs chan<- error) {
+	for {
+		msg, err := d.conn.RecvMessage()
+		if err != nil {
+			errs <- err
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		select {
+		case msgs <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *Driver) handle(msg interface{}) error {
+	if err := d.model.OnUpdate(msg); err != nil {
+		if d.config.StrictOrdering {
+			return err
+		}
+		log.WithError(err).Error("Update from Felix broke ordering guarantee")
+	}
+	Dispatch(d.handler, msg)
+	return nil
+}
+
+func (d *Driver) sendHeartbeat() {
+	err := d.conn.SendMessage(&proto.ProcessStatusUpdate{
+		IsoTimestamp: time.Now().UTC().Format(time.RFC3339),
+		Uptime:       time.Since(d.startTime).Seconds(),
+	})
+	if err != nil {
+		log.WithError(err).Warn("Failed to send heartbeat to Felix")
+	}
+}
+
+// ReportWorkloadEndpointStatus reports the status of a workload endpoint, typically StatusUp,
+// StatusDown or StatusError.  It may be called from any goroutine.
+func (d *Driver) ReportWorkloadEndpointStatus(id proto.WorkloadEndpointID, status string) error {
+	return d.conn.SendMessage(&proto.WorkloadEndpointStatusUpdate{
+		Id:     &id,
+		Status: &proto.EndpointStatus{Status: status},
+	})
+}
+
+// RemoveWorkloadEndpointStatus tells Felix that the workload endpoint has been removed from
+// the dataplane.
+func (d *Driver) RemoveWorkloadEndpointStatus(id proto.WorkloadEndpointID) error {
+	return d.conn.SendMessage(&proto.WorkloadEndpointStatusRemove{Id: &id})
+}
+
+// ReportHostEndpointStatus reports the status of a host endpoint.
+func (d *Driver) ReportHostEndpointStatus(id proto.HostEndpointID, status string) error {
+	return d.conn.SendMessage(&proto.HostEndpointStatusUpdate{
+		Id:     &id,
+		Status: &proto.EndpointStatus{Status: status},
+	})
+}
+
+// RemoveHostEndpointStatus tells Felix that the host endpoint has been removed from the
+// dataplane.
+func (d *Driver) RemoveHostEndpointStatus(id proto.HostEndpointID) error {
+	return d.conn.SendMessage(&proto.HostEndpointStatusRemove{Id: &id})
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sdk_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/projectcalico/felix/dataplane/mock"
+	"github.com/projectcalico/felix/dataplane/sdk"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// fakeConn is a Conn that's fed by the test.
+type fakeConn struct {
+	toDriver   chan interface{}
+	fromDriver chan interface{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		toDriver:   make(chan interface{}, 100),
+		fromDriver: make(chan interface{}, 100),
+	}
+}
+
+func (c *fakeConn) RecvMessage() (interface{}, error) {
+	msg, ok := <-c.toDriver
+	if !ok {
+		return nil, io.EOF
+	}
+	return msg, nil
+}
+
+func (c *fakeConn) SendMessage(msg interface{}) error {
+	c.fromDriver <- msg
+	return nil
+}
+
+// mockHandler passes each update on to a MockDataplane, which checks that the updates arrive in
+// the order that Felix guarantees.  It counts the calls to Apply.
+type mockHandler struct {
+	dp *mock.MockDataplane
+
+	lock       sync.Mutex
+	applyCount int
+	applyErrs  []error
+}
+
+func (h *mockHandler) OnConfigUpdate(u *proto.ConfigUpdate)               { h.dp.OnEvent(u) }
+func (h *mockHandler) OnInSync()                                          { h.dp.OnEvent(&proto.InSync{}) }
+func (h *mockHandler) OnIPSetUpdate(u *proto.IPSetUpdate)                 { h.dp.OnEvent(u) }
+func (h *mockHandler) OnIPSetDeltaUpdate(u *proto.IPSetDeltaUpdate)       { h.dp.OnEvent(u) }
+func (h *mockHandler) OnIPSetRemove(u *proto.IPSetRemove)                 { h.dp.OnEvent(u) }
+func (h *mockHandler) OnActiveProfileUpdate(u *proto.ActiveProfileUpdate) { h.dp.OnEvent(u) }
+func (h *mockHandler) OnActiveProfileRemove(u *proto.ActiveProfileRemove) { h.dp.OnEvent(u) }
+func (h *mockHandler) OnActivePolicyUpdate(u *proto.ActivePolicyUpdate)   { h.dp.OnEvent(u) }
+func (h *mockHandler) OnActivePolicyRemove(u *proto.ActivePolicyRemove)   { h.dp.OnEvent(u) }
+func (h *mockHandler) OnHostEndpointUpdate(u *proto.HostEndpointUpdate)   { h.dp.OnEvent(u) }
+func (h *mockHandler) OnHostEndpointRemove(u *proto.HostEndpointRemove)   { h.dp.OnEvent(u) }
+func (h *mockHandler) OnWorkloadEndpointUpdate(u *proto.WorkloadEndpointUpdate) {
+	h.dp.OnEvent(u)
+}
+func (h *mockHandler) OnWorkloadEndpointRemove(u *proto.WorkloadEndpointRemove) {
+	h.dp.OnEvent(u)
+}
+func (h *mockHandler) OnHostMetadataUpdate(u *proto.HostMetadataUpdate)     { h.dp.OnEvent(u) }
+func (h *mockHandler) OnHostMetadataRemove(u *proto.HostMetadataRemove)     { h.dp.OnEvent(u) }
+func (h *mockHandler) OnIPAMPoolUpdate(u *proto.IPAMPoolUpdate)             { h.dp.OnEvent(u) }
+func (h *mockHandler) OnIPAMPoolRemove(u *proto.IPAMPoolRemove)             { h.dp.OnEvent(u) }
+func (h *mockHandler) OnServiceAccountUpdate(u *proto.ServiceAccountUpdate) { h.dp.OnEvent(u) }
+func (h *mockHandler) OnServiceAccountRemove(u *proto.ServiceAccountRemove) { h.dp.OnEvent(u) }
+func (h *mockHandler) OnNamespaceUpdate(u *proto.NamespaceUpdate)           { h.dp.OnEvent(u) }
+func (h *mockHandler) OnNamespaceRemove(u *proto.NamespaceRemove)           { h.dp.OnEvent(u) }
+func (h *mockHandler) OnRouteUpdate(u *proto.RouteUpdate)                   { h.dp.OnEvent(u) }
+func (h *mockHandler) OnRouteRemove(u *proto.RouteRemove)                   { h.dp.OnEvent(u) }
+
+func (h *mockHandler) Apply() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.applyCount++
+	if len(h.applyErrs) > 0 {
+		err := h.applyErrs[0]
+		h.applyErrs = h.applyErrs[1:]
+		return err
+	}
+	return nil
+}
+
+func (h *mockHandler) ApplyCount() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.applyCount
+}
+
+var _ = Describe("Driver", func() {
+	var (
+		conn    *fakeConn
+		handler *mockHandler
+		driver  *sdk.Driver
+		config  sdk.Config
+		cancel  context.CancelFunc
+		runErr  chan error
+	)
+
+	polID := proto.PolicyID{Tier: "default", Name: "pol1"}
+	profID := proto.ProfileID{Name: "prof1"}
+	epID := proto.WorkloadEndpointID{OrchestratorId: "k8s", WorkloadId: "ns1/pod1", EndpointId: "eth0"}
+	ipSetUpd := &proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}}
+	polUpd := &proto.ActivePolicyUpdate{
+		Id: &polID,
+		Policy: &proto.Policy{InboundRules: []*proto.Rule{
+			{Action: "allow", SrcIpSetIds: []string{"s1"}},
+		}},
+	}
+	profUpd := &proto.ActiveProfileUpdate{Id: &profID, Profile: &proto.Profile{}}
+	epUpd := &proto.WorkloadEndpointUpdate{
+		Id: &epID,
+		Endpoint: &proto.WorkloadEndpoint{
+			Tiers:      []*proto.TierInfo{{Name: "default", IngressPolicies: []string{"pol1"}}},
+			ProfileIds: []string{"prof1"},
+		},
+	}
+
+	BeforeEach(func() {
+		conn = newFakeConn()
+		handler = &mockHandler{dp: mock.NewMockDataplane()}
+		config = sdk.Config{ApplyRetryInterval: 10 * time.Millisecond}
+	})
+
+	JustBeforeEach(func() {
+		driver = sdk.NewDriver(conn, handler, config)
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		runErr = make(chan error, 1)
+		go func() {
+			runErr <- driver.Run(ctx)
+		}()
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("should send a heartbeat when it starts", func() {
+		var msg interface{}
+		Eventually(conn.fromDriver).Should(Receive(&msg))
+		Expect(msg).To(BeAssignableToTypeOf(&proto.ProcessStatusUpdate{}))
+	})
+
+	It("should report endpoint status", func() {
+		Eventually(conn.fromDriver).Should(Receive())
+		Expect(driver.ReportWorkloadEndpointStatus(epID, sdk.StatusUp)).To(Succeed())
+		Eventually(conn.fromDriver).Should(Receive(Equal(&proto.WorkloadEndpointStatusUpdate{
+			Id:     &epID,
+			Status: &proto.EndpointStatus{Status: "up"},
+		})))
+		Expect(driver.RemoveWorkloadEndpointStatus(epID)).To(Succeed())
+		Eventually(conn.fromDriver).Should(Receive(Equal(&proto.WorkloadEndpointStatusRemove{Id: &epID})))
+	})
+
+	It("should not apply before InSync", func() {
+		conn.toDriver <- ipSetUpd
+		conn.toDriver <- polUpd
+		conn.toDriver <- profUpd
+		conn.toDriver <- epUpd
+		Eventually(handler.dp.EndpointToProfiles).Should(HaveLen(1))
+		Consistently(handler.ApplyCount, "50ms").Should(Equal(0))
+	})
+
+	Describe("after sending a snapshot and InSync", func() {
+		JustBeforeEach(func() {
+			conn.toDriver <- ipSetUpd
+			conn.toDriver <- polUpd
+			conn.toDriver <- profUpd
+			conn.toDriver <- epUpd
+			conn.toDriver <- &proto.InSync{}
+			Eventually(handler.ApplyCount).Should(BeNumerically(">=", 1))
+		})
+
+		It("should pass the snapshot to the handler", func() {
+			Expect(handler.dp.InSync()).To(BeTrue())
+			Expect(handler.dp.IPSets()).To(Equal(map[string]set.Set{"s1": set.From("10.0.0.1")}))
+			Expect(handler.dp.ActivePolicies()).To(Equal(set.From(polID)))
+			Expect(handler.dp.ActiveProfiles()).To(Equal(set.From(profID)))
+			Expect(handler.dp.EndpointToPolicyOrder()).To(Equal(map[string][]mock.TierInfo{
+				"k8s/ns1/pod1/eth0": {{Name: "default", IngressPolicyNames: []string{"pol1"}}},
+			}))
+		})
+
+		It("should apply each later update and keep the model in step", func() {
+			applies := handler.ApplyCount()
+			conn.toDriver <- &proto.IPSetDeltaUpdate{Id: "s1", AddedMembers: []string{"10.0.0.2"}}
+			Eventually(handler.ApplyCount).Should(BeNumerically(">", applies))
+			Expect(handler.dp.IPSets()).To(Equal(map[string]set.Set{"s1": set.From("10.0.0.1", "10.0.0.2")}))
+
+			conn.toDriver <- &proto.WorkloadEndpointRemove{Id: &epID}
+			conn.toDriver <- &proto.ActivePolicyRemove{Id: &polID}
+			conn.toDriver <- &proto.ActiveProfileRemove{Id: &profID}
+			conn.toDriver <- &proto.IPSetRemove{Id: "s1"}
+			Eventually(handler.dp.IPSets).Should(BeEmpty())
+			Expect(handler.dp.ActivePolicies()).To(Equal(set.New()))
+
+			cancel()
+			Eventually(runErr).Should(Receive())
+			model := driver.Model()
+			Expect(model.InSync()).To(BeTrue())
+			Expect(model.IPSetIDs()).To(BeEmpty())
+			Expect(model.Policies()).To(BeEmpty())
+			Expect(model.WorkloadEndpoints()).To(BeEmpty())
+		})
+
+		It("should return when the connection fails", func() {
+			close(conn.toDriver)
+			Eventually(runErr).Should(Receive(Equal(io.EOF)))
+		})
+	})
+
+	Describe("with a failing Apply", func() {
+		BeforeEach(func() {
+			handler.applyErrs = []error{errors.New("failed"), errors.New("failed")}
+		})
+
+		It("should retry until Apply succeeds", func() {
+			conn.toDriver <- &proto.InSync{}
+			Eventually(handler.ApplyCount).Should(Equal(3))
+			Consistently(handler.ApplyCount, "50ms").Should(Equal(3))
+		})
+	})
+
+	Describe("with strict ordering", func() {
+		BeforeEach(func() {
+			config.StrictOrdering = true
+		})
+
+		It("should fail if an endpoint refers to a policy that hasn't been sent", func() {
+			conn.toDriver <- epUpd
+			var err error
+			Eventually(runErr).Should(Receive(&err))
+			Expect(err).To(MatchError(ContainSubstring("refers to policy")))
+		})
+	})
+})
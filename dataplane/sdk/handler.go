@@ -0,0 +1,156 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sdk helps to write external dataplane drivers; that is, the programs that Felix runs
+// (with UseInternalDataplaneDriver=false) and sends its calculated dataplane state to.
+//
+// A driver implements Handler, then creates a Driver with a connection to Felix and calls Run.
+// The Driver takes care of the framing of messages on the pipes, dispatches each update to the
+// typed Handler methods, keeps a reference Model of the dataplane state, batches updates, sends
+// heartbeats and provides methods for reporting endpoint status back to Felix.
+//
+// Felix guarantees the ordering of the updates that it sends, and the Model checks it: IP sets
+// are sent before the policies that reference them, and policies and profiles are sent before
+// the endpoints that reference them; they're only removed once nothing refers to them.
+package sdk
+
+import (
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// Handler is implemented by a dataplane driver to receive updates from Felix.  The Driver calls
+// its methods from a single goroutine.  The On... methods should only record the update; the
+// driver should program the dataplane in Apply, which the Driver calls once it has passed on a
+// batch of updates.  Drivers that aren't interested in some updates can embed NoOpHandler.
+type Handler interface {
+	OnConfigUpdate(*proto.ConfigUpdate)
+	OnInSync()
+
+	OnIPSetUpdate(*proto.IPSetUpdate)
+	OnIPSetDeltaUpdate(*proto.IPSetDeltaUpdate)
+	OnIPSetRemove(*proto.IPSetRemove)
+
+	OnActiveProfileUpdate(*proto.ActiveProfileUpdate)
+	OnActiveProfileRemove(*proto.ActiveProfileRemove)
+	OnActivePolicyUpdate(*proto.ActivePolicyUpdate)
+	OnActivePolicyRemove(*proto.ActivePolicyRemove)
+
+	OnHostEndpointUpdate(*proto.HostEndpointUpdate)
+	OnHostEndpointRemove(*proto.HostEndpointRemove)
+	OnWorkloadEndpointUpdate(*proto.WorkloadEndpointUpdate)
+	OnWorkloadEndpointRemove(*proto.WorkloadEndpointRemove)
+
+	OnHostMetadataUpdate(*proto.HostMetadataUpdate)
+	OnHostMetadataRemove(*proto.HostMetadataRemove)
+	OnIPAMPoolUpdate(*proto.IPAMPoolUpdate)
+	OnIPAMPoolRemove(*proto.IPAMPoolRemove)
+	OnServiceAccountUpdate(*proto.ServiceAccountUpdate)
+	OnServiceAccountRemove(*proto.ServiceAccountRemove)
+	OnNamespaceUpdate(*proto.NamespaceUpdate)
+	OnNamespaceRemove(*proto.NamespaceRemove)
+	OnRouteUpdate(*proto.RouteUpdate)
+	OnRouteRemove(*proto.RouteRemove)
+
+	// Apply programs the dataplane with the updates received since the last successful
+	// Apply.  If it returns an error, the Driver calls it again after a delay.
+	Apply() error
+}
+
+// NoOpHandler implements all the On... methods of Handler by ignoring the update.
+type NoOpHandler struct{}
+
+func (NoOpHandler) OnConfigUpdate(*proto.ConfigUpdate)                     {}
+func (NoOpHandler) OnInSync()                                              {}
+func (NoOpHandler) OnIPSetUpdate(*proto.IPSetUpdate)                       {}
+func (NoOpHandler) OnIPSetDeltaUpdate(*proto.IPSetDeltaUpdate)             {}
+func (NoOpHandler) OnIPSetRemove(*proto.IPSetRemove)                       {}
+func (NoOpHandler) OnActiveProfileUpdate(*proto.ActiveProfileUpdate)       {}
+func (NoOpHandler) OnActiveProfileRemove(*proto.ActiveProfileRemove)       {}
+func (NoOpHandler) OnActivePolicyUpdate(*proto.ActivePolicyUpdate)         {}
+func (NoOpHandler) OnActivePolicyRemove(*proto.ActivePolicyRemove)         {}
+func (NoOpHandler) OnHostEndpointUpdate(*proto.HostEndpointUpdate)         {}
+func (NoOpHandler) OnHostEndpointRemove(*proto.HostEndpointRemove)         {}
+func (NoOpHandler) OnWorkloadEndpointUpdate(*proto.WorkloadEndpointUpdate) {}
+func (NoOpHandler) OnWorkloadEndpointRemove(*proto.WorkloadEndpointRemove) {}
+func (NoOpHandler) OnHostMetadataUpdate(*proto.HostMetadataUpdate)         {}
+func (NoOpHandler) OnHostMetadataRemove(*proto.HostMetadataRemove)         {}
+func (NoOpHandler) OnIPAMPoolUpdate(*proto.IPAMPoolUpdate)                 {}
+func (NoOpHandler) OnIPAMPoolRemove(*proto.IPAMPoolRemove)                 {}
+func (NoOpHandler) OnServiceAccountUpdate(*proto.ServiceAccountUpdate)     {}
+func (NoOpHandler) OnServiceAccountRemove(*proto.ServiceAccountRemove)     {}
+func (NoOpHandler) OnNamespaceUpdate(*proto.NamespaceUpdate)               {}
+func (NoOpHandler) OnNamespaceRemove(*proto.NamespaceRemove)               {}
+func (NoOpHandler) OnRouteUpdate(*proto.RouteUpdate)                       {}
+func (NoOpHandler) OnRouteRemove(*proto.RouteRemove)                       {}
+
+// Dispatch calls the Handler method that corresponds to the type of msg.  It returns false if
+// msg is of an unknown type.
+func Dispatch(h Handler, msg interface{}) bool {
+	switch msg := msg.(type) {
+	case *proto.ConfigUpdate:
+		h.OnConfigUpdate(msg)
+	case *proto.InSync:
+		h.OnInSync()
+	case *proto.IPSetUpdate:
+		h.OnIPSetUpdate(msg)
+	case *proto.IPSetDeltaUpdate:
+		h.OnIPSetDeltaUpdate(msg)
+	case *proto.IPSetRemove:
+		h.OnIPSetRemove(msg)
+	case *proto.ActiveProfileUpdate:
+		h.OnActiveProfileUpdate(msg)
+	case *proto.ActiveProfileRemove:
+		h.OnActiveProfileRemove(msg)
+	case *proto.ActivePolicyUpdate:
+		h.OnActivePolicyUpdate(msg)
+	case *proto.ActivePolicyRemove:
+		h.OnActivePolicyRemove(msg)
+	case *proto.HostEndpointUpdate:
+		h.OnHostEndpointUpdate(msg)
+	case *proto.HostEndpointRemove:
+		h.OnHostEndpointRemove(msg)
+	case *proto.WorkloadEndpointUpdate:
+		h.OnWorkloadEndpointUpdate(msg)
+	case *proto.WorkloadEndpointRemove:
+		h.OnWorkloadEndpointRemove(msg)
+	case *proto.HostMetadataUpdate:
+		h.OnHostMetadataUpdate(msg)
+	case *proto.HostMetadataRemove:
+		h.OnHostMetadataRemove(msg)
+	case *proto.IPAMPoolUpdate:
+		h.OnIPAMPoolUpdate(msg)
+	case *proto.IPAMPoolRemove:
+		h.OnIPAMPoolRemove(msg)
+	case *proto.ServiceAccountUpdate:
+		h.OnServiceAccountUpdate(msg)
+	case *proto.ServiceAccountRemove:
+		h.OnServiceAccountRemove(msg)
+	case *proto.NamespaceUpdate:
+		h.OnNamespaceUpdate(msg)
+	case *proto.NamespaceRemove:
+		h.OnNamespaceRemove(msg)
+	case *proto.RouteUpdate:
+		h.OnRouteUpdate(msg)
+	case *proto.RouteRemove:
+		h.OnRouteRemove(msg)
+	default:
+		log.WithField("type", reflect.TypeOf(msg)).Warn("Ignoring unknown message from Felix")
+		return false
+	}
+	return true
+}
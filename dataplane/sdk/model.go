@@ -0,0 +1,341 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sdk
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// Model is an in-memory reference model of the dataplane state that Felix has sent.  It checks
+// that the updates arrive in the order that Felix guarantees and returns an error from OnUpdate
+// if they don't.  Model is not safe for concurrent use; the Driver only updates it from the
+// goroutine that calls the Handler.
+type Model struct {
+	inSync          bool
+	config          map[string]string
+	ipSetTypes      map[string]proto.IPSetUpdate_IPSetType
+	ipSetMembers    map[string]set.Set
+	profiles        map[proto.ProfileID]*proto.Profile
+	policies        map[proto.PolicyID]*proto.Policy
+	hostEndpoints   map[proto.HostEndpointID]*proto.HostEndpoint
+	workloadEPs     map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint
+	hostMetadata    map[string]*proto.HostMetadataUpdate
+	ipamPools       map[string]*proto.IPAMPool
+	serviceAccounts map[proto.ServiceAccountID]*proto.ServiceAccountUpdate
+	namespaces      map[proto.NamespaceID]*proto.NamespaceUpdate
+	routes          map[string]*proto.RouteUpdate
+}
+
+func NewModel() *Model {
+	return &Model{
+		ipSetTypes:      map[string]proto.IPSetUpdate_IPSetType{},
+		ipSetMembers:    map[string]set.Set{},
+		profiles:        map[proto.ProfileID]*proto.Profile{},
+		policies:        map[proto.PolicyID]*proto.Policy{},
+		hostEndpoints:   map[proto.HostEndpointID]*proto.HostEndpoint{},
+		workloadEPs:     map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint{},
+		hostMetadata:    map[string]*proto.HostMetadataUpdate{},
+		ipamPools:       map[string]*proto.IPAMPool{},
+		serviceAccounts: map[proto.ServiceAccountID]*proto.ServiceAccountUpdate{},
+		namespaces:      map[proto.NamespaceID]*proto.NamespaceUpdate{},
+		routes:          map[string]*proto.RouteUpdate{},
+	}
+}
+
+// OnUpdate applies an update to the model.  It returns an error if the update breaks one of
+// Felix's ordering guarantees; the model is still updated in that case.
+func (m *Model) OnUpdate(msg interface{}) error {
+	switch msg := msg.(type) {
+	case *proto.ConfigUpdate:
+		m.config = msg.Config
+	case *proto.InSync:
+		m.inSync = true
+	case *proto.IPSetUpdate:
+		members := set.New()
+		for _, member := range msg.Members {
+			members.Add(member)
+		}
+		m.ipSetTypes[msg.Id] = msg.Type
+		m.ipSetMembers[msg.Id] = members
+	case *proto.IPSetDeltaUpdate:
+		members, ok := m.ipSetMembers[msg.Id]
+		if !ok {
+			return fmt.Errorf("IP set delta update for unknown IP set %q", msg.Id)
+		}
+		for _, member := range msg.RemovedMembers {
+			members.Discard(member)
+		}
+		for _, member := range msg.AddedMembers {
+			members.Add(member)
+		}
+	case *proto.IPSetRemove:
+		if _, ok := m.ipSetMembers[msg.Id]; !ok {
+			return fmt.Errorf("remove for unknown IP set %q", msg.Id)
+		}
+		delete(m.ipSetMembers, msg.Id)
+		delete(m.ipSetTypes, msg.Id)
+		if polID, ok := m.policyUsingIPSet(msg.Id); ok {
+			return fmt.Errorf("IP set %q removed while still in use by policy %v", msg.Id, polID)
+		}
+	case *proto.ActiveProfileUpdate:
+		m.profiles[*msg.Id] = msg.Profile
+		return m.checkIPSetsPresent(fmt.Sprintf("profile %v", *msg.Id), msg.Profile.InboundRules, msg.Profile.OutboundRules)
+	case *proto.ActiveProfileRemove:
+		delete(m.profiles, *msg.Id)
+		for epID, ep := range m.workloadEPs {
+			if stringInSlice(msg.Id.Name, ep.ProfileIds) {
+				return fmt.Errorf("profile %v removed while still in use by endpoint %v", *msg.Id, epID)
+			}
+		}
+		for epID, ep := range m.hostEndpoints {
+			if stringInSlice(msg.Id.Name, ep.ProfileIds) {
+				return fmt.Errorf("profile %v removed while still in use by endpoint %v", *msg.Id, epID)
+			}
+		}
+	case *proto.ActivePolicyUpdate:
+		m.policies[*msg.Id] = msg.Policy
+		return m.checkIPSetsPresent(fmt.Sprintf("policy %v", *msg.Id), msg.Policy.InboundRules, msg.Policy.OutboundRules)
+	case *proto.ActivePolicyRemove:
+		delete(m.policies, *msg.Id)
+		for epID, ep := range m.workloadEPs {
+			if tiersReferencePolicy(ep.Tiers, *msg.Id) {
+				return fmt.Errorf("policy %v removed while still in use by endpoint %v", *msg.Id, epID)
+			}
+		}
+		for epID, ep := range m.hostEndpoints {
+			if tiersReferencePolicy(ep.Tiers, *msg.Id) ||
+				tiersReferencePolicy(ep.UntrackedTiers, *msg.Id) ||
+				tiersReferencePolicy(ep.PreDnatTiers, *msg.Id) {
+				return fmt.Errorf("policy %v removed while still in use by endpoint %v", *msg.Id, epID)
+			}
+		}
+	case *proto.HostEndpointUpdate:
+		m.hostEndpoints[*msg.Id] = msg.Endpoint
+		desc := fmt.Sprintf("host endpoint %v", *msg.Id)
+		for _, tiers := range [][]*proto.TierInfo{msg.Endpoint.Tiers, msg.Endpoint.UntrackedTiers, msg.Endpoint.PreDnatTiers} {
+			if err := m.checkPoliciesPresent(desc, tiers); err != nil {
+				return err
+			}
+		}
+		return m.checkProfilesPresent(desc, msg.Endpoint.ProfileIds)
+	case *proto.HostEndpointRemove:
+		delete(m.hostEndpoints, *msg.Id)
+	case *proto.WorkloadEndpointUpdate:
+		m.workloadEPs[*msg.Id] = msg.Endpoint
+		desc := fmt.Sprintf("workload endpoint %v", *msg.Id)
+		if err := m.checkPoliciesPresent(desc, msg.Endpoint.Tiers); err != nil {
+			return err
+		}
+		return m.checkProfilesPresent(desc, msg.Endpoint.ProfileIds)
+	case *proto.WorkloadEndpointRemove:
+		delete(m.workloadEPs, *msg.Id)
+	case *proto.HostMetadataUpdate:
+		m.hostMetadata[msg.Hostname] = msg
+	case *proto.HostMetadataRemove:
+		delete(m.hostMetadata, msg.Hostname)
+	case *proto.IPAMPoolUpdate:
+		m.ipamPools[msg.Id] = msg.Pool
+	case *proto.IPAMPoolRemove:
+		delete(m.ipamPools, msg.Id)
+	case *proto.ServiceAccountUpdate:
+		m.serviceAccounts[*msg.Id] = msg
+	case *proto.ServiceAccountRemove:
+		delete(m.serviceAccounts, *msg.Id)
+	case *proto.NamespaceUpdate:
+		m.namespaces[*msg.Id] = msg
+	case *proto.NamespaceRemove:
+		delete(m.namespaces, *msg.Id)
+	case *proto.RouteUpdate:
+		m.routes[msg.Dst] = msg
+	case *proto.RouteRemove:
+		delete(m.routes, msg.Dst)
+	default:
+		return fmt.Errorf("unknown message type %T", msg)
+	}
+	return nil
+}
+
+func (m *Model) checkIPSetsPresent(desc string, ruleLists ...[]*proto.Rule) error {
+	for _, rules := range ruleLists {
+		for _, rule := range rules {
+			for _, id := range ruleIPSetIDs(rule) {
+				if _, ok := m.ipSetMembers[id]; !ok {
+					return fmt.Errorf("%s refers to IP set %q before it was sent", desc, id)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Model) checkPoliciesPresent(desc string, tiers []*proto.TierInfo) error {
+	for _, tier := range tiers {
+		for _, names := range [][]string{tier.IngressPolicies, tier.EgressPolicies} {
+			for _, name := range names {
+				polID := proto.PolicyID{Tier: tier.Name, Name: name}
+				if _, ok := m.policies[polID]; !ok {
+					return fmt.Errorf("%s refers to policy %v before it was sent", desc, polID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Model) checkProfilesPresent(desc string, profileIDs []string) error {
+	for _, name := range profileIDs {
+		if _, ok := m.profiles[proto.ProfileID{Name: name}]; !ok {
+			return fmt.Errorf("%s refers to profile %q before it was sent", desc, name)
+		}
+	}
+	return nil
+}
+
+func (m *Model) policyUsingIPSet(ipSetID string) (proto.PolicyID, bool) {
+	for polID, pol := range m.policies {
+		for _, rules := range [][]*proto.Rule{pol.InboundRules, pol.OutboundRules} {
+			for _, rule := range rules {
+				if stringInSlice(ipSetID, ruleIPSetIDs(rule)) {
+					return polID, true
+				}
+			}
+		}
+	}
+	return proto.PolicyID{}, false
+}
+
+func ruleIPSetIDs(rule *proto.Rule) []string {
+	var ids []string
+	for _, l := range [][]string{
+		rule.SrcIpSetIds, rule.DstIpSetIds, rule.NotSrcIpSetIds, rule.NotDstIpSetIds,
+		rule.SrcNamedPortIpSetIds, rule.DstNamedPortIpSetIds,
+		rule.NotSrcNamedPortIpSetIds, rule.NotDstNamedPortIpSetIds,
+	} {
+		ids = append(ids, l...)
+	}
+	return ids
+}
+
+func tiersReferencePolicy(tiers []*proto.TierInfo, polID proto.PolicyID) bool {
+	for _, tier := range tiers {
+		if tier.Name != polID.Tier {
+			continue
+		}
+		if stringInSlice(polID.Name, tier.IngressPolicies) || stringInSlice(polID.Name, tier.EgressPolicies) {
+			return true
+		}
+	}
+	return false
+}
+
+func stringInSlice(s string, slice []string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// InSync returns true once Felix has sent InSync.
+func (m *Model) InSync() bool {
+	return m.inSync
+}
+
+// Config returns the latest config that Felix sent, or nil if it hasn't sent any.
+func (m *Model) Config() map[string]string {
+	return m.config
+}
+
+// IPSetIDs returns the IDs of all the IP sets, sorted.
+func (m *Model) IPSetIDs() []string {
+	var ids []string
+	for id := range m.ipSetMembers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// IPSetMembers returns the sorted members of the IP set and whether the IP set exists.
+func (m *Model) IPSetMembers(id string) ([]string, bool) {
+	members, ok := m.ipSetMembers[id]
+	if !ok {
+		return nil, false
+	}
+	var sorted []string
+	members.Iter(func(item interface{}) error {
+		sorted = append(sorted, item.(string))
+		return nil
+	})
+	sort.Strings(sorted)
+	return sorted, true
+}
+
+// IPSetType returns the type of the IP set.
+func (m *Model) IPSetType(id string) proto.IPSetUpdate_IPSetType {
+	return m.ipSetTypes[id]
+}
+
+// Policies returns the active policies, indexed by ID.  The returned map must not be modified.
+func (m *Model) Policies() map[proto.PolicyID]*proto.Policy {
+	return m.policies
+}
+
+// Profiles returns the active profiles, indexed by ID.  The returned map must not be modified.
+func (m *Model) Profiles() map[proto.ProfileID]*proto.Profile {
+	return m.profiles
+}
+
+// WorkloadEndpoints returns the local workload endpoints, indexed by ID.  The returned map must
+// not be modified.
+func (m *Model) WorkloadEndpoints() map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint {
+	return m.workloadEPs
+}
+
+// HostEndpoints returns the local host endpoints, indexed by ID.  The returned map must not be
+// modified.
+func (m *Model) HostEndpoints() map[proto.HostEndpointID]*proto.HostEndpoint {
+	return m.hostEndpoints
+}
+
+// HostMetadata returns the known hosts' metadata, indexed by hostname.
+func (m *Model) HostMetadata() map[string]*proto.HostMetadataUpdate {
+	return m.hostMetadata
+}
+
+// IPAMPools returns the IPAM pools, indexed by ID.
+func (m *Model) IPAMPools() map[string]*proto.IPAMPool {
+	return m.ipamPools
+}
+
+// ServiceAccounts returns the service accounts, indexed by ID.
+func (m *Model) ServiceAccounts() map[proto.ServiceAccountID]*proto.ServiceAccountUpdate {
+	return m.serviceAccounts
+}
+
+// Namespaces returns the namespaces, indexed by ID.
+func (m *Model) Namespaces() map[proto.NamespaceID]*proto.NamespaceUpdate {
+	return m.namespaces
+}
+
+// Routes returns the routes to remote IPAM blocks, indexed by destination CIDR.
+func (m *Model) Routes() map[string]*proto.RouteUpdate {
+	return m.routes
+}
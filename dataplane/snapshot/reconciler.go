@@ -0,0 +1,186 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"sort"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// Reconciler works out which parts of a snapshot the datastore no longer has.  After a warm
+// start, the dataplane driver passes each update from Felix to OnUpdate until Felix is in sync;
+// anything in the snapshot that Felix hasn't sent by then is stale.
+type Reconciler struct {
+	ipSets            map[string]bool
+	profiles          map[proto.ProfileID]bool
+	policies          map[proto.PolicyID]bool
+	hostEndpoints     map[proto.HostEndpointID]bool
+	workloadEndpoints map[proto.WorkloadEndpointID]bool
+	hostMetadata      map[string]*proto.HostMetadataUpdate
+	ipamPools         map[string]bool
+	routes            map[string]bool
+}
+
+func NewReconciler(snap *proto.DataplaneSnapshot) *Reconciler {
+	r := &Reconciler{
+		ipSets:            map[string]bool{},
+		profiles:          map[proto.ProfileID]bool{},
+		policies:          map[proto.PolicyID]bool{},
+		hostEndpoints:     map[proto.HostEndpointID]bool{},
+		workloadEndpoints: map[proto.WorkloadEndpointID]bool{},
+		hostMetadata:      map[string]*proto.HostMetadataUpdate{},
+		ipamPools:         map[string]bool{},
+		routes:            map[string]bool{},
+	}
+	for _, upd := range snap.IpSets {
+		r.ipSets[upd.Id] = true
+	}
+	for _, upd := range snap.Profiles {
+		r.profiles[*upd.Id] = true
+	}
+	for _, upd := range snap.Policies {
+		r.policies[*upd.Id] = true
+	}
+	for _, upd := range snap.HostEndpoints {
+		r.hostEndpoints[*upd.Id] = true
+	}
+	for _, upd := range snap.WorkloadEndpoints {
+		r.workloadEndpoints[*upd.Id] = true
+	}
+	for _, upd := range snap.HostMetadata {
+		r.hostMetadata[upd.Hostname] = upd
+	}
+	for _, upd := range snap.IpamPools {
+		r.ipamPools[upd.Id] = true
+	}
+	for _, upd := range snap.Routes {
+		r.routes[upd.Dst] = true
+	}
+	return r
+}
+
+// OnUpdate records that Felix has sent an update (or removal) for a resource, so it is no longer
+// stale.
+func (r *Reconciler) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.IPSetUpdate:
+		delete(r.ipSets, msg.Id)
+	case *proto.IPSetRemove:
+		delete(r.ipSets, msg.Id)
+	case *proto.ActiveProfileUpdate:
+		delete(r.profiles, *msg.Id)
+	case *proto.ActiveProfileRemove:
+		delete(r.profiles, *msg.Id)
+	case *proto.ActivePolicyUpdate:
+		delete(r.policies, *msg.Id)
+	case *proto.ActivePolicyRemove:
+		delete(r.policies, *msg.Id)
+	case *proto.HostEndpointUpdate:
+		delete(r.hostEndpoints, *msg.Id)
+	case *proto.HostEndpointRemove:
+		delete(r.hostEndpoints, *msg.Id)
+	case *proto.WorkloadEndpointUpdate:
+		delete(r.workloadEndpoints, *msg.Id)
+	case *proto.WorkloadEndpointRemove:
+		delete(r.workloadEndpoints, *msg.Id)
+	case *proto.HostMetadataUpdate:
+		delete(r.hostMetadata, msg.Hostname)
+	case *proto.HostMetadataRemove:
+		delete(r.hostMetadata, msg.Hostname)
+	case *proto.IPAMPoolUpdate:
+		delete(r.ipamPools, msg.Id)
+	case *proto.IPAMPoolRemove:
+		delete(r.ipamPools, msg.Id)
+	case *proto.RouteUpdate:
+		delete(r.routes, msg.Dst)
+	case *proto.RouteRemove:
+		delete(r.routes, msg.Dst)
+	}
+}
+
+// StaleRemoves returns the removals for the parts of the snapshot that Felix hasn't sent, in an
+// order that meets the dataplane API's ordering guarantees: endpoints before the policies and
+// profiles that they use, which come before the IP sets that those use.
+func (r *Reconciler) StaleRemoves() []interface{} {
+	var msgs []interface{}
+
+	var wepIDs []proto.WorkloadEndpointID
+	for id := range r.workloadEndpoints {
+		wepIDs = append(wepIDs, id)
+	}
+	sort.Slice(wepIDs, func(i, j int) bool { return workloadEndpointIDLess(wepIDs[i], wepIDs[j]) })
+	for i := range wepIDs {
+		msgs = append(msgs, &proto.WorkloadEndpointRemove{Id: &wepIDs[i]})
+	}
+
+	var hepIDs []proto.HostEndpointID
+	for id := range r.hostEndpoints {
+		hepIDs = append(hepIDs, id)
+	}
+	sort.Slice(hepIDs, func(i, j int) bool { return hepIDs[i].EndpointId < hepIDs[j].EndpointId })
+	for i := range hepIDs {
+		msgs = append(msgs, &proto.HostEndpointRemove{Id: &hepIDs[i]})
+	}
+
+	var polIDs []proto.PolicyID
+	for id := range r.policies {
+		polIDs = append(polIDs, id)
+	}
+	sort.Slice(polIDs, func(i, j int) bool { return policyIDLess(polIDs[i], polIDs[j]) })
+	for i := range polIDs {
+		msgs = append(msgs, &proto.ActivePolicyRemove{Id: &polIDs[i]})
+	}
+
+	var profIDs []proto.ProfileID
+	for id := range r.profiles {
+		profIDs = append(profIDs, id)
+	}
+	sort.Slice(profIDs, func(i, j int) bool { return profIDs[i].Name < profIDs[j].Name })
+	for i := range profIDs {
+		msgs = append(msgs, &proto.ActiveProfileRemove{Id: &profIDs[i]})
+	}
+
+	for _, dst := range sortedKeys(r.routes) {
+		msgs = append(msgs, &proto.RouteRemove{Dst: dst})
+	}
+	for _, id := range sortedKeys(r.ipamPools) {
+		msgs = append(msgs, &proto.IPAMPoolRemove{Id: id})
+	}
+	var hostnames []string
+	for hostname := range r.hostMetadata {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	for _, hostname := range hostnames {
+		msgs = append(msgs, &proto.HostMetadataRemove{
+			Hostname: hostname,
+			Ipv4Addr: r.hostMetadata[hostname].Ipv4Addr,
+		})
+	}
+	for _, id := range sortedKeys(r.ipSets) {
+		msgs = append(msgs, &proto.IPSetRemove{Id: id})
+	}
+	return msgs
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
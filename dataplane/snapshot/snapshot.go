@@ -0,0 +1,431 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package snapshot saves the state that Felix has applied to the dataplane, so that the
+// dataplane driver can reprogram the same state as soon as it restarts instead of waiting for
+// the datastore resync.  A Tracker follows the updates that the driver receives and saves them
+// as a DataplaneSnapshot; after a restart, Load reads the snapshot back and a Reconciler works
+// out which parts of it the datastore no longer has once the driver is in sync again.
+package snapshot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	pb "github.com/gogo/protobuf/proto"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// formatVersion is the version of the snapshot format; Load rejects snapshots that were saved
+// with a different version.
+const formatVersion = 1
+
+// ErrStale is returned by Load if the snapshot was taken with a different config, or is too old.
+var ErrStale = errors.New("dataplane snapshot is stale")
+
+// ConfigHash returns a hash of Felix's raw config, as sent in a ConfigUpdate, which is stored
+// in the snapshot so that Load can check that the snapshot was taken with the same config.
+func ConfigHash(rawConfig map[string]string) string {
+	var names []string
+	for name := range rawConfig {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\n", name, rawConfig[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Tracker keeps track of the dataplane state from the updates that are sent to the dataplane
+// driver.  It is not safe for concurrent use.
+type Tracker struct {
+	configHash        string
+	ipSetTypes        map[string]proto.IPSetUpdate_IPSetType
+	ipSetMembers      map[string]set.Set
+	profiles          map[proto.ProfileID]*proto.ActiveProfileUpdate
+	policies          map[proto.PolicyID]*proto.ActivePolicyUpdate
+	hostEndpoints     map[proto.HostEndpointID]*proto.HostEndpointUpdate
+	workloadEndpoints map[proto.WorkloadEndpointID]*proto.WorkloadEndpointUpdate
+	hostMetadata      map[string]*proto.HostMetadataUpdate
+	ipamPools         map[string]*proto.IPAMPoolUpdate
+	routes            map[string]*proto.RouteUpdate
+
+	// dirty is set if the state has changed since it was last saved.
+	dirty bool
+}
+
+// NewTracker returns a Tracker for a dataplane that was started with the config that has the
+// given hash.  A later ConfigUpdate replaces the hash.
+func NewTracker(configHash string) *Tracker {
+	return &Tracker{
+		configHash:        configHash,
+		ipSetTypes:        map[string]proto.IPSetUpdate_IPSetType{},
+		ipSetMembers:      map[string]set.Set{},
+		profiles:          map[proto.ProfileID]*proto.ActiveProfileUpdate{},
+		policies:          map[proto.PolicyID]*proto.ActivePolicyUpdate{},
+		hostEndpoints:     map[proto.HostEndpointID]*proto.HostEndpointUpdate{},
+		workloadEndpoints: map[proto.WorkloadEndpointID]*proto.WorkloadEndpointUpdate{},
+		hostMetadata:      map[string]*proto.HostMetadataUpdate{},
+		ipamPools:         map[string]*proto.IPAMPoolUpdate{},
+		routes:            map[string]*proto.RouteUpdate{},
+	}
+}
+
+// OnUpdate applies an update from Felix to the tracked state.  Updates that don't affect the
+// snapshot are ignored.
+func (t *Tracker) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.ConfigUpdate:
+		configHash := ConfigHash(msg.Config)
+		if configHash == t.configHash {
+			return
+		}
+		t.configHash = configHash
+	case *proto.IPSetUpdate:
+		members := set.New()
+		for _, member := range msg.Members {
+			members.Add(member)
+		}
+		t.ipSetTypes[msg.Id] = msg.Type
+		t.ipSetMembers[msg.Id] = members
+	case *proto.IPSetDeltaUpdate:
+		members, ok := t.ipSetMembers[msg.Id]
+		if !ok {
+			return
+		}
+		for _, member := range msg.RemovedMembers {
+			members.Discard(member)
+		}
+		for _, member := range msg.AddedMembers {
+			members.Add(member)
+		}
+	case *proto.IPSetRemove:
+		delete(t.ipSetTypes, msg.Id)
+		delete(t.ipSetMembers, msg.Id)
+	case *proto.ActiveProfileUpdate:
+		t.profiles[*msg.Id] = msg
+	case *proto.ActiveProfileRemove:
+		delete(t.profiles, *msg.Id)
+	case *proto.ActivePolicyUpdate:
+		t.policies[*msg.Id] = msg
+	case *proto.ActivePolicyRemove:
+		delete(t.policies, *msg.Id)
+	case *proto.HostEndpointUpdate:
+		t.hostEndpoints[*msg.Id] = msg
+	case *proto.HostEndpointRemove:
+		delete(t.hostEndpoints, *msg.Id)
+	case *proto.WorkloadEndpointUpdate:
+		t.workloadEndpoints[*msg.Id] = msg
+	case *proto.WorkloadEndpointRemove:
+		delete(t.workloadEndpoints, *msg.Id)
+	case *proto.HostMetadataUpdate:
+		t.hostMetadata[msg.Hostname] = msg
+	case *proto.HostMetadataRemove:
+		delete(t.hostMetadata, msg.Hostname)
+	case *proto.IPAMPoolUpdate:
+		t.ipamPools[msg.Id] = msg
+	case *proto.IPAMPoolRemove:
+		delete(t.ipamPools, msg.Id)
+	case *proto.RouteUpdate:
+		t.routes[msg.Dst] = msg
+	case *proto.RouteRemove:
+		delete(t.routes, msg.Dst)
+	default:
+		return
+	}
+	t.dirty = true
+}
+
+// Dirty returns true if the state has changed since it was last saved.
+func (t *Tracker) Dirty() bool {
+	return t.dirty
+}
+
+// Snapshot returns the current state.  Each list is sorted by ID so that the same state always
+// gives the same snapshot.
+func (t *Tracker) Snapshot() *proto.DataplaneSnapshot {
+	snap := &proto.DataplaneSnapshot{
+		Version:      formatVersion,
+		ConfigHash:   t.configHash,
+		IsoTimestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+	for id, members := range t.ipSetMembers {
+		upd := &proto.IPSetUpdate{Id: id, Type: t.ipSetTypes[id]}
+		members.Iter(func(item interface{}) error {
+			upd.Members = append(upd.Members, item.(string))
+			return nil
+		})
+		sort.Strings(upd.Members)
+		snap.IpSets = append(snap.IpSets, upd)
+	}
+	sort.Slice(snap.IpSets, func(i, j int) bool { return snap.IpSets[i].Id < snap.IpSets[j].Id })
+	for _, upd := range t.profiles {
+		snap.Profiles = append(snap.Profiles, upd)
+	}
+	sort.Slice(snap.Profiles, func(i, j int) bool {
+		return snap.Profiles[i].Id.Name < snap.Profiles[j].Id.Name
+	})
+	for _, upd := range t.policies {
+		snap.Policies = append(snap.Policies, upd)
+	}
+	sort.Slice(snap.Policies, func(i, j int) bool {
+		return policyIDLess(*snap.Policies[i].Id, *snap.Policies[j].Id)
+	})
+	for _, upd := range t.hostEndpoints {
+		snap.HostEndpoints = append(snap.HostEndpoints, upd)
+	}
+	sort.Slice(snap.HostEndpoints, func(i, j int) bool {
+		return snap.HostEndpoints[i].Id.EndpointId < snap.HostEndpoints[j].Id.EndpointId
+	})
+	for _, upd := range t.workloadEndpoints {
+		snap.WorkloadEndpoints = append(snap.WorkloadEndpoints, upd)
+	}
+	sort.Slice(snap.WorkloadEndpoints, func(i, j int) bool {
+		return workloadEndpointIDLess(*snap.WorkloadEndpoints[i].Id, *snap.WorkloadEndpoints[j].Id)
+	})
+	for _, upd := range t.hostMetadata {
+		snap.HostMetadata = append(snap.HostMetadata, upd)
+	}
+	sort.Slice(snap.HostMetadata, func(i, j int) bool {
+		return snap.HostMetadata[i].Hostname < snap.HostMetadata[j].Hostname
+	})
+	for _, upd := range t.ipamPools {
+		snap.IpamPools = append(snap.IpamPools, upd)
+	}
+	sort.Slice(snap.IpamPools, func(i, j int) bool { return snap.IpamPools[i].Id < snap.IpamPools[j].Id })
+	for _, upd := range t.routes {
+		snap.Routes = append(snap.Routes, upd)
+	}
+	sort.Slice(snap.Routes, func(i, j int) bool { return snap.Routes[i].Dst < snap.Routes[j].Dst })
+	return snap
+}
+
+// Save writes the current state to the file at path.  The file starts with a SHA-256 checksum of
+// the rest of its contents, which is the serialized DataplaneSnapshot, so that Load can detect a
+// corrupt file.  The file is written to a temporary file first and then renamed into place.
+func (t *Tracker) Save(path string) error {
+	data, err := pb.Marshal(t.Snapshot())
+	if err != nil {
+		return err
+	}
+	checksum := sha256.Sum256(data)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(checksum[:])
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
+
+// Load reads the snapshot at path and checks that it can be used.  It returns an error that
+// satisfies os.IsNotExist if there's no snapshot, and ErrStale if the snapshot was taken with a
+// config that doesn't have the given hash or was taken more than maxAge ago (if maxAge is
+// non-zero).  It returns some other error if the snapshot is corrupt or inconsistent.
+func Load(path, configHash string, maxAge time.Duration) (*proto.DataplaneSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < sha256.Size {
+		return nil, errors.New("dataplane snapshot is truncated")
+	}
+	checksum := sha256.Sum256(data[sha256.Size:])
+	if !bytes.Equal(checksum[:], data[:sha256.Size]) {
+		return nil, errors.New("dataplane snapshot has a bad checksum")
+	}
+	snap := &proto.DataplaneSnapshot{}
+	if err := pb.Unmarshal(data[sha256.Size:], snap); err != nil {
+		return nil, err
+	}
+	if snap.Version != formatVersion {
+		return nil, fmt.Errorf("dataplane snapshot has unsupported version %d", snap.Version)
+	}
+	if snap.ConfigHash != configHash {
+		return nil, ErrStale
+	}
+	if maxAge > 0 {
+		timestamp, err := time.Parse(time.RFC3339, snap.IsoTimestamp)
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(timestamp) > maxAge {
+			return nil, ErrStale
+		}
+	}
+	if err := validate(snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// validate checks that everything that the snapshot's endpoints and policies refer to is in the
+// snapshot, as the dataplane API requires.
+func validate(snap *proto.DataplaneSnapshot) error {
+	ipSets := set.New()
+	for _, upd := range snap.IpSets {
+		ipSets.Add(upd.Id)
+	}
+	checkRules := func(desc string, ruleLists ...[]*proto.Rule) error {
+		for _, rules := range ruleLists {
+			for _, rule := range rules {
+				for _, ids := range [][]string{
+					rule.SrcIpSetIds, rule.DstIpSetIds, rule.NotSrcIpSetIds, rule.NotDstIpSetIds,
+					rule.SrcNamedPortIpSetIds, rule.DstNamedPortIpSetIds,
+					rule.NotSrcNamedPortIpSetIds, rule.NotDstNamedPortIpSetIds,
+				} {
+					for _, id := range ids {
+						if !ipSets.Contains(id) {
+							return fmt.Errorf("%s refers to missing IP set %q", desc, id)
+						}
+					}
+				}
+			}
+		}
+		return nil
+	}
+	profiles := set.New()
+	for _, upd := range snap.Profiles {
+		if err := checkRules(fmt.Sprintf("profile %v", *upd.Id),
+			upd.Profile.InboundRules, upd.Profile.OutboundRules); err != nil {
+			return err
+		}
+		profiles.Add(upd.Id.Name)
+	}
+	policies := set.New()
+	for _, upd := range snap.Policies {
+		if err := checkRules(fmt.Sprintf("policy %v", *upd.Id),
+			upd.Policy.InboundRules, upd.Policy.OutboundRules); err != nil {
+			return err
+		}
+		policies.Add(*upd.Id)
+	}
+	checkEndpoint := func(desc string, profileIDs []string, tierLists ...[]*proto.TierInfo) error {
+		for _, id := range profileIDs {
+			if !profiles.Contains(id) {
+				return fmt.Errorf("%s refers to missing profile %q", desc, id)
+			}
+		}
+		for _, tiers := range tierLists {
+			for _, tier := range tiers {
+				for _, names := range [][]string{tier.IngressPolicies, tier.EgressPolicies} {
+					for _, name := range names {
+						id := proto.PolicyID{Tier: tier.Name, Name: name}
+						if !policies.Contains(id) {
+							return fmt.Errorf("%s refers to missing policy %v", desc, id)
+						}
+					}
+				}
+			}
+		}
+		return nil
+	}
+	for _, upd := range snap.HostEndpoints {
+		ep := upd.Endpoint
+		if err := checkEndpoint(fmt.Sprintf("host endpoint %v", *upd.Id), ep.ProfileIds,
+			ep.Tiers, ep.UntrackedTiers, ep.PreDnatTiers); err != nil {
+			return err
+		}
+	}
+	for _, upd := range snap.WorkloadEndpoints {
+		ep := upd.Endpoint
+		if err := checkEndpoint(fmt.Sprintf("workload endpoint %v", *upd.Id), ep.ProfileIds,
+			ep.Tiers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Messages returns the snapshot as a sequence of dataplane updates, in an order that meets the
+// dataplane API's ordering guarantees: IP sets before the policies and profiles that use them,
+// which come before the endpoints that use them.
+func Messages(snap *proto.DataplaneSnapshot) []interface{} {
+	var msgs []interface{}
+	for _, upd := range snap.IpSets {
+		msgs = append(msgs, upd)
+	}
+	for _, upd := range snap.Profiles {
+		msgs = append(msgs, upd)
+	}
+	for _, upd := range snap.Policies {
+		msgs = append(msgs, upd)
+	}
+	for _, upd := range snap.HostMetadata {
+		msgs = append(msgs, upd)
+	}
+	for _, upd := range snap.IpamPools {
+		msgs = append(msgs, upd)
+	}
+	for _, upd := range snap.Routes {
+		msgs = append(msgs, upd)
+	}
+	for _, upd := range snap.HostEndpoints {
+		msgs = append(msgs, upd)
+	}
+	for _, upd := range snap.WorkloadEndpoints {
+		msgs = append(msgs, upd)
+	}
+	return msgs
+}
+
+func policyIDLess(a, b proto.PolicyID) bool {
+	if a.Tier != b.Tier {
+		return a.Tier < b.Tier
+	}
+	return a.Name < b.Name
+}
+
+func workloadEndpointIDLess(a, b proto.WorkloadEndpointID) bool {
+	if a.OrchestratorId != b.OrchestratorId {
+		return a.OrchestratorId < b.OrchestratorId
+	}
+	if a.WorkloadId != b.WorkloadId {
+		return a.WorkloadId < b.WorkloadId
+	}
+	return a.EndpointId < b.EndpointId
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/projectcalico/felix/dataplane/snapshot"
+	"github.com/projectcalico/felix/proto"
+)
+
+var (
+	polID  = proto.PolicyID{Tier: "default", Name: "pol1"}
+	profID = proto.ProfileID{Name: "prof1"}
+	epID   = proto.WorkloadEndpointID{OrchestratorId: "k8s", WorkloadId: "ns1/pod1", EndpointId: "eth0"}
+
+	ipSetUpd = &proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}}
+	polUpd   = &proto.ActivePolicyUpdate{
+		Id: &polID,
+		Policy: &proto.Policy{InboundRules: []*proto.Rule{
+			{Action: "allow", SrcIpSetIds: []string{"s1"}},
+		}},
+	}
+	profUpd = &proto.ActiveProfileUpdate{Id: &profID, Profile: &proto.Profile{}}
+	epUpd   = &proto.WorkloadEndpointUpdate{
+		Id: &epID,
+		Endpoint: &proto.WorkloadEndpoint{
+			Tiers:      []*proto.TierInfo{{Name: "default", IngressPolicies: []string{"pol1"}}},
+			ProfileIds: []string{"prof1"},
+		},
+	}
+	hostUpd  = &proto.HostMetadataUpdate{Hostname: "host2", Ipv4Addr: "192.168.0.2"}
+	routeUpd = &proto.RouteUpdate{Dst: "10.0.1.0/26", DstNodeName: "host2", DstNodeIp: "192.168.0.2"}
+)
+
+var _ = Describe("ConfigHash", func() {
+	It("should depend on the config values", func() {
+		hash := snapshot.ConfigHash(map[string]string{"A": "1", "B": "2"})
+		Expect(snapshot.ConfigHash(map[string]string{"B": "2", "A": "1"})).To(Equal(hash))
+		Expect(snapshot.ConfigHash(map[string]string{"A": "1", "B": "3"})).NotTo(Equal(hash))
+	})
+})
+
+var _ = Describe("Tracker", func() {
+	var dir, path string
+	var tracker *snapshot.Tracker
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "snapshot")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "felix", "snapshot")
+		tracker = snapshot.NewTracker("hash1")
+		for _, msg := range []interface{}{
+			&proto.ConfigUpdate{Config: map[string]string{"InterfacePrefix": "cali"}},
+			ipSetUpd,
+			&proto.IPSetDeltaUpdate{Id: "s1", AddedMembers: []string{"10.0.0.3", "10.0.0.2"}},
+			&proto.IPSetUpdate{Id: "s2", Members: []string{"10.0.0.4"}},
+			&proto.IPSetRemove{Id: "s2"},
+			polUpd,
+			profUpd,
+			epUpd,
+			hostUpd,
+			routeUpd,
+			&proto.InSync{},
+		} {
+			tracker.OnUpdate(msg)
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	configHash := snapshot.ConfigHash(map[string]string{"InterfacePrefix": "cali"})
+
+	It("should save and load the state", func() {
+		Expect(tracker.Dirty()).To(BeTrue())
+		Expect(tracker.Save(path)).To(Succeed())
+		Expect(tracker.Dirty()).To(BeFalse())
+
+		snap, err := snapshot.Load(path, configHash, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(snapshot.Messages(snap)).To(Equal([]interface{}{
+			&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+			profUpd,
+			polUpd,
+			hostUpd,
+			routeUpd,
+			epUpd,
+		}))
+	})
+
+	It("should report a missing snapshot", func() {
+		_, err := snapshot.Load(path, configHash, time.Hour)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should reject a snapshot with a different config", func() {
+		Expect(tracker.Save(path)).To(Succeed())
+		_, err := snapshot.Load(path, "hash1", time.Hour)
+		Expect(err).To(Equal(snapshot.ErrStale))
+	})
+
+	It("should warm start after a restart for a config change once the new config is saved", func() {
+		Expect(tracker.Save(path)).To(Succeed())
+		newConfig := map[string]string{"InterfacePrefix": "tap"}
+		newConfigHash := snapshot.ConfigHash(newConfig)
+		_, err := snapshot.Load(path, newConfigHash, time.Hour)
+		Expect(err).To(Equal(snapshot.ErrStale))
+
+		// The driver saves a fresh snapshot when the ConfigUpdate arrives, so the restart
+		// with the new config can use it.
+		tracker.OnUpdate(&proto.ConfigUpdate{Config: newConfig})
+		Expect(tracker.Dirty()).To(BeTrue())
+		Expect(tracker.Save(path)).To(Succeed())
+		snap, err := snapshot.Load(path, newConfigHash, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(snap.ConfigHash).To(Equal(newConfigHash))
+		_, err = snapshot.Load(path, configHash, time.Hour)
+		Expect(err).To(Equal(snapshot.ErrStale))
+	})
+
+	It("should not need saving for a ConfigUpdate that doesn't change the config", func() {
+		Expect(tracker.Save(path)).To(Succeed())
+		tracker.OnUpdate(&proto.ConfigUpdate{Config: map[string]string{"InterfacePrefix": "cali"}})
+		Expect(tracker.Dirty()).To(BeFalse())
+	})
+
+	It("should reject an old snapshot", func() {
+		Expect(tracker.Save(path)).To(Succeed())
+		_, err := snapshot.Load(path, configHash, time.Nanosecond)
+		Expect(err).To(Equal(snapshot.ErrStale))
+	})
+
+	It("should reject a corrupt snapshot", func() {
+		Expect(tracker.Save(path)).To(Succeed())
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		data[len(data)-1] ^= 0xff
+		Expect(ioutil.WriteFile(path, data, 0644)).To(Succeed())
+		_, err = snapshot.Load(path, configHash, time.Hour)
+		Expect(err).To(MatchError(ContainSubstring("checksum")))
+	})
+
+	It("should reject an inconsistent snapshot", func() {
+		tracker.OnUpdate(&proto.ActivePolicyRemove{Id: &polID})
+		Expect(tracker.Save(path)).To(Succeed())
+		_, err := snapshot.Load(path, configHash, time.Hour)
+		Expect(err).To(MatchError(ContainSubstring("missing policy")))
+	})
+
+	Describe("Reconciler", func() {
+		It("should remove the state that Felix doesn't send again, in a safe order", func() {
+			reconciler := snapshot.NewReconciler(tracker.Snapshot())
+			reconciler.OnUpdate(ipSetUpd)
+			reconciler.OnUpdate(hostUpd)
+			Expect(reconciler.StaleRemoves()).To(Equal([]interface{}{
+				&proto.WorkloadEndpointRemove{Id: &epID},
+				&proto.ActivePolicyRemove{Id: &polID},
+				&proto.ActiveProfileRemove{Id: &profID},
+				&proto.RouteRemove{Dst: "10.0.1.0/26"},
+			}))
+		})
+
+		It("should have nothing to remove if Felix sends everything", func() {
+			reconciler := snapshot.NewReconciler(tracker.Snapshot())
+			for _, msg := range []interface{}{ipSetUpd, polUpd, profUpd, epUpd, hostUpd, routeUpd} {
+				reconciler.OnUpdate(msg)
+			}
+			Expect(reconciler.StaleRemoves()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,94 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/docopt/docopt-go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/projectcalico/felix/authz"
+	"github.com/projectcalico/felix/policysync/client"
+)
+
+const usage = `felix-authz: HTTP authorization agent driven by Felix's policy sync API.
+
+Usage:
+  felix-authz [--policy-sync-socket=<path>] [--listen=<path>] [--log-level=<level>]
+
+Options:
+  --policy-sync-socket=<path>  Path of the policy sync socket that Felix mounts into the pod
+                               [default: /var/run/nodeagent/socket].
+  --listen=<path>              Path of the unix socket to serve the Authorization API on
+                               [default: /var/run/authz/authz.sock].
+  --log-level=<level>          Log level [default: info].
+
+felix-authz runs alongside a workload, receives the workload's policy from Felix and answers
+Authorization.Check requests from a proxy in the same pod.  Requests are reported as
+unavailable until the agent is in sync with Felix.`
+
+func main() {
+	arguments, err := docopt.Parse(usage, nil, true, "v0.1", false)
+	if err != nil {
+		println(usage)
+		log.WithError(err).Fatal("Failed to parse usage")
+	}
+	logLevel, err := log.ParseLevel(arguments["--log-level"].(string))
+	if err != nil {
+		log.WithError(err).Fatal("Invalid log level")
+	}
+	log.SetLevel(logLevel)
+	log.WithField("args", arguments).Info("Parsed arguments")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	syncClient := client.New(client.Config{
+		SocketPath: arguments["--policy-sync-socket"].(string),
+	})
+	syncClient.Start(ctx)
+
+	listenPath := arguments["--listen"].(string)
+	// Remove any socket left over from a previous run.
+	if err := os.Remove(listenPath); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("path", listenPath).Fatal("Failed to remove old socket")
+	}
+	lis, err := net.Listen("unix", listenPath)
+	if err != nil {
+		log.WithError(err).WithField("path", listenPath).Fatal("Failed to listen")
+	}
+
+	grpcServer := grpc.NewServer()
+	authz.NewServer(syncClient.Snapshot).RegisterGrpc(grpcServer)
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signalChan
+		log.WithField("signal", sig).Info("Received signal, shutting down")
+		grpcServer.GracefulStop()
+	}()
+
+	log.WithField("path", listenPath).Info("Serving Authorization API")
+	if err := grpcServer.Serve(lis); err != nil {
+		log.WithError(err).Fatal("Authorization server failed")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/docopt/docopt-go"
+	"github.com/gogo/protobuf/jsonpb"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/dataplane"
+	"github.com/projectcalico/felix/dataplane/external"
+	"github.com/projectcalico/felix/filestore"
+	"github.com/projectcalico/felix/offlinecalc"
+	"github.com/projectcalico/felix/policysim"
+)
+
+const usage = `felix-debug: debugging tools for Felix.
+
+Usage:
+  felix-debug simulate --snapshot=<file> <src-ip> <dst-ip> [--protocol=<protocol>] [--src-port=<port>] [--dst-port=<port>] [--icmp-type=<type>] [--icmp-code=<code>] [--from-host] [--log-level=<level>]
+  felix-debug calc <resource-dir> --hostname=<name> [--iptables=<file>] [--ip-version=<ver>] [--log-level=<level>]
+
+Options:
+  --snapshot=<file>      File containing a stream of JSON-encoded ToDataplane messages, as
+                         sent by the calculation graph.
+  --protocol=<protocol>  Protocol name or number [default: tcp].
+  --src-port=<port>      Source port [default: 0].
+  --dst-port=<port>      Destination port [default: 0].
+  --icmp-type=<type>     ICMP type [default: 0].
+  --icmp-code=<code>     ICMP code [default: 0].
+  --from-host            The packet is sent by a process on the host, rather than forwarded.
+  --hostname=<name>      Hostname of the node to calculate the dataplane state for.
+  --iptables=<file>      Also write the iptables chains that Felix would program to the file,
+                         as iptables-restore input.
+  --ip-version=<ver>     IP version of the iptables chains [default: 4].
+  --log-level=<level>    Log level [default: warning].
+
+The simulate command walks the policies and profiles that apply to the packet, in the same
+order as Felix's iptables rules, and prints the rules that matched and the final verdict.  It
+exits with status 0 if the packet would be allowed and 1 if it would be denied.
+
+The calc command loads Calico v3 resources (policies, profiles, endpoints, network sets, IP
+pools, nodes and Felix configuration) from the YAML and JSON files in a directory, runs them
+through Felix's calculation graph for the given node and prints the resulting ToDataplane
+messages, in the format that simulate accepts as a snapshot.`
+
+func main() {
+	arguments, err := docopt.Parse(usage, nil, true, "v0.1", false)
+	if err != nil {
+		println(usage)
+		log.WithError(err).Fatal("Failed to parse usage")
+	}
+	logLevel, err := log.ParseLevel(arguments["--log-level"].(string))
+	if err != nil {
+		log.WithError(err).Fatal("Invalid log level")
+	}
+	log.SetLevel(logLevel)
+	log.WithField("args", arguments).Info("Parsed arguments")
+
+	if arguments["simulate"].(bool) {
+		allowed, err := simulate(arguments)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(2)
+		}
+		if !allowed {
+			os.Exit(1)
+		}
+	} else if arguments["calc"].(bool) {
+		if err := runCalc(arguments); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(2)
+		}
+	}
+}
+
+func runCalc(arguments map[string]interface{}) error {
+	ipVersion, err := strconv.ParseUint(arguments["--ip-version"].(string), 10, 8)
+	if err != nil || (ipVersion != 4 && ipVersion != 6) {
+		return fmt.Errorf("invalid IP version %q", arguments["--ip-version"])
+	}
+
+	kvs, err := filestore.LoadResourceDir(arguments["<resource-dir>"].(string))
+	if err != nil {
+		return err
+	}
+	updates, err := filestore.ConvertResources(kvs)
+	if err != nil {
+		return err
+	}
+	result := offlinecalc.Run(updates, arguments["--hostname"].(string))
+
+	out := bufio.NewWriter(os.Stdout)
+	marshaller := jsonpb.Marshaler{}
+	for i, msg := range result.Messages {
+		s, err := marshaller.MarshalToString(external.WrapToDataplane(uint64(i+1), msg))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, s)
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	if iptablesFile, ok := arguments["--iptables"].(string); ok {
+		rulesConfig := dataplane.RulesConfigFromConfigParams(result.Config, false)
+		text := offlinecalc.RenderIptables(rulesConfig, result.Messages, uint8(ipVersion))
+		if err := ioutil.WriteFile(iptablesFile, []byte(text), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func simulate(arguments map[string]interface{}) (bool, error) {
+	pkt, err := parsePacket(arguments)
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.Open(arguments["--snapshot"].(string))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	snapshot, err := policysim.LoadSnapshot(f)
+	if err != nil {
+		return false, fmt.Errorf("failed to load snapshot: %v", err)
+	}
+
+	result, err := snapshot.Simulate(pkt)
+	if err != nil {
+		return false, err
+	}
+	for _, step := range result.Steps {
+		fmt.Println(step)
+	}
+	fmt.Println("Verdict:", result.Verdict)
+	return result.Verdict == policysim.VerdictAllow, nil
+}
+
+func parsePacket(arguments map[string]interface{}) (*policysim.Packet, error) {
+	pkt := &policysim.Packet{
+		SrcIP:    net.ParseIP(arguments["<src-ip>"].(string)),
+		DstIP:    net.ParseIP(arguments["<dst-ip>"].(string)),
+		FromHost: arguments["--from-host"].(bool),
+	}
+	if pkt.SrcIP == nil {
+		return nil, fmt.Errorf("invalid source IP %q", arguments["<src-ip>"])
+	}
+	if pkt.DstIP == nil {
+		return nil, fmt.Errorf("invalid destination IP %q", arguments["<dst-ip>"])
+	}
+
+	protocol := arguments["--protocol"].(string)
+	if num, ok := policysim.ProtocolNumber(protocol); ok {
+		pkt.Protocol = num
+	} else if num, err := strconv.ParseUint(protocol, 10, 8); err == nil {
+		pkt.Protocol = int(num)
+	} else {
+		return nil, fmt.Errorf("unknown protocol %q", protocol)
+	}
+
+	var err error
+	if pkt.SrcPort, err = parsePort(arguments["--src-port"].(string)); err != nil {
+		return nil, err
+	}
+	if pkt.DstPort, err = parsePort(arguments["--dst-port"].(string)); err != nil {
+		return nil, err
+	}
+	if pkt.ICMPType, err = parseUint8(arguments["--icmp-type"].(string)); err != nil {
+		return nil, err
+	}
+	if pkt.ICMPCode, err = parseUint8(arguments["--icmp-code"].(string)); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(port), nil
+}
+
+func parseUint8(s string) (uint8, error) {
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ICMP type or code %q", s)
+	}
+	return uint8(n), nil
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/docopt/docopt-go"
+	"github.com/gogo/protobuf/jsonpb"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/dataplane/external"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/recorder"
+)
+
+const usage = `felix-replay: replays a recording of Felix's datastore updates through the calculation graph.
+
+Usage:
+  felix-replay print <recording> [--hostname=<name>] [--log-level=<level>]
+  felix-replay diff <recording> <expected> [--hostname=<name>] [--log-level=<level>]
+
+Options:
+  --hostname=<name>    Hostname to calculate the dataplane state for; defaults to the hostname
+                       of the Felix that made the recording.
+  --log-level=<level>  Log level [default: warning].
+
+Recordings are made by setting Felix's DebugSyncerRecordingFile parameter; Felix adds the time
+that it started to the file name.
+
+The print command writes the ToDataplane messages that the calculation graph produces as a
+stream of JSON objects, which felix-debug simulate accepts as a snapshot.  The diff command
+compares them with a stream in the same format, such as the output of an earlier print, and
+reports the first difference; it exits with status 1 if the streams differ.`
+
+func main() {
+	arguments, err := docopt.Parse(usage, nil, true, "v0.1", false)
+	if err != nil {
+		println(usage)
+		log.WithError(err).Fatal("Failed to parse usage")
+	}
+	logLevel, err := log.ParseLevel(arguments["--log-level"].(string))
+	if err != nil {
+		log.WithError(err).Fatal("Invalid log level")
+	}
+	log.SetLevel(logLevel)
+	log.WithField("args", arguments).Info("Parsed arguments")
+
+	msgs, err := replay(arguments)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(2)
+	}
+
+	if arguments["print"].(bool) {
+		out := bufio.NewWriter(os.Stdout)
+		marshaller := jsonpb.Marshaler{}
+		for _, m := range msgs {
+			s, err := marshaller.MarshalToString(m.envelope)
+			if err != nil {
+				log.WithError(err).Fatal("Failed to marshal message")
+			}
+			fmt.Fprintln(out, s)
+		}
+		out.Flush()
+	} else if arguments["diff"].(bool) {
+		same, err := diff(msgs, arguments["<expected>"].(string))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(2)
+		}
+		if !same {
+			os.Exit(1)
+		}
+	}
+}
+
+// replayedMsg is a message from the calculation graph, along with the recorded entry that
+// caused it.
+type replayedMsg struct {
+	envelope *proto.ToDataplane
+	entry    *recorder.Entry
+}
+
+func replay(arguments map[string]interface{}) ([]replayedMsg, error) {
+	f, err := os.Open(arguments["<recording>"].(string))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader, err := recorder.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("header", reader.Header).Info("Opened recording")
+
+	conf := config.New()
+	conf.FelixHostname = reader.Header.Hostname
+	if hostname, ok := arguments["--hostname"].(string); ok {
+		conf.FelixHostname = hostname
+	}
+
+	var msgs []replayedMsg
+	var seqNo uint64
+	err = recorder.ReplayThroughCalcGraph(reader, conf, func(entry *recorder.Entry, out []interface{}) error {
+		for _, msg := range out {
+			seqNo++
+			msgs = append(msgs, replayedMsg{
+				envelope: external.WrapToDataplane(seqNo, msg),
+				entry:    entry,
+			})
+		}
+		return nil
+	})
+	if err == io.ErrUnexpectedEOF {
+		// Felix was probably killed while recording; the entries up to that point are still
+		// useful.
+		log.Warn("Recording was truncated, replayed the complete entries")
+		err = nil
+	}
+	return msgs, err
+}
+
+// diff compares the replayed messages with the expected stream.  Sequence numbers are ignored
+// so the expected stream may come from somewhere other than felix-replay.
+func diff(msgs []replayedMsg, expectedFile string) (bool, error) {
+	f, err := os.Open(expectedFile)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	marshaller := jsonpb.Marshaler{}
+	marshalPayload := func(envelope *proto.ToDataplane) (string, error) {
+		e := *envelope
+		e.SequenceNumber = 0
+		return marshaller.MarshalToString(&e)
+	}
+	decoder := json.NewDecoder(f)
+	for i := 0; ; i++ {
+		var envelope proto.ToDataplane
+		err := jsonpb.UnmarshalNext(decoder, &envelope)
+		if err == io.EOF {
+			if i < len(msgs) {
+				fmt.Printf("Replay produced %d more messages than expected, starting with:\n", len(msgs)-i)
+				printReplayed(msgs[i])
+				return false, nil
+			}
+			fmt.Printf("Replay matches the expected %d messages\n", i)
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read expected message %d: %v", i+1, err)
+		}
+		expected, err := marshalPayload(&envelope)
+		if err != nil {
+			return false, err
+		}
+		if i >= len(msgs) {
+			fmt.Printf("Replay ended after %d messages, expected:\n  %s\n", i, expected)
+			return false, nil
+		}
+		replayed, err := marshalPayload(msgs[i].envelope)
+		if err != nil {
+			return false, err
+		}
+		if expected != replayed {
+			fmt.Printf("Message %d differs.\nExpected:\n  %s\n", i+1, expected)
+			printReplayed(msgs[i])
+			return false, nil
+		}
+	}
+}
+
+func printReplayed(msg replayedMsg) {
+	fmt.Printf("Replayed:\n  %v\n", msg.envelope)
+	fmt.Printf("Produced by the entry recorded at %v", msg.entry.Time)
+	if msg.entry.Status != nil {
+		fmt.Printf(" (status %v)\n", *msg.entry.Status)
+		return
+	}
+	fmt.Printf(" (%d updates):\n", len(msg.entry.Updates))
+	for _, u := range msg.entry.Updates {
+		fmt.Printf("  %v %s\n", u.UpdateType, u.Key)
+	}
+}
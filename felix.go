@@ -25,6 +25,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"strings"
 	"syscall"
 	"time"
 
@@ -42,21 +43,22 @@ import (
 	"github.com/projectcalico/felix/config"
 	_ "github.com/projectcalico/felix/config"
 	dp "github.com/projectcalico/felix/dataplane"
+	"github.com/projectcalico/felix/filestore"
+	"github.com/projectcalico/felix/localsyncer"
 	"github.com/projectcalico/felix/logutils"
 	"github.com/projectcalico/felix/policysync"
 	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/recorder"
 	"github.com/projectcalico/felix/statusrep"
 	"github.com/projectcalico/felix/usagerep"
 	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
 	"github.com/projectcalico/libcalico-go/lib/backend"
 	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
-	"github.com/projectcalico/libcalico-go/lib/backend/syncersv1/felixsyncer"
 	"github.com/projectcalico/libcalico-go/lib/backend/syncersv1/updateprocessors"
 	"github.com/projectcalico/libcalico-go/lib/backend/watchersyncer"
 	errors2 "github.com/projectcalico/libcalico-go/lib/errors"
 	"github.com/projectcalico/libcalico-go/lib/health"
-	"github.com/projectcalico/libcalico-go/lib/set"
 	"github.com/projectcalico/typha/pkg/syncclient"
 )
 
@@ -83,6 +85,9 @@ const (
 	// Process return code used to report a config change.  This is the same as the code used
 	// by SIGHUP, which means that the wrapper script also restarts Felix on a SIGHUP.
 	configChangedRC = 129
+
+	// How often we flush the syncer recording, if enabled.
+	recordingFlushInterval = time.Second
 )
 
 // main is the entry point to the calico-felix binary.
@@ -213,6 +218,33 @@ configRetry:
 		// be, or cancel any existing server if we should not be serving any more.
 		healthAggregator.ServeHTTP(configParams.HealthEnabled, configParams.HealthPort)
 
+		if configParams.DatastoreType == "file" {
+			// There's no datastore to connect to; the rest of the config comes from the
+			// resource files.
+			globalConfig, hostConfig, err := filestore.LoadConfig(
+				configParams.FileDatastorePath, configParams.FelixHostname)
+			if err == filestore.ErrNotReady {
+				log.Warn("Waiting for the resource files to mark the datastore as ready")
+				healthAggregator.Report(healthName, &health.HealthReport{Live: true, Ready: true})
+				time.Sleep(1 * time.Second)
+				continue configRetry
+			} else if err != nil {
+				log.WithError(err).Error("Failed to get config from resource files")
+				time.Sleep(1 * time.Second)
+				continue configRetry
+			}
+			configParams.UpdateFrom(globalConfig, config.DatastoreGlobal)
+			configParams.UpdateFrom(hostConfig, config.DatastorePerHost)
+			configParams.Validate()
+			if configParams.Err != nil {
+				log.WithError(configParams.Err).Error(
+					"Failed to parse/validate configuration from resource files.")
+				time.Sleep(1 * time.Second)
+				continue configRetry
+			}
+			break configRetry
+		}
+
 		// We should now have enough config to connect to the datastore
 		// so we can load the remainder of the config.
 		datastoreConfig := configParams.DatastoreConfig()
@@ -311,7 +343,16 @@ configRetry:
 		// (Otherwise, we pass in a nil channel, which disables such updates.)
 		connToUsageRepUpdChan = make(chan map[string]string, 1)
 	}
-	dpConnector := newConnector(configParams, connToUsageRepUpdChan, backendClient, dpDriver, failureReportChan)
+
+	// Felix reports its status to the datastore or, if it's using resource files, to a local
+	// status file.
+	var statusStore statusDatastore
+	if configParams.DatastoreType == "file" {
+		statusStore = filestore.NewStatusFile(configParams.FileDatastoreStatusFile)
+	} else {
+		statusStore = backendClient
+	}
+	dpConnector := newConnector(configParams, connToUsageRepUpdChan, statusStore, dpDriver, failureReportChan)
 
 	// If enabled, create a server for the policy sync API.  This allows clients to connect to
 	// Felix over a socket and receive policy updates.
@@ -324,9 +365,15 @@ configRetry:
 			"Policy sync API enabled.  Creating the policy sync server.")
 		toPolicySync := make(chan interface{})
 		policySyncUIDAllocator := policysync.NewUIDAllocator()
-		policySyncProcessor = policysync.NewProcessor(toPolicySync)
+		policySyncProcessor = policysync.NewProcessor(toPolicySync, configParams.PolicySyncMaxQueueLen)
+		var policySyncStatusUpdates chan<- interface{}
+		if configParams.EndpointReportingEnabled {
+			// Errors reported by policy sync clients are merged into the endpoint status.
+			policySyncStatusUpdates = dpConnector.StatusUpdatesFromDataplane
+		}
 		policySyncServer = policysync.NewServer(
 			policySyncProcessor.JoinUpdates,
+			policySyncStatusUpdates,
 			policySyncUIDAllocator.NextUID,
 		)
 		policySyncAPIBinder = binder.NewBinder(configParams.PolicySyncPathPrefix)
@@ -351,6 +398,24 @@ configRetry:
 	var syncer Startable
 	var typhaConnection *syncclient.SyncerClient
 	syncerToValidator := calc.NewSyncerCallbacksDecoupler()
+	var syncerCallbacks bapi.SyncerCallbacks = syncerToValidator
+	if configParams.DebugSyncerRecordingFile != "" {
+		// Record the updates from the syncer so that they can be replayed with felix-replay.
+		// Felix restarts itself when its config changes so we start a new file each time
+		// rather than overwriting the recording that led up to the restart.
+		recPath := recorder.TimestampedPath(configParams.DebugSyncerRecordingFile, time.Now())
+		log.WithField("file", recPath).Warn(
+			"Recording datastore updates; this is a debug feature and may slow Felix down.")
+		recFile, err := os.OpenFile(recPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			log.WithError(err).Panic("Failed to create syncer recording file")
+		}
+		syncerCallbacks, err = recorder.New(recFile, configParams.FelixHostname,
+			buildinfo.GitVersion, recordingFlushInterval, syncerToValidator)
+		if err != nil {
+			log.WithError(err).Panic("Failed to start syncer recording")
+		}
+	}
 	if typhaAddr != "" {
 		// Use a remote Syncer, via the Typha server.
 		log.WithField("addr", typhaAddr).Info("Connecting to Typha.")
@@ -360,15 +425,23 @@ configRetry:
 			configParams.FelixHostname,
 			fmt.Sprintf("Revision: %s; Build date: %s",
 				buildinfo.GitRevision, buildinfo.BuildDate),
-			syncerToValidator,
+			syncerCallbacks,
 			&syncclient.Options{
 				ReadTimeout:  configParams.TyphaReadTimeout,
 				WriteTimeout: configParams.TyphaWriteTimeout,
 			},
 		)
+	} else if configParams.DatastoreType == "file" {
+		// Watch the local resource files.
+		syncer = filestore.NewSyncer(configParams.FileDatastorePath, syncerCallbacks)
 	} else {
-		// Use the syncer locally.
-		syncer = felixsyncer.New(backendClient, syncerToValidator)
+		// Use the syncer locally.  As well as the Felix syncer's updates, it sends the v3
+		// Node resources, which the calculation graph uses for the nodes' IPv6 addresses,
+		// and, if we're programming routes to other hosts, the IPAM blocks.  Typha doesn't
+		// send those yet.  Only the etcd datastore stores IPAM blocks.
+		watchBlocks := configParams.DatastoreType == "etcdv3" &&
+			(configParams.RemoteRoutesEnabled || configParams.VXLANEnabled)
+		syncer = localsyncer.New(backendClient, syncerCallbacks, watchBlocks)
 	}
 	log.WithField("syncer", syncer).Info("Created Syncer")
 
@@ -500,6 +573,11 @@ configRetry:
 		go servePrometheusMetrics(configParams)
 	}
 
+	if configParams.CalcGraphDebugEnabled {
+		log.Info("Calculation graph debug API enabled.  Starting server.")
+		go serveCalcGraphDebug(configParams, asyncCalcGraph)
+	}
+
 	// On receipt of SIGUSR1, write out heap profile.
 	logutils.DumpHeapMemoryOnSignal(configParams)
 
@@ -531,6 +609,20 @@ func servePrometheusMetrics(configParams *config.Config) {
 	}
 }
 
+// serveCalcGraphDebug serves the calculation graph's debug API.  Since it exposes the details of
+// the policy that applies to each endpoint, it only listens on localhost.
+func serveCalcGraphDebug(configParams *config.Config, asyncCalcGraph *calc.AsyncCalcGraph) {
+	handler := calc.NewDebugHandler(asyncCalcGraph)
+	addr := fmt.Sprintf("localhost:%v", configParams.CalcGraphDebugPort)
+	for {
+		log.WithField("addr", addr).Info("Starting calculation graph debug endpoint")
+		err := http.ListenAndServe(addr, handler)
+		log.WithError(err).Error(
+			"Calculation graph debug endpoint failed, trying to restart it...")
+		time.Sleep(1 * time.Second)
+	}
+}
+
 func monitorAndManageShutdown(failureReportChan <-chan string, driverCmd *exec.Cmd, stopSignalChans []chan<- bool) {
 	// Ask the runtime to tell us if we get a term/int signal.
 	signalChan := make(chan os.Signal, 1)
@@ -777,7 +869,7 @@ type DataplaneConnector struct {
 	InSync                     chan bool
 	failureReportChan          chan<- string
 	dataplane                  dp.DataplaneDriver
-	datastore                  bapi.Client
+	datastore                  statusDatastore
 	statusReporter             *statusrep.EndpointStatusReporter
 
 	datastoreInSync bool
@@ -789,9 +881,17 @@ type Startable interface {
 	Start()
 }
 
+// statusDatastore is the part of the datastore API that Felix uses to report its status and the
+// status of its endpoints.
+type statusDatastore interface {
+	List(ctx context.Context, list model.ListInterface, revision string) (*model.KVPairList, error)
+	Apply(ctx context.Context, object *model.KVPair) (*model.KVPair, error)
+	Delete(ctx context.Context, key model.Key, revision string) (*model.KVPair, error)
+}
+
 func newConnector(configParams *config.Config,
 	configUpdChan chan<- map[string]string,
-	datastore bapi.Client,
+	datastore statusDatastore,
 	dataplane dp.DataplaneDriver,
 	failureReportChan chan<- string,
 ) *DataplaneConnector {
@@ -879,14 +979,12 @@ func (fc *DataplaneConnector) handleProcessStatusUpdate(ctx context.Context, msg
 	}
 }
 
-var handledConfigChanges = set.From("CalicoVersion", "ClusterGUID", "ClusterType")
-
 func (fc *DataplaneConnector) sendMessagesToDataplaneDriver() {
 	defer func() {
 		fc.shutDownProcess("Failed to send messages to dataplane")
 	}()
 
-	var config map[string]string
+	var currentConfig map[string]string
 	for {
 		msg := <-fc.ToDataplane
 		switch msg := msg.(type) {
@@ -898,35 +996,35 @@ func (fc *DataplaneConnector) sendMessagesToDataplaneDriver() {
 				fc.InSync <- true
 			}
 		case *proto.ConfigUpdate:
-			if config != nil {
+			if currentConfig != nil {
 				log.WithFields(log.Fields{
-					"old": config,
+					"old": currentConfig,
 					"new": msg.Config,
 				}).Info("Config updated, checking whether we need to restart")
 				restartNeeded := false
 				for kNew, vNew := range msg.Config {
 					logCxt := log.WithFields(log.Fields{"key": kNew, "new": vNew})
-					if vOld, prs := config[kNew]; !prs {
+					if vOld, prs := currentConfig[kNew]; !prs {
 						logCxt = logCxt.WithField("updateType", "add")
 					} else if vNew != vOld {
 						logCxt = logCxt.WithFields(log.Fields{"old": vOld, "updateType": "update"})
 					} else {
 						continue
 					}
-					if handledConfigChanges.Contains(kNew) {
+					if config.ParamIsLiveReloadable(kNew) {
 						logCxt.Info("Config change can be handled without restart")
 						continue
 					}
 					logCxt.Warning("Config change requires restart")
 					restartNeeded = true
 				}
-				for kOld, vOld := range config {
+				for kOld, vOld := range currentConfig {
 					logCxt := log.WithFields(log.Fields{"key": kOld, "old": vOld, "updateType": "delete"})
 					if _, prs := msg.Config[kOld]; prs {
 						// Key was present in the message so we've handled above.
 						continue
 					}
-					if handledConfigChanges.Contains(kOld) {
+					if config.ParamIsLiveReloadable(kOld) {
 						logCxt.Info("Config change can be handled without restart")
 						continue
 					}
@@ -937,17 +1035,22 @@ func (fc *DataplaneConnector) sendMessagesToDataplaneDriver() {
 				if restartNeeded {
 					fc.shutDownProcess("config changed")
 				}
+
+				// All the changes can be applied live.  The dataplane driver applies the
+				// changes that affect it when we forward the message below; we're
+				// responsible for the logging config.
+				fc.applyLiveConfig(currentConfig, msg.Config)
 			}
 
 			// Take a copy of the config to compare against next time.
-			config = make(map[string]string)
+			currentConfig = make(map[string]string)
 			for k, v := range msg.Config {
-				config[k] = v
+				currentConfig[k] = v
 			}
 
 			if fc.configUpdChan != nil {
 				// Send the config over to the usage reporter.
-				fc.configUpdChan <- config
+				fc.configUpdChan <- currentConfig
 			}
 		case *calc.DatastoreNotReady:
 			log.Warn("Datastore became unready, need to restart.")
@@ -959,6 +1062,39 @@ func (fc *DataplaneConnector) sendMessagesToDataplaneDriver() {
 	}
 }
 
+// applyLiveConfig applies the live-reloadable parameters that are owned by the main Felix
+// process, i.e. the log levels.  Reconfiguring logging replaces the log destinations so we only
+// do it if one of the logging parameters has changed.  We parse our own copy of the config
+// because the shared Config object is owned by the calculation graph.
+func (fc *DataplaneConnector) applyLiveConfig(oldRawConfig, rawConfig map[string]string) {
+	if !loggingConfigChanged(oldRawConfig, rawConfig) {
+		return
+	}
+	newConfig, err := config.NewFromRawValues(rawConfig)
+	if err != nil {
+		log.WithError(err).Error("Failed to parse updated config, unable to apply log levels")
+		return
+	}
+	logutils.ConfigureLogging(newConfig)
+}
+
+func loggingConfigChanged(oldRawConfig, rawConfig map[string]string) bool {
+	isLoggingParam := func(name string) bool {
+		return strings.HasPrefix(name, "LogSeverity") || strings.HasPrefix(name, "LogFile")
+	}
+	for k, v := range rawConfig {
+		if isLoggingParam(k) && oldRawConfig[k] != v {
+			return true
+		}
+	}
+	for k := range oldRawConfig {
+		if _, prs := rawConfig[k]; isLoggingParam(k) && !prs {
+			return true
+		}
+	}
+	return false
+}
+
 func (fc *DataplaneConnector) shutDownProcess(reason string) {
 	// Send a failure report to the managed shutdown thread then give it
 	// a few seconds to do the shutdown.
@@ -0,0 +1,124 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore
+
+import (
+	"errors"
+	"fmt"
+
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/backend/syncersv1/updateprocessors"
+	"github.com/projectcalico/libcalico-go/lib/backend/watchersyncer"
+)
+
+// ErrNotReady is returned by LoadConfig if the resources say that the datastore isn't ready.
+var ErrNotReady = errors.New("datastore ready flag is not set")
+
+// newUpdateProcessors returns the processors that convert each kind of v3 resource into the v1
+// model that the calculation graph uses; they're the same ones that Felix's syncer uses.
+func newUpdateProcessors() map[string]watchersyncer.SyncerUpdateProcessor {
+	return map[string]watchersyncer.SyncerUpdateProcessor{
+		apiv3.KindClusterInformation:  updateprocessors.NewClusterInfoUpdateProcessor(),
+		apiv3.KindFelixConfiguration:  updateprocessors.NewFelixConfigUpdateProcessor(),
+		apiv3.KindGlobalNetworkPolicy: updateprocessors.NewGlobalNetworkPolicyUpdateProcessor(),
+		apiv3.KindGlobalNetworkSet:    updateprocessors.NewGlobalNetworkSetUpdateProcessor(),
+		apiv3.KindHostEndpoint:        updateprocessors.NewHostEndpointUpdateProcessor(),
+		apiv3.KindIPPool:              updateprocessors.NewIPPoolUpdateProcessor(),
+		apiv3.KindNetworkPolicy:       updateprocessors.NewNetworkPolicyUpdateProcessor(),
+		apiv3.KindNode:                updateprocessors.NewFelixNodeUpdateProcessor(),
+		apiv3.KindProfile:             updateprocessors.NewProfileUpdateProcessor(),
+		apiv3.KindWorkloadEndpoint:    updateprocessors.NewWorkloadEndpointUpdateProcessor(),
+	}
+}
+
+// ConvertResources converts v3 resources, as returned by LoadResourceDir, into the updates that
+// Felix's local syncer would send for them.  The updates start with a datastore ready flag, which a
+// ClusterInformation resource may override.
+func ConvertResources(kvs []*model.KVPair) ([]api.Update, error) {
+	processors := newUpdateProcessors()
+	for _, p := range processors {
+		p.OnSyncerStarting()
+	}
+	updates := []api.Update{{
+		KVPair:     model.KVPair{Key: model.ReadyFlagKey{}, Value: true},
+		UpdateType: api.UpdateTypeKVNew,
+	}}
+	for _, kv := range kvs {
+		key := kv.Key.(model.ResourceKey)
+		p := processors[key.Kind]
+		if p == nil {
+			return nil, fmt.Errorf("no update processor for kind %q", key.Kind)
+		}
+		v1KVs, err := p.Process(kv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert %s %s: %v", key.Kind, key.Name, err)
+		}
+		for _, v1KV := range v1KVs {
+			if v1KV.Value == nil {
+				// The processors emit deletions for, for example, config fields that
+				// aren't set; there's nothing to delete here.
+				continue
+			}
+			updates = append(updates, api.Update{
+				KVPair:     *v1KV,
+				UpdateType: api.UpdateTypeKVNew,
+			})
+		}
+		if key.Kind == apiv3.KindNode {
+			// As with the local syncer, the calculation graph also gets the Node itself,
+			// for its IPv6 address.
+			updates = append(updates, api.Update{
+				KVPair:     *kv,
+				UpdateType: api.UpdateTypeKVNew,
+			})
+		}
+	}
+	return updates, nil
+}
+
+// LoadConfig loads the resources in dir and returns the global Felix configuration and the
+// configuration for the given host, in the same form as Felix loads them from a datastore.  It
+// returns ErrNotReady if a ClusterInformation resource has cleared the ready flag.
+func LoadConfig(dir, hostname string) (globalConfig, hostConfig map[string]string, err error) {
+	kvs, err := LoadResourceDir(dir)
+	if err != nil {
+		return
+	}
+	updates, err := ConvertResources(kvs)
+	if err != nil {
+		return
+	}
+	globalConfig = make(map[string]string)
+	hostConfig = make(map[string]string)
+	ready := false
+	for _, u := range updates {
+		switch k := u.Key.(type) {
+		case model.ReadyFlagKey:
+			ready = u.Value == true
+		case model.GlobalConfigKey:
+			globalConfig[k.Name] = u.Value.(string)
+		case model.HostConfigKey:
+			if k.Hostname == hostname {
+				hostConfig[k.Name] = u.Value.(string)
+			}
+		}
+	}
+	if !ready {
+		err = ErrNotReady
+	}
+	return
+}
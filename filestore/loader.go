@@ -0,0 +1,160 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package filestore lets Felix use a directory of Calico v3 resource files as its datastore, for
+// hosts that have no etcd or Kubernetes API server.  It loads and validates the resources, feeds
+// them to the calculation graph through a Syncer that watches the directory for changes, and
+// keeps Felix's status reports in a local file.
+package filestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	validator "github.com/projectcalico/libcalico-go/lib/validator/v3"
+)
+
+// newResourceFuncs maps the kinds of resource that we load to functions that create an empty
+// resource of that kind.
+var newResourceFuncs = map[string]func() interface{}{
+	apiv3.KindClusterInformation:  func() interface{} { return apiv3.NewClusterInformation() },
+	apiv3.KindFelixConfiguration:  func() interface{} { return apiv3.NewFelixConfiguration() },
+	apiv3.KindGlobalNetworkPolicy: func() interface{} { return apiv3.NewGlobalNetworkPolicy() },
+	apiv3.KindGlobalNetworkSet:    func() interface{} { return apiv3.NewGlobalNetworkSet() },
+	apiv3.KindHostEndpoint:        func() interface{} { return apiv3.NewHostEndpoint() },
+	apiv3.KindIPPool:              func() interface{} { return apiv3.NewIPPool() },
+	apiv3.KindNetworkPolicy:       func() interface{} { return apiv3.NewNetworkPolicy() },
+	apiv3.KindNode:                func() interface{} { return apiv3.NewNode() },
+	apiv3.KindProfile:             func() interface{} { return apiv3.NewProfile() },
+	apiv3.KindWorkloadEndpoint:    func() interface{} { return apiv3.NewWorkloadEndpoint() },
+}
+
+// namespacedKinds are the kinds that belong to a namespace; they default to the "default"
+// namespace, as in calicoctl.
+var namespacedKinds = map[string]bool{
+	apiv3.KindNetworkPolicy:    true,
+	apiv3.KindWorkloadEndpoint: true,
+}
+
+// resourceHeader holds the fields that we need to decode before we know the type of a resource.
+type resourceHeader struct {
+	metav1.TypeMeta
+	Metadata metav1.ObjectMeta `json:"metadata"`
+}
+
+// LoadResourceDir loads every .yaml, .yml and .json file under dir, in lexical order.  Each file
+// may hold several resources, separated by "---".  The resources are validated as calicoctl
+// would and returned as KVPairs, keyed by model.ResourceKey.
+func LoadResourceDir(dir string) ([]*model.KVPair, error) {
+	var kvs []*model.KVPair
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			log.WithField("file", path).Debug("Skipping file that isn't YAML or JSON")
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fileKVs, err := LoadResources(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		kvs = append(kvs, fileKVs...)
+		return nil
+	})
+	return kvs, err
+}
+
+// LoadResources loads a stream of YAML or JSON resources.
+func LoadResources(r io.Reader) ([]*model.KVPair, error) {
+	var kvs []*model.KVPair
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for i := 1; ; i++ {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if err == io.EOF {
+			return kvs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("resource %d: %v", i, err)
+		}
+		if len(raw) == 0 || string(raw) == "null" {
+			// Empty document, for example after a trailing "---".
+			continue
+		}
+		kv, err := parseResource(raw)
+		if err != nil {
+			return nil, fmt.Errorf("resource %d: %v", i, err)
+		}
+		kvs = append(kvs, kv)
+	}
+}
+
+func parseResource(raw []byte) (*model.KVPair, error) {
+	var header resourceHeader
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, err
+	}
+	if header.APIVersion != apiv3.GroupVersionCurrent {
+		return nil, fmt.Errorf("unsupported apiVersion %q, expected %q",
+			header.APIVersion, apiv3.GroupVersionCurrent)
+	}
+	newResource, ok := newResourceFuncs[header.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported kind %q", header.Kind)
+	}
+	if header.Metadata.Name == "" {
+		return nil, fmt.Errorf("%s has no name", header.Kind)
+	}
+	resource := newResource()
+	if err := json.Unmarshal(raw, resource); err != nil {
+		return nil, fmt.Errorf("%s %s: %v", header.Kind, header.Metadata.Name, err)
+	}
+
+	key := model.ResourceKey{
+		Kind: header.Kind,
+		Name: header.Metadata.Name,
+	}
+	if namespacedKinds[header.Kind] {
+		key.Namespace = header.Metadata.Namespace
+		if key.Namespace == "" {
+			key.Namespace = "default"
+			resource.(metav1.ObjectMetaAccessor).GetObjectMeta().SetNamespace("default")
+		}
+	}
+	if err := validator.Validate(resource); err != nil {
+		return nil, fmt.Errorf("%s %s: %v", header.Kind, header.Metadata.Name, err)
+	}
+	return &model.KVPair{Key: key, Value: resource}, nil
+}
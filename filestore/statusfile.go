@@ -0,0 +1,164 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+// StatusFile stands in for the datastore when Felix reports its own status and the status of
+// its endpoints.  It keeps the status KVs in memory and rewrites the file after each change.
+// The file holds a JSON object that maps the datastore path of each key to its value, in the
+// same JSON form that the etcdv3 datastore stores.
+//
+// It is safe to use from multiple goroutines.
+type StatusFile struct {
+	path string
+
+	lock sync.Mutex
+	kvs  map[string]*model.KVPair
+}
+
+// NewStatusFile returns a StatusFile that writes to the given path.  It starts with the
+// contents of any existing file so that the status reporter can clean up the entries of
+// endpoints that went away while Felix was down.
+func NewStatusFile(path string) *StatusFile {
+	f := &StatusFile{
+		path: path,
+		kvs:  map[string]*model.KVPair{},
+	}
+	if err := f.load(); err != nil {
+		log.WithError(err).WithField("file", path).Warn("Failed to load status file, starting afresh")
+		f.kvs = map[string]*model.KVPair{}
+	}
+	return f
+}
+
+func (f *StatusFile) load() error {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for path, value := range raw {
+		key := model.KeyFromDefaultPath(path)
+		if key == nil {
+			log.WithField("path", path).Warn("Ignoring unknown key in status file")
+			continue
+		}
+		v, err := model.ParseValue(key, value)
+		if err != nil {
+			return err
+		}
+		f.kvs[path] = &model.KVPair{Key: key, Value: v}
+	}
+	return nil
+}
+
+// List returns the KVs that match the list options, ordered by path.
+func (f *StatusFile) List(ctx context.Context, list model.ListInterface, revision string) (*model.KVPairList, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var paths []string
+	for path := range f.kvs {
+		if list.KeyFromDefaultPath(path) != nil {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	result := &model.KVPairList{}
+	for _, path := range paths {
+		kv := *f.kvs[path]
+		result.KVPairs = append(result.KVPairs, &kv)
+	}
+	return result, nil
+}
+
+// Apply stores the KV and rewrites the file.  The TTL of the KV is ignored.
+func (f *StatusFile) Apply(ctx context.Context, kv *model.KVPair) (*model.KVPair, error) {
+	path, err := model.KeyToDefaultPath(kv.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	stored := *kv
+	f.kvs[path] = &stored
+	return kv, f.write()
+}
+
+// Delete removes the key and rewrites the file.  Like the datastore, it returns
+// ErrorResourceDoesNotExist if the key isn't present.
+func (f *StatusFile) Delete(ctx context.Context, key model.Key, revision string) (*model.KVPair, error) {
+	path, err := model.KeyToDefaultPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	kv, ok := f.kvs[path]
+	if !ok {
+		return nil, cerrors.ErrorResourceDoesNotExist{Identifier: key}
+	}
+	delete(f.kvs, path)
+	return kv, f.write()
+}
+
+// write replaces the file with the current KVs.  It writes to a temporary file and renames it
+// into place so that readers never see a partial file.
+func (f *StatusFile) write() error {
+	raw := map[string]json.RawMessage{}
+	for path, kv := range f.kvs {
+		value, err := model.SerializeValue(kv)
+		if err != nil {
+			return err
+		}
+		raw[path] = value
+	}
+	data, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	tmpPath := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, f.path)
+}
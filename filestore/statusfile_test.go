@@ -0,0 +1,113 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/projectcalico/felix/filestore"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+var _ = Describe("StatusFile", func() {
+	var dir, path string
+	var statusFile *filestore.StatusFile
+	ctx := context.Background()
+
+	wepStatusKey := model.WorkloadEndpointStatusKey{
+		Hostname:       "host1",
+		OrchestratorID: "openstack",
+		WorkloadID:     "vm1",
+		EndpointID:     "tap1",
+	}
+	otherHostStatusKey := model.WorkloadEndpointStatusKey{
+		Hostname:       "host2",
+		OrchestratorID: "openstack",
+		WorkloadID:     "vm2",
+		EndpointID:     "tap2",
+	}
+	reportKey := model.ActiveStatusReportKey{Hostname: "host1"}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "filestore")
+		Expect(err).NotTo(HaveOccurred())
+		// The directory is created on the first write.
+		path = filepath.Join(dir, "run", "status.json")
+		statusFile = filestore.NewStatusFile(path)
+
+		for _, key := range []model.Key{wepStatusKey, otherHostStatusKey} {
+			_, err = statusFile.Apply(ctx, &model.KVPair{
+				Key:   key,
+				Value: &model.WorkloadEndpointStatus{Status: "up"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, err = statusFile.Apply(ctx, &model.KVPair{
+			Key:   reportKey,
+			Value: &model.StatusReport{Timestamp: "2018-01-01T00:00:00Z", UptimeSeconds: 10},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	listHost1 := func(f *filestore.StatusFile) []*model.KVPair {
+		kvs, err := f.List(ctx, model.WorkloadEndpointStatusListOptions{Hostname: "host1"}, "")
+		Expect(err).NotTo(HaveOccurred())
+		return kvs.KVPairs
+	}
+
+	It("should list the matching statuses", func() {
+		Expect(listHost1(statusFile)).To(Equal([]*model.KVPair{{
+			Key:   wepStatusKey,
+			Value: &model.WorkloadEndpointStatus{Status: "up"},
+		}}))
+	})
+
+	It("should load the statuses from an existing file", func() {
+		reloaded := filestore.NewStatusFile(path)
+		Expect(listHost1(reloaded)).To(Equal(listHost1(statusFile)))
+		kvs, err := reloaded.List(ctx, model.WorkloadEndpointStatusListOptions{}, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kvs.KVPairs).To(HaveLen(2))
+	})
+
+	It("should delete a status", func() {
+		_, err := statusFile.Delete(ctx, wepStatusKey, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(listHost1(statusFile)).To(BeEmpty())
+		Expect(listHost1(filestore.NewStatusFile(path))).To(BeEmpty())
+	})
+
+	It("should return ErrorResourceDoesNotExist when deleting a missing status", func() {
+		_, err := statusFile.Delete(ctx, model.HostEndpointStatusKey{Hostname: "host1", EndpointID: "eth0"}, "")
+		Expect(err).To(BeAssignableToTypeOf(cerrors.ErrorResourceDoesNotExist{}))
+	})
+
+	It("should start afresh if the file is corrupt", func() {
+		Expect(ioutil.WriteFile(path, []byte("{"), 0644)).To(Succeed())
+		Expect(listHost1(filestore.NewStatusFile(path))).To(BeEmpty())
+	})
+})
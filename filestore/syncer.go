@@ -0,0 +1,159 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+const (
+	// settleTime is how long the Syncer waits after a change to the directory before reloading
+	// it, so that an editor's write-and-rename, or a batch of copied files, is picked up as one
+	// change.
+	settleTime = 100 * time.Millisecond
+	// retryInterval is how often the Syncer retries if it can't load the resources at start
+	// of day.
+	retryInterval = 1 * time.Second
+)
+
+// Syncer implements the api.SyncerCallbacks contract over a directory of resource files.  It
+// sends the resources that it finds at start of day, followed by InSync, then it watches the
+// directory and sends the difference each time that the files change.
+//
+// If a change leaves the files invalid, for example because a file is only half written, the
+// Syncer logs an error and keeps the last good state until the files are fixed.
+type Syncer struct {
+	dir       string
+	callbacks api.SyncerCallbacks
+
+	// current maps the default path of each key that we've sent to its KV.
+	current map[string]model.KVPair
+}
+
+func NewSyncer(dir string, callbacks api.SyncerCallbacks) *Syncer {
+	return &Syncer{
+		dir:       dir,
+		callbacks: callbacks,
+		current:   map[string]model.KVPair{},
+	}
+}
+
+func (s *Syncer) Start() {
+	go s.loop()
+}
+
+func (s *Syncer) loop() {
+	s.callbacks.OnStatusUpdated(api.WaitForDatastore)
+	// Start watching before the initial load so that we can't miss a change.
+	w, err := newDirWatcher(s.dir)
+	if err != nil {
+		log.WithError(err).Panic("Failed to watch resource directory")
+	}
+
+	s.callbacks.OnStatusUpdated(api.ResyncInProgress)
+	for {
+		err := s.resync(w)
+		if err == nil {
+			break
+		}
+		log.WithError(err).WithField("dir", s.dir).Error("Failed to load resources, will retry")
+		time.Sleep(retryInterval)
+	}
+	s.callbacks.OnStatusUpdated(api.InSync)
+
+	for range w.C {
+		time.Sleep(settleTime)
+		// Absorb any other changes that happened while we were waiting.
+		select {
+		case <-w.C:
+		default:
+		}
+		log.WithField("dir", s.dir).Info("Resource files changed, reloading")
+		if err := s.resync(w); err != nil {
+			log.WithError(err).WithField("dir", s.dir).Error(
+				"Failed to reload resources; keeping the previous resources until the files are fixed")
+		}
+	}
+}
+
+// resync reloads the directory and sends the updates that take the calculation graph from the
+// last state that we sent to the new one.
+func (s *Syncer) resync(w *dirWatcher) error {
+	// Watch any new subdirectories before we read them.
+	if err := w.watchTree(); err != nil {
+		return err
+	}
+	kvs, err := LoadResourceDir(s.dir)
+	if err != nil {
+		return err
+	}
+	updates, err := ConvertResources(kvs)
+	if err != nil {
+		return err
+	}
+
+	// Later updates for the same key win, for example a ClusterInformation resource's ready
+	// flag overrides the default one.
+	latest := map[string]model.KVPair{}
+	var paths []string
+	for _, u := range updates {
+		path, err := model.KeyToDefaultPath(u.Key)
+		if err != nil {
+			return err
+		}
+		if _, ok := latest[path]; !ok {
+			paths = append(paths, path)
+		}
+		latest[path] = u.KVPair
+	}
+
+	var changes []api.Update
+	for _, path := range paths {
+		kv := latest[path]
+		old, ok := s.current[path]
+		if !ok {
+			changes = append(changes, api.Update{KVPair: kv, UpdateType: api.UpdateTypeKVNew})
+		} else if !reflect.DeepEqual(old.Value, kv.Value) {
+			changes = append(changes, api.Update{KVPair: kv, UpdateType: api.UpdateTypeKVUpdated})
+		}
+	}
+	var deletedPaths []string
+	for path := range s.current {
+		if _, ok := latest[path]; !ok {
+			deletedPaths = append(deletedPaths, path)
+		}
+	}
+	sort.Strings(deletedPaths)
+	for _, path := range deletedPaths {
+		changes = append(changes, api.Update{
+			KVPair:     model.KVPair{Key: s.current[path].Key},
+			UpdateType: api.UpdateTypeKVDeleted,
+		})
+	}
+
+	s.current = latest
+	log.WithField("numChanges", len(changes)).Debug("Loaded resources")
+	if len(changes) > 0 {
+		s.callbacks.OnUpdates(changes)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/projectcalico/felix/filestore"
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+const policyYAML = `
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: allow-frontend
+spec:
+  selector: app == 'frontend'
+  ingress:
+  - action: Allow
+`
+
+const configYAML = `
+apiVersion: projectcalico.org/v3
+kind: FelixConfiguration
+metadata:
+  name: default
+spec:
+  interfacePrefix: tap
+---
+apiVersion: projectcalico.org/v3
+kind: FelixConfiguration
+metadata:
+  name: node.host1
+spec:
+  logSeverityScreen: Debug
+---
+apiVersion: projectcalico.org/v3
+kind: FelixConfiguration
+metadata:
+  name: node.host2
+spec:
+  logSeverityScreen: Warning
+`
+
+const nodeYAML = `
+apiVersion: projectcalico.org/v3
+kind: Node
+metadata:
+  name: host1
+spec:
+  bgp:
+    ipv4Address: 10.0.0.1/24
+    ipv6Address: fd00::1/64
+`
+
+// callbackRecorder is an api.SyncerCallbacks that remembers what it was called with.  The
+// Syncer calls it from its own goroutine.
+type callbackRecorder struct {
+	lock     sync.Mutex
+	statuses []api.SyncStatus
+	updates  []keyAndType
+}
+
+type keyAndType struct {
+	Key  model.Key
+	Type api.UpdateType
+}
+
+func (c *callbackRecorder) OnStatusUpdated(status api.SyncStatus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.statuses = append(c.statuses, status)
+}
+
+func (c *callbackRecorder) OnUpdates(updates []api.Update) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, u := range updates {
+		c.updates = append(c.updates, keyAndType{u.Key, u.UpdateType})
+	}
+}
+
+func (c *callbackRecorder) Statuses() []api.SyncStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]api.SyncStatus(nil), c.statuses...)
+}
+
+func (c *callbackRecorder) Updates() []keyAndType {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]keyAndType(nil), c.updates...)
+}
+
+var policyKey = model.PolicyKey{Name: "allow-frontend"}
+
+var _ = Describe("Syncer", func() {
+	var dir string
+	var callbacks *callbackRecorder
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "filestore")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "policy.yaml"), []byte(policyYAML), 0644)).To(Succeed())
+		callbacks = &callbackRecorder{}
+		filestore.NewSyncer(dir, callbacks).Start()
+		Eventually(callbacks.Statuses).Should(Equal([]api.SyncStatus{
+			api.WaitForDatastore,
+			api.ResyncInProgress,
+			api.InSync,
+		}))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should send the initial resources before InSync", func() {
+		Expect(callbacks.Updates()).To(Equal([]keyAndType{
+			{model.ReadyFlagKey{}, api.UpdateTypeKVNew},
+			{policyKey, api.UpdateTypeKVNew},
+		}))
+	})
+
+	It("should send an update when a resource changes", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, "policy.yaml"),
+			[]byte(policyYAML+"  - action: Deny\n"), 0644)).To(Succeed())
+		Eventually(callbacks.Updates).Should(HaveLen(3))
+		Expect(callbacks.Updates()[2]).To(Equal(keyAndType{policyKey, api.UpdateTypeKVUpdated}))
+	})
+
+	It("should send a deletion when a file is removed", func() {
+		Expect(os.Remove(filepath.Join(dir, "policy.yaml"))).To(Succeed())
+		Eventually(callbacks.Updates).Should(HaveLen(3))
+		Expect(callbacks.Updates()[2]).To(Equal(keyAndType{policyKey, api.UpdateTypeKVDeleted}))
+	})
+
+	It("should pick up files in new subdirectories", func() {
+		Expect(os.Mkdir(filepath.Join(dir, "config"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "config", "felix.yaml"), []byte(configYAML), 0644)).To(Succeed())
+		Eventually(callbacks.Updates).Should(ContainElement(
+			keyAndType{model.GlobalConfigKey{Name: "InterfacePrefix"}, api.UpdateTypeKVNew},
+		))
+	})
+
+	It("should send a Node both converted and as a resource", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, "node.yaml"), []byte(nodeYAML), 0644)).To(Succeed())
+		Eventually(callbacks.Updates).Should(ContainElement(
+			keyAndType{model.HostIPKey{Hostname: "host1"}, api.UpdateTypeKVNew},
+		))
+		Expect(callbacks.Updates()).To(ContainElement(
+			keyAndType{model.ResourceKey{Kind: apiv3.KindNode, Name: "host1"}, api.UpdateTypeKVNew},
+		))
+	})
+
+	It("should keep the previous resources while a file is invalid", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, "policy.yaml"), []byte("kind: [\n"), 0644)).To(Succeed())
+		Consistently(callbacks.Updates, "300ms").Should(HaveLen(2))
+
+		Expect(ioutil.WriteFile(filepath.Join(dir, "policy.yaml"), []byte(configYAML), 0644)).To(Succeed())
+		Eventually(callbacks.Updates).Should(ContainElement(keyAndType{policyKey, api.UpdateTypeKVDeleted}))
+	})
+})
+
+var _ = Describe("LoadConfig", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "filestore")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "felix.yaml"), []byte(configYAML), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should return the global and per-host config", func() {
+		globalConfig, hostConfig, err := filestore.LoadConfig(dir, "host1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(globalConfig).To(Equal(map[string]string{"InterfacePrefix": "tap"}))
+		Expect(hostConfig).To(Equal(map[string]string{"LogSeverityScreen": "Debug"}))
+	})
+
+	It("should return ErrNotReady if the ClusterInformation isn't ready", func() {
+		Expect(ioutil.WriteFile(filepath.Join(dir, "cluster.yaml"), []byte(`
+apiVersion: projectcalico.org/v3
+kind: ClusterInformation
+metadata:
+  name: default
+spec:
+  datastoreReady: false
+`), 0644)).To(Succeed())
+		_, _, err := filestore.LoadConfig(dir, "host1")
+		Expect(err).To(Equal(filestore.ErrNotReady))
+	})
+})
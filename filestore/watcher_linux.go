@@ -0,0 +1,82 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_CLOSE_WRITE | unix.IN_MODIFY |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// dirWatcher uses inotify to watch a directory tree.  It sends to C when anything in the tree
+// changes; we reload the whole tree on each change so we don't need to decode the events.
+type dirWatcher struct {
+	dir string
+	fd  int
+	C   chan struct{}
+}
+
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &dirWatcher{
+		dir: dir,
+		fd:  fd,
+		C:   make(chan struct{}, 1),
+	}
+	go w.loopReadingEvents()
+	return w, nil
+}
+
+// watchTree adds a watch for the directory and each of its subdirectories.  Adding a watch for
+// a directory that is already watched is a no-op and the kernel removes the watches of deleted
+// directories so it is safe to call repeatedly.
+func (w *dirWatcher) watchTree() error {
+	return filepath.Walk(w.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		_, err = unix.InotifyAddWatch(w.fd, path, watchMask)
+		return err
+	})
+}
+
+func (w *dirWatcher) loopReadingEvents() {
+	buf := make([]byte, 64*1024)
+	for {
+		_, err := unix.Read(w.fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Panic("Failed to read inotify events")
+		}
+		select {
+		case w.C <- struct{}{}:
+		default:
+			// There's already a change pending.
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// +build !linux
+
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore
+
+import (
+	"time"
+)
+
+// pollInterval is how often we reload the directory on platforms that don't have inotify.
+const pollInterval = 10 * time.Second
+
+// dirWatcher signals C periodically so that the Syncer polls the directory for changes.
+type dirWatcher struct {
+	C <-chan struct{}
+}
+
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	c := make(chan struct{})
+	go func() {
+		for range time.Tick(pollInterval) {
+			c <- struct{}{}
+		}
+	}()
+	return &dirWatcher{C: c}, nil
+}
+
+func (w *dirWatcher) watchTree() error {
+	return nil
+}
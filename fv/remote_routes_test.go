@@ -0,0 +1,85 @@
+// +build fvtests
+
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fv_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"net"
+
+	"github.com/projectcalico/felix/fv/containers"
+	"github.com/projectcalico/felix/fv/utils"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+)
+
+// These tests start from the datastore: Felix has to learn the IPAM blocks through its syncer
+// and program the routes to them.
+var _ = Context("with remote routes enabled and IPAM blocks in etcd", func() {
+
+	var (
+		etcd    *containers.Container
+		felixes []*containers.Felix
+		client  client.Interface
+	)
+
+	BeforeEach(func() {
+		options := containers.DefaultTopologyOptions()
+		options.ExtraEnvVars["FELIX_REMOTEROUTESENABLED"] = "true"
+		felixes, etcd, client = containers.StartNNodeEtcdTopology(2, options)
+	})
+
+	AfterEach(func() {
+		if CurrentGinkgoTestDescription().Failed {
+			for _, felix := range felixes {
+				felix.Exec("ip", "r")
+			}
+			etcd.Exec("etcdctl", "ls", "--recursive", "/")
+		}
+		for _, felix := range felixes {
+			felix.Stop()
+		}
+		etcd.Stop()
+	})
+
+	routesTo := func(felix *containers.Felix, cidr string) func() string {
+		return func() string {
+			out, err := felix.ExecOutput("ip", "route", "show", cidr)
+			Expect(err).NotTo(HaveOccurred())
+			return out
+		}
+	}
+
+	It("should program a route to another host's block via that host", func() {
+		// Assigning an IP on felixes[1] claims a block that's affine to that host.
+		v4IPs, _, err := client.IPAM().AutoAssign(utils.Ctx, ipam.AutoAssignArgs{
+			Num4:     1,
+			Hostname: felixes[1].Hostname,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v4IPs).To(HaveLen(1))
+		block := (&net.IPNet{
+			IP:   v4IPs[0].IP.Mask(net.CIDRMask(26, 32)),
+			Mask: net.CIDRMask(26, 32),
+		}).String()
+
+		Eventually(routesTo(felixes[0], block), "10s", "200ms").Should(
+			ContainSubstring("via " + felixes[1].IP))
+		Consistently(routesTo(felixes[1], block), "2s", "200ms").Should(BeEmpty())
+	})
+})
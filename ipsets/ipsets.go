@@ -47,6 +47,10 @@ type IPSets struct {
 	// Factory for command objects; shimmed for UT mocking.
 	newCmd cmdFactory
 
+	// netlink is non-nil if we're programming the IP sets using the kernel's netlink API
+	// instead of by running the ipset command.
+	netlink *ipsetNetlink
+
 	// Shim for time.Sleep()
 	sleep func(time.Duration)
 
@@ -101,6 +105,18 @@ func NewIPSetsWithShims(
 	}
 }
 
+// NewNetlinkIPSetsWithShims is an internal test constructor for an IPSets that uses the
+// netlink API.
+func NewNetlinkIPSetsWithShims(
+	ipVersionConfig *IPVersionConfig,
+	newSocket NetlinkSocketFactory,
+	sleep func(time.Duration),
+) *IPSets {
+	s := NewIPSetsWithShims(ipVersionConfig, nil, sleep)
+	s.netlink = newIPSetNetlink(newSocket)
+	return s
+}
+
 // AddOrReplaceIPSet queues up the creation (or replacement) of an IP set.  After the next call
 // to ApplyUpdates(), the IP sets will be replaced with the new contents and the set's metadata
 // will be updated as appropriate.
@@ -295,6 +311,10 @@ func (s *IPSets) tryResync() (numProblems int, err error) {
 		}).Info("Finished resync")
 	}()
 
+	if s.netlink != nil {
+		return s.tryResyncNetlink()
+	}
+
 	// Start an 'ipset list' child process, which will emit output of the following form:
 	//
 	// 	Name: test-100
@@ -404,88 +424,7 @@ func (s *IPSets) tryResync() (numProblems int, err error) {
 
 			// If we get here, we've read all the members of the IP set.  Compare them
 			// with what we expect and queue up any fixes.
-			numMissing := 0
-			ipSet.members.Iter(func(item interface{}) error {
-				m := item.(ipSetMember)
-				if dataplaneMembers.Contains(m) {
-					// Mainline (correct) case, member is in memory and in the
-					// dataplane.
-					dataplaneMembers.Discard(m)
-					return nil
-				}
-
-				logCxt := logCxt.WithField("member", m.String())
-				numProblems++
-				if ipSet.pendingDeletions.Contains(m) {
-					// We were trying to delete this item anyway, record that
-					// it's already gone.  We commonly hit this case when we're
-					// doing a retry after a failure and we're not sure which
-					// deltas got applied.
-					logCxt.Debug("Resync found member missing from " +
-						"dataplane. (Already queued for deletion.)")
-					ipSet.pendingDeletions.Discard(m)
-					return set.RemoveItem
-				}
-
-				// The item should be in the dataplane but it's not, queue up an
-				// add to add it back in.
-				if numMissing == 0 {
-					logCxt.Warning("Resync found member missing from " +
-						"dataplane. Queueing up an add to reinstate it. " +
-						"Further inconsistencies will be logged at DEBUG.")
-				} else {
-					logCxt.Debug("Found another member missing")
-				}
-				numMissing++
-				s.dirtyIPSetIDs.Add(ipSet.SetID)
-				ipSet.pendingAdds.Add(m)
-				return set.RemoveItem
-			})
-			if numMissing > 0 {
-				logCxt.WithField("numMissing", numMissing).Warn(
-					"Resync found members missing from dataplane.")
-			}
-
-			// Now look for any members which are in the dataplane but are not expected.
-			// We removed the members we were expecting above so dataplaneMembers now
-			// contains only unexpected members.
-			numExtras := 0
-			dataplaneMembers.Iter(func(item interface{}) error {
-				m := item.(ipSetMember)
-				logCxt := logCxt.WithField("member", m.String())
-
-				// Record that this member really is in the dataplane.
-				ipSet.members.Add(m)
-				numProblems++
-
-				if ipSet.pendingAdds.Contains(m) {
-					// We were trying to add this item anyway, record that
-					// it's already there.  We commonly hit this case when we're
-					// doing a retry after a failure and we're not sure which
-					// deltas got applied.
-					logCxt.Debug("Resync found unexpected member in " +
-						"dataplane. (Was about to add it anyway.)")
-					ipSet.pendingAdds.Discard(m)
-					return nil
-				}
-
-				// We weren't planning on adding this member, queue up a deletion.
-				if numExtras == 0 {
-					logCxt.Warning("Resync found unexpected member in " +
-						"dataplane. Queueing it for removal.  Further " +
-						"inconsistencies will be logged at DEBUG.")
-				} else {
-					logCxt.Debug("Found another extra member.")
-				}
-				numExtras++
-				s.dirtyIPSetIDs.Add(ipSet.SetID)
-				ipSet.pendingDeletions.Add(m)
-				return nil
-			})
-			if numExtras > 0 {
-				logCxt.WithField("numExtras", numExtras).Warn(
-					"Resync found extra members in dataplane.")
-			}
+			numProblems += s.reconcileMembers(ipSet, dataplaneMembers, logCxt)
 		}
 	}
 	closeErr := out.Close()
@@ -506,8 +445,103 @@ func (s *IPSets) tryResync() (numProblems int, err error) {
 		return
 	}
 
-	// Scan for IP sets that need to be cleaned up.  Create a whitelist containing the IP sets
-	// that we expect to be there.
+	s.queueLeftOverIPSetDeletions()
+	return
+}
+
+// reconcileMembers compares the members of an IP set that we read back from the dataplane with
+// the members that we expect it to have and queues up any fixes.  It returns the number of
+// inconsistencies found.
+func (s *IPSets) reconcileMembers(ipSet *ipSet, dataplaneMembers set.Set, logCxt *log.Entry) (numProblems int) {
+	numMissing := 0
+	ipSet.members.Iter(func(item interface{}) error {
+		m := item.(ipSetMember)
+		if dataplaneMembers.Contains(m) {
+			// Mainline (correct) case, member is in memory and in the
+			// dataplane.
+			dataplaneMembers.Discard(m)
+			return nil
+		}
+
+		logCxt := logCxt.WithField("member", m.String())
+		numProblems++
+		if ipSet.pendingDeletions.Contains(m) {
+			// We were trying to delete this item anyway, record that
+			// it's already gone.  We commonly hit this case when we're
+			// doing a retry after a failure and we're not sure which
+			// deltas got applied.
+			logCxt.Debug("Resync found member missing from " +
+				"dataplane. (Already queued for deletion.)")
+			ipSet.pendingDeletions.Discard(m)
+			return set.RemoveItem
+		}
+
+		// The item should be in the dataplane but it's not, queue up an
+		// add to add it back in.
+		if numMissing == 0 {
+			logCxt.Warning("Resync found member missing from " +
+				"dataplane. Queueing up an add to reinstate it. " +
+				"Further inconsistencies will be logged at DEBUG.")
+		} else {
+			logCxt.Debug("Found another member missing")
+		}
+		numMissing++
+		s.dirtyIPSetIDs.Add(ipSet.SetID)
+		ipSet.pendingAdds.Add(m)
+		return set.RemoveItem
+	})
+	if numMissing > 0 {
+		logCxt.WithField("numMissing", numMissing).Warn(
+			"Resync found members missing from dataplane.")
+	}
+
+	// Now look for any members which are in the dataplane but are not expected.
+	// We removed the members we were expecting above so dataplaneMembers now
+	// contains only unexpected members.
+	numExtras := 0
+	dataplaneMembers.Iter(func(item interface{}) error {
+		m := item.(ipSetMember)
+		logCxt := logCxt.WithField("member", m.String())
+
+		// Record that this member really is in the dataplane.
+		ipSet.members.Add(m)
+		numProblems++
+
+		if ipSet.pendingAdds.Contains(m) {
+			// We were trying to add this item anyway, record that
+			// it's already there.  We commonly hit this case when we're
+			// doing a retry after a failure and we're not sure which
+			// deltas got applied.
+			logCxt.Debug("Resync found unexpected member in " +
+				"dataplane. (Was about to add it anyway.)")
+			ipSet.pendingAdds.Discard(m)
+			return nil
+		}
+
+		// We weren't planning on adding this member, queue up a deletion.
+		if numExtras == 0 {
+			logCxt.Warning("Resync found unexpected member in " +
+				"dataplane. Queueing it for removal.  Further " +
+				"inconsistencies will be logged at DEBUG.")
+		} else {
+			logCxt.Debug("Found another extra member.")
+		}
+		numExtras++
+		s.dirtyIPSetIDs.Add(ipSet.SetID)
+		ipSet.pendingDeletions.Add(m)
+		return nil
+	})
+	if numExtras > 0 {
+		logCxt.WithField("numExtras", numExtras).Warn(
+			"Resync found extra members in dataplane.")
+	}
+	return
+}
+
+// queueLeftOverIPSetDeletions scans existingIPSetNames, which should have just been reloaded from
+// the dataplane, for Calico IP sets that we no longer need and queues them for deletion.
+func (s *IPSets) queueLeftOverIPSetDeletions() {
+	// Create a whitelist containing the IP sets that we expect to be there.
 	expectedIPSets := set.New()
 	for _, ipSet := range s.ipSetIDToIPSet {
 		expectedIPSets.Add(ipSet.MainIPSetName)
@@ -542,8 +576,6 @@ func (s *IPSets) tryResync() (numProblems int, err error) {
 		s.pendingIPSetDeletions.Add(setName)
 		return nil
 	})
-
-	return
 }
 
 // tryUpdates attempts to create and/or update IP sets.  It attempts to do the updates as a single
@@ -555,6 +587,10 @@ func (s *IPSets) tryUpdates() error {
 		return nil
 	}
 
+	if s.netlink != nil {
+		return s.tryUpdatesNetlink()
+	}
+
 	// Set up an ipset restore session.
 	countNumIPSetCalls.Inc()
 	cmd := s.newCmd("ipset", "restore")
@@ -623,6 +659,14 @@ func (s *IPSets) tryUpdates() error {
 	// If we get here, the writes were successful, reset the IP sets delta tracking now the
 	// dataplane should be in sync.  If we bail out above, then the resync logic will kick in
 	// and figure out how much of our update succeeded.
+	s.markDirtyIPSetsInSync()
+
+	return nil
+}
+
+// markDirtyIPSetsInSync updates our record of the dataplane after a successful update and clears
+// the dirty set.
+func (s *IPSets) markDirtyIPSetsInSync() {
 	s.dirtyIPSetIDs.Iter(func(item interface{}) error {
 		ipSet := s.ipSetIDToIPSet[item.(string)]
 		if ipSet.pendingReplace != nil {
@@ -644,8 +688,6 @@ func (s *IPSets) tryUpdates() error {
 		}
 		return set.RemoveItem
 	})
-
-	return nil
 }
 
 func (s *IPSets) writeUpdates(ipSet *ipSet, w io.Writer) error {
@@ -794,6 +836,9 @@ func (s *IPSets) ApplyDeletions() {
 
 func (s *IPSets) deleteIPSet(setName string) error {
 	s.logCxt.WithField("setName", setName).Info("Deleting IP set.")
+	if s.netlink != nil {
+		return s.deleteIPSetNetlink(setName)
+	}
 	cmd := s.newCmd("ipset", "destroy", string(setName))
 	if output, err := cmd.CombinedOutput(); err != nil {
 		s.logCxt.WithError(err).WithFields(log.Fields{
@@ -810,6 +855,10 @@ func (s *IPSets) deleteIPSet(setName string) error {
 }
 
 func (s *IPSets) dumpIPSetsToLog() {
+	if s.netlink != nil {
+		s.dumpIPSetsToLogNetlink()
+		return
+	}
 	cmd := s.newCmd("ipset", "list")
 	output, err := cmd.Output()
 	if err != nil {
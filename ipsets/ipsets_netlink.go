@@ -0,0 +1,159 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipsets
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// This file contains the netlink equivalents of the methods of IPSets that run the ipset
+// command.  They share the delta tracking and resync logic with the ipset command backend; only
+// the reading and writing of the dataplane differs.
+
+// tryResyncNetlink is the netlink version of tryResync().  It loads all the IP sets from the
+// kernel and queues up fixes for any of our IP sets that are out-of-sync.
+func (s *IPSets) tryResyncNetlink() (numProblems int, err error) {
+	countNumIPSetCalls.Inc()
+	listedSets, err := s.netlink.list()
+	if err != nil {
+		s.logCxt.WithError(err).Error("Failed to list IP sets over netlink.")
+		return
+	}
+
+	s.existingIPSetNames.Clear()
+	for _, listedSet := range listedSets {
+		s.existingIPSetNames.Add(listedSet.Name)
+		ipSet := s.mainIPSetNameToIPSet[listedSet.Name]
+		logCxt := s.logCxt.WithField("setName", listedSet.Name)
+		if ipSet == nil || ipSet.members == nil {
+			// Either this is not one of our IP sets, or it's one that we're about to
+			// rewrite.  Either way, we don't care about its members.
+			logCxt.Debug("Skipping IP set, either not ours or about to rewrite")
+			continue
+		}
+
+		logCxt = s.logCxt.WithField("setID", ipSet.SetID)
+		dataplaneMembers := set.New()
+		for _, member := range listedSet.Members {
+			dataplaneMembers.Add(ipSet.Type.CanonicaliseMember(member))
+		}
+		numProblems += s.reconcileMembers(ipSet, dataplaneMembers, logCxt)
+	}
+
+	s.queueLeftOverIPSetDeletions()
+	return
+}
+
+// tryUpdatesNetlink is the netlink version of tryUpdates().  It sends the same sequence of
+// operations that we'd feed to 'ipset restore' as a batch of netlink requests.  Like 'ipset
+// restore', the batch is not atomic.
+func (s *IPSets) tryUpdatesNetlink() error {
+	countNumIPSetCalls.Inc()
+	s.dirtyIPSetIDs.Iter(func(item interface{}) error {
+		ipSet := s.ipSetIDToIPSet[item.(string)]
+		s.queueNetlinkUpdates(ipSet)
+		return nil
+	})
+	numRequests := s.netlink.numPending()
+	if err := s.netlink.flush(); err != nil {
+		s.logCxt.WithError(err).WithField("numRequests", numRequests).Warning(
+			"Failed to update IP sets over netlink, IP sets may be out-of-sync.")
+		return err
+	}
+	countNumIPSetLinesExecuted.Add(float64(numRequests))
+
+	// If we get here, the writes were successful; the dataplane should now be in sync.
+	s.markDirtyIPSetsInSync()
+	return nil
+}
+
+// queueNetlinkUpdates queues up the netlink requests needed to bring the given IP set in sync;
+// it mirrors writeUpdates().
+func (s *IPSets) queueNetlinkUpdates(ipSet *ipSet) {
+	logCxt := s.logCxt.WithField("setID", ipSet.SetID)
+	family := s.IPVersionConfig.Family
+	mainSetName := ipSet.MainIPSetName
+
+	if ipSet.pendingReplace == nil {
+		if ipSet.pendingAdds.Len() == 0 && ipSet.pendingDeletions.Len() == 0 {
+			logCxt.Debug("Skipping delta write, IP set not dirty.")
+			return
+		}
+		logCxt.WithFields(log.Fields{
+			"numDeltaAdds":    ipSet.pendingAdds.Len(),
+			"numDeltaDeletes": ipSet.pendingDeletions.Len(),
+		}).Info("Calculating deltas to IP set")
+		ipSet.pendingDeletions.Iter(func(item interface{}) error {
+			s.netlink.queueDel(mainSetName, family, item.(ipSetMember).String())
+			return nil
+		})
+		ipSet.pendingAdds.Iter(func(item interface{}) error {
+			s.netlink.queueAdd(mainSetName, family, item.(ipSetMember).String())
+			return nil
+		})
+		return
+	}
+
+	// Full rewrite: fill in a temporary IP set and then atomically swap it into place.  See
+	// writeFullRewrite() for the details.
+	logCxt.WithField("numMembersInPendingReplace", ipSet.pendingReplace.Len()).Info(
+		"Doing full IP set rewrite")
+	if !s.existingIPSetNames.Contains(mainSetName) {
+		s.netlink.queueCreate(mainSetName, ipSet.Type, family, ipSet.MaxSize)
+	}
+	tempSetName := ipSet.TempIPSetName
+	if s.existingIPSetNames.Contains(tempSetName) {
+		s.netlink.queueDestroy(tempSetName)
+	}
+	s.netlink.queueCreate(tempSetName, ipSet.Type, family, ipSet.MaxSize)
+	ipSet.pendingReplace.Iter(func(item interface{}) error {
+		s.netlink.queueAdd(tempSetName, family, item.(ipSetMember).String())
+		return nil
+	})
+	s.netlink.queueSwap(mainSetName, tempSetName)
+	s.netlink.queueDestroy(tempSetName)
+}
+
+func (s *IPSets) deleteIPSetNetlink(setName string) error {
+	s.netlink.queueDestroy(setName)
+	if err := s.netlink.flush(); err != nil {
+		s.logCxt.WithError(err).WithField("setName", setName).Warn(
+			"Failed to delete IP set, may be out-of-sync.")
+		s.resyncRequired = true
+		return err
+	}
+	s.logCxt.WithField("setName", setName).Info("Deleted IP set")
+	s.existingIPSetNames.Discard(setName)
+	return nil
+}
+
+func (s *IPSets) dumpIPSetsToLogNetlink() {
+	listedSets, err := s.netlink.list()
+	if err != nil {
+		s.logCxt.WithError(err).Error("Failed to read IP sets")
+		return
+	}
+	for _, listedSet := range listedSets {
+		s.logCxt.WithFields(log.Fields{
+			"setName": listedSet.Name,
+			"type":    listedSet.Type,
+			"members": strings.Join(listedSet.Members, ","),
+		}).Info("Current state of IP set")
+	}
+}
@@ -177,7 +177,17 @@ var _ = Describe("IPFamily", func() {
 	})
 })
 
-var _ = Describe("IP sets dataplane", func() {
+var _ = Describe("IP sets dataplane using ipset restore", func() {
+	describeIPSetsDataplaneTests("ipset-restore")
+})
+
+var _ = Describe("IP sets dataplane using netlink", func() {
+	describeIPSetsDataplaneTests("netlink")
+})
+
+// describeIPSetsDataplaneTests describes the tests that are shared between the two backends.
+// Both backends are tested against the same mockDataplane.
+func describeIPSetsDataplaneTests(backend string) {
 	var dataplane *mockDataplane
 	var ipsets *IPSets
 
@@ -216,11 +226,19 @@ var _ = Describe("IP sets dataplane", func() {
 
 	BeforeEach(func() {
 		dataplane = newMockDataplane()
-		ipsets = NewIPSetsWithShims(
-			v4VersionConf,
-			dataplane.newCmd,
-			dataplane.sleep,
-		)
+		if backend == "netlink" {
+			ipsets = NewNetlinkIPSetsWithShims(
+				v4VersionConf,
+				dataplane.newNetlinkSocket,
+				dataplane.sleep,
+			)
+		} else {
+			ipsets = NewIPSetsWithShims(
+				v4VersionConf,
+				dataplane.newCmd,
+				dataplane.sleep,
+			)
+		}
 	})
 
 	It("mainline: should pend updates until apply is called", func() {
@@ -478,7 +496,11 @@ var _ = Describe("IP sets dataplane", func() {
 			BeforeEach(func() {
 				dataplane.IPSetMembers[v4MainIPSetName] =
 					set.From("10.0.0.1", "10.0.0.3", "10.0.0.4")
-				dataplane.ListOpFailures = []string{"pipe", "start", "read", "read-member", "member", "rc"}
+				if backend == "netlink" {
+					dataplane.ListOpFailures = []string{"send", "read-member", "rc"}
+				} else {
+					dataplane.ListOpFailures = []string{"pipe", "start", "read", "read-member", "member", "rc"}
+				}
 			})
 
 			It("it should get there in the end", func() {
@@ -512,13 +534,19 @@ var _ = Describe("IP sets dataplane", func() {
 			}
 		}
 
-		Describe("with a failure to create ipset list pipe", describeResyncFailureTests("pipe"))
-		Describe("with a failure to start ipset list", describeResyncFailureTests("start"))
-		Describe("with a failure to read straight away", describeResyncFailureTests("read"))
-		Describe("with a failure to read a member", describeResyncFailureTests("read-member"))
-		Describe("with a failure to close pipe", describeResyncFailureTests("close"))
-		Describe("with a failure to close pipe and a good RC", describeResyncFailureTests("close", "force-good-rc"))
-		Describe("with a failure return code", describeResyncFailureTests("rc"))
+		if backend == "netlink" {
+			Describe("with a failure to send the dump request", describeResyncFailureTests("send"))
+			Describe("with a failure to read a member", describeResyncFailureTests("read-member"))
+			Describe("with an error response to the dump request", describeResyncFailureTests("rc"))
+		} else {
+			Describe("with a failure to create ipset list pipe", describeResyncFailureTests("pipe"))
+			Describe("with a failure to start ipset list", describeResyncFailureTests("start"))
+			Describe("with a failure to read straight away", describeResyncFailureTests("read"))
+			Describe("with a failure to read a member", describeResyncFailureTests("read-member"))
+			Describe("with a failure to close pipe", describeResyncFailureTests("close"))
+			Describe("with a failure to close pipe and a good RC", describeResyncFailureTests("close", "force-good-rc"))
+			Describe("with a failure return code", describeResyncFailureTests("rc"))
+		}
 
 		describeRetryTests := func(failures ...string) func() {
 			return func() {
@@ -566,12 +594,16 @@ var _ = Describe("IP sets dataplane", func() {
 			}
 		}
 
-		Describe("with a failure to create the ipset restore pipe", describeRetryTests("pipe"))
-		Describe("with a failure to start ipset restore", describeRetryTests("start"))
-		Describe("with a failure to start ipset restore and a close failure", describeRetryTests(
-			"close" /* needs to be queued up before the start */, "start"))
-		Describe("with a write failure to the pipe (immediately)", describeRetryTests("write"))
-		Describe("with a write failure to the pipe when writing an IP", describeRetryTests("write-ip"))
+		if backend == "netlink" {
+			Describe("with a failure to send the requests", describeRetryTests("send"))
+		} else {
+			Describe("with a failure to create the ipset restore pipe", describeRetryTests("pipe"))
+			Describe("with a failure to start ipset restore", describeRetryTests("start"))
+			Describe("with a failure to start ipset restore and a close failure", describeRetryTests(
+				"close" /* needs to be queued up before the start */, "start"))
+			Describe("with a write failure to the pipe (immediately)", describeRetryTests("write"))
+			Describe("with a write failure to the pipe when writing an IP", describeRetryTests("write-ip"))
+		}
 		Describe("with an update failure before any upates succeed", describeRetryTests("pre-update"))
 		Describe("with an update failure after upates succeed", describeRetryTests("post-update"))
 		Describe("with a couple of failures", describeRetryTests("post-update", "pre-update"))
@@ -655,7 +687,7 @@ var _ = Describe("IP sets dataplane", func() {
 		resyncAndApply()
 		dataplane.ExpectMembers(map[string][]string{"noncali": v4Members1And2})
 	})
-})
+}
 
 var _ = Describe("Standard IPv4 IPVersionConfig", func() {
 	v4VersionConf := NewIPVersionConfig(
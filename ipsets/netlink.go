@@ -0,0 +1,416 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipsets
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/nfnetlink"
+)
+
+// Constants from linux/netfilter/ipset/ip_set.h.
+const (
+	nfnlSubsysIPSet = 6
+
+	// ipsetProtocol is the oldest protocol version supported by current kernels; it has
+	// everything that we need.
+	ipsetProtocol = 6
+
+	ipsetCmdCreate  = 2
+	ipsetCmdDestroy = 3
+	ipsetCmdSwap    = 6
+	ipsetCmdList    = 7
+	ipsetCmdAdd     = 9
+	ipsetCmdDel     = 10
+
+	// Top-level attributes.
+	ipsetAttrProtocol = 1
+	ipsetAttrSetName  = 2
+	ipsetAttrTypeName = 3
+	ipsetAttrSetName2 = ipsetAttrTypeName
+	ipsetAttrRevision = 4
+	ipsetAttrFamily   = 5
+	ipsetAttrData     = 7
+	ipsetAttrADT      = 8
+
+	// Attributes nested inside ipsetAttrData.
+	ipsetAttrIP      = 1
+	ipsetAttrCIDR    = 3
+	ipsetAttrPort    = 4
+	ipsetAttrProto   = 7
+	ipsetAttrMaxElem = 19
+
+	// Attributes nested inside ipsetAttrIP.
+	ipsetAttrIPAddrIPv4 = 1
+	ipsetAttrIPAddrIPv6 = 2
+)
+
+// NetlinkSocket is a shim for a NETLINK_NETFILTER socket; it allows the netlink API to be
+// mocked in UT.
+type NetlinkSocket = nfnetlink.Socket
+
+type NetlinkSocketFactory = nfnetlink.SocketFactory
+
+// NetlinkError is returned when the kernel rejects one of our requests.
+type NetlinkError = nfnetlink.Error
+
+// ipsetNetlink is a minimal client for the kernel's ipset netlink API (NFNL_SUBSYS_IPSET).
+// Requests are queued up and then sent as a batch by flush(), which waits for the kernel to ack
+// each of them.
+type ipsetNetlink struct {
+	newSocket NetlinkSocketFactory
+	socket    NetlinkSocket
+	seq       uint32
+
+	pending []nfnetlink.Request
+}
+
+// listedIPSet holds an IP set that we read back from the kernel.
+type listedIPSet struct {
+	Name    string
+	Type    string
+	Members []string
+}
+
+func newIPSetNetlink(newSocket NetlinkSocketFactory) *ipsetNetlink {
+	return &ipsetNetlink{
+		newSocket: newSocket,
+	}
+}
+
+func (n *ipsetNetlink) queueCreate(name string, setType IPSetType, family IPFamily, maxSize int) {
+	var b nfnetlink.MsgBuilder
+	b.AddUint8(ipsetAttrProtocol, ipsetProtocol)
+	b.AddString(ipsetAttrSetName, name)
+	b.AddString(ipsetAttrTypeName, string(setType))
+	// Revision 0 of each of our set types is supported by all the kernels that we care about
+	// and it has all the features that we need.
+	b.AddUint8(ipsetAttrRevision, 0)
+	b.AddUint8(ipsetAttrFamily, nfproto(family))
+	b.StartNested(ipsetAttrData)
+	b.AddBE32(ipsetAttrMaxElem, uint32(maxSize))
+	b.EndNested()
+	// NLM_F_EXCL makes the create fail if the set already exists, like "ipset create"
+	// without "-exist".
+	n.queue(ipsetCmdCreate, nfnetlink.FlagExcl, family, &b,
+		fmt.Sprintf("create %s %s family %s maxelem %d", name, setType, family, maxSize))
+}
+
+func (n *ipsetNetlink) queueDestroy(name string) {
+	var b nfnetlink.MsgBuilder
+	b.AddUint8(ipsetAttrProtocol, ipsetProtocol)
+	b.AddString(ipsetAttrSetName, name)
+	n.queue(ipsetCmdDestroy, 0, "", &b, "destroy "+name)
+}
+
+func (n *ipsetNetlink) queueSwap(name1, name2 string) {
+	var b nfnetlink.MsgBuilder
+	b.AddUint8(ipsetAttrProtocol, ipsetProtocol)
+	b.AddString(ipsetAttrSetName, name1)
+	b.AddString(ipsetAttrSetName2, name2)
+	n.queue(ipsetCmdSwap, 0, "", &b, "swap "+name1+" "+name2)
+}
+
+// queueAdd queues up the addition of a member, which should be in the format accepted by the
+// ipset command.  The add fails if the member is already present.
+func (n *ipsetNetlink) queueAdd(name string, family IPFamily, member string) {
+	n.queueMemberUpdate(ipsetCmdAdd, nfnetlink.FlagExcl, name, family, member, "add")
+}
+
+// queueDel queues up the deletion of a member.  Like "ipset del --exist", the deletion succeeds
+// if the member is already gone.
+func (n *ipsetNetlink) queueDel(name string, family IPFamily, member string) {
+	n.queueMemberUpdate(ipsetCmdDel, 0, name, family, member, "del")
+}
+
+func (n *ipsetNetlink) queueMemberUpdate(cmd uint8, flags uint16, name string, family IPFamily, member, op string) {
+	var b nfnetlink.MsgBuilder
+	b.AddUint8(ipsetAttrProtocol, ipsetProtocol)
+	b.AddString(ipsetAttrSetName, name)
+	b.StartNested(ipsetAttrData)
+	addMemberAttrs(&b, member)
+	b.EndNested()
+	n.queue(cmd, flags, family, &b, op+" "+name+" "+member)
+}
+
+func (n *ipsetNetlink) queue(cmd uint8, flags uint16, family IPFamily, b *nfnetlink.MsgBuilder, desc string) {
+	n.seq++
+	n.pending = append(n.pending, nfnetlink.Request{
+		Seq:         n.seq,
+		Data:        b.Message(nfnlSubsysIPSet, cmd, nfnetlink.FlagRequest|nfnetlink.FlagAck|flags, nfproto(family), 0, n.seq),
+		Description: desc,
+	})
+}
+
+// numPending returns the number of requests waiting to be flushed.
+func (n *ipsetNetlink) numPending() int {
+	return len(n.pending)
+}
+
+// flush sends the pending requests to the kernel and waits for them to be acked.  The kernel
+// processes each request independently so, if one fails, the others may still have been
+// applied.  In that case, flush returns the first error.
+func (n *ipsetNetlink) flush() (err error) {
+	pending := n.pending
+	n.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	if err = n.ensureSocket(); err != nil {
+		return
+	}
+	defer func() {
+		if _, ok := err.(NetlinkError); err != nil && !ok {
+			// Socket-level error; we don't know what state the socket is in so start
+			// again with a fresh one next time.
+			n.closeSocket()
+		}
+	}()
+
+	// If a request fails, we don't send the later batches since they may depend on it; for
+	// example, we shouldn't swap in a set that we failed to create.
+	err = nfnetlink.SendRequests(n.socket, pending, func(req *nfnetlink.Request, errno int32) error {
+		if errno != 0 {
+			return NetlinkError{Errno: errno, Request: req.Description}
+		}
+		return nil
+	})
+	return
+}
+
+// list loads all the IP sets from the kernel.  A large IP set may be split over several
+// messages; list merges them.
+func (n *ipsetNetlink) list() (sets []*listedIPSet, err error) {
+	if err = n.ensureSocket(); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			n.closeSocket()
+		}
+	}()
+
+	var b nfnetlink.MsgBuilder
+	b.AddUint8(ipsetAttrProtocol, ipsetProtocol)
+	n.seq++
+	request := b.Message(nfnlSubsysIPSet, ipsetCmdList, nfnetlink.FlagRequest|nfnetlink.FlagDump, 0, 0, n.seq)
+	nameToSet := map[string]*listedIPSet{}
+	err = nfnetlink.Dump(n.socket, request, n.seq, "list", func(msg nfnetlink.Message) error {
+		if msg.Type != nfnlSubsysIPSet<<8|ipsetCmdList {
+			return nil
+		}
+		s, err := parseListedIPSet(msg)
+		if err != nil {
+			return err
+		}
+		if existing := nameToSet[s.Name]; existing != nil {
+			existing.Members = append(existing.Members, s.Members...)
+		} else {
+			nameToSet[s.Name] = s
+			sets = append(sets, s)
+		}
+		return nil
+	})
+	return
+}
+
+func (n *ipsetNetlink) ensureSocket() (err error) {
+	if n.socket != nil {
+		return
+	}
+	n.socket, err = n.newSocket()
+	if err != nil {
+		n.socket = nil
+		log.WithError(err).Error("Failed to open netlink socket")
+	}
+	return
+}
+
+func (n *ipsetNetlink) closeSocket() {
+	if n.socket == nil {
+		return
+	}
+	if err := n.socket.Close(); err != nil {
+		log.WithError(err).Warn("Failed to close netlink socket")
+	}
+	n.socket = nil
+}
+
+func nfproto(family IPFamily) uint8 {
+	switch family {
+	case IPFamilyV4:
+		return nfnetlink.ProtoIPv4
+	case IPFamilyV6:
+		return nfnetlink.ProtoIPv6
+	}
+	return 0
+}
+
+// addMemberAttrs converts a member in ipset command format ("<ip>", "<ip>/<prefix len>" or
+// "<ip>,<proto>:<port>") to netlink attributes.
+func addMemberAttrs(b *nfnetlink.MsgBuilder, member string) {
+	ipPart := member
+	var portPart string
+	if parts := strings.SplitN(member, ",", 2); len(parts) == 2 {
+		ipPart, portPart = parts[0], parts[1]
+	}
+	var prefixLen int
+	hasPrefix := false
+	if parts := strings.SplitN(ipPart, "/", 2); len(parts) == 2 {
+		ipPart = parts[0]
+		l, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.WithField("member", member).Panic("Failed to parse prefix length of IP set member")
+		}
+		prefixLen = l
+		hasPrefix = true
+	}
+	addr := net.ParseIP(ipPart)
+	if addr == nil {
+		log.WithField("member", member).Panic("Failed to parse IP of IP set member")
+	}
+	b.StartNested(ipsetAttrIP)
+	if v4 := addr.To4(); v4 != nil {
+		b.AddNetOrder(ipsetAttrIPAddrIPv4, v4)
+	} else {
+		b.AddNetOrder(ipsetAttrIPAddrIPv6, addr.To16())
+	}
+	b.EndNested()
+	if hasPrefix {
+		b.AddUint8(ipsetAttrCIDR, uint8(prefixLen))
+	}
+	if portPart != "" {
+		parts := strings.SplitN(portPart, ":", 2)
+		if len(parts) != 2 {
+			log.WithField("member", member).Panic("Failed to parse port of IP set member")
+		}
+		var proto uint8
+		switch strings.ToLower(parts[0]) {
+		case "tcp":
+			proto = 6
+		case "udp":
+			proto = 17
+		default:
+			log.WithField("member", member).Panic("Unknown protocol in IP set member")
+		}
+		port, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil {
+			log.WithField("member", member).Panic("Failed to parse port of IP set member")
+		}
+		b.AddBE16(ipsetAttrPort, uint16(port))
+		b.AddUint8(ipsetAttrProto, proto)
+	}
+}
+
+// parseListedIPSet parses one message from an IP set dump.
+func parseListedIPSet(msg nfnetlink.Message) (*listedIPSet, error) {
+	attrs, err := nfnetlink.ParseAttrs(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	s := &listedIPSet{}
+	for _, attr := range attrs {
+		switch attr.Type {
+		case ipsetAttrSetName:
+			s.Name = attr.StringValue()
+		case ipsetAttrTypeName:
+			s.Type = attr.StringValue()
+		case ipsetAttrADT:
+			entries, err := nfnetlink.ParseAttrs(attr.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if entry.Type != ipsetAttrData {
+					continue
+				}
+				member, err := parseMember(entry.Value)
+				if err != nil {
+					return nil, err
+				}
+				s.Members = append(s.Members, member)
+			}
+		}
+	}
+	if s.Name == "" {
+		return nil, errors.New("IP set in netlink dump had no name")
+	}
+	return s, nil
+}
+
+// parseMember converts the attributes of an IP set entry back into ipset command format.
+func parseMember(data []byte) (string, error) {
+	attrs, err := nfnetlink.ParseAttrs(data)
+	if err != nil {
+		return "", err
+	}
+	var addr net.IP
+	var member string
+	var port uint16
+	var proto uint8
+	hasPort := false
+	for _, attr := range attrs {
+		switch attr.Type {
+		case ipsetAttrIP:
+			ipAttrs, err := nfnetlink.ParseAttrs(attr.Value)
+			if err != nil {
+				return "", err
+			}
+			for _, ipAttr := range ipAttrs {
+				if ipAttr.Type == ipsetAttrIPAddrIPv4 || ipAttr.Type == ipsetAttrIPAddrIPv6 {
+					addr = net.IP(ipAttr.Value)
+				}
+			}
+		case ipsetAttrCIDR:
+			if len(attr.Value) < 1 {
+				return "", errors.New("bad CIDR attribute in netlink dump")
+			}
+			member = "/" + strconv.Itoa(int(attr.Value[0]))
+		case ipsetAttrPort:
+			if len(attr.Value) < 2 {
+				return "", errors.New("bad port attribute in netlink dump")
+			}
+			port = binary.BigEndian.Uint16(attr.Value)
+			hasPort = true
+		case ipsetAttrProto:
+			if len(attr.Value) < 1 {
+				return "", errors.New("bad protocol attribute in netlink dump")
+			}
+			proto = attr.Value[0]
+		}
+	}
+	if addr == nil {
+		return "", errors.New("IP set entry in netlink dump had no IP")
+	}
+	member = addr.String() + member
+	if hasPort {
+		protoName := strconv.Itoa(int(proto))
+		switch proto {
+		case 6:
+			protoName = "tcp"
+		case 17:
+			protoName = "udp"
+		}
+		member += fmt.Sprintf(",%s:%d", protoName, port)
+	}
+	return member, nil
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipsets
+
+import (
+	"time"
+
+	"github.com/projectcalico/felix/nfnetlink"
+)
+
+const netlinkRecvTimeout = 10 * time.Second
+
+// NewNetlinkIPSets creates an IPSets that programs the kernel using the ipset netlink API
+// rather than by running the ipset command.
+func NewNetlinkIPSets(ipVersionConfig *IPVersionConfig) *IPSets {
+	return NewNetlinkIPSetsWithShims(
+		ipVersionConfig,
+		newRealNetlinkSocket,
+		time.Sleep,
+	)
+}
+
+func newRealNetlinkSocket() (NetlinkSocket, error) {
+	return nfnetlink.NewSocket(nfnetlink.SocketOptions{RecvTimeout: netlinkRecvTimeout})
+}
@@ -0,0 +1,469 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipsets_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// This file contains a fake netlink socket, which decodes the ipset netlink requests sent by
+// IPSets and applies them to the mockDataplane.  It deliberately doesn't share any encoding
+// code with the production code so that it acts as a cross-check.
+
+const (
+	fakeNlmsgError = 2
+	fakeNlmsgDone  = 3
+	fakeNlmFAck    = 0x4
+	fakeNlmFExcl   = 0x200
+	fakeNlmFDump   = 0x300
+
+	fakeIPSetSubsys = 6
+
+	fakeIPSetCmdCreate  = 2
+	fakeIPSetCmdDestroy = 3
+	fakeIPSetCmdSwap    = 6
+	fakeIPSetCmdList    = 7
+	fakeIPSetCmdAdd     = 9
+	fakeIPSetCmdDel     = 10
+
+	fakeErrnoENOENT = 2
+	fakeErrnoEPERM  = 1
+	fakeErrnoEEXIST = 17
+)
+
+var fakeNativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		fakeNativeEndian = binary.BigEndian
+	}
+}
+
+var socketClosedError = errors.New("Simulated use of closed socket")
+
+func (d *mockDataplane) newNetlinkSocket() (NetlinkSocket, error) {
+	sock := &fakeNetlinkSocket{Dataplane: d}
+	d.NetlinkSockets = append(d.NetlinkSockets, sock)
+	return sock, nil
+}
+
+type fakeNetlinkSocket struct {
+	Dataplane *mockDataplane
+	Closed    bool
+
+	responses []fakeNetlinkResponse
+}
+
+// fakeNetlinkResponse is a datagram to return from Receive() or an error to return instead.
+type fakeNetlinkResponse struct {
+	Data []byte
+	Err  error
+}
+
+func (s *fakeNetlinkSocket) Send(data []byte) error {
+	Expect(s.Closed).To(BeFalse(), "Send() called on closed socket")
+	Expect(s.responses).To(BeEmpty(), "Send() called with unread responses")
+
+	msgs := fakeParseMessages(data)
+	Expect(msgs).NotTo(BeEmpty())
+	if msgs[0].Cmd == fakeIPSetCmdList {
+		Expect(msgs).To(HaveLen(1))
+		return s.handleList(msgs[0])
+	}
+	return s.handleUpdates(msgs)
+}
+
+func (s *fakeNetlinkSocket) handleList(msg fakeMessage) error {
+	d := s.Dataplane
+	Expect(msg.Flags & fakeNlmFDump).To(Equal(uint16(fakeNlmFDump)))
+	d.CmdNames = append(d.CmdNames, "list")
+
+	if d.popListOpFailure("send") {
+		return transientFailure
+	}
+	if d.FailAllLists {
+		log.Info("Simulating persistent failure of netlink list")
+		s.queueResponse(fakeErrorMessage(msg.Seq, fakeErrnoEPERM))
+		return nil
+	}
+	if d.popListOpFailure("rc") {
+		log.Info("Simulating netlink list returning an error")
+		s.queueResponse(fakeErrorMessage(msg.Seq, fakeErrnoEPERM))
+		return nil
+	}
+	if d.popListOpFailure("read-member") {
+		// Return part of the dump, then fail the next read.
+		s.queueResponse(fakeListMessage(msg.Seq, v4MainIPSetName, []string{"10.0.0.1"}))
+		s.responses = append(s.responses, fakeNetlinkResponse{Err: transientFailure})
+		return nil
+	}
+
+	for setName, members := range d.IPSetMembers {
+		var memberStrs []string
+		members.Iter(func(item interface{}) error {
+			memberStrs = append(memberStrs, item.(string))
+			return nil
+		})
+		s.queueResponse(fakeListMessage(msg.Seq, setName, memberStrs))
+	}
+	s.queueResponse(fakeDoneMessage(msg.Seq))
+	return nil
+}
+
+func (s *fakeNetlinkSocket) handleUpdates(msgs []fakeMessage) error {
+	d := s.Dataplane
+	isDestroy := len(msgs) == 1 && msgs[0].Cmd == fakeIPSetCmdDestroy
+	if isDestroy {
+		d.CmdNames = append(d.CmdNames, "destroy")
+	} else {
+		d.CmdNames = append(d.CmdNames, "restore")
+	}
+
+	if d.popRestoreFailure("send") {
+		return transientFailure
+	}
+
+	failAll := false
+	if isDestroy && d.FailNextDestroy {
+		d.FailNextDestroy = false
+		failAll = true
+	} else if !isDestroy && d.FailAllRestores {
+		log.Warn("Netlink update permanent failure")
+		failAll = true
+	} else if !isDestroy && d.popRestoreFailure("pre-update") {
+		log.Warn("Netlink update simulating pre-update failure")
+		failAll = true
+	}
+
+	for _, msg := range msgs {
+		Expect(msg.Flags & fakeNlmFAck).To(Equal(uint16(fakeNlmFAck)))
+		errno := int32(fakeErrnoEPERM)
+		if !failAll {
+			errno = s.applyUpdate(msg)
+		}
+		s.queueResponse(fakeErrorMessage(msg.Seq, errno))
+	}
+
+	if !isDestroy && d.popRestoreFailure("post-update") {
+		// Updates were applied but the acks get lost.
+		s.responses = []fakeNetlinkResponse{{Err: transientFailure}}
+	}
+	return nil
+}
+
+// applyUpdate applies a single netlink request to the dataplane, with the same semantics as the
+// kernel.  Returns the errno, or 0 for success.
+func (s *fakeNetlinkSocket) applyUpdate(msg fakeMessage) int32 {
+	d := s.Dataplane
+	attrs := msg.Attrs
+	name := attrs.str(2)
+	logCxt := log.WithFields(log.Fields{"setName": name, "cmd": msg.Cmd})
+	logCxt.Info("Mock dataplane, analysing netlink request")
+
+	switch msg.Cmd {
+	case fakeIPSetCmdCreate:
+		Expect(len(name)).To(BeNumerically("<=", MaxIPSetNameLength))
+		Expect(name).To(HavePrefix("cali"))
+		ipSetType := IPSetType(attrs.str(3))
+		Expect(ipSetType.IsValid()).To(BeTrue())
+		var family IPFamily
+		switch msg.Family {
+		case 2:
+			family = IPFamilyV4
+		case 10:
+			family = IPFamilyV6
+		default:
+			Fail(fmt.Sprintf("Unexpected family %v", msg.Family))
+		}
+		data := fakeParseAttrs(attrs[7])
+		maxElem := binary.BigEndian.Uint32(data[19])
+		Expect(msg.Flags & fakeNlmFExcl).To(Equal(uint16(fakeNlmFExcl)))
+
+		if _, ok := d.IPSetMembers[name]; ok {
+			return fakeErrnoEEXIST
+		}
+		d.IPSetMembers[name] = set.New()
+		d.IPSetMetadata[name] = setMetadata{
+			Name:    name,
+			Family:  family,
+			MaxSize: int(maxElem),
+			Type:    ipSetType,
+		}
+		logCxt.Info("Set created")
+	case fakeIPSetCmdDestroy:
+		if _, ok := d.IPSetMembers[name]; !ok {
+			d.TriedToDeleteNonExistent = true
+			return fakeErrnoENOENT
+		}
+		delete(d.IPSetMembers, name)
+		delete(d.IPSetMetadata, name)
+		logCxt.Info("Set destroyed")
+	case fakeIPSetCmdSwap:
+		name2 := attrs.str(3)
+		set1, ok1 := d.IPSetMembers[name]
+		set2, ok2 := d.IPSetMembers[name2]
+		if !ok1 || !ok2 {
+			return fakeErrnoENOENT
+		}
+		d.IPSetMembers[name], d.IPSetMembers[name2] = set2, set1
+		d.IPSetMetadata[name], d.IPSetMetadata[name2] = d.IPSetMetadata[name2], d.IPSetMetadata[name]
+	case fakeIPSetCmdAdd:
+		member := fakeDecodeMember(attrs[7])
+		members, ok := d.IPSetMembers[name]
+		if !ok {
+			return fakeErrnoENOENT
+		}
+		Expect(msg.Flags & fakeNlmFExcl).To(Equal(uint16(fakeNlmFExcl)))
+		if members.Contains(member) {
+			d.TriedToAddExistent = true
+			logCxt.Warn("Add of existing member")
+			return fakeErrnoEEXIST
+		}
+		members.Add(member)
+		logCxt.WithField("member", member).Info("Member added")
+	case fakeIPSetCmdDel:
+		member := fakeDecodeMember(attrs[7])
+		members, ok := d.IPSetMembers[name]
+		if !ok {
+			return fakeErrnoENOENT
+		}
+		// Without NLM_F_EXCL, the kernel ignores deletion of a missing member.
+		Expect(msg.Flags & fakeNlmFExcl).To(BeZero())
+		if !members.Contains(member) {
+			d.TriedToDeleteNonExistent = true
+		}
+		members.Discard(member)
+		logCxt.WithField("member", member).Info("Member deleted")
+	default:
+		Fail(fmt.Sprintf("Unexpected netlink command %v", msg.Cmd))
+	}
+	return 0
+}
+
+func (s *fakeNetlinkSocket) queueResponse(data []byte) {
+	s.responses = append(s.responses, fakeNetlinkResponse{Data: data})
+}
+
+func (s *fakeNetlinkSocket) Receive() ([]byte, error) {
+	Expect(s.Closed).To(BeFalse(), "Receive() called on closed socket")
+	if len(s.responses) == 0 {
+		// A real socket would block forever.
+		Fail("Receive() called with nothing to receive")
+		return nil, socketClosedError
+	}
+	resp := s.responses[0]
+	s.responses = s.responses[1:]
+	return resp.Data, resp.Err
+}
+
+func (s *fakeNetlinkSocket) Close() error {
+	s.Closed = true
+	return nil
+}
+
+type fakeMessage struct {
+	Cmd    uint8
+	Flags  uint16
+	Seq    uint32
+	Family uint8
+	Attrs  fakeAttrs
+}
+
+type fakeAttrs map[uint16][]byte
+
+func (a fakeAttrs) str(attrType uint16) string {
+	return strings.TrimRight(string(a[attrType]), "\x00")
+}
+
+func fakeParseMessages(data []byte) (msgs []fakeMessage) {
+	for len(data) > 0 {
+		Expect(len(data)).To(BeNumerically(">=", 20))
+		msgLen := int(fakeNativeEndian.Uint32(data[0:4]))
+		Expect(msgLen).To(BeNumerically("<=", len(data)))
+		msgType := fakeNativeEndian.Uint16(data[4:6])
+		Expect(msgType >> 8).To(Equal(uint16(fakeIPSetSubsys)))
+		msg := fakeMessage{
+			Cmd:    uint8(msgType),
+			Flags:  fakeNativeEndian.Uint16(data[6:8]),
+			Seq:    fakeNativeEndian.Uint32(data[8:12]),
+			Family: data[16],
+			Attrs:  fakeParseAttrs(data[20:msgLen]),
+		}
+		// Every request should include the protocol version.
+		Expect(msg.Attrs).To(HaveKey(uint16(1)))
+		msgs = append(msgs, msg)
+		data = data[(msgLen+3)&^3:]
+	}
+	return
+}
+
+func fakeParseAttrs(data []byte) fakeAttrs {
+	attrs := fakeAttrs{}
+	for len(data) >= 4 {
+		attrLen := int(fakeNativeEndian.Uint16(data[0:2]))
+		Expect(attrLen).To(BeNumerically(">=", 4))
+		Expect(attrLen).To(BeNumerically("<=", len(data)))
+		attrType := fakeNativeEndian.Uint16(data[2:4]) & 0x3fff
+		attrs[attrType] = data[4:attrLen]
+		padded := (attrLen + 3) &^ 3
+		if padded > len(data) {
+			break
+		}
+		data = data[padded:]
+	}
+	return attrs
+}
+
+// fakeDecodeMember converts the data attribute of an add/del request to the string form that
+// we'd see in an 'ipset restore' line.
+func fakeDecodeMember(data []byte) string {
+	attrs := fakeParseAttrs(data)
+	ipAttrs := fakeParseAttrs(attrs[1])
+	var member string
+	if v4, ok := ipAttrs[1]; ok {
+		member = net.IP(v4).String()
+	} else {
+		member = net.IP(ipAttrs[2]).String()
+	}
+	if cidr, ok := attrs[3]; ok {
+		member += "/" + strconv.Itoa(int(cidr[0]))
+	}
+	if port, ok := attrs[4]; ok {
+		proto := "tcp"
+		if attrs[7][0] == 17 {
+			proto = "udp"
+		}
+		member += fmt.Sprintf(",%s:%d", proto, binary.BigEndian.Uint16(port))
+	}
+	return member
+}
+
+type fakeAttrBuilder []byte
+
+func (b *fakeAttrBuilder) add(attrType uint16, value []byte) {
+	hdr := make([]byte, 4)
+	fakeNativeEndian.PutUint16(hdr[0:2], uint16(4+len(value)))
+	fakeNativeEndian.PutUint16(hdr[2:4], attrType)
+	*b = append(*b, hdr...)
+	*b = append(*b, value...)
+	for len(*b)%4 != 0 {
+		*b = append(*b, 0)
+	}
+}
+
+func (b *fakeAttrBuilder) addString(attrType uint16, s string) {
+	b.add(attrType, append([]byte(s), 0))
+}
+
+func fakeMessageBytes(msgType uint16, seq uint32, payload []byte) []byte {
+	msg := make([]byte, 16, 16+len(payload))
+	fakeNativeEndian.PutUint32(msg[0:4], uint32(16+len(payload)))
+	fakeNativeEndian.PutUint16(msg[4:6], msgType)
+	fakeNativeEndian.PutUint32(msg[8:12], seq)
+	return append(msg, payload...)
+}
+
+func fakeErrorMessage(seq uint32, errno int32) []byte {
+	// struct nlmsgerr: negative errno followed by the header of the failed request.
+	payload := make([]byte, 20)
+	fakeNativeEndian.PutUint32(payload[0:4], uint32(-errno))
+	return fakeMessageBytes(fakeNlmsgError, seq, payload)
+}
+
+func fakeDoneMessage(seq uint32) []byte {
+	return fakeMessageBytes(fakeNlmsgDone, seq, make([]byte, 4))
+}
+
+func fakeListMessage(seq uint32, setName string, members []string) []byte {
+	var attrs fakeAttrBuilder
+	attrs.addString(2, setName)
+	attrs.addString(3, fakeInferSetType(members))
+	var adt fakeAttrBuilder
+	for _, member := range members {
+		adt.add(7|1<<15, fakeEncodeMember(member))
+	}
+	attrs.add(8|1<<15, adt)
+	// nfgenmsg header followed by the attributes.
+	payload := append([]byte{2, 0, 0, 0}, attrs...)
+	return fakeMessageBytes(fakeIPSetSubsys<<8|fakeIPSetCmdList, seq, payload)
+}
+
+func fakeInferSetType(members []string) string {
+	for _, member := range members {
+		if strings.Contains(member, ",") {
+			return string(IPSetTypeHashIPPort)
+		}
+		if strings.Contains(member, "/") {
+			return string(IPSetTypeHashNet)
+		}
+	}
+	return string(IPSetTypeHashIP)
+}
+
+func fakeEncodeMember(member string) []byte {
+	var data fakeAttrBuilder
+	ipPart := member
+	portPart := ""
+	if parts := strings.SplitN(member, ",", 2); len(parts) == 2 {
+		ipPart, portPart = parts[0], parts[1]
+	}
+	cidr := -1
+	if parts := strings.SplitN(ipPart, "/", 2); len(parts) == 2 {
+		ipPart = parts[0]
+		var err error
+		cidr, err = strconv.Atoi(parts[1])
+		Expect(err).NotTo(HaveOccurred())
+	}
+	addr := net.ParseIP(ipPart)
+	Expect(addr).NotTo(BeNil())
+	var ipAttr fakeAttrBuilder
+	if v4 := addr.To4(); v4 != nil {
+		ipAttr.add(1|1<<14, v4)
+	} else {
+		ipAttr.add(2|1<<14, addr.To16())
+	}
+	data.add(1|1<<15, ipAttr)
+	if cidr >= 0 {
+		data.add(3, []byte{byte(cidr)})
+	}
+	if portPart != "" {
+		parts := strings.SplitN(portPart, ":", 2)
+		port, err := strconv.Atoi(parts[1])
+		Expect(err).NotTo(HaveOccurred())
+		portBytes := make([]byte, 2)
+		binary.BigEndian.PutUint16(portBytes, uint16(port))
+		data.add(4|1<<14, portBytes)
+		proto := byte(6)
+		if parts[0] == "udp" {
+			proto = 17
+		}
+		data.add(7, []byte{proto})
+	}
+	return data
+}
@@ -62,6 +62,9 @@ type mockDataplane struct {
 	RestoreOpFailures []string
 	FailNextDestroy   bool
 
+	// NetlinkSockets records the fake netlink sockets opened by the netlink backend.
+	NetlinkSockets []*fakeNetlinkSocket
+
 	// Record when various (expected) error cases are hit.
 	TriedToDeleteNonExistent bool
 	TriedToAddExistent       bool
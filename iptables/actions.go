@@ -83,6 +83,22 @@ func (g LogAction) String() string {
 	return "Log"
 }
 
+// NflogAction sends the packet to the given NFLOG group, from which a userspace process can read
+// it over netlink.  Like LOG, it doesn't terminate the chain.
+type NflogAction struct {
+	Group     uint16
+	Prefix    string
+	TypeNflog struct{}
+}
+
+func (n NflogAction) ToFragment() string {
+	return fmt.Sprintf(`--jump NFLOG --nflog-group %d --nflog-prefix "%s"`, n.Group, n.Prefix)
+}
+
+func (n NflogAction) String() string {
+	return fmt.Sprintf("Nflog:%d:%s", n.Group, n.Prefix)
+}
+
 type AcceptAction struct {
 	TypeAccept struct{}
 }
@@ -29,6 +29,8 @@ var _ = DescribeTable("Actions",
 	Entry("JumpAction", JumpAction{Target: "cali-abcd"}, "--jump cali-abcd"),
 	Entry("ReturnAction", ReturnAction{}, "--jump RETURN"),
 	Entry("DropAction", DropAction{}, "--jump DROP"),
+	Entry("NflogAction", NflogAction{Group: 20, Prefix: "AI|0123456789abcdef|pol:default/foo"},
+		`--jump NFLOG --nflog-group 20 --nflog-prefix "AI|0123456789abcdef|pol:default/foo"`),
 	Entry("AcceptAction", AcceptAction{}, "--jump ACCEPT"),
 	Entry("LogAction", LogAction{Prefix: "prefix"}, `--jump LOG --log-prefix "prefix: " --log-level 5`),
 	Entry("DNATAction", DNATAction{DestAddr: "10.0.0.1", DestPort: 8081}, "--jump DNAT --to-destination 10.0.0.1:8081"),
@@ -0,0 +1,90 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// counterAppendRegexp matches an append line in the output of iptables-save -c, capturing
+// the packet and byte counters and the name of the chain.
+var counterAppendRegexp = regexp.MustCompile(`^\[(\d+):(\d+)\] -A (\S+)`)
+
+// RuleCounters holds the packet and byte counters of a rule.
+type RuleCounters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// ReadRuleCounters runs iptables-save to read the packet and byte counters of the rules that
+// we've programmed.  The returned map is indexed by rule hash; rules that don't have one of
+// our hashes are skipped.
+//
+// ReadRuleCounters only reads from the dataplane and it doesn't touch the Table's cache so,
+// unlike the other methods, it may be called from a different goroutine to the one that's
+// driving the Table.
+func (t *Table) ReadRuleCounters() (map[string]RuleCounters, error) {
+	cmd := t.newCmd(t.iptablesSaveCmd, "-c", "-t", t.Name)
+	countNumSaveCalls.Inc()
+	output, err := cmd.Output()
+	if err != nil {
+		countNumSaveErrors.Inc()
+		t.logCxt.WithError(err).Warnf("%s command failed while reading counters", t.iptablesSaveCmd)
+		return nil, err
+	}
+	return t.readCountersFrom(bytes.NewReader(output))
+}
+
+// readCountersFrom scans the given reader, which should contain the output of iptables-save -c
+// for this table, and extracts the counters of the rules that have one of our hashes.
+func (t *Table) readCountersFrom(r io.Reader) (map[string]RuleCounters, error) {
+	counters := map[string]RuleCounters{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		captures := counterAppendRegexp.FindSubmatch(line)
+		if captures == nil {
+			// Not a rule.
+			continue
+		}
+		hashCaptures := t.hashCommentRegexp.FindSubmatch(line)
+		if hashCaptures == nil {
+			// Not one of our rules.
+			continue
+		}
+		numPackets, err := strconv.ParseUint(string(captures[1]), 10, 64)
+		if err != nil {
+			log.WithError(err).WithField("line", string(line)).Warn("Failed to parse packet counter")
+			continue
+		}
+		numBytes, err := strconv.ParseUint(string(captures[2]), 10, 64)
+		if err != nil {
+			log.WithError(err).WithField("line", string(line)).Warn("Failed to parse byte counter")
+			continue
+		}
+		counters[string(hashCaptures[1])] = RuleCounters{Packets: numPackets, Bytes: numBytes}
+	}
+	if scanner.Err() != nil {
+		t.logCxt.WithError(scanner.Err()).Error("Failed to read counters from dataplane")
+		return nil, scanner.Err()
+	}
+	return counters, nil
+}
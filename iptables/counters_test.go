@@ -0,0 +1,86 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/rules"
+)
+
+var _ = Describe("Table rule counters", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	chain := &Chain{
+		Name: "cali-foobar",
+		Rules: []Rule{
+			{Action: AcceptAction{}},
+			{Action: DropAction{}},
+		},
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			&mockMutex{},
+			TableOptions{
+				HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
+				NewCmdOverride:        dataplane.newCmd,
+				SleepOverride:         dataplane.sleep,
+				NowOverride:           dataplane.now,
+			},
+		)
+		table.UpdateChains([]*Chain{chain})
+		table.Apply()
+		dataplane.Chains["FORWARD"] = append(dataplane.Chains["FORWARD"], "-j ACCEPT")
+		dataplane.RuleCounters = map[string][]RuleCounters{
+			"cali-foobar": {
+				{Packets: 10, Bytes: 1000},
+				{Packets: 2, Bytes: 120},
+			},
+			"FORWARD": {
+				{Packets: 100, Bytes: 10000},
+			},
+		}
+		dataplane.ResetCmds()
+	})
+
+	It("should read the counters of our rules, indexed by hash", func() {
+		counters, err := table.ReadRuleCounters()
+		Expect(err).NotTo(HaveOccurred())
+		hashes := chain.RuleHashes()
+		Expect(counters).To(Equal(map[string]RuleCounters{
+			hashes[0]: {Packets: 10, Bytes: 1000},
+			hashes[1]: {Packets: 2, Bytes: 120},
+		}))
+		Expect(dataplane.CmdNames).To(Equal([]string{"iptables-save"}))
+	})
+
+	It("should return an error if iptables-save fails", func() {
+		dataplane.FailNextSaveRead = true
+		_, err := table.ReadRuleCounters()
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -718,6 +718,13 @@ func (t *Table) InvalidateDataplaneCache(reason string) {
 	t.inSyncWithDataPlane = false
 }
 
+// SetRefreshInterval changes the interval after which Apply() forces a full reload of the
+// table from the dataplane.  A zero interval disables the periodic refresh.
+func (t *Table) SetRefreshInterval(interval time.Duration) {
+	t.logCxt.WithField("interval", interval).Info("Updating refresh interval")
+	t.refreshInterval = interval
+}
+
 func (t *Table) Apply() (rescheduleAfter time.Duration) {
 	now := t.timeNow()
 	// We _think_ we're in sync, check if there are any reasons to think we might
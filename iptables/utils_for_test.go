@@ -68,6 +68,9 @@ type mockDataplane struct {
 	PipeBuffers            []*closableBuffer
 	CumulativeSleep        time.Duration
 	Time                   time.Time
+	// RuleCounters, if set, holds the counters that "iptables-save -c" reports for each
+	// rule, indexed by chain name.  Rules that don't have an entry report zero counters.
+	RuleCounters map[string][]RuleCounters
 }
 
 func (d *mockDataplane) ResetCmds() {
@@ -99,9 +102,15 @@ func (d *mockDataplane) newCmd(name string, arg ...string) CmdIface {
 			Dataplane: d,
 		}
 	case "iptables-save", "ip6tables-save":
+		withCounters := false
+		if len(arg) > 0 && arg[0] == "-c" {
+			withCounters = true
+			arg = arg[1:]
+		}
 		Expect(arg).To(Equal([]string{"-t", d.Table}))
 		cmd = &saveCmd{
-			Dataplane: d,
+			Dataplane:    d,
+			WithCounters: withCounters,
 		}
 	default:
 		Fail(fmt.Sprintf("Unexpected command %v", name))
@@ -310,8 +319,9 @@ func (d *restoreCmd) Run() error {
 }
 
 type saveCmd struct {
-	Dataplane  *mockDataplane
-	stdoutPipe *closableBuffer
+	Dataplane    *mockDataplane
+	WithCounters bool
+	stdoutPipe   *closableBuffer
 }
 
 func (d *saveCmd) String() string {
@@ -370,7 +380,14 @@ func (d *saveCmd) Output() ([]byte, error) {
 	}
 
 	for chainName, chain := range d.Dataplane.Chains {
-		for _, rule := range chain {
+		for i, rule := range chain {
+			if d.WithCounters {
+				var counters RuleCounters
+				if i < len(d.Dataplane.RuleCounters[chainName]) {
+					counters = d.Dataplane.RuleCounters[chainName][i]
+				}
+				buf.WriteString(fmt.Sprintf("[%d:%d] ", counters.Packets, counters.Bytes))
+			}
 			buf.WriteString(fmt.Sprintf("-A %s %s\n", chainName, rule))
 		}
 	}
@@ -723,3 +723,47 @@ func (idx *SelectorAndNamedPortIndex) discardParentIfEmpty(id string) {
 		delete(idx.parentDataByParentID, id)
 	}
 }
+
+// IPSetDescription describes an active IP set and why each of its members is present.  It's
+// used by the calculation graph's debug API.
+type IPSetDescription struct {
+	Selector          string
+	NamedPortProtocol IPSetPortProtocol
+	NamedPort         string
+	// Contributors maps each member of the IP set to the IDs of the endpoints and network sets
+	// that contribute it.
+	Contributors map[IPSetMember][]interface{}
+}
+
+// IPSetIDs returns the IDs of the active IP sets.
+func (idx *SelectorAndNamedPortIndex) IPSetIDs() []string {
+	ids := make([]string, 0, len(idx.ipSetDataByID))
+	for id := range idx.ipSetDataByID {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// DescribeIPSet returns a description of the given IP set, or nil if the IP set isn't active.
+// Endpoints that match the IP set's selector but contribute no members to it are not included.
+func (idx *SelectorAndNamedPortIndex) DescribeIPSet(ipSetID string) *IPSetDescription {
+	ipSetData := idx.ipSetDataByID[ipSetID]
+	if ipSetData == nil {
+		return nil
+	}
+	desc := &IPSetDescription{
+		Selector:          ipSetData.selector.String(),
+		NamedPortProtocol: ipSetData.namedPortProtocol,
+		NamedPort:         ipSetData.namedPort,
+		Contributors:      map[IPSetMember][]interface{}{},
+	}
+	for epID, epData := range idx.endpointDataByID {
+		if epData.cachedMatchingIPSetIDs == nil || !epData.cachedMatchingIPSetIDs.Contains(ipSetID) {
+			continue
+		}
+		for _, member := range idx.CalculateEndpointContribution(epData, ipSetData) {
+			desc.Contributors[member] = append(desc.Contributors[member], epID)
+		}
+	}
+	return desc
+}
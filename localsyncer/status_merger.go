@@ -0,0 +1,89 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localsyncer
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+)
+
+// StatusMerger combines several syncers' callbacks into one stream.  Updates are passed straight
+// through; the merged status is the least advanced of the inputs' statuses, so that the
+// downstream callbacks only see InSync once every input is in sync.  The inputs may be called
+// from different goroutines.
+type StatusMerger struct {
+	lock     sync.Mutex
+	sink     api.SyncerCallbacks
+	statuses []api.SyncStatus
+	reported bool
+	lastSent api.SyncStatus
+}
+
+func NewStatusMerger(sink api.SyncerCallbacks, numInputs int) *StatusMerger {
+	return &StatusMerger{
+		sink:     sink,
+		statuses: make([]api.SyncStatus, numInputs),
+	}
+}
+
+// Input returns the callbacks for the input with the given index.
+func (m *StatusMerger) Input(idx int) api.SyncerCallbacks {
+	return &mergerInput{merger: m, idx: idx}
+}
+
+func (m *StatusMerger) onStatusUpdated(idx int, status api.SyncStatus) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.statuses[idx] = status
+	merged := m.statuses[0]
+	for _, s := range m.statuses[1:] {
+		if s < merged {
+			merged = s
+		}
+	}
+	if m.reported && merged == m.lastSent {
+		return
+	}
+	log.WithFields(log.Fields{
+		"input":  idx,
+		"status": merged,
+	}).Info("Merged syncer status changed")
+	m.reported = true
+	m.lastSent = merged
+	m.sink.OnStatusUpdated(merged)
+}
+
+func (m *StatusMerger) onUpdates(updates []api.Update) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sink.OnUpdates(updates)
+}
+
+type mergerInput struct {
+	merger *StatusMerger
+	idx    int
+}
+
+func (i *mergerInput) OnStatusUpdated(status api.SyncStatus) {
+	i.merger.onStatusUpdated(i.idx, status)
+}
+
+func (i *mergerInput) OnUpdates(updates []api.Update) {
+	i.merger.onUpdates(updates)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package localsyncer_test
+
+import (
+	. "github.com/projectcalico/felix/localsyncer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+var _ = Describe("StatusMerger", func() {
+	var sink *recordingCallbacks
+	var merger *StatusMerger
+
+	BeforeEach(func() {
+		sink = &recordingCallbacks{}
+		merger = NewStatusMerger(sink, 2)
+	})
+
+	It("should only report in sync once all the inputs are in sync", func() {
+		merger.Input(0).OnStatusUpdated(api.WaitForDatastore)
+		merger.Input(1).OnStatusUpdated(api.WaitForDatastore)
+		merger.Input(0).OnStatusUpdated(api.ResyncInProgress)
+		merger.Input(0).OnStatusUpdated(api.InSync)
+		Expect(sink.statuses).To(Equal([]api.SyncStatus{api.WaitForDatastore}))
+
+		merger.Input(1).OnStatusUpdated(api.ResyncInProgress)
+		merger.Input(1).OnStatusUpdated(api.InSync)
+		Expect(sink.statuses).To(Equal([]api.SyncStatus{
+			api.WaitForDatastore,
+			api.ResyncInProgress,
+			api.InSync,
+		}))
+	})
+
+	It("should report a resync by any input", func() {
+		merger.Input(0).OnStatusUpdated(api.InSync)
+		merger.Input(1).OnStatusUpdated(api.InSync)
+		merger.Input(1).OnStatusUpdated(api.ResyncInProgress)
+		Expect(sink.statuses).To(Equal([]api.SyncStatus{
+			api.WaitForDatastore,
+			api.InSync,
+			api.ResyncInProgress,
+		}))
+	})
+
+	It("should pass the updates from every input through", func() {
+		u1 := api.Update{KVPair: model.KVPair{Key: model.HostIPKey{Hostname: "a"}}}
+		u2 := api.Update{KVPair: model.KVPair{Key: model.HostIPKey{Hostname: "b"}}}
+		merger.Input(0).OnUpdates([]api.Update{u1})
+		merger.Input(1).OnUpdates([]api.Update{u2})
+		Expect(sink.updates).To(Equal([][]api.Update{{u1}, {u2}}))
+	})
+})
+
+type recordingCallbacks struct {
+	statuses []api.SyncStatus
+	updates  [][]api.Update
+}
+
+func (r *recordingCallbacks) OnStatusUpdated(status api.SyncStatus) {
+	r.statuses = append(r.statuses, status)
+}
+
+func (r *recordingCallbacks) OnUpdates(updates []api.Update) {
+	r.updates = append(r.updates, updates)
+}
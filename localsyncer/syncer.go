@@ -0,0 +1,71 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package localsyncer provides the Syncer that Felix uses when it talks to the datastore
+// directly, rather than via Typha.  It wraps libcalico-go's Felix syncer and adds a watch for
+// the resources that the calculation graph needs but that syncer doesn't send: the v3 Node
+// resources, which carry the nodes' IPv6 addresses, and the IPAM blocks, from which Felix
+// calculates the routes to other hosts' workloads.
+package localsyncer
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/backend/syncersv1/felixsyncer"
+	"github.com/projectcalico/libcalico-go/lib/backend/watchersyncer"
+)
+
+type startable interface {
+	Start()
+}
+
+// Syncer runs several syncers, which all feed the same callbacks.
+type Syncer struct {
+	syncers []startable
+}
+
+// New creates a Syncer that sends the updates from libcalico-go's Felix syncer, plus the raw v3
+// Node resources and, if watchBlocks is set, the IPAM blocks, to callbacks.  Only some
+// datastores store IPAM blocks so the caller should only set watchBlocks if the datastore
+// supports them.  The Syncer only reports that it is in sync once all of its syncers are in
+// sync.
+func New(client api.Client, callbacks api.SyncerCallbacks, watchBlocks bool) *Syncer {
+	merger := NewStatusMerger(callbacks, 2)
+	// With no update processor, the watcher syncer passes the resources through unchanged,
+	// keyed by model.ResourceKey for the Nodes and model.BlockKey for the blocks.
+	resourceTypes := []watchersyncer.ResourceType{
+		{ListInterface: model.ResourceListOptions{Kind: apiv3.KindNode}},
+	}
+	if watchBlocks {
+		resourceTypes = append(resourceTypes, watchersyncer.ResourceType{
+			ListInterface: model.BlockListOptions{},
+		})
+	}
+	return &Syncer{
+		syncers: []startable{
+			felixsyncer.New(client, merger.Input(0)),
+			watchersyncer.New(client, resourceTypes, merger.Input(1)),
+		},
+	}
+}
+
+func (s *Syncer) Start() {
+	log.WithField("numSyncers", len(s.syncers)).Info("Starting syncers")
+	for _, syncer := range s.syncers {
+		syncer.Start()
+	}
+}
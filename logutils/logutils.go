@@ -15,7 +15,9 @@
 package logutils
 
 import (
+	"io"
 	"os"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
@@ -44,6 +46,81 @@ func init() {
 
 const logQueueSize = 100
 
+// hookSwitch is the hook that we register with logrus.  It forwards to the current background
+// hook, which allows ConfigureLogging to be called again to apply new log levels without
+// adding a second hook.
+type hookSwitch struct {
+	lock sync.RWMutex
+	hook log.Hook
+}
+
+// Levels returns all levels; logrus only consults it when the hook is added.  The global log
+// level set by ConfigureLogging filters out the more-verbose logs before they reach us.
+func (h *hookSwitch) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *hookSwitch) Fire(entry *log.Entry) error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.hook.Fire(entry)
+}
+
+func (h *hookSwitch) setHook(hook log.Hook) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.hook = hook
+}
+
+var (
+	configuredHookOnce sync.Once
+	configuredHook     = &hookSwitch{}
+
+	// configureLock serialises calls to ConfigureLogging, which owns currentTargets.
+	configureLock sync.Mutex
+	// currentTargets are the destinations of the hook that is currently installed.
+	currentTargets []*logTarget
+)
+
+// logTarget is a destination of our background hook, along with the resources that we release
+// when a reconfiguration replaces the hook.
+type logTarget struct {
+	dest  *logutils.Destination
+	queue chan logutils.QueuedLog
+	// closer is the underlying log file or syslog connection; nil for the screen.
+	closer io.Closer
+}
+
+func newLogTarget(
+	newDest func(queue chan logutils.QueuedLog) *logutils.Destination,
+	closer io.Closer,
+) *logTarget {
+	queue := make(chan logutils.QueuedLog, logQueueSize)
+	return &logTarget{
+		dest:   newDest(queue),
+		queue:  queue,
+		closer: closer,
+	}
+}
+
+// start starts the goroutine that writes the queued logs.  Once stop is called, the goroutine
+// writes the logs that are still queued, closes the underlying writer and exits.
+func (t *logTarget) start() {
+	go func() {
+		t.dest.LoopWritingLogs()
+		if t.closer != nil {
+			if err := t.closer.Close(); err != nil {
+				log.WithError(err).Warn("Failed to close old log destination.")
+			}
+		}
+	}()
+}
+
+// stop must only be called once the hook that uses the target can no longer be called.
+func (t *logTarget) stop() {
+	close(t.queue)
+}
+
 // ConfigureEarlyLogging installs our logging adapters, and enables early logging to screen
 // if it is enabled by either the FELIX_EARLYLOGSEVERITYSCREEN or FELIX_LOGSEVERITYSCREEN
 // environment variable.
@@ -84,8 +161,12 @@ func ConfigureEarlyLogging() {
 
 // ConfigureLogging uses the resolved configuration to complete the logging
 // configuration.  It creates hooks for the relevant logging targets and
-// attaches them to logrus.
+// attaches them to logrus.  It may be called again to apply changes to the
+// log levels; the new targets replace the old ones, which are then closed.
 func ConfigureLogging(configParams *config.Config) {
+	configureLock.Lock()
+	defer configureLock.Unlock()
+
 	// Parse the log levels, defaulting to panic if in doubt.
 	logLevelScreen := logutils.SafeParseLogLevel(configParams.LogSeverityScreen)
 	logLevelFile := logutils.SafeParseLogLevel(configParams.LogSeverityFile)
@@ -104,35 +185,48 @@ func ConfigureLogging(configParams *config.Config) {
 	log.SetLevel(mostVerboseLevel)
 
 	// Screen target.
-	var dests []*logutils.Destination
+	var targets []*logTarget
 	if configParams.LogSeverityScreen != "" {
-		dests = append(dests, getScreenDestination(configParams, logLevelScreen))
+		targets = append(targets, getScreenTarget(configParams, logLevelScreen))
 	}
 
 	// File target.  We record any errors so we can log them out below after finishing set-up
 	// of the logger.
 	var fileDirErr, fileOpenErr error
 	if configParams.LogSeverityFile != "" && configParams.LogFilePath != "" {
-		var destination *logutils.Destination
-		destination, fileDirErr, fileOpenErr = getFileDestination(configParams, logLevelFile)
-		if fileDirErr == nil && fileOpenErr == nil && destination != nil {
-			dests = append(dests, destination)
+		var target *logTarget
+		target, fileDirErr, fileOpenErr = getFileTarget(configParams, logLevelFile)
+		if fileDirErr == nil && fileOpenErr == nil && target != nil {
+			targets = append(targets, target)
 		}
 	}
 
 	// Syslog target.  Again, we record the error if we fail to connect to syslog.
 	var sysErr error
 	if configParams.LogSeveritySys != "" {
-		var destination *logutils.Destination
-		destination, sysErr = getSyslogDestination(configParams, logLevelSyslog)
-		if sysErr == nil && destination != nil {
-			dests = append(dests, destination)
+		var target *logTarget
+		target, sysErr = getSyslogTarget(configParams, logLevelSyslog)
+		if sysErr == nil && target != nil {
+			targets = append(targets, target)
 		}
 	}
 
+	var dests []*logutils.Destination
+	for _, t := range targets {
+		dests = append(dests, t.dest)
+		t.start()
+	}
 	hook := logutils.NewBackgroundHook(logutils.FilterLevels(mostVerboseLevel), logLevelSyslog, dests, counterDroppedLogs)
-	hook.Start()
-	log.AddHook(hook)
+	configuredHook.setHook(hook)
+	// Once setHook returns, the old hook can't be called so it's safe to shut down its
+	// destinations.
+	for _, t := range currentTargets {
+		t.stop()
+	}
+	currentTargets = targets
+	configuredHookOnce.Do(func() {
+		log.AddHook(configuredHook)
+	})
 
 	// Disable logrus' default output, which only supports a single destination.  We use the
 	// hook above to fan out logs to multiple destinations.
@@ -161,12 +255,14 @@ func ConfigureLogging(configParams *config.Config) {
 	}
 }
 
-func getScreenDestination(configParams *config.Config, logLevel log.Level) *logutils.Destination {
-	return logutils.NewStreamDestination(
-		logLevel,
-		os.Stdout,
-		make(chan logutils.QueuedLog, logQueueSize),
-		configParams.DebugDisableLogDropping,
-		counterLogErrors,
-	)
+func getScreenTarget(configParams *config.Config, logLevel log.Level) *logTarget {
+	return newLogTarget(func(queue chan logutils.QueuedLog) *logutils.Destination {
+		return logutils.NewStreamDestination(
+			logLevel,
+			os.Stdout,
+			queue,
+			configParams.DebugDisableLogDropping,
+			counterLogErrors,
+		)
+	}, nil)
 }
@@ -27,23 +27,25 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/logutils"
 )
 
-func getFileDestination(configParams *config.Config, logLevel log.Level) (fileDest *logutils.Destination, fileDirErr error, fileOpenErr error) {
+func getFileTarget(configParams *config.Config, logLevel log.Level) (target *logTarget, fileDirErr error, fileOpenErr error) {
 	fileDirErr = os.MkdirAll(path.Dir(configParams.LogFilePath), 0755)
-	var rotAwareFile io.Writer
+	var rotAwareFile io.WriteCloser
 	rotAwareFile, fileOpenErr = rfw.Open(configParams.LogFilePath, 0644)
 	if fileDirErr == nil && fileOpenErr == nil {
-		fileDest = logutils.NewStreamDestination(
-			logLevel,
-			rotAwareFile,
-			make(chan logutils.QueuedLog, logQueueSize),
-			configParams.DebugDisableLogDropping,
-			counterLogErrors,
-		)
+		target = newLogTarget(func(queue chan logutils.QueuedLog) *logutils.Destination {
+			return logutils.NewStreamDestination(
+				logLevel,
+				rotAwareFile,
+				queue,
+				configParams.DebugDisableLogDropping,
+				counterLogErrors,
+			)
+		}, rotAwareFile)
 	}
 	return
 }
 
-func getSyslogDestination(configParams *config.Config, logLevel log.Level) (*logutils.Destination, error) {
+func getSyslogTarget(configParams *config.Config, logLevel log.Level) (*logTarget, error) {
 	// Set net/addr to "" so we connect to the system syslog server rather
 	// than a remote one.
 	net := ""
@@ -56,14 +58,16 @@ func getSyslogDestination(configParams *config.Config, logLevel log.Level) (*log
 	tag := "calico-felix"
 	w, sysErr := syslog.Dial(net, addr, priority, tag)
 	if sysErr == nil {
-		syslogDest := logutils.NewSyslogDestination(
-			logLevel,
-			w,
-			make(chan logutils.QueuedLog, logQueueSize),
-			configParams.DebugDisableLogDropping,
-			counterLogErrors,
-		)
-		return syslogDest, sysErr
+		syslogTarget := newLogTarget(func(queue chan logutils.QueuedLog) *logutils.Destination {
+			return logutils.NewSyslogDestination(
+				logLevel,
+				w,
+				queue,
+				configParams.DebugDisableLogDropping,
+				counterLogErrors,
+			)
+		}, w)
+		return syslogTarget, sysErr
 	}
 	return nil, sysErr
 }
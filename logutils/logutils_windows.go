@@ -26,24 +26,26 @@ import (
 )
 
 // File destination for Windows
-func getFileDestination(configParams *config.Config, logLevel log.Level) (fileDest *logutils.Destination, fileDirErr error, fileOpenErr error) {
+func getFileTarget(configParams *config.Config, logLevel log.Level) (target *logTarget, fileDirErr error, fileOpenErr error) {
 	fileDirErr = os.MkdirAll(path.Dir(configParams.LogFilePath), 0755)
-	var logFile io.Writer
+	var logFile io.WriteCloser
 	logFile, fileOpenErr = openLogFile(configParams.LogFilePath, 0644)
 	if fileDirErr == nil && fileOpenErr == nil {
-		fileDest = logutils.NewStreamDestination(
-			logLevel,
-			logFile,
-			make(chan logutils.QueuedLog, logQueueSize),
-			configParams.DebugDisableLogDropping,
-			counterLogErrors,
-		)
+		target = newLogTarget(func(queue chan logutils.QueuedLog) *logutils.Destination {
+			return logutils.NewStreamDestination(
+				logLevel,
+				logFile,
+				queue,
+				configParams.DebugDisableLogDropping,
+				counterLogErrors,
+			)
+		}, logFile)
 	}
 	return
 }
 
 // Stub, syslog destination is not used on Windows
-func getSyslogDestination(configParams *config.Config, logLevel log.Level) (*logutils.Destination, error) {
+func getSyslogTarget(configParams *config.Config, logLevel log.Level) (*logTarget, error) {
 	return nil, nil
 }
 
@@ -61,6 +63,10 @@ func (f *FileWriter) Write(p []byte) (int, error) {
 	return f.file.Write(p)
 }
 
+func (f *FileWriter) Close() error {
+	return f.file.Close()
+}
+
 func openLogFile(path string, mode os.FileMode) (*FileWriter, error) {
 	var w FileWriter
 	var err error
@@ -0,0 +1,360 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nfnetlink contains the netlink plumbing that is shared by our clients for the kernel's
+// netfilter netlink APIs (ipset, conntrack and NFLOG): building and parsing messages, sending
+// batches of requests and dumps, and the socket itself.
+package nfnetlink
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Constants from linux/netlink.h and linux/netfilter/nfnetlink.h.
+const (
+	msgHdrLen   = 16
+	nfgenmsgLen = 4
+	attrHdrLen  = 4
+
+	// msgMinType is the lowest message type that isn't a netlink control message; netfilter
+	// messages (subsystem << 8 | command) are all above it.
+	msgMinType = 0x10
+
+	MsgError = 2
+	MsgDone  = 3
+
+	FlagRequest = 0x1
+	FlagAck     = 0x4
+	FlagExcl    = 0x200
+	FlagDump    = 0x300
+
+	AttrFlagNested       = 1 << 15
+	AttrFlagNetByteOrder = 1 << 14
+	attrTypeMask         = ^uint16(AttrFlagNested | AttrFlagNetByteOrder)
+
+	ProtoUnspec = 0
+	ProtoIPv4   = 2
+	ProtoIPv6   = 10
+
+	// maxBatchSize and maxBatchRequests limit the requests that SendRequests sends in one go.
+	// Each request generates an ack, which the kernel has to buffer until we read it; if we
+	// send too many requests at once, the socket's receive buffer overflows and the kernel
+	// drops the acks (ENOBUFS).
+	maxBatchSize     = 32 * 1024
+	maxBatchRequests = 128
+)
+
+// Socket is a shim for a NETLINK_NETFILTER socket; it allows the netlink clients to be tested
+// without a kernel.
+type Socket interface {
+	// Send sends a buffer containing one or more netlink messages.
+	Send(data []byte) error
+	// Receive blocks until it receives a datagram, which may contain several netlink
+	// messages.
+	Receive() ([]byte, error)
+	Close() error
+}
+
+type SocketFactory func() (Socket, error)
+
+// ErrBufferOverrun is returned by Socket.Receive if the socket's receive buffer overflowed and
+// the kernel dropped some messages.
+var ErrBufferOverrun = errors.New("netlink socket receive buffer overrun")
+
+// NativeEndian is the byte order used for netlink headers (but not for attributes that are
+// flagged with AttrFlagNetByteOrder).
+var NativeEndian binary.ByteOrder
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		NativeEndian = binary.LittleEndian
+	} else {
+		NativeEndian = binary.BigEndian
+	}
+}
+
+// Error is returned when the kernel rejects one of our requests.
+type Error struct {
+	Errno   int32
+	Request string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("netlink request %q failed with errno %d", e.Request, e.Errno)
+}
+
+// MsgBuilder builds the attributes of a netfilter netlink message.
+type MsgBuilder struct {
+	attrs       []byte
+	nestedStack []int
+}
+
+func (b *MsgBuilder) AddAttr(attrType uint16, value []byte) {
+	hdr := make([]byte, attrHdrLen)
+	NativeEndian.PutUint16(hdr[0:2], uint16(attrHdrLen+len(value)))
+	NativeEndian.PutUint16(hdr[2:4], attrType)
+	b.attrs = append(b.attrs, hdr...)
+	b.attrs = append(b.attrs, value...)
+	for len(b.attrs)%4 != 0 {
+		b.attrs = append(b.attrs, 0)
+	}
+}
+
+func (b *MsgBuilder) AddUint8(attrType uint16, v uint8) {
+	b.AddAttr(attrType, []byte{v})
+}
+
+// AddString adds a NUL-terminated string attribute.
+func (b *MsgBuilder) AddString(attrType uint16, s string) {
+	b.AddAttr(attrType, append([]byte(s), 0))
+}
+
+// AddNetOrder adds an attribute whose value is already in network byte order.
+func (b *MsgBuilder) AddNetOrder(attrType uint16, value []byte) {
+	b.AddAttr(attrType|AttrFlagNetByteOrder, value)
+}
+
+func (b *MsgBuilder) AddBE16(attrType uint16, v uint16) {
+	value := make([]byte, 2)
+	binary.BigEndian.PutUint16(value, v)
+	b.AddNetOrder(attrType, value)
+}
+
+func (b *MsgBuilder) AddBE32(attrType uint16, v uint32) {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, v)
+	b.AddNetOrder(attrType, value)
+}
+
+// StartNested starts a nested attribute; the attributes that are added before the matching
+// EndNested() go inside it.
+func (b *MsgBuilder) StartNested(attrType uint16) {
+	b.nestedStack = append(b.nestedStack, len(b.attrs))
+	b.AddAttr(attrType|AttrFlagNested, nil)
+}
+
+func (b *MsgBuilder) EndNested() {
+	start := b.nestedStack[len(b.nestedStack)-1]
+	b.nestedStack = b.nestedStack[:len(b.nestedStack)-1]
+	NativeEndian.PutUint16(b.attrs[start:start+2], uint16(len(b.attrs)-start))
+}
+
+// Message returns the complete netlink message, including the netlink and nfgenmsg headers.
+func (b *MsgBuilder) Message(subsys, cmd uint8, flags uint16, family uint8, resID uint16, seq uint32) []byte {
+	if len(b.nestedStack) != 0 {
+		log.Panic("Unterminated nested netlink attribute")
+	}
+	msgLen := msgHdrLen + nfgenmsgLen + len(b.attrs)
+	msg := make([]byte, msgHdrLen+nfgenmsgLen, msgLen)
+	NativeEndian.PutUint32(msg[0:4], uint32(msgLen))
+	NativeEndian.PutUint16(msg[4:6], uint16(subsys)<<8|uint16(cmd))
+	NativeEndian.PutUint16(msg[6:8], flags)
+	NativeEndian.PutUint32(msg[8:12], seq)
+	// Port ID (bytes 12-16) is left as 0, which addresses the kernel.
+	msg[16] = family
+	// Version (NFNETLINK_V0) is 0; the resource ID is in network byte order.
+	binary.BigEndian.PutUint16(msg[18:20], resID)
+	return append(msg, b.attrs...)
+}
+
+// Message is a parsed netlink message.  For netfilter messages, the Payload excludes the
+// nfgenmsg header.  For error messages, it is the raw nlmsgerr struct.
+type Message struct {
+	Type    uint16
+	Flags   uint16
+	Seq     uint32
+	Payload []byte
+}
+
+// Errno extracts the errno from an NLMSG_ERROR message.  The kernel sends a negative errno; we
+// return it as a positive value.  0 indicates an ack.
+func (m Message) Errno() (int32, error) {
+	if len(m.Payload) < 4 {
+		return 0, errors.New("netlink error message too short")
+	}
+	return -int32(NativeEndian.Uint32(m.Payload[0:4])), nil
+}
+
+// ParseMessages splits a datagram into netlink messages.
+func ParseMessages(data []byte) (msgs []Message, err error) {
+	for len(data) >= msgHdrLen {
+		msgLen := int(NativeEndian.Uint32(data[0:4]))
+		if msgLen < msgHdrLen || msgLen > len(data) {
+			return nil, fmt.Errorf("bad netlink message length %d", msgLen)
+		}
+		msg := Message{
+			Type:  NativeEndian.Uint16(data[4:6]),
+			Flags: NativeEndian.Uint16(data[6:8]),
+			Seq:   NativeEndian.Uint32(data[8:12]),
+		}
+		payload := data[msgHdrLen:msgLen]
+		if msg.Type >= msgMinType {
+			if len(payload) < nfgenmsgLen {
+				return nil, errors.New("netfilter netlink message too short")
+			}
+			payload = payload[nfgenmsgLen:]
+		}
+		msg.Payload = payload
+		msgs = append(msgs, msg)
+		// Messages are 4-byte aligned.
+		msgLen = (msgLen + 3) &^ 3
+		if msgLen > len(data) {
+			break
+		}
+		data = data[msgLen:]
+	}
+	return
+}
+
+// Attr is a parsed netlink attribute.  The Type excludes the nested and byte order flags.
+type Attr struct {
+	Type  uint16
+	Value []byte
+}
+
+// StringValue returns the value of a NUL-terminated string attribute.
+func (a Attr) StringValue() string {
+	return strings.TrimRight(string(a.Value), "\x00")
+}
+
+func ParseAttrs(data []byte) (attrs []Attr, err error) {
+	for len(data) >= attrHdrLen {
+		attrLen := int(NativeEndian.Uint16(data[0:2]))
+		if attrLen < attrHdrLen || attrLen > len(data) {
+			return nil, fmt.Errorf("bad netlink attribute length %d", attrLen)
+		}
+		attrs = append(attrs, Attr{
+			Type:  NativeEndian.Uint16(data[2:4]) & attrTypeMask,
+			Value: data[attrHdrLen:attrLen],
+		})
+		attrLen = (attrLen + 3) &^ 3
+		if attrLen > len(data) {
+			break
+		}
+		data = data[attrLen:]
+	}
+	return
+}
+
+// Request is a complete netlink request, which asks the kernel for an ack.
+type Request struct {
+	Seq         uint32
+	Data        []byte
+	Description string
+}
+
+// SendRequests sends the given requests, in as few batches as possible, and waits for the kernel
+// to ack each of them.  onAck is called with the errno of each ack (0 for success).  If onAck
+// returns an error, SendRequests waits for the rest of the current batch's acks and then returns
+// the first such error without sending the remaining batches.  Socket-level and parse errors
+// are returned immediately, in which case the state of the socket is unknown.
+func SendRequests(socket Socket, pending []Request, onAck func(req *Request, errno int32) error) error {
+	for len(pending) > 0 {
+		// Build a batch.
+		var batch []byte
+		seqToReq := map[uint32]*Request{}
+		for len(pending) > 0 && len(seqToReq) < maxBatchRequests &&
+			(len(batch) == 0 || len(batch)+len(pending[0].Data) <= maxBatchSize) {
+			batch = append(batch, pending[0].Data...)
+			seqToReq[pending[0].Seq] = &pending[0]
+			pending = pending[1:]
+		}
+		if err := socket.Send(batch); err != nil {
+			return err
+		}
+		// Wait for the acks.
+		var firstErr error
+		for len(seqToReq) > 0 {
+			msgs, err := receive(socket)
+			if err != nil {
+				return err
+			}
+			for _, msg := range msgs {
+				if msg.Type != MsgError {
+					log.WithField("type", msg.Type).Debug("Ignoring unexpected netlink message")
+					continue
+				}
+				req := seqToReq[msg.Seq]
+				if req == nil {
+					log.WithField("seq", msg.Seq).Debug("Ignoring ack for unknown request")
+					continue
+				}
+				delete(seqToReq, msg.Seq)
+				errno, err := msg.Errno()
+				if err != nil {
+					return err
+				}
+				if err := onAck(req, errno); err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		if firstErr != nil {
+			return firstErr
+		}
+	}
+	return nil
+}
+
+// Dump sends a dump request and passes each message in the response to onMessage, stopping at
+// the NLMSG_DONE message.  If the kernel rejects the request, Dump returns an Error.  If
+// onMessage returns an error, Dump stops and returns it; in that case, and after a socket-level
+// error, the rest of the dump is left unread so the socket should be discarded.
+func Dump(socket Socket, request []byte, seq uint32, desc string, onMessage func(msg Message) error) error {
+	if err := socket.Send(request); err != nil {
+		return err
+	}
+	for {
+		msgs, err := receive(socket)
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if msg.Seq != seq {
+				continue
+			}
+			switch msg.Type {
+			case MsgDone:
+				return nil
+			case MsgError:
+				errno, err := msg.Errno()
+				if err != nil {
+					return err
+				}
+				if errno != 0 {
+					return Error{Errno: errno, Request: desc}
+				}
+			default:
+				if err := onMessage(msg); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func receive(socket Socket) ([]Message, error) {
+	data, err := socket.Receive()
+	if err != nil {
+		return nil, err
+	}
+	return ParseMessages(data)
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfnetlink_test
+
+import (
+	. "github.com/projectcalico/felix/nfnetlink"
+
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Message building and parsing", func() {
+	It("should round-trip a message with nested attributes", func() {
+		var b MsgBuilder
+		b.AddString(1, "foo")
+		b.StartNested(2)
+		b.AddUint8(3, 7)
+		b.AddBE16(4, 0x1234)
+		b.EndNested()
+		b.AddBE32(5, 0xdeadbeef)
+		data := b.Message(6, 2, FlagRequest|FlagAck, ProtoIPv4, 0, 42)
+		Expect(len(data) % 4).To(BeZero())
+
+		msgs, err := ParseMessages(data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).To(HaveLen(1))
+		msg := msgs[0]
+		Expect(msg.Type).To(Equal(uint16(6<<8 | 2)))
+		Expect(msg.Flags).To(Equal(uint16(FlagRequest | FlagAck)))
+		Expect(msg.Seq).To(Equal(uint32(42)))
+
+		attrs, err := ParseAttrs(msg.Payload)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attrs).To(HaveLen(3))
+		Expect(attrs[0].StringValue()).To(Equal("foo"))
+		Expect(attrs[1].Type).To(Equal(uint16(2)))
+		nested, err := ParseAttrs(attrs[1].Value)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nested).To(Equal([]Attr{
+			{Type: 3, Value: []byte{7}},
+			{Type: 4, Value: []byte{0x12, 0x34}},
+		}))
+		Expect(attrs[2]).To(Equal(Attr{Type: 5, Value: []byte{0xde, 0xad, 0xbe, 0xef}}))
+	})
+
+	It("should put the resource ID in network byte order", func() {
+		var b MsgBuilder
+		data := b.Message(4, 1, FlagRequest, ProtoUnspec, 0x0102, 1)
+		Expect(data[16:20]).To(Equal([]byte{ProtoUnspec, 0, 1, 2}))
+	})
+
+	It("should parse several messages from one datagram", func() {
+		var b MsgBuilder
+		data := append(b.Message(1, 0, 0, ProtoIPv4, 0, 1), errorMessage(2, 1)...)
+		msgs, err := ParseMessages(data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).To(HaveLen(2))
+		Expect(msgs[0].Payload).To(BeEmpty())
+		Expect(msgs[1].Type).To(Equal(uint16(MsgError)))
+		Expect(msgs[1].Errno()).To(Equal(int32(1)))
+	})
+
+	It("should reject a truncated message", func() {
+		var b MsgBuilder
+		data := b.Message(1, 0, 0, ProtoIPv4, 0, 1)
+		NativeEndian.PutUint32(data[0:4], 100)
+		_, err := ParseMessages(data)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject a bad attribute length", func() {
+		_, err := ParseAttrs([]byte{2, 0, 1, 0})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("SendRequests", func() {
+	var socket *fakeSocket
+
+	BeforeEach(func() {
+		socket = &fakeSocket{errnos: map[uint32]int32{}}
+	})
+
+	requests := func(n int) (reqs []Request) {
+		for i := 1; i <= n; i++ {
+			var b MsgBuilder
+			b.AddString(1, "x")
+			reqs = append(reqs, Request{Seq: uint32(i), Data: b.Message(1, 2, FlagRequest|FlagAck, ProtoIPv4, 0, uint32(i))})
+		}
+		return
+	}
+
+	It("should split the requests into batches and collect the acks", func() {
+		socket.errnos[200] = 2
+		acks := map[uint32]int32{}
+		err := SendRequests(socket, requests(300), func(req *Request, errno int32) error {
+			acks[req.Seq] = errno
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(acks).To(HaveLen(300))
+		Expect(acks[200]).To(Equal(int32(2)))
+		Expect(socket.batchSizes).To(Equal([]int{128, 128, 44}))
+	})
+
+	It("should stop after the batch that failed", func() {
+		socket.errnos[5] = 1
+		socket.errnos[6] = 3
+		numAcks := 0
+		err := SendRequests(socket, requests(300), func(req *Request, errno int32) error {
+			numAcks++
+			if errno != 0 {
+				return Error{Errno: errno, Request: "test"}
+			}
+			return nil
+		})
+		Expect(err).To(Equal(Error{Errno: 1, Request: "test"}))
+		Expect(numAcks).To(Equal(128))
+		Expect(socket.batchSizes).To(Equal([]int{128}))
+	})
+
+	It("should return a socket error", func() {
+		socket.sendErr = errors.New("dead socket")
+		err := SendRequests(socket, requests(1), func(req *Request, errno int32) error {
+			return nil
+		})
+		Expect(err).To(Equal(socket.sendErr))
+	})
+})
+
+var _ = Describe("Dump", func() {
+	var socket *fakeSocket
+
+	BeforeEach(func() {
+		socket = &fakeSocket{}
+	})
+
+	dumpRequest := func() []byte {
+		var b MsgBuilder
+		return b.Message(1, 1, FlagRequest|FlagDump, ProtoIPv4, 0, 7)
+	}
+
+	It("should pass each message of the dump to the callback", func() {
+		var b MsgBuilder
+		socket.responses = [][]byte{
+			append(b.Message(1, 0, 0, ProtoIPv4, 0, 7), b.Message(1, 0, 0, ProtoIPv4, 0, 7)...),
+			// A message for another request, which should be ignored.
+			b.Message(1, 0, 0, ProtoIPv4, 0, 6),
+			append(b.Message(1, 0, 0, ProtoIPv4, 0, 7), doneMessage(7)...),
+		}
+		numMsgs := 0
+		err := Dump(socket, dumpRequest(), 7, "dump", func(msg Message) error {
+			numMsgs++
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(numMsgs).To(Equal(3))
+	})
+
+	It("should return an Error if the kernel rejects the dump", func() {
+		socket.responses = [][]byte{errorMessage(7, 1)}
+		err := Dump(socket, dumpRequest(), 7, "dump", func(msg Message) error {
+			return nil
+		})
+		Expect(err).To(Equal(Error{Errno: 1, Request: "dump"}))
+	})
+
+	It("should stop if the callback fails", func() {
+		var b MsgBuilder
+		socket.responses = [][]byte{b.Message(1, 0, 0, ProtoIPv4, 0, 7)}
+		cbErr := errors.New("bad message")
+		err := Dump(socket, dumpRequest(), 7, "dump", func(msg Message) error {
+			return cbErr
+		})
+		Expect(err).To(Equal(cbErr))
+	})
+})
+
+// fakeSocket acks each request that it's sent, with the errno from errnos, or returns the
+// canned responses.
+type fakeSocket struct {
+	errnos     map[uint32]int32
+	responses  [][]byte
+	batchSizes []int
+	sendErr    error
+}
+
+func (s *fakeSocket) Send(data []byte) error {
+	if s.sendErr != nil {
+		return s.sendErr
+	}
+	if s.errnos == nil {
+		return nil
+	}
+	msgs, err := ParseMessages(data)
+	Expect(err).NotTo(HaveOccurred())
+	s.batchSizes = append(s.batchSizes, len(msgs))
+	// Send the acks back in two datagrams.
+	var acks []byte
+	for i, msg := range msgs {
+		acks = append(acks, errorMessage(msg.Seq, s.errnos[msg.Seq])...)
+		if i == len(msgs)/2 {
+			s.responses = append(s.responses, acks)
+			acks = nil
+		}
+	}
+	s.responses = append(s.responses, acks)
+	return nil
+}
+
+func (s *fakeSocket) Receive() ([]byte, error) {
+	Expect(s.responses).NotTo(BeEmpty(), "Receive() would block")
+	data := s.responses[0]
+	s.responses = s.responses[1:]
+	return data, nil
+}
+
+func (s *fakeSocket) Close() error {
+	return nil
+}
+
+func errorMessage(seq uint32, errno int32) []byte {
+	// struct nlmsgerr: negative errno followed by the header of the failed request.
+	payload := make([]byte, 4+16)
+	NativeEndian.PutUint32(payload[0:4], uint32(-errno))
+	return rawMessage(MsgError, seq, payload)
+}
+
+func doneMessage(seq uint32) []byte {
+	return rawMessage(MsgDone, seq, make([]byte, 4))
+}
+
+func rawMessage(msgType uint16, seq uint32, payload []byte) []byte {
+	msg := make([]byte, 16, 16+len(payload))
+	NativeEndian.PutUint32(msg[0:4], uint32(16+len(payload)))
+	NativeEndian.PutUint16(msg[4:6], msgType)
+	NativeEndian.PutUint32(msg[8:12], seq)
+	return append(msg, payload...)
+}
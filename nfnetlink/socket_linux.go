@@ -0,0 +1,98 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfnetlink
+
+import (
+	"syscall"
+	"time"
+)
+
+const (
+	netlinkNetfilter = 12
+
+	// recvBufSize is large enough for any single datagram that the kernel sends us; the kernel
+	// splits large dumps into several datagrams.
+	recvBufSize = 128 * 1024
+)
+
+// SocketOptions control the behaviour of a real netlink socket.
+type SocketOptions struct {
+	// RecvTimeout, if non-zero, limits how long Receive() waits for the kernel, so that we
+	// don't block forever if the kernel fails to respond to a request.
+	RecvTimeout time.Duration
+	// KernelRecvBufSize, if non-zero, sets the size of the kernel's socket buffer.  If we fall
+	// behind reading unsolicited messages and the buffer fills up, the kernel drops messages.
+	KernelRecvBufSize int
+}
+
+type realSocket struct {
+	fd      int
+	recvBuf []byte
+}
+
+// NewSocket opens a NETLINK_NETFILTER socket.
+func NewSocket(options SocketOptions) (Socket, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkNetfilter)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if options.RecvTimeout != 0 {
+		tv := syscall.NsecToTimeval(options.RecvTimeout.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	if options.KernelRecvBufSize != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, options.KernelRecvBufSize); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	return &realSocket{
+		fd:      fd,
+		recvBuf: make([]byte, recvBufSize),
+	}, nil
+}
+
+func (s *realSocket) Send(data []byte) error {
+	return syscall.Sendto(s.fd, data, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+}
+
+func (s *realSocket) Receive() ([]byte, error) {
+	for {
+		n, _, err := syscall.Recvfrom(s.fd, s.recvBuf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.ENOBUFS {
+			return nil, ErrBufferOverrun
+		}
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, n)
+		copy(data, s.recvBuf[:n])
+		return data, nil
+	}
+}
+
+func (s *realSocket) Close() error {
+	return syscall.Close(s.fd)
+}
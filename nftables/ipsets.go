@@ -0,0 +1,198 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nftables
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// IPSets holds the desired contents of all the IP sets for one IP version when Felix is using
+// the nftables backend.  It presents the same API as ipsets.IPSets to the dataplane managers.
+//
+// Unlike ipsets.IPSets, it doesn't program the dataplane itself.  nft sets are scoped to a table
+// and they can only be referenced by rules in the same table, so each Table that references a
+// set renders the set (and any changes to its members) as part of its own atomic update.  Each
+// set carries a generation number, which is incremented whenever its contents change, to allow
+// the Tables to cheaply detect which sets need to be updated.
+//
+// Like the Table, IPSets doesn't do any internal synchronization.
+type IPSets struct {
+	IPVersionConfig *ipsets.IPVersionConfig
+
+	setIDToSet map[string]*ipSet
+	nameToSet  map[string]*ipSet
+	nextGen    uint64
+
+	logCxt *log.Entry
+}
+
+// ipSet holds the desired state of a single nft set.
+type ipSet struct {
+	ipsets.IPSetMetadata
+
+	// Name is the name of the set in nft, which is derived from the main ipset name that the
+	// rule renderer uses in its match criteria.
+	Name string
+	// Members contains the nft rendering of each member.
+	Members set.Set
+	// Generation is updated each time the set changes.
+	Generation uint64
+}
+
+func NewIPSets(ipVersionConfig *ipsets.IPVersionConfig) *IPSets {
+	return &IPSets{
+		IPVersionConfig: ipVersionConfig,
+		setIDToSet:      map[string]*ipSet{},
+		nameToSet:       map[string]*ipSet{},
+		nextGen:         1,
+		logCxt: log.WithFields(log.Fields{
+			"family":  ipVersionConfig.Family,
+			"backend": "nftables",
+		}),
+	}
+}
+
+// AddOrReplaceIPSet records the desired contents of an IP set, replacing any previous contents.
+func (s *IPSets) AddOrReplaceIPSet(setMetadata ipsets.IPSetMetadata, members []string) {
+	s.logCxt.WithFields(log.Fields{
+		"setID":   setMetadata.SetID,
+		"setType": setMetadata.Type,
+	}).Info("Queueing IP set for creation")
+	name := SetNameForIPSet(s.IPVersionConfig.NameForMainIPSet(setMetadata.SetID))
+	ipSet := &ipSet{
+		IPSetMetadata: setMetadata,
+		Name:          name,
+		Members:       s.filterAndRenderMembers(setMetadata.Type, members),
+		Generation:    s.nextGeneration(),
+	}
+	s.setIDToSet[setMetadata.SetID] = ipSet
+	s.nameToSet[name] = ipSet
+}
+
+// RemoveIPSet removes the given IP set.  The Tables that reference the set will remove it on
+// their next Apply(), once they no longer have any rules that reference it.
+func (s *IPSets) RemoveIPSet(setID string) {
+	s.logCxt.WithField("setID", setID).Info("Queueing IP set for removal")
+	ipSet := s.setIDToSet[setID]
+	if ipSet == nil {
+		return
+	}
+	delete(s.setIDToSet, setID)
+	delete(s.nameToSet, ipSet.Name)
+}
+
+// AddMembers adds the given members to the IP set.  Filters out members that are of the incorrect
+// IP version.
+func (s *IPSets) AddMembers(setID string, newMembers []string) {
+	ipSet := s.setIDToSet[setID]
+	members := s.filterAndRenderMembers(ipSet.Type, newMembers)
+	if members.Len() == 0 {
+		return
+	}
+	members.Iter(func(item interface{}) error {
+		ipSet.Members.Add(item)
+		return nil
+	})
+	ipSet.Generation = s.nextGeneration()
+}
+
+// RemoveMembers removes the given members from the IP set.  Members of the wrong IP version
+// are ignored.
+func (s *IPSets) RemoveMembers(setID string, removedMembers []string) {
+	ipSet := s.setIDToSet[setID]
+	members := s.filterAndRenderMembers(ipSet.Type, removedMembers)
+	if members.Len() == 0 {
+		return
+	}
+	members.Iter(func(item interface{}) error {
+		ipSet.Members.Discard(item)
+		return nil
+	})
+	ipSet.Generation = s.nextGeneration()
+}
+
+// QueueResync is a no-op; the Tables that render our sets handle resyncs.
+func (s *IPSets) QueueResync() {}
+
+// ApplyUpdates is a no-op; the Tables that render our sets write them to the dataplane.
+func (s *IPSets) ApplyUpdates() {}
+
+// ApplyDeletions is a no-op; the Tables that render our sets write them to the dataplane.
+func (s *IPSets) ApplyDeletions() {}
+
+// lookup returns the desired state of the set with the given nft name or nil if it isn't known.
+func (s *IPSets) lookup(name string) *ipSet {
+	return s.nameToSet[name]
+}
+
+func (s *IPSets) nextGeneration() uint64 {
+	gen := s.nextGen
+	s.nextGen++
+	return gen
+}
+
+func (s *IPSets) filterAndRenderMembers(setType ipsets.IPSetType, members []string) set.Set {
+	filtered := set.New()
+	wantIPV6 := s.IPVersionConfig.Family == ipsets.IPFamilyV6
+	for _, member := range members {
+		if setType.IsMemberIPV6(member) != wantIPV6 {
+			continue
+		}
+		canon := setType.CanonicaliseMember(member).String()
+		filtered.Add(renderElement(setType, canon))
+	}
+	return filtered
+}
+
+// renderElement converts the ipset representation of a member into an nft set element.
+func renderElement(setType ipsets.IPSetType, member string) string {
+	if setType != ipsets.IPSetTypeHashIPPort {
+		return member
+	}
+	// Convert "<IP>,<proto>:<port>" to "<IP> . <proto> . <port>".
+	parts := strings.SplitN(member, ",", 2)
+	protoAndPort := strings.SplitN(parts[1], ":", 2)
+	return fmt.Sprintf("%s . %s . %s", parts[0], protoAndPort[0], protoAndPort[1])
+}
+
+// renderSetDefinition renders the body of an nft set declaration for the given set.
+func renderSetDefinition(ipSet *ipSet, ipVersion uint8) string {
+	addrType := "ipv4_addr"
+	if ipVersion == 6 {
+		addrType = "ipv6_addr"
+	}
+	var spec string
+	switch ipSet.Type {
+	case ipsets.IPSetTypeHashIP:
+		spec = fmt.Sprintf("type %s;", addrType)
+	case ipsets.IPSetTypeHashNet:
+		// Our CIDRs may overlap so we need the kernel to merge them.
+		spec = fmt.Sprintf("type %s; flags interval; auto-merge;", addrType)
+	case ipsets.IPSetTypeHashIPPort:
+		spec = fmt.Sprintf("type %s . inet_proto . inet_service;", addrType)
+	default:
+		log.WithField("type", ipSet.Type).Panic("Unknown IP set type")
+	}
+	if ipSet.MaxSize > 0 {
+		spec += fmt.Sprintf(" size %d;", ipSet.MaxSize)
+	}
+	return "{ " + spec + " }"
+}
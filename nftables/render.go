@@ -0,0 +1,268 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nftables
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+// The rule renderer produces iptables.Rule objects, whose match criteria are iptables command
+// line fragments generated by iptables.MatchCriteria.  Rather than duplicating the renderer, we
+// translate each fragment into its nft equivalent.  Since the fragments all come from the match
+// builder, the set of forms that we need to recognise is small and fixed.  Any fragment that
+// we don't recognise is an error: silently dropping a match would broaden the rule.
+
+var (
+	ErrUnsupportedMatch  = errors.New("match criteria not supported by nftables backend")
+	ErrUnsupportedAction = errors.New("action not supported by nftables backend")
+)
+
+var (
+	markRegexp      = regexp.MustCompile(`^-m mark (! )?--mark (0x[0-9a-f]+|0)/(0x[0-9a-f]+)$`)
+	ifaceRegexp     = regexp.MustCompile(`^--(in|out)-interface (\S+)$`)
+	addrTypeRegexp  = regexp.MustCompile(`^-m addrtype (! )?--(src|dst)-type (\S+)( --limit-iface-out)?$`)
+	ctStateRegexp   = regexp.MustCompile(`^-m conntrack --ctstate (\S+)$`)
+	protocolRegexp  = regexp.MustCompile(`^(! )?-p (\S+)$`)
+	netRegexp       = regexp.MustCompile(`^(! )?--(source|destination) (\S+)$`)
+	ipSetRegexp     = regexp.MustCompile(`^-m set (! )?--match-set (\S+) (src|dst)(,src|,dst)?$`)
+	multiportRegexp = regexp.MustCompile(`^-m multiport (! )?--(source|destination)-ports (\S+)$`)
+	icmpRegexp      = regexp.MustCompile(`^-m (icmp|icmp6) (! )?--icmp(?:v6)?-type (\d+)(?:/(\d+))?$`)
+)
+
+// SetNameForIPSet converts an ipset name, as rendered into iptables match criteria by the rule
+// renderer, into a valid nft set name.  nft identifiers may not contain ':', which our ipset
+// names use as a separator.
+func SetNameForIPSet(ipSetName string) string {
+	return strings.Replace(ipSetName, ":", "_", -1)
+}
+
+// ipSetNameFromFragment returns the name of the ipset referenced by the given match fragment, or
+// "" if the fragment doesn't reference an ipset.
+func ipSetNameFromFragment(fragment string) string {
+	captures := ipSetRegexp.FindStringSubmatch(fragment)
+	if captures == nil {
+		return ""
+	}
+	return captures[2]
+}
+
+// addrFamilyKeyword returns the nft payload keyword for the IP header of the given IP version.
+func addrFamilyKeyword(ipVersion uint8) string {
+	if ipVersion == 6 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+func neq(negated string) string {
+	if negated != "" {
+		return "!= "
+	}
+	return ""
+}
+
+// RenderMatch converts a single iptables match fragment into an nft expression.
+func RenderMatch(fragment string, ipVersion uint8) (string, error) {
+	family := addrFamilyKeyword(ipVersion)
+
+	if captures := markRegexp.FindStringSubmatch(fragment); captures != nil {
+		mark, err := strconv.ParseUint(captures[2], 0, 32)
+		if err != nil {
+			return "", err
+		}
+		mask, err := strconv.ParseUint(captures[3], 0, 32)
+		if err != nil {
+			return "", err
+		}
+		op := "=="
+		if captures[1] != "" {
+			op = "!="
+		}
+		return fmt.Sprintf("meta mark & %#x %s %#x", mask, op, mark), nil
+	}
+	if captures := ifaceRegexp.FindStringSubmatch(fragment); captures != nil {
+		// iptables uses "+" as its interface wildcard, nft uses "*".
+		ifaceMatch := strings.Replace(captures[2], "+", "*", -1)
+		if captures[1] == "in" {
+			return fmt.Sprintf(`iifname "%s"`, ifaceMatch), nil
+		}
+		return fmt.Sprintf(`oifname "%s"`, ifaceMatch), nil
+	}
+	switch fragment {
+	case "-m rpfilter":
+		return "fib saddr . iif oif exists", nil
+	case "-m rpfilter --invert":
+		return "fib saddr . iif oif missing", nil
+	}
+	if captures := addrTypeRegexp.FindStringSubmatch(fragment); captures != nil {
+		addr := "saddr"
+		if captures[2] == "dst" {
+			addr = "daddr"
+		}
+		if captures[4] != "" {
+			addr += " . oif"
+		}
+		return fmt.Sprintf("fib %s type %s%s", addr, neq(captures[1]), strings.ToLower(captures[3])), nil
+	}
+	if captures := ctStateRegexp.FindStringSubmatch(fragment); captures != nil {
+		return "ct state " + strings.ToLower(captures[1]), nil
+	}
+	if captures := protocolRegexp.FindStringSubmatch(fragment); captures != nil {
+		return fmt.Sprintf("meta l4proto %s%s", neq(captures[1]), captures[2]), nil
+	}
+	if captures := netRegexp.FindStringSubmatch(fragment); captures != nil {
+		addr := "saddr"
+		if captures[2] == "destination" {
+			addr = "daddr"
+		}
+		return fmt.Sprintf("%s %s %s%s", family, addr, neq(captures[1]), captures[3]), nil
+	}
+	if captures := ipSetRegexp.FindStringSubmatch(fragment); captures != nil {
+		addr := "saddr"
+		port := "sport"
+		if captures[3] == "dst" {
+			addr = "daddr"
+			port = "dport"
+		}
+		setName := SetNameForIPSet(captures[2])
+		if captures[4] != "" {
+			// IP,port set, we store the protocol in the set alongside the IP and port.
+			return fmt.Sprintf("%s %s . meta l4proto . th %s %s@%s",
+				family, addr, port, neq(captures[1]), setName), nil
+		}
+		return fmt.Sprintf("%s %s %s@%s", family, addr, neq(captures[1]), setName), nil
+	}
+	if captures := multiportRegexp.FindStringSubmatch(fragment); captures != nil {
+		port := "sport"
+		if captures[2] == "destination" {
+			port = "dport"
+		}
+		// Multiport uses "a:b" for ranges, nft uses "a-b".
+		ports := strings.Split(strings.Replace(captures[3], ":", "-", -1), ",")
+		return fmt.Sprintf("th %s %s{ %s }", port, neq(captures[1]), strings.Join(ports, ", ")), nil
+	}
+	if captures := icmpRegexp.FindStringSubmatch(fragment); captures != nil {
+		proto := "icmp"
+		if captures[1] == "icmp6" {
+			proto = "icmpv6"
+		}
+		if captures[4] == "" {
+			return fmt.Sprintf("%s type %s%s", proto, neq(captures[2]), captures[3]), nil
+		}
+		if captures[2] == "" {
+			return fmt.Sprintf("%s type %s %s code %s", proto, captures[3], proto, captures[4]), nil
+		}
+		// nft can't negate a conjunction directly; use a concatenation instead.
+		return fmt.Sprintf("%s type . %s code != { %s . %s }",
+			proto, proto, captures[3], captures[4]), nil
+	}
+	// Notably, this includes "-m ipvs", which has no nft equivalent.
+	return "", ErrUnsupportedMatch
+}
+
+// RenderMatchCriteria converts all the fragments in the given match criteria to nft.
+func RenderMatchCriteria(m iptables.MatchCriteria, ipVersion uint8) (string, error) {
+	parts := make([]string, 0, len(m))
+	for _, fragment := range m {
+		part, err := RenderMatch(fragment, ipVersion)
+		if err != nil {
+			return "", fmt.Errorf("%v: %q", err, fragment)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// RenderAction converts an iptables action into the equivalent nft statement.
+func RenderAction(a iptables.Action, ipVersion uint8) (string, error) {
+	switch a := a.(type) {
+	case iptables.JumpAction:
+		return "jump " + a.Target, nil
+	case iptables.GotoAction:
+		return "goto " + a.Target, nil
+	case iptables.ReturnAction:
+		return "return", nil
+	case iptables.DropAction:
+		return "drop", nil
+	case iptables.AcceptAction:
+		return "accept", nil
+	case iptables.LogAction:
+		// Level 5 in the iptables LOG action is "notice".
+		return fmt.Sprintf(`log prefix "%s: " level notice`, a.Prefix), nil
+	case iptables.NflogAction:
+		return fmt.Sprintf(`log prefix "%s" group %d`, a.Prefix, a.Group), nil
+	case iptables.DNATAction:
+		addr := a.DestAddr
+		if ipVersion == 6 && a.DestPort != 0 {
+			addr = "[" + addr + "]"
+		}
+		if a.DestPort == 0 {
+			return fmt.Sprintf("dnat to %s", addr), nil
+		}
+		return fmt.Sprintf("dnat to %s:%d", addr, a.DestPort), nil
+	case iptables.SNATAction:
+		return fmt.Sprintf("snat to %s", a.ToAddr), nil
+	case iptables.MasqAction:
+		return "masquerade", nil
+	case iptables.ClearMarkAction:
+		return fmt.Sprintf("meta mark set meta mark & %#x", ^a.Mark), nil
+	case iptables.SetMarkAction:
+		return fmt.Sprintf("meta mark set meta mark | %#x", a.Mark), nil
+	case iptables.SetMaskedMarkAction:
+		return fmt.Sprintf("meta mark set meta mark & %#x | %#x", ^a.Mask, a.Mark), nil
+	case iptables.NoTrackAction:
+		return "notrack", nil
+	}
+	return "", ErrUnsupportedAction
+}
+
+// RenderRule converts an iptables.Rule to the body of an nft "add rule" command, i.e. without
+// the "add rule <family> <table> <chain>" prefix.  Every rule gets a counter (to match
+// iptables' behaviour) and a comment containing the given hash, which we use to detect
+// whether the dataplane is in sync.
+func RenderRule(r iptables.Rule, ipVersion uint8, hashComment string) (string, error) {
+	fragments := make([]string, 0, 4)
+	match, err := RenderMatchCriteria(r.Match, ipVersion)
+	if err != nil {
+		return "", err
+	}
+	if match != "" {
+		fragments = append(fragments, match)
+	}
+	fragments = append(fragments, "counter")
+	if r.Action != nil {
+		action, err := RenderAction(r.Action, ipVersion)
+		if err != nil {
+			return "", fmt.Errorf("%v: %v", err, r.Action)
+		}
+		fragments = append(fragments, action)
+	}
+	comment := hashComment
+	if r.Comment != "" {
+		comment += "; " + r.Comment
+	}
+	if len(comment) > maxCommentLength {
+		comment = comment[:maxCommentLength]
+	}
+	comment = strings.Replace(comment, `"`, `'`, -1)
+	fragments = append(fragments, fmt.Sprintf(`comment "%s"`, comment))
+	return strings.Join(fragments, " "), nil
+}
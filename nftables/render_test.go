@@ -0,0 +1,127 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nftables_test
+
+import (
+	. "github.com/projectcalico/felix/nftables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = DescribeTable("RenderMatch",
+	func(match iptables.MatchCriteria, ipVersion int, expRendering string) {
+		Expect(RenderMatchCriteria(match, uint8(ipVersion))).To(Equal(expRendering))
+	},
+	// Marks.
+	Entry("MarkClear", iptables.Match().MarkClear(0x400a), 4, "meta mark & 0x400a == 0"),
+	Entry("MarkNotClear", iptables.Match().MarkNotClear(0x400a), 4, "meta mark & 0x400a != 0"),
+	Entry("MarkSingleBitSet", iptables.Match().MarkSingleBitSet(0x4000), 4, "meta mark & 0x4000 == 0x4000"),
+	Entry("NotMarkMatchesWithMask", iptables.Match().NotMarkMatchesWithMask(0x400a, 0xf00f), 4,
+		"meta mark & 0xf00f != 0x400a"),
+	// Conntrack.
+	Entry("ConntrackState", iptables.Match().ConntrackState("RELATED,ESTABLISHED"), 4,
+		"ct state related,established"),
+	// Interfaces.
+	Entry("InInterface", iptables.Match().InInterface("cali+"), 4, `iifname "cali*"`),
+	Entry("OutInterface", iptables.Match().OutInterface("tap1234abcd"), 4, `oifname "tap1234abcd"`),
+	// RPF.
+	Entry("RPFCheckFailed", iptables.Match().RPFCheckFailed(), 4, "fib saddr . iif oif missing"),
+	// Address types.
+	Entry("SrcAddrType limit iface", iptables.Match().SrcAddrType(iptables.AddrTypeLocal, true), 4,
+		"fib saddr . oif type local"),
+	Entry("NotSrcAddrType", iptables.Match().NotSrcAddrType(iptables.AddrTypeLocal, false), 4,
+		"fib saddr type != local"),
+	Entry("DestAddrType", iptables.Match().DestAddrType(iptables.AddrTypeLocal), 4,
+		"fib daddr type local"),
+	// Protocol.
+	Entry("Protocol", iptables.Match().Protocol("tcp"), 4, "meta l4proto tcp"),
+	Entry("NotProtocolNum", iptables.Match().NotProtocolNum(123), 4, "meta l4proto != 123"),
+	// CIDRs.
+	Entry("SourceNet v4", iptables.Match().SourceNet("10.0.0.0/8"), 4, "ip saddr 10.0.0.0/8"),
+	Entry("NotDestNet v6", iptables.Match().NotDestNet("fe80::/64"), 6, "ip6 daddr != fe80::/64"),
+	// IP sets.
+	Entry("SourceIPSet", iptables.Match().SourceIPSet("cali40s:abcd"), 4, "ip saddr @cali40s_abcd"),
+	Entry("NotDestIPSet", iptables.Match().NotDestIPSet("cali60s:abcd"), 6, "ip6 daddr != @cali60s_abcd"),
+	Entry("DestIPPortSet", iptables.Match().DestIPPortSet("cali40n:abcd"), 4,
+		"ip daddr . meta l4proto . th dport @cali40n_abcd"),
+	// Ports.
+	Entry("DestPorts", iptables.Match().DestPorts(80, 443), 4, "th dport { 80, 443 }"),
+	Entry("NotSourcePortRanges", iptables.Match().NotSourcePortRanges([]*proto.PortRange{
+		{First: 1234, Last: 1234},
+		{First: 5678, Last: 6000},
+	}), 4, "th sport != { 1234, 5678-6000 }"),
+	// ICMP.
+	Entry("ICMPType", iptables.Match().ICMPType(8), 4, "icmp type 8"),
+	Entry("ICMPTypeAndCode", iptables.Match().ICMPTypeAndCode(8, 1), 4, "icmp type 8 icmp code 1"),
+	Entry("NotICMPV6TypeAndCode", iptables.Match().NotICMPV6TypeAndCode(128, 0), 6,
+		"icmpv6 type . icmpv6 code != { 128 . 0 }"),
+	// Combination.
+	Entry("Protocol and ports", iptables.Match().Protocol("udp").DestPorts(53), 4,
+		"meta l4proto udp th dport { 53 }"),
+)
+
+var _ = Describe("RenderMatch failure cases", func() {
+	It("should reject IPVS matches", func() {
+		_, err := RenderMatchCriteria(iptables.Match().IPVSConnection(), 4)
+		Expect(err).To(HaveOccurred())
+	})
+	It("should reject unknown fragments", func() {
+		_, err := RenderMatch("-m foobar --baz", 4)
+		Expect(err).To(Equal(ErrUnsupportedMatch))
+	})
+})
+
+var _ = DescribeTable("RenderAction",
+	func(action iptables.Action, ipVersion int, expRendering string) {
+		Expect(RenderAction(action, uint8(ipVersion))).To(Equal(expRendering))
+	},
+	Entry("Goto", iptables.GotoAction{Target: "cali-abcd"}, 4, "goto cali-abcd"),
+	Entry("Jump", iptables.JumpAction{Target: "cali-abcd"}, 4, "jump cali-abcd"),
+	Entry("Return", iptables.ReturnAction{}, 4, "return"),
+	Entry("Drop", iptables.DropAction{}, 4, "drop"),
+	Entry("Accept", iptables.AcceptAction{}, 4, "accept"),
+	Entry("Log", iptables.LogAction{Prefix: "calico-drop"}, 4, `log prefix "calico-drop: " level notice`),
+	Entry("Nflog", iptables.NflogAction{Group: 20, Prefix: "DO|0123456789abcdef|pro:kns.default"}, 4,
+		`log prefix "DO|0123456789abcdef|pro:kns.default" group 20`),
+	Entry("DNAT v4", iptables.DNATAction{DestAddr: "10.0.0.1", DestPort: 8080}, 4, "dnat to 10.0.0.1:8080"),
+	Entry("DNAT v6", iptables.DNATAction{DestAddr: "fd00::1", DestPort: 8080}, 6, "dnat to [fd00::1]:8080"),
+	Entry("SNAT", iptables.SNATAction{ToAddr: "10.0.0.1"}, 4, "snat to 10.0.0.1"),
+	Entry("Masq", iptables.MasqAction{}, 4, "masquerade"),
+	Entry("ClearMark", iptables.ClearMarkAction{Mark: 0x1000}, 4, "meta mark set meta mark & 0xffffefff"),
+	Entry("SetMark", iptables.SetMarkAction{Mark: 0x1000}, 4, "meta mark set meta mark | 0x1000"),
+	Entry("SetMaskedMark", iptables.SetMaskedMarkAction{Mark: 0x1000, Mask: 0xf000}, 4,
+		"meta mark set meta mark & 0xffff0fff | 0x1000"),
+	Entry("NoTrack", iptables.NoTrackAction{}, 4, "notrack"),
+)
+
+var _ = Describe("RenderRule", func() {
+	It("should render a full rule with hash comment", func() {
+		r := iptables.Rule{
+			Match:   iptables.Match().Protocol("tcp").DestPorts(80),
+			Action:  iptables.AcceptAction{},
+			Comment: "Allow HTTP",
+		}
+		Expect(RenderRule(r, 4, "cali:abcdef")).To(Equal(
+			`meta l4proto tcp th dport { 80 } counter accept comment "cali:abcdef; Allow HTTP"`))
+	})
+	It("should render a rule with no match or action", func() {
+		Expect(RenderRule(iptables.Rule{}, 4, "cali:abcdef")).To(Equal(`counter comment "cali:abcdef"`))
+	})
+})
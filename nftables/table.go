@@ -0,0 +1,823 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nftables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+const (
+	// TableNamePrefix is prepended to the iptables table name to get the name of the nft table
+	// that we own.  For example, the rules that would go in the iptables "filter" table go in
+	// the nft table "calico-filter".
+	TableNamePrefix = "calico-"
+
+	// nft limits rule comments to 128 bytes.
+	maxCommentLength = 128
+)
+
+// baseChain describes the nft base chain that we use in place of one of the kernel's iptables
+// chains.  We use the same hooks and priorities as the corresponding iptables table.
+type baseChain struct {
+	Type     string
+	Hook     string
+	Priority int
+}
+
+var (
+	// tableToBaseChains maps from iptables table name to the kernel chains of that table and the
+	// nft base chain parameters that we use to emulate them.
+	tableToBaseChains = map[string]map[string]baseChain{
+		"filter": {
+			"INPUT":   {"filter", "input", 0},
+			"FORWARD": {"filter", "forward", 0},
+			"OUTPUT":  {"filter", "output", 0},
+		},
+		"nat": {
+			"PREROUTING":  {"nat", "prerouting", -100},
+			"INPUT":       {"nat", "input", 100},
+			"OUTPUT":      {"nat", "output", -100},
+			"POSTROUTING": {"nat", "postrouting", 100},
+		},
+		"mangle": {
+			"PREROUTING":  {"filter", "prerouting", -150},
+			"INPUT":       {"filter", "input", -150},
+			"FORWARD":     {"filter", "forward", -150},
+			"OUTPUT":      {"route", "output", -150},
+			"POSTROUTING": {"filter", "postrouting", -150},
+		},
+		"raw": {
+			"PREROUTING": {"filter", "prerouting", -300},
+			"OUTPUT":     {"filter", "output", -300},
+		},
+	}
+
+	chainRegexp = regexp.MustCompile(`^\s*chain (\S+) \{`)
+	setRegexp   = regexp.MustCompile(`^\s*set (\S+) \{`)
+
+	countNumNftCalls = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_nft_calls",
+		Help: "Number of nft -f calls.",
+	})
+	countNumNftErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_nft_errors",
+		Help: "Number of nft -f errors.",
+	})
+	countNumNftListCalls = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_nft_list_calls",
+		Help: "Number of nft list calls.",
+	})
+	gaugeNumNftChains = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_nft_chains",
+		Help: "Number of active nftables chains.",
+	}, []string{"ip_version", "table"})
+	gaugeNumNftRules = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_nft_rules",
+		Help: "Number of active nftables rules.",
+	}, []string{"ip_version", "table"})
+)
+
+func init() {
+	prometheus.MustRegister(countNumNftCalls)
+	prometheus.MustRegister(countNumNftErrors)
+	prometheus.MustRegister(countNumNftListCalls)
+	prometheus.MustRegister(gaugeNumNftChains)
+	prometheus.MustRegister(gaugeNumNftRules)
+}
+
+// Table is an nftables-based alternative to iptables.Table.  It has the same API as the
+// iptables Table (UpdateChains(), SetRuleInsertions(), RemoveChainByName(), Apply(), etc.) and
+// it consumes the same iptables.Chain and iptables.Rule objects, which are rendered by the
+// rules.RuleRenderer.  Each Table owns one nft table, named after the iptables table that it
+// replaces (for example "calico-filter" in the "ip" family).
+//
+// Rule insertions into the kernel's chains are emulated by creating base chains, with the same
+// hook and priority as the corresponding iptables table, in our own nft table.  Since we own the
+// whole nft table, we never need to share a chain with another application and the insert mode
+// only affects logging.
+//
+// IP sets are rendered as nft sets inside the table.  The contents of the sets come from the
+// IPSets object for the Table's IP version.  Only sets that are referenced by the table's rules
+// are rendered.
+//
+// All updates are written in a single "nft -f" transaction, which the kernel applies
+// atomically.  After a restart, or if we detect that the table has been modified by another
+// process, we rewrite the whole table, using the "add table; delete table; table {...}" idiom
+// so that the replacement is also atomic.
+//
+// To check that the dataplane is in sync, we use the same trick as the iptables Table: each
+// rule carries a comment containing a hash of the rule and we compare the hashes that we read
+// back from "nft list table" with the hashes that we expect.
+//
+// Like the iptables Table, Table doesn't do any internal synchronization.
+type Table struct {
+	Name      string
+	IPVersion uint8
+
+	nftFamily    string
+	nftTableName string
+
+	chainToInsertedRules map[string][]iptables.Rule
+	dirtyInserts         set.Set
+
+	chainNameToChain map[string]*iptables.Chain
+	dirtyChains      set.Set
+
+	// chainToSetNames records the nft sets that are referenced by each chain (including base
+	// chains).
+	chainToSetNames map[string][]string
+
+	ipSets *IPSets
+
+	// chainToDataplaneHashes contains the rule hashes that we think are in the dataplane.
+	chainToDataplaneHashes map[string][]string
+	// setNameToDataplaneSet contains the state of the sets that we've programmed.
+	setNameToDataplaneSet map[string]*dataplaneSet
+
+	inSyncWithDataPlane bool
+	fullRewriteRequired bool
+
+	hashCommentPrefix string
+	hashCommentRegexp *regexp.Regexp
+
+	insertMode string
+
+	lastReadTime    time.Time
+	refreshInterval time.Duration
+
+	logCxt *log.Entry
+
+	gaugeNumChains prometheus.Gauge
+	gaugeNumRules  prometheus.Gauge
+
+	// Factory for making commands, used by UTs to shim exec.Command().
+	newCmd cmdFactory
+	// Shims for time.XXX functions:
+	timeSleep func(d time.Duration)
+	timeNow   func() time.Time
+}
+
+// dataplaneSet records what we've written to the dataplane for a particular set.
+type dataplaneSet struct {
+	Metadata   string
+	Generation uint64
+	Members    set.Set
+}
+
+type TableOptions struct {
+	InsertMode      string
+	RefreshInterval time.Duration
+
+	// NewCmdOverride for tests, if non-nil, factory to use instead of the real exec.Command()
+	NewCmdOverride cmdFactory
+	// SleepOverride for tests, if non-nil, replacement for time.Sleep()
+	SleepOverride func(d time.Duration)
+	// NowOverride for tests, if non-nil, replacement for time.Now()
+	NowOverride func() time.Time
+}
+
+func NewTable(
+	name string,
+	ipVersion uint8,
+	hashPrefix string,
+	ipSets *IPSets,
+	options TableOptions,
+) *Table {
+	if _, ok := tableToBaseChains[name]; !ok {
+		log.WithField("table", name).Panic("Unknown table")
+	}
+	hashCommentRegexp := regexp.MustCompile(`comment "` + regexp.QuoteMeta(hashPrefix) + `([a-zA-Z0-9_-]+)`)
+
+	var insertMode string
+	switch options.InsertMode {
+	case "", "insert":
+		insertMode = "insert"
+	case "append":
+		insertMode = "append"
+	default:
+		log.WithField("insertMode", options.InsertMode).Panic("Unknown insert mode")
+	}
+
+	newCmd := newRealCmd
+	if options.NewCmdOverride != nil {
+		newCmd = options.NewCmdOverride
+	}
+	sleep := time.Sleep
+	if options.SleepOverride != nil {
+		sleep = options.SleepOverride
+	}
+	now := time.Now
+	if options.NowOverride != nil {
+		now = options.NowOverride
+	}
+
+	nftFamily := "ip"
+	if ipVersion == 6 {
+		nftFamily = "ip6"
+	}
+
+	return &Table{
+		Name:      name,
+		IPVersion: ipVersion,
+
+		nftFamily:    nftFamily,
+		nftTableName: TableNamePrefix + name,
+
+		chainToInsertedRules:   map[string][]iptables.Rule{},
+		dirtyInserts:           set.New(),
+		chainNameToChain:       map[string]*iptables.Chain{},
+		dirtyChains:            set.New(),
+		chainToSetNames:        map[string][]string{},
+		ipSets:                 ipSets,
+		chainToDataplaneHashes: map[string][]string{},
+		setNameToDataplaneSet:  map[string]*dataplaneSet{},
+
+		// Always start by rewriting the whole table; this cleans up anything left over
+		// from a previous run.
+		fullRewriteRequired: true,
+
+		hashCommentPrefix: hashPrefix,
+		hashCommentRegexp: hashCommentRegexp,
+		insertMode:        insertMode,
+		refreshInterval:   options.RefreshInterval,
+
+		logCxt: log.WithFields(log.Fields{
+			"ipVersion": ipVersion,
+			"table":     name,
+			"backend":   "nftables",
+		}),
+
+		gaugeNumChains: gaugeNumNftChains.WithLabelValues(fmt.Sprintf("%d", ipVersion), name),
+		gaugeNumRules:  gaugeNumNftRules.WithLabelValues(fmt.Sprintf("%d", ipVersion), name),
+
+		newCmd:    newCmd,
+		timeSleep: sleep,
+		timeNow:   now,
+	}
+}
+
+func (t *Table) SetRuleInsertions(chainName string, rules []iptables.Rule) {
+	t.logCxt.WithFields(log.Fields{
+		"chainName":  chainName,
+		"insertMode": t.insertMode,
+	}).Debug("Updating rule insertions")
+	if _, ok := tableToBaseChains[t.Name][chainName]; !ok {
+		t.logCxt.WithField("chainName", chainName).Panic("Rule insertion into unknown kernel chain")
+	}
+	oldRules := t.chainToInsertedRules[chainName]
+	t.chainToInsertedRules[chainName] = rules
+	t.gaugeNumRules.Add(float64(len(rules) - len(oldRules)))
+	t.chainToSetNames[chainName] = t.mustCalculateSetRefs(chainName, rules)
+	t.dirtyInserts.Add(chainName)
+}
+
+func (t *Table) UpdateChains(chains []*iptables.Chain) {
+	for _, chain := range chains {
+		t.UpdateChain(chain)
+	}
+}
+
+func (t *Table) UpdateChain(chain *iptables.Chain) {
+	t.logCxt.WithField("chainName", chain.Name).Info("Queueing update of chain.")
+	oldNumRules := 0
+	if oldChain := t.chainNameToChain[chain.Name]; oldChain != nil {
+		oldNumRules = len(oldChain.Rules)
+	}
+	t.chainNameToChain[chain.Name] = chain
+	t.gaugeNumRules.Add(float64(len(chain.Rules) - oldNumRules))
+	t.chainToSetNames[chain.Name] = t.mustCalculateSetRefs(chain.Name, chain.Rules)
+	t.dirtyChains.Add(chain.Name)
+}
+
+func (t *Table) RemoveChains(chains []*iptables.Chain) {
+	for _, chain := range chains {
+		t.RemoveChainByName(chain.Name)
+	}
+}
+
+func (t *Table) RemoveChainByName(name string) {
+	t.logCxt.WithField("chainName", name).Info("Queing deletion of chain.")
+	if oldChain, known := t.chainNameToChain[name]; known {
+		t.gaugeNumRules.Sub(float64(len(oldChain.Rules)))
+		delete(t.chainNameToChain, name)
+		delete(t.chainToSetNames, name)
+		t.dirtyChains.Add(name)
+	}
+}
+
+// mustCalculateSetRefs returns the names of the nft sets referenced by the given rules.  As a
+// side-effect, it checks that the rules can be rendered; a rule that can't be rendered is a bug
+// (or a feature that the nftables backend doesn't support) so we panic rather than risk
+// programming a rule that is broader than intended.
+func (t *Table) mustCalculateSetRefs(chainName string, rules []iptables.Rule) []string {
+	var setNames []string
+	for _, r := range rules {
+		if _, err := RenderRule(r, t.IPVersion, ""); err != nil {
+			t.logCxt.WithError(err).WithFields(log.Fields{
+				"chainName": chainName,
+				"rule":      r,
+			}).Panic("Unable to render rule for nftables")
+		}
+		for _, frag := range r.Match {
+			if ipSetName := ipSetNameFromFragment(frag); ipSetName != "" {
+				setNames = append(setNames, SetNameForIPSet(ipSetName))
+			}
+		}
+	}
+	return setNames
+}
+
+func (t *Table) InvalidateDataplaneCache(reason string) {
+	logCxt := t.logCxt.WithField("reason", reason)
+	if !t.inSyncWithDataPlane {
+		logCxt.Debug("Would invalidate dataplane cache but it was already invalid.")
+		return
+	}
+	logCxt.Info("Invalidating dataplane cache")
+	t.inSyncWithDataPlane = false
+}
+
+// SetRefreshInterval changes the interval after which Apply() forces a full reload of the
+// table from the dataplane.  A zero interval disables the periodic refresh.
+func (t *Table) SetRefreshInterval(interval time.Duration) {
+	t.logCxt.WithField("interval", interval).Info("Updating refresh interval")
+	t.refreshInterval = interval
+}
+
+// Apply writes any pending changes to the dataplane.  It returns the time after which it
+// would like to be called again in order to refresh the dataplane (or 0 if no refresh is
+// needed).
+func (t *Table) Apply() (rescheduleAfter time.Duration) {
+	now := t.timeNow()
+	if t.refreshInterval > 0 && now.Sub(t.lastReadTime) > t.refreshInterval {
+		t.InvalidateDataplaneCache("refresh timer")
+	}
+
+	retries := 10
+	backoffTime := 1 * time.Millisecond
+	failedAtLeastOnce := false
+	for {
+		if !t.inSyncWithDataPlane && !t.fullRewriteRequired {
+			t.loadDataplaneState()
+		}
+		if err := t.applyUpdates(); err != nil {
+			if retries > 0 {
+				retries--
+				t.logCxt.WithError(err).Warn("Failed to program nftables, will retry")
+				t.timeSleep(backoffTime)
+				backoffTime *= 2
+				failedAtLeastOnce = true
+				// We don't know how much of the update succeeded (if any) so fall
+				// back to a full rewrite.
+				t.fullRewriteRequired = true
+				continue
+			}
+			t.logCxt.WithError(err).Panic("Failed to program nftables, giving up after retries")
+		}
+		if failedAtLeastOnce {
+			t.logCxt.Warn("Succeeded after retry.")
+		}
+		break
+	}
+
+	t.gaugeNumChains.Set(float64(len(t.chainNameToChain)))
+
+	if t.refreshInterval > 0 {
+		rescheduleAfter = t.refreshInterval - now.Sub(t.lastReadTime)
+		if rescheduleAfter <= 0 {
+			rescheduleAfter = 1 * time.Millisecond
+		}
+	}
+	return
+}
+
+// loadDataplaneState reads back the rule hashes from the dataplane and compares them with what
+// we expect.  If there are any discrepancies, it schedules a full rewrite of the table.
+func (t *Table) loadDataplaneState() {
+	t.logCxt.Info("Loading current nftables state and checking it is correct.")
+	t.lastReadTime = t.timeNow()
+	t.inSyncWithDataPlane = true
+
+	dataplaneHashes, dataplaneSets, err := t.readHashesFromDataplane()
+	if err != nil {
+		t.logCxt.WithError(err).Warn("Failed to read nftables state, will rewrite table")
+		t.fullRewriteRequired = true
+		return
+	}
+	if !reflect.DeepEqual(dataplaneHashes, t.chainToDataplaneHashes) {
+		t.logCxt.WithFields(log.Fields{
+			"expected": t.chainToDataplaneHashes,
+			"actual":   dataplaneHashes,
+		}).Warn("Detected out-of-sync nftables table, will rewrite table")
+		t.fullRewriteRequired = true
+		return
+	}
+	for setName := range t.setNameToDataplaneSet {
+		if !dataplaneSets.Contains(setName) {
+			t.logCxt.WithField("setName", setName).Warn(
+				"Detected missing nftables set, will rewrite table")
+			t.fullRewriteRequired = true
+			return
+		}
+	}
+}
+
+// readHashesFromDataplane runs "nft list table" and extracts our rule hashes, in the same
+// form as the iptables Table: a map from chain name to a slice containing the hash of each
+// rule, with empty strings for rules that we don't recognise.  It also returns the names of
+// the sets in the table.
+func (t *Table) readHashesFromDataplane() (map[string][]string, set.Set, error) {
+	countNumNftListCalls.Inc()
+	// --terse omits the set elements, which can be very large.
+	cmd := t.newCmd("nft", "--terse", "list", "table", t.nftFamily, t.nftTableName)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, nil, err
+	}
+	return t.readHashesFrom(bytes.NewReader(output))
+}
+
+func (t *Table) readHashesFrom(r io.Reader) (map[string][]string, set.Set, error) {
+	hashes := map[string][]string{}
+	sets := set.New()
+	scanner := bufio.NewScanner(r)
+	currentChain := ""
+	inSet := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if inSet {
+			if trimmed == "}" {
+				inSet = false
+			}
+			continue
+		}
+		if captures := setRegexp.FindStringSubmatch(line); captures != nil {
+			sets.Add(captures[1])
+			inSet = true
+			continue
+		}
+		if captures := chainRegexp.FindStringSubmatch(line); captures != nil {
+			currentChain = captures[1]
+			hashes[currentChain] = []string{}
+			continue
+		}
+		if currentChain == "" {
+			continue
+		}
+		if trimmed == "}" {
+			currentChain = ""
+			continue
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "type ") {
+			// Blank line or the hook definition of a base chain.
+			continue
+		}
+		hash := ""
+		if captures := t.hashCommentRegexp.FindStringSubmatch(line); captures != nil {
+			hash = captures[1]
+		}
+		hashes[currentChain] = append(hashes[currentChain], hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return hashes, sets, nil
+}
+
+// referencedSets calculates the set of nft set names that are referenced by our chains.
+func (t *Table) referencedSets() set.Set {
+	refs := set.New()
+	for chainName, setNames := range t.chainToSetNames {
+		if _, ok := t.chainNameToChain[chainName]; !ok && len(t.chainToInsertedRules[chainName]) == 0 {
+			continue
+		}
+		for _, name := range setNames {
+			refs.Add(name)
+		}
+	}
+	return refs
+}
+
+func (t *Table) applyUpdates() error {
+	var buf bytes.Buffer
+	newHashes := map[string][]string{}
+	newSets := map[string]*dataplaneSet{}
+	deletedSets := set.New()
+	tableSpec := t.nftFamily + " " + t.nftTableName
+
+	refSets := t.referencedSets()
+	if t.fullRewriteRequired {
+		t.logCxt.Info("Doing full rewrite of nftables table")
+		// "add table" is idempotent so this sequence replaces the table whether it
+		// exists or not.
+		fmt.Fprintf(&buf, "add table %s\n", tableSpec)
+		fmt.Fprintf(&buf, "delete table %s\n", tableSpec)
+		fmt.Fprintf(&buf, "add table %s\n", tableSpec)
+		for _, setName := range sortedStrings(refSets) {
+			newSets[setName] = t.writeFullSet(&buf, tableSpec, setName)
+		}
+		// Declare all the chains first so that jumps can be resolved.
+		for _, chainName := range t.sortedBaseChainNames() {
+			t.writeBaseChainDecl(&buf, tableSpec, chainName)
+		}
+		for _, chainName := range t.sortedChainNames() {
+			fmt.Fprintf(&buf, "add chain %s %s\n", tableSpec, chainName)
+		}
+		for _, chainName := range t.sortedBaseChainNames() {
+			newHashes[chainName] = t.writeRules(&buf, tableSpec, chainName, t.chainToInsertedRules[chainName])
+		}
+		for _, chainName := range t.sortedChainNames() {
+			newHashes[chainName] = t.writeRules(&buf, tableSpec, chainName, t.chainNameToChain[chainName].Rules)
+		}
+	} else {
+		// Incremental update.  First, create/update any sets so that they're ready for
+		// the rules that reference them.
+		for _, setName := range sortedStrings(refSets) {
+			desired := t.ipSets.lookup(setName)
+			programmed := t.setNameToDataplaneSet[setName]
+			if programmed == nil {
+				newSets[setName] = t.writeFullSet(&buf, tableSpec, setName)
+				continue
+			}
+			if desired == nil || desired.Generation == programmed.Generation {
+				continue
+			}
+			if renderSetDefinition(desired, t.IPVersion) != programmed.Metadata {
+				// Can't change the type of a set that's in use; fall back to
+				// rewriting the whole table.
+				t.fullRewriteRequired = true
+				return t.applyUpdates()
+			}
+			newSets[setName] = t.writeSetDeltas(&buf, tableSpec, desired, programmed)
+		}
+
+		// Next, create any new chains and flush any that we're about to rewrite or delete.
+		// Flushing the chains that we're deleting severs any references to them.
+		t.dirtyInserts.Iter(func(item interface{}) error {
+			chainName := item.(string)
+			if _, ok := t.chainToDataplaneHashes[chainName]; !ok {
+				if len(t.chainToInsertedRules[chainName]) > 0 {
+					t.writeBaseChainDecl(&buf, tableSpec, chainName)
+				}
+			} else {
+				fmt.Fprintf(&buf, "flush chain %s %s\n", tableSpec, chainName)
+			}
+			return nil
+		})
+		t.dirtyChains.Iter(func(item interface{}) error {
+			chainName := item.(string)
+			if _, ok := t.chainToDataplaneHashes[chainName]; !ok {
+				if _, ok := t.chainNameToChain[chainName]; ok {
+					fmt.Fprintf(&buf, "add chain %s %s\n", tableSpec, chainName)
+				}
+			} else {
+				fmt.Fprintf(&buf, "flush chain %s %s\n", tableSpec, chainName)
+			}
+			return nil
+		})
+
+		// Then write the rules.
+		t.dirtyInserts.Iter(func(item interface{}) error {
+			chainName := item.(string)
+			if rules := t.chainToInsertedRules[chainName]; len(rules) > 0 {
+				newHashes[chainName] = t.writeRules(&buf, tableSpec, chainName, rules)
+			}
+			return nil
+		})
+		t.dirtyChains.Iter(func(item interface{}) error {
+			chainName := item.(string)
+			if chain, ok := t.chainNameToChain[chainName]; ok {
+				newHashes[chainName] = t.writeRules(&buf, tableSpec, chainName, chain.Rules)
+			}
+			return nil
+		})
+
+		// Now that the references have been removed, do the deletions.
+		t.dirtyInserts.Iter(func(item interface{}) error {
+			chainName := item.(string)
+			_, exists := t.chainToDataplaneHashes[chainName]
+			if exists && len(t.chainToInsertedRules[chainName]) == 0 {
+				fmt.Fprintf(&buf, "delete chain %s %s\n", tableSpec, chainName)
+				newHashes[chainName] = nil
+			}
+			return nil
+		})
+		t.dirtyChains.Iter(func(item interface{}) error {
+			chainName := item.(string)
+			_, exists := t.chainToDataplaneHashes[chainName]
+			if _, ok := t.chainNameToChain[chainName]; !ok && exists {
+				fmt.Fprintf(&buf, "delete chain %s %s\n", tableSpec, chainName)
+				newHashes[chainName] = nil
+			}
+			return nil
+		})
+		for setName := range t.setNameToDataplaneSet {
+			if !refSets.Contains(setName) {
+				fmt.Fprintf(&buf, "delete set %s %s\n", tableSpec, setName)
+				deletedSets.Add(setName)
+			}
+		}
+	}
+
+	if buf.Len() > 0 {
+		input := buf.String()
+		t.logCxt.WithField("nftInput", input).Debug("Writing to nftables")
+		var outputBuf, errBuf bytes.Buffer
+		cmd := t.newCmd("nft", "-f", "-")
+		cmd.SetStdin(&buf)
+		cmd.SetStdout(&outputBuf)
+		cmd.SetStderr(&errBuf)
+		countNumNftCalls.Inc()
+		if err := cmd.Run(); err != nil {
+			t.logCxt.WithFields(log.Fields{
+				"output":      outputBuf.String(),
+				"errorOutput": errBuf.String(),
+				"error":       err,
+				"input":       input,
+			}).Warn("Failed to execute nft command")
+			countNumNftErrors.Inc()
+			return err
+		}
+	}
+
+	// Success, record what we wrote.
+	if t.fullRewriteRequired {
+		t.chainToDataplaneHashes = newHashes
+		t.setNameToDataplaneSet = newSets
+		t.fullRewriteRequired = false
+		t.inSyncWithDataPlane = true
+		t.lastReadTime = t.timeNow()
+	} else {
+		for chainName, hashes := range newHashes {
+			if hashes == nil {
+				delete(t.chainToDataplaneHashes, chainName)
+			} else {
+				t.chainToDataplaneHashes[chainName] = hashes
+			}
+		}
+		for setName, s := range newSets {
+			t.setNameToDataplaneSet[setName] = s
+		}
+		deletedSets.Iter(func(item interface{}) error {
+			delete(t.setNameToDataplaneSet, item.(string))
+			return nil
+		})
+	}
+	t.dirtyChains = set.New()
+	t.dirtyInserts = set.New()
+	return nil
+}
+
+// writeFullSet writes the commands to create the given set with its full contents.
+func (t *Table) writeFullSet(buf *bytes.Buffer, tableSpec, setName string) *dataplaneSet {
+	desired := t.ipSets.lookup(setName)
+	if desired == nil {
+		// We should always hear about an IP set before the rules that reference it.
+		t.logCxt.WithField("setName", setName).Panic("Rule references unknown IP set")
+	}
+	metadata := renderSetDefinition(desired, t.IPVersion)
+	fmt.Fprintf(buf, "add set %s %s %s\n", tableSpec, setName, metadata)
+	members := set.New()
+	elements := make([]string, 0, desired.Members.Len())
+	desired.Members.Iter(func(item interface{}) error {
+		members.Add(item)
+		elements = append(elements, item.(string))
+		return nil
+	})
+	writeElements(buf, "add", tableSpec, setName, elements)
+	return &dataplaneSet{
+		Metadata:   metadata,
+		Generation: desired.Generation,
+		Members:    members,
+	}
+}
+
+// writeSetDeltas writes the commands to bring the programmed set into line with the desired
+// set.
+func (t *Table) writeSetDeltas(buf *bytes.Buffer, tableSpec string, desired *ipSet, programmed *dataplaneSet) *dataplaneSet {
+	var adds, dels []string
+	members := set.New()
+	desired.Members.Iter(func(item interface{}) error {
+		members.Add(item)
+		if !programmed.Members.Contains(item) {
+			adds = append(adds, item.(string))
+		}
+		return nil
+	})
+	programmed.Members.Iter(func(item interface{}) error {
+		if !members.Contains(item) {
+			dels = append(dels, item.(string))
+		}
+		return nil
+	})
+	if len(dels) > 0 && desired.Type == ipsets.IPSetTypeHashNet {
+		// The kernel merges overlapping and adjacent CIDRs in an interval set so the
+		// elements that we'd delete may no longer exist, or may cover members that we
+		// want to keep.  Rewrite the whole set instead.
+		fmt.Fprintf(buf, "flush set %s %s\n", tableSpec, desired.Name)
+		adds = adds[:0]
+		members.Iter(func(item interface{}) error {
+			adds = append(adds, item.(string))
+			return nil
+		})
+		dels = nil
+	}
+	writeElements(buf, "delete", tableSpec, desired.Name, dels)
+	writeElements(buf, "add", tableSpec, desired.Name, adds)
+	return &dataplaneSet{
+		Metadata:   programmed.Metadata,
+		Generation: desired.Generation,
+		Members:    members,
+	}
+}
+
+// writeElements writes an add/delete element command for the given elements, chunking them to
+// keep the lines a sensible length.
+func writeElements(buf *bytes.Buffer, op, tableSpec, setName string, elements []string) {
+	const chunkSize = 1000
+	sort.Strings(elements)
+	for len(elements) > 0 {
+		n := len(elements)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		fmt.Fprintf(buf, "%s element %s %s { %s }\n", op, tableSpec, setName, strings.Join(elements[:n], ", "))
+		elements = elements[n:]
+	}
+}
+
+func (t *Table) writeBaseChainDecl(buf *bytes.Buffer, tableSpec, chainName string) {
+	bc := tableToBaseChains[t.Name][chainName]
+	fmt.Fprintf(buf, "add chain %s %s { type %s hook %s priority %d; policy accept; }\n",
+		tableSpec, chainName, bc.Type, bc.Hook, bc.Priority)
+}
+
+// writeRules writes the "add rule" commands for the given chain and returns the rule hashes.
+func (t *Table) writeRules(buf *bytes.Buffer, tableSpec, chainName string, rules []iptables.Rule) []string {
+	chain := iptables.Chain{Name: chainName, Rules: rules}
+	hashes := chain.RuleHashes()
+	for i, r := range rules {
+		// We checked that the rule could be rendered when it was added.
+		rendered, _ := RenderRule(r, t.IPVersion, t.hashCommentPrefix+hashes[i])
+		fmt.Fprintf(buf, "add rule %s %s %s\n", tableSpec, chainName, rendered)
+	}
+	return hashes
+}
+
+func (t *Table) sortedChainNames() []string {
+	names := make([]string, 0, len(t.chainNameToChain))
+	for name := range t.chainNameToChain {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t *Table) sortedBaseChainNames() []string {
+	var names []string
+	for name, rules := range t.chainToInsertedRules {
+		if len(rules) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedStrings(s set.Set) []string {
+	strs := make([]string, 0, s.Len())
+	s.Iter(func(item interface{}) error {
+		strs = append(strs, item.(string))
+		return nil
+	})
+	sort.Strings(strs)
+	return strs
+}
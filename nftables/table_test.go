@@ -0,0 +1,303 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nftables_test
+
+import (
+	. "github.com/projectcalico/felix/nftables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/rules"
+)
+
+var _ = Describe("Table", func() {
+	var dataplane *mockNft
+	var ipSets *IPSets
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = &mockNft{}
+		ipSets = NewIPSets(ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil))
+		table = NewTable(
+			"filter",
+			4,
+			rules.RuleHashPrefix,
+			ipSets,
+			TableOptions{
+				NewCmdOverride: dataplane.newCmd,
+				SleepOverride:  dataplane.sleep,
+				NowOverride:    dataplane.now,
+			},
+		)
+	})
+
+	It("should rewrite the table on first Apply()", func() {
+		table.Apply()
+		Expect(dataplane.Scripts).To(HaveLen(1))
+		Expect(dataplane.Scripts[0]).To(Equal(
+			"add table ip calico-filter\n" +
+				"delete table ip calico-filter\n" +
+				"add table ip calico-filter\n"))
+	})
+
+	It("should not schedule a refresh by default", func() {
+		Expect(table.Apply()).To(BeZero())
+	})
+
+	It("should reject rules that it can't render", func() {
+		Expect(func() {
+			table.UpdateChain(&iptables.Chain{
+				Name:  "cali-foo",
+				Rules: []iptables.Rule{{Match: iptables.Match().IPVSConnection()}},
+			})
+		}).To(Panic())
+	})
+
+	Describe("after programming some chains and sets", func() {
+		BeforeEach(func() {
+			ipSets.AddOrReplaceIPSet(ipsets.IPSetMetadata{
+				SetID: "s:abcd",
+				Type:  ipsets.IPSetTypeHashNet,
+			}, []string{"10.0.0.0/24", "fe80::/64"})
+			table.SetRuleInsertions("FORWARD", []iptables.Rule{
+				{Action: iptables.JumpAction{Target: "cali-foo"}},
+			})
+			table.UpdateChain(&iptables.Chain{
+				Name: "cali-foo",
+				Rules: []iptables.Rule{
+					{
+						Match:  iptables.Match().SourceIPSet("cali40s:abcd"),
+						Action: iptables.AcceptAction{},
+					},
+				},
+			})
+			table.Apply()
+		})
+
+		It("should write the whole table in one transaction", func() {
+			Expect(dataplane.Scripts).To(HaveLen(1))
+			script := dataplane.Scripts[0]
+			Expect(script).To(ContainSubstring(
+				"add set ip calico-filter cali40s_abcd { type ipv4_addr; flags interval; auto-merge; }\n" +
+					"add element ip calico-filter cali40s_abcd { 10.0.0.0/24 }\n"))
+			Expect(script).NotTo(ContainSubstring("fe80"))
+			Expect(script).To(ContainSubstring(
+				"add chain ip calico-filter FORWARD { type filter hook forward priority 0; policy accept; }\n" +
+					"add chain ip calico-filter cali-foo\n"))
+			Expect(script).To(MatchRegexp(
+				`add rule ip calico-filter FORWARD counter jump cali-foo comment "cali:[a-zA-Z0-9_-]+"\n`))
+			Expect(script).To(MatchRegexp(
+				`add rule ip calico-filter cali-foo ip saddr @cali40s_abcd counter accept comment "cali:[a-zA-Z0-9_-]+"\n`))
+		})
+
+		It("should do nothing on a second Apply()", func() {
+			table.Apply()
+			Expect(dataplane.Scripts).To(HaveLen(1))
+		})
+
+		It("should only write set deltas for additions", func() {
+			ipSets.AddMembers("s:abcd", []string{"10.0.1.0/24"})
+			table.Apply()
+			Expect(dataplane.Scripts).To(HaveLen(2))
+			Expect(dataplane.Scripts[1]).To(Equal(
+				"add element ip calico-filter cali40s_abcd { 10.0.1.0/24 }\n"))
+		})
+
+		It("should rewrite an interval set when members are removed", func() {
+			ipSets.AddMembers("s:abcd", []string{"10.0.1.0/24", "10.0.2.0/24"})
+			table.Apply()
+			ipSets.RemoveMembers("s:abcd", []string{"10.0.0.0/24"})
+			table.Apply()
+			Expect(dataplane.Scripts).To(HaveLen(3))
+			Expect(dataplane.Scripts[2]).To(Equal(
+				"flush set ip calico-filter cali40s_abcd\n" +
+					"add element ip calico-filter cali40s_abcd { 10.0.1.0/24, 10.0.2.0/24 }\n"))
+		})
+
+		It("should flush and rewrite an updated chain", func() {
+			table.UpdateChain(&iptables.Chain{
+				Name:  "cali-foo",
+				Rules: []iptables.Rule{{Action: iptables.DropAction{}}},
+			})
+			table.Apply()
+			Expect(dataplane.Scripts).To(HaveLen(2))
+			Expect(dataplane.Scripts[1]).To(MatchRegexp(
+				`^flush chain ip calico-filter cali-foo\n` +
+					`add rule ip calico-filter cali-foo counter drop comment "cali:[a-zA-Z0-9_-]+"\n` +
+					`delete set ip calico-filter cali40s_abcd\n$`))
+		})
+
+		It("should delete a chain and its base chain", func() {
+			table.SetRuleInsertions("FORWARD", nil)
+			table.RemoveChainByName("cali-foo")
+			table.Apply()
+			Expect(dataplane.Scripts).To(HaveLen(2))
+			script := dataplane.Scripts[1]
+			Expect(script).To(ContainSubstring("flush chain ip calico-filter FORWARD\n"))
+			Expect(script).To(ContainSubstring("flush chain ip calico-filter cali-foo\n"))
+			Expect(script).To(ContainSubstring("delete chain ip calico-filter FORWARD\n"))
+			Expect(script).To(ContainSubstring("delete chain ip calico-filter cali-foo\n"))
+			Expect(script).To(HaveSuffix("delete set ip calico-filter cali40s_abcd\n"))
+		})
+
+		It("should do a full rewrite after a failure", func() {
+			dataplane.FailNextRun = true
+			table.UpdateChain(&iptables.Chain{
+				Name:  "cali-foo",
+				Rules: []iptables.Rule{{Action: iptables.DropAction{}}},
+			})
+			table.Apply()
+			Expect(dataplane.Scripts).To(HaveLen(3))
+			Expect(dataplane.Scripts[2]).To(HavePrefix("add table ip calico-filter\n"))
+		})
+
+		Describe("after invalidating the cache", func() {
+			BeforeEach(func() {
+				table.InvalidateDataplaneCache("test")
+			})
+
+			It("should do nothing if the dataplane is correct", func() {
+				dataplane.ListOutput = dataplane.listingFor(dataplane.Scripts[0])
+				table.Apply()
+				Expect(dataplane.ListCalls).To(Equal(1))
+				Expect(dataplane.Scripts).To(HaveLen(1))
+			})
+
+			It("should rewrite the table if it's missing", func() {
+				dataplane.FailList = true
+				table.Apply()
+				Expect(dataplane.ListCalls).To(Equal(1))
+				Expect(dataplane.Scripts).To(HaveLen(2))
+				Expect(dataplane.Scripts[1]).To(Equal(dataplane.Scripts[0]))
+			})
+
+			It("should rewrite the table if a rule has been modified", func() {
+				dataplane.ListOutput = strings.Replace(
+					dataplane.listingFor(dataplane.Scripts[0]), "comment \"cali:", "comment \"foo:", 1)
+				table.Apply()
+				Expect(dataplane.Scripts).To(HaveLen(2))
+			})
+		})
+	})
+})
+
+// mockNft is a fake nft binary.  It records the scripts passed to "nft -f -" and returns
+// canned output for "nft list".
+type mockNft struct {
+	Scripts     []string
+	FailNextRun bool
+
+	ListCalls  int
+	ListOutput string
+	FailList   bool
+
+	Time time.Time
+}
+
+func (d *mockNft) newCmd(name string, arg ...string) CmdIface {
+	Expect(name).To(Equal("nft"))
+	return &mockNftCmd{dataplane: d, args: arg}
+}
+
+func (d *mockNft) sleep(t time.Duration) {
+	d.Time = d.Time.Add(t)
+}
+
+func (d *mockNft) now() time.Time {
+	return d.Time
+}
+
+// listingFor converts an "nft -f" script containing a full rewrite of a table into the output
+// of "nft --terse list table".  It only needs to handle the commands that the Table generates.
+func (d *mockNft) listingFor(script string) string {
+	var sets []string
+	chains := map[string][]string{}
+	var chainOrder []string
+	for _, line := range strings.Split(script, "\n") {
+		parts := strings.SplitN(line, " ", 6)
+		if len(parts) < 5 {
+			continue
+		}
+		switch parts[0] + " " + parts[1] {
+		case "add set":
+			sets = append(sets, parts[4])
+		case "add chain":
+			chainOrder = append(chainOrder, parts[4])
+			chains[parts[4]] = nil
+		case "add rule":
+			chains[parts[4]] = append(chains[parts[4]], parts[5])
+		}
+	}
+	out := "table ip calico-filter {\n"
+	for _, s := range sets {
+		out += "\tset " + s + " {\n\t\ttype ipv4_addr\n\t}\n"
+	}
+	for _, c := range chainOrder {
+		out += "\tchain " + c + " {\n"
+		for _, r := range chains[c] {
+			out += "\t\t" + r + "\n"
+		}
+		out += "\t}\n"
+	}
+	return out + "}\n"
+}
+
+type mockNftCmd struct {
+	dataplane *mockNft
+	args      []string
+	stdin     io.Reader
+}
+
+func (c *mockNftCmd) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+func (c *mockNftCmd) SetStdout(w io.Writer) {}
+
+func (c *mockNftCmd) SetStderr(w io.Writer) {}
+
+func (c *mockNftCmd) Run() error {
+	Expect(c.args).To(Equal([]string{"-f", "-"}))
+	script, err := ioutil.ReadAll(c.stdin)
+	Expect(err).NotTo(HaveOccurred())
+	c.dataplane.Scripts = append(c.dataplane.Scripts, string(script))
+	if c.dataplane.FailNextRun {
+		c.dataplane.FailNextRun = false
+		return errors.New("dummy error")
+	}
+	return nil
+}
+
+func (c *mockNftCmd) Output() ([]byte, error) {
+	Expect(c.args).To(Equal([]string{"--terse", "list", "table", "ip", "calico-filter"}))
+	c.dataplane.ListCalls++
+	if c.dataplane.FailList {
+		return nil, errors.New("no such table")
+	}
+	return []byte(c.dataplane.ListOutput), nil
+}
+
+func (c *mockNftCmd) String() string {
+	return "nft " + strings.Join(c.args, " ")
+}
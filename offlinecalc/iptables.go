@@ -0,0 +1,54 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package offlinecalc
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/projectcalico/felix/dataplane/linux"
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/rules"
+)
+
+// RenderIptables renders the iptables chains that Felix would program for the given calculation
+// graph output, as iptables-restore input.  The chains are rendered by the dataplane's own
+// managers; see intdataplane.RenderChainsOffline.  Tables and chains are sorted by name and rules
+// aren't prefixed with Felix's hash comments, so that the output diffs cleanly.
+func RenderIptables(config rules.Config, msgs []interface{}, ipVersion uint8) string {
+	tables := intdataplane.RenderChainsOffline(config, msgs, ipVersion)
+	var buf bytes.Buffer
+	for _, table := range []string{"filter", "mangle", "nat", "raw"} {
+		writeTable(&buf, table, tables[table])
+	}
+	return buf.String()
+}
+
+func writeTable(buf *bytes.Buffer, tableName string, chains []*iptables.Chain) {
+	sort.SliceStable(chains, func(i, j int) bool {
+		return chains[i].Name < chains[j].Name
+	})
+	fmt.Fprintf(buf, "*%s\n", tableName)
+	for _, chain := range chains {
+		fmt.Fprintf(buf, ":%s - [0:0]\n", chain.Name)
+	}
+	for _, chain := range chains {
+		for _, rule := range chain.Rules {
+			fmt.Fprintln(buf, rule.RenderAppend(chain.Name, ""))
+		}
+	}
+	buf.WriteString("COMMIT\n")
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package offlinecalc_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/projectcalico/felix/filestore"
+	"github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/felix/offlinecalc"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/rules"
+	apiv3 "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+const policyYAML = `
+apiVersion: projectcalico.org/v3
+kind: GlobalNetworkPolicy
+metadata:
+  name: allow-frontend
+spec:
+  selector: app == 'frontend'
+  ingress:
+  - action: Allow
+    source:
+      nets: [10.1.0.0/16]
+---
+apiVersion: projectcalico.org/v3
+kind: Profile
+metadata:
+  name: prof1
+spec:
+  ingress:
+  - action: Deny
+`
+
+const endpointsYAML = `
+apiVersion: projectcalico.org/v3
+kind: WorkloadEndpoint
+metadata:
+  name: node1-openstack-vm1-tap1
+  labels:
+    app: frontend
+spec:
+  node: node1
+  orchestrator: openstack
+  workload: vm1
+  endpoint: tap1
+  interfaceName: tap1234
+  ipNetworks: [10.0.0.1/32]
+  profiles: [prof1]
+---
+apiVersion: projectcalico.org/v3
+kind: WorkloadEndpoint
+metadata:
+  name: node2-openstack-vm2-tap2
+  labels:
+    app: frontend
+spec:
+  node: node2
+  orchestrator: openstack
+  workload: vm2
+  endpoint: tap2
+  interfaceName: tap5678
+  ipNetworks: [10.0.0.2/32]
+  profiles: [prof1]
+---
+apiVersion: projectcalico.org/v3
+kind: HostEndpoint
+metadata:
+  name: node1-eth0
+spec:
+  node: node1
+  interfaceName: eth0
+  profiles: [prof1]
+---
+apiVersion: projectcalico.org/v3
+kind: IPPool
+metadata:
+  name: pool1
+spec:
+  cidr: 10.0.0.0/16
+  natOutgoing: true
+---
+apiVersion: projectcalico.org/v3
+kind: FelixConfiguration
+metadata:
+  name: default
+spec:
+  interfacePrefix: tap
+`
+
+var _ = Describe("Offline calculation graph", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "offlinecalc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "policy.yaml"), []byte(policyYAML), 0644)).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(dir, "endpoints"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "endpoints", "eps.yml"), []byte(endpointsYAML), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("Not a resource"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should load all the resources in the directory", func() {
+		kvs, err := filestore.LoadResourceDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		var keys []model.Key
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		Expect(keys).To(Equal([]model.Key{
+			model.ResourceKey{Kind: apiv3.KindWorkloadEndpoint, Name: "node1-openstack-vm1-tap1", Namespace: "default"},
+			model.ResourceKey{Kind: apiv3.KindWorkloadEndpoint, Name: "node2-openstack-vm2-tap2", Namespace: "default"},
+			model.ResourceKey{Kind: apiv3.KindHostEndpoint, Name: "node1-eth0"},
+			model.ResourceKey{Kind: apiv3.KindIPPool, Name: "pool1"},
+			model.ResourceKey{Kind: apiv3.KindFelixConfiguration, Name: "default"},
+			model.ResourceKey{Kind: apiv3.KindGlobalNetworkPolicy, Name: "allow-frontend"},
+			model.ResourceKey{Kind: apiv3.KindProfile, Name: "prof1"},
+		}))
+		Expect(kvs[5].Value).To(BeAssignableToTypeOf(&apiv3.GlobalNetworkPolicy{}))
+	})
+
+	It("should reject unknown kinds", func() {
+		_, err := filestore.LoadResources(strings.NewReader(
+			"apiVersion: projectcalico.org/v3\nkind: Widget\nmetadata:\n  name: w1\n"))
+		Expect(err).To(MatchError(ContainSubstring(`unsupported kind "Widget"`)))
+	})
+
+	It("should reject invalid resources", func() {
+		_, err := filestore.LoadResources(strings.NewReader(
+			"apiVersion: projectcalico.org/v3\nkind: GlobalNetworkPolicy\nmetadata:\n  name: p1\nspec:\n  selector: 'foo =='\n"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	Describe("after running the calculation graph for node1", func() {
+		var result *offlinecalc.Result
+
+		BeforeEach(func() {
+			kvs, err := filestore.LoadResourceDir(dir)
+			Expect(err).NotTo(HaveOccurred())
+			updates, err := filestore.ConvertResources(kvs)
+			Expect(err).NotTo(HaveOccurred())
+			result = offlinecalc.Run(updates, "node1")
+		})
+
+		It("should only send node1's endpoint", func() {
+			var ifaceNames []string
+			for _, msg := range result.Messages {
+				if upd, ok := msg.(*proto.WorkloadEndpointUpdate); ok {
+					ifaceNames = append(ifaceNames, upd.Endpoint.Name)
+					Expect(upd.Endpoint.ProfileIds).To(Equal([]string{"prof1"}))
+					Expect(upd.Endpoint.Tiers[0].IngressPolicies).To(Equal([]string{"allow-frontend"}))
+				}
+			}
+			Expect(ifaceNames).To(Equal([]string{"tap1234"}))
+		})
+
+		It("should send the active policy and profile", func() {
+			Expect(result.Messages).To(ContainElement(BeAssignableToTypeOf(&proto.ActivePolicyUpdate{})))
+			Expect(result.Messages).To(ContainElement(BeAssignableToTypeOf(&proto.ActiveProfileUpdate{})))
+		})
+
+		It("should apply the Felix configuration", func() {
+			Expect(result.Config.InterfacePrefix).To(Equal("tap"))
+			Expect(result.Messages[len(result.Messages)-1]).To(Equal(&proto.InSync{}))
+		})
+
+		It("should render the iptables chains", func() {
+			config := rules.Config{
+				WorkloadIfacePrefixes: result.Config.InterfacePrefixes(),
+				IPSetConfigV4:         ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+				IPSetConfigV6:         ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+				IptablesMarkAccept:    0x10,
+				IptablesMarkPass:      0x20,
+				IptablesMarkScratch0:  0x40,
+				IptablesMarkScratch1:  0x80,
+				IptablesMarkEndpoint:  0xff00,
+
+				IptablesMarkNonCaliEndpoint: 0x100,
+			}
+			text := offlinecalc.RenderIptables(config, result.Messages, 4)
+			polID := proto.PolicyID{Tier: "default", Name: "allow-frontend"}
+			Expect(text).To(HavePrefix("*filter\n"))
+			Expect(text).To(ContainSubstring(":" + rules.PolicyChainName(rules.PolicyInboundPfx, &polID) + " - [0:0]\n"))
+			Expect(text).To(ContainSubstring(":" + rules.WorkloadToEndpointPfx + "tap1234 - [0:0]\n"))
+			Expect(text).NotTo(ContainSubstring("tap5678"))
+			// The host endpoint is resolved by its interface name.
+			Expect(text).To(ContainSubstring(":" + rules.HostToEndpointPfx + "eth0 - [0:0]\n"))
+			Expect(text).To(ContainSubstring("-A " + rules.ChainNATOutgoing + " "))
+			Expect(strings.Count(text, "COMMIT\n")).To(Equal(4))
+
+			// The output should be stable so that it can be diffed.
+			Expect(offlinecalc.RenderIptables(config, result.Messages, 4)).To(Equal(text))
+		})
+	})
+})
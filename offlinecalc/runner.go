@@ -0,0 +1,63 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package offlinecalc runs Felix's calculation graph over a set of Calico v3 resources loaded
+// from local files, without a datastore, so that the effect of a change to the resources can be
+// seen (and diffed) before it is rolled out.
+package offlinecalc
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/calc"
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+)
+
+// Result is the output of a calculation graph run.
+type Result struct {
+	// Messages are the messages that the calculation graph sent to the dataplane, in order,
+	// ending with InSync.
+	Messages []interface{}
+	// Config is Felix's configuration after applying the FelixConfiguration resources.
+	Config *config.Config
+}
+
+// Run passes the updates through the validation filter and calculation graph for the given
+// host, then flushes the graph and returns its output.  Unlike Felix, it runs the graph
+// synchronously and flushes it once, so the output is a single snapshot of the dataplane state.
+func Run(updates []api.Update, hostname string) *Result {
+	conf := config.New()
+	conf.FelixHostname = hostname
+
+	result := &Result{Config: conf}
+	eventSequencer := calc.NewEventSequencer(conf)
+	eventSequencer.Callback = func(msg interface{}) {
+		if _, ok := msg.(*calc.DatastoreNotReady); ok {
+			log.Warn("Datastore is not ready; Felix would wait for the ready flag")
+			return
+		}
+		result.Messages = append(result.Messages, msg)
+	}
+	calcGraph := calc.NewCalculationGraph(eventSequencer, hostname)
+	validator := calc.NewValidationFilter(calcGraph.AllUpdDispatcher)
+
+	validator.OnStatusUpdated(api.ResyncInProgress)
+	validator.OnUpdates(updates)
+	validator.OnStatusUpdated(api.InSync)
+	eventSequencer.Flush()
+	result.Messages = append(result.Messages, &proto.InSync{})
+	return result
+}
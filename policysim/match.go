@@ -0,0 +1,306 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysim
+
+import (
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+const (
+	ProtocolICMP    = 1
+	ProtocolTCP     = 6
+	ProtocolUDP     = 17
+	ProtocolICMPv6  = 58
+	ProtocolSCTP    = 132
+	ProtocolUDPLite = 136
+)
+
+var protocolNameToNumber = map[string]int{
+	"icmp":    ProtocolICMP,
+	"tcp":     ProtocolTCP,
+	"udp":     ProtocolUDP,
+	"icmpv6":  ProtocolICMPv6,
+	"sctp":    ProtocolSCTP,
+	"udplite": ProtocolUDPLite,
+}
+
+// ProtocolNumber converts a protocol name, as used in rules, to its number.  Returns false if
+// the name is not known.
+func ProtocolNumber(name string) (int, bool) {
+	num, ok := protocolNameToNumber[strings.ToLower(name)]
+	return num, ok
+}
+
+// protocolName returns the name used for the protocol in named port IP set members, or "" for
+// protocols that don't have ports.
+func protocolName(num int) string {
+	switch num {
+	case ProtocolTCP:
+		return "tcp"
+	case ProtocolUDP:
+		return "udp"
+	case ProtocolSCTP:
+		return "sctp"
+	case ProtocolUDPLite:
+		return "udplite"
+	}
+	return ""
+}
+
+// ruleMatches returns true if the rule matches the packet.  It mirrors the match criteria that
+// DefaultRuleRenderer.ProtoRuleToIptablesRules() renders: positive CIDRs and ports are or-ed
+// within a field, all fields are and-ed and negated fields exclude the packet if any entry
+// matches.
+func (s *Snapshot) ruleMatches(rule *proto.Rule, pkt *Packet) bool {
+	ipVersion := pkt.ipVersion()
+	switch rule.IpVersion {
+	case proto.IPVersion_IPV4:
+		if ipVersion != 4 {
+			return false
+		}
+	case proto.IPVersion_IPV6:
+		if ipVersion != 6 {
+			return false
+		}
+	}
+
+	// Like the renderer, we skip the whole rule if filtering its CIDRs to the packet's IP
+	// version would remove all of the entries from one of its CIDR fields.
+	srcNets, filteredAll := filterNets(rule.SrcNet, ipVersion)
+	if filteredAll {
+		return false
+	}
+	notSrcNets, filteredAll := filterNets(rule.NotSrcNet, ipVersion)
+	if filteredAll {
+		return false
+	}
+	dstNets, filteredAll := filterNets(rule.DstNet, ipVersion)
+	if filteredAll {
+		return false
+	}
+	notDstNets, filteredAll := filterNets(rule.NotDstNet, ipVersion)
+	if filteredAll {
+		return false
+	}
+
+	// Positive matches.
+	if rule.Protocol != nil && !protocolMatches(rule.Protocol, pkt.Protocol) {
+		return false
+	}
+	if len(srcNets) > 0 && !anyNetContains(srcNets, pkt.SrcIP) {
+		return false
+	}
+	if len(dstNets) > 0 && !anyNetContains(dstNets, pkt.DstIP) {
+		return false
+	}
+	for _, id := range rule.SrcIpSetIds {
+		if !s.ipSetContainsIP(id, pkt.SrcIP) {
+			return false
+		}
+	}
+	for _, id := range rule.DstIpSetIds {
+		if !s.ipSetContainsIP(id, pkt.DstIP) {
+			return false
+		}
+	}
+	if len(rule.SrcPorts) > 0 || len(rule.SrcNamedPortIpSetIds) > 0 {
+		if !s.portsMatch(rule.SrcPorts, rule.SrcNamedPortIpSetIds, pkt.SrcIP, pkt.Protocol, pkt.SrcPort) {
+			return false
+		}
+	}
+	if len(rule.DstPorts) > 0 || len(rule.DstNamedPortIpSetIds) > 0 {
+		if !s.portsMatch(rule.DstPorts, rule.DstNamedPortIpSetIds, pkt.DstIP, pkt.Protocol, pkt.DstPort) {
+			return false
+		}
+	}
+	if rule.Icmp != nil && !icmpMatches(rule.Icmp, pkt) {
+		return false
+	}
+
+	// Negated matches.
+	if rule.NotProtocol != nil && protocolMatches(rule.NotProtocol, pkt.Protocol) {
+		return false
+	}
+	if anyNetContains(notSrcNets, pkt.SrcIP) || anyNetContains(notDstNets, pkt.DstIP) {
+		return false
+	}
+	for _, id := range rule.NotSrcIpSetIds {
+		if s.ipSetContainsIP(id, pkt.SrcIP) {
+			return false
+		}
+	}
+	for _, id := range rule.NotDstIpSetIds {
+		if s.ipSetContainsIP(id, pkt.DstIP) {
+			return false
+		}
+	}
+	// Negated port matches can only match protocols that have ports; iptables rejects the rule
+	// otherwise so the validator makes sure that the rule also has a protocol match.
+	if protocolName(pkt.Protocol) != "" {
+		if portInRanges(rule.NotSrcPorts, pkt.SrcPort) || portInRanges(rule.NotDstPorts, pkt.DstPort) {
+			return false
+		}
+	}
+	for _, id := range rule.NotSrcNamedPortIpSetIds {
+		if s.ipSetContainsIPPort(id, pkt.SrcIP, pkt.Protocol, pkt.SrcPort) {
+			return false
+		}
+	}
+	for _, id := range rule.NotDstNamedPortIpSetIds {
+		if s.ipSetContainsIPPort(id, pkt.DstIP, pkt.Protocol, pkt.DstPort) {
+			return false
+		}
+	}
+	if rule.NotIcmp != nil && notICMPMatches(rule.NotIcmp, pkt) {
+		return false
+	}
+	return true
+}
+
+// filterNets is the equivalent of the renderer's function of the same name; it returns the
+// CIDRs of the given IP version and sets filteredAll if that removed every CIDR.
+func filterNets(mixedCIDRs []string, ipVersion uint8) (filtered []*net.IPNet, filteredAll bool) {
+	if len(mixedCIDRs) == 0 {
+		return nil, false
+	}
+	wantV6 := ipVersion == 6
+	for _, cidr := range mixedCIDRs {
+		isV6 := strings.Contains(cidr, ":")
+		if isV6 != wantV6 {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(withPrefixLen(cidr))
+		if err != nil {
+			log.WithError(err).WithField("cidr", cidr).Warn("Ignoring bad CIDR in rule")
+			continue
+		}
+		filtered = append(filtered, ipNet)
+	}
+	filteredAll = len(filtered) == 0
+	return
+}
+
+func anyNetContains(nets []*net.IPNet, addr net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func protocolMatches(protocol *proto.Protocol, pktProto int) bool {
+	switch p := protocol.NumberOrName.(type) {
+	case *proto.Protocol_Name:
+		num, ok := ProtocolNumber(p.Name)
+		if !ok {
+			log.WithField("protocol", p.Name).Warn("Unknown protocol name in rule")
+			return false
+		}
+		return num == pktProto
+	case *proto.Protocol_Number:
+		return int(p.Number) == pktProto
+	}
+	return false
+}
+
+// portsMatch returns true if the port is in one of the port ranges or the (IP, protocol, port)
+// is in one of the named port IP sets.  Packets with protocols that don't have ports never match.
+func (s *Snapshot) portsMatch(
+	ranges []*proto.PortRange,
+	namedPortIPSetIDs []string,
+	addr net.IP,
+	pktProto int,
+	port uint16,
+) bool {
+	if protocolName(pktProto) == "" {
+		return false
+	}
+	if portInRanges(ranges, port) {
+		return true
+	}
+	for _, id := range namedPortIPSetIDs {
+		if s.ipSetContainsIPPort(id, addr, pktProto, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func portInRanges(ranges []*proto.PortRange, port uint16) bool {
+	for _, r := range ranges {
+		if int32(port) >= r.First && int32(port) <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+func icmpMatches(icmp interface{}, pkt *Packet) bool {
+	if !pkt.isICMP() {
+		return false
+	}
+	switch icmp := icmp.(type) {
+	case *proto.Rule_IcmpTypeCode:
+		return int32(pkt.ICMPType) == icmp.IcmpTypeCode.Type &&
+			int32(pkt.ICMPCode) == icmp.IcmpTypeCode.Code
+	case *proto.Rule_IcmpType:
+		return int32(pkt.ICMPType) == icmp.IcmpType
+	}
+	return false
+}
+
+func notICMPMatches(icmp interface{}, pkt *Packet) bool {
+	if !pkt.isICMP() {
+		return false
+	}
+	switch icmp := icmp.(type) {
+	case *proto.Rule_NotIcmpTypeCode:
+		return int32(pkt.ICMPType) == icmp.NotIcmpTypeCode.Type &&
+			int32(pkt.ICMPCode) == icmp.NotIcmpTypeCode.Code
+	case *proto.Rule_NotIcmpType:
+		return int32(pkt.ICMPType) == icmp.NotIcmpType
+	}
+	return false
+}
+
+func (s *Snapshot) ipSetContainsIP(id string, addr net.IP) bool {
+	ipSet := s.ipSets[id]
+	if ipSet == nil {
+		// The calculation graph always sends the IP sets before the policies that use them
+		// so this indicates an incomplete snapshot.  An empty IP set is the best guess.
+		log.WithField("setID", id).Warn("Rule references unknown IP set, treating it as empty")
+		return false
+	}
+	return ipSet.containsIP(addr)
+}
+
+func (s *Snapshot) ipSetContainsIPPort(id string, addr net.IP, pktProto int, port uint16) bool {
+	protoName := protocolName(pktProto)
+	if protoName == "" {
+		return false
+	}
+	ipSet := s.ipSets[id]
+	if ipSet == nil {
+		log.WithField("setID", id).Warn("Rule references unknown IP set, treating it as empty")
+		return false
+	}
+	return ipSet.containsIPPort(addr, protoName, port)
+}
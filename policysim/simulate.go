@@ -0,0 +1,305 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policysim answers the question "would this packet be allowed?" offline, given a
+// snapshot of the calculation graph's output.  It evaluates the active policies and profiles in
+// the same order as the chains rendered by rules.DefaultRuleRenderer.
+package policysim
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// Packet describes the packet to simulate.
+type Packet struct {
+	SrcIP    net.IP
+	DstIP    net.IP
+	Protocol int
+	SrcPort  uint16
+	DstPort  uint16
+	ICMPType uint8
+	ICMPCode uint8
+	// FromHost is set if a process on this host sent the packet, in which case it goes
+	// through the OUTPUT chain rather than FORWARD.
+	FromHost bool
+}
+
+func (p *Packet) ipVersion() uint8 {
+	if p.SrcIP.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+func (p *Packet) isICMP() bool {
+	if p.ipVersion() == 4 {
+		return p.Protocol == ProtocolICMP
+	}
+	return p.Protocol == ProtocolICMPv6
+}
+
+type Verdict string
+
+const (
+	VerdictAllow Verdict = "allow"
+	VerdictDeny  Verdict = "deny"
+)
+
+type Direction string
+
+const (
+	// DirectionEgress is the policy applied to traffic leaving the source workload.
+	DirectionEgress Direction = "egress"
+	// DirectionIngress is the policy applied to traffic arriving at the destination workload.
+	DirectionIngress Direction = "ingress"
+)
+
+// Step records one decision taken while walking an endpoint's policy.  Steps that come from a
+// rule have Policy or Profile set, along with the index of the rule that matched.
+type Step struct {
+	Endpoint  string
+	Direction Direction
+	Tier      string
+	Policy    string
+	Profile   string
+	RuleIndex int
+	Action    string
+	Reason    string
+}
+
+func (s Step) String() string {
+	var desc string
+	switch {
+	case s.Policy != "":
+		desc = fmt.Sprintf("tier %q policy %q rule %d: %s", s.Tier, s.Policy, s.RuleIndex, s.Action)
+	case s.Profile != "":
+		desc = fmt.Sprintf("profile %q rule %d: %s", s.Profile, s.RuleIndex, s.Action)
+	default:
+		desc = s.Action
+	}
+	if s.Reason != "" {
+		desc = desc + " (" + s.Reason + ")"
+	}
+	return fmt.Sprintf("%s %s: %s", s.Endpoint, s.Direction, desc)
+}
+
+// Result is the outcome of a simulation.  Steps lists the decisions that led to the verdict, in
+// order.
+type Result struct {
+	Verdict Verdict
+	Steps   []Step
+}
+
+// Simulate calculates the verdict for the given packet.  Egress policy is applied if the source
+// IP belongs to a local workload endpoint and ingress policy is applied if the destination IP
+// does; the packet is allowed only if both allow it.  As in the OUTPUT chain, ingress policy
+// isn't applied to packets from the host itself.
+func (s *Snapshot) Simulate(pkt *Packet) (*Result, error) {
+	if pkt.SrcIP == nil || pkt.DstIP == nil {
+		return nil, fmt.Errorf("source and destination IPs are required")
+	}
+	if (pkt.SrcIP.To4() == nil) != (pkt.DstIP.To4() == nil) {
+		return nil, fmt.Errorf("source and destination IPs must be of the same IP version")
+	}
+
+	result := &Result{Verdict: VerdictAllow}
+	srcID, srcEP := s.lookupEndpoint(pkt.SrcIP)
+	dstID, dstEP := s.lookupEndpoint(pkt.DstIP)
+	if srcEP == nil && dstEP == nil {
+		result.Steps = append(result.Steps, Step{
+			Action: string(VerdictAllow),
+			Reason: "neither IP belongs to a local workload endpoint, packet is not policed",
+		})
+		return result, nil
+	}
+
+	if srcEP != nil {
+		if !s.evaluateEndpoint(srcID, srcEP, DirectionEgress, pkt, result) {
+			result.Verdict = VerdictDeny
+			return result, nil
+		}
+	}
+	if dstEP != nil && pkt.FromHost {
+		result.Steps = append(result.Steps, Step{
+			Endpoint:  dstID.WorkloadId + "/" + dstID.EndpointId,
+			Direction: DirectionIngress,
+			Action:    string(VerdictAllow),
+			Reason:    "traffic from the host to a local workload is not policed",
+		})
+	} else if dstEP != nil {
+		if !s.evaluateEndpoint(dstID, dstEP, DirectionIngress, pkt, result) {
+			result.Verdict = VerdictDeny
+			return result, nil
+		}
+	}
+	return result, nil
+}
+
+// evaluateEndpoint walks the policy for one direction of an endpoint, in the same order as the
+// endpoint chains rendered by DefaultRuleRenderer.  It appends the steps that it takes to the
+// result and returns true if the packet is allowed.
+func (s *Snapshot) evaluateEndpoint(
+	id *proto.WorkloadEndpointID,
+	ep *proto.WorkloadEndpoint,
+	dir Direction,
+	pkt *Packet,
+	result *Result,
+) bool {
+	epName := id.WorkloadId + "/" + id.EndpointId
+	logCxt := log.WithFields(log.Fields{
+		"endpoint":  epName,
+		"direction": dir,
+	})
+	addStep := func(step Step) {
+		step.Endpoint = epName
+		step.Direction = dir
+		logCxt.WithField("step", step).Debug("Simulation step")
+		result.Steps = append(result.Steps, step)
+	}
+
+	if ep.State != "active" {
+		addStep(Step{Action: string(VerdictDeny), Reason: "endpoint is admin down"})
+		return false
+	}
+
+	// Like the endpoint manager, we only render the first tier.
+	if len(ep.Tiers) > 0 {
+		tier := ep.Tiers[0]
+		policyNames := tier.IngressPolicies
+		if dir == DirectionEgress {
+			policyNames = tier.EgressPolicies
+		}
+		if len(policyNames) > 0 {
+			passed := false
+			for _, polName := range policyNames {
+				polID := proto.PolicyID{Tier: tier.Name, Name: polName}
+				policy := s.policies[polID]
+				if policy == nil {
+					log.WithField("policy", polID).Warn("Endpoint references unknown policy, skipping")
+					continue
+				}
+				action := s.evaluateRules(rulesForDirection(policy.InboundRules, policy.OutboundRules, dir), pkt, func(idx int, action string) {
+					addStep(Step{Tier: tier.Name, Policy: polName, RuleIndex: idx, Action: action})
+				})
+				switch action {
+				case "allow":
+					return true
+				case "deny":
+					return false
+				case "pass":
+					passed = true
+				default:
+					logCxt.WithField("policy", polName).Debug("No rule matched in policy")
+				}
+				if passed {
+					break
+				}
+			}
+			if !passed {
+				addStep(Step{
+					Tier:   tier.Name,
+					Action: string(VerdictDeny),
+					Reason: "no policies in tier passed packet",
+				})
+				return false
+			}
+		}
+	}
+
+	for _, profName := range ep.ProfileIds {
+		profile := s.profiles[proto.ProfileID{Name: profName}]
+		if profile == nil {
+			log.WithField("profile", profName).Warn("Endpoint references unknown profile, skipping")
+			continue
+		}
+		action := s.evaluateRules(rulesForDirection(profile.InboundRules, profile.OutboundRules, dir), pkt, func(idx int, action string) {
+			addStep(Step{Profile: profName, RuleIndex: idx, Action: action})
+		})
+		switch action {
+		case "allow":
+			return true
+		case "deny":
+			return false
+		}
+		// A pass action in a profile returns to the endpoint chain without setting the
+		// accept bit so we continue with the next profile.
+	}
+
+	addStep(Step{Action: string(VerdictDeny), Reason: "no profiles matched"})
+	return false
+}
+
+// rulesForDirection returns the rules that apply to the given direction.  Inbound rules are
+// the ingress rules of the endpoint.
+func rulesForDirection(inbound, outbound []*proto.Rule, dir Direction) []*proto.Rule {
+	if dir == DirectionEgress {
+		return outbound
+	}
+	return inbound
+}
+
+// evaluateRules evaluates the rules in order and returns the normalised action of the first
+// terminating rule: "allow", "deny" or "pass".  Log rules are reported but don't terminate the
+// chain.  Returns "" if no terminating rule matched.
+func (s *Snapshot) evaluateRules(rules []*proto.Rule, pkt *Packet, onMatch func(idx int, action string)) string {
+	for i, rule := range rules {
+		if s.skipForHTTPMatch(rule) {
+			continue
+		}
+		if !s.ruleMatches(rule, pkt) {
+			continue
+		}
+		var action string
+		switch rule.Action {
+		case "", "allow":
+			action = "allow"
+		case "next-tier", "pass":
+			action = "pass"
+		case "deny":
+			action = "deny"
+		case "log":
+			onMatch(i, "log")
+			continue
+		default:
+			log.WithField("action", rule.Action).Warn("Unknown rule action, skipping rule")
+			continue
+		}
+		onMatch(i, action)
+		return action
+	}
+	return ""
+}
+
+// skipForHTTPMatch returns true if the rule renderer leaves the rule out of iptables because of
+// its HTTP match, which iptables can't enforce.  The rules that it keeps are rendered without the
+// HTTP match so we don't evaluate it either.  See DefaultRuleRenderer.skipForHTTPMatch.
+func (s *Snapshot) skipForHTTPMatch(rule *proto.Rule) bool {
+	if rule.HttpMatch == nil || len(rule.HttpMatch.Methods) == 0 {
+		return false
+	}
+	switch rule.Action {
+	case "deny":
+		// Left to the workload's agent.
+		return s.httpMatchEnforcedExternally
+	case "log":
+		return false
+	}
+	// Allow and pass rules fail closed unless the workload's agent enforces the HTTP match.
+	return !s.httpMatchEnforcedExternally
+}
@@ -0,0 +1,332 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysim_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"net"
+	"strings"
+
+	. "github.com/projectcalico/felix/policysim"
+	"github.com/projectcalico/felix/proto"
+)
+
+var (
+	wepID = proto.WorkloadEndpointID{
+		OrchestratorId: "k8s",
+		WorkloadId:     "default/pod-a",
+		EndpointId:     "eth0",
+	}
+	remoteIP   = net.ParseIP("10.0.1.1")
+	localIP    = net.ParseIP("10.0.0.1")
+	remoteIPv6 = net.ParseIP("fd00::2")
+	localIPv6  = net.ParseIP("fd00::1")
+)
+
+func tcpPacket(src, dst net.IP, dstPort uint16) *Packet {
+	return &Packet{SrcIP: src, DstIP: dst, Protocol: ProtocolTCP, SrcPort: 32768, DstPort: dstPort}
+}
+
+func tcp() *proto.Protocol {
+	return &proto.Protocol{NumberOrName: &proto.Protocol_Name{Name: "tcp"}}
+}
+
+var _ = Describe("Policy simulation", func() {
+	var snapshot *Snapshot
+	var wep *proto.WorkloadEndpoint
+
+	BeforeEach(func() {
+		snapshot = NewSnapshot()
+		wep = &proto.WorkloadEndpoint{
+			State:      "active",
+			Name:       "cali1234",
+			ProfileIds: []string{"prof-1"},
+			Ipv4Nets:   []string{"10.0.0.1/32"},
+			Ipv6Nets:   []string{"fd00::1/128"},
+			Tiers: []*proto.TierInfo{{
+				Name:            "default",
+				IngressPolicies: []string{"pol-1", "pol-2"},
+				EgressPolicies:  []string{"pol-1"},
+			}},
+		}
+		snapshot.OnUpdate(&proto.WorkloadEndpointUpdate{Id: &wepID, Endpoint: wep})
+		snapshot.OnUpdate(&proto.ActiveProfileUpdate{
+			Id:      &proto.ProfileID{Name: "prof-1"},
+			Profile: &proto.Profile{},
+		})
+	})
+
+	setPolicy := func(name string, inbound, outbound []*proto.Rule) {
+		snapshot.OnUpdate(&proto.ActivePolicyUpdate{
+			Id:     &proto.PolicyID{Tier: "default", Name: name},
+			Policy: &proto.Policy{InboundRules: inbound, OutboundRules: outbound},
+		})
+	}
+
+	simulate := func(pkt *Packet) *Result {
+		result, err := snapshot.Simulate(pkt)
+		Expect(err).NotTo(HaveOccurred())
+		return result
+	}
+
+	It("should not police traffic between non-local IPs", func() {
+		result := simulate(tcpPacket(remoteIP, net.ParseIP("10.0.2.2"), 80))
+		Expect(result.Verdict).To(Equal(VerdictAllow))
+		Expect(result.Steps).To(HaveLen(1))
+	})
+
+	It("should reject mixed IP versions", func() {
+		_, err := snapshot.Simulate(tcpPacket(remoteIP, localIPv6, 80))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should deny if no policies match", func() {
+		setPolicy("pol-1", nil, nil)
+		setPolicy("pol-2", nil, nil)
+		result := simulate(tcpPacket(remoteIP, localIP, 80))
+		Expect(result.Verdict).To(Equal(VerdictDeny))
+		Expect(result.Steps[len(result.Steps)-1].Reason).To(Equal("no policies in tier passed packet"))
+	})
+
+	It("should deny if the endpoint is admin down", func() {
+		wep.State = "down"
+		result := simulate(tcpPacket(remoteIP, localIP, 80))
+		Expect(result.Verdict).To(Equal(VerdictDeny))
+		Expect(result.Steps[0].Reason).To(Equal("endpoint is admin down"))
+	})
+
+	It("should report the first allow rule that matched", func() {
+		setPolicy("pol-1", []*proto.Rule{
+			{Action: "log"},
+			{Action: "allow", Protocol: tcp(), DstPorts: []*proto.PortRange{{First: 443, Last: 443}}},
+			{Action: "allow"},
+		}, nil)
+		result := simulate(tcpPacket(remoteIP, localIP, 80))
+		Expect(result.Verdict).To(Equal(VerdictAllow))
+		Expect(result.Steps).To(Equal([]Step{
+			{Endpoint: "default/pod-a/eth0", Direction: DirectionIngress, Tier: "default", Policy: "pol-1", RuleIndex: 0, Action: "log"},
+			{Endpoint: "default/pod-a/eth0", Direction: DirectionIngress, Tier: "default", Policy: "pol-1", RuleIndex: 2, Action: "allow"},
+		}))
+		Expect(result.Steps[1].String()).To(Equal(`default/pod-a/eth0 ingress: tier "default" policy "pol-1" rule 2: allow`))
+	})
+
+	It("should not apply ingress policy to traffic from the host", func() {
+		setPolicy("pol-1", []*proto.Rule{{Action: "deny"}}, nil)
+		pkt := tcpPacket(net.ParseIP("10.0.2.1"), localIP, 80)
+		Expect(simulate(pkt).Verdict).To(Equal(VerdictDeny))
+
+		pkt.FromHost = true
+		result := simulate(pkt)
+		Expect(result.Verdict).To(Equal(VerdictAllow))
+		Expect(result.Steps).To(Equal([]Step{{
+			Endpoint:  "default/pod-a/eth0",
+			Direction: DirectionIngress,
+			Action:    "allow",
+			Reason:    "traffic from the host to a local workload is not policed",
+		}}))
+	})
+
+	Describe("with rules that have HTTP matches", func() {
+		httpMatch := &proto.HTTPMatch{Methods: []string{"GET"}}
+
+		BeforeEach(func() {
+			setPolicy("pol-1", []*proto.Rule{
+				{Action: "deny", HttpMatch: httpMatch, SrcNet: []string{"10.0.2.0/24"}},
+				{Action: "allow", HttpMatch: httpMatch},
+			}, nil)
+			setPolicy("pol-2", nil, nil)
+		})
+
+		It("should skip allow rules and apply deny rules without the HTTP match", func() {
+			Expect(simulate(tcpPacket(remoteIP, localIP, 80)).Verdict).To(Equal(VerdictDeny))
+			result := simulate(tcpPacket(net.ParseIP("10.0.2.1"), localIP, 80))
+			Expect(result.Verdict).To(Equal(VerdictDeny))
+			Expect(result.Steps[0].RuleIndex).To(Equal(0))
+		})
+
+		It("should apply allow rules and skip deny rules when the policy sync API is enabled", func() {
+			snapshot.OnUpdate(&proto.ConfigUpdate{Config: map[string]string{
+				"PolicySyncPathPrefix": "/var/run/nodeagent",
+			}})
+			result := simulate(tcpPacket(net.ParseIP("10.0.2.1"), localIP, 80))
+			Expect(result.Verdict).To(Equal(VerdictAllow))
+			Expect(result.Steps).To(HaveLen(1))
+			Expect(result.Steps[0].RuleIndex).To(Equal(1))
+		})
+	})
+
+	It("should apply egress policy for traffic from the endpoint", func() {
+		setPolicy("pol-1", []*proto.Rule{{Action: "allow"}}, []*proto.Rule{{Action: "deny"}})
+		result := simulate(tcpPacket(localIP, remoteIP, 80))
+		Expect(result.Verdict).To(Equal(VerdictDeny))
+		Expect(result.Steps).To(HaveLen(1))
+		Expect(result.Steps[0].Direction).To(Equal(DirectionEgress))
+	})
+
+	It("should skip the remaining policies and apply profiles on pass", func() {
+		setPolicy("pol-1", []*proto.Rule{{Action: "pass"}}, nil)
+		setPolicy("pol-2", []*proto.Rule{{Action: "allow"}}, nil)
+		snapshot.OnUpdate(&proto.ActiveProfileUpdate{
+			Id: &proto.ProfileID{Name: "prof-1"},
+			Profile: &proto.Profile{InboundRules: []*proto.Rule{
+				{Action: "deny", SrcNet: []string{"10.0.1.0/24"}},
+			}},
+		})
+		result := simulate(tcpPacket(remoteIP, localIP, 80))
+		Expect(result.Verdict).To(Equal(VerdictDeny))
+		Expect(result.Steps).To(HaveLen(2))
+		Expect(result.Steps[1].Profile).To(Equal("prof-1"))
+	})
+
+	It("should deny when no profile matches", func() {
+		wep.Tiers = nil
+		result := simulate(tcpPacket(remoteIP, localIP, 80))
+		Expect(result.Verdict).To(Equal(VerdictDeny))
+		Expect(result.Steps[0].Reason).To(Equal("no profiles matched"))
+	})
+
+	Describe("with an IP set", func() {
+		BeforeEach(func() {
+			snapshot.OnUpdate(&proto.IPSetUpdate{
+				Id:      "set-1",
+				Type:    proto.IPSetUpdate_IP,
+				Members: []string{"10.0.1.1", "fd00:0:0::2"},
+			})
+			snapshot.OnUpdate(&proto.IPSetUpdate{
+				Id:      "net-set",
+				Type:    proto.IPSetUpdate_NET,
+				Members: []string{"10.0.1.0/24"},
+			})
+			snapshot.OnUpdate(&proto.IPSetUpdate{
+				Id:      "named-port",
+				Type:    proto.IPSetUpdate_IP_AND_PORT,
+				Members: []string{"10.0.0.1,tcp:8080"},
+			})
+		})
+
+		DescribeTable("rule matching",
+			func(rule *proto.Rule, pkt *Packet, expectedVerdict Verdict) {
+				setPolicy("pol-1", []*proto.Rule{rule}, nil)
+				setPolicy("pol-2", nil, nil)
+				Expect(simulate(pkt).Verdict).To(Equal(expectedVerdict))
+			},
+			Entry("empty rule", &proto.Rule{}, tcpPacket(remoteIP, localIP, 80), VerdictAllow),
+			Entry("IP version mismatch",
+				&proto.Rule{IpVersion: proto.IPVersion_IPV6}, tcpPacket(remoteIP, localIP, 80), VerdictDeny),
+			Entry("IPv6 packet",
+				&proto.Rule{IpVersion: proto.IPVersion_IPV6}, tcpPacket(remoteIPv6, localIPv6, 80), VerdictAllow),
+			Entry("protocol by number",
+				&proto.Rule{Protocol: &proto.Protocol{NumberOrName: &proto.Protocol_Number{Number: 17}}},
+				tcpPacket(remoteIP, localIP, 80), VerdictDeny),
+			Entry("negated protocol",
+				&proto.Rule{NotProtocol: tcp()}, tcpPacket(remoteIP, localIP, 80), VerdictDeny),
+			Entry("source CIDRs are or-ed",
+				&proto.Rule{SrcNet: []string{"10.1.0.0/16", "10.0.1.1/32"}}, tcpPacket(remoteIP, localIP, 80), VerdictAllow),
+			Entry("CIDRs of the wrong version skip the rule",
+				&proto.Rule{SrcNet: []string{"fd00::/64"}}, tcpPacket(remoteIP, localIP, 80), VerdictDeny),
+			Entry("mixed CIDRs match the packet's version",
+				&proto.Rule{SrcNet: []string{"fd00::/64", "10.0.1.0/24"}}, tcpPacket(remoteIP, localIP, 80), VerdictAllow),
+			Entry("negated source CIDR",
+				&proto.Rule{NotSrcNet: []string{"10.0.1.0/24"}}, tcpPacket(remoteIP, localIP, 80), VerdictDeny),
+			Entry("negated dest CIDR not matching",
+				&proto.Rule{NotDstNet: []string{"10.0.9.0/24"}}, tcpPacket(remoteIP, localIP, 80), VerdictAllow),
+			Entry("source IP set",
+				&proto.Rule{SrcIpSetIds: []string{"set-1"}}, tcpPacket(remoteIP, localIP, 80), VerdictAllow),
+			Entry("source IP set with non-canonical IPv6 member",
+				&proto.Rule{SrcIpSetIds: []string{"set-1"}}, tcpPacket(remoteIPv6, localIPv6, 80), VerdictAllow),
+			Entry("IP sets are and-ed",
+				&proto.Rule{SrcIpSetIds: []string{"set-1", "net-set"}}, tcpPacket(remoteIP, localIP, 80), VerdictAllow),
+			Entry("unknown IP set is empty",
+				&proto.Rule{SrcIpSetIds: []string{"set-1", "unknown"}}, tcpPacket(remoteIP, localIP, 80), VerdictDeny),
+			Entry("negated NET IP set",
+				&proto.Rule{NotSrcIpSetIds: []string{"net-set"}}, tcpPacket(remoteIP, localIP, 80), VerdictDeny),
+			Entry("dest port range",
+				&proto.Rule{Protocol: tcp(), DstPorts: []*proto.PortRange{{First: 1, Last: 1024}}},
+				tcpPacket(remoteIP, localIP, 80), VerdictAllow),
+			Entry("dest port outside range",
+				&proto.Rule{Protocol: tcp(), DstPorts: []*proto.PortRange{{First: 1, Last: 79}}},
+				tcpPacket(remoteIP, localIP, 80), VerdictDeny),
+			Entry("negated source port",
+				&proto.Rule{Protocol: tcp(), NotSrcPorts: []*proto.PortRange{{First: 32768, Last: 65535}}},
+				tcpPacket(remoteIP, localIP, 80), VerdictDeny),
+			Entry("named port matches",
+				&proto.Rule{Protocol: tcp(), DstNamedPortIpSetIds: []string{"named-port"}},
+				tcpPacket(remoteIP, localIP, 8080), VerdictAllow),
+			Entry("named port is or-ed with numeric ports",
+				&proto.Rule{
+					Protocol:             tcp(),
+					DstPorts:             []*proto.PortRange{{First: 80, Last: 80}},
+					DstNamedPortIpSetIds: []string{"named-port"},
+				},
+				tcpPacket(remoteIP, localIP, 80), VerdictAllow),
+			Entry("named port doesn't match other ports",
+				&proto.Rule{Protocol: tcp(), DstNamedPortIpSetIds: []string{"named-port"}},
+				tcpPacket(remoteIP, localIP, 8081), VerdictDeny),
+			Entry("negated named port",
+				&proto.Rule{Protocol: tcp(), NotDstNamedPortIpSetIds: []string{"named-port"}},
+				tcpPacket(remoteIP, localIP, 8080), VerdictDeny),
+			Entry("ports don't match ICMP",
+				&proto.Rule{DstPorts: []*proto.PortRange{{First: 0, Last: 65535}}},
+				&Packet{SrcIP: remoteIP, DstIP: localIP, Protocol: ProtocolICMP}, VerdictDeny),
+			Entry("ICMP type",
+				&proto.Rule{Icmp: &proto.Rule_IcmpType{IcmpType: 8}},
+				&Packet{SrcIP: remoteIP, DstIP: localIP, Protocol: ProtocolICMP, ICMPType: 8}, VerdictAllow),
+			Entry("ICMP type and code",
+				&proto.Rule{Icmp: &proto.Rule_IcmpTypeCode{IcmpTypeCode: &proto.IcmpTypeAndCode{Type: 3, Code: 1}}},
+				&Packet{SrcIP: remoteIP, DstIP: localIP, Protocol: ProtocolICMP, ICMPType: 3, ICMPCode: 2}, VerdictDeny),
+			Entry("ICMPv6 type",
+				&proto.Rule{Icmp: &proto.Rule_IcmpType{IcmpType: 128}},
+				&Packet{SrcIP: remoteIPv6, DstIP: localIPv6, Protocol: ProtocolICMPv6, ICMPType: 128}, VerdictAllow),
+			Entry("ICMP type doesn't match TCP",
+				&proto.Rule{Icmp: &proto.Rule_IcmpType{IcmpType: 8}}, tcpPacket(remoteIP, localIP, 80), VerdictDeny),
+			Entry("negated ICMP type",
+				&proto.Rule{NotIcmp: &proto.Rule_NotIcmpType{NotIcmpType: 8}},
+				&Packet{SrcIP: remoteIP, DstIP: localIP, Protocol: ProtocolICMP, ICMPType: 8}, VerdictDeny),
+		)
+
+		It("should apply IP set deltas", func() {
+			setPolicy("pol-1", []*proto.Rule{{SrcIpSetIds: []string{"set-1"}}}, nil)
+			snapshot.OnUpdate(&proto.IPSetDeltaUpdate{
+				Id:             "set-1",
+				RemovedMembers: []string{"10.0.1.1"},
+				AddedMembers:   []string{"10.0.1.2"},
+			})
+			Expect(simulate(tcpPacket(remoteIP, localIP, 80)).Verdict).To(Equal(VerdictDeny))
+			Expect(simulate(tcpPacket(net.ParseIP("10.0.1.2"), localIP, 80)).Verdict).To(Equal(VerdictAllow))
+		})
+	})
+
+	It("should load a JSON snapshot", func() {
+		input := `
+{"workloadEndpointUpdate": {"id": {"orchestratorId": "k8s", "workloadId": "default/pod-a", "endpointId": "eth0"},
+  "endpoint": {"state": "active", "ipv4Nets": ["10.0.0.1/32"],
+               "tiers": [{"name": "default", "ingressPolicies": ["pol-1"]}]}}}
+{"ipsetUpdate": {"id": "set-1", "members": ["10.0.1.1"], "type": "IP"}}
+{"activePolicyUpdate": {"id": {"tier": "default", "name": "pol-1"},
+  "policy": {"inboundRules": [{"action": "allow", "srcIpSetIds": ["set-1"]}]}}}
+`
+		loaded, err := LoadSnapshot(strings.NewReader(input))
+		Expect(err).NotTo(HaveOccurred())
+		result, err := loaded.Simulate(tcpPacket(remoteIP, localIP, 80))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Verdict).To(Equal(VerdictAllow))
+		result, err = loaded.Simulate(tcpPacket(net.ParseIP("10.0.1.2"), localIP, 80))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Verdict).To(Equal(VerdictDeny))
+	})
+})
@@ -0,0 +1,269 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/gogo/protobuf/jsonpb"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// Snapshot holds the parts of the calculation graph's output that affect policy: the active
+// policies and profiles, the IP sets that they reference and the local workload endpoints.
+// It is built up by feeding it the same messages that the dataplane driver receives.
+type Snapshot struct {
+	policies  map[proto.PolicyID]*proto.Policy
+	profiles  map[proto.ProfileID]*proto.Profile
+	ipSets    map[string]*ipSet
+	endpoints map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint
+
+	// httpMatchEnforcedExternally mirrors the rule renderer's config of the same name, which
+	// decides which rules with HTTP matches make it into iptables.
+	httpMatchEnforcedExternally bool
+}
+
+// ipSet holds the members of an IP set in a form that is convenient for lookups.
+type ipSet struct {
+	Type proto.IPSetUpdate_IPSetType
+	// Members contains the canonical string form of each member.
+	Members set.Set
+	// Nets contains the parsed members of a NET IP set, which need a containment check.
+	Nets map[string]*net.IPNet
+}
+
+func NewSnapshot() *Snapshot {
+	return &Snapshot{
+		policies:  map[proto.PolicyID]*proto.Policy{},
+		profiles:  map[proto.ProfileID]*proto.Profile{},
+		ipSets:    map[string]*ipSet{},
+		endpoints: map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint{},
+	}
+}
+
+// LoadSnapshot reads a stream of JSON-encoded proto.ToDataplane messages and applies them to a
+// new Snapshot.
+func LoadSnapshot(r io.Reader) (*Snapshot, error) {
+	s := NewSnapshot()
+	decoder := json.NewDecoder(r)
+	for {
+		var envelope proto.ToDataplane
+		err := jsonpb.UnmarshalNext(decoder, &envelope)
+		if err == io.EOF {
+			return s, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if msg := PayloadFromEnvelope(&envelope); msg != nil {
+			s.OnUpdate(msg)
+		}
+	}
+}
+
+// PayloadFromEnvelope unwraps the message inside a proto.ToDataplane envelope.  Returns nil if
+// the envelope is empty.
+func PayloadFromEnvelope(envelope *proto.ToDataplane) interface{} {
+	switch payload := envelope.Payload.(type) {
+	case *proto.ToDataplane_InSync:
+		return payload.InSync
+	case *proto.ToDataplane_IpsetUpdate:
+		return payload.IpsetUpdate
+	case *proto.ToDataplane_IpsetDeltaUpdate:
+		return payload.IpsetDeltaUpdate
+	case *proto.ToDataplane_IpsetRemove:
+		return payload.IpsetRemove
+	case *proto.ToDataplane_ActiveProfileUpdate:
+		return payload.ActiveProfileUpdate
+	case *proto.ToDataplane_ActiveProfileRemove:
+		return payload.ActiveProfileRemove
+	case *proto.ToDataplane_ActivePolicyUpdate:
+		return payload.ActivePolicyUpdate
+	case *proto.ToDataplane_ActivePolicyRemove:
+		return payload.ActivePolicyRemove
+	case *proto.ToDataplane_HostEndpointUpdate:
+		return payload.HostEndpointUpdate
+	case *proto.ToDataplane_HostEndpointRemove:
+		return payload.HostEndpointRemove
+	case *proto.ToDataplane_WorkloadEndpointUpdate:
+		return payload.WorkloadEndpointUpdate
+	case *proto.ToDataplane_WorkloadEndpointRemove:
+		return payload.WorkloadEndpointRemove
+	case *proto.ToDataplane_ConfigUpdate:
+		return payload.ConfigUpdate
+	case *proto.ToDataplane_HostMetadataUpdate:
+		return payload.HostMetadataUpdate
+	case *proto.ToDataplane_HostMetadataRemove:
+		return payload.HostMetadataRemove
+	case *proto.ToDataplane_IpamPoolUpdate:
+		return payload.IpamPoolUpdate
+	case *proto.ToDataplane_IpamPoolRemove:
+		return payload.IpamPoolRemove
+	case *proto.ToDataplane_ServiceAccountUpdate:
+		return payload.ServiceAccountUpdate
+	case *proto.ToDataplane_ServiceAccountRemove:
+		return payload.ServiceAccountRemove
+	case *proto.ToDataplane_NamespaceUpdate:
+		return payload.NamespaceUpdate
+	case *proto.ToDataplane_NamespaceRemove:
+		return payload.NamespaceRemove
+	case *proto.ToDataplane_RouteUpdate:
+		return payload.RouteUpdate
+	case *proto.ToDataplane_RouteRemove:
+		return payload.RouteRemove
+	}
+	return nil
+}
+
+// OnUpdate applies a single calculation graph message to the snapshot.  Messages that don't
+// affect policy are ignored.
+func (s *Snapshot) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.IPSetUpdate:
+		ipSet := &ipSet{
+			Type:    msg.Type,
+			Members: set.New(),
+			Nets:    map[string]*net.IPNet{},
+		}
+		s.ipSets[msg.Id] = ipSet
+		for _, m := range msg.Members {
+			ipSet.add(m)
+		}
+	case *proto.IPSetDeltaUpdate:
+		ipSet := s.ipSets[msg.Id]
+		if ipSet == nil {
+			log.WithField("setID", msg.Id).Warn("IP set delta for unknown IP set, ignoring")
+			return
+		}
+		for _, m := range msg.RemovedMembers {
+			ipSet.discard(m)
+		}
+		for _, m := range msg.AddedMembers {
+			ipSet.add(m)
+		}
+	case *proto.IPSetRemove:
+		delete(s.ipSets, msg.Id)
+	case *proto.ActivePolicyUpdate:
+		s.policies[*msg.Id] = msg.Policy
+	case *proto.ActivePolicyRemove:
+		delete(s.policies, *msg.Id)
+	case *proto.ActiveProfileUpdate:
+		s.profiles[*msg.Id] = msg.Profile
+	case *proto.ActiveProfileRemove:
+		delete(s.profiles, *msg.Id)
+	case *proto.WorkloadEndpointUpdate:
+		s.endpoints[*msg.Id] = msg.Endpoint
+	case *proto.WorkloadEndpointRemove:
+		delete(s.endpoints, *msg.Id)
+	case *proto.ConfigUpdate:
+		// As in dataplane.RulesConfigFromConfigParams, workloads' agents enforce HTTP matches
+		// when the policy sync API is enabled.
+		s.httpMatchEnforcedExternally = msg.Config["PolicySyncPathPrefix"] != ""
+	default:
+		log.WithField("msg", msg).Debug("Ignoring message that doesn't affect policy")
+	}
+}
+
+// lookupEndpoint finds the local workload endpoint that owns the given IP.
+func (s *Snapshot) lookupEndpoint(addr net.IP) (*proto.WorkloadEndpointID, *proto.WorkloadEndpoint) {
+	for id, ep := range s.endpoints {
+		nets := ep.Ipv4Nets
+		if addr.To4() == nil {
+			nets = ep.Ipv6Nets
+		}
+		for _, cidr := range nets {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.WithError(err).WithField("cidr", cidr).Warn("Ignoring bad endpoint CIDR")
+				continue
+			}
+			if ipNet.Contains(addr) {
+				id := id
+				return &id, ep
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (i *ipSet) add(member string) {
+	canon := canonicaliseMember(member)
+	i.Members.Add(canon)
+	if i.Type == proto.IPSetUpdate_NET {
+		_, ipNet, err := net.ParseCIDR(withPrefixLen(member))
+		if err != nil {
+			log.WithError(err).WithField("member", member).Warn("Ignoring bad IP set member")
+			return
+		}
+		i.Nets[canon] = ipNet
+	}
+}
+
+func (i *ipSet) discard(member string) {
+	canon := canonicaliseMember(member)
+	i.Members.Discard(canon)
+	delete(i.Nets, canon)
+}
+
+// containsIP returns true if the IP (or, for a NET IP set, a CIDR containing it) is in the set.
+func (i *ipSet) containsIP(addr net.IP) bool {
+	if i.Type == proto.IPSetUpdate_NET {
+		for _, ipNet := range i.Nets {
+			if ipNet.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	return i.Members.Contains(addr.String())
+}
+
+// containsIPPort returns true if the given IP, protocol and port is in an IP_AND_PORT set.
+func (i *ipSet) containsIPPort(addr net.IP, protoName string, port uint16) bool {
+	return i.Members.Contains(fmt.Sprintf("%s,%s:%d", addr.String(), protoName, port))
+}
+
+// canonicaliseMember converts an IP set member into a canonical string so that, for example,
+// differently-formatted IPv6 addresses compare equal.
+func canonicaliseMember(member string) string {
+	ipPart := member
+	suffix := ""
+	if idx := strings.IndexAny(member, ",/"); idx >= 0 {
+		ipPart = member[:idx]
+		suffix = strings.ToLower(member[idx:])
+	}
+	if addr := net.ParseIP(ipPart); addr != nil {
+		ipPart = addr.String()
+	}
+	return ipPart + suffix
+}
+
+// withPrefixLen adds a full-length prefix to a bare IP so that it can be parsed as a CIDR.
+func withPrefixLen(member string) string {
+	if strings.Contains(member, "/") {
+		return member
+	}
+	if strings.Contains(member, ":") {
+		return member + "/128"
+	}
+	return member + "/32"
+}
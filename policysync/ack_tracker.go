@@ -0,0 +1,157 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// maxTrackedUpdates limits the number of unacknowledged updates whose send times we remember
+// for each client, so that a client that never acks can't use unbounded memory.
+const maxTrackedUpdates = 1000
+
+var (
+	gaugeVecUnackedUpdates = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_policysync_unacked_updates",
+		Help: "Number of updates sent to a workload's policy sync client that it hasn't acknowledged.",
+	}, []string{"workload"})
+	gaugeVecSyncLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_policysync_sync_lag_seconds",
+		Help: "Time between sending an update to a workload's policy sync client and the client acknowledging it.",
+	}, []string{"workload"})
+	counterClientErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_policysync_client_errors",
+		Help: "Number of errors that policy sync clients reported when acknowledging updates.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(gaugeVecUnackedUpdates, gaugeVecSyncLag, counterClientErrors)
+}
+
+type sentUpdate struct {
+	seqNo uint64
+	time  time.Time
+}
+
+// ackTracker tracks the acknowledgements from one SyncWithAcks client.  The server's send loop
+// calls onSent for each update and readAcks processes the client's acks in the background.
+type ackTracker struct {
+	lock      sync.Mutex
+	unacked   []sentUpdate
+	lastSent  uint64
+	lastAcked uint64
+
+	epIDs         []proto.WorkloadEndpointID
+	statusUpdates chan<- interface{}
+	workload      string
+	logCxt        *log.Entry
+}
+
+func newAckTracker(epIDs []proto.WorkloadEndpointID, statusUpdates chan<- interface{}, logCxt *log.Entry) *ackTracker {
+	return &ackTracker{
+		epIDs:         epIDs,
+		statusUpdates: statusUpdates,
+		workload:      epIDs[0].WorkloadId,
+		logCxt:        logCxt,
+	}
+}
+
+func (t *ackTracker) onSent(seqNo uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.lastSent = seqNo
+	if len(t.unacked) >= maxTrackedUpdates {
+		t.unacked = t.unacked[1:]
+	}
+	t.unacked = append(t.unacked, sentUpdate{seqNo: seqNo, time: time.Now()})
+	gaugeVecUnackedUpdates.WithLabelValues(t.workload).Set(float64(t.lastSent - t.lastAcked))
+}
+
+func (t *ackTracker) onAck(ack *proto.SyncAck) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	seqNo := ack.SequenceNumber
+	if seqNo > t.lastSent {
+		t.logCxt.WithFields(log.Fields{
+			"ackedSeqNo": seqNo,
+			"lastSent":   t.lastSent,
+		}).Warn("Client acknowledged an update that we haven't sent")
+		seqNo = t.lastSent
+	}
+	if seqNo <= t.lastAcked {
+		return
+	}
+	t.lastAcked = seqNo
+	for len(t.unacked) > 0 && t.unacked[0].seqNo <= seqNo {
+		if t.unacked[0].seqNo == seqNo {
+			gaugeVecSyncLag.WithLabelValues(t.workload).Set(time.Since(t.unacked[0].time).Seconds())
+		}
+		t.unacked = t.unacked[1:]
+	}
+	gaugeVecUnackedUpdates.WithLabelValues(t.workload).Set(float64(t.lastSent - t.lastAcked))
+}
+
+// readAcks reads acks from the stream until it fails, which happens when the connection is
+// closed.  It reports changes to the client's error state to the status reporter and clears
+// any error when it exits.
+func (t *ackTracker) readAcks(stream proto.PolicySync_SyncWithAcksServer) {
+	lastErr := ""
+	defer func() {
+		if lastErr != "" {
+			t.sendStatus("")
+		}
+		gaugeVecUnackedUpdates.DeleteLabelValues(t.workload)
+		gaugeVecSyncLag.DeleteLabelValues(t.workload)
+	}()
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.logCxt.WithError(err).Debug("Stopped reading acks from policy sync client")
+			return
+		}
+		ack := msg.GetAck()
+		if ack == nil {
+			t.logCxt.WithField("msg", msg).Warn("Ignoring unexpected message from policy sync client")
+			continue
+		}
+		t.onAck(ack)
+		if ack.Error != lastErr {
+			if ack.Error != "" {
+				t.logCxt.WithField("error", ack.Error).Warn("Policy sync client failed to apply updates")
+				counterClientErrors.Inc()
+			} else {
+				t.logCxt.Info("Policy sync client recovered from error")
+			}
+			lastErr = ack.Error
+			t.sendStatus(lastErr)
+		}
+	}
+}
+
+func (t *ackTracker) sendStatus(errMsg string) {
+	if t.statusUpdates == nil {
+		return
+	}
+	for i := range t.epIDs {
+		t.statusUpdates <- &proto.PolicySyncStatusUpdate{Id: &t.epIDs[i], Error: errMsg}
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client is a client for Felix's policy sync API, for use by agents that run alongside
+// a workload (such as a service mesh sidecar).  It connects to the socket that Felix's binder
+// mounts into the pod, maintains a local model of the policy that applies to the workload and
+// reconnects, with backoff, if the connection fails.
+//
+// The model is only exposed once it is in sync: when the client (re)connects, it builds a fresh
+// model from the new stream and replaces the previous model only once Felix sends InSync.  Stale
+// state from an earlier connection is never merged with new state.
+//
+// The client acknowledges each update once it has applied it, so that Felix can report
+// whether the workload's policy is up to date.  If the update can't be applied, or OnChange
+// returns an error, the ack carries the error.
+package client
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+const (
+	// DefaultSocketPath is where the policy sync socket is usually mounted in the workload.
+	DefaultSocketPath = "/var/run/nodeagent/socket"
+
+	defaultMinBackoff  = 100 * time.Millisecond
+	defaultMaxBackoff  = 10 * time.Second
+	defaultDialTimeout = 5 * time.Second
+)
+
+type Config struct {
+	// SocketPath is the path of the policy sync socket.  Defaults to DefaultSocketPath.
+	SocketPath string
+	// MinBackoff and MaxBackoff bound the exponential backoff between connection attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// DialTimeout limits each connection attempt.
+	DialTimeout time.Duration
+
+	// OrchestratorID, WorkloadID and EndpointIDs select the endpoints to subscribe to.  If
+	// they're empty, Felix uses the workload and endpoints that the socket's credentials allow.
+	OrchestratorID string
+	WorkloadID     string
+	EndpointIDs    []string
+
+	// OnChange, if set, is called whenever the snapshot changes; that is, when the client
+	// first gets in sync, when it gets back in sync after reconnecting and after each update
+	// that it receives while in sync.  It is called from the client's goroutine so it should
+	// not block for long.  If it returns an error, for example, because the workload's proxy
+	// rejected the new policy, the error is reported to Felix until OnChange next succeeds.
+	OnChange func(snap *Snapshot) error
+}
+
+// Client maintains a local model of the policy sync API's state.  Create it with New and start
+// it with Start.
+type Client struct {
+	config Config
+
+	lock sync.Mutex
+	// current is the model that we expose; nil until we first get in sync.
+	current *model
+	// inSyncC is closed when we first get in sync.
+	inSyncC chan struct{}
+}
+
+func New(config Config) *Client {
+	if config.SocketPath == "" {
+		config.SocketPath = DefaultSocketPath
+	}
+	if config.MinBackoff == 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaultDialTimeout
+	}
+	return &Client{
+		config:  config,
+		inSyncC: make(chan struct{}),
+	}
+}
+
+// Start starts the client's background goroutine, which runs until the context is cancelled.
+func (c *Client) Start(ctx context.Context) {
+	go c.loop(ctx)
+}
+
+// WaitForInSync blocks until the client is first in sync with Felix or the context is done.
+func (c *Client) WaitForInSync(ctx context.Context) error {
+	select {
+	case <-c.inSyncC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Snapshot returns a copy of the current model, or nil if the client hasn't been in sync yet.
+// The proto messages in the snapshot are shared with the client and must not be modified.
+func (c *Client) Snapshot() *Snapshot {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.current == nil {
+		return nil
+	}
+	return c.current.snapshot()
+}
+
+func (c *Client) loop(ctx context.Context) {
+	backoff := c.config.MinBackoff
+	for {
+		receivedData, err := c.syncOnce(ctx)
+		if ctx.Err() != nil {
+			log.Info("Policy sync client stopped")
+			return
+		}
+		if receivedData {
+			// The connection worked for a while; start the backoff from scratch.
+			backoff = c.config.MinBackoff
+		}
+		log.WithError(err).WithField("backoff", backoff).Warn(
+			"Policy sync connection failed, will reconnect")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			log.Info("Policy sync client stopped")
+			return
+		}
+		backoff *= 2
+		if backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
+		}
+	}
+}
+
+// syncOnce connects to the socket and processes updates until the stream fails.  It returns
+// true if it received any updates.
+func (c *Client) syncOnce(ctx context.Context) (receivedData bool, err error) {
+	dialCtx, cancel := context.WithTimeout(ctx, c.config.DialTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(dialCtx, c.config.SocketPath,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}),
+	)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	stream, err := proto.NewPolicySyncClient(conn).SyncWithAcks(ctx)
+	if err != nil {
+		return false, err
+	}
+	err = stream.Send(&proto.SyncClientMessage{
+		Payload: &proto.SyncClientMessage_SyncRequest{SyncRequest: &proto.SyncRequest{
+			OrchestratorId: c.config.OrchestratorID,
+			WorkloadId:     c.config.WorkloadID,
+			EndpointIds:    c.config.EndpointIDs,
+		}},
+	})
+	if err != nil {
+		return false, err
+	}
+	log.WithField("socket", c.config.SocketPath).Info("Connected to policy sync API")
+
+	// Build a fresh model for this connection; it replaces the current one once it's in sync.
+	// If the model fails to apply an update, it stays broken (and we keep reporting the
+	// error) until we reconnect.
+	pending := newModel()
+	var modelErr, onChangeErr error
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return receivedData, err
+		}
+		receivedData = true
+
+		c.lock.Lock()
+		inSyncBefore := pending.inSync
+		if err := pending.apply(msg); err != nil && modelErr == nil {
+			modelErr = err
+		}
+		var snap *Snapshot
+		if pending.inSync {
+			if !inSyncBefore {
+				log.Info("Policy sync client in sync")
+				c.current = pending
+				select {
+				case <-c.inSyncC:
+				default:
+					close(c.inSyncC)
+				}
+			}
+			if c.config.OnChange != nil {
+				snap = pending.snapshot()
+			}
+		}
+		c.lock.Unlock()
+
+		if snap != nil {
+			onChangeErr = c.config.OnChange(snap)
+			if onChangeErr != nil {
+				log.WithError(onChangeErr).Warn("Failed to handle policy sync update")
+			}
+		}
+
+		ack := &proto.SyncAck{SequenceNumber: msg.SequenceNumber}
+		if modelErr != nil {
+			ack.Error = modelErr.Error()
+		} else if onChangeErr != nil {
+			ack.Error = onChangeErr.Error()
+		}
+		err = stream.Send(&proto.SyncClientMessage{
+			Payload: &proto.SyncClientMessage_Ack{Ack: ack},
+		})
+		if err != nil {
+			return receivedData, err
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/projectcalico/felix/binder"
+	"github.com/projectcalico/felix/policysync"
+	"github.com/projectcalico/felix/policysync/client"
+	"github.com/projectcalico/felix/proto"
+)
+
+// felixSide runs a real policy sync processor and server on a unix socket.
+type felixSide struct {
+	updates       chan interface{}
+	statusUpdates chan interface{}
+	grpcServer    *grpc.Server
+}
+
+func startFelixSide(socketPath string) *felixSide {
+	updates := make(chan interface{})
+	processor := policysync.NewProcessor(updates, 100)
+	processor.Start()
+	statusUpdates := make(chan interface{}, 100)
+	server := policysync.NewServer(processor.JoinUpdates, statusUpdates, policysync.NewUIDAllocator().NextUID)
+	grpcServer := grpc.NewServer(grpc.Creds(testCreds{}))
+	server.RegisterGrpc(grpcServer)
+	lis, err := net.Listen("unix", socketPath)
+	Expect(err).NotTo(HaveOccurred())
+	go grpcServer.Serve(lis)
+	return &felixSide{updates: updates, statusUpdates: statusUpdates, grpcServer: grpcServer}
+}
+
+func (f *felixSide) sendEndpointAndPolicy(policyName string) {
+	polID := proto.PolicyID{Tier: "default", Name: policyName}
+	f.updates <- &proto.ActivePolicyUpdate{
+		Id:     &polID,
+		Policy: &proto.Policy{InboundRules: []*proto.Rule{{Action: "allow"}}},
+	}
+	f.updates <- &proto.WorkloadEndpointUpdate{
+		Id: &testEndpointID,
+		Endpoint: &proto.WorkloadEndpoint{
+			Tiers: []*proto.TierInfo{{Name: "default", IngressPolicies: []string{policyName}}},
+		},
+	}
+	f.updates <- &proto.InSync{}
+}
+
+var testEndpointID = proto.WorkloadEndpointID{
+	OrchestratorId: policysync.OrchestratorId,
+	WorkloadId:     "ns1/pod1",
+	EndpointId:     policysync.EndpointId,
+}
+
+var _ = Describe("Policy sync client", func() {
+	var (
+		tempDir    string
+		socketPath string
+		felix      *felixSide
+		c          *client.Client
+		ctx        context.Context
+		cancel     context.CancelFunc
+		changes    chan *client.Snapshot
+
+		onChangeErrLock sync.Mutex
+		onChangeErr     error
+	)
+	setOnChangeErr := func(err error) {
+		onChangeErrLock.Lock()
+		defer onChangeErrLock.Unlock()
+		onChangeErr = err
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "policysync-client")
+		Expect(err).NotTo(HaveOccurred())
+		socketPath = filepath.Join(tempDir, "socket")
+		felix = startFelixSide(socketPath)
+
+		changes = make(chan *client.Snapshot, 100)
+		setOnChangeErr(nil)
+		c = client.New(client.Config{
+			SocketPath: socketPath,
+			MinBackoff: 10 * time.Millisecond,
+			MaxBackoff: 100 * time.Millisecond,
+			OnChange: func(snap *client.Snapshot) error {
+				changes <- snap
+				onChangeErrLock.Lock()
+				defer onChangeErrLock.Unlock()
+				return onChangeErr
+			},
+		})
+		ctx, cancel = context.WithCancel(context.Background())
+		c.Start(ctx)
+	})
+
+	AfterEach(func() {
+		cancel()
+		felix.grpcServer.Stop()
+		os.RemoveAll(tempDir)
+	})
+
+	It("should have no snapshot before it's in sync", func() {
+		Expect(c.Snapshot()).To(BeNil())
+	})
+
+	Describe("after Felix sends the endpoint and its policy", func() {
+		BeforeEach(func() {
+			felix.sendEndpointAndPolicy("pol1")
+			waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+			defer waitCancel()
+			Expect(c.WaitForInSync(waitCtx)).To(Succeed())
+		})
+
+		It("should expose the endpoint and policy", func() {
+			snap := c.Snapshot()
+			Expect(snap.Endpoints).To(HaveKey(testEndpointID))
+			Expect(snap.Policies).To(HaveKey(proto.PolicyID{Tier: "default", Name: "pol1"}))
+			Eventually(changes).Should(Receive())
+		})
+
+		It("should apply IP set updates and deltas", func() {
+			felix.updates <- &proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}}
+			felix.updates <- &proto.ActivePolicyUpdate{
+				Id: &proto.PolicyID{Tier: "default", Name: "pol1"},
+				Policy: &proto.Policy{InboundRules: []*proto.Rule{
+					{Action: "allow", SrcIpSetIds: []string{"s1"}},
+				}},
+			}
+			felix.updates <- &proto.IPSetDeltaUpdate{Id: "s1", AddedMembers: []string{"10.0.0.2"}}
+			Eventually(func() []string {
+				ipSet := c.Snapshot().IPSets["s1"]
+				if ipSet == nil {
+					return nil
+				}
+				return ipSet.Members
+			}).Should(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+		})
+
+		It("should report OnChange errors to Felix until OnChange succeeds", func() {
+			setOnChangeErr(errors.New("proxy rejected config"))
+			felix.updates <- &proto.NamespaceUpdate{Id: &proto.NamespaceID{Name: "ns1"}}
+			Eventually(felix.statusUpdates, "5s").Should(Receive(Equal(&proto.PolicySyncStatusUpdate{
+				Id:    &testEndpointID,
+				Error: "proxy rejected config",
+			})))
+
+			setOnChangeErr(nil)
+			felix.updates <- &proto.NamespaceUpdate{Id: &proto.NamespaceID{Name: "ns2"}}
+			Eventually(felix.statusUpdates, "5s").Should(Receive(Equal(&proto.PolicySyncStatusUpdate{
+				Id: &testEndpointID,
+			})))
+		})
+
+		It("should reconnect and discard stale state", func() {
+			felix.grpcServer.Stop()
+			os.Remove(socketPath)
+			felix = startFelixSide(socketPath)
+			felix.sendEndpointAndPolicy("pol2")
+
+			Eventually(func() map[proto.PolicyID]*proto.Policy {
+				return c.Snapshot().Policies
+			}, "5s").Should(And(
+				HaveKey(proto.PolicyID{Tier: "default", Name: "pol2"}),
+				Not(HaveKey(proto.PolicyID{Tier: "default", Name: "pol1"})),
+			))
+		})
+	})
+})
+
+// testCreds identifies every connection as coming from testEndpointID's workload, in place of
+// the binder's per-pod credentials.
+type testCreds struct{}
+
+func (testCreds) ClientHandshake(_ context.Context, _ string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, nil, errors.New("client handshake unsupported")
+}
+
+func (testCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, binder.Credentials{Namespace: "ns1", Workload: "pod1"}, nil
+}
+
+func (testCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "test"}
+}
+
+func (t testCreds) Clone() credentials.TransportCredentials {
+	return t
+}
+
+func (testCreds) OverrideServerName(string) error {
+	return nil
+}
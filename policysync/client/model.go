@@ -0,0 +1,156 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// Snapshot is a consistent copy of the state that Felix has sent over the policy sync API.
+type Snapshot struct {
+	// Endpoints contains the subscribed endpoints that Felix knows about.
+	Endpoints       map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint
+	Policies        map[proto.PolicyID]*proto.Policy
+	Profiles        map[proto.ProfileID]*proto.Profile
+	IPSets          map[string]*IPSet
+	ServiceAccounts map[proto.ServiceAccountID]*proto.ServiceAccountUpdate
+	Namespaces      map[proto.NamespaceID]*proto.NamespaceUpdate
+}
+
+type IPSet struct {
+	Type proto.IPSetUpdate_IPSetType
+	// Members is sorted.
+	Members []string
+}
+
+// model is the state built up from one connection's stream of updates.
+type model struct {
+	inSync bool
+
+	endpoints       map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint
+	policies        map[proto.PolicyID]*proto.Policy
+	profiles        map[proto.ProfileID]*proto.Profile
+	ipSetTypes      map[string]proto.IPSetUpdate_IPSetType
+	ipSetMembers    map[string]map[string]bool
+	serviceAccounts map[proto.ServiceAccountID]*proto.ServiceAccountUpdate
+	namespaces      map[proto.NamespaceID]*proto.NamespaceUpdate
+}
+
+func newModel() *model {
+	return &model{
+		endpoints:       map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint{},
+		policies:        map[proto.PolicyID]*proto.Policy{},
+		profiles:        map[proto.ProfileID]*proto.Profile{},
+		ipSetTypes:      map[string]proto.IPSetUpdate_IPSetType{},
+		ipSetMembers:    map[string]map[string]bool{},
+		serviceAccounts: map[proto.ServiceAccountID]*proto.ServiceAccountUpdate{},
+		namespaces:      map[proto.NamespaceID]*proto.NamespaceUpdate{},
+	}
+}
+
+// apply applies the update to the model.  It returns an error if the update is inconsistent
+// with the model, in which case the model may no longer match Felix's state.
+func (m *model) apply(msg *proto.ToDataplane) error {
+	switch payload := msg.Payload.(type) {
+	case *proto.ToDataplane_InSync:
+		m.inSync = true
+	case *proto.ToDataplane_WorkloadEndpointUpdate:
+		m.endpoints[*payload.WorkloadEndpointUpdate.Id] = payload.WorkloadEndpointUpdate.Endpoint
+	case *proto.ToDataplane_WorkloadEndpointRemove:
+		delete(m.endpoints, *payload.WorkloadEndpointRemove.Id)
+	case *proto.ToDataplane_ActivePolicyUpdate:
+		m.policies[*payload.ActivePolicyUpdate.Id] = payload.ActivePolicyUpdate.Policy
+	case *proto.ToDataplane_ActivePolicyRemove:
+		delete(m.policies, *payload.ActivePolicyRemove.Id)
+	case *proto.ToDataplane_ActiveProfileUpdate:
+		m.profiles[*payload.ActiveProfileUpdate.Id] = payload.ActiveProfileUpdate.Profile
+	case *proto.ToDataplane_ActiveProfileRemove:
+		delete(m.profiles, *payload.ActiveProfileRemove.Id)
+	case *proto.ToDataplane_IpsetUpdate:
+		members := map[string]bool{}
+		for _, member := range payload.IpsetUpdate.Members {
+			members[member] = true
+		}
+		m.ipSetTypes[payload.IpsetUpdate.Id] = payload.IpsetUpdate.Type
+		m.ipSetMembers[payload.IpsetUpdate.Id] = members
+	case *proto.ToDataplane_IpsetDeltaUpdate:
+		members, ok := m.ipSetMembers[payload.IpsetDeltaUpdate.Id]
+		if !ok {
+			log.WithField("id", payload.IpsetDeltaUpdate.Id).Warn("Delta update for unknown IP set")
+			return fmt.Errorf("delta update for unknown IP set %q", payload.IpsetDeltaUpdate.Id)
+		}
+		for _, member := range payload.IpsetDeltaUpdate.RemovedMembers {
+			delete(members, member)
+		}
+		for _, member := range payload.IpsetDeltaUpdate.AddedMembers {
+			members[member] = true
+		}
+	case *proto.ToDataplane_IpsetRemove:
+		delete(m.ipSetTypes, payload.IpsetRemove.Id)
+		delete(m.ipSetMembers, payload.IpsetRemove.Id)
+	case *proto.ToDataplane_ServiceAccountUpdate:
+		m.serviceAccounts[*payload.ServiceAccountUpdate.Id] = payload.ServiceAccountUpdate
+	case *proto.ToDataplane_ServiceAccountRemove:
+		delete(m.serviceAccounts, *payload.ServiceAccountRemove.Id)
+	case *proto.ToDataplane_NamespaceUpdate:
+		m.namespaces[*payload.NamespaceUpdate.Id] = payload.NamespaceUpdate
+	case *proto.ToDataplane_NamespaceRemove:
+		delete(m.namespaces, *payload.NamespaceRemove.Id)
+	default:
+		log.WithField("type", reflect.TypeOf(msg.Payload)).Debug("Ignoring unexpected policy sync message")
+	}
+	return nil
+}
+
+func (m *model) snapshot() *Snapshot {
+	snap := &Snapshot{
+		Endpoints:       make(map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint, len(m.endpoints)),
+		Policies:        make(map[proto.PolicyID]*proto.Policy, len(m.policies)),
+		Profiles:        make(map[proto.ProfileID]*proto.Profile, len(m.profiles)),
+		IPSets:          make(map[string]*IPSet, len(m.ipSetMembers)),
+		ServiceAccounts: make(map[proto.ServiceAccountID]*proto.ServiceAccountUpdate, len(m.serviceAccounts)),
+		Namespaces:      make(map[proto.NamespaceID]*proto.NamespaceUpdate, len(m.namespaces)),
+	}
+	for id, ep := range m.endpoints {
+		snap.Endpoints[id] = ep
+	}
+	for id, policy := range m.policies {
+		snap.Policies[id] = policy
+	}
+	for id, profile := range m.profiles {
+		snap.Profiles[id] = profile
+	}
+	for id, members := range m.ipSetMembers {
+		ipSet := &IPSet{Type: m.ipSetTypes[id], Members: make([]string, 0, len(members))}
+		for member := range members {
+			ipSet.Members = append(ipSet.Members, member)
+		}
+		sort.Strings(ipSet.Members)
+		snap.IPSets[id] = ipSet
+	}
+	for id, sa := range m.serviceAccounts {
+		snap.ServiceAccounts[id] = sa
+	}
+	for id, ns := range m.namespaces {
+		snap.Namespaces[id] = ns
+	}
+	return snap
+}
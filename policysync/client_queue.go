@@ -0,0 +1,268 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var (
+	summaryQueueLen = prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "felix_policysync_client_queue_len",
+		Help: "Length of a policy sync client's queue, recorded each time an update is queued.",
+	})
+	counterForcedDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_policysync_forced_disconnects",
+		Help: "Number of policy sync clients that were disconnected because they fell too far behind.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(summaryQueueLen, counterForcedDisconnects)
+}
+
+// clientQueue is the bounded queue of updates for one policy sync client.  The Processor adds
+// updates without blocking and a background goroutine feeds them to the client's channel so
+// that a slow client can't stall the Processor (and hence every other client).
+//
+// Updates that are superseded by a later update for the same resource, for example, two policy
+// updates for the same PolicyID, are coalesced.  A superseding update takes the place of the
+// oldest queued update for the resource so that it stays ahead of the updates that were queued
+// after it and may depend on it; for example, an endpoint update that references the policy.
+// However, if something that the resource may depend on has been queued since (an IP set, in
+// the case of a policy), the new update could then overtake it, so it is added to the back of
+// the queue instead and the older update is left in place.  Removes always go to the back of
+// the queue, after any updates that stop referencing the resource.  That preserves the
+// ordering guarantees of the Processor; for example, that IP sets are sent before the policies
+// that reference them.
+//
+// If the queue grows beyond its maximum length, it overflows: it discards the pending updates
+// and closes the client's channel, which disconnects the client.  The client then has to
+// reconnect and resync.
+type clientQueue struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	items      *list.List
+	itemsByKey map[interface{}][]*list.Element
+	maxLen     int
+
+	closed     bool
+	overflowed bool
+
+	output chan<- proto.ToDataplane
+	logCxt *log.Entry
+}
+
+func newClientQueue(output chan<- proto.ToDataplane, maxLen int, logCxt *log.Entry) *clientQueue {
+	q := &clientQueue{
+		items:      list.New(),
+		itemsByKey: map[interface{}][]*list.Element{},
+		maxLen:     maxLen,
+		output:     output,
+		logCxt:     logCxt,
+	}
+	q.cond = sync.NewCond(&q.lock)
+	go q.pump()
+	return q
+}
+
+// Push adds an update to the back of the queue.  It returns false if the queue overflowed, in
+// which case the queue is closed and the caller should treat the client as disconnected.
+func (q *clientQueue) Push(msg proto.ToDataplane) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		q.logCxt.WithField("msg", msg).Debug("Discarding update for closed queue")
+		return !q.overflowed
+	}
+
+	key, mode := coalescingKey(msg)
+	queued := q.itemsByKey[key]
+	switch {
+	case mode == coalesceReplace && len(queued) > 0 && q.canReplaceInPlace(queued[0], key):
+		// Replace the oldest queued update and drop the rest.
+		queued[0].Value = msg
+		for _, elem := range queued[1:] {
+			q.items.Remove(elem)
+		}
+		q.itemsByKey[key] = queued[:1]
+	case mode == coalesceRemove:
+		for _, elem := range queued {
+			q.items.Remove(elem)
+		}
+		delete(q.itemsByKey, key)
+		fallthrough
+	default:
+		elem := q.items.PushBack(msg)
+		if key != nil {
+			q.itemsByKey[key] = append(q.itemsByKey[key], elem)
+		}
+	}
+	summaryQueueLen.Observe(float64(q.items.Len()))
+
+	if q.items.Len() > q.maxLen {
+		q.logCxt.WithField("maxLen", q.maxLen).Warn(
+			"Policy sync client fell too far behind, disconnecting it")
+		counterForcedDisconnects.Inc()
+		q.overflowed = true
+		q.closed = true
+		q.items.Init()
+		q.itemsByKey = nil
+		q.cond.Signal()
+		return false
+	}
+	q.cond.Signal()
+	return true
+}
+
+// canReplaceInPlace returns true if none of the updates that were queued after elem are for a
+// kind of resource that the resource with the given key may depend on.
+func (q *clientQueue) canReplaceInPlace(elem *list.Element, key interface{}) bool {
+	rank := dependencyRank(key)
+	for e := elem.Next(); e != nil; e = e.Next() {
+		otherKey, _ := coalescingKey(e.Value.(proto.ToDataplane))
+		if otherKey != nil && dependencyRank(otherKey) < rank {
+			return false
+		}
+	}
+	return true
+}
+
+// Close closes the queue.  The updates that are already queued are still sent to the client
+// before its channel is closed.
+func (q *clientQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.cond.Signal()
+}
+
+// pump sends the queued updates to the client's channel until the queue is closed and empty.
+func (q *clientQueue) pump() {
+	defer close(q.output)
+	for {
+		q.lock.Lock()
+		for q.items.Len() == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.items.Len() == 0 {
+			// Closed and drained (or overflowed, which empties the queue).
+			q.lock.Unlock()
+			q.logCxt.Debug("Client queue closed")
+			return
+		}
+		elem := q.items.Front()
+		msg := q.items.Remove(elem).(proto.ToDataplane)
+		if key, _ := coalescingKey(msg); key != nil {
+			q.itemsByKey[key] = removeElem(q.itemsByKey[key], elem)
+			if len(q.itemsByKey[key]) == 0 {
+				delete(q.itemsByKey, key)
+			}
+		}
+		q.lock.Unlock()
+
+		q.output <- msg
+	}
+}
+
+func removeElem(elems []*list.Element, elem *list.Element) []*list.Element {
+	for i, e := range elems {
+		if e == elem {
+			return append(elems[:i], elems[i+1:]...)
+		}
+	}
+	return elems
+}
+
+type policyKey proto.PolicyID
+type profileKey proto.ProfileID
+type ipSetKey string
+type endpointKey proto.WorkloadEndpointID
+type serviceAccountKey proto.ServiceAccountID
+type namespaceKey proto.NamespaceID
+type inSyncKey struct{}
+
+// dependencyRank orders the kinds of resource so that a resource can only depend on resources
+// of a lower rank: endpoints reference policies and profiles, which reference IP sets, service
+// accounts and namespaces.
+func dependencyRank(key interface{}) int {
+	switch key.(type) {
+	case ipSetKey, serviceAccountKey, namespaceKey:
+		return 0
+	case policyKey, profileKey:
+		return 1
+	case endpointKey:
+		return 2
+	}
+	return 3
+}
+
+type coalesceMode int
+
+const (
+	// coalesceAppend updates are added to the back of the queue without superseding anything.
+	coalesceAppend coalesceMode = iota
+	// coalesceReplace updates supersede the queued updates with the same key, in place.
+	coalesceReplace
+	// coalesceRemove updates supersede the queued updates with the same key and go to the
+	// back of the queue.
+	coalesceRemove
+)
+
+// coalescingKey returns the key of the resource that the update is about, or nil if the update
+// can't be coalesced, and how it coalesces with the queued updates with the same key.  IP set
+// deltas have a key (so that a later full update or remove supersedes them) but they don't
+// supersede anything themselves since each delta builds on the ones before.
+func coalescingKey(msg proto.ToDataplane) (key interface{}, mode coalesceMode) {
+	switch payload := msg.Payload.(type) {
+	case *proto.ToDataplane_InSync:
+		return inSyncKey{}, coalesceReplace
+	case *proto.ToDataplane_ActivePolicyUpdate:
+		return policyKey(*payload.ActivePolicyUpdate.Id), coalesceReplace
+	case *proto.ToDataplane_ActivePolicyRemove:
+		return policyKey(*payload.ActivePolicyRemove.Id), coalesceRemove
+	case *proto.ToDataplane_ActiveProfileUpdate:
+		return profileKey(*payload.ActiveProfileUpdate.Id), coalesceReplace
+	case *proto.ToDataplane_ActiveProfileRemove:
+		return profileKey(*payload.ActiveProfileRemove.Id), coalesceRemove
+	case *proto.ToDataplane_IpsetUpdate:
+		return ipSetKey(payload.IpsetUpdate.Id), coalesceReplace
+	case *proto.ToDataplane_IpsetDeltaUpdate:
+		return ipSetKey(payload.IpsetDeltaUpdate.Id), coalesceAppend
+	case *proto.ToDataplane_IpsetRemove:
+		return ipSetKey(payload.IpsetRemove.Id), coalesceRemove
+	case *proto.ToDataplane_WorkloadEndpointUpdate:
+		return endpointKey(*payload.WorkloadEndpointUpdate.Id), coalesceReplace
+	case *proto.ToDataplane_WorkloadEndpointRemove:
+		return endpointKey(*payload.WorkloadEndpointRemove.Id), coalesceRemove
+	case *proto.ToDataplane_ServiceAccountUpdate:
+		return serviceAccountKey(*payload.ServiceAccountUpdate.Id), coalesceReplace
+	case *proto.ToDataplane_ServiceAccountRemove:
+		return serviceAccountKey(*payload.ServiceAccountRemove.Id), coalesceRemove
+	case *proto.ToDataplane_NamespaceUpdate:
+		return namespaceKey(*payload.NamespaceUpdate.Id), coalesceReplace
+	case *proto.ToDataplane_NamespaceRemove:
+		return namespaceKey(*payload.NamespaceRemove.Id), coalesceRemove
+	}
+	return nil, coalesceAppend
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("clientQueue", func() {
+	var output chan proto.ToDataplane
+	var q *clientQueue
+
+	polID := proto.PolicyID{Tier: "default", Name: "pol1"}
+	epID := proto.WorkloadEndpointID{WorkloadId: "wl1", EndpointId: "ep1"}
+
+	policyUpdate := func(ipSet string) proto.ToDataplane {
+		id := polID
+		return proto.ToDataplane{Payload: &proto.ToDataplane_ActivePolicyUpdate{
+			ActivePolicyUpdate: &proto.ActivePolicyUpdate{
+				Id:     &id,
+				Policy: &proto.Policy{InboundRules: []*proto.Rule{{SrcIpSetIds: []string{ipSet}}}},
+			},
+		}}
+	}
+	policyRemove := func() proto.ToDataplane {
+		id := polID
+		return proto.ToDataplane{Payload: &proto.ToDataplane_ActivePolicyRemove{
+			ActivePolicyRemove: &proto.ActivePolicyRemove{Id: &id},
+		}}
+	}
+	ipSetUpdate := func(setID string) proto.ToDataplane {
+		return proto.ToDataplane{Payload: &proto.ToDataplane_IpsetUpdate{
+			IpsetUpdate: &proto.IPSetUpdate{Id: setID},
+		}}
+	}
+	endpointUpdate := func() proto.ToDataplane {
+		id := epID
+		return proto.ToDataplane{Payload: &proto.ToDataplane_WorkloadEndpointUpdate{
+			WorkloadEndpointUpdate: &proto.WorkloadEndpointUpdate{Id: &id},
+		}}
+	}
+	describe := func(msg proto.ToDataplane) string {
+		switch payload := msg.Payload.(type) {
+		case *proto.ToDataplane_ActivePolicyUpdate:
+			return "policy:" + payload.ActivePolicyUpdate.Policy.InboundRules[0].SrcIpSetIds[0]
+		case *proto.ToDataplane_ActivePolicyRemove:
+			return "policy-remove"
+		case *proto.ToDataplane_IpsetUpdate:
+			return "ipset:" + payload.IpsetUpdate.Id
+		case *proto.ToDataplane_WorkloadEndpointUpdate:
+			return "endpoint"
+		}
+		return "other"
+	}
+
+	BeforeEach(func() {
+		output = make(chan proto.ToDataplane)
+		q = newClientQueue(output, 100, log.WithField("test", true))
+		// Get an update in flight so that the pump blocks and the rest stay queued.
+		Expect(q.Push(ipSetUpdate("in-flight"))).To(BeTrue())
+		Eventually(func() int {
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			return q.items.Len()
+		}).Should(BeZero())
+	})
+
+	drain := func() (msgs []string) {
+		q.Close()
+		for msg := range output {
+			msgs = append(msgs, describe(msg))
+		}
+		return
+	}
+
+	It("should replace a superseded update in place", func() {
+		q.Push(ipSetUpdate("s1"))
+		q.Push(policyUpdate("s1"))
+		q.Push(endpointUpdate())
+		q.Push(policyUpdate("s1"))
+		Expect(drain()).To(Equal([]string{"ipset:in-flight", "ipset:s1", "policy:s1", "endpoint"}))
+	})
+
+	It("should not let an update overtake an IP set that it may depend on", func() {
+		q.Push(policyUpdate("s1"))
+		q.Push(endpointUpdate())
+		q.Push(ipSetUpdate("s2"))
+		q.Push(policyUpdate("s2"))
+		Expect(drain()).To(Equal([]string{"ipset:in-flight", "policy:s1", "endpoint", "ipset:s2", "policy:s2"}))
+	})
+
+	It("should send a remove after the updates that were queued before it", func() {
+		q.Push(policyUpdate("s1"))
+		q.Push(endpointUpdate())
+		q.Push(policyRemove())
+		Expect(drain()).To(Equal([]string{"ipset:in-flight", "endpoint", "policy-remove"}))
+	})
+})
@@ -20,30 +20,86 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/set"
 )
 
 type Processor struct {
 	Updates            <-chan interface{}
 	JoinUpdates        chan interface{}
 	endpointsByID      map[proto.WorkloadEndpointID]*EndpointInfo
+	subscriptions      map[*subscription]bool
 	policyByID         map[proto.PolicyID]*proto.Policy
 	profileByID        map[proto.ProfileID]*proto.Profile
 	serviceAccountByID map[proto.ServiceAccountID]*proto.ServiceAccountUpdate
 	namespaceByID      map[proto.NamespaceID]*proto.NamespaceUpdate
+	ipSetsByID         map[string]*ipSetInfo
 	receivedInSync     bool
+	// maxQueueLen is the maximum number of updates that we queue for a client before we
+	// disconnect it.
+	maxQueueLen int
+}
+
+// ipSetInfo records the current members of an IP set so that we can send the whole set to
+// endpoints that start using it.
+type ipSetInfo struct {
+	setType proto.IPSetUpdate_IPSetType
+	members set.Set
+}
+
+func (i *ipSetInfo) toUpdate(id string) *proto.IPSetUpdate {
+	members := make([]string, 0, i.members.Len())
+	i.members.Iter(func(item interface{}) error {
+		members = append(members, item.(string))
+		return nil
+	})
+	return &proto.IPSetUpdate{Id: id, Type: i.setType, Members: members}
 }
 
 type EndpointInfo struct {
-	// The channel to send updates for this workload to.
-	output         chan<- proto.ToDataplane
-	currentJoinUID uint64
-	endpointUpd    *proto.WorkloadEndpointUpdate
+	id          proto.WorkloadEndpointID
+	endpointUpd *proto.WorkloadEndpointUpdate
+	// subscription is the client connection that's subscribed to this endpoint, if any.
+	subscription *subscription
+}
+
+// subscription is the state of one client connection, which may be subscribed to several
+// endpoints of the same workload.  The policies, profiles and IP sets that the client needs are
+// the union of those needed by its endpoints; they're only removed once no endpoint needs them.
+type subscription struct {
+	joinUID uint64
+	// The queue of updates for the client, or nil if the client has been disconnected.
+	output         *clientQueue
+	endpoints      []*EndpointInfo
 	syncedPolicies map[proto.PolicyID]bool
 	syncedProfiles map[proto.ProfileID]bool
+	syncedIPSets   map[string]bool
+}
+
+// send queues an update for the subscription's client.  If the client's queue overflows, the
+// client is disconnected; it resyncs when it reconnects.
+func (s *subscription) send(msg proto.ToDataplane) {
+	if s.output == nil {
+		return
+	}
+	if !s.output.Push(msg) {
+		s.output = nil
+	}
+}
+
+// hasEndpointUpdates returns true if any of the subscription's endpoints exist.
+func (s *subscription) hasEndpointUpdates() bool {
+	for _, ei := range s.endpoints {
+		if ei.endpointUpd != nil {
+			return true
+		}
+	}
+	return false
 }
 
 type JoinMetadata struct {
-	EndpointID proto.WorkloadEndpointID
+	// EndpointIDs are the endpoints that the client subscribes to.  They all belong to the same
+	// workload.
+	EndpointIDs []proto.WorkloadEndpointID
 	// JoinUID is a correlator, used to match stop requests with join requests.
 	JoinUID uint64
 }
@@ -52,9 +108,8 @@ type JoinMetadata struct {
 // it provides the channel used to send sync messages back to the server goroutine.
 type JoinRequest struct {
 	JoinMetadata
-	// C is the channel to send updates to the policy sync client.  Processor closes the channel when the
-	// workload endpoint is removed, or when a new JoinRequest is received for the same endpoint.  If nil, indicates
-	// the client wants to stop receiving updates.
+	// C is the channel to send updates to the policy sync client.  Processor closes the channel when all the
+	// workload endpoints are removed, or when a new JoinRequest is received for one of the same endpoints.
 	C chan<- proto.ToDataplane
 }
 
@@ -62,17 +117,20 @@ type LeaveRequest struct {
 	JoinMetadata
 }
 
-func NewProcessor(updates <-chan interface{}) *Processor {
+func NewProcessor(updates <-chan interface{}, maxQueueLen int) *Processor {
 	return &Processor{
 		// Updates from the calculation graph.
 		Updates: updates,
 		// JoinUpdates from the new servers that have started.
 		JoinUpdates:        make(chan interface{}, 10),
 		endpointsByID:      make(map[proto.WorkloadEndpointID]*EndpointInfo),
+		subscriptions:      make(map[*subscription]bool),
 		policyByID:         make(map[proto.PolicyID]*proto.Policy),
 		profileByID:        make(map[proto.ProfileID]*proto.Profile),
 		serviceAccountByID: make(map[proto.ServiceAccountID]*proto.ServiceAccountUpdate),
 		namespaceByID:      make(map[proto.NamespaceID]*proto.NamespaceUpdate),
+		ipSetsByID:         make(map[string]*ipSetInfo),
+		maxQueueLen:        maxQueueLen,
 	}
 }
 
@@ -100,63 +158,83 @@ func (p *Processor) loop() {
 }
 
 func (p *Processor) handleJoin(joinReq JoinRequest) {
-	epID := joinReq.EndpointID
-	logCxt := log.WithField("joinReq", joinReq).WithField("epID", epID)
-	ei, ok := p.endpointsByID[epID]
-
-	if !ok {
-		logCxt.Info("Join request for unknown endpoint, pre-creating EndpointInfo")
-		ei = &EndpointInfo{}
-		p.endpointsByID[epID] = ei
+	logCxt := log.WithField("joinReq", joinReq)
+	sub := &subscription{
+		joinUID:        joinReq.JoinUID,
+		output:         newClientQueue(joinReq.C, p.maxQueueLen, logCxt),
+		syncedPolicies: map[proto.PolicyID]bool{},
+		syncedProfiles: map[proto.ProfileID]bool{},
+		syncedIPSets:   map[string]bool{},
 	}
 
-	if ei.output != nil {
-		logCxt.Info("Join request for already-active connection, closing old channel.")
-		close(ei.output)
-	} else {
-		logCxt.Info("Join request with no previously active connection.")
+	// Close the old connections first: closing a connection cleans up the EndpointInfos that it
+	// pre-created, which may include the ones that we're about to attach to.
+	for _, epID := range joinReq.EndpointIDs {
+		if ei, ok := p.endpointsByID[epID]; ok && ei.subscription != nil {
+			logCxt.WithField("epID", epID).Info(
+				"Join request for already-active connection, closing old connection.")
+			p.closeSubscription(ei.subscription)
+		}
 	}
 
-	ei.currentJoinUID = joinReq.JoinUID
-	ei.output = joinReq.C
-	ei.syncedPolicies = map[proto.PolicyID]bool{}
-	ei.syncedProfiles = map[proto.ProfileID]bool{}
+	for _, epID := range joinReq.EndpointIDs {
+		logCxt := logCxt.WithField("epID", epID)
+		ei, ok := p.endpointsByID[epID]
+		if !ok {
+			logCxt.Info("Join request for unknown endpoint, pre-creating EndpointInfo")
+			ei = &EndpointInfo{id: epID}
+			p.endpointsByID[epID] = ei
+		}
+		if ei.subscription == sub {
+			logCxt.Debug("Endpoint listed twice in join request")
+			continue
+		}
+		ei.subscription = sub
+		sub.endpoints = append(sub.endpoints, ei)
+	}
+	p.subscriptions[sub] = true
 
-	p.maybeSyncEndpoint(ei)
+	p.syncEndpoints(sub, sub.endpoints)
 
 	// Any updates to service accounts will be synced, but the endpoint needs to know about any existing service
 	// accounts that were updated before it joined.
-	p.sendServiceAccounts(ei)
-	p.sendNamespaces(ei)
+	p.sendServiceAccounts(sub)
+	p.sendNamespaces(sub)
 	logCxt.Debug("Done with join")
 }
 
 func (p *Processor) handleLeave(leaveReq LeaveRequest) {
-	epID := leaveReq.EndpointID
-	logCxt := log.WithField("leaveReq", leaveReq).WithField("epID", epID)
-	ei, ok := p.endpointsByID[epID]
-
-	if !ok {
-		logCxt.Info("Leave request for unknown endpoint, ignoring")
+	logCxt := log.WithField("leaveReq", leaveReq)
+	for _, epID := range leaveReq.EndpointIDs {
+		ei, ok := p.endpointsByID[epID]
+		if !ok || ei.subscription == nil || ei.subscription.joinUID != leaveReq.JoinUID {
+			continue
+		}
+		logCxt.Info("Leave request for active connection, closing channel.")
+		p.closeSubscription(ei.subscription)
 		return
 	}
+	logCxt.Info("Leave request doesn't match active connection, ignoring")
+}
 
-	// Make sure we clean up endpointsByID if needed.
-	defer func() {
-		if ei.output == nil && ei.currentJoinUID == 0 && ei.endpointUpd == nil {
-			logCxt.Info("Cleaning up empty EndpointInfo")
-			delete(p.endpointsByID, epID)
+// closeSubscription closes the subscription's client queue (if it's still open) and detaches
+// it from its endpoints, cleaning up any endpoints that are no longer needed.
+func (p *Processor) closeSubscription(sub *subscription) {
+	if sub.output != nil {
+		sub.output.Close()
+		sub.output = nil
+	}
+	for _, ei := range sub.endpoints {
+		if ei.subscription != sub {
+			continue
+		}
+		ei.subscription = nil
+		if ei.endpointUpd == nil {
+			log.WithField("epID", ei.id).Info("Cleaning up empty EndpointInfo")
+			delete(p.endpointsByID, ei.id)
 		}
-	}()
-	if ei.currentJoinUID != leaveReq.JoinUID {
-		logCxt.Info("Leave request doesn't match active connection, ignoring")
-		return
 	}
-	logCxt.Info("Leave request for active connection, closing channel.")
-	close(ei.output)
-	ei.output = nil
-	ei.currentJoinUID = 0
-	return
+	delete(p.subscriptions, sub)
 }
 
 func (p *Processor) handleDataplane(update interface{}) {
@@ -184,6 +262,12 @@ func (p *Processor) handleDataplane(update interface{}) {
 		p.handleNamespaceUpdate(update)
 	case *proto.NamespaceRemove:
 		p.handleNamespaceRemove(update)
+	case *proto.IPSetUpdate:
+		p.handleIPSetUpdate(update)
+	case *proto.IPSetDeltaUpdate:
+		p.handleIPSetDeltaUpdate(update)
+	case *proto.IPSetRemove:
+		p.handleIPSetRemove(update)
 	default:
 		log.WithFields(log.Fields{
 			"update": update,
@@ -199,11 +283,9 @@ func (p *Processor) handleInSync(update *proto.InSync) {
 	}
 	log.Info("Now in sync with the calculation graph")
 	p.receivedInSync = true
-	for _, ei := range p.endpointsByID {
-		if ei.output != nil {
-			ei.output <- proto.ToDataplane{
-				Payload: &proto.ToDataplane_InSync{InSync: &proto.InSync{}}}
-		}
+	for _, sub := range p.activeSubscriptions() {
+		sub.send(proto.ToDataplane{
+			Payload: &proto.ToDataplane_InSync{InSync: &proto.InSync{}}})
 	}
 	return
 }
@@ -214,52 +296,71 @@ func (p *Processor) handleWorkloadEndpointUpdate(update *proto.WorkloadEndpointU
 	ei, ok := p.endpointsByID[epID]
 	if !ok {
 		// Add this endpoint
-		ei = &EndpointInfo{
-			endpointUpd:    update,
-			syncedPolicies: map[proto.PolicyID]bool{},
-			syncedProfiles: map[proto.ProfileID]bool{},
-		}
+		ei = &EndpointInfo{id: epID}
 		p.endpointsByID[epID] = ei
-	} else {
-		ei.endpointUpd = update
 	}
-	p.maybeSyncEndpoint(ei)
+	ei.endpointUpd = update
+	if ei.subscription != nil {
+		p.syncEndpoints(ei.subscription, []*EndpointInfo{ei})
+	}
 }
 
-func (p *Processor) maybeSyncEndpoint(ei *EndpointInfo) {
-	if ei.endpointUpd == nil {
-		log.Debug("Skipping sync: endpoint has no update")
+// syncEndpoints sends the given endpoints of the subscription to its client, along with any
+// policies, profiles and IP sets that the client now needs, then removes the ones that it no
+// longer needs.
+func (p *Processor) syncEndpoints(sub *subscription, eps []*EndpointInfo) {
+	if sub.output == nil {
+		log.Debug("Skipping sync: endpoint has no listening client")
 		return
 	}
-	if ei.output == nil {
-		log.Debug("Skipping sync: endpoint has no listening client")
+	var updates []*proto.WorkloadEndpointUpdate
+	for _, ei := range eps {
+		if ei.endpointUpd != nil {
+			updates = append(updates, ei.endpointUpd)
+		}
+	}
+	if len(updates) == 0 {
+		log.Debug("Skipping sync: endpoint has no update")
 		return
 	}
 
 	// The calc graph sends us policies and profiles before endpoint updates, but the Processor doesn't know
 	// which endpoints need them until now.  Send any unsynced profiles & policies referenced
-	p.syncAddedPolicies(ei)
-	p.syncAddedProfiles(ei)
-	ei.output <- proto.ToDataplane{
-		Payload: &proto.ToDataplane_WorkloadEndpointUpdate{ei.endpointUpd}}
-	p.syncRemovedPolicies(ei)
-	p.syncRemovedProfiles(ei)
+	p.syncAddedPolicies(sub)
+	p.syncAddedProfiles(sub)
+	for _, update := range updates {
+		sub.send(proto.ToDataplane{
+			Payload: &proto.ToDataplane_WorkloadEndpointUpdate{update}})
+	}
+	p.syncRemovedPolicies(sub)
+	p.syncRemovedProfiles(sub)
+	p.syncRemovedIPSets(sub)
 	if p.receivedInSync {
-		log.WithField("channel", ei.output).Debug("Already in sync with the datastore, sending in-sync message to client")
-		ei.output <- proto.ToDataplane{
-			Payload: &proto.ToDataplane_InSync{InSync: &proto.InSync{}}}
+		log.Debug("Already in sync with the datastore, sending in-sync message to client")
+		sub.send(proto.ToDataplane{
+			Payload: &proto.ToDataplane_InSync{InSync: &proto.InSync{}}})
 	}
 }
 
 func (p *Processor) handleWorkloadEndpointRemove(update *proto.WorkloadEndpointRemove) {
 	// we trust the Calc graph never to send us a remove for an endpoint it didn't tell us about
 	ei := p.endpointsByID[*update.Id]
-	if ei.output != nil {
-		// Send update and close down.
-		ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_WorkloadEndpointRemove{update}}
-		close(ei.output)
+	ei.endpointUpd = nil
+	sub := ei.subscription
+	if sub == nil {
+		delete(p.endpointsByID, *update.Id)
+		return
 	}
-	delete(p.endpointsByID, *update.Id)
+	sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_WorkloadEndpointRemove{update}})
+	if !sub.hasEndpointUpdates() {
+		// The client's last endpoint has gone; close down.
+		p.closeSubscription(sub)
+		return
+	}
+	// Other endpoints remain; remove anything that only the removed endpoint needed.
+	p.syncRemovedPolicies(sub)
+	p.syncRemovedProfiles(sub)
+	p.syncRemovedIPSets(sub)
 }
 
 func (p *Processor) handleActiveProfileUpdate(update *proto.ActiveProfileUpdate) {
@@ -268,16 +369,18 @@ func (p *Processor) handleActiveProfileUpdate(update *proto.ActiveProfileUpdate)
 	p.profileByID[pId] = profile
 
 	// Update any endpoints that reference this profile
-	for _, ei := range p.updateableEndpoints() {
+	for _, sub := range p.activeSubscriptions() {
 		action := func(other proto.ProfileID) bool {
 			if other == pId {
-				ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_ActiveProfileUpdate{update}}
-				ei.syncedProfiles[pId] = true
+				p.syncAddedIPSets(sub, profile.GetInboundRules(), profile.GetOutboundRules())
+				sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_ActiveProfileUpdate{update}})
+				sub.syncedProfiles[pId] = true
+				p.syncRemovedIPSets(sub)
 				return true
 			}
 			return false
 		}
-		ei.iterateProfiles(action)
+		sub.iterateProfiles(action)
 	}
 }
 
@@ -286,10 +389,11 @@ func (p *Processor) handleActiveProfileRemove(update *proto.ActiveProfileRemove)
 	log.WithFields(log.Fields{"ProfileID": pId}).Debug("Processing ActiveProfileRemove")
 
 	// Push the update to any endpoints it was synced to
-	for _, ei := range p.updateableEndpoints() {
-		if ei.syncedProfiles[pId] {
-			ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_ActiveProfileRemove{update}}
-			delete(ei.syncedProfiles, pId)
+	for _, sub := range p.activeSubscriptions() {
+		if sub.syncedProfiles[pId] {
+			sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_ActiveProfileRemove{update}})
+			delete(sub.syncedProfiles, pId)
+			p.syncRemovedIPSets(sub)
 		}
 	}
 	delete(p.profileByID, pId)
@@ -302,17 +406,19 @@ func (p *Processor) handleActivePolicyUpdate(update *proto.ActivePolicyUpdate) {
 	p.policyByID[pId] = policy
 
 	// Update any endpoints that reference this policy
-	for _, ei := range p.updateableEndpoints() {
+	for _, sub := range p.activeSubscriptions() {
 		// Closure of the action to take on each policy on the endpoint.
 		action := func(other proto.PolicyID) bool {
 			if other == pId {
-				ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_ActivePolicyUpdate{update}}
-				ei.syncedPolicies[pId] = true
+				p.syncAddedIPSets(sub, policy.GetInboundRules(), policy.GetOutboundRules())
+				sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_ActivePolicyUpdate{update}})
+				sub.syncedPolicies[pId] = true
+				p.syncRemovedIPSets(sub)
 				return true
 			}
 			return false
 		}
-		ei.iteratePolicies(action)
+		sub.iteratePolicies(action)
 	}
 }
 
@@ -321,10 +427,11 @@ func (p *Processor) handleActivePolicyRemove(update *proto.ActivePolicyRemove) {
 	log.WithFields(log.Fields{"PolicyID": pId}).Debug("Processing ActivePolicyRemove")
 
 	// Push the update to any endpoints it was synced to
-	for _, ei := range p.updateableEndpoints() {
-		if ei.syncedPolicies[pId] {
-			ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_ActivePolicyRemove{update}}
-			delete(ei.syncedPolicies, pId)
+	for _, sub := range p.activeSubscriptions() {
+		if sub.syncedPolicies[pId] {
+			sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_ActivePolicyRemove{update}})
+			delete(sub.syncedPolicies, pId)
+			p.syncRemovedIPSets(sub)
 		}
 	}
 	delete(p.policyByID, pId)
@@ -334,8 +441,8 @@ func (p *Processor) handleServiceAccountUpdate(update *proto.ServiceAccountUpdat
 	id := *update.Id
 	log.WithField("ServiceAccountID", id).Debug("Processing ServiceAccountUpdate")
 
-	for _, ei := range p.updateableEndpoints() {
-		ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_ServiceAccountUpdate{update}}
+	for _, sub := range p.activeSubscriptions() {
+		sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_ServiceAccountUpdate{update}})
 	}
 	p.serviceAccountByID[id] = update
 	return
@@ -345,8 +452,8 @@ func (p *Processor) handleServiceAccountRemove(update *proto.ServiceAccountRemov
 	id := *update.Id
 	log.WithField("ServiceAccountID", id).Debug("Processing ServiceAccountRemove")
 
-	for _, ei := range p.updateableEndpoints() {
-		ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_ServiceAccountRemove{update}}
+	for _, sub := range p.activeSubscriptions() {
+		sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_ServiceAccountRemove{update}})
 	}
 	delete(p.serviceAccountByID, id)
 }
@@ -355,8 +462,8 @@ func (p *Processor) handleNamespaceUpdate(update *proto.NamespaceUpdate) {
 	id := *update.Id
 	log.WithField("NamespaceID", id).Debug("Processing NamespaceUpdate")
 
-	for _, ei := range p.updateableEndpoints() {
-		ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_NamespaceUpdate{update}}
+	for _, sub := range p.activeSubscriptions() {
+		sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_NamespaceUpdate{update}})
 	}
 	p.namespaceByID[id] = update
 	return
@@ -366,23 +473,158 @@ func (p *Processor) handleNamespaceRemove(update *proto.NamespaceRemove) {
 	id := *update.Id
 	log.WithField("NamespaceID", id).Debug("Processing NamespaceRemove")
 
-	for _, ei := range p.updateableEndpoints() {
-		ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_NamespaceRemove{update}}
+	for _, sub := range p.activeSubscriptions() {
+		sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_NamespaceRemove{update}})
 	}
 	delete(p.namespaceByID, id)
 }
 
-func (p *Processor) syncAddedPolicies(ei *EndpointInfo) {
-	ei.iteratePolicies(func(pId proto.PolicyID) bool {
-		if !ei.syncedPolicies[pId] {
+func (p *Processor) handleIPSetUpdate(update *proto.IPSetUpdate) {
+	log.WithField("IPSetID", update.Id).Debug("Processing IPSetUpdate")
+	info := &ipSetInfo{setType: update.Type, members: set.New()}
+	for _, member := range update.Members {
+		info.members.Add(member)
+	}
+	p.ipSetsByID[update.Id] = info
+
+	// Send the update to endpoints that already have the IP set and to any endpoints whose
+	// synced policies reference it.  (The calculation graph sends IP sets before the policies
+	// that use them so we only expect the former.)
+	for _, sub := range p.activeSubscriptions() {
+		if sub.syncedIPSets[update.Id] || p.referencedIPSets(sub).Contains(update.Id) {
+			sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_IpsetUpdate{update}})
+			sub.syncedIPSets[update.Id] = true
+		}
+	}
+}
+
+func (p *Processor) handleIPSetDeltaUpdate(update *proto.IPSetDeltaUpdate) {
+	log.WithField("IPSetID", update.Id).Debug("Processing IPSetDeltaUpdate")
+	info, ok := p.ipSetsByID[update.Id]
+	if !ok {
+		log.WithField("IPSetID", update.Id).Warn("Delta update for unknown IP set, ignoring")
+		return
+	}
+	for _, member := range update.RemovedMembers {
+		info.members.Discard(member)
+	}
+	for _, member := range update.AddedMembers {
+		info.members.Add(member)
+	}
+
+	for _, sub := range p.activeSubscriptions() {
+		if sub.syncedIPSets[update.Id] {
+			sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_IpsetDeltaUpdate{update}})
+		}
+	}
+}
+
+func (p *Processor) handleIPSetRemove(update *proto.IPSetRemove) {
+	log.WithField("IPSetID", update.Id).Debug("Processing IPSetRemove")
+
+	// The calculation graph removes IP sets after the policies that reference them so the
+	// endpoints should already have removed the IP set.  Make sure.
+	for _, sub := range p.activeSubscriptions() {
+		if sub.syncedIPSets[update.Id] {
+			sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_IpsetRemove{update}})
+			delete(sub.syncedIPSets, update.Id)
+		}
+	}
+	delete(p.ipSetsByID, update.Id)
+}
+
+// syncAddedIPSets sends IPSetUpdates for any IP sets that the given rules reference and that
+// haven't been sent to the client yet.  It must be called before the policy or profile that
+// contains the rules is sent so that the client never sees a reference to an unknown IP set.
+func (p *Processor) syncAddedIPSets(sub *subscription, ruleLists ...[]*proto.Rule) {
+	for _, rules := range ruleLists {
+		for _, rule := range rules {
+			iterateIPSetIDs(rule, func(id string) {
+				if sub.syncedIPSets[id] {
+					return
+				}
+				info, ok := p.ipSetsByID[id]
+				if !ok {
+					log.WithField("IPSetID", id).Warn("Rule references unknown IP set")
+					return
+				}
+				sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_IpsetUpdate{info.toUpdate(id)}})
+				sub.syncedIPSets[id] = true
+			})
+		}
+	}
+}
+
+// syncRemovedIPSets sends IPSetRemove messages for any IP sets that were sent to the client
+// but that its synced policies and profiles no longer reference.
+func (p *Processor) syncRemovedIPSets(sub *subscription) {
+	referenced := p.referencedIPSets(sub)
+	for id := range sub.syncedIPSets {
+		if referenced.Contains(id) {
+			continue
+		}
+		sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_IpsetRemove{
+			&proto.IPSetRemove{Id: id},
+		}})
+		delete(sub.syncedIPSets, id)
+	}
+}
+
+// referencedIPSets returns the IDs of the IP sets that the subscription's synced policies and
+// profiles reference.
+func (p *Processor) referencedIPSets(sub *subscription) set.Set {
+	ids := set.New()
+	addIDs := func(rules []*proto.Rule) {
+		for _, rule := range rules {
+			iterateIPSetIDs(rule, func(id string) {
+				ids.Add(id)
+			})
+		}
+	}
+	for polID := range sub.syncedPolicies {
+		policy := p.policyByID[polID]
+		addIDs(policy.GetInboundRules())
+		addIDs(policy.GetOutboundRules())
+	}
+	for profID := range sub.syncedProfiles {
+		profile := p.profileByID[profID]
+		addIDs(profile.GetInboundRules())
+		addIDs(profile.GetOutboundRules())
+	}
+	return ids
+}
+
+// iterateIPSetIDs calls the action for each IP set ID in the rule, including the named port IP
+// sets.
+func iterateIPSetIDs(rule *proto.Rule, action func(id string)) {
+	for _, ids := range [][]string{
+		rule.SrcIpSetIds,
+		rule.DstIpSetIds,
+		rule.NotSrcIpSetIds,
+		rule.NotDstIpSetIds,
+		rule.SrcNamedPortIpSetIds,
+		rule.DstNamedPortIpSetIds,
+		rule.NotSrcNamedPortIpSetIds,
+		rule.NotDstNamedPortIpSetIds,
+	} {
+		for _, id := range ids {
+			action(id)
+		}
+	}
+}
+
+func (p *Processor) syncAddedPolicies(sub *subscription) {
+	sub.iteratePolicies(func(pId proto.PolicyID) bool {
+		if !sub.syncedPolicies[pId] {
 			policy := p.policyByID[pId]
-			ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_ActivePolicyUpdate{
+			p.syncAddedIPSets(sub, policy.GetInboundRules(), policy.GetOutboundRules())
+			sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_ActivePolicyUpdate{
 				&proto.ActivePolicyUpdate{
 					Id:     &pId,
 					Policy: policy,
 				},
-			}}
-			ei.syncedPolicies[pId] = true
+			}})
+			sub.syncedPolicies[pId] = true
 		}
 		return false
 	})
@@ -390,11 +632,11 @@ func (p *Processor) syncAddedPolicies(ei *EndpointInfo) {
 
 // syncRemovedPolicies sends ActivePolicyRemove messages for any previously active, but now unused
 // policies.
-func (p *Processor) syncRemovedPolicies(ei *EndpointInfo) {
-	oldSyncedPolicies := ei.syncedPolicies
-	ei.syncedPolicies = map[proto.PolicyID]bool{}
+func (p *Processor) syncRemovedPolicies(sub *subscription) {
+	oldSyncedPolicies := sub.syncedPolicies
+	sub.syncedPolicies = map[proto.PolicyID]bool{}
 
-	ei.iteratePolicies(func(pId proto.PolicyID) bool {
+	sub.iteratePolicies(func(pId proto.PolicyID) bool {
 		if !oldSyncedPolicies[pId] {
 			// We've never sent this policy?
 			return false
@@ -402,29 +644,32 @@ func (p *Processor) syncRemovedPolicies(ei *EndpointInfo) {
 
 		// Still an active policy, remove it from the old set.
 		delete(oldSyncedPolicies, pId)
-		ei.syncedPolicies[pId] = true
+		sub.syncedPolicies[pId] = true
 		return false
 	})
 
-	// oldSyncedPolicies now contains only policies that are no longer needed by this endpoint.
+	// oldSyncedPolicies now contains only policies that are no longer needed by this subscription's endpoints.
 	for polID := range oldSyncedPolicies {
-		ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_ActivePolicyRemove{
-			&proto.ActivePolicyRemove{Id: &polID},
-		}}
+		// Copy the ID; the queued message may outlive this iteration.
+		id := polID
+		sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_ActivePolicyRemove{
+			&proto.ActivePolicyRemove{Id: &id},
+		}})
 	}
 }
 
-func (p *Processor) syncAddedProfiles(ei *EndpointInfo) {
-	ei.iterateProfiles(func(pId proto.ProfileID) bool {
-		if !ei.syncedProfiles[pId] {
+func (p *Processor) syncAddedProfiles(sub *subscription) {
+	sub.iterateProfiles(func(pId proto.ProfileID) bool {
+		if !sub.syncedProfiles[pId] {
 			profile := p.profileByID[pId]
-			ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_ActiveProfileUpdate{
+			p.syncAddedIPSets(sub, profile.GetInboundRules(), profile.GetOutboundRules())
+			sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_ActiveProfileUpdate{
 				&proto.ActiveProfileUpdate{
 					Id:      &pId,
 					Profile: profile,
 				},
-			}}
-			ei.syncedProfiles[pId] = true
+			}})
+			sub.syncedProfiles[pId] = true
 		}
 		return false
 	})
@@ -432,11 +677,11 @@ func (p *Processor) syncAddedProfiles(ei *EndpointInfo) {
 
 // syncRemovedProfiles sends ActiveProfileRemove messages for any previously active, but now unused
 // profiles.
-func (p *Processor) syncRemovedProfiles(ei *EndpointInfo) {
-	oldSyncedProfiles := ei.syncedProfiles
-	ei.syncedProfiles = map[proto.ProfileID]bool{}
+func (p *Processor) syncRemovedProfiles(sub *subscription) {
+	oldSyncedProfiles := sub.syncedProfiles
+	sub.syncedProfiles = map[proto.ProfileID]bool{}
 
-	ei.iterateProfiles(func(pId proto.ProfileID) bool {
+	sub.iterateProfiles(func(pId proto.ProfileID) bool {
 		if !oldSyncedProfiles[pId] {
 			// We've never sent this profile?
 			return false
@@ -444,78 +689,84 @@ func (p *Processor) syncRemovedProfiles(ei *EndpointInfo) {
 
 		// Still an active profile, remove it from the old set.
 		delete(oldSyncedProfiles, pId)
-		ei.syncedProfiles[pId] = true
+		sub.syncedProfiles[pId] = true
 		return false
 	})
 
-	// oldSyncedProfiles now contains only policies that are no longer needed by this endpoint.
-	for polID := range oldSyncedProfiles {
-		ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_ActiveProfileRemove{
-			&proto.ActiveProfileRemove{Id: &polID},
-		}}
+	// oldSyncedProfiles now contains only policies that are no longer needed by this subscription's endpoints.
+	for profID := range oldSyncedProfiles {
+		// Copy the ID; the queued message may outlive this iteration.
+		id := profID
+		sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_ActiveProfileRemove{
+			&proto.ActiveProfileRemove{Id: &id},
+		}})
 	}
 }
 
-// sendServiceAccounts sends all known ServiceAccounts to the endpoint
-func (p *Processor) sendServiceAccounts(ei *EndpointInfo) {
+// sendServiceAccounts sends all known ServiceAccounts to the subscription's client.
+func (p *Processor) sendServiceAccounts(sub *subscription) {
 	for _, update := range p.serviceAccountByID {
 		log.WithFields(log.Fields{
 			"serviceAccount": update.Id,
-			"endpoint":       ei.endpointUpd.GetEndpoint(),
+			"joinUID":        sub.joinUID,
 		}).Debug("sending ServiceAccountUpdate")
-		ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_ServiceAccountUpdate{update}}
+		sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_ServiceAccountUpdate{update}})
 	}
 }
 
-// sendNamespaces sends all known Namespaces to the endpoint
-func (p *Processor) sendNamespaces(ei *EndpointInfo) {
+// sendNamespaces sends all known Namespaces to the subscription's client.
+func (p *Processor) sendNamespaces(sub *subscription) {
 	for _, update := range p.namespaceByID {
 		log.WithFields(log.Fields{
 			"namespace": update.Id,
-			"endpoint":  ei.endpointUpd.GetEndpoint(),
+			"joinUID":   sub.joinUID,
 		}).Debug("sending NamespaceUpdate")
-		ei.output <- proto.ToDataplane{Payload: &proto.ToDataplane_NamespaceUpdate{update}}
+		sub.send(proto.ToDataplane{Payload: &proto.ToDataplane_NamespaceUpdate{update}})
 	}
 }
 
-// A slice of all the Endpoints that can currently be sent updates.
-func (p *Processor) updateableEndpoints() []*EndpointInfo {
-	out := make([]*EndpointInfo, 0)
-	for _, ei := range p.endpointsByID {
-		if ei.output != nil {
-			out = append(out, ei)
+// A slice of all the subscriptions that can currently be sent updates.
+func (p *Processor) activeSubscriptions() []*subscription {
+	out := make([]*subscription, 0)
+	for sub := range p.subscriptions {
+		if sub.output != nil {
+			out = append(out, sub)
 		}
 	}
 	return out
 }
 
-// Perform the action on every policy on the Endpoint, breaking if the action returns true.
-func (ei *EndpointInfo) iteratePolicies(action func(id proto.PolicyID) (stop bool)) {
+// Perform the action on every policy of the subscription's endpoints, breaking if the action returns true.
+func (sub *subscription) iteratePolicies(action func(id proto.PolicyID) (stop bool)) {
 	var pId proto.PolicyID
-	for _, tier := range ei.endpointUpd.GetEndpoint().GetTiers() {
-		pId.Tier = tier.Name
-		for _, name := range tier.GetIngressPolicies() {
-			pId.Name = name
-			if action(pId) {
-				return
+	for _, ei := range sub.endpoints {
+		for _, tier := range ei.endpointUpd.GetEndpoint().GetTiers() {
+			pId.Tier = tier.Name
+			for _, name := range tier.GetIngressPolicies() {
+				pId.Name = name
+				if action(pId) {
+					return
+				}
 			}
-		}
-		for _, name := range tier.GetEgressPolicies() {
-			pId.Name = name
-			if action(pId) {
-				return
+			for _, name := range tier.GetEgressPolicies() {
+				pId.Name = name
+				if action(pId) {
+					return
+				}
 			}
 		}
 	}
 }
 
-// Perform the action on every profile on the Endpoint, breaking if the action returns true.
-func (ei *EndpointInfo) iterateProfiles(action func(id proto.ProfileID) (stop bool)) {
+// Perform the action on every profile of the subscription's endpoints, breaking if the action returns true.
+func (sub *subscription) iterateProfiles(action func(id proto.ProfileID) (stop bool)) {
 	var pId proto.ProfileID
-	for _, name := range ei.endpointUpd.GetEndpoint().GetProfileIds() {
-		pId.Name = name
-		if action(pId) {
-			return
+	for _, ei := range sub.endpoints {
+		for _, name := range ei.endpointUpd.GetEndpoint().GetProfileIds() {
+			pId.Name = name
+			if action(pId) {
+				return
+			}
 		}
 	}
 }
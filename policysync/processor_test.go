@@ -35,7 +35,7 @@ var _ = Describe("Processor", func() {
 
 	BeforeEach(func() {
 		updates = make(chan interface{})
-		uut = policysync.NewProcessor(updates)
+		uut = policysync.NewProcessor(updates, 100)
 
 		updateServiceAccount = func(name, namespace string) {
 			msg := &proto.ServiceAccountUpdate{
@@ -65,7 +65,7 @@ var _ = Describe("Processor", func() {
 			// Buffer outputs so that Processor won't block.
 			output := make(chan proto.ToDataplane, 100)
 			joinMeta := policysync.JoinMetadata{
-				EndpointID: testId(w),
+				EndpointIDs: []proto.WorkloadEndpointID{testId(w)},
 			}
 			jr := policysync.JoinRequest{JoinMetadata: joinMeta, C: output}
 			uut.JoinUpdates <- jr
@@ -73,6 +73,92 @@ var _ = Describe("Processor", func() {
 		}
 	})
 
+	Describe("with a slow client", func() {
+		var output chan proto.ToDataplane
+		var polID proto.PolicyID
+		var updatePolicy func(action string)
+
+		BeforeEach(func() {
+			uut = policysync.NewProcessor(updates, 3)
+			uut.Start()
+
+			polID = proto.PolicyID{Tier: "default", Name: "pol1"}
+			updatePolicy = func(action string) {
+				updates <- &proto.ActivePolicyUpdate{
+					Id:     &polID,
+					Policy: &proto.Policy{InboundRules: []*proto.Rule{{Action: action}}},
+				}
+			}
+
+			// The client doesn't read from its channel until the test tells it to.
+			output = make(chan proto.ToDataplane)
+			uut.JoinUpdates <- policysync.JoinRequest{
+				JoinMetadata: policysync.JoinMetadata{EndpointIDs: []proto.WorkloadEndpointID{testId("test")}, JoinUID: 1},
+				C:            output,
+			}
+			updatePolicy("allow")
+			id := testId("test")
+			updates <- &proto.WorkloadEndpointUpdate{
+				Id: &id,
+				Endpoint: &proto.WorkloadEndpoint{
+					Tiers: []*proto.TierInfo{{Name: "default", IngressPolicies: []string{"pol1"}}},
+				},
+			}
+		})
+
+		It("should coalesce superseded updates", func() {
+			updatePolicy("deny")
+			updatePolicy("pass")
+			// Processing of the last update is complete once the Processor accepts another.
+			updates <- &proto.ConfigUpdate{}
+
+			var actions []string
+			for len(actions) == 0 || actions[len(actions)-1] != "pass" {
+				msg := <-output
+				if pol := msg.GetActivePolicyUpdate(); pol != nil {
+					actions = append(actions, pol.Policy.InboundRules[0].Action)
+				}
+			}
+			// The first update may already have been in flight but the second must have
+			// been superseded.
+			Expect(actions).NotTo(ContainElement("deny"))
+			Expect(len(actions)).To(BeNumerically("<=", 2))
+		})
+
+		It("should disconnect the client when it falls too far behind", func() {
+			for i := 0; i < 5; i++ {
+				updateNamespace(fmt.Sprintf("ns%d", i))
+			}
+			updates <- &proto.ConfigUpdate{}
+
+			// The client may get the update that was in flight but then its channel is closed.
+			received := 0
+			Eventually(func() bool {
+				_, ok := <-output
+				if ok {
+					received++
+				}
+				return ok
+			}).Should(BeFalse())
+			Expect(received).To(BeNumerically("<=", 1))
+		})
+
+		It("should resync the client when it rejoins", func() {
+			for i := 0; i < 5; i++ {
+				updateNamespace(fmt.Sprintf("ns%d", i))
+			}
+			updates <- &proto.ConfigUpdate{}
+			for range output {
+			}
+
+			output, _ = join("test")
+			msg := <-output
+			Expect(msg.GetActivePolicyUpdate().GetId()).To(Equal(&polID))
+			msg = <-output
+			Expect(msg.GetWorkloadEndpointUpdate()).NotTo(BeNil())
+		})
+	})
+
 	Context("with Processor started", func() {
 
 		BeforeEach(func() {
@@ -293,6 +379,233 @@ var _ = Describe("Processor", func() {
 
 			})
 		})
+
+		Describe("IP set update/remove", func() {
+			var output chan proto.ToDataplane
+			var polID proto.PolicyID
+			var updatePolicy func(ipSetIDs ...string)
+
+			BeforeEach(func() {
+				polID = proto.PolicyID{Tier: "default", Name: "pol1"}
+				updatePolicy = func(ipSetIDs ...string) {
+					updates <- &proto.ActivePolicyUpdate{
+						Id: &polID,
+						Policy: &proto.Policy{
+							InboundRules: []*proto.Rule{{Action: "allow", SrcIpSetIds: ipSetIDs}},
+						},
+					}
+				}
+				updates <- &proto.IPSetUpdate{
+					Id:      "set1",
+					Members: []string{"10.0.0.1"},
+					Type:    proto.IPSetUpdate_IP,
+				}
+				updates <- &proto.IPSetUpdate{
+					Id:      "set2",
+					Members: []string{"10.0.0.2"},
+					Type:    proto.IPSetUpdate_IP,
+				}
+				updates <- &proto.IPSetDeltaUpdate{
+					Id:           "set1",
+					AddedMembers: []string{"10.0.0.3"},
+				}
+				updatePolicy("set1")
+				id := testId("test")
+				updates <- &proto.WorkloadEndpointUpdate{
+					Id: &id,
+					Endpoint: &proto.WorkloadEndpoint{
+						Tiers: []*proto.TierInfo{{Name: "default", IngressPolicies: []string{"pol1"}}},
+					},
+				}
+				output, _ = join("test")
+			})
+
+			It("should send the referenced IP set before the policy on join", func() {
+				msg := <-output
+				Expect(msg.GetIpsetUpdate().GetId()).To(Equal("set1"))
+				Expect(msg.GetIpsetUpdate().GetMembers()).To(ConsistOf("10.0.0.1", "10.0.0.3"))
+				msg = <-output
+				Expect(msg.GetActivePolicyUpdate().GetId()).To(Equal(&polID))
+				msg = <-output
+				Expect(msg.GetWorkloadEndpointUpdate()).NotTo(BeNil())
+			})
+
+			Context("after the join", func() {
+				BeforeEach(func() {
+					for i := 0; i < 3; i++ {
+						<-output
+					}
+				})
+
+				It("should forward deltas for referenced IP sets only", func() {
+					updates <- &proto.IPSetDeltaUpdate{Id: "set2", AddedMembers: []string{"10.0.0.4"}}
+					updates <- &proto.IPSetDeltaUpdate{Id: "set1", RemovedMembers: []string{"10.0.0.1"}}
+					msg := <-output
+					Expect(msg.GetIpsetDeltaUpdate().GetId()).To(Equal("set1"))
+					Expect(msg.GetIpsetDeltaUpdate().GetRemovedMembers()).To(ConsistOf("10.0.0.1"))
+				})
+
+				It("should swap IP sets when the policy changes", func() {
+					updatePolicy("set2")
+					msg := <-output
+					Expect(msg.GetIpsetUpdate().GetId()).To(Equal("set2"))
+					msg = <-output
+					Expect(msg.GetActivePolicyUpdate().GetId()).To(Equal(&polID))
+					msg = <-output
+					Expect(msg.GetIpsetRemove().GetId()).To(Equal("set1"))
+				})
+
+				It("should remove the IP set when the policy is removed", func() {
+					updates <- &proto.ActivePolicyRemove{Id: &polID}
+					msg := <-output
+					Expect(msg.GetActivePolicyRemove().GetId()).To(Equal(&polID))
+					msg = <-output
+					Expect(msg.GetIpsetRemove().GetId()).To(Equal("set1"))
+				})
+			})
+		})
+
+		Describe("with a join for an endpoint that doesn't exist yet", func() {
+			var output chan proto.ToDataplane
+			var epID proto.WorkloadEndpointID
+
+			BeforeEach(func() {
+				epID = testId("precreated")
+				output = make(chan proto.ToDataplane, 100)
+				uut.JoinUpdates <- policysync.JoinRequest{
+					JoinMetadata: policysync.JoinMetadata{
+						EndpointIDs: []proto.WorkloadEndpointID{epID},
+						JoinUID:     1,
+					},
+					C: output,
+				}
+			})
+
+			It("should send the endpoint to a client that rejoins before the old leave", func() {
+				output2 := make(chan proto.ToDataplane, 100)
+				uut.JoinUpdates <- policysync.JoinRequest{
+					JoinMetadata: policysync.JoinMetadata{
+						EndpointIDs: []proto.WorkloadEndpointID{epID},
+						JoinUID:     2,
+					},
+					C: output2,
+				}
+				Eventually(output).Should(BeClosed())
+
+				updates <- &proto.WorkloadEndpointUpdate{Id: &epID, Endpoint: &proto.WorkloadEndpoint{}}
+				msg := <-output2
+				Expect(msg.GetWorkloadEndpointUpdate().GetId()).To(Equal(&epID))
+
+				// The old connection's leave arrives late and mustn't affect the new one.
+				uut.JoinUpdates <- policysync.LeaveRequest{JoinMetadata: policysync.JoinMetadata{
+					EndpointIDs: []proto.WorkloadEndpointID{epID},
+					JoinUID:     1,
+				}}
+				updateNamespace("ns1")
+				msg = <-output2
+				Expect(msg.GetNamespaceUpdate()).NotTo(BeNil())
+			})
+		})
+
+		Describe("with a join for several endpoints", func() {
+			var output chan proto.ToDataplane
+			var eth0, eth1 proto.WorkloadEndpointID
+			var pol1, pol2 proto.PolicyID
+			var updateEndpoint func(id proto.WorkloadEndpointID, policies ...string)
+
+			BeforeEach(func() {
+				eth0 = testId("multi")
+				eth0.EndpointId = "eth0"
+				eth1 = testId("multi")
+				eth1.EndpointId = "eth1"
+				pol1 = proto.PolicyID{Tier: "default", Name: "pol1"}
+				pol2 = proto.PolicyID{Tier: "default", Name: "pol2"}
+				updateEndpoint = func(id proto.WorkloadEndpointID, policies ...string) {
+					updates <- &proto.WorkloadEndpointUpdate{
+						Id: &id,
+						Endpoint: &proto.WorkloadEndpoint{
+							Tiers: []*proto.TierInfo{{Name: "default", IngressPolicies: policies}},
+						},
+					}
+				}
+
+				updates <- &proto.ActivePolicyUpdate{Id: &pol1, Policy: &proto.Policy{}}
+				updates <- &proto.ActivePolicyUpdate{Id: &pol2, Policy: &proto.Policy{}}
+				updateEndpoint(eth0, "pol1")
+				updateEndpoint(eth1, "pol1", "pol2")
+
+				output = make(chan proto.ToDataplane, 100)
+				uut.JoinUpdates <- policysync.JoinRequest{
+					JoinMetadata: policysync.JoinMetadata{
+						EndpointIDs: []proto.WorkloadEndpointID{eth0, eth1},
+						JoinUID:     5,
+					},
+					C: output,
+				}
+			})
+
+			It("should send the union of the endpoints' policies, then the endpoints", func() {
+				msg := <-output
+				Expect(msg.GetActivePolicyUpdate().GetId()).To(Equal(&pol1))
+				msg = <-output
+				Expect(msg.GetActivePolicyUpdate().GetId()).To(Equal(&pol2))
+				msg = <-output
+				Expect(msg.GetWorkloadEndpointUpdate().GetId()).To(Equal(&eth0))
+				msg = <-output
+				Expect(msg.GetWorkloadEndpointUpdate().GetId()).To(Equal(&eth1))
+			})
+
+			Context("after the join", func() {
+				BeforeEach(func() {
+					for i := 0; i < 4; i++ {
+						<-output
+					}
+				})
+
+				It("should only remove a policy once no endpoint uses it", func() {
+					updateEndpoint(eth1, "pol1")
+					msg := <-output
+					Expect(msg.GetWorkloadEndpointUpdate().GetId()).To(Equal(&eth1))
+					msg = <-output
+					Expect(msg.GetActivePolicyRemove().GetId()).To(Equal(&pol2))
+
+					updateEndpoint(eth0)
+					updateNamespace("ns1")
+					msg = <-output
+					Expect(msg.GetWorkloadEndpointUpdate().GetId()).To(Equal(&eth0))
+					msg = <-output
+					Expect(msg.GetNamespaceUpdate()).NotTo(BeNil())
+				})
+
+				It("should only close the connection once all the endpoints are removed", func() {
+					updates <- &proto.WorkloadEndpointRemove{Id: &eth0}
+					updateNamespace("ns1")
+					msg := <-output
+					Expect(msg.GetWorkloadEndpointRemove().GetId()).To(Equal(&eth0))
+					msg = <-output
+					Expect(msg.GetNamespaceUpdate()).NotTo(BeNil())
+
+					updates <- &proto.WorkloadEndpointRemove{Id: &eth1}
+					msg = <-output
+					Expect(msg.GetWorkloadEndpointRemove().GetId()).To(Equal(&eth1))
+					Eventually(output).Should(BeClosed())
+				})
+
+				It("should close the connection when another client joins one of its endpoints", func() {
+					join2 := make(chan proto.ToDataplane, 100)
+					uut.JoinUpdates <- policysync.JoinRequest{
+						JoinMetadata: policysync.JoinMetadata{
+							EndpointIDs: []proto.WorkloadEndpointID{eth1},
+							JoinUID:     6,
+						},
+						C: join2,
+					}
+					Eventually(output).Should(BeClosed())
+					msg := <-join2
+					Expect(msg.GetActivePolicyUpdate().GetId()).To(Equal(&pol1))
+				})
+			})
+		})
 	})
 })
 
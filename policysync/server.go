@@ -16,9 +16,11 @@ package policysync
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
 
 	"github.com/projectcalico/felix/binder"
 	"github.com/projectcalico/felix/proto"
@@ -27,7 +29,9 @@ import (
 )
 
 const (
-	SockName       = "/policysync.sock"
+	SockName = "/policysync.sock"
+	// OrchestratorId and EndpointId are the defaults for credentials that don't specify the
+	// orchestrator or endpoints; that is, a Kubernetes pod with a single interface.
 	OrchestratorId = "k8s"
 	EndpointId     = "eth0"
 )
@@ -37,13 +41,17 @@ const (
 // credentials present in the gRPC request.
 type Server struct {
 	JoinUpdates chan<- interface{}
-	nextJoinUID func() uint64
+	// StatusUpdates, if non-nil, receives a *proto.PolicySyncStatusUpdate for each endpoint
+	// whenever a client of SyncWithAcks reports (or clears) an error.
+	StatusUpdates chan<- interface{}
+	nextJoinUID   func() uint64
 }
 
-func NewServer(joins chan<- interface{}, allocUID func() uint64) *Server {
+func NewServer(joins chan<- interface{}, statusUpdates chan<- interface{}, allocUID func() uint64) *Server {
 	return &Server{
-		JoinUpdates: joins,
-		nextJoinUID: allocUID,
+		JoinUpdates:   joins,
+		StatusUpdates: statusUpdates,
+		nextJoinUID:   allocUID,
 	}
 }
 
@@ -52,38 +60,70 @@ func (s *Server) RegisterGrpc(g *grpc.Server) {
 	proto.RegisterPolicySyncServer(g, s)
 }
 
-func (s *Server) Sync(_ *proto.SyncRequest, stream proto.PolicySync_SyncServer) error {
+// updateStream is the part of the PolicySync_SyncServer and PolicySync_SyncWithAcksServer
+// interfaces that we need to send updates.
+type updateStream interface {
+	Context() context.Context
+	Send(*proto.ToDataplane) error
+}
+
+func (s *Server) Sync(req *proto.SyncRequest, stream proto.PolicySync_SyncServer) error {
+	return s.sync(req, stream, nil)
+}
+
+func (s *Server) SyncWithAcks(stream proto.PolicySync_SyncWithAcksServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	req := first.GetSyncRequest()
+	if req == nil {
+		return errors.New("first message on the stream must be a SyncRequest")
+	}
+	return s.sync(req, stream, stream)
+}
+
+// sync subscribes to the processor's updates for the requested endpoints and sends them to
+// the client until either side disconnects.  If acks is non-nil, it tracks the client's
+// acknowledgements in the background.
+func (s *Server) sync(req *proto.SyncRequest, stream updateStream, acks proto.PolicySync_SyncWithAcksServer) error {
 	log.Info("New policy sync connection")
 
-	// Extract the workload ID from the request.
+	// Extract the workload's identity from the credentials and check that the client is allowed
+	// to subscribe to the endpoints that it asked for.
 	cxt := stream.Context()
 	creds, ok := binder.CallerFromContext(cxt)
 	if !ok {
 		return errors.New("unable to authenticate client")
 	}
-	// TODO Ensure names are correctly handled/namespaced
-	workloadID := creds.Namespace + "/" + creds.Workload
+	epIDs, err := EndpointIDsForRequest(creds, req)
+	if err != nil {
+		log.WithError(err).WithField("creds", creds).Warn("Rejecting policy sync connection")
+		return err
+	}
 
 	// Allocate a new unique join ID, this allows the processor to disambiguate if there are multiple connections
 	// for the same workload, which can happen transiently over client restart.  In particular, if our "leave"
 	// request races with the "join" request of the new connection.
 	myJoinUID := s.nextJoinUID()
 	logCxt := log.WithFields(log.Fields{
-		"workload": workloadID,
-		"joinID":   myJoinUID,
+		"workload":  epIDs[0].WorkloadId,
+		"endpoints": epIDs,
+		"joinID":    myJoinUID,
 	})
 	logCxt.Info("New policy sync connection identified")
 
+	var tracker *ackTracker
+	if acks != nil {
+		tracker = newAckTracker(epIDs, s.StatusUpdates, logCxt)
+		go tracker.readAcks(acks)
+	}
+
 	// Send a join request to the processor to ask it to start sending us updates.
 	updates := make(chan proto.ToDataplane)
-	epID := proto.WorkloadEndpointID{
-		OrchestratorId: OrchestratorId,
-		EndpointId:     EndpointId,
-		WorkloadId:     workloadID,
-	}
 	joinMeta := JoinMetadata{
-		EndpointID: epID,
-		JoinUID:    myJoinUID,
+		EndpointIDs: epIDs,
+		JoinUID:     myJoinUID,
 	}
 	s.JoinUpdates <- JoinRequest{
 		JoinMetadata: joinMeta,
@@ -96,7 +136,7 @@ func (s *Server) Sync(_ *proto.SyncRequest, stream proto.PolicySync_SyncServer)
 		joinsCopy := s.JoinUpdates
 		leaveRequest := LeaveRequest{JoinMetadata: joinMeta}
 		// Since the processor closes the update channel, we need to keep draining the updates channel to avoid
-		// blocking the processor.
+		// leaking the goroutine that feeds it from our queue in the processor.
 		//
 		// We also need to send the processor a leave request to ask it to stop sending updates.
 		//
@@ -117,7 +157,13 @@ func (s *Server) Sync(_ *proto.SyncRequest, stream proto.PolicySync_SyncServer)
 		logCxt.Info("Finished shutting down policy sync connection")
 	}()
 
+	var seqNo uint64
 	for update := range updates {
+		seqNo++
+		update.SequenceNumber = seqNo
+		if tracker != nil {
+			tracker.onSent(seqNo)
+		}
 		err := stream.Send(&update)
 		if err != nil {
 			logCxt.WithError(err).Warn("Failed to send update to policy sync client")
@@ -128,6 +174,58 @@ func (s *Server) Sync(_ *proto.SyncRequest, stream proto.PolicySync_SyncServer)
 	return nil
 }
 
+// EndpointIDsForRequest returns the IDs of the endpoints that the sync request subscribes to.
+// It returns an error if the request asks for a workload or endpoint that the credentials
+// don't allow.
+func EndpointIDsForRequest(creds binder.Credentials, req *proto.SyncRequest) ([]proto.WorkloadEndpointID, error) {
+	orchestratorID := creds.OrchestratorID
+	if orchestratorID == "" {
+		orchestratorID = OrchestratorId
+	}
+	workloadID := creds.WorkloadID
+	if workloadID == "" {
+		// TODO Ensure names are correctly handled/namespaced
+		workloadID = creds.Namespace + "/" + creds.Workload
+	}
+	if req.OrchestratorId != "" && req.OrchestratorId != orchestratorID {
+		return nil, fmt.Errorf("not authorized for orchestrator %q", req.OrchestratorId)
+	}
+	if req.WorkloadId != "" && req.WorkloadId != workloadID {
+		return nil, fmt.Errorf("not authorized for workload %q", req.WorkloadId)
+	}
+
+	allowed := creds.EndpointIDs
+	if len(allowed) == 0 {
+		allowed = []string{EndpointId}
+	}
+	requested := req.EndpointIds
+	if len(requested) == 0 {
+		requested = allowed
+	}
+
+	var epIDs []proto.WorkloadEndpointID
+	for _, endpointID := range requested {
+		if !stringInSlice(endpointID, allowed) {
+			return nil, fmt.Errorf("not authorized for endpoint %q", endpointID)
+		}
+		epIDs = append(epIDs, proto.WorkloadEndpointID{
+			OrchestratorId: orchestratorID,
+			WorkloadId:     workloadID,
+			EndpointId:     endpointID,
+		})
+	}
+	return epIDs, nil
+}
+
+func stringInSlice(s string, slice []string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 type UIDAllocator struct {
 	l       sync.Mutex
 	nextUID uint64
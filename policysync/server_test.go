@@ -0,0 +1,73 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/binder"
+	"github.com/projectcalico/felix/policysync"
+	"github.com/projectcalico/felix/proto"
+)
+
+var k8sCreds = binder.Credentials{Namespace: "ns1", Workload: "pod1"}
+
+var vmCreds = binder.Credentials{
+	OrchestratorID: "openstack",
+	WorkloadID:     "vm1",
+	EndpointIDs:    []string{"tap1", "tap2"},
+}
+
+func k8sID(endpointID string) proto.WorkloadEndpointID {
+	return proto.WorkloadEndpointID{OrchestratorId: "k8s", WorkloadId: "ns1/pod1", EndpointId: endpointID}
+}
+
+func vmID(endpointID string) proto.WorkloadEndpointID {
+	return proto.WorkloadEndpointID{OrchestratorId: "openstack", WorkloadId: "vm1", EndpointId: endpointID}
+}
+
+var _ = DescribeTable("EndpointIDsForRequest",
+	func(creds binder.Credentials, req *proto.SyncRequest, expected []proto.WorkloadEndpointID, expectErr bool) {
+		epIDs, err := policysync.EndpointIDsForRequest(creds, req)
+		if expectErr {
+			Expect(err).To(HaveOccurred())
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(epIDs).To(Equal(expected))
+	},
+	Entry("k8s pod, empty request", k8sCreds, &proto.SyncRequest{},
+		[]proto.WorkloadEndpointID{k8sID("eth0")}, false),
+	Entry("k8s pod, fully specified request", k8sCreds,
+		&proto.SyncRequest{OrchestratorId: "k8s", WorkloadId: "ns1/pod1", EndpointIds: []string{"eth0"}},
+		[]proto.WorkloadEndpointID{k8sID("eth0")}, false),
+	Entry("k8s pod, other endpoint", k8sCreds,
+		&proto.SyncRequest{EndpointIds: []string{"eth1"}}, nil, true),
+	Entry("k8s pod, other workload", k8sCreds,
+		&proto.SyncRequest{WorkloadId: "ns1/pod2"}, nil, true),
+	Entry("k8s pod, other orchestrator", k8sCreds,
+		&proto.SyncRequest{OrchestratorId: "openstack"}, nil, true),
+	Entry("VM, empty request", vmCreds, &proto.SyncRequest{},
+		[]proto.WorkloadEndpointID{vmID("tap1"), vmID("tap2")}, false),
+	Entry("VM, subset of endpoints", vmCreds,
+		&proto.SyncRequest{EndpointIds: []string{"tap2"}},
+		[]proto.WorkloadEndpointID{vmID("tap2")}, false),
+	Entry("VM, unauthorized endpoint", vmCreds,
+		&proto.SyncRequest{EndpointIds: []string{"tap1", "tap3"}}, nil, true),
+	Entry("VM, k8s orchestrator", vmCreds,
+		&proto.SyncRequest{OrchestratorId: "k8s"}, nil, true),
+)
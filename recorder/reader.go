@@ -0,0 +1,114 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recorder
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+// Reader reads back a recording that was written by a Recorder.
+type Reader struct {
+	Header Header
+
+	dec *json.Decoder
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	reader := &Reader{
+		dec: json.NewDecoder(gz),
+	}
+	if err := reader.dec.Decode(&reader.Header); err != nil {
+		return nil, fmt.Errorf("failed to read recording header: %v", err)
+	}
+	if reader.Header.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported recording version %d", reader.Header.Version)
+	}
+	return reader, nil
+}
+
+// Next returns the next entry in the recording, or io.EOF at the end.  A recording that was
+// cut short, for example because Felix was killed, ends with io.ErrUnexpectedEOF.
+func (r *Reader) Next() (*Entry, error) {
+	var entry Entry
+	if err := r.dec.Decode(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// ParseUpdates parses the updates in the entry back into api.Updates.
+func (e *Entry) ParseUpdates() ([]api.Update, error) {
+	updates := make([]api.Update, 0, len(e.Updates))
+	for _, ru := range e.Updates {
+		key := model.KeyFromDefaultPath(ru.Key)
+		if key == nil {
+			return nil, fmt.Errorf("failed to parse key %q", ru.Key)
+		}
+		u := api.Update{
+			KVPair: model.KVPair{
+				Key:      key,
+				Revision: ru.Revision,
+			},
+			UpdateType: ru.UpdateType,
+		}
+		if ru.Value != nil {
+			value, err := model.ParseValue(key, ru.Value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse value for key %q: %v", ru.Key, err)
+			}
+			u.Value = value
+		}
+		updates = append(updates, u)
+	}
+	return updates, nil
+}
+
+// Replay sends the remaining entries in the recording to the given callbacks, calling
+// afterEach, if non-nil, after each one.
+func (r *Reader) Replay(callbacks api.SyncerCallbacks, afterEach func(*Entry) error) error {
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Status != nil {
+			callbacks.OnStatusUpdated(*entry.Status)
+		} else {
+			updates, err := entry.ParseUpdates()
+			if err != nil {
+				return err
+			}
+			callbacks.OnUpdates(updates)
+		}
+		if afterEach != nil {
+			if err := afterEach(entry); err != nil {
+				return err
+			}
+		}
+	}
+}
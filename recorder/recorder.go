@@ -0,0 +1,248 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package recorder records the stream of updates that the datastore syncer sends to the
+// calculation graph so that it can be replayed offline, for example by felix-replay.
+//
+// A recording is a gzipped stream of JSON objects, one per line.  The first line is a Header;
+// each following line is an Entry that holds either a sync status change or a batch of updates.
+// Keys are stored in their default datastore path form and values in their datastore encoding.
+package recorder
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+const FormatVersion = 1
+
+// Header is the first line of a recording.
+type Header struct {
+	Version      int       `json:"version"`
+	Hostname     string    `json:"hostname"`
+	FelixVersion string    `json:"felixVersion,omitempty"`
+	StartTime    time.Time `json:"startTime"`
+}
+
+// Entry is a single sync status change or batch of updates, as received from the syncer.
+type Entry struct {
+	Time    time.Time        `json:"t"`
+	Status  *api.SyncStatus  `json:"s,omitempty"`
+	Updates []RecordedUpdate `json:"u,omitempty"`
+}
+
+// RecordedUpdate is the serialized form of an api.Update.  Value is omitted for deletions.
+type RecordedUpdate struct {
+	Key        string          `json:"k"`
+	Value      json.RawMessage `json:"v,omitempty"`
+	Revision   string          `json:"r,omitempty"`
+	UpdateType api.UpdateType  `json:"t"`
+}
+
+// TimestampedPath inserts the time into the file name of path, before its extension, so that
+// each run of Felix writes a new recording rather than overwriting the last one.  For example,
+// "/tmp/syncer.gz" becomes "/tmp/syncer-20180102-150405.000.gz".
+func TimestampedPath(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + t.UTC().Format("20060102-150405.000") + ext
+}
+
+// Recorder is an api.SyncerCallbacks that writes each callback to a recording before passing
+// it on to the next stage.  It writes synchronously, on the syncer's goroutine.  Compressing
+// each entry separately would make the recording much bigger so, instead, it flushes the
+// recording periodically, on a background goroutine, so that the recording is still usable
+// (up to the last flush) if Felix is killed.
+type Recorder struct {
+	next api.SyncerCallbacks
+
+	// lock protects the writers, which are shared with the flushing goroutine.
+	lock   sync.Mutex
+	file   io.WriteCloser
+	buf    *bufio.Writer
+	gz     *gzip.Writer
+	enc    *json.Encoder
+	dirty  bool
+	failed bool
+
+	stopFlushing chan struct{}
+	flushingDone chan struct{}
+}
+
+// New creates a Recorder that writes to w and passes the callbacks on to next.  It flushes the
+// recording every flushInterval, and when it's closed.
+func New(
+	w io.WriteCloser,
+	hostname, felixVersion string,
+	flushInterval time.Duration,
+	next api.SyncerCallbacks,
+) (*Recorder, error) {
+	buf := bufio.NewWriter(w)
+	gz := gzip.NewWriter(buf)
+	r := &Recorder{
+		next:         next,
+		file:         w,
+		buf:          buf,
+		gz:           gz,
+		enc:          json.NewEncoder(gz),
+		stopFlushing: make(chan struct{}),
+		flushingDone: make(chan struct{}),
+	}
+	err := r.write(&Header{
+		Version:      FormatVersion,
+		Hostname:     hostname,
+		FelixVersion: felixVersion,
+		StartTime:    time.Now().UTC(),
+	})
+	if err == nil {
+		// Make sure that even an idle recording is readable.
+		err = r.flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	go r.loopFlushing(flushInterval)
+	return r, nil
+}
+
+func (r *Recorder) OnStatusUpdated(status api.SyncStatus) {
+	r.record(&Entry{Time: time.Now().UTC(), Status: &status})
+	r.next.OnStatusUpdated(status)
+}
+
+func (r *Recorder) OnUpdates(updates []api.Update) {
+	entry := &Entry{
+		Time:    time.Now().UTC(),
+		Updates: make([]RecordedUpdate, 0, len(updates)),
+	}
+	for _, u := range updates {
+		ru, err := serializeUpdate(u)
+		if err != nil {
+			log.WithError(err).WithField("key", u.Key).Warn("Failed to serialize update, not recording it")
+			continue
+		}
+		entry.Updates = append(entry.Updates, ru)
+	}
+	r.record(entry)
+	r.next.OnUpdates(updates)
+}
+
+// Close flushes the recording and closes the underlying file.
+func (r *Recorder) Close() error {
+	close(r.stopFlushing)
+	<-r.flushingDone
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.gz.Close(); err != nil {
+		r.file.Close()
+		return err
+	}
+	if err := r.buf.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+func (r *Recorder) record(entry *Entry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.failed {
+		return
+	}
+	if err := r.write(entry); err != nil {
+		r.onFailure(err)
+	}
+}
+
+func (r *Recorder) loopFlushing(interval time.Duration) {
+	defer close(r.flushingDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.lock.Lock()
+			if r.dirty && !r.failed {
+				if err := r.flush(); err != nil {
+					r.onFailure(err)
+				}
+			}
+			r.lock.Unlock()
+		case <-r.stopFlushing:
+			return
+		}
+	}
+}
+
+// onFailure disables the recording.  Recording is a debug aid so we don't want to take Felix
+// down.  Must be called with the lock held.
+func (r *Recorder) onFailure(err error) {
+	log.WithError(err).Error("Failed to write to syncer recording, disabling recording")
+	r.failed = true
+}
+
+// write encodes the object into the compressor.  Must be called with the lock held (or before
+// the flushing goroutine starts).
+func (r *Recorder) write(obj interface{}) error {
+	if err := r.enc.Encode(obj); err != nil {
+		return err
+	}
+	r.dirty = true
+	return nil
+}
+
+// flush writes out everything that's been written so far.  Must be called with the lock held
+// (or before the flushing goroutine starts).
+func (r *Recorder) flush() error {
+	if err := r.gz.Flush(); err != nil {
+		return err
+	}
+	if err := r.buf.Flush(); err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+func serializeUpdate(u api.Update) (RecordedUpdate, error) {
+	path, err := model.KeyToDefaultPath(u.Key)
+	if err != nil {
+		return RecordedUpdate{}, err
+	}
+	ru := RecordedUpdate{
+		Key:        path,
+		Revision:   u.Revision,
+		UpdateType: u.UpdateType,
+	}
+	if u.Value != nil {
+		value, err := model.SerializeValue(&u.KVPair)
+		if err != nil {
+			return RecordedUpdate{}, err
+		}
+		ru.Value = value
+	}
+	return ru, nil
+}
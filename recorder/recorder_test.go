@@ -0,0 +1,246 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recorder_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/recorder"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// nopCloser adds a no-op Close method to a bytes.Buffer so we can inspect it after the
+// recorder has closed it.
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// syncBuffer is a bytes.Buffer that can be read while the recorder is flushing to it in the
+// background.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Close() error { return nil }
+
+func (b *syncBuffer) Bytes() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// callbackRecorder is an api.SyncerCallbacks that remembers what it was called with.
+type callbackRecorder struct {
+	calls []interface{}
+}
+
+func (c *callbackRecorder) OnStatusUpdated(status api.SyncStatus) {
+	c.calls = append(c.calls, status)
+}
+
+func (c *callbackRecorder) OnUpdates(updates []api.Update) {
+	c.calls = append(c.calls, updates)
+}
+
+var (
+	wepKey = model.WorkloadEndpointKey{
+		Hostname:       "localhostname",
+		OrchestratorID: "orch",
+		WorkloadID:     "wl1",
+		EndpointID:     "ep1",
+	}
+	wep = &model.WorkloadEndpoint{
+		State:      "active",
+		Name:       "cali1234",
+		ProfileIDs: []string{"prof-1"},
+		IPv4Nets:   []net.IPNet{mustParseNet("10.0.0.1/32")},
+		Labels:     map[string]string{"app": "frontend"},
+	}
+	updates = []api.Update{
+		{
+			KVPair:     model.KVPair{Key: model.GlobalConfigKey{Name: "InterfacePrefix"}, Value: "cali", Revision: "1"},
+			UpdateType: api.UpdateTypeKVNew,
+		},
+		{
+			KVPair:     model.KVPair{Key: wepKey, Value: wep, Revision: "2"},
+			UpdateType: api.UpdateTypeKVNew,
+		},
+	}
+	deletion = []api.Update{
+		{
+			KVPair:     model.KVPair{Key: wepKey, Revision: "3"},
+			UpdateType: api.UpdateTypeKVDeleted,
+		},
+	}
+)
+
+func mustParseNet(n string) net.IPNet {
+	_, cidr, err := net.ParseCIDR(n)
+	if err != nil {
+		panic(err)
+	}
+	return *cidr
+}
+
+var _ = Describe("TimestampedPath", func() {
+	t := time.Date(2018, 1, 2, 15, 4, 5, 6000000, time.UTC)
+
+	It("should insert the time before the extension", func() {
+		Expect(recorder.TimestampedPath("/tmp/syncer.rec.gz", t)).To(Equal("/tmp/syncer.rec-20180102-150405.006.gz"))
+	})
+	It("should append the time if there's no extension", func() {
+		Expect(recorder.TimestampedPath("/tmp/syncer", t)).To(Equal("/tmp/syncer-20180102-150405.006"))
+	})
+})
+
+var _ = Describe("Recorder", func() {
+	var buf *syncBuffer
+	var next *callbackRecorder
+	var rec *recorder.Recorder
+
+	BeforeEach(func() {
+		buf = &syncBuffer{}
+		next = &callbackRecorder{}
+		var err error
+		rec, err = recorder.New(buf, "localhostname", "v1.2.3", 10*time.Millisecond, next)
+		Expect(err).NotTo(HaveOccurred())
+		rec.OnStatusUpdated(api.ResyncInProgress)
+		rec.OnUpdates(updates)
+		rec.OnStatusUpdated(api.InSync)
+		rec.OnUpdates(deletion)
+	})
+
+	It("should pass the callbacks on", func() {
+		Expect(next.calls).To(Equal([]interface{}{
+			api.ResyncInProgress,
+			updates,
+			api.InSync,
+			deletion,
+		}))
+		Expect(rec.Close()).To(Succeed())
+	})
+
+	It("should write a recording that replays the same callbacks", func() {
+		Expect(rec.Close()).To(Succeed())
+		reader, err := recorder.NewReader(bytes.NewReader(buf.Bytes()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reader.Header.Hostname).To(Equal("localhostname"))
+		Expect(reader.Header.FelixVersion).To(Equal("v1.2.3"))
+
+		replayed := &callbackRecorder{}
+		numEntries := 0
+		err = reader.Replay(replayed, func(entry *recorder.Entry) error {
+			Expect(entry.Time.IsZero()).To(BeFalse())
+			numEntries++
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(numEntries).To(Equal(4))
+		Expect(replayed.calls).To(Equal(next.calls))
+	})
+
+	It("should flush periodically so that a truncated recording can be read", func() {
+		// Deliberately don't close the recorder, as if Felix had been killed.
+		replayTruncated := func() []interface{} {
+			reader, err := recorder.NewReader(bytes.NewReader(buf.Bytes()))
+			Expect(err).NotTo(HaveOccurred())
+			replayed := &callbackRecorder{}
+			err = reader.Replay(replayed, nil)
+			Expect(err).To(Equal(io.ErrUnexpectedEOF))
+			return replayed.calls
+		}
+		Eventually(replayTruncated).Should(Equal(next.calls))
+		Expect(rec.Close()).To(Succeed())
+	})
+})
+
+var _ = Describe("ReplayThroughCalcGraph", func() {
+	It("should produce the calculation graph's output for each entry", func() {
+		buf := &bytes.Buffer{}
+		rec, err := recorder.New(nopCloser{buf}, "localhostname", "", time.Second, &callbackRecorder{})
+		Expect(err).NotTo(HaveOccurred())
+		rec.OnUpdates(updates)
+		rec.OnStatusUpdated(api.InSync)
+		rec.OnUpdates(deletion)
+		Expect(rec.Close()).To(Succeed())
+
+		reader, err := recorder.NewReader(buf)
+		Expect(err).NotTo(HaveOccurred())
+		conf := config.New()
+		conf.FelixHostname = reader.Header.Hostname
+		var outputs [][]interface{}
+		err = recorder.ReplayThroughCalcGraph(reader, conf, func(entry *recorder.Entry, msgs []interface{}) error {
+			outputs = append(outputs, msgs)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		wepID := proto.WorkloadEndpointID{OrchestratorId: "orch", WorkloadId: "wl1", EndpointId: "ep1"}
+		Expect(outputs).To(HaveLen(3))
+		Expect(endpointUpdateIDs(outputs[0])).To(Equal([]proto.WorkloadEndpointID{wepID}))
+		Expect(outputs[1]).To(ContainElement(Equal(&proto.InSync{})))
+		Expect(outputs[2]).To(ContainElement(Equal(&proto.WorkloadEndpointRemove{Id: &wepID})))
+	})
+})
+
+func endpointUpdateIDs(msgs []interface{}) (ids []proto.WorkloadEndpointID) {
+	for _, msg := range msgs {
+		if upd, ok := msg.(*proto.WorkloadEndpointUpdate); ok {
+			ids = append(ids, *upd.Id)
+		}
+	}
+	return
+}
+
+var _ = Describe("Canonicalise", func() {
+	It("should sort runs of messages of the same type and IP set members", func() {
+		msgs := []interface{}{
+			&proto.IPSetUpdate{Id: "s2", Members: []string{"10.0.0.2", "10.0.0.1"}},
+			&proto.IPSetUpdate{Id: "s1"},
+			&proto.ActivePolicyUpdate{Id: &proto.PolicyID{Tier: "default", Name: "b"}},
+			&proto.ActivePolicyUpdate{Id: &proto.PolicyID{Tier: "default", Name: "a"}},
+			&proto.IPSetRemove{Id: "s4"},
+			&proto.IPSetRemove{Id: "s3"},
+		}
+		recorder.Canonicalise(msgs)
+		Expect(msgs).To(Equal([]interface{}{
+			&proto.IPSetUpdate{Id: "s1"},
+			&proto.IPSetUpdate{Id: "s2", Members: []string{"10.0.0.1", "10.0.0.2"}},
+			&proto.ActivePolicyUpdate{Id: &proto.PolicyID{Tier: "default", Name: "a"}},
+			&proto.ActivePolicyUpdate{Id: &proto.PolicyID{Tier: "default", Name: "b"}},
+			&proto.IPSetRemove{Id: "s3"},
+			&proto.IPSetRemove{Id: "s4"},
+		}))
+	})
+})
@@ -0,0 +1,108 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recorder
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	pb "github.com/gogo/protobuf/proto"
+
+	"github.com/projectcalico/felix/calc"
+	"github.com/projectcalico/felix/config"
+	"github.com/projectcalico/felix/proto"
+)
+
+// endOfEntry is sent down the calculation graph's output channel, after the graph has flushed,
+// to mark the end of the output for a recorded entry.
+type endOfEntry struct{}
+
+// ReplayThroughCalcGraph feeds the remaining entries in the recording through a validation
+// filter and calculation graph, as Felix would, and calls emit with the messages that the graph
+// produced for each entry.
+//
+// The graph is flushed after every entry so the output only depends on the recording.  Within
+// the output for an entry, runs of messages of the same type are sorted, as are IP set members,
+// because the graph emits those in map order.  Together, these make the output reproducible so
+// that it can be diffed.
+func ReplayThroughCalcGraph(
+	r *Reader,
+	conf *config.Config,
+	emit func(entry *Entry, msgs []interface{}) error,
+) error {
+	outputChan := make(chan interface{})
+	asyncGraph := calc.NewAsyncCalcGraph(conf, []chan<- interface{}{outputChan}, nil)
+	validator := calc.NewValidationFilter(asyncGraph)
+	asyncGraph.Start()
+
+	entryOutputs := make(chan []interface{})
+	go func() {
+		var msgs []interface{}
+		for msg := range outputChan {
+			if _, ok := msg.(endOfEntry); ok {
+				entryOutputs <- msgs
+				msgs = nil
+				continue
+			}
+			msgs = append(msgs, msg)
+		}
+	}()
+
+	return r.Replay(validator, func(entry *Entry) error {
+		if err := asyncGraph.WaitForFlush(context.Background()); err != nil {
+			return err
+		}
+		// The graph has finished sending its output for this entry so our marker arrives
+		// after the last message.
+		outputChan <- endOfEntry{}
+		msgs := <-entryOutputs
+		Canonicalise(msgs)
+		return emit(entry, msgs)
+	})
+}
+
+// Canonicalise puts a batch of calculation graph output messages into a consistent order
+// without changing their meaning: runs of messages of the same type are sorted, along with the
+// members of IP set updates.
+func Canonicalise(msgs []interface{}) {
+	for _, msg := range msgs {
+		switch msg := msg.(type) {
+		case *proto.IPSetUpdate:
+			sort.Strings(msg.Members)
+		case *proto.IPSetDeltaUpdate:
+			sort.Strings(msg.AddedMembers)
+			sort.Strings(msg.RemovedMembers)
+		}
+	}
+	start := 0
+	for i := 1; i <= len(msgs); i++ {
+		if i < len(msgs) && reflect.TypeOf(msgs[i]) == reflect.TypeOf(msgs[start]) {
+			continue
+		}
+		run := msgs[start:i]
+		sort.SliceStable(run, func(a, b int) bool {
+			return sortKey(run[a]) < sortKey(run[b])
+		})
+		start = i
+	}
+}
+
+func sortKey(msg interface{}) string {
+	if m, ok := msg.(pb.Message); ok {
+		return pb.CompactTextString(m)
+	}
+	return ""
+}
@@ -35,6 +35,16 @@ import (
 const (
 	cleanupGracePeriod = 10 * time.Second
 	maxConnFailures    = 3
+
+	// InterfaceNone is the pseudo-interface name that is passed to SetRoutes to program routes
+	// that aren't scoped to an interface.  The kernel chooses the interface for such routes
+	// by looking up their next hop.
+	InterfaceNone = "*NoOIF*"
+
+	// ProtocolFelix is the routing protocol number that marks the routes that Felix owns in
+	// route tables that share the routing table with other programs (such as BIRD).  Such
+	// route tables only remove routes that have this protocol.
+	ProtocolFelix = 80
 )
 
 var (
@@ -62,9 +72,26 @@ func init() {
 	prometheus.MustRegister(listIfaceTime, perIfaceSyncTime)
 }
 
+type TargetType string
+
+const (
+	// TargetTypeLocal is a link-scoped route to a local workload; it is the default.
+	TargetTypeLocal TargetType = ""
+	// TargetTypeOnLink is a route via GW that is programmed with the onlink flag so the next
+	// hop doesn't need to be in a subnet of the interface; we use that to route via remote
+	// tunnel endpoints.
+	TargetTypeOnLink TargetType = "onlink"
+	// TargetTypeGateway is a route via GW that the kernel resolves to an interface.  It is
+	// only valid for InterfaceNone.
+	TargetTypeGateway TargetType = "gateway"
+)
+
 type Target struct {
+	Type    TargetType
 	CIDR    ip.CIDR
 	DestMAC net.HardwareAddr
+	// GW is the next hop for the route; required for TargetTypeOnLink and TargetTypeGateway.
+	GW ip.Addr
 }
 
 type RouteTable struct {
@@ -83,6 +110,13 @@ type RouteTable struct {
 
 	ifacePrefixes     set.Set
 	ifacePrefixRegexp *regexp.Regexp
+	// includeNoIface is set if the route table owns the routes for InterfaceNone.
+	includeNoIface bool
+
+	// removeExternalRoutes is true if the route table owns its interfaces outright and should
+	// remove any unexpected routes from them.  Otherwise, it only removes unexpected routes
+	// that have protocol ProtocolFelix and it programs its routes with that protocol.
+	removeExternalRoutes bool
 
 	ifaceNameToTargets        map[string][]Target
 	ifaceNameToFirstSeen      map[string]time.Time
@@ -100,10 +134,20 @@ type RouteTable struct {
 	time              timeIface
 }
 
-func New(interfacePrefixes []string, ipVersion uint8, netlinkTimeout time.Duration) *RouteTable {
+// New creates a route table for the interfaces with the given name prefixes.  The prefixes may
+// include InterfaceNone to give the route table ownership of routes that aren't scoped to an
+// interface.  If removeExternalRoutes is false, the route table only removes routes that it
+// programmed itself.
+func New(
+	interfacePrefixes []string,
+	ipVersion uint8,
+	netlinkTimeout time.Duration,
+	removeExternalRoutes bool,
+) *RouteTable {
 	return NewWithShims(
 		interfacePrefixes,
 		ipVersion,
+		removeExternalRoutes,
 		newNetlinkHandle,
 		netlinkTimeout,
 		addStaticARPEntry,
@@ -116,6 +160,7 @@ func New(interfacePrefixes []string, ipVersion uint8, netlinkTimeout time.Durati
 func NewWithShims(
 	interfacePrefixes []string,
 	ipVersion uint8,
+	removeExternalRoutes bool,
 	newNetlinkHandle func() (HandleIface, error),
 	netlinkTimeout time.Duration,
 	addStaticARPEntry func(cidr ip.CIDR, destMAC net.HardwareAddr, ifaceName string) error,
@@ -124,12 +169,21 @@ func NewWithShims(
 ) *RouteTable {
 	prefixSet := set.New()
 	regexpParts := []string{}
+	includeNoIface := false
 	for _, prefix := range interfacePrefixes {
+		if prefix == InterfaceNone {
+			includeNoIface = true
+			continue
+		}
 		prefixSet.Add(prefix)
 		regexpParts = append(regexpParts, "^"+prefix+".*")
 	}
 
 	ifaceNamePattern := strings.Join(regexpParts, "|")
+	if ifaceNamePattern == "" {
+		// No real interfaces; interface names are never empty so this matches nothing.
+		ifaceNamePattern = "^$"
+	}
 	log.WithField("regex", ifaceNamePattern).Info("Calculated interface name regexp")
 
 	family := netlink.FAMILY_V4
@@ -147,6 +201,8 @@ func NewWithShims(
 		netlinkFamily:             family,
 		ifacePrefixes:             prefixSet,
 		ifacePrefixRegexp:         regexp.MustCompile(ifaceNamePattern),
+		includeNoIface:            includeNoIface,
+		removeExternalRoutes:      removeExternalRoutes,
 		ifaceNameToTargets:        map[string][]Target{},
 		ifaceNameToFirstSeen:      map[string]time.Time{},
 		pendingIfaceNameToTargets: map[string][]Target{},
@@ -181,6 +237,9 @@ func (r *RouteTable) onIfaceSeen(ifaceName string) {
 }
 
 func (r *RouteTable) SetRoutes(ifaceName string, targets []Target) {
+	if ifaceName == InterfaceNone && !r.includeNoIface {
+		r.logCxt.Panic("SetRoutes called for InterfaceNone on a route table that doesn't own it")
+	}
 	r.pendingIfaceNameToTargets[ifaceName] = targets
 	r.dirtyIfaces.Add(ifaceName)
 }
@@ -260,6 +319,11 @@ func (r *RouteTable) Apply() error {
 				r.onIfaceSeen(ifaceName)
 			}
 		}
+		if r.includeNoIface {
+			// There's no interface to find for the routes without one; resync them every
+			// time so that we clean up any that we left behind.
+			r.dirtyIfaces.Add(InterfaceNone)
+		}
 		// Clean up first-seen timestamps for old interfaces.
 		// Resyncs happen periodically, so the amount of memory leaked to old
 		// first seen timestamps is small.
@@ -360,6 +424,10 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string) error {
 			r.ifaceNameToTargets[ifaceName] = updatedTargets
 		}
 		for _, target := range oldTargets {
+			if target.Type != TargetTypeLocal {
+				// Only workload routes need their conntrack entries cleaning up.
+				continue
+			}
 			oldCIDRs.Add(target.CIDR)
 		}
 		delete(r.pendingIfaceNameToTargets, ifaceName)
@@ -367,9 +435,13 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string) error {
 
 	expectedTargets := r.ifaceNameToTargets[ifaceName]
 	expectedCIDRs := set.New()
+	expectedGWs := map[ip.CIDR]ip.Addr{}
 	for _, t := range expectedTargets {
 		expectedCIDRs.Add(t.CIDR)
 		oldCIDRs.Discard(t.CIDR)
+		if t.GW != nil {
+			expectedGWs[t.CIDR] = t.GW
+		}
 	}
 	if r.ipVersion == 6 {
 		expectedCIDRs.Add(ipV6LinkLocalCIDR)
@@ -385,12 +457,16 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string) error {
 		return nil
 	})
 
-	// Try to get the link.  This may fail if it's been deleted out from under us.
 	nl, err := r.getNetlinkHandle()
 	if err != nil {
 		r.logCxt.WithError(err).Error("Failed to connect to netlink, retrying...")
 		return ConnectFailed
 	}
+	if ifaceName == InterfaceNone {
+		return r.syncRoutesWithoutIface(nl, expectedTargets, expectedGWs)
+	}
+
+	// Try to get the link.  This may fail if it's been deleted out from under us.
 	link, err := nl.LinkByName(ifaceName)
 	if err != nil {
 		// Filter the error so that we don't spam errors if the interface is being torn
@@ -432,12 +508,21 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string) error {
 			dest = ip.CIDRFromIPNet(route.Dst)
 		}
 		logCxt := logCxt.WithField("dest", dest)
-		seenCIDRs.Add(dest)
+		wrongGW := false
 		if expectedCIDRs.Contains(dest) {
-			logCxt.Debug("Syncing routes: Found expected route.")
+			if gw := expectedGWs[dest]; gw == nil || gw.AsNetIP().Equal(route.Gw) {
+				logCxt.Debug("Syncing routes: Found expected route.")
+				seenCIDRs.Add(dest)
+				continue
+			}
+			// The next hop has changed; remove the route so that we re-add it below.
+			logCxt.WithField("oldGW", route.Gw).Info("Syncing routes: route has wrong next hop.")
+			wrongGW = true
+		} else if !r.removeExternalRoutes && route.Protocol != ProtocolFelix {
+			logCxt.Debug("Syncing routes: ignoring unexpected route that we don't own.")
 			continue
 		}
-		if inGracePeriod {
+		if inGracePeriod && !wrongGW {
 			// Don't remove routes from interfaces created recently.
 			logCxt.Info("Syncing routes: found unexpected route; ignoring due to grace period.")
 			leaveDirty = true
@@ -450,8 +535,8 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string) error {
 				"Route deletion failed, assuming someone got there first.")
 			updatesFailed = true
 		}
-		if dest != nil {
-			// Collect any old route CIDRs that we find in the dataplane so we
+		if dest != nil && !wrongGW && route.Gw == nil {
+			// Collect any old workload route CIDRs that we find in the dataplane so we
 			// can remove their conntrack entries later.
 			oldCIDRs.Add(dest)
 		}
@@ -461,14 +546,8 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string) error {
 		if !seenCIDRs.Contains(cidr) {
 			logCxt := logCxt.WithField("targetCIDR", target.CIDR)
 			logCxt.Info("Syncing routes: adding new route.")
-			ipNet := cidr.ToIPNet()
-			route := netlink.Route{
-				LinkIndex: linkAttrs.Index,
-				Dst:       &ipNet,
-				Type:      syscall.RTN_UNICAST,
-				Protocol:  syscall.RTPROT_BOOT,
-				Scope:     netlink.SCOPE_LINK,
-			}
+			route := r.routeForTarget(target)
+			route.LinkIndex = linkAttrs.Index
 			// In case this IP is being re-used, wait for any previous conntrack entry
 			// to be cleaned up.  (No-op if there are no pending deletes.)
 			r.waitForPendingConntrackDeletion(cidr.Addr())
@@ -503,6 +582,97 @@ func (r *RouteTable) syncRoutesForLink(ifaceName string) error {
 	return nil
 }
 
+// syncRoutesWithoutIface syncs the routes for InterfaceNone.  Since those routes don't belong to
+// an interface, we find them by their protocol instead.
+func (r *RouteTable) syncRoutesWithoutIface(
+	nl HandleIface,
+	expectedTargets []Target,
+	expectedGWs map[ip.CIDR]ip.Addr,
+) error {
+	logCxt := r.logCxt.WithField("ifaceName", InterfaceNone)
+	oldRoutes, err := nl.RouteListFiltered(
+		r.netlinkFamily,
+		&netlink.Route{Protocol: ProtocolFelix},
+		netlink.RT_FILTER_PROTOCOL,
+	)
+	if err != nil {
+		logCxt.WithError(err).Error("Error listing routes")
+		r.closeNetlinkHandle() // Defensive: force a netlink reconnection next time.
+		return ListFailed
+	}
+
+	seenCIDRs := set.New()
+	updatesFailed := false
+	for _, route := range oldRoutes {
+		if route.Flags&int(netlink.FLAG_ONLINK) != 0 {
+			// Onlink routes belong to an interface-scoped route table.
+			continue
+		}
+		var dest ip.CIDR
+		if route.Dst != nil {
+			dest = ip.CIDRFromIPNet(route.Dst)
+		}
+		logCxt := logCxt.WithField("dest", dest)
+		if gw, ok := expectedGWs[dest]; ok && gw.AsNetIP().Equal(route.Gw) {
+			logCxt.Debug("Syncing routes: Found expected route.")
+			seenCIDRs.Add(dest)
+			continue
+		}
+		logCxt.Info("Syncing routes: removing old route.")
+		if err := nl.RouteDel(&route); err != nil {
+			logCxt.WithError(err).Warn("Route deletion failed")
+			updatesFailed = true
+		}
+	}
+	for _, target := range expectedTargets {
+		if seenCIDRs.Contains(target.CIDR) {
+			continue
+		}
+		logCxt := logCxt.WithField("targetCIDR", target.CIDR)
+		if target.Type != TargetTypeGateway || target.GW == nil {
+			logCxt.WithField("target", target).Warn("Ignoring invalid target for InterfaceNone")
+			continue
+		}
+		logCxt.Info("Syncing routes: adding new route.")
+		route := r.routeForTarget(target)
+		if err := nl.RouteAdd(&route); err != nil {
+			logCxt.WithError(err).Warn("Failed to add route")
+			updatesFailed = true
+		}
+	}
+
+	if updatesFailed {
+		r.closeNetlinkHandle() // Defensive: force a netlink reconnection next time.
+		return UpdateFailed
+	}
+	return nil
+}
+
+// routeForTarget returns the netlink route for the given target, without its link index.
+func (r *RouteTable) routeForTarget(target Target) netlink.Route {
+	ipNet := target.CIDR.ToIPNet()
+	route := netlink.Route{
+		Dst:      &ipNet,
+		Type:     syscall.RTN_UNICAST,
+		Protocol: syscall.RTPROT_BOOT,
+		Scope:    netlink.SCOPE_LINK,
+	}
+	if !r.removeExternalRoutes || target.Type == TargetTypeGateway {
+		// Mark the route so that we can tell it apart from routes that we don't own.
+		route.Protocol = ProtocolFelix
+	}
+	switch target.Type {
+	case TargetTypeOnLink:
+		route.Gw = target.GW.AsNetIP()
+		route.Flags = int(netlink.FLAG_ONLINK)
+		route.Scope = netlink.SCOPE_UNIVERSE
+	case TargetTypeGateway:
+		route.Gw = target.GW.AsNetIP()
+		route.Scope = netlink.SCOPE_UNIVERSE
+	}
+	return route
+}
+
 // startConntrackDeletion starts the deletion of conntrack entries for the given CIDR in the background.  Pending
 // deletions are tracked in the pendingConntrackCleanups map so we can block waiting for them later.
 //
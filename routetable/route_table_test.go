@@ -74,6 +74,7 @@ var _ = Describe("RouteTable", func() {
 		rt = NewWithShims(
 			[]string{"cali"},
 			4,
+			true,
 			dataplane.NewNetlinkHandle,
 			10*time.Second,
 			dataplane.AddStaticArpEntry,
@@ -154,6 +155,44 @@ var _ = Describe("RouteTable", func() {
 			))
 		})
 
+		Describe("with a route via a gateway", func() {
+			BeforeEach(func() {
+				rt.SetRoutes("cali1", []Target{
+					{
+						Type: TargetTypeOnLink,
+						CIDR: ip.MustParseCIDROrIP("10.1.0.0/26"),
+						GW:   ip.FromString("172.16.0.2"),
+					},
+				})
+				rt.Apply()
+			})
+			It("should add the route with the onlink flag", func() {
+				route := dataplane.routeKeyToRoute["1-10.1.0.0/26"]
+				Expect(route.Gw.Equal(net.ParseIP("172.16.0.2"))).To(BeTrue())
+				Expect(route.Flags).To(Equal(int(netlink.FLAG_ONLINK)))
+				Expect(route.Scope).To(Equal(netlink.SCOPE_UNIVERSE))
+			})
+			It("should replace the route if the gateway changes", func() {
+				rt.SetRoutes("cali1", []Target{
+					{
+						Type: TargetTypeOnLink,
+						CIDR: ip.MustParseCIDROrIP("10.1.0.0/26"),
+						GW:   ip.FromString("172.16.0.3"),
+					},
+				})
+				rt.Apply()
+				Expect(dataplane.deletedRouteKeys.Contains("1-10.1.0.0/26")).To(BeTrue())
+				route := dataplane.routeKeyToRoute["1-10.1.0.0/26"]
+				Expect(route.Gw.Equal(net.ParseIP("172.16.0.3"))).To(BeTrue())
+			})
+			It("should leave the route alone on resync if the gateway is correct", func() {
+				dataplane.deletedRouteKeys.Clear()
+				rt.QueueResync()
+				rt.Apply()
+				Expect(dataplane.deletedRouteKeys.Contains("1-10.1.0.0/26")).To(BeFalse())
+			})
+		})
+
 		Describe("with a slow conntrack deletion", func() {
 			const delay = 300 * time.Millisecond
 			BeforeEach(func() {
@@ -410,6 +449,125 @@ var _ = Describe("RouteTable", func() {
 			})
 		}
 	})
+
+	Describe("with a route table that doesn't own its routes outright", func() {
+		var eth0Route, birdRoute, staleTunlRoute, staleNoIfaceRoute netlink.Route
+		BeforeEach(func() {
+			rt = NewWithShims(
+				[]string{"tunl", InterfaceNone},
+				4,
+				false,
+				dataplane.NewNetlinkHandle,
+				10*time.Second,
+				dataplane.AddStaticArpEntry,
+				dataplane,
+				t,
+			)
+			eth0 := dataplane.addIface(4, "eth0", true, true)
+			tunl0 := dataplane.addIface(5, "tunl0", true, true)
+			eth0Route = netlink.Route{
+				LinkIndex: eth0.attrs.Index,
+				Dst:       mustParseCIDR("172.16.0.0/24"),
+				Type:      syscall.RTN_UNICAST,
+				Protocol:  syscall.RTPROT_BOOT,
+				Scope:     netlink.SCOPE_LINK,
+			}
+			dataplane.addMockRoute(&eth0Route)
+			birdRoute = netlink.Route{
+				LinkIndex: tunl0.attrs.Index,
+				Dst:       mustParseCIDR("10.2.0.0/26"),
+				Gw:        net.ParseIP("172.16.0.5"),
+				Type:      syscall.RTN_UNICAST,
+				Protocol:  12,
+				Scope:     netlink.SCOPE_UNIVERSE,
+				Flags:     int(netlink.FLAG_ONLINK),
+			}
+			dataplane.addMockRoute(&birdRoute)
+			staleTunlRoute = netlink.Route{
+				LinkIndex: tunl0.attrs.Index,
+				Dst:       mustParseCIDR("10.3.0.0/26"),
+				Gw:        net.ParseIP("172.16.0.6"),
+				Type:      syscall.RTN_UNICAST,
+				Protocol:  ProtocolFelix,
+				Scope:     netlink.SCOPE_UNIVERSE,
+				Flags:     int(netlink.FLAG_ONLINK),
+			}
+			dataplane.addMockRoute(&staleTunlRoute)
+			staleNoIfaceRoute = netlink.Route{
+				Dst:      mustParseCIDR("10.4.0.0/26"),
+				Gw:       net.ParseIP("172.16.0.7"),
+				Type:     syscall.RTN_UNICAST,
+				Protocol: ProtocolFelix,
+				Scope:    netlink.SCOPE_UNIVERSE,
+			}
+			dataplane.addMockRoute(&staleNoIfaceRoute)
+		})
+
+		It("should only remove the routes that it programmed", func() {
+			err := rt.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataplane.routeKeyToRoute).To(ConsistOf(eth0Route, birdRoute))
+		})
+		It("should add routes without an interface", func() {
+			rt.SetRoutes(InterfaceNone, []Target{{
+				Type: TargetTypeGateway,
+				CIDR: ip.MustParseCIDROrIP("10.5.0.0/26"),
+				GW:   ip.FromString("172.16.0.8"),
+			}})
+			err := rt.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			route := dataplane.routeKeyToRoute["0-10.5.0.0/26"]
+			Expect(route.Gw.Equal(net.ParseIP("172.16.0.8"))).To(BeTrue())
+			Expect(route.Protocol).To(Equal(ProtocolFelix))
+			Expect(route.Scope).To(Equal(netlink.SCOPE_UNIVERSE))
+			Expect(route.Flags).To(BeZero())
+		})
+		It("should keep its expected routes and mark new ones with its protocol", func() {
+			rt.SetRoutes("tunl0", []Target{
+				{
+					Type: TargetTypeOnLink,
+					CIDR: ip.MustParseCIDROrIP("10.3.0.0/26"),
+					GW:   ip.FromString("172.16.0.6"),
+				},
+				{
+					Type: TargetTypeOnLink,
+					CIDR: ip.MustParseCIDROrIP("10.6.0.0/26"),
+					GW:   ip.FromString("172.16.0.10"),
+				},
+			})
+			err := rt.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataplane.routeKeyToRoute).To(HaveLen(4))
+			Expect(dataplane.routeKeyToRoute).To(ContainElement(staleTunlRoute))
+			route := dataplane.routeKeyToRoute["5-10.6.0.0/26"]
+			Expect(route.Protocol).To(Equal(ProtocolFelix))
+			Expect(route.Flags).To(Equal(int(netlink.FLAG_ONLINK)))
+		})
+		It("should replace a route without an interface if its gateway changes", func() {
+			rt.SetRoutes(InterfaceNone, []Target{{
+				Type: TargetTypeGateway,
+				CIDR: ip.MustParseCIDROrIP("10.4.0.0/26"),
+				GW:   ip.FromString("172.16.0.9"),
+			}})
+			err := rt.Apply()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataplane.deletedRouteKeys.Contains("0-10.4.0.0/26")).To(BeTrue())
+			route := dataplane.routeKeyToRoute["0-10.4.0.0/26"]
+			Expect(route.Gw.Equal(net.ParseIP("172.16.0.9"))).To(BeTrue())
+		})
+		It("should remove routes without an interface when they're deleted", func() {
+			rt.SetRoutes(InterfaceNone, []Target{{
+				Type: TargetTypeGateway,
+				CIDR: ip.MustParseCIDROrIP("10.4.0.0/26"),
+				GW:   ip.FromString("172.16.0.7"),
+			}})
+			Expect(rt.Apply()).NotTo(HaveOccurred())
+			Expect(dataplane.routeKeyToRoute).To(ContainElement(staleNoIfaceRoute))
+			rt.SetRoutes(InterfaceNone, nil)
+			Expect(rt.Apply()).NotTo(HaveOccurred())
+			Expect(dataplane.routeKeyToRoute).To(ConsistOf(eth0Route, birdRoute))
+		})
+	})
 })
 
 var _ = Describe("Tests to verify netlink interface", func() {
@@ -601,6 +759,21 @@ func (d *mockDataplane) RouteList(link netlink.Link, family int) ([]netlink.Rout
 	return routes, nil
 }
 
+func (d *mockDataplane) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	Expect(d.NetlinkOpen).To(BeTrue())
+	if d.shouldFail(failNextRouteList) {
+		return nil, simulatedError
+	}
+	var routes []netlink.Route
+	for _, route := range d.routeKeyToRoute {
+		if filterMask&netlink.RT_FILTER_PROTOCOL != 0 && route.Protocol != filter.Protocol {
+			continue
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
 func (d *mockDataplane) addMockRoute(route *netlink.Route) {
 	key := keyForRoute(route)
 	d.routeKeyToRoute[key] = *route
@@ -261,11 +261,7 @@ func (r *DefaultRuleRenderer) endpointIptablesChain(
 
 	if !adminUp {
 		// Endpoint is admin-down, drop all traffic to/from it.
-		rules = append(rules, Rule{
-			Match:   Match(),
-			Action:  DropAction{},
-			Comment: "Endpoint admin disabled",
-		})
+		rules = append(rules, r.endpointDropRules(Match(), "Endpoint admin disabled", name, policyPrefix)...)
 		return &Chain{
 			Name:  chainName,
 			Rules: rules,
@@ -338,11 +334,12 @@ func (r *DefaultRuleRenderer) endpointIptablesChain(
 			//
 			// For untracked and pre-DNAT rules, we don't do that because there may be
 			// normal rules still to be applied to the packet in the filter table.
-			rules = append(rules, Rule{
-				Match:   Match().MarkClear(r.IptablesMarkPass),
-				Action:  DropAction{},
-				Comment: "Drop if no policies passed packet",
-			})
+			rules = append(rules, r.endpointDropRules(
+				Match().MarkClear(r.IptablesMarkPass),
+				"Drop if no policies passed packet",
+				name,
+				policyPrefix,
+			)...)
 		}
 	}
 
@@ -366,11 +363,7 @@ func (r *DefaultRuleRenderer) endpointIptablesChain(
 		//
 		// For untracked rules, we don't do that because there may be tracked rules
 		// still to be applied to the packet in the filter table.
-		rules = append(rules, Rule{
-			Match:   Match(),
-			Action:  DropAction{},
-			Comment: "Drop if no profiles matched",
-		})
+		rules = append(rules, r.endpointDropRules(Match(), "Drop if no profiles matched", name, policyPrefix)...)
 	}
 
 	return &Chain{
@@ -379,6 +372,40 @@ func (r *DefaultRuleRenderer) endpointIptablesChain(
 	}
 }
 
+// endpointDropRules returns the rule that drops packets that reach the end of an endpoint
+// chain's policies or profiles.  If flow logs are enabled, it's preceded by a rule that logs the
+// packet to the flow log collector.
+func (r *DefaultRuleRenderer) endpointDropRules(
+	match MatchCriteria,
+	comment string,
+	ifaceName string,
+	policyPrefix PolicyChainNamePrefix,
+) []Rule {
+	var rules []Rule
+	if r.FlowLogsEnabled {
+		direction := FlowLogDirOutbound
+		if policyPrefix == PolicyInboundPfx {
+			direction = FlowLogDirInbound
+		}
+		rules = append(rules, Rule{
+			Match: match,
+			Action: NflogAction{
+				Group: r.FlowLogsNflogGroup,
+				Prefix: FlowLogPrefix{
+					Action:    FlowLogActionDeny,
+					Direction: direction,
+					Owner:     EndpointFlowLogOwner(ifaceName),
+				}.String(),
+			},
+		})
+	}
+	return append(rules, Rule{
+		Match:   match,
+		Action:  DropAction{},
+		Comment: comment,
+	})
+}
+
 func (r *DefaultRuleRenderer) appendConntrackRules(rules []Rule, allowAction Action) []Rule {
 	// Allow return packets for established connections.
 	if allowAction != (AcceptAction{}) {
@@ -0,0 +1,163 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+)
+
+// When flow logs are enabled, we add an NFLOG action in front of each rule that allows or
+// denies traffic, and in front of the endpoint chains' default drop rules.  The NFLOG prefix
+// tells the flow log collector which rule the packet hit.  Its format is
+//
+//     <action><direction>|<rule ID>|<owner>
+//
+// where action is 'A' (allow) or 'D' (deny), direction is 'I' (inbound) or 'O' (outbound), the
+// rule ID is the proto.Rule's RuleId (empty for the default drop rules) and the owner is the
+// policy ("pol:<tier>/<name>"), profile ("pro:<name>") or, for default drop rules, endpoint
+// ("ep:<interface>") that contains the rule.
+//
+// The kernel limits the prefix to 64 bytes, including the terminating NUL, so long owner names
+// are truncated.
+const (
+	MaxFlowLogPrefixLen = 63
+
+	flowLogOwnerPolicyPfx   = "pol:"
+	flowLogOwnerProfilePfx  = "pro:"
+	flowLogOwnerEndpointPfx = "ep:"
+)
+
+type FlowLogAction byte
+
+const (
+	FlowLogActionAllow FlowLogAction = 'A'
+	FlowLogActionDeny  FlowLogAction = 'D'
+)
+
+func (a FlowLogAction) String() string {
+	switch a {
+	case FlowLogActionAllow:
+		return "allow"
+	case FlowLogActionDeny:
+		return "deny"
+	}
+	return "unknown"
+}
+
+type FlowLogDirection byte
+
+const (
+	FlowLogDirInbound  FlowLogDirection = 'I'
+	FlowLogDirOutbound FlowLogDirection = 'O'
+)
+
+func (d FlowLogDirection) String() string {
+	switch d {
+	case FlowLogDirInbound:
+		return "inbound"
+	case FlowLogDirOutbound:
+		return "outbound"
+	}
+	return "unknown"
+}
+
+// FlowLogPrefix is the parsed form of a flow log NFLOG prefix.
+type FlowLogPrefix struct {
+	Action    FlowLogAction
+	Direction FlowLogDirection
+	RuleID    string
+	Owner     string
+}
+
+func (p FlowLogPrefix) String() string {
+	s := string([]byte{byte(p.Action), byte(p.Direction)}) + "|" + p.RuleID + "|" + p.Owner
+	if len(s) > MaxFlowLogPrefixLen {
+		s = s[:MaxFlowLogPrefixLen]
+	}
+	return s
+}
+
+var ErrBadFlowLogPrefix = errors.New("not a flow log prefix")
+
+// ParseFlowLogPrefix parses an NFLOG prefix that was rendered by FlowLogPrefix.String().
+func ParseFlowLogPrefix(s string) (FlowLogPrefix, error) {
+	parts := strings.SplitN(s, "|", 3)
+	if len(parts) != 3 || len(parts[0]) != 2 {
+		return FlowLogPrefix{}, ErrBadFlowLogPrefix
+	}
+	p := FlowLogPrefix{
+		Action:    FlowLogAction(parts[0][0]),
+		Direction: FlowLogDirection(parts[0][1]),
+		RuleID:    parts[1],
+		Owner:     parts[2],
+	}
+	if p.Action != FlowLogActionAllow && p.Action != FlowLogActionDeny {
+		return FlowLogPrefix{}, ErrBadFlowLogPrefix
+	}
+	if p.Direction != FlowLogDirInbound && p.Direction != FlowLogDirOutbound {
+		return FlowLogPrefix{}, ErrBadFlowLogPrefix
+	}
+	return p, nil
+}
+
+func PolicyFlowLogOwner(id *proto.PolicyID) string {
+	return flowLogOwnerPolicyPfx + id.Tier + "/" + id.Name
+}
+
+func ProfileFlowLogOwner(id *proto.ProfileID) string {
+	return flowLogOwnerProfilePfx + id.Name
+}
+
+func EndpointFlowLogOwner(ifaceName string) string {
+	return flowLogOwnerEndpointPfx + ifaceName
+}
+
+// flowLogContext identifies the chain that we're rendering rules into, for use in flow log
+// prefixes.  A nil *flowLogContext disables flow logs for the rules.
+type flowLogContext struct {
+	Owner     string
+	Direction FlowLogDirection
+}
+
+// flowLogAction returns the NFLOG action to add in front of the given rule action, or nil if
+// flow logs are disabled or the rule action doesn't allow or deny traffic.
+func (r *DefaultRuleRenderer) flowLogAction(ruleAction string, ruleID string, flowLog *flowLogContext) iptables.Action {
+	if !r.FlowLogsEnabled || flowLog == nil {
+		return nil
+	}
+	var action FlowLogAction
+	switch ruleAction {
+	case "", "allow":
+		action = FlowLogActionAllow
+	case "deny":
+		action = FlowLogActionDeny
+	default:
+		// Pass and log rules don't decide the fate of the packet.
+		return nil
+	}
+	return iptables.NflogAction{
+		Group: r.FlowLogsNflogGroup,
+		Prefix: FlowLogPrefix{
+			Action:    action,
+			Direction: flowLog.Direction,
+			RuleID:    ruleID,
+			Owner:     flowLog.Owner,
+		}.String(),
+	}
+}
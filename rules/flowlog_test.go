@@ -0,0 +1,201 @@
+// Copyright (c) 2018 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	"strings"
+
+	. "github.com/projectcalico/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/ipsets"
+	. "github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = DescribeTable("Flow log prefix round-trip",
+	func(prefix FlowLogPrefix, expRendering string) {
+		Expect(prefix.String()).To(Equal(expRendering))
+		parsed, err := ParseFlowLogPrefix(expRendering)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed).To(Equal(prefix))
+	},
+	Entry("policy allow",
+		FlowLogPrefix{
+			Action:    FlowLogActionAllow,
+			Direction: FlowLogDirInbound,
+			RuleID:    "0123456789abcdef",
+			Owner:     PolicyFlowLogOwner(&proto.PolicyID{Tier: "default", Name: "foo"}),
+		},
+		"AI|0123456789abcdef|pol:default/foo"),
+	Entry("profile deny",
+		FlowLogPrefix{
+			Action:    FlowLogActionDeny,
+			Direction: FlowLogDirOutbound,
+			RuleID:    "0123456789abcdef",
+			Owner:     ProfileFlowLogOwner(&proto.ProfileID{Name: "kns.default"}),
+		},
+		"DO|0123456789abcdef|pro:kns.default"),
+	Entry("endpoint default drop",
+		FlowLogPrefix{
+			Action:    FlowLogActionDeny,
+			Direction: FlowLogDirInbound,
+			Owner:     EndpointFlowLogOwner("cali1234"),
+		},
+		"DI||ep:cali1234"),
+)
+
+var _ = Describe("Flow log prefixes", func() {
+	It("should truncate long owners", func() {
+		prefix := FlowLogPrefix{
+			Action:    FlowLogActionAllow,
+			Direction: FlowLogDirInbound,
+			RuleID:    "0123456789abcdef",
+			Owner:     PolicyFlowLogOwner(&proto.PolicyID{Tier: "default", Name: strings.Repeat("x", 100)}),
+		}.String()
+		Expect(prefix).To(HaveLen(MaxFlowLogPrefixLen))
+		parsed, err := ParseFlowLogPrefix(prefix)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.RuleID).To(Equal("0123456789abcdef"))
+		Expect(parsed.Owner).To(HavePrefix("pol:default/xxx"))
+	})
+
+	DescribeTable("should reject bad prefixes",
+		func(prefix string) {
+			_, err := ParseFlowLogPrefix(prefix)
+			Expect(err).To(Equal(ErrBadFlowLogPrefix))
+		},
+		Entry("empty", ""),
+		Entry("LOG prefix", "calico-packet: "),
+		Entry("bad action", "XI|id|pol:default/foo"),
+		Entry("bad direction", "AX|id|pol:default/foo"),
+		Entry("missing owner", "AI|id"),
+	)
+})
+
+var _ = Describe("Flow log rendering", func() {
+	var renderer RuleRenderer
+	var epMarkMapper EndpointMarkMapper
+
+	BeforeEach(func() {
+		config := Config{
+			IPSetConfigV4:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+			IPSetConfigV6:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+			IptablesMarkAccept:   0x8,
+			IptablesMarkPass:     0x10,
+			IptablesMarkScratch0: 0x20,
+			IptablesMarkScratch1: 0x40,
+			IptablesMarkEndpoint: 0xff00,
+			FlowLogsEnabled:      true,
+			FlowLogsNflogGroup:   20,
+		}
+		renderer = NewRenderer(config)
+		epMarkMapper = NewEndpointMarkMapper(config.IptablesMarkEndpoint, config.IptablesMarkNonCaliEndpoint)
+	})
+
+	It("should log allow and deny rules in policies", func() {
+		chains := renderer.PolicyToIptablesChains(
+			&proto.PolicyID{Tier: "default", Name: "foo"},
+			&proto.Policy{
+				InboundRules: []*proto.Rule{
+					{Action: "allow", RuleId: "rule-allow"},
+					{Action: "pass", RuleId: "rule-pass"},
+					{Action: "log", RuleId: "rule-log"},
+				},
+				OutboundRules: []*proto.Rule{
+					{Action: "deny", RuleId: "rule-deny"},
+				},
+			},
+			4,
+		)
+		Expect(chains).To(Equal([]*Chain{
+			{
+				Name: "cali-pi-foo",
+				Rules: []Rule{
+					{Match: Match(), Action: SetMarkAction{Mark: 0x8}},
+					{
+						Match:  Match().MarkSingleBitSet(0x8),
+						Action: NflogAction{Group: 20, Prefix: "AI|rule-allow|pol:default/foo"},
+					},
+					{Match: Match().MarkSingleBitSet(0x8), Action: ReturnAction{}},
+					{Match: Match(), Action: SetMarkAction{Mark: 0x10}},
+					{Match: Match().MarkSingleBitSet(0x10), Action: ReturnAction{}},
+					{Match: Match(), Action: LogAction{}},
+				},
+			},
+			{
+				Name: "cali-po-foo",
+				Rules: []Rule{
+					{Match: Match(), Action: NflogAction{Group: 20, Prefix: "DO|rule-deny|pol:default/foo"}},
+					{Match: Match(), Action: DropAction{}},
+				},
+			},
+		}))
+	})
+
+	It("should log allow rules in profiles", func() {
+		chains := renderer.ProfileToIptablesChains(
+			&proto.ProfileID{Name: "prof"},
+			&proto.Profile{
+				OutboundRules: []*proto.Rule{{Action: "allow", RuleId: "rule-allow"}},
+			},
+			4,
+		)
+		Expect(chains[1].Rules).To(ContainElement(Rule{
+			Match:  Match().MarkSingleBitSet(0x8),
+			Action: NflogAction{Group: 20, Prefix: "AO|rule-allow|pro:prof"},
+		}))
+	})
+
+	It("should not log rules rendered outside a policy or profile", func() {
+		rules := renderer.ProtoRuleToIptablesRules(&proto.Rule{Action: "deny", RuleId: "rule-deny"}, 4)
+		Expect(rules).To(Equal([]Rule{{Match: Match(), Action: DropAction{}}}))
+	})
+
+	It("should log the endpoint chains' default drops", func() {
+		chains := renderer.WorkloadEndpointToIptablesChains(
+			"cali1234", epMarkMapper,
+			true,
+			[]string{"ai"},
+			[]string{"ae"},
+			[]string{"prof1"},
+		)
+		Expect(chains[0].Name).To(Equal("cali-tw-cali1234"))
+		Expect(chains[0].Rules).To(ContainElement(Rule{
+			Match:  Match().MarkClear(0x10),
+			Action: NflogAction{Group: 20, Prefix: "DI||ep:cali1234"},
+		}))
+		Expect(chains[0].Rules[len(chains[0].Rules)-2:]).To(Equal([]Rule{
+			{Match: Match(), Action: NflogAction{Group: 20, Prefix: "DI||ep:cali1234"}},
+			{Match: Match(), Action: DropAction{}, Comment: "Drop if no profiles matched"},
+		}))
+		Expect(chains[1].Name).To(Equal("cali-fw-cali1234"))
+		Expect(chains[1].Rules[len(chains[1].Rules)-2:]).To(Equal([]Rule{
+			{Match: Match(), Action: NflogAction{Group: 20, Prefix: "DO||ep:cali1234"}},
+			{Match: Match(), Action: DropAction{}, Comment: "Drop if no profiles matched"},
+		}))
+	})
+
+	It("should log drops from admin down endpoints", func() {
+		chains := renderer.WorkloadEndpointToIptablesChains("cali1234", epMarkMapper, false, nil, nil, nil)
+		Expect(chains[0].Rules).To(Equal([]Rule{
+			{Match: Match(), Action: NflogAction{Group: 20, Prefix: "DI||ep:cali1234"}},
+			{Match: Match(), Action: DropAction{}, Comment: "Endpoint admin disabled"},
+		}))
+	})
+})
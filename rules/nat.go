@@ -26,14 +26,23 @@ func (r *DefaultRuleRenderer) NATOutgoingChain(natOutgoingActive bool, ipVersion
 		ipConf := r.ipSetConfig(ipVersion)
 		allIPsSetName := ipConf.NameForMainIPSet(IPSetIDNATOutgoingAllPools)
 		masqIPsSetName := ipConf.NameForMainIPSet(IPSetIDNATOutgoingMasqPools)
-		rules = []iptables.Rule{
-			{
-				Action: iptables.MasqAction{},
+		if ipVersion == 6 && r.IPIPEnabledV6 {
+			// Traffic that we send down the IPv6 tunnel to another Calico host, for
+			// example to its tunnel address, needs to keep the workload's source IP.
+			// Other traffic that leaves via the tunnel device is NATted as normal.
+			rules = append(rules, iptables.Rule{
 				Match: iptables.Match().
-					SourceIPSet(masqIPsSetName).
-					NotDestIPSet(allIPsSetName),
-			},
+					OutInterface(IPIPIfaceNameV6).
+					DestIPSet(ipConf.NameForMainIPSet(IPSetIDAllHostIPs)),
+				Action: iptables.ReturnAction{},
+			})
 		}
+		rules = append(rules, iptables.Rule{
+			Action: iptables.MasqAction{},
+			Match: iptables.Match().
+				SourceIPSet(masqIPsSetName).
+				NotDestIPSet(allIPsSetName),
+		})
 	}
 	return &iptables.Chain{
 		Name:  ChainNATOutgoing,
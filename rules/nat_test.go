@@ -61,4 +61,35 @@ var _ = Describe("NAT", func() {
 			Rules: nil,
 		}))
 	})
+
+	Describe("with IPv6 IPIP enabled", func() {
+		BeforeEach(func() {
+			conf := rrConfigNormal
+			conf.IPIPEnabledV6 = true
+			renderer = NewRenderer(conf)
+		})
+
+		It("should only exclude IPv6 tunnel traffic to other hosts", func() {
+			Expect(renderer.NATOutgoingChain(true, 6)).To(Equal(&Chain{
+				Name: "cali-nat-outgoing",
+				Rules: []Rule{
+					{
+						Match: Match().
+							OutInterface("ip6tnl0").
+							DestIPSet("cali60all-hosts"),
+						Action: ReturnAction{},
+					},
+					{
+						Action: MasqAction{},
+						Match: Match().
+							SourceIPSet("cali60masq-ipam-pools").
+							NotDestIPSet("cali60all-ipam-pools"),
+					},
+				},
+			}))
+		})
+		It("should leave IPv4 unchanged", func() {
+			Expect(renderer.NATOutgoingChain(true, 4).Rules).To(HaveLen(1))
+		})
+	})
 })
@@ -29,37 +29,81 @@ import (
 // ruleRenderer defined in rules_defs.go.
 
 func (r *DefaultRuleRenderer) PolicyToIptablesChains(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) []*iptables.Chain {
-	inbound := iptables.Chain{
-		Name:  PolicyChainName(PolicyInboundPfx, policyID),
-		Rules: r.ProtoRulesToIptablesRules(policy.InboundRules, ipVersion),
-	}
-	outbound := iptables.Chain{
-		Name:  PolicyChainName(PolicyOutboundPfx, policyID),
-		Rules: r.ProtoRulesToIptablesRules(policy.OutboundRules, ipVersion),
+	chains, _, _ := r.PolicyToIptablesChainsWithHitIndexes(policyID, policy, ipVersion)
+	return chains
+}
+
+// PolicyToIptablesChainsWithHitIndexes renders the policy's chains, like PolicyToIptablesChains.
+// It also returns, for each of the policy's inbound and outbound rules, the index of the hit rule
+// in the corresponding chain.  The packet and byte counters of the hit rule count the traffic
+// that matched the policy rule.  Rules that aren't rendered for the given IP version have index
+// -1.
+func (r *DefaultRuleRenderer) PolicyToIptablesChainsWithHitIndexes(
+	policyID *proto.PolicyID,
+	policy *proto.Policy,
+	ipVersion uint8,
+) (chains []*iptables.Chain, inbound, outbound []int) {
+	owner := PolicyFlowLogOwner(policyID)
+	inRules, inbound := r.protoRulesToIptablesRulesWithHitIndexes(policy.InboundRules, ipVersion, &flowLogContext{owner, FlowLogDirInbound})
+	outRules, outbound := r.protoRulesToIptablesRulesWithHitIndexes(policy.OutboundRules, ipVersion, &flowLogContext{owner, FlowLogDirOutbound})
+	chains = []*iptables.Chain{
+		{Name: PolicyChainName(PolicyInboundPfx, policyID), Rules: inRules},
+		{Name: PolicyChainName(PolicyOutboundPfx, policyID), Rules: outRules},
 	}
-	return []*iptables.Chain{&inbound, &outbound}
+	return
 }
 
 func (r *DefaultRuleRenderer) ProfileToIptablesChains(profileID *proto.ProfileID, profile *proto.Profile, ipVersion uint8) []*iptables.Chain {
-	inbound := iptables.Chain{
-		Name:  ProfileChainName(ProfileInboundPfx, profileID),
-		Rules: r.ProtoRulesToIptablesRules(profile.InboundRules, ipVersion),
-	}
-	outbound := iptables.Chain{
-		Name:  ProfileChainName(ProfileOutboundPfx, profileID),
-		Rules: r.ProtoRulesToIptablesRules(profile.OutboundRules, ipVersion),
+	chains, _, _ := r.ProfileToIptablesChainsWithHitIndexes(profileID, profile, ipVersion)
+	return chains
+}
+
+// ProfileToIptablesChainsWithHitIndexes is the profile equivalent of
+// PolicyToIptablesChainsWithHitIndexes.
+func (r *DefaultRuleRenderer) ProfileToIptablesChainsWithHitIndexes(
+	profileID *proto.ProfileID,
+	profile *proto.Profile,
+	ipVersion uint8,
+) (chains []*iptables.Chain, inbound, outbound []int) {
+	owner := ProfileFlowLogOwner(profileID)
+	inRules, inbound := r.protoRulesToIptablesRulesWithHitIndexes(profile.InboundRules, ipVersion, &flowLogContext{owner, FlowLogDirInbound})
+	outRules, outbound := r.protoRulesToIptablesRulesWithHitIndexes(profile.OutboundRules, ipVersion, &flowLogContext{owner, FlowLogDirOutbound})
+	chains = []*iptables.Chain{
+		{Name: ProfileChainName(ProfileInboundPfx, profileID), Rules: inRules},
+		{Name: ProfileChainName(ProfileOutboundPfx, profileID), Rules: outRules},
 	}
-	return []*iptables.Chain{&inbound, &outbound}
+	return
 }
 
 func (r *DefaultRuleRenderer) ProtoRulesToIptablesRules(protoRules []*proto.Rule, ipVersion uint8) []iptables.Rule {
-	var rules []iptables.Rule
-	for _, protoRule := range protoRules {
-		rules = append(rules, r.ProtoRuleToIptablesRules(protoRule, ipVersion)...)
-	}
+	return r.protoRulesToIptablesRules(protoRules, ipVersion, nil)
+}
+
+func (r *DefaultRuleRenderer) protoRulesToIptablesRules(protoRules []*proto.Rule, ipVersion uint8, flowLog *flowLogContext) []iptables.Rule {
+	rules, _ := r.protoRulesToIptablesRulesWithHitIndexes(protoRules, ipVersion, flowLog)
 	return rules
 }
 
+// protoRulesToIptablesRulesWithHitIndexes renders the rules and returns the index of each
+// proto.Rule's hit rule in the result, or -1 if the rule was skipped.
+func (r *DefaultRuleRenderer) protoRulesToIptablesRulesWithHitIndexes(
+	protoRules []*proto.Rule,
+	ipVersion uint8,
+	flowLog *flowLogContext,
+) (rules []iptables.Rule, hitIndexes []int) {
+	hitIndexes = make([]int, len(protoRules))
+	for i, protoRule := range protoRules {
+		rs, hitIdx := r.renderProtoRule(protoRule, ipVersion, flowLog)
+		if hitIdx < 0 {
+			hitIndexes[i] = -1
+		} else {
+			hitIndexes[i] = len(rules) + hitIdx
+		}
+		rules = append(rules, rs...)
+	}
+	return
+}
+
 func filterNets(mixedCIDRs []string, ipVersion uint8) (filtered []string, filteredAll bool) {
 	if len(mixedCIDRs) == 0 {
 		return nil, false
@@ -78,6 +122,19 @@ func filterNets(mixedCIDRs []string, ipVersion uint8) (filtered []string, filter
 }
 
 func (r *DefaultRuleRenderer) ProtoRuleToIptablesRules(pRule *proto.Rule, ipVersion uint8) []iptables.Rule {
+	return r.protoRuleToIptablesRules(pRule, ipVersion, nil)
+}
+
+func (r *DefaultRuleRenderer) protoRuleToIptablesRules(pRule *proto.Rule, ipVersion uint8, flowLog *flowLogContext) []iptables.Rule {
+	rs, _ := r.renderProtoRule(pRule, ipVersion, flowLog)
+	return rs
+}
+
+// renderProtoRule renders the iptables rules for a single proto.Rule.  It also returns the index
+// of the "hit" rule; the first iptables rule that applies the complete match criteria, whose
+// packet counter therefore counts the packets that hit the proto.Rule.  The hit index is -1 if
+// the rule was skipped.
+func (r *DefaultRuleRenderer) renderProtoRule(pRule *proto.Rule, ipVersion uint8, flowLog *flowLogContext) (rs []iptables.Rule, hitIdx int) {
 	// Filter the CIDRs to the IP version that we're rendering.  In general, we should have an
 	// explicit IP version in the rule and all CIDRs should match it (and calicoctl, for
 	// example, enforces that).  However, we try to handle a rule gracefully if it's missing a
@@ -92,23 +149,27 @@ func (r *DefaultRuleRenderer) ProtoRuleToIptablesRules(pRule *proto.Rule, ipVers
 	// It also handles rules like "allow from 10.0.0.1,feed::beef" in an intuitive way.  Only
 	// rules of the form "allow from 10.0.0.1,feed::beef to 10.0.0.2" will get filtered out,
 	// and only for IPv6, where there's no obvious meaning to the rule.
+	if r.skipForHTTPMatch(pRule) {
+		return nil, -1
+	}
+
 	ruleCopy := *pRule
 	var filteredAll bool
 	ruleCopy.SrcNet, filteredAll = filterNets(pRule.SrcNet, ipVersion)
 	if filteredAll {
-		return nil
+		return nil, -1
 	}
 	ruleCopy.NotSrcNet, filteredAll = filterNets(pRule.NotSrcNet, ipVersion)
 	if filteredAll {
-		return nil
+		return nil, -1
 	}
 	ruleCopy.DstNet, filteredAll = filterNets(pRule.DstNet, ipVersion)
 	if filteredAll {
-		return nil
+		return nil, -1
 	}
 	ruleCopy.NotDstNet, filteredAll = filterNets(pRule.NotDstNet, ipVersion)
 	if filteredAll {
-		return nil
+		return nil, -1
 	}
 
 	// There are a few areas where our data model doesn't fit with iptables, requiring us to
@@ -236,7 +297,7 @@ func (r *DefaultRuleRenderer) ProtoRuleToIptablesRules(pRule *proto.Rule, ipVers
 	match, err := r.CalculateRuleMatch(&ruleCopy, ipVersion)
 	if err == SkipRule {
 		logCxt.Debug("Rule skipped.")
-		return nil
+		return nil, -1
 	}
 	if matchBlockBuilder.UsingMatchBlocks {
 		// The CIDR or port matches in the rule overflowed and we rendered them
@@ -245,7 +306,14 @@ func (r *DefaultRuleRenderer) ProtoRuleToIptablesRules(pRule *proto.Rule, ipVers
 		match = match.MarkSingleBitSet(matchBlockBuilder.markAllBlocksPass)
 	}
 	markBit, actions := r.CalculateActions(&ruleCopy, ipVersion)
-	rs := matchBlockBuilder.Rules
+	if nflog := r.flowLogAction(ruleCopy.Action, ruleCopy.RuleId, flowLog); nflog != nil {
+		// Log the packet for the flow log collector before we act on it.
+		actions = append([]iptables.Action{nflog}, actions...)
+	}
+	rs = matchBlockBuilder.Rules
+	// Whether it sets a mark bit or does the first action, the next rule applies the full
+	// match criteria.
+	hitIdx = len(rs)
 	if markBit != 0 {
 		// The rule needs to do more than one action. Render a rule that
 		// executes the match criteria and sets the given mark bit if it
@@ -263,7 +331,7 @@ func (r *DefaultRuleRenderer) ProtoRuleToIptablesRules(pRule *proto.Rule, ipVers
 		})
 	}
 
-	return rs
+	return rs, hitIdx
 }
 
 type matchBlockBuilder struct {
@@ -480,6 +548,49 @@ func SplitPortList(ports []*proto.PortRange) (splits [][]*proto.PortRange) {
 	return
 }
 
+// skipForHTTPMatch returns true if the rule has HTTP match criteria and rendering only its
+// L3/L4 criteria would allow more traffic than the rule intends.  iptables can't match on HTTP
+// so we have two options:
+//
+//   - If HTTP matches are enforced by an agent alongside each workload (which receives the
+//     complete rules over the policy sync API), we render allow, pass and log rules without the
+//     HTTP match so that the traffic reaches the agent.  Deny rules are left to the agent since
+//     rendering them without the HTTP match would block the traffic that the agent should allow.
+//
+//   - Otherwise, we fail closed: allow and pass rules are skipped since they would allow (or
+//     bypass the tier for) every request, and deny and log rules are rendered without the HTTP
+//     match.
+//
+// policysim models the same choice so keep it in step.
+func (r *DefaultRuleRenderer) skipForHTTPMatch(pRule *proto.Rule) bool {
+	if !hasHTTPMatch(pRule) {
+		return false
+	}
+	logCxt := log.WithFields(log.Fields{
+		"ruleID":    pRule.RuleId,
+		"action":    pRule.Action,
+		"httpMatch": pRule.HttpMatch,
+	})
+	switch pRule.Action {
+	case "deny":
+		if r.HTTPMatchEnforcedExternally {
+			logCxt.Debug("Skipping deny rule with HTTP match, it will be enforced by the workload's agent")
+			return true
+		}
+	case "log":
+	default:
+		if !r.HTTPMatchEnforcedExternally {
+			logCxt.Warn("Skipping rule with HTTP match, which can't be enforced by iptables")
+			return true
+		}
+	}
+	return false
+}
+
+func hasHTTPMatch(pRule *proto.Rule) bool {
+	return pRule.HttpMatch != nil && len(pRule.HttpMatch.Methods) > 0
+}
+
 func (r *DefaultRuleRenderer) CalculateActions(pRule *proto.Rule, ipVersion uint8) (mark uint32, actions []iptables.Action) {
 	actions = []iptables.Action{}
 
@@ -1023,3 +1023,127 @@ var _ = DescribeTable("Port split tests",
 		{First: 215, Last: 216},
 	}}),
 )
+
+var _ = Describe("Policy rule hit indexes", func() {
+	var renderer RuleRenderer
+	policyID := &proto.PolicyID{Tier: "default", Name: "pol1"}
+	policy := &proto.Policy{
+		InboundRules: []*proto.Rule{
+			{Action: "allow"},
+			{Action: "deny", SrcNet: []string{"10.0.0.0/8", "11.0.0.0/8"}},
+			{Action: "allow", IpVersion: proto.IPVersion_IPV6},
+			{Action: "log"},
+		},
+	}
+
+	BeforeEach(func() {
+		renderer = NewRenderer(Config{
+			IPSetConfigV4:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+			IPSetConfigV6:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+			IptablesMarkAccept:   0x80,
+			IptablesMarkPass:     0x100,
+			IptablesMarkScratch0: 0x200,
+			IptablesMarkScratch1: 0x400,
+			IptablesMarkEndpoint: 0xff000,
+			IptablesLogPrefix:    "calico-packet",
+		})
+	})
+
+	It("should return the index of the rule that applies the full match", func() {
+		chains, inbound, outbound := renderer.PolicyToIptablesChainsWithHitIndexes(policyID, policy, 4)
+		Expect(inbound).To(Equal([]int{0, 5, -1, 6}))
+		Expect(outbound).To(BeEmpty())
+		Expect(chains).To(Equal(renderer.PolicyToIptablesChains(policyID, policy, 4)))
+		Expect(chains[0].Rules[0].Action).To(Equal(iptables.SetMarkAction{Mark: 0x80}))
+		Expect(chains[0].Rules[5]).To(Equal(iptables.Rule{
+			Match:  iptables.Match().MarkSingleBitSet(0x200),
+			Action: iptables.DropAction{},
+		}))
+		Expect(chains[0].Rules[6].Action).To(Equal(iptables.LogAction{Prefix: "calico-packet"}))
+	})
+
+	It("should skip rules for the other IP version", func() {
+		_, inbound, _ := renderer.PolicyToIptablesChainsWithHitIndexes(policyID, policy, 6)
+		Expect(inbound).To(Equal([]int{0, -1, 2, 4}))
+	})
+
+	It("should return the hit indexes of profile rules", func() {
+		profile := &proto.Profile{OutboundRules: policy.InboundRules}
+		profileID := &proto.ProfileID{Name: "prof1"}
+		chains, inbound, outbound := renderer.ProfileToIptablesChainsWithHitIndexes(profileID, profile, 4)
+		Expect(inbound).To(BeEmpty())
+		Expect(outbound).To(Equal([]int{0, 5, -1, 6}))
+		Expect(chains).To(Equal(renderer.ProfileToIptablesChains(profileID, profile, 4)))
+	})
+})
+
+var _ = Describe("Rules with HTTP matches", func() {
+	httpMatch := &proto.HTTPMatch{Methods: []string{"GET"}}
+	config := Config{
+		IPSetConfigV4:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+		IPSetConfigV6:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+		IptablesMarkAccept:   0x80,
+		IptablesMarkPass:     0x100,
+		IptablesMarkScratch0: 0x200,
+		IptablesMarkScratch1: 0x400,
+		IptablesMarkEndpoint: 0xff000,
+		IptablesLogPrefix:    "calico-packet",
+	}
+
+	renderAction := func(config Config, action string) []iptables.Rule {
+		renderer := NewRenderer(config)
+		return renderer.ProtoRuleToIptablesRules(&proto.Rule{
+			Action:    action,
+			DstPorts:  []*proto.PortRange{{First: 8080, Last: 8080}},
+			HttpMatch: httpMatch,
+		}, 4)
+	}
+
+	It("should render rules with an empty HTTP match as normal", func() {
+		renderer := NewRenderer(config)
+		Expect(renderer.ProtoRuleToIptablesRules(&proto.Rule{
+			Action:    "allow",
+			HttpMatch: &proto.HTTPMatch{},
+		}, 4)).To(HaveLen(2))
+	})
+
+	Describe("without an external enforcer", func() {
+		It("should skip allow rules", func() {
+			Expect(renderAction(config, "allow")).To(BeEmpty())
+		})
+		It("should skip pass rules", func() {
+			Expect(renderAction(config, "pass")).To(BeEmpty())
+		})
+		It("should render deny rules without the HTTP match", func() {
+			rules := renderAction(config, "deny")
+			Expect(rules).To(HaveLen(1))
+			Expect(rules[0].Action).To(Equal(iptables.DropAction{}))
+		})
+		It("should report skipped rules in the hit indexes", func() {
+			policy := &proto.Policy{InboundRules: []*proto.Rule{
+				{Action: "allow", HttpMatch: httpMatch},
+				{Action: "allow"},
+			}}
+			_, inbound, _ := NewRenderer(config).PolicyToIptablesChainsWithHitIndexes(&proto.PolicyID{Name: "pol1"}, policy, 4)
+			Expect(inbound).To(Equal([]int{-1, 0}))
+		})
+	})
+
+	Describe("with an external enforcer", func() {
+		var externalConfig Config
+
+		BeforeEach(func() {
+			externalConfig = config
+			externalConfig.HTTPMatchEnforcedExternally = true
+		})
+
+		It("should render allow rules without the HTTP match", func() {
+			rules := renderAction(externalConfig, "allow")
+			Expect(rules).To(HaveLen(2))
+			Expect(rules[0].Action).To(Equal(iptables.SetMarkAction{Mark: 0x80}))
+		})
+		It("should skip deny rules", func() {
+			Expect(renderAction(externalConfig, "deny")).To(BeEmpty())
+		})
+	})
+})
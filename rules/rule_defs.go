@@ -60,6 +60,15 @@ const (
 	IPSetIDAllHostIPs  = "all-hosts"
 	IPSetIDThisHostIPs = "this-host"
 
+	// IPIPIfaceNameV4 and IPIPIfaceNameV6 are the tunnel devices used for IPIP.  Both are
+	// created automatically by the kernel when the tunnel module is loaded.
+	IPIPIfaceNameV4 = "tunl0"
+	IPIPIfaceNameV6 = "ip6tnl0"
+
+	// VXLANIfaceName is the VXLAN device that Felix creates and maintains when VXLAN is
+	// enabled.
+	VXLANIfaceName = "vxlan.calico"
+
 	ChainFIPDnat = ChainNamePrefix + "fip-dnat"
 	ChainFIPSnat = ChainNamePrefix + "fip-snat"
 
@@ -183,13 +192,19 @@ type RuleRenderer interface {
 	) []*iptables.Chain
 
 	PolicyToIptablesChains(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) []*iptables.Chain
+	PolicyToIptablesChainsWithHitIndexes(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) (chains []*iptables.Chain, inbound, outbound []int)
 	ProfileToIptablesChains(profileID *proto.ProfileID, policy *proto.Profile, ipVersion uint8) []*iptables.Chain
+	ProfileToIptablesChainsWithHitIndexes(profileID *proto.ProfileID, profile *proto.Profile, ipVersion uint8) (chains []*iptables.Chain, inbound, outbound []int)
 	ProtoRuleToIptablesRules(pRule *proto.Rule, ipVersion uint8) []iptables.Rule
 
 	NATOutgoingChain(active bool, ipVersion uint8) *iptables.Chain
 
 	DNATsToIptablesChains(dnats map[string]string) []*iptables.Chain
 	SNATsToIptablesChains(snats map[string]string) []*iptables.Chain
+
+	// UpdateConfig replaces the renderer's config.  It's used to apply live-reloadable
+	// config changes; chains that were rendered with the old config need to be re-rendered.
+	UpdateConfig(config Config)
 }
 
 type DefaultRuleRenderer struct {
@@ -199,6 +214,38 @@ type DefaultRuleRenderer struct {
 	mangleAllowAction  iptables.Action
 }
 
+// ipipEnabled returns true if the IPIP tunnel is enabled for the given IP version.
+func (r *DefaultRuleRenderer) ipipEnabled(ipVersion uint8) bool {
+	if ipVersion == 6 {
+		return r.IPIPEnabledV6
+	}
+	return r.IPIPEnabled
+}
+
+func (r *DefaultRuleRenderer) ipipTunnelAddress(ipVersion uint8) net.IP {
+	if ipVersion == 6 {
+		return r.IPIPTunnelAddressV6
+	}
+	return r.IPIPTunnelAddress
+}
+
+// IPIPIfaceName returns the name of the IPIP tunnel device for the given IP version.
+func IPIPIfaceName(ipVersion uint8) string {
+	if ipVersion == 6 {
+		return IPIPIfaceNameV6
+	}
+	return IPIPIfaceNameV4
+}
+
+// ipipProtocol returns the protocol number of the encapsulated packets for the given IP
+// version's tunnel: IPv4-in-IPv4 or IPv6-in-IPv6.
+func ipipProtocol(ipVersion uint8) uint8 {
+	if ipVersion == 6 {
+		return ProtoIPv6Encap
+	}
+	return ProtoIPIP
+}
+
 func (r *DefaultRuleRenderer) ipSetConfig(ipVersion uint8) *ipsets.IPVersionConfig {
 	if ipVersion == 4 {
 		return r.IPSetConfigV4
@@ -236,6 +283,16 @@ type Config struct {
 	// IPIPTunnelAddress is an address chosen from an IPAM pool, used as a source address
 	// by the host when sending traffic to a workload over IPIP.
 	IPIPTunnelAddress net.IP
+	// IPIPEnabledV6 and IPIPTunnelAddressV6 are the equivalents for the IPv6-in-IPv6
+	// tunnel, which carries IPv6 workload traffic.
+	IPIPEnabledV6       bool
+	IPIPTunnelAddressV6 net.IP
+
+	// VXLANEnabled turns on the rules for the IPv4 VXLAN overlay.  VXLANTunnelAddress plays the
+	// same role as IPIPTunnelAddress.
+	VXLANEnabled       bool
+	VXLANPort          int
+	VXLANTunnelAddress net.IP
 
 	IptablesLogPrefix         string
 	EndpointToHostAction      string
@@ -246,6 +303,16 @@ type Config struct {
 	FailsafeOutboundHostPorts []config.ProtoPort
 
 	DisableConntrackInvalid bool
+
+	// HTTPMatchEnforcedExternally is set if rules' HTTP match criteria are enforced by an agent
+	// that runs alongside each workload and receives its policy over the policy sync API.  It
+	// controls how rules with HTTP matches are rendered since iptables can't enforce them.
+	HTTPMatchEnforcedExternally bool
+
+	// FlowLogsEnabled causes the renderer to add NFLOG actions, for the flow log collector,
+	// to rules that allow or deny traffic.
+	FlowLogsEnabled    bool
+	FlowLogsNflogGroup uint16
 }
 
 func (c *Config) validate() {
@@ -279,6 +346,12 @@ func (c *Config) validate() {
 
 func NewRenderer(config Config) RuleRenderer {
 	log.WithField("config", config).Info("Creating rule renderer.")
+	r := &DefaultRuleRenderer{}
+	r.UpdateConfig(config)
+	return r
+}
+
+func (r *DefaultRuleRenderer) UpdateConfig(config Config) {
 	config.validate()
 	// Convert configured actions to rule slices.
 	// First, what should we do with packets that come from workloads to the host itself.
@@ -314,10 +387,8 @@ func NewRenderer(config Config) RuleRenderer {
 		mangleAllowAction = iptables.AcceptAction{}
 	}
 
-	return &DefaultRuleRenderer{
-		Config:             config,
-		inputAcceptActions: inputAcceptActions,
-		filterAllowAction:  filterAllowAction,
-		mangleAllowAction:  mangleAllowAction,
-	}
+	r.Config = config
+	r.inputAcceptActions = inputAcceptActions
+	r.filterAllowAction = filterAllowAction
+	r.mangleAllowAction = mangleAllowAction
 }
@@ -29,10 +29,11 @@ func (r *DefaultRuleRenderer) StaticFilterTableChains(ipVersion uint8) (chains [
 }
 
 const (
-	ProtoIPIP   = 4
-	ProtoTCP    = 6
-	ProtoUDP    = 17
-	ProtoICMPv6 = 58
+	ProtoIPIP      = 4
+	ProtoTCP       = 6
+	ProtoUDP       = 17
+	ProtoIPv6Encap = 41
+	ProtoICMPv6    = 58
 )
 
 func (r *DefaultRuleRenderer) StaticFilterInputChains(ipVersion uint8) []*Chain {
@@ -207,26 +208,42 @@ func (r *DefaultRuleRenderer) filterInputChain(ipVersion uint8) *Chain {
 	// Accept immediately if we've already accepted this packet in the raw or mangle table.
 	inputRules = append(inputRules, r.acceptAlreadyAccepted()...)
 
-	if ipVersion == 4 && r.IPIPEnabled {
+	if r.ipipEnabled(ipVersion) {
 		// IPIP is enabled, filter incoming IPIP packets to ensure they come from a
 		// recognised host and are going to a local address on the host.  We use the protocol
 		// number rather than its name because the name is not guaranteed to be known by the kernel.
 		inputRules = append(inputRules,
 			Rule{
-				Match: Match().ProtocolNum(ProtoIPIP).
-					SourceIPSet(r.IPSetConfigV4.NameForMainIPSet(IPSetIDAllHostIPs)).
+				Match: Match().ProtocolNum(ipipProtocol(ipVersion)).
+					SourceIPSet(r.ipSetConfig(ipVersion).NameForMainIPSet(IPSetIDAllHostIPs)).
 					DestAddrType(AddrTypeLocal),
 				Action:  r.filterAllowAction,
 				Comment: "Allow IPIP packets from Calico hosts",
 			},
 			Rule{
-				Match:   Match().ProtocolNum(ProtoIPIP),
+				Match:   Match().ProtocolNum(ipipProtocol(ipVersion)),
 				Action:  DropAction{},
 				Comment: "Drop IPIP packets from non-Calico hosts",
 			},
 		)
 	}
 
+	if ipVersion == 4 && r.VXLANEnabled {
+		// VXLAN is enabled, allow VXLAN packets from recognised hosts so that host endpoint
+		// policy can't break the overlay.  Packets from other sources are dropped in the raw
+		// table.
+		inputRules = append(inputRules,
+			Rule{
+				Match: Match().ProtocolNum(ProtoUDP).
+					DestPorts(uint16(r.VXLANPort)).
+					SourceIPSet(r.IPSetConfigV4.NameForMainIPSet(IPSetIDAllHostIPs)).
+					DestAddrType(AddrTypeLocal),
+				Action:  r.filterAllowAction,
+				Comment: "Allow VXLAN packets from Calico hosts",
+			},
+		)
+	}
+
 	if r.KubeIPVSSupportEnabled {
 		// Check if packet belongs to forwarded traffic. (e.g. part of an ipvs connection).
 		// If it is, set endpoint mark and skip "to local host" rules below.
@@ -560,14 +577,14 @@ func (r *DefaultRuleRenderer) filterOutputChain(ipVersion uint8) *Chain {
 	// If we reach here, the packet is not going to a workload so it must be going to a
 	// host endpoint. It also has no endpoint mark so it must be going from a process.
 
-	if ipVersion == 4 && r.IPIPEnabled {
+	if r.ipipEnabled(ipVersion) {
 		// When IPIP is enabled, auto-allow IPIP traffic to other Calico nodes.  Without this,
 		// it's too easy to make a host policy that blocks IPIP traffic, resulting in very confusing
 		// connectivity problems.
 		rules = append(rules,
 			Rule{
-				Match: Match().ProtocolNum(ProtoIPIP).
-					DestIPSet(r.IPSetConfigV4.NameForMainIPSet(IPSetIDAllHostIPs)).
+				Match: Match().ProtocolNum(ipipProtocol(ipVersion)).
+					DestIPSet(r.ipSetConfig(ipVersion).NameForMainIPSet(IPSetIDAllHostIPs)).
 					SrcAddrType(AddrTypeLocal, false),
 				Action:  r.filterAllowAction,
 				Comment: "Allow IPIP packets to other Calico hosts",
@@ -575,6 +592,20 @@ func (r *DefaultRuleRenderer) filterOutputChain(ipVersion uint8) *Chain {
 		)
 	}
 
+	if ipVersion == 4 && r.VXLANEnabled {
+		// Similarly, auto-allow VXLAN traffic to other Calico nodes.
+		rules = append(rules,
+			Rule{
+				Match: Match().ProtocolNum(ProtoUDP).
+					DestPorts(uint16(r.VXLANPort)).
+					DestIPSet(r.IPSetConfigV4.NameForMainIPSet(IPSetIDAllHostIPs)).
+					SrcAddrType(AddrTypeLocal, false),
+				Action:  r.filterAllowAction,
+				Comment: "Allow VXLAN packets to other Calico hosts",
+			},
+		)
+	}
+
 	// Apply host endpoint policy.
 	rules = append(rules,
 		Rule{
@@ -638,7 +669,7 @@ func (r *DefaultRuleRenderer) StaticNATPostroutingChains(ipVersion uint8) []*Cha
 			Action: JumpAction{Target: ChainNATOutgoing},
 		},
 	}
-	if ipVersion == 4 && r.IPIPEnabled && len(r.IPIPTunnelAddress) > 0 {
+	if r.ipipEnabled(ipVersion) && len(r.ipipTunnelAddress(ipVersion)) > 0 {
 		// Add a rule to catch packets that are being sent down the IPIP tunnel from an
 		// incorrect local IP address of the host and NAT them to use the tunnel IP as its
 		// source.  This happens if:
@@ -657,7 +688,7 @@ func (r *DefaultRuleRenderer) StaticNATPostroutingChains(ipVersion uint8) []*Cha
 		rules = append(rules, Rule{
 			Match: Match().
 				// Only match packets going out the tunnel.
-				OutInterface("tunl0").
+				OutInterface(IPIPIfaceName(ipVersion)).
 				// Match packets that don't have the correct source address.  This
 				// matches local addresses (i.e. ones assigned to this host)
 				// limiting the match to the output interface (which we matched
@@ -671,6 +702,16 @@ func (r *DefaultRuleRenderer) StaticNATPostroutingChains(ipVersion uint8) []*Cha
 			Action: MasqAction{},
 		})
 	}
+	if ipVersion == 4 && r.VXLANEnabled && len(r.VXLANTunnelAddress) > 0 {
+		// As above, but for packets that are sent down the VXLAN device.
+		rules = append(rules, Rule{
+			Match: Match().
+				OutInterface(VXLANIfaceName).
+				NotSrcAddrType(AddrTypeLocal, true).
+				SrcAddrType(AddrTypeLocal, false),
+			Action: MasqAction{},
+		})
+	}
 	return []*Chain{{
 		Name:  ChainNATPostrouting,
 		Rules: rules,
@@ -798,6 +839,29 @@ func (r *DefaultRuleRenderer) StaticRawPreroutingChain(ipVersion uint8) *Chain {
 			Match:  Match().MarkSingleBitSet(markFromWorkload).RPFCheckFailed(),
 			Action: DropAction{},
 		})
+		if r.IPIPEnabledV6 {
+			// Similarly, there's no sysctl to enforce RPF on packets that are decapsulated
+			// by the IPv6 tunnel so check that they came from a source that we route down
+			// the tunnel.
+			rules = append(rules, Rule{
+				Match:  Match().InInterface(IPIPIfaceNameV6).RPFCheckFailed(),
+				Action: DropAction{},
+			})
+		}
+	}
+
+	if ipVersion == 4 && r.VXLANEnabled {
+		// Drop VXLAN packets that are addressed to this host but didn't come from another
+		// Calico host; otherwise anyone who can reach the VXLAN port could inject packets
+		// into the overlay.
+		rules = append(rules, Rule{
+			Match: Match().ProtocolNum(ProtoUDP).
+				DestPorts(uint16(r.VXLANPort)).
+				NotSourceIPSet(r.IPSetConfigV4.NameForMainIPSet(IPSetIDAllHostIPs)).
+				DestAddrType(AddrTypeLocal),
+			Action:  DropAction{},
+			Comment: "Drop VXLAN packets from non-Calico hosts",
+		})
 	}
 
 	rules = append(rules,
@@ -767,6 +767,191 @@ var _ = Describe("Static", func() {
 				}))
 			})
 		})
+
+		Describe("with IPv6 IPIP enabled", func() {
+			BeforeEach(func() {
+				conf = Config{
+					WorkloadIfacePrefixes:       []string{"cali"},
+					IPIPEnabledV6:               true,
+					IPIPTunnelAddressV6:         net.ParseIP("fd00::1"),
+					IPSetConfigV4:               ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+					IPSetConfigV6:               ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+					IptablesMarkAccept:          0x10,
+					IptablesMarkPass:            0x20,
+					IptablesMarkScratch0:        0x40,
+					IptablesMarkScratch1:        0x80,
+					IptablesMarkEndpoint:        0xff00,
+					IptablesMarkNonCaliEndpoint: 0x100,
+					KubeIPVSSupportEnabled:      kubeIPVSEnabled,
+				}
+			})
+
+			It("IPv6: should filter incoming IPv6-in-IPv6 packets", func() {
+				inputChain := findChain(rr.StaticFilterTableChains(6), "cali-INPUT")
+				Expect(inputChain.Rules[1:3]).To(Equal([]Rule{
+					{Match: Match().
+						ProtocolNum(41).
+						SourceIPSet("cali60all-hosts").
+						DestAddrType("LOCAL"),
+						Action:  AcceptAction{},
+						Comment: "Allow IPIP packets from Calico hosts"},
+					{Match: Match().ProtocolNum(41),
+						Action:  DropAction{},
+						Comment: "Drop IPIP packets from non-Calico hosts"},
+				}))
+			})
+			It("IPv6: should allow outgoing IPv6-in-IPv6 packets to Calico hosts", func() {
+				outputChain := findChain(rr.StaticFilterTableChains(6), "cali-OUTPUT")
+				Expect(outputChain.Rules).To(ContainElement(Rule{
+					Match: Match().ProtocolNum(41).
+						DestIPSet("cali60all-hosts").
+						SrcAddrType(AddrTypeLocal, false),
+					Action:  AcceptAction{},
+					Comment: "Allow IPIP packets to other Calico hosts",
+				}))
+			})
+			It("IPv4: should not include any IPIP rules", func() {
+				inputChain := findChain(rr.StaticFilterTableChains(4), "cali-INPUT")
+				for _, rule := range inputChain.Rules {
+					Expect(rule.Comment).NotTo(ContainSubstring("IPIP"))
+				}
+			})
+			It("IPv6: Should return expected NAT postrouting chain", func() {
+				Expect(rr.StaticNATPostroutingChains(6)).To(Equal([]*Chain{
+					{
+						Name: "cali-POSTROUTING",
+						Rules: []Rule{
+							{Action: JumpAction{Target: "cali-fip-snat"}},
+							{Action: JumpAction{Target: "cali-nat-outgoing"}},
+							{
+								Match: Match().
+									OutInterface("ip6tnl0").
+									NotSrcAddrType(AddrTypeLocal, true).
+									SrcAddrType(AddrTypeLocal, false),
+								Action: MasqAction{},
+							},
+						},
+					},
+				}))
+			})
+			It("IPv4: Should return expected NAT postrouting chain", func() {
+				Expect(rr.StaticNATPostroutingChains(4)).To(Equal([]*Chain{
+					{
+						Name: "cali-POSTROUTING",
+						Rules: []Rule{
+							{Action: JumpAction{Target: "cali-fip-snat"}},
+							{Action: JumpAction{Target: "cali-nat-outgoing"}},
+						},
+					},
+				}))
+			})
+			It("IPv6: Should return expected raw PREROUTING chain", func() {
+				Expect(findChain(rr.StaticRawTableChains(6), "cali-PREROUTING")).To(Equal(&Chain{
+					Name: "cali-PREROUTING",
+					Rules: []Rule{
+						{Action: ClearMarkAction{Mark: 0xf0}},
+						{Match: Match().InInterface("cali+"),
+							Action: SetMarkAction{Mark: 0x40}},
+						{Match: Match().MarkSingleBitSet(0x40).RPFCheckFailed(),
+							Action: DropAction{}},
+						{Match: Match().InInterface("ip6tnl0").RPFCheckFailed(),
+							Action: DropAction{}},
+						{Match: Match().MarkClear(0x40),
+							Action: JumpAction{Target: ChainDispatchFromHostEndpoint}},
+						{Match: Match().MarkSingleBitSet(0x10),
+							Action: AcceptAction{}},
+					},
+				}))
+			})
+		})
+
+		Describe("with VXLAN enabled", func() {
+			BeforeEach(func() {
+				conf = Config{
+					WorkloadIfacePrefixes:       []string{"cali"},
+					VXLANEnabled:                true,
+					VXLANPort:                   4789,
+					VXLANTunnelAddress:          net.ParseIP("10.0.0.1"),
+					IPSetConfigV4:               ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+					IPSetConfigV6:               ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+					IptablesMarkAccept:          0x10,
+					IptablesMarkPass:            0x20,
+					IptablesMarkScratch0:        0x40,
+					IptablesMarkScratch1:        0x80,
+					IptablesMarkEndpoint:        0xff00,
+					IptablesMarkNonCaliEndpoint: 0x100,
+					KubeIPVSSupportEnabled:      kubeIPVSEnabled,
+				}
+			})
+
+			It("IPv4: should allow incoming VXLAN packets from Calico hosts", func() {
+				inputChain := findChain(rr.StaticFilterTableChains(4), "cali-INPUT")
+				Expect(inputChain.Rules[1]).To(Equal(Rule{
+					Match: Match().ProtocolNum(17).
+						DestPorts(4789).
+						SourceIPSet("cali40all-hosts").
+						DestAddrType("LOCAL"),
+					Action:  AcceptAction{},
+					Comment: "Allow VXLAN packets from Calico hosts",
+				}))
+			})
+			It("IPv4: should allow outgoing VXLAN packets to Calico hosts", func() {
+				outputChain := findChain(rr.StaticFilterTableChains(4), "cali-OUTPUT")
+				Expect(outputChain.Rules).To(ContainElement(Rule{
+					Match: Match().ProtocolNum(17).
+						DestPorts(4789).
+						DestIPSet("cali40all-hosts").
+						SrcAddrType(AddrTypeLocal, false),
+					Action:  AcceptAction{},
+					Comment: "Allow VXLAN packets to other Calico hosts",
+				}))
+			})
+			It("IPv6: should not include any VXLAN rules", func() {
+				for _, chain := range rr.StaticFilterTableChains(6) {
+					for _, rule := range chain.Rules {
+						Expect(rule.Comment).NotTo(ContainSubstring("VXLAN"))
+					}
+				}
+			})
+			It("IPv4: Should return expected NAT postrouting chain", func() {
+				Expect(rr.StaticNATPostroutingChains(4)).To(Equal([]*Chain{
+					{
+						Name: "cali-POSTROUTING",
+						Rules: []Rule{
+							{Action: JumpAction{Target: "cali-fip-snat"}},
+							{Action: JumpAction{Target: "cali-nat-outgoing"}},
+							{
+								Match: Match().
+									OutInterface("vxlan.calico").
+									NotSrcAddrType(AddrTypeLocal, true).
+									SrcAddrType(AddrTypeLocal, false),
+								Action: MasqAction{},
+							},
+						},
+					},
+				}))
+			})
+			It("IPv4: Should return expected raw PREROUTING chain", func() {
+				Expect(findChain(rr.StaticRawTableChains(4), "cali-PREROUTING")).To(Equal(&Chain{
+					Name: "cali-PREROUTING",
+					Rules: []Rule{
+						{Action: ClearMarkAction{Mark: 0xf0}},
+						{Match: Match().InInterface("cali+"),
+							Action: SetMarkAction{Mark: 0x40}},
+						{Match: Match().ProtocolNum(17).
+							DestPorts(4789).
+							NotSourceIPSet("cali40all-hosts").
+							DestAddrType("LOCAL"),
+							Action:  DropAction{},
+							Comment: "Drop VXLAN packets from non-Calico hosts"},
+						{Match: Match().MarkClear(0x40),
+							Action: JumpAction{Target: ChainDispatchFromHostEndpoint}},
+						{Match: Match().MarkSingleBitSet(0x10),
+							Action: AcceptAction{}},
+					},
+				}))
+			})
+		})
 	}
 
 	Describe("with multiple KubePortRanges", func() {
@@ -1129,6 +1314,53 @@ var _ = Describe("Static", func() {
 			})
 		}
 	})
+
+	Describe("after a config update", func() {
+		BeforeEach(func() {
+			conf = Config{
+				WorkloadIfacePrefixes: []string{"cali"},
+				IPSetConfigV4:         ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+				IPSetConfigV6:         ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+				FailsafeInboundHostPorts: []config.ProtoPort{
+					{Protocol: "tcp", Port: 22},
+				},
+				EndpointToHostAction:        "DROP",
+				IptablesMarkAccept:          0x10,
+				IptablesMarkPass:            0x20,
+				IptablesMarkScratch0:        0x40,
+				IptablesMarkScratch1:        0x80,
+				IptablesMarkEndpoint:        0xff00,
+				IptablesMarkNonCaliEndpoint: 0x100,
+			}
+		})
+		JustBeforeEach(func() {
+			newConf := conf
+			newConf.EndpointToHostAction = "ACCEPT"
+			newConf.FailsafeInboundHostPorts = []config.ProtoPort{
+				{Protocol: "tcp", Port: 1022},
+			}
+			rr.UpdateConfig(newConf)
+		})
+
+		It("should render the new DefaultEndpointToHostAction", func() {
+			Expect(findChain(rr.StaticFilterTableChains(4), "cali-wl-to-host")).To(Equal(&Chain{
+				Name: "cali-wl-to-host",
+				Rules: []Rule{
+					{Action: JumpAction{Target: "cali-from-wl-dispatch"}},
+					{Action: AcceptAction{},
+						Comment: "Configured DefaultEndpointToHostAction"},
+				},
+			}))
+		})
+		It("should render the new failsafe ports", func() {
+			Expect(findChain(rr.StaticFilterTableChains(4), "cali-failsafe-in")).To(Equal(&Chain{
+				Name: "cali-failsafe-in",
+				Rules: []Rule{
+					{Match: Match().Protocol("tcp").DestPorts(1022), Action: AcceptAction{}},
+				},
+			}))
+		})
+	})
 })
 
 func findChain(chains []*Chain, name string) *Chain {
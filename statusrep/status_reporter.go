@@ -34,14 +34,17 @@ type EndpointStatusReporter struct {
 	stop               chan bool
 	datastore          datastore
 	epStatusIDToStatus map[model.Key]string
-	queuedDirtyIDs     set.Set
-	activeDirtyIDs     set.Set
-	reportingDelay     time.Duration
-	resyncInterval     time.Duration
-	resyncTicker       stoppable
-	resyncTickerC      <-chan time.Time
-	rateLimitTicker    stoppable
-	rateLimitTickerC   <-chan time.Time
+	// policySyncErrors maps the status IDs of workload endpoints whose policy sync client
+	// reported an error to that error.
+	policySyncErrors map[model.Key]string
+	queuedDirtyIDs   set.Set
+	activeDirtyIDs   set.Set
+	reportingDelay   time.Duration
+	resyncInterval   time.Duration
+	resyncTicker     stoppable
+	resyncTickerC    <-chan time.Time
+	rateLimitTicker  stoppable
+	rateLimitTickerC <-chan time.Time
 }
 
 func NewEndpointStatusReporter(hostname string,
@@ -87,6 +90,7 @@ func newEndpointStatusReporterWithTickerChans(hostname string,
 		inSync:             inSync,
 		stop:               make(chan bool),
 		epStatusIDToStatus: make(map[model.Key]string),
+		policySyncErrors:   make(map[model.Key]string),
 		queuedDirtyIDs:     set.New(),
 		activeDirtyIDs:     set.New(),
 		resyncTicker:       resyncTicker,
@@ -148,6 +152,8 @@ loop:
 		case msg := <-esr.endpointUpdates:
 			var statID model.Key
 			var status string
+			isPolicySyncStatus := false
+			var policySyncErr string
 			switch msg := msg.(type) {
 			case *proto.WorkloadEndpointStatusUpdate:
 				statID = model.WorkloadEndpointStatusKey{
@@ -164,6 +170,15 @@ loop:
 					WorkloadID:     msg.Id.WorkloadId,
 					EndpointID:     msg.Id.EndpointId,
 				}
+			case *proto.PolicySyncStatusUpdate:
+				statID = model.WorkloadEndpointStatusKey{
+					Hostname:       esr.hostname,
+					OrchestratorID: msg.Id.OrchestratorId,
+					WorkloadID:     msg.Id.WorkloadId,
+					EndpointID:     msg.Id.EndpointId,
+				}
+				isPolicySyncStatus = true
+				policySyncErr = msg.Error
 			case *proto.HostEndpointStatusUpdate:
 				statID = model.HostEndpointStatusKey{
 					Hostname:   esr.hostname,
@@ -178,12 +193,23 @@ loop:
 			default:
 				log.Panicf("Unexpected message: %#v", msg)
 			}
-			if esr.epStatusIDToStatus[statID] != status {
-				if status != "" {
-					esr.epStatusIDToStatus[statID] = status
+			oldStatus := esr.desiredStatus(statID)
+			if isPolicySyncStatus {
+				if policySyncErr != "" {
+					log.WithFields(log.Fields{
+						"statID": statID,
+						"error":  policySyncErr,
+					}).Warn("Policy sync client reported an error")
+					esr.policySyncErrors[statID] = policySyncErr
 				} else {
-					delete(esr.epStatusIDToStatus, statID)
+					delete(esr.policySyncErrors, statID)
 				}
+			} else if status != "" {
+				esr.epStatusIDToStatus[statID] = status
+			} else {
+				delete(esr.epStatusIDToStatus, statID)
+			}
+			if esr.desiredStatus(statID) != oldStatus {
 				if !esr.activeDirtyIDs.Contains(statID) &&
 					!esr.queuedDirtyIDs.Contains(statID) {
 					// Add the update into the queued set so that
@@ -220,7 +246,7 @@ loop:
 				// Note: the update could be a deletion, in which case
 				// the read from the cache wil return nil.
 				err := esr.writeEndpointStatus(ctx, statID,
-					esr.epStatusIDToStatus[statID])
+					esr.desiredStatus(statID))
 				if err != nil {
 					log.WithError(err).Warn(
 						"Failed to write endpoint status; is datastore up?")
@@ -266,11 +292,11 @@ func (esr *EndpointStatusReporter) attemptResync(ctx context.Context) {
 			esr.activeDirtyIDs.Add(kv.Key)
 		} else {
 			status := kv.Value.(*model.WorkloadEndpointStatus).Status
-			if status != esr.epStatusIDToStatus[kv.Key] {
+			if status != esr.desiredStatus(kv.Key) {
 				log.WithFields(log.Fields{
 					"key":            kv.Key,
 					"datastoreState": status,
-					"desiredState":   esr.epStatusIDToStatus[kv.Key],
+					"desiredState":   esr.desiredStatus(kv.Key),
 				}).Info("Found out-of-sync workload endpoint status")
 				esr.activeDirtyIDs.Add(kv.Key)
 			}
@@ -305,6 +331,17 @@ func (esr *EndpointStatusReporter) attemptResync(ctx context.Context) {
 	}
 }
 
+// desiredStatus returns the status that we want to write for the given endpoint: the status
+// that the dataplane reported, overridden to "error" if the endpoint's policy sync client
+// reported an error.  Returns "" if the endpoint's status should be deleted.
+func (esr *EndpointStatusReporter) desiredStatus(statID model.Key) string {
+	status := esr.epStatusIDToStatus[statID]
+	if status != "" && esr.policySyncErrors[statID] != "" {
+		return "error"
+	}
+	return status
+}
+
 func (esr *EndpointStatusReporter) writeEndpointStatus(ctx context.Context, epID model.Key, status string) (err error) {
 	kv := model.KVPair{Key: epID}
 	logCxt := log.WithFields(log.Fields{
@@ -89,6 +89,13 @@ var wlEPUpdateDown = proto.WorkloadEndpointStatusUpdate{
 	Id:     &protoWlID,
 	Status: &protoDown,
 }
+var policySyncErr = proto.PolicySyncStatusUpdate{
+	Id:    &protoWlID,
+	Error: "failed to apply policy",
+}
+var policySyncOK = proto.PolicySyncStatusUpdate{
+	Id: &protoWlID,
+}
 var updatedWlEPKey = model.WorkloadEndpointStatusKey{
 	Hostname:       hostname,
 	OrchestratorID: "orch",
@@ -211,6 +218,28 @@ var _ = Describe("Status", func() {
 				rateLimitTickerChan <- time.Now()
 				Eventually(datastore.snapshot).Should(BeEmpty())
 			})
+			It("should report an error for a workload EP whose policy sync client failed", func() {
+				epUpdates <- &wlEPUpdateUp
+				epUpdates <- &policySyncErr
+				rateLimitTickerChan <- time.Now()
+				rateLimitTickerChan <- time.Now()
+				Eventually(datastore.snapshot).Should(Equal(map[model.Key]interface{}{
+					updatedWlEPKey: model.WorkloadEndpointStatus{Status: "error"},
+				}))
+
+				epUpdates <- &policySyncOK
+				rateLimitTickerChan <- time.Now()
+				rateLimitTickerChan <- time.Now()
+				Eventually(datastore.snapshot).Should(Equal(map[model.Key]interface{}{
+					updatedWlEPKey: wlEPUp,
+				}))
+			})
+			It("should ignore policy sync errors for workload EPs that the dataplane hasn't reported", func() {
+				epUpdates <- &policySyncErr
+				rateLimitTickerChan <- time.Now()
+				rateLimitTickerChan <- time.Now()
+				Consistently(datastore.snapshot, "50ms").Should(BeEmpty())
+			})
 
 			Describe("with an error on the first 2 Apply() calls", func() {
 				BeforeEach(func() {